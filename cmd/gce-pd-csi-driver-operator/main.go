@@ -0,0 +1,63 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is the GCE PD CSI Driver operator entrypoint. The operator
+// renders a GCEPDDriverConfig resource into the ConfigMap that the driver
+// reads with --config-file.
+package main
+
+import (
+	"flag"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/driverconfig"
+)
+
+var (
+	kubeconfig    = flag.String("kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	configName    = flag.String("config-name", "default", "Name of the GCEPDDriverConfig resource to read.")
+	namespace     = flag.String("namespace", "gce-pd-csi-driver", "Namespace of the driver ConfigMap.")
+	configMapName = flag.String("configmap-name", "gce-pd-csi-driver-config", "Name of the driver ConfigMap to maintain.")
+	resyncPeriod  = flag.Duration("resync-period", 30*time.Second, "How often the GCEPDDriverConfig resource is read and the ConfigMap updated.")
+)
+
+func init() {
+	// klog verbosity guide for this package
+	// Use V(2) for one time config information and ConfigMap changes
+	// Use V(4) for general debug information logging
+	klog.InitFlags(flag.CommandLine)
+	flag.Set("logtostderr", "true")
+}
+
+func main() {
+	flag.Parse()
+
+	// An empty kubeconfig path falls back to the in-cluster config.
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		klog.Fatalf("Failed to build client config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create client: %v", err)
+	}
+
+	op := driverconfig.NewOperator(client, *configName, *namespace, *configMapName)
+	op.Run(*resyncPeriod, wait.NeverStop)
+}
@@ -18,13 +18,20 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
+	"strings"
 	"time"
 
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog"
+	"k8s.io/mount-utils"
 
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/driverconfig"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 	driver "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-pd-csi-driver"
@@ -33,14 +40,70 @@ import (
 )
 
 var (
-	cloudConfigFilePath  = flag.String("cloud-config", "", "Path to GCE cloud provider config")
-	endpoint             = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
-	runControllerService = flag.Bool("run-controller-service", true, "If set to false then the CSI driver does not activate its controller service (default: true)")
-	runNodeService       = flag.Bool("run-node-service", true, "If set to false then the CSI driver does not activate its node service (default: true)")
-	httpEndpoint         = flag.String("http-endpoint", "", "The TCP network address where the prometheus metrics endpoint will listen (example: `:8080`). The default is empty string, which means metrics endpoint is disabled.")
-	metricsPath          = flag.String("metrics-path", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
-	extraVolumeLabelsStr = flag.String("extra-labels", "", "Extra labels to attach to each PD created. It is a comma separated list of key value pairs like '<key1>=<value1>,<key2>=<value2>'. See https://cloud.google.com/compute/docs/labeling-resources for details")
-	version              string
+	cloudConfigFilePath    = flag.String("cloud-config", "", "Path to GCE cloud provider config")
+	endpoint               = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
+	runControllerService   = flag.Bool("run-controller-service", true, "If set to false then the CSI driver does not activate its controller service (default: true)")
+	runNodeService         = flag.Bool("run-node-service", true, "If set to false then the CSI driver does not activate its node service (default: true)")
+	httpEndpoint           = flag.String("http-endpoint", "", "The TCP network address where the prometheus metrics endpoint will listen (example: `:8080`). The default is empty string, which means metrics endpoint is disabled.")
+	metricsPath            = flag.String("metrics-path", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
+	enableNodeMetrics      = flag.Bool("enable-node-metrics", false, "If set along with --http-endpoint, the node service exports the durations of its stage, publish, unstage and unpublish calls and of formatting and checking filesystems. A node plugin that does not run the controller service only serves metrics, including the process and build info metrics, when this is set.")
+	debugPath              = flag.String("debug-path", "", "If set along with --http-endpoint, the HTTP path where the controller serves its zones cache, ongoing operations, disk cache state and volume operation history as JSON, such as `/debug/state`. The default is empty string, which means the debug endpoint is disabled.")
+	extraVolumeLabelsStr   = flag.String("extra-labels", "", "Extra labels to attach to each PD created. It is a comma separated list of key value pairs like '<key1>=<value1>,<key2>=<value2>'. See https://cloud.google.com/compute/docs/labeling-resources for details")
+	defaultDiskType        = flag.String("default-disk-type", "", "Disk type used when a StorageClass does not specify one. The default is empty string, which means pd-standard.")
+	defaultKMSKey          = flag.String("default-disk-encryption-kms-key", "", "KMS key used to encrypt disks when a StorageClass does not specify one.")
+	useMetadataDefaults    = flag.Bool("use-metadata-defaults", false, "If set to true the controller reads default disk type, labels and KMS key from instance or project metadata at startup. Values given by flags take precedence.")
+	disableSnapshots       = flag.Bool("disable-snapshots", false, "If set to true the controller does not advertise or serve snapshot capabilities. Use in projects where the driver is not permitted to manage snapshots.")
+	disableExpansion       = flag.Bool("disable-volume-expansion", false, "If set to true the driver does not advertise or serve volume expansion, so that the external-resizer and the kubelet leave volumes at their size. Use where disk sizes are managed outside Kubernetes.")
+	deviceDiscoveryTimeout = flag.Duration("device-discovery-timeout", 30*time.Second, "How long NodeStageVolume waits for an attached disk to appear on the node before returning an error. Zero disables retries.")
+	allowUnownedDelete     = flag.Bool("allow-unowned-delete", false, "If set to true DeleteVolume also deletes disks that were not created by this driver, such as manually created disks bound through static PVs.")
+	maxDetachPause         = flag.Duration("max-detach-pause", 0, "If non-zero, ControllerUnpublishVolume does not detach disks from a node whose pd-csi-pause-detach-until instance metadata holds an RFC 3339 time in the future, for at most this long after the controller first sees the pause on that node. Used to avoid detaching volumes during in-place node upgrades. The default of zero disables pausing.")
+	expansionPolicyStr     = flag.String("disk-type-expansion-policy", "", "Comma separated <type>:<max size>:<upgrade type> entries, such as pd-standard:2Ti:pd-balanced, that limit the size disks of a type may be expanded to. Larger expansions fail with FailedPrecondition naming the type to migrate the disk to, since GCE cannot change the type of a disk in place.")
+	configFile             = flag.String("config-file", "", "Path to a driver config file, usually a mounted ConfigMap maintained by the driver operator from a GCEPDDriverConfig resource. Values set in the file override the corresponding flags and are reloaded when the file changes.")
+	configReloadPeriod     = flag.Duration("config-reload-period", time.Minute, "How often the config file is checked for changes.")
+	computeEndpoint        = flag.String("compute-endpoint", "", "If set, the root URL of the compute API used by the controller instead of the public endpoint, such as https://compute.googleapis.com when restricted.googleapis.com is mapped to it in DNS inside a VPC Service Controls perimeter, or an emulator. Overrides compute-endpoint in the [global] section of the cloud config file.")
+	endpointRegion         = flag.String("endpoint-region", "", "If set, the region, such as us-central1, whose regional compute API endpoint the controller uses instead of the global endpoint, for data residency. Cannot be used with --compute-endpoint.")
+	impersonateSA          = flag.String("impersonate-service-account", "", "If set, the email of a service account the controller impersonates for compute API calls, using short-lived tokens generated with its own credentials, which need roles/iam.serviceAccountTokenCreator on the account.")
+	oauthTokenEndpoint     = flag.String("oauth-token-endpoint", "", "If set, the OAuth 2.0 token URL used with the service account key in GOOGLE_APPLICATION_CREDENTIALS instead of the one in the key, such as https://oauth2.googleapis.com/token.")
+	nodeName               = flag.String("node-name", "", "If set, the name of the instance the node plugin runs on, used instead of the one from the metadata server. Use with --node-zone and --node-project, or --node-identity-file, where the metadata server is absent or describes another machine, such as in nested virtualization or test rigs.")
+	nodeZone               = flag.String("node-zone", "", "If set, the zone of the instance the node plugin runs on, used instead of the one from the metadata server.")
+	nodeProject            = flag.String("node-project", "", "If set, the project of the instance the node plugin runs on, used instead of the one from the metadata server.")
+	nodeMachineType        = flag.String("node-machine-type", "", "If set, the machine type of the instance the node plugin runs on, such as n2-standard-4, used instead of the one from the metadata server to compute the volume attach limit.")
+	nodeIdentityFile       = flag.String("node-identity-file", "", "If set, the path of a JSON file, such as one mounted from a ConfigMap, with any of the project, zone, name and machineType of the instance the node plugin runs on. The --node-* flags take precedence over the file, and the metadata server is only asked for the values neither gives.")
+	volumeAttachLimit      = flag.Int64("volume-attach-limit", 0, "If positive, the maximum number of volumes the node reports it can attach instead of the limit computed from its machine type. Use on nodes where some attachment slots are taken by local SSDs or other disks not managed by the driver. The default of zero uses the computed limit.")
+	enforceMountHardening  = flag.Bool("enforce-mount-hardening", false, "If set, the node mounts filesystem volumes with noexec, nosuid and nodev unless the volume attribute mount-hardening, which the StorageClass parameter of the same name sets, is \"false\". Staging or publishing a volume whose mount options include exec, suid or dev then fails. It has no effect on block volumes or on Windows.")
+	reportFsTopology       = flag.Bool("report-filesystem-topology", false, "If set, the node reports the filesystems it can mount in the topology key topology.gke.io/filesystems as a dot-separated list such as ext4.xfs, and CreateVolume rejects a filesystem type that no node in the requested topology reports. Nodes that do not report filesystems, or report them as unknown, are assumed to support all of them.")
+	reportRegionTopology   = flag.Bool("report-region-topology", false, "If set, the node also reports its region as the topology key topology.gke.io/region, so that volumes whose topology only names a region can be scheduled. Only enable it once every controller has been upgraded to a version that accepts the key.")
+	kubeletRootDir         = flag.String("kubelet-root-dir", "", "If set, the kubelet root directory, such as /var/lib/kubelet or C:\\var\\lib\\kubelet, that NodePublishVolume target and staging paths must be under once symlinks are resolved. The default of empty string accepts any path.")
+	nodeStateDir           = flag.String("node-state-dir", "", "If set, a directory on the host, such as one under the kubelet plugin directory of the driver, in which the node service keeps state that must survive reboots, such as which volumes restored from snapshots have had their filesystem UUID regenerated and been trimmed. The default of empty string keeps no state, so restored volumes are prepared each time they are staged.")
+	nodeOperationHardLimit = flag.Duration("node-operation-hard-limit", 0, "If positive, how long a node operation such as NodeStageVolume may run before the node plugin logs it as hung and fails its Probe, so that the livenessprobe sidecar restarts it. The default of zero disables the check.")
+	enableVolumeIOLimits   = flag.Bool("enable-volume-io-limits", false, "If set, the node applies the IO limits set by the node-read-bytes-per-sec, node-write-bytes-per-sec, node-read-iops and node-write-iops StorageClass parameters to the cgroup of each pod a volume is published to. It needs the io or blkio cgroup controller and has no effect on Windows.")
+	mountCheckMode         = flag.String("mount-check-mode", "fast", "How the node checks existing stage and publish mounts: fast only checks that the path is a mount point, deep also checks that the filesystem answers statfs and is backed by the expected device, which costs more on nodes with many volumes. Deep checks have no effect on Windows.")
+	expansionResyncPeriod  = flag.Duration("expansion-resync-period", 0, "If positive, how often the node checks the filesystems staged for being smaller than their disks, as happens when the kubelet restarts before calling NodeExpandVolume, and grows them. Filesystems staged before the node service started are found in the mount table under the kubelet-root-dir, by default /var/lib/kubelet. An event is posted on the PVC of each grown volume when the node service runs in the cluster and may get persistentvolumes and create events. The default of zero disables the check.")
+	windowsHostProcess     = flag.Bool("windows-host-process", false, "If set, the Windows node plugin runs in a HostProcess container and manages disks and volumes with PowerShell on the node instead of through csi-proxy, which then need not be installed. Only supported on Windows.")
+	freezeBeforeUnstage    = flag.Bool("freeze-before-unstage", false, "If set, the node freezes and thaws filesystems with fsfreeze before NodeUnstageVolume unmounts them, instead of only syncing them, which leaves their journal clean for a detach that follows right away. Writers to the volume block while it is frozen. It has no effect on Windows.")
+	maxIdleConnsPerHost    = flag.Int("compute-max-idle-conns-per-host", 0, "If positive, the number of idle connections the controller keeps open to each Google API host, shared by all compute API versions and token requests. The default of zero keeps the Go default.")
+	computeMaxAttempts     = flag.Int("compute-max-attempts", 3, "The total number of attempts of a compute API request that fails with a transient error, including the first. Read requests are retried on connection errors and 429 or 5xx responses; requests that change state only on 429 or 503 responses. One disables retries.")
+	computeInitialBackoff  = flag.Duration("compute-retry-initial-backoff", time.Second, "The pause before the first retry of a failed compute API request. It doubles after each further attempt.")
+	gceAPIQPS              = flag.Float64("gce-api-qps", 0, "If positive, the rate of compute API requests per second the controller sends, applied separately to reads and to mutations. The default of zero sets no limit.")
+	gceAPIBurst            = flag.Int("gce-api-burst", 10, "The number of compute API reads, and separately mutations, the controller may send at once above --gce-api-qps.")
+	maxComputeOperations   = flag.Int("max-concurrent-compute-operations", 0, "If positive, the most disk and snapshot mutations, such as inserts, attaches and resizes, the controller runs at once. Each counts until its compute operation completes, and further mutations wait for one to finish. The default of zero sets no cap.")
+	minimalPermissions     = flag.Bool("minimal-permissions", false, "If set, the controller skips the optional compute API calls that need compute.zones.list, compute.zoneOperations.list and compute.regionOperations.list, so that it can run with a tighter custom role, and logs each permission it no longer uses on startup. Topology requirements must then name the zones of regional disks, and CreateVolume retries instead of adopting a disk insert started by another replica.")
+	snapshotDeleteQPS      = flag.Float64("snapshot-delete-qps", 0, "If positive, the rate of snapshot deletes per second the controller starts. Deletes beyond the rate wait, taking turns across the volumes the snapshots were taken of, so that mass snapshot cleanup, such as a retention sweep, leaves compute API quota for provisioning. The number waiting is reported in the snapshot_deletes_queued metric. The default of zero sets no limit.")
+	snapshotDeleteBurst    = flag.Int("snapshot-delete-burst", 10, "The number of snapshot deletes the controller may start at once above --snapshot-delete-qps.")
+	computeMaxBackoff      = flag.Duration("compute-retry-max-backoff", 10*time.Second, "The longest pause between retries of a failed compute API request.")
+	instanceCacheTTL       = flag.Duration("instance-cache-ttl", 0, "If non-zero, ControllerPublishVolume and ControllerUnpublishVolume reuse instances read from GCE for up to this long, at most 5s, which cuts API reads when many volumes are attached to or detached from the same nodes at once, such as during a cluster-wide reboot. Cached instances are dropped whenever the controller attaches or detaches a disk on them, and re-read before reporting a failure or that a disk is already attached or detached. The default of zero disables caching.")
+	listVolumesCachePeriod = flag.Duration("list-volumes-cache-refresh-period", 0, "If non-zero, ListVolumes is served from a cache of the project's disks carrying the extra labels, refreshed at this period. The default of zero lists disks in the driver's zone on every call.")
+	concurrencyLimitsStr   = flag.String("max-concurrent-calls", "", "Comma separated <rpc>=<limit> entries, such as CreateVolume=50,DeleteVolume=50, that cap the calls to a CSI RPC the driver runs at once. Calls beyond the cap fail with Aborted, which the sidecars retry with backoff, instead of piling up during provisioning storms. RPCs without an entry are not capped.")
+	logSampleInterval      = flag.Duration("log-sample-interval", 0, "If non-zero, requests and responses of frequently called methods, such as NodeGetVolumeStats and the GetCapabilities calls, are logged at most once per interval per method, followed by the number of calls that were not logged. Errors are always logged. The default of zero logs every call.")
+	preDetachNodeTaints    = flag.String("pre-detach-node-taints", "", "Comma separated taint keys, such as node.kubernetes.io/out-of-service,cloud.google.com/impending-node-termination, that mark a node as shutting down or being preempted. If set, the controller detaches disks from such nodes as soon as no running pod on the node uses them and the node has unmounted them, instead of waiting for the external-attacher. Requires the controller to run in the cluster. The default of empty disables pre-detaching.")
+	preDetachPeriod        = flag.Duration("pre-detach-period", 10*time.Second, "How often the controller checks for nodes with a --pre-detach-node-taints taint.")
+	orphanCheckPeriod      = flag.Duration("orphaned-attachment-check-period", 0, "If non-zero, how often the controller compares the instances the disks of its PVs are attached to against the VolumeAttachments, reporting attachments that none accounts for in two checks in a row in the orphaned_attachments metric, the debug state and a log with the command that detaches them. Requires the controller to run in the cluster. The default of zero disables the check.")
+	operationHistorySize   = flag.Int("volume-operation-history-size", 10, "The number of operations, such as creates, attaches and detaches, the controller keeps in memory per volume with their times and results. They are served at --debug-path, and the error of a failed operation names the last earlier failure on its volume. Zero disables the history.")
+	auditAttachPods        = flag.Bool("audit-attach-pods", false, "If set, the controller logs the pods each attach and detach is done for, found through the claim of the volume's PV among the pods on the node. The pods are looked up in the background after each operation. Requires the controller to run in the cluster.")
+	prewarmCaches          = flag.Bool("prewarm-caches", false, "If set, the controller lists the PVs and VolumeAttachments of the driver on startup and reads the instances their volumes are attached to into the instance cache before it starts serving, so that the attaches and detaches the external-attacher sends after a controller restart do not each read their instance from GCE. Requires --instance-cache-ttl; skipped with a warning if the controller does not run in the cluster.")
+	version                string
+	// gitCommit is optionally set at compile time.
+	gitCommit string
 )
 
 const (
@@ -70,12 +133,36 @@ func handle() {
 	if version == "" {
 		klog.Fatalf("version must be set at compile time")
 	}
-	klog.V(2).Infof("Driver vendor version %v", version)
+	if gitCommit == "" {
+		gitCommit = "unknown"
+	}
+	klog.V(2).Infof("Driver vendor version %v, git commit %v", version, gitCommit)
+
+	var computeAPIVersions []string
+	if *runControllerService {
+		for _, v := range gce.GCEAPIVersions {
+			computeAPIVersions = append(computeAPIVersions, string(v))
+		}
+	}
 
-	if *runControllerService && *httpEndpoint != "" && metrics.IsGKEComponentVersionAvailable() {
-		mm := metrics.NewMetricsManager()
+	mm := metrics.NewMetricsManager()
+	exportNodeMetrics := *runNodeService && *enableNodeMetrics
+	if *httpEndpoint != "" && (*runControllerService || exportNodeMetrics) {
 		mm.InitializeHttpHandler(*httpEndpoint, *metricsPath)
-		mm.EmitGKEComponentVersion()
+		mm.RegisterProcessMetrics()
+		mm.EmitBuildInfo(version, gitCommit, computeAPIVersions)
+	}
+	if *runControllerService && *httpEndpoint != "" {
+		mm.RegisterAttachDetachMetrics()
+		mm.RegisterComputeAPIMetrics()
+		mm.RegisterSnapshotMetrics()
+		mm.RegisterOrphanedAttachmentMetrics()
+		if metrics.IsGKEComponentVersionAvailable() {
+			mm.EmitGKEComponentVersion()
+		}
+	}
+	if exportNodeMetrics && *httpEndpoint != "" {
+		mm.RegisterNodeOperationMetrics()
 	}
 
 	if len(*extraVolumeLabelsStr) > 0 && !*runControllerService {
@@ -85,6 +172,32 @@ func handle() {
 	if err != nil {
 		klog.Fatalf("Bad extra volume labels: %v", err)
 	}
+	expansionPolicy, err := common.ParseExpansionPolicy(*expansionPolicyStr)
+	if err != nil {
+		klog.Fatalf("Bad disk type expansion policy: %v", err)
+	}
+	concurrencyLimits, err := common.ParseConcurrencyLimits(*concurrencyLimitsStr)
+	if err != nil {
+		klog.Fatalf("Bad max concurrent calls: %v", err)
+	}
+	parameterDefaults := common.ParameterDefaults{
+		DiskType:             *defaultDiskType,
+		DiskEncryptionKMSKey: *defaultKMSKey,
+	}
+
+	if *useMetadataDefaults {
+		if !*runControllerService {
+			klog.Fatalf("Metadata defaults requested but not running controller")
+		}
+		md, err := metadataservice.GetDriverDefaults()
+		if err != nil {
+			klog.Fatalf("Failed to read driver defaults from metadata: %v", err)
+		}
+		extraVolumeLabels, parameterDefaults, err = mergeMetadataDefaults(md, extraVolumeLabels, parameterDefaults)
+		if err != nil {
+			klog.Fatalf("Bad driver defaults in metadata: %v", err)
+		}
+	}
 
 	gceDriver := driver.GetGCEDriver()
 
@@ -97,12 +210,51 @@ func handle() {
 
 	//Initialize requirements for the controller service
 	var controllerServer *driver.GCEControllerServer
+	var cloudProvider *gce.CloudProvider
 	if *runControllerService {
-		cloudProvider, err := gce.CreateCloudProvider(ctx, version, *cloudConfigFilePath)
+		endpoints := gce.Endpoints{
+			Compute:    *computeEndpoint,
+			OAuthToken: *oauthTokenEndpoint,
+			Region:     *endpointRegion,
+		}
+		if *instanceCacheTTL < 0 || *instanceCacheTTL > driver.MaxInstanceCacheTTL {
+			klog.Fatalf("Instance cache TTL must be between 0 and %v, got %v", driver.MaxInstanceCacheTTL, *instanceCacheTTL)
+		}
+		transportOpts := gce.TransportOptions{
+			MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+			MaxAttempts:         *computeMaxAttempts,
+			InitialBackoff:      *computeInitialBackoff,
+			MaxBackoff:          *computeMaxBackoff,
+			QPS:                 float32(*gceAPIQPS),
+			Burst:               *gceAPIBurst,
+		}
+		var err error
+		cloudProvider, err = gce.CreateCloudProvider(ctx, version, *cloudConfigFilePath, endpoints, gce.CredentialOptions{ImpersonateServiceAccount: *impersonateSA}, transportOpts)
 		if err != nil {
 			klog.Fatalf("Failed to get cloud provider: %v", err)
 		}
-		controllerServer = driver.NewControllerServer(gceDriver, cloudProvider)
+		cloudProvider.LimitConcurrentOperations(*maxComputeOperations)
+		if *minimalPermissions {
+			cloudProvider.SetMinimalPermissions()
+		}
+		controllerServerArgs := driver.ControllerServerArgs{
+			DisableSnapshots:  *disableSnapshots,
+			DisableExpansion:  *disableExpansion,
+			ParameterDefaults: parameterDefaults,
+
+			ListVolumesCacheRefreshPeriod: *listVolumesCachePeriod,
+			AllowUnownedDelete:            *allowUnownedDelete,
+			MaxDetachPause:                *maxDetachPause,
+			InstanceCacheTTL:              *instanceCacheTTL,
+			ExpansionPolicy:               expansionPolicy,
+			OperationHistorySize:          *operationHistorySize,
+			SnapshotDeleteQPS:             float32(*snapshotDeleteQPS),
+			SnapshotDeleteBurst:           *snapshotDeleteBurst,
+		}
+		controllerServer = driver.NewControllerServer(gceDriver, gce.NewInstrumentedCompute(cloudProvider), controllerServerArgs)
+		if *httpEndpoint != "" && *debugPath != "" {
+			mm.RegisterHandler(*debugPath, controllerServer.DebugHandler())
+		}
 	} else if *cloudConfigFilePath != "" {
 		klog.Warningf("controller service is disabled but cloud config given - it has no effect")
 	}
@@ -110,23 +262,177 @@ func handle() {
 	//Initialize requirements for the node service
 	var nodeServer *driver.GCENodeServer
 	if *runNodeService {
-		mounter, err := mountmanager.NewSafeMounter()
+		if *volumeAttachLimit < 0 {
+			klog.Fatalf("Volume attach limit must not be negative, got %d", *volumeAttachLimit)
+		}
+		var mounter *mount.SafeFormatAndMount
+		if *windowsHostProcess {
+			mounter, err = mountmanager.NewHostProcessSafeMounter()
+		} else {
+			mounter, err = mountmanager.NewSafeMounter()
+		}
 		if err != nil {
 			klog.Fatalf("Failed to get safe mounter: %v", err)
 		}
 		deviceUtils := mountmanager.NewDeviceUtils()
 		statter := mountmanager.NewStatter(mounter)
-		meta, err := metadataservice.NewMetadataService()
+		nodeIdentity := metadataservice.NodeIdentity{
+			Project:     *nodeProject,
+			Zone:        *nodeZone,
+			Name:        *nodeName,
+			MachineType: *nodeMachineType,
+		}
+		if *nodeIdentityFile != "" {
+			fileIdentity, err := metadataservice.ReadNodeIdentityFile(*nodeIdentityFile)
+			if err != nil {
+				klog.Fatalf("Bad node identity file: %v", err)
+			}
+			nodeIdentity = nodeIdentity.Merge(fileIdentity)
+		}
+		if nodeIdentity.Zone != "" {
+			if _, err := common.GetRegionFromZones([]string{nodeIdentity.Zone}); err != nil {
+				klog.Fatalf("Bad node zone %q: %v", nodeIdentity.Zone, err)
+			}
+		}
+		meta, err := metadataservice.NewMetadataService(nodeIdentity)
 		if err != nil {
 			klog.Fatalf("Failed to set up metadata service: %v", err)
 		}
-		nodeServer = driver.NewNodeServer(gceDriver, mounter, deviceUtils, meta, statter)
+		klog.V(2).Infof("Node instance %s in project %s, zone %s, machine type %s", meta.GetName(), meta.GetProject(), meta.GetZone(), meta.GetMachineType())
+		if *mountCheckMode != "fast" && *mountCheckMode != "deep" {
+			klog.Fatalf("Mount check mode must be fast or deep, got %q", *mountCheckMode)
+		}
+		nodeServerArgs := driver.NodeServerArgs{
+			DeviceDiscoveryTimeout: *deviceDiscoveryTimeout,
+			VolumeAttachLimit:      *volumeAttachLimit,
+			EnforceMountHardening:  *enforceMountHardening,
+
+			ReportFilesystemTopology: *reportFsTopology,
+			ReportRegionTopology:     *reportRegionTopology,
+			KubeletRootDir:           *kubeletRootDir,
+			StateDir:                 *nodeStateDir,
+			FreezeBeforeUnstage:      *freezeBeforeUnstage,
+			OperationHardLimit:       *nodeOperationHardLimit,
+			EnableIOLimits:           *enableVolumeIOLimits,
+			DeepMountChecks:          *mountCheckMode == "deep",
+			DisableExpansion:         *disableExpansion,
+		}
+		nodeServer = driver.NewNodeServer(gceDriver, mounter, deviceUtils, meta, statter, nodeServerArgs)
+	} else if *volumeAttachLimit != 0 {
+		klog.Warningf("node service is disabled but volume attach limit given - it has no effect")
+	}
+	if *enforceMountHardening && (!*runNodeService || runtime.GOOS == "windows") {
+		klog.Warningf("mount hardening is only enforced by the node service on Linux - it has no effect")
 	}
 
 	err = gceDriver.SetupGCEDriver(driverName, version, extraVolumeLabels, identityServer, controllerServer, nodeServer)
 	if err != nil {
 		klog.Fatalf("Failed to initialize GCE CSI Driver: %v", err)
 	}
+	gceDriver.SetBuildInfo(gitCommit, computeAPIVersions)
+	gceDriver.SetLogSampleInterval(*logSampleInterval)
+	gceDriver.SetConcurrencyLimits(concurrencyLimits)
+
+	var kubeClient kubernetes.Interface
+	if *preDetachNodeTaints != "" || *orphanCheckPeriod != 0 || *auditAttachPods {
+		if controllerServer == nil {
+			klog.Fatalf("Pre-detach node taints, orphaned attachment check or attach auditing given but not running controller")
+		}
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			klog.Fatalf("Failed to get in-cluster config: %v", err)
+		}
+		kubeClient, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			klog.Fatalf("Failed to create Kubernetes client: %v", err)
+		}
+	}
+	if *preDetachNodeTaints != "" {
+		detacher := driver.NewShutdownDetacher(controllerServer, kubeClient, strings.Split(*preDetachNodeTaints, ","))
+		go detacher.Run(*preDetachPeriod, ctx.Done())
+	}
+	if *orphanCheckPeriod != 0 {
+		detector := driver.NewOrphanedAttachmentDetector(controllerServer, kubeClient)
+		go detector.Run(*orphanCheckPeriod, ctx.Done())
+	}
+	if *auditAttachPods {
+		driver.NewAttachAuditor(controllerServer, kubeClient)
+	}
+
+	if *expansionResyncPeriod > 0 {
+		if nodeServer == nil {
+			klog.Fatalf("Expansion resync period given but not running node service")
+		}
+		if *disableExpansion {
+			klog.Fatalf("Expansion resync period given but volume expansion is disabled")
+		}
+		var client kubernetes.Interface
+		if config, err := rest.InClusterConfig(); err != nil {
+			klog.Warningf("Expansion resync will not post events, failed to get in-cluster config: %v", err)
+		} else if client, err = kubernetes.NewForConfig(config); err != nil {
+			klog.Warningf("Expansion resync will not post events, failed to create Kubernetes client: %v", err)
+			client = nil
+		}
+		resyncer := driver.NewExpansionResyncer(nodeServer, client)
+		go resyncer.Run(*expansionResyncPeriod, ctx.Done())
+	}
+
+	if *prewarmCaches {
+		if controllerServer == nil || *instanceCacheTTL == 0 {
+			klog.Warningf("cache prewarming needs the controller service with an instance cache TTL - it has no effect")
+		} else if kubeClient != nil {
+			driver.PrewarmCaches(ctx, controllerServer, kubeClient)
+		} else if config, err := rest.InClusterConfig(); err != nil {
+			klog.Warningf("Skipping cache prewarm, failed to get in-cluster config: %v", err)
+		} else if client, err := kubernetes.NewForConfig(config); err != nil {
+			klog.Warningf("Skipping cache prewarm, failed to create Kubernetes client: %v", err)
+		} else {
+			driver.PrewarmCaches(ctx, controllerServer, client)
+		}
+	}
+
+	if *configFile != "" {
+		applyConfig := func(cfg *driverconfig.Config) {
+			if controllerServer != nil {
+				controllerServer.SetParameterDefaults(cfg.ParameterDefaults(parameterDefaults))
+				controllerServer.SetTopologyAliases(cfg.GetTopologyAliases())
+				controllerServer.SetAllowUnownedDelete(cfg.FeatureEnabled(driverconfig.FeatureAllowUnownedDelete, *allowUnownedDelete))
+				cloudProvider.SetComputeAPIRateLimit(cfg.GetComputeAPIRateLimit(float32(*gceAPIQPS), *gceAPIBurst))
+			}
+			if nodeServer != nil {
+				nodeServer.SetDeviceDiscoveryTimeout(cfg.GetDeviceDiscoveryTimeout(*deviceDiscoveryTimeout))
+				nodeServer.SetEnforceMountHardening(cfg.FeatureEnabled(driverconfig.FeatureEnforceMountHardening, *enforceMountHardening))
+				nodeServer.SetFreezeBeforeUnstage(cfg.FeatureEnabled(driverconfig.FeatureFreezeBeforeUnstage, *freezeBeforeUnstage))
+			}
+			gceDriver.SetRetryPolicies(cfg.GetRetryPolicies())
+		}
+		cfg, err := driverconfig.Load(*configFile)
+		if err != nil {
+			klog.Fatalf("Failed to load driver config: %v", err)
+		}
+		applyConfig(cfg)
+		go driverconfig.Watch(*configFile, *configReloadPeriod, applyConfig, ctx.Done())
+	}
 
 	gceDriver.Run(*endpoint)
 }
+
+// mergeMetadataDefaults fills in driver defaults that were not given by flags
+// from the defaults found in metadata. Labels are merged, with flag labels
+// overriding metadata labels of the same key.
+func mergeMetadataDefaults(md metadataservice.DriverDefaults, labels map[string]string, defaults common.ParameterDefaults) (map[string]string, common.ParameterDefaults, error) {
+	mdLabels, err := common.ConvertLabelsStringToMap(md.Labels)
+	if err != nil {
+		return nil, defaults, fmt.Errorf("invalid labels in metadata key %s: %v", metadataservice.DefaultLabelsKey, err)
+	}
+	for k, v := range labels {
+		mdLabels[k] = v
+	}
+	if defaults.DiskType == "" {
+		defaults.DiskType = md.DiskType
+	}
+	if defaults.DiskEncryptionKMSKey == "" {
+		defaults.DiskEncryptionKMSKey = md.DiskEncryptionKMSKey
+	}
+	return mdLabels, defaults, nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
+)
+
+func TestMergeMetadataDefaults(t *testing.T) {
+	testCases := []struct {
+		name        string
+		md          metadataservice.DriverDefaults
+		labels      map[string]string
+		defaults    common.ParameterDefaults
+		expLabels   map[string]string
+		expDefaults common.ParameterDefaults
+		expectError bool
+	}{
+		{
+			name:        "nothing set",
+			expLabels:   map[string]string{},
+			expDefaults: common.ParameterDefaults{},
+		},
+		{
+			name: "metadata only",
+			md: metadataservice.DriverDefaults{
+				DiskType:             "pd-ssd",
+				Labels:               "team=storage,env=prod",
+				DiskEncryptionKMSKey: "md-key",
+			},
+			expLabels:   map[string]string{"team": "storage", "env": "prod"},
+			expDefaults: common.ParameterDefaults{DiskType: "pd-ssd", DiskEncryptionKMSKey: "md-key"},
+		},
+		{
+			name:        "flags only",
+			labels:      map[string]string{"team": "storage"},
+			defaults:    common.ParameterDefaults{DiskType: "pd-balanced", DiskEncryptionKMSKey: "flag-key"},
+			expLabels:   map[string]string{"team": "storage"},
+			expDefaults: common.ParameterDefaults{DiskType: "pd-balanced", DiskEncryptionKMSKey: "flag-key"},
+		},
+		{
+			name: "flags override metadata",
+			md: metadataservice.DriverDefaults{
+				DiskType:             "pd-ssd",
+				DiskEncryptionKMSKey: "md-key",
+			},
+			defaults:    common.ParameterDefaults{DiskType: "pd-balanced", DiskEncryptionKMSKey: "flag-key"},
+			expLabels:   map[string]string{},
+			expDefaults: common.ParameterDefaults{DiskType: "pd-balanced", DiskEncryptionKMSKey: "flag-key"},
+		},
+		{
+			name:        "metadata fills in defaults flags leave unset",
+			md:          metadataservice.DriverDefaults{DiskType: "pd-ssd", DiskEncryptionKMSKey: "md-key"},
+			defaults:    common.ParameterDefaults{DiskType: "pd-balanced"},
+			expLabels:   map[string]string{},
+			expDefaults: common.ParameterDefaults{DiskType: "pd-balanced", DiskEncryptionKMSKey: "md-key"},
+		},
+		{
+			name:        "labels are merged, flag label wins on conflict",
+			md:          metadataservice.DriverDefaults{Labels: "team=storage,env=prod"},
+			labels:      map[string]string{"env": "dev", "owner": "infra"},
+			expLabels:   map[string]string{"team": "storage", "env": "dev", "owner": "infra"},
+			expDefaults: common.ParameterDefaults{},
+		},
+		{
+			name:        "invalid metadata labels",
+			md:          metadataservice.DriverDefaults{Labels: "Team=storage"},
+			labels:      map[string]string{"env": "dev"},
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		labels, defaults, err := mergeMetadataDefaults(tc.md, tc.labels, tc.defaults)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(labels, tc.expLabels) {
+			t.Errorf("%s: got labels %v, expected %v", tc.name, labels, tc.expLabels)
+		}
+		if defaults != tc.expDefaults {
+			t.Errorf("%s: got defaults %+v, expected %+v", tc.name, defaults, tc.expDefaults)
+		}
+	}
+}
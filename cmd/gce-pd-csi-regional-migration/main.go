@@ -0,0 +1,91 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main converts the zonal disk of a PV into a regional disk and
+// prints a PV using the regional disk, to be created in place of the
+// original. See docs/kubernetes/user-guides/regional-migration.md.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/regionalmigration"
+)
+
+var (
+	kubeconfig          = flag.String("kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	cloudConfigFilePath = flag.String("cloud-config", "", "Path to GCE cloud provider config")
+	driverName          = flag.String("driver-name", "pd.csi.storage.gke.io", "Name of the driver that provisioned the PV.")
+	pvName              = flag.String("pv", "", "Name of the PV to migrate.")
+	replicaZone         = flag.String("replica-zone", "", "Zone, in the region of the disk, the regional disk is replicated to in addition to the zone of the disk.")
+	regionalDiskName    = flag.String("regional-disk-name", "", "Name of the regional disk. The default is the name of the zonal disk.")
+	snapshotName        = flag.String("snapshot-name", "", "Name of the snapshot the regional disk is restored from. The default is the name of the zonal disk.")
+	keepSnapshot        = flag.Bool("keep-snapshot", false, "If set, the snapshot is kept once the regional disk is created.")
+	version             string
+)
+
+func init() {
+	// klog verbosity guide for this package
+	// Use V(2) for migration steps
+	// Use V(4) for general debug information logging
+	klog.InitFlags(flag.CommandLine)
+	flag.Set("logtostderr", "true")
+}
+
+func main() {
+	flag.Parse()
+	if *pvName == "" || *replicaZone == "" {
+		klog.Fatalf("--pv and --replica-zone must be set")
+	}
+	ctx := context.Background()
+
+	// An empty kubeconfig path falls back to the in-cluster config.
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		klog.Fatalf("Failed to build client config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create client: %v", err)
+	}
+	cloudProvider, err := gce.CreateCloudProvider(ctx, version, *cloudConfigFilePath, gce.Endpoints{}, gce.CredentialOptions{}, gce.TransportOptions{})
+	if err != nil {
+		klog.Fatalf("Failed to get cloud provider: %v", err)
+	}
+
+	m := regionalmigration.NewMigrator(client, cloudProvider, *driverName)
+	pv, err := m.Migrate(ctx, regionalmigration.Options{
+		PVName:           *pvName,
+		ReplicaZone:      *replicaZone,
+		RegionalDiskName: *regionalDiskName,
+		SnapshotName:     *snapshotName,
+		KeepSnapshot:     *keepSnapshot,
+	})
+	if err != nil {
+		klog.Fatalf("Failed to migrate PV %s: %v", *pvName, err)
+	}
+	out, err := yaml.Marshal(pv)
+	if err != nil {
+		klog.Fatalf("Failed to render PV %s: %v", *pvName, err)
+	}
+	fmt.Print(string(out))
+}
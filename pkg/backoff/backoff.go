@@ -0,0 +1,209 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backoff holds the retry policies shared by the controller and node
+// services, so that how the driver retries GCE and node operations is
+// defined, and tuned, in one place.
+package backoff
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Class groups errors that are retried the same way.
+type Class string
+
+const (
+	// ClassOther is any error without a retry policy of its own. Retry
+	// returns such errors without retrying.
+	ClassOther Class = "other"
+	// ClassQuota is a GCE quota or rate limit error.
+	ClassQuota Class = "quota"
+	// ClassAttachConflict is a GCE error for a disk that is being attached
+	// to or detached from another instance.
+	ClassAttachConflict Class = "attach-conflict"
+)
+
+// Policy describes how an operation is retried.
+type Policy struct {
+	// Duration is the pause before the first retry.
+	Duration time.Duration
+	// Factor multiplies the pause after each retry. Values below one keep
+	// the pause constant.
+	Factor float64
+	// Jitter adds up to Jitter*pause to each pause.
+	Jitter float64
+	// Cap bounds the pause. Zero leaves it unbounded.
+	Cap time.Duration
+	// Steps bounds the number of attempts. Zero leaves only Timeout and the
+	// caller's context in effect.
+	Steps int
+	// Timeout bounds the total time spent retrying. Zero leaves only Steps
+	// and the caller's context in effect.
+	Timeout time.Duration
+}
+
+var (
+	// Fast is for short-lived conditions expected to clear within seconds,
+	// such as eventually consistent reads and device discovery.
+	Fast = Policy{Duration: 500 * time.Millisecond, Factor: 2, Cap: 4 * time.Second, Timeout: 15 * time.Second}
+	// Standard is for polling long-running GCE operations.
+	Standard = Policy{Duration: 3 * time.Second, Factor: 1, Timeout: 5 * time.Minute}
+	// Quota is used once GCE reports a quota or rate limit error.
+	Quota = Policy{Duration: 5 * time.Second, Factor: 2, Jitter: 0.1, Cap: time.Minute, Timeout: 5 * time.Minute}
+	// AttachConflict is for waiting on attach and detach to settle, and is
+	// used once GCE reports that a disk is in use by another instance.
+	AttachConflict = Policy{Duration: 5 * time.Second, Factor: 1, Timeout: 2 * time.Minute}
+)
+
+// WithTimeout returns a copy of p with its Timeout replaced.
+func (p Policy) WithTimeout(timeout time.Duration) Policy {
+	p.Timeout = timeout
+	return p
+}
+
+// ForClass returns the policy used after an error of class c, and false if
+// errors of that class are not retried.
+func ForClass(c Class) (Policy, bool) {
+	switch c {
+	case ClassQuota:
+		return Quota, true
+	case ClassAttachConflict:
+		return AttachConflict, true
+	}
+	return Policy{}, false
+}
+
+// Classify returns the class of err.
+func Classify(err error) Class {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return ClassOther
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return ClassQuota
+	}
+	for _, e := range apiErr.Errors {
+		switch e.Reason {
+		case "quotaExceeded", "rateLimitExceeded", "userRateLimitExceeded":
+			return ClassQuota
+		case "resourceInUseByAnotherResource":
+			return ClassAttachConflict
+		}
+	}
+	return ClassOther
+}
+
+// pacer hands out the pauses of one policy.
+type pacer struct {
+	policy Policy
+	next   time.Duration
+}
+
+func (p *pacer) pause() time.Duration {
+	if p.next == 0 {
+		p.next = p.policy.Duration
+	}
+	d := p.next
+	if p.policy.Factor > 1 {
+		p.next = time.Duration(float64(p.next) * p.policy.Factor)
+	}
+	if p.policy.Cap > 0 && p.next > p.policy.Cap {
+		p.next = p.policy.Cap
+	}
+	if p.policy.Jitter > 0 {
+		d = wait.Jitter(d, p.policy.Jitter)
+	}
+	return d
+}
+
+// Retry calls condition until it returns true, pausing between attempts as
+// set by policy. An error whose class has a policy of its own is retried,
+// pausing as set by that class's policy; any other error is returned at
+// once. Once policy's Steps or Timeout are used up Retry returns the last
+// retried error, or wait.ErrWaitTimeout if there was none. If ctx is done
+// first its error is returned.
+func Retry(ctx context.Context, policy Policy, condition func() (bool, error)) error {
+	return RetryWithClock(ctx, clock.RealClock{}, policy, condition)
+}
+
+// RetryWithClock is Retry with its pauses and Timeout measured by clk, so
+// that tests can step through them with a fake clock instead of sleeping.
+func RetryWithClock(ctx context.Context, clk clock.Clock, policy Policy, condition func() (bool, error)) error {
+	var deadline time.Time
+	if policy.Timeout > 0 {
+		deadline = clk.Now().Add(policy.Timeout)
+	}
+	timedOut := func() bool {
+		return !deadline.IsZero() && !clk.Now().Before(deadline)
+	}
+	var lastErr error
+	expired := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lastErr != nil {
+			return lastErr
+		}
+		return wait.ErrWaitTimeout
+	}
+
+	pacers := map[Class]*pacer{ClassOther: {policy: policy}}
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil || timedOut() {
+			return expired()
+		}
+		done, err := condition()
+		if done {
+			return err
+		}
+		lastErr = err
+		class := ClassOther
+		if err != nil {
+			class = Classify(err)
+			classPolicy, ok := ForClass(class)
+			if !ok {
+				return err
+			}
+			if pacers[class] == nil {
+				pacers[class] = &pacer{policy: classPolicy}
+			}
+		}
+		if policy.Steps > 0 && attempt >= policy.Steps {
+			return expired()
+		}
+		pause := pacers[class].pause()
+		if !deadline.IsZero() {
+			if remaining := deadline.Sub(clk.Now()); remaining < pause {
+				pause = remaining
+			}
+		}
+		timer := clk.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return expired()
+		case <-timer.C():
+		}
+	}
+}
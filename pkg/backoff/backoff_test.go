@@ -0,0 +1,220 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backoff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func gceError(code int, reason string) error {
+	return &googleapi.Error{Code: code, Errors: []googleapi.ErrorItem{{Reason: reason}}}
+}
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expClass Class
+	}{
+		{
+			name:     "not a googleapi error",
+			err:      errors.New("boom"),
+			expClass: ClassOther,
+		},
+		{
+			name:     "not found",
+			err:      gceError(http.StatusNotFound, "notFound"),
+			expClass: ClassOther,
+		},
+		{
+			name:     "too many requests",
+			err:      &googleapi.Error{Code: http.StatusTooManyRequests},
+			expClass: ClassQuota,
+		},
+		{
+			name:     "quota exceeded",
+			err:      gceError(http.StatusForbidden, "quotaExceeded"),
+			expClass: ClassQuota,
+		},
+		{
+			name:     "user rate limit exceeded",
+			err:      gceError(http.StatusForbidden, "userRateLimitExceeded"),
+			expClass: ClassQuota,
+		},
+		{
+			name:     "wrapped rate limit exceeded",
+			err:      fmt.Errorf("get failed: %w", gceError(http.StatusForbidden, "rateLimitExceeded")),
+			expClass: ClassQuota,
+		},
+		{
+			name:     "in use by another resource",
+			err:      gceError(http.StatusBadRequest, "resourceInUseByAnotherResource"),
+			expClass: ClassAttachConflict,
+		},
+	}
+	for _, tc := range testCases {
+		if class := Classify(tc.err); class != tc.expClass {
+			t.Errorf("%s: got class %q, expected %q", tc.name, class, tc.expClass)
+		}
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := &pacer{policy: Policy{Duration: time.Second, Factor: 2, Cap: 3 * time.Second}}
+	expPauses := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i, exp := range expPauses {
+		if got := p.pause(); got != exp {
+			t.Errorf("pause %d: got %v, expected %v", i, got, exp)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(quota, attachConflict Policy) {
+		Quota, AttachConflict = quota, attachConflict
+	}(Quota, AttachConflict)
+	Quota = Policy{Duration: time.Millisecond}
+	AttachConflict = Policy{Duration: time.Millisecond}
+
+	quotaErr := gceError(http.StatusForbidden, "quotaExceeded")
+	otherErr := errors.New("boom")
+	policy := Policy{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+	testCases := []struct {
+		name        string
+		results     []error
+		doneAt      int
+		expAttempts int
+		expErr      error
+	}{
+		{
+			name:        "done at once",
+			doneAt:      1,
+			expAttempts: 1,
+		},
+		{
+			name:        "done after retries",
+			doneAt:      3,
+			expAttempts: 3,
+		},
+		{
+			name:        "steps used up",
+			expAttempts: 3,
+			expErr:      wait.ErrWaitTimeout,
+		},
+		{
+			name:        "other error is not retried",
+			results:     []error{otherErr},
+			expAttempts: 1,
+			expErr:      otherErr,
+		},
+		{
+			name:        "quota error is retried",
+			results:     []error{quotaErr, quotaErr},
+			doneAt:      3,
+			expAttempts: 3,
+		},
+		{
+			name:        "last quota error returned once steps are used up",
+			results:     []error{quotaErr, quotaErr, quotaErr},
+			expAttempts: 3,
+			expErr:      quotaErr,
+		},
+	}
+	for _, tc := range testCases {
+		attempts := 0
+		err := Retry(context.Background(), policy, func() (bool, error) {
+			attempts++
+			if attempts == tc.doneAt {
+				return true, nil
+			}
+			if attempts <= len(tc.results) {
+				return false, tc.results[attempts-1]
+			}
+			return false, nil
+		})
+		if err != tc.expErr {
+			t.Errorf("%s: got error %v, expected %v", tc.name, err, tc.expErr)
+		}
+		if attempts != tc.expAttempts {
+			t.Errorf("%s: got %d attempts, expected %d", tc.name, attempts, tc.expAttempts)
+		}
+	}
+}
+
+func TestRetryTimeout(t *testing.T) {
+	policy := Policy{Duration: time.Millisecond, Timeout: 20 * time.Millisecond}
+	err := Retry(context.Background(), policy, func() (bool, error) { return false, nil })
+	if err != wait.ErrWaitTimeout {
+		t.Errorf("got error %v, expected %v", err, wait.ErrWaitTimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Retry(ctx, policy, func() (bool, error) { return false, nil })
+	if err != context.Canceled {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestRetryWithClock(t *testing.T) {
+	start := time.Now()
+	clk := clock.NewFakeClock(start)
+	policy := Policy{Duration: 3 * time.Second, Factor: 1, Timeout: 10 * time.Second}
+
+	var attempts []time.Duration
+	errCh := make(chan error)
+	go func() {
+		errCh <- RetryWithClock(context.Background(), clk, policy, func() (bool, error) {
+			attempts = append(attempts, clk.Since(start))
+			return false, nil
+		})
+	}()
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != wait.ErrWaitTimeout {
+				t.Errorf("got error %v, expected %v", err, wait.ErrWaitTimeout)
+			}
+			// The last pause is cut short by the timeout.
+			expAttempts := []time.Duration{0, 3 * time.Second, 6 * time.Second, 9 * time.Second}
+			if fmt.Sprint(attempts) != fmt.Sprint(expAttempts) {
+				t.Errorf("got attempts at %v, expected %v", attempts, expAttempts)
+			}
+			if got := clk.Since(start); got != policy.Timeout {
+				t.Errorf("gave up after %v, expected %v", got, policy.Timeout)
+			}
+			return
+		default:
+		}
+		if clk.HasWaiters() {
+			clk.Step(time.Second)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ConcurrencyLimits holds the number of calls to an RPC that may run at
+// once, by RPC name such as "CreateVolume".
+type ConcurrencyLimits map[string]int
+
+// ParseConcurrencyLimits parses a comma separated list of <rpc>=<limit>
+// entries, such as "CreateVolume=50,DeleteVolume=50".
+func ParseConcurrencyLimits(s string) (ConcurrencyLimits, error) {
+	limits := ConcurrencyLimits{}
+	if s == "" {
+		return limits, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid concurrency limit entry %q, must be <rpc>=<limit>", entry)
+		}
+		if _, ok := limits[parts[0]]; ok {
+			return nil, fmt.Errorf("invalid concurrency limits, rpc %s is given more than once", parts[0])
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid concurrency limit entry %q, limit must be a positive integer", entry)
+		}
+		limits[parts[0]] = limit
+	}
+	return limits, nil
+}
+
+// ConcurrencyLimiter admits calls to an RPC up to its limit and turns away
+// the rest instead of queueing them, so that a burst of calls does not pile
+// up goroutines.
+type ConcurrencyLimiter struct {
+	slots map[string]chan struct{}
+}
+
+// NewConcurrencyLimiter returns a limiter enforcing limits. RPCs without a
+// limit are not limited.
+func NewConcurrencyLimiter(limits ConcurrencyLimits) *ConcurrencyLimiter {
+	slots := make(map[string]chan struct{}, len(limits))
+	for rpc, limit := range limits {
+		slots[rpc] = make(chan struct{}, limit)
+	}
+	return &ConcurrencyLimiter{slots: slots}
+}
+
+// TryAcquire takes a slot for a call to rpc and returns the function that
+// gives it back, or false if all slots of rpc are taken. A nil limiter
+// admits every call.
+func (l *ConcurrencyLimiter) TryAcquire(rpc string) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	slots, ok := l.slots[rpc]
+	if !ok {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// Limit returns the limit of rpc, or 0 if it is not limited.
+func (l *ConcurrencyLimiter) Limit(rpc string) int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots[rpc])
+}
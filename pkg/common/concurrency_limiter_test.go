@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConcurrencyLimits(t *testing.T) {
+	testCases := []struct {
+		name      string
+		limits    string
+		expLimits ConcurrencyLimits
+		expectErr bool
+	}{
+		{
+			name:      "empty",
+			expLimits: ConcurrencyLimits{},
+		},
+		{
+			name:      "several rpcs",
+			limits:    "CreateVolume=50, DeleteVolume=20",
+			expLimits: ConcurrencyLimits{"CreateVolume": 50, "DeleteVolume": 20},
+		},
+		{
+			name:      "missing limit",
+			limits:    "CreateVolume",
+			expectErr: true,
+		},
+		{
+			name:      "zero limit",
+			limits:    "CreateVolume=0",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate rpc",
+			limits:    "CreateVolume=5,CreateVolume=10",
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		limits, err := ParseConcurrencyLimits(tc.limits)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tc.name, limits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(limits, tc.expLimits) {
+			t.Errorf("%s: got %v, expected %v", tc.name, limits, tc.expLimits)
+		}
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	var unlimited *ConcurrencyLimiter
+	if _, ok := unlimited.TryAcquire("CreateVolume"); !ok {
+		t.Errorf("nil limiter turned a call away")
+	}
+
+	limiter := NewConcurrencyLimiter(ConcurrencyLimits{"CreateVolume": 1})
+	release, ok := limiter.TryAcquire("CreateVolume")
+	if !ok {
+		t.Fatalf("first call was turned away")
+	}
+	if _, ok := limiter.TryAcquire("CreateVolume"); ok {
+		t.Errorf("call beyond the limit was admitted")
+	}
+	if _, ok := limiter.TryAcquire("DeleteVolume"); !ok {
+		t.Errorf("call to an rpc without a limit was turned away")
+	}
+	release()
+	if _, ok := limiter.TryAcquire("CreateVolume"); !ok {
+		t.Errorf("call after a release was turned away")
+	}
+}
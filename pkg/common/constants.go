@@ -17,11 +17,70 @@ limitations under the License.
 package common
 
 const (
-	// Keys for Topology. This key will be shared amongst drivers from GCP
-	TopologyKeyZone = "topology.gke.io/zone"
+	// Keys for Topology. These keys will be shared amongst drivers from GCP
+	TopologyKeyZone   = "topology.gke.io/zone"
+	TopologyKeyRegion = "topology.gke.io/region"
+	// Topology key with which nodes report the filesystems they can mount,
+	// as a dot-separated list such as "ext4.xfs". It is a single key so that
+	// every node reporting filesystems has the same topology keys.
+	TopologyKeyFilesystems = "topology.gke.io/filesystems"
+	// Value of TopologyKeyFilesystems on a node that failed to list its
+	// filesystems, which is assumed to support all of them.
+	TopologyFilesystemsUnknown = "unknown"
 
 	// VolumeAttributes for Partition
 	VolumeAttributePartition = "partition"
+	// VolumeAttributes for the interface the disk should be attached with
+	VolumeAttributeDiskInterface = "interface"
+	// VolumeAttributes to opt a volume out of the mount hardening enforced
+	// by the node, when set to "false"
+	VolumeAttributeMountHardening = "mount-hardening"
+	// VolumeAttributes to mount a volume with discard, when "true", or to
+	// reject the discard mount option, when "false"
+	VolumeAttributeDiscard = "discard"
+	// VolumeAttributes to run fstrim when a volume restored from a snapshot
+	// is staged, when "true"
+	VolumeAttributeTrimAfterRestore = "trim-after-restore"
+	// VolumeAttributes to give the filesystem of a volume restored from a
+	// snapshot a new UUID when it is staged, when "true"
+	VolumeAttributeRegenerateFSUUID = "regenerate-fs-uuid"
+	// VolumeAttributes to attach and mount a volume read-only whatever the
+	// request, when "true"
+	VolumeAttributeReadOnly = "read-only"
+	// VolumeAttributes to write the disk metadata file into the volume at
+	// publish time, when "true"
+	VolumeAttributePublishMetadata = "publish-metadata"
+	// VolumeAttributes for the disk type, reported in the disk metadata file
+	VolumeAttributeDiskType = "disk-type"
+	// VolumeAttributes for the IO limits the node applies to each pod the
+	// volume is published to, formatted by IOLimits.String
+	VolumeAttributeIOMax = "io-max"
+	// VolumeAttributes for the IOPS provisioned when the disk was created
+	VolumeAttributeProvisionedIOPS = "provisioned-iops"
+	// VolumeAttributes for the access types, "block,mount", of a volume
+	// created with both block and mount capabilities
+	VolumeAttributeAccessTypes = "access-types"
+	// VolumeAttributes set by ListVolumes on disks provisioned by the in-tree
+	// GCE PD plugin, with the value InTreeProvisionerName
+	VolumeAttributeProvisioner = "provisioner"
+
+	// InTreeProvisionerName is the name of the in-tree GCE PD plugin that the
+	// driver replaces through CSI migration
+	InTreeProvisionerName = "kubernetes.io/gce-pd"
+
+	// PublishContext key for the device name a disk was attached with. The
+	// device name is what shows up as the disk serial on the node.
+	ContextKeyDeviceName = "devicename"
+	// PublishContext key for the interface a disk was attached with, when
+	// one was requested.
+	ContextKeyDiskInterface = "interface"
+	// PublishContext key for the type of the attached disk, such as
+	// pd-ssd, which the node records its operation metrics with.
+	ContextKeyDiskType = "disk-type"
+
+	// Disk interfaces accepted by the interface parameter.
+	DiskInterfaceNVME = "NVME"
+	DiskInterfaceSCSI = "SCSI"
 
 	UnspecifiedValue = "UNSPECIFIED"
 )
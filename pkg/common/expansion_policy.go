@@ -0,0 +1,78 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// DiskTypeUpgrade is the largest size disks of a type may be expanded to,
+// and the type they must be migrated to in order to grow further.
+type DiskTypeUpgrade struct {
+	MaxSizeGb int64
+	ToType    string
+}
+
+// ExpansionPolicy holds the upgrade of each disk type that is limited, by
+// type. GCE cannot change the type of an existing disk, so expansions beyond
+// the limit are refused and the disk has to be migrated, for example by
+// restoring a snapshot of it to a volume of the new type.
+type ExpansionPolicy map[string]DiskTypeUpgrade
+
+// ParseExpansionPolicy parses a comma separated list of
+// <type>:<max size>:<upgrade type> entries, such as
+// "pd-standard:2Ti:pd-balanced". Sizes are resource quantities.
+func ParseExpansionPolicy(s string) (ExpansionPolicy, error) {
+	policy := ExpansionPolicy{}
+	if s == "" {
+		return policy, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid expansion policy entry %q, must be <type>:<max size>:<upgrade type>", entry)
+		}
+		if parts[0] == parts[2] {
+			return nil, fmt.Errorf("invalid expansion policy entry %q, upgrade type must differ from the type", entry)
+		}
+		if _, ok := policy[parts[0]]; ok {
+			return nil, fmt.Errorf("invalid expansion policy, type %s is given more than once", parts[0])
+		}
+		size, err := resource.ParseQuantity(parts[1])
+		if err != nil || size.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid expansion policy entry %q, max size must be a positive quantity", entry)
+		}
+		policy[parts[0]] = DiskTypeUpgrade{
+			MaxSizeGb: BytesToGbRoundDown(size.Value()),
+			ToType:    parts[2],
+		}
+	}
+	return policy, nil
+}
+
+// Check returns an error if the policy does not allow a disk of diskType to
+// be expanded to sizeGb.
+func (p ExpansionPolicy) Check(diskType string, sizeGb int64) error {
+	upgrade, ok := p[diskType]
+	if !ok || sizeGb <= upgrade.MaxSizeGb {
+		return nil
+	}
+	return fmt.Errorf("disks of type %s may only be expanded to %vGB, larger disks must be migrated to type %s", diskType, upgrade.MaxSizeGb, upgrade.ToType)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpansionPolicy(t *testing.T) {
+	testCases := []struct {
+		name      string
+		policy    string
+		expPolicy ExpansionPolicy
+		expectErr bool
+	}{
+		{
+			name:      "empty",
+			expPolicy: ExpansionPolicy{},
+		},
+		{
+			name:   "several types",
+			policy: "pd-standard:2Ti:pd-balanced, pd-balanced:500Gi:pd-ssd",
+			expPolicy: ExpansionPolicy{
+				"pd-standard": {MaxSizeGb: 2048, ToType: "pd-balanced"},
+				"pd-balanced": {MaxSizeGb: 500, ToType: "pd-ssd"},
+			},
+		},
+		{
+			name:      "missing upgrade type",
+			policy:    "pd-standard:2Ti",
+			expectErr: true,
+		},
+		{
+			name:      "same type",
+			policy:    "pd-ssd:2Ti:pd-ssd",
+			expectErr: true,
+		},
+		{
+			name:      "invalid size",
+			policy:    "pd-standard:big:pd-ssd",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate type",
+			policy:    "pd-standard:2Ti:pd-ssd,pd-standard:1Ti:pd-balanced",
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		policy, err := ParseExpansionPolicy(tc.policy)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tc.name, policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(policy, tc.expPolicy) {
+			t.Errorf("%s: got %v, expected %v", tc.name, policy, tc.expPolicy)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// IOLimits are the per-device throughput and IOPS limits the node applies to
+// each pod a volume is published to. Zero fields are unlimited.
+type IOLimits struct {
+	ReadBytesPerSec  int64
+	WriteBytesPerSec int64
+	ReadIOPS         int64
+	WriteIOPS        int64
+}
+
+// ioLimitKeys are the keys of the io.max cgroup file, in the order of the
+// IOLimits fields.
+var ioLimitKeys = []string{"rbps", "wbps", "riops", "wiops"}
+
+func (l *IOLimits) fields() []*int64 {
+	return []*int64{&l.ReadBytesPerSec, &l.WriteBytesPerSec, &l.ReadIOPS, &l.WriteIOPS}
+}
+
+// IsZero returns true if no limit is set.
+func (l IOLimits) IsZero() bool {
+	return l == IOLimits{}
+}
+
+// String formats the limits that are set like the io.max cgroup file, for
+// example "rbps=104857600 wiops=1000".
+func (l IOLimits) String() string {
+	var parts []string
+	for i, field := range l.fields() {
+		if *field > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", ioLimitKeys[i], *field))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseIOLimits parses limits formatted by IOLimits.String.
+func ParseIOLimits(s string) (IOLimits, error) {
+	var l IOLimits
+	fields := l.fields()
+	for _, part := range strings.Fields(s) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("invalid IO limit %q, must be key=value", part)
+		}
+		i := indexOf(ioLimitKeys, kv[0])
+		if i < 0 {
+			return l, fmt.Errorf("invalid IO limit %q, key must be one of %v", part, ioLimitKeys)
+		}
+		v, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil || v <= 0 {
+			return l, fmt.Errorf("invalid IO limit %q, value must be a positive integer", part)
+		}
+		*fields[i] = v
+	}
+	return l, nil
+}
+
+func indexOf(values []string, v string) int {
+	for i, value := range values {
+		if value == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseBytesPerSec parses a throughput limit given as a quantity, such as
+// "100Mi".
+func parseBytesPerSec(key, v string) (int64, error) {
+	q, err := resource.ParseQuantity(v)
+	if err != nil || q.Sign() <= 0 {
+		return 0, fmt.Errorf("parameters contain invalid %s %q, must be a positive quantity of bytes such as 100Mi", key, v)
+	}
+	return q.Value(), nil
+}
+
+// parseIOPS parses an IOPS limit.
+func parseIOPS(key, v string) (int64, error) {
+	iops, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || iops <= 0 {
+		return 0, fmt.Errorf("parameters contain invalid %s %q, must be a positive integer", key, v)
+	}
+	return iops, nil
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// LogSampler limits how often messages with the same key are logged, so
+// that messages from frequent calls do not flood the logs.
+type LogSampler struct {
+	interval time.Duration
+	now      func() time.Time
+
+	samples map[string]*logSample
+	mux     sync.Mutex
+}
+
+type logSample struct {
+	logged     time.Time
+	suppressed int
+}
+
+// NewLogSampler returns a sampler that logs at most one message per key in
+// each interval. A zero interval logs every message.
+func NewLogSampler(interval time.Duration) *LogSampler {
+	return &LogSampler{
+		interval: interval,
+		now:      time.Now,
+		samples:  make(map[string]*logSample),
+	}
+}
+
+// Sample returns whether a message with key should be logged, and if so how
+// many messages with key were suppressed since the last one was logged. A nil
+// sampler logs every message.
+func (s *LogSampler) Sample(key string) (log bool, suppressed int) {
+	if s == nil || s.interval <= 0 {
+		return true, 0
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := s.now()
+	sample, ok := s.samples[key]
+	if !ok {
+		s.samples[key] = &logSample{logged: now}
+		return true, 0
+	}
+	if now.Sub(sample.logged) < s.interval {
+		sample.suppressed++
+		return false, 0
+	}
+	suppressed = sample.suppressed
+	sample.logged = now
+	sample.suppressed = 0
+	return true, suppressed
+}
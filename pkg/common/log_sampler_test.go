@@ -0,0 +1,61 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	start := time.Now()
+	now := start
+	s := NewLogSampler(time.Minute)
+	s.now = func() time.Time { return now }
+
+	steps := []struct {
+		name          string
+		key           string
+		after         time.Duration
+		expLog        bool
+		expSuppressed int
+	}{
+		{name: "first message", key: "a", expLog: true},
+		{name: "repeat", key: "a", after: time.Second, expLog: false},
+		{name: "other key", key: "b", after: 2 * time.Second, expLog: true},
+		{name: "repeat again", key: "a", after: 30 * time.Second, expLog: false},
+		{name: "interval passed", key: "a", after: time.Minute, expLog: true, expSuppressed: 2},
+		{name: "counts reset", key: "a", after: 2*time.Minute + time.Second, expLog: true},
+	}
+	for _, step := range steps {
+		now = start.Add(step.after)
+		log, suppressed := s.Sample(step.key)
+		if log != step.expLog || suppressed != step.expSuppressed {
+			t.Errorf("%s: Sample(%q) = %v, %d; expected %v, %d", step.name, step.key, log, suppressed, step.expLog, step.expSuppressed)
+		}
+	}
+}
+
+func TestLogSamplerDisabled(t *testing.T) {
+	for _, s := range []*LogSampler{nil, NewLogSampler(0)} {
+		for i := 0; i < 3; i++ {
+			if log, suppressed := s.Sample("a"); !log || suppressed != 0 {
+				t.Errorf("Sample() on sampler %v = %v, %d; expected true, 0", s, log, suppressed)
+			}
+		}
+	}
+}
@@ -18,14 +18,41 @@ package common
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
 )
 
 const (
 	ParameterKeyType                 = "type"
 	ParameterKeyReplicationType      = "replication-type"
+	ParameterKeyReplicaZones         = "replica-zones"
 	ParameterKeyDiskEncryptionKmsKey = "disk-encryption-kms-key"
 	ParameterKeyLabels               = "labels"
+	ParameterKeyDiskInterface        = "interface"
+	ParameterKeyMountHardening       = "mount-hardening"
+	ParameterKeyDiscard              = "discard"
+	ParameterKeyTrimAfterRestore     = "trim-after-restore"
+	ParameterKeyRegenerateFSUUID     = "regenerate-fs-uuid"
+	ParameterKeyReadOnlyRestore      = "read-only-restore"
+	ParameterKeyPublishMetadata      = "publish-metadata"
+	ParameterKeyNodeReadBytesPerSec  = "node-read-bytes-per-sec"
+	ParameterKeyNodeWriteBytesPerSec = "node-write-bytes-per-sec"
+	ParameterKeyNodeReadIOPS         = "node-read-iops"
+	ParameterKeyNodeWriteIOPS        = "node-write-iops"
+	ParameterKeyProvisionedIOPS      = "provisioned-iops-on-create"
+
+	// Keys for VolumeSnapshotClass parameters
+	ParameterKeySnapshotType = "snapshot-type"
+
+	// Values of the snapshot-type parameter. PD snapshots and images are
+	// also the collections named in their snapshot IDs.
+	DiskSnapshotType        = "snapshots"
+	DiskImageType           = "images"
+	DiskInstantSnapshotType = "instant-snapshots"
 
 	replicationTypeNone = "none"
 
@@ -37,8 +64,8 @@ const (
 	// Keys for tags to put in the provisioned disk description.
 	tagKeyCreatedForClaimNamespace = "kubernetes.io/created-for/pvc/namespace"
 	tagKeyCreatedForClaimName      = "kubernetes.io/created-for/pvc/name"
-	tagKeyCreatedForVolumeName     = "kubernetes.io/created-for/pv/name"
-	tagKeyCreatedBy                = "storage.gke.io/created-by"
+	TagKeyCreatedForVolumeName     = "kubernetes.io/created-for/pv/name"
+	TagKeyCreatedBy                = "storage.gke.io/created-by"
 )
 
 // DiskParameters contains normalized and defaulted disk parameters
@@ -49,6 +76,9 @@ type DiskParameters struct {
 	// Values: "none", regional-pd
 	// Default: "none"
 	ReplicationType string
+	// Values: {[]string}, two zones of one region, only for regional-pd
+	// Default: nil (picked from the topology requirement)
+	ReplicaZones []string
 	// Values: {string}
 	// Default: ""
 	DiskEncryptionKMSKey string
@@ -58,13 +88,76 @@ type DiskParameters struct {
 	// Values: {map[string]string}
 	// Default: ""
 	Labels map[string]string
+	// Values: NVME, SCSI
+	// Default: "" (the instance default)
+	DiskInterface string
+	// Values: {bool}, set when the mount-hardening parameter is false
+	// Default: false (hardening applies if the node enforces it)
+	DisableMountHardening bool
+	// Values: "true", "false"
+	// Default: "" (the mount options decide)
+	Discard string
+	// Values: {bool}
+	// Default: false
+	TrimAfterRestore bool
+	// Values: {bool}
+	// Default: false
+	RegenerateFSUUID bool
+	// Values: {bool}
+	// Default: false
+	ReadOnlyRestore bool
+	// Values: {bool}
+	// Default: false
+	PublishMetadata bool
+	// Values: {IOLimits}
+	// Default: no limits
+	NodeIOLimits IOLimits
+	// Values: {int64}, only for disk types with provisioned IOPS
+	// Default: 0 (the disk type default)
+	ProvisionedIOPSOnCreate int64
+}
+
+// SnapshotParameters contains normalized and defaulted snapshot parameters
+type SnapshotParameters struct {
+	// Values: snapshots, images, instant-snapshots
+	// Default: snapshots
+	SnapshotType string
+	// Values: {map[string]string}
+	// Default: ""
+	Labels map[string]string
 }
 
+// ParameterDefaults are driver-wide values used in place of the built-in
+// defaults for parameters that are not set in the StorageClass.
+type ParameterDefaults struct {
+	// Values: {string}
+	// Default: "" (use pd-standard)
+	DiskType string
+	// Values: {string}
+	// Default: ""
+	DiskEncryptionKMSKey string
+}
+
+// TopologyAliases translate the zone topology of distros that label nodes
+// with their own keys or zone names into GCE zones.
+type TopologyAliases struct {
+	// ZoneKeys are topology keys, besides TopologyKeyZone, whose values
+	// name the zone of a segment.
+	ZoneKeys []string
+	// Zones maps zone names used in topology segments to GCE zones.
+	Zones map[string]string
+}
+
+// kmsKeyNameRegex matches the resource name of a Cloud KMS key, optionally
+// of one of its versions, which GCE accepts as well.
+var kmsKeyNameRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+(/cryptoKeyVersions/[^/]+)?$`)
+
 // ExtractAndDefaultParameters will take the relevant parameters from a map and
 // put them into a well defined struct making sure to default unspecified fields.
 // extraVolumeLabels are added as labels; if there are also labels specified in
-// parameters, any matching extraVolumeLabels will be overridden.
-func ExtractAndDefaultParameters(parameters map[string]string, driverName string, extraVolumeLabels map[string]string) (DiskParameters, error) {
+// parameters, any matching extraVolumeLabels will be overridden. Non-empty
+// fields of defaults replace the built-in defaults.
+func ExtractAndDefaultParameters(parameters map[string]string, driverName string, extraVolumeLabels map[string]string, defaults ParameterDefaults) (DiskParameters, error) {
 	p := DiskParameters{
 		DiskType:             "pd-standard",           // Default
 		ReplicationType:      replicationTypeNone,     // Default
@@ -72,6 +165,12 @@ func ExtractAndDefaultParameters(parameters map[string]string, driverName string
 		Tags:                 make(map[string]string), // Default
 		Labels:               make(map[string]string), // Default
 	}
+	if defaults.DiskType != "" {
+		p.DiskType = strings.ToLower(defaults.DiskType)
+	}
+	if defaults.DiskEncryptionKMSKey != "" {
+		p.DiskEncryptionKMSKey = defaults.DiskEncryptionKMSKey
+	}
 
 	for k, v := range extraVolumeLabels {
 		p.Labels[k] = v
@@ -91,15 +190,121 @@ func ExtractAndDefaultParameters(parameters map[string]string, driverName string
 			if v != "" {
 				p.ReplicationType = strings.ToLower(v)
 			}
+		case ParameterKeyReplicaZones:
+			if v != "" {
+				zones, err := parseReplicaZones(v)
+				if err != nil {
+					return p, err
+				}
+				p.ReplicaZones = zones
+			}
 		case ParameterKeyDiskEncryptionKmsKey:
 			// Resource names (e.g. "keyRings", "cryptoKeys", etc.) are case sensitive, so do not change case
-			p.DiskEncryptionKMSKey = v
+			if v != "" {
+				p.DiskEncryptionKMSKey = v
+			}
 		case ParameterKeyPVCName:
 			p.Tags[tagKeyCreatedForClaimName] = v
 		case ParameterKeyPVCNamespace:
 			p.Tags[tagKeyCreatedForClaimNamespace] = v
 		case ParameterKeyPVName:
-			p.Tags[tagKeyCreatedForVolumeName] = v
+			p.Tags[TagKeyCreatedForVolumeName] = v
+		case ParameterKeyDiskInterface:
+			if v != "" {
+				diskInterface := strings.ToUpper(v)
+				if diskInterface != DiskInterfaceNVME && diskInterface != DiskInterfaceSCSI {
+					return p, fmt.Errorf("parameters contain invalid interface %q, must be %s or %s", v, DiskInterfaceNVME, DiskInterfaceSCSI)
+				}
+				p.DiskInterface = diskInterface
+			}
+		case ParameterKeyMountHardening:
+			if v != "" {
+				hardening, err := strconv.ParseBool(v)
+				if err != nil {
+					return p, fmt.Errorf("parameters contain invalid mount-hardening %q, must be true or false", v)
+				}
+				p.DisableMountHardening = !hardening
+			}
+		case ParameterKeyDiscard:
+			if v != "" {
+				discard, err := strconv.ParseBool(v)
+				if err != nil {
+					return p, fmt.Errorf("parameters contain invalid discard %q, must be true or false", v)
+				}
+				p.Discard = strconv.FormatBool(discard)
+			}
+		case ParameterKeyTrimAfterRestore:
+			if v != "" {
+				trim, err := strconv.ParseBool(v)
+				if err != nil {
+					return p, fmt.Errorf("parameters contain invalid trim-after-restore %q, must be true or false", v)
+				}
+				p.TrimAfterRestore = trim
+			}
+		case ParameterKeyRegenerateFSUUID:
+			if v != "" {
+				regenerate, err := strconv.ParseBool(v)
+				if err != nil {
+					return p, fmt.Errorf("parameters contain invalid regenerate-fs-uuid %q, must be true or false", v)
+				}
+				p.RegenerateFSUUID = regenerate
+			}
+		case ParameterKeyReadOnlyRestore:
+			if v != "" {
+				readOnly, err := strconv.ParseBool(v)
+				if err != nil {
+					return p, fmt.Errorf("parameters contain invalid read-only-restore %q, must be true or false", v)
+				}
+				p.ReadOnlyRestore = readOnly
+			}
+		case ParameterKeyPublishMetadata:
+			if v != "" {
+				publish, err := strconv.ParseBool(v)
+				if err != nil {
+					return p, fmt.Errorf("parameters contain invalid publish-metadata %q, must be true or false", v)
+				}
+				p.PublishMetadata = publish
+			}
+		case ParameterKeyNodeReadBytesPerSec:
+			if v != "" {
+				limit, err := parseBytesPerSec(ParameterKeyNodeReadBytesPerSec, v)
+				if err != nil {
+					return p, err
+				}
+				p.NodeIOLimits.ReadBytesPerSec = limit
+			}
+		case ParameterKeyNodeWriteBytesPerSec:
+			if v != "" {
+				limit, err := parseBytesPerSec(ParameterKeyNodeWriteBytesPerSec, v)
+				if err != nil {
+					return p, err
+				}
+				p.NodeIOLimits.WriteBytesPerSec = limit
+			}
+		case ParameterKeyNodeReadIOPS:
+			if v != "" {
+				limit, err := parseIOPS(ParameterKeyNodeReadIOPS, v)
+				if err != nil {
+					return p, err
+				}
+				p.NodeIOLimits.ReadIOPS = limit
+			}
+		case ParameterKeyNodeWriteIOPS:
+			if v != "" {
+				limit, err := parseIOPS(ParameterKeyNodeWriteIOPS, v)
+				if err != nil {
+					return p, err
+				}
+				p.NodeIOLimits.WriteIOPS = limit
+			}
+		case ParameterKeyProvisionedIOPS:
+			if v != "" {
+				iops, err := parseIOPS(ParameterKeyProvisionedIOPS, v)
+				if err != nil {
+					return p, err
+				}
+				p.ProvisionedIOPSOnCreate = iops
+			}
 		case ParameterKeyLabels:
 			paramLabels, err := ConvertLabelsStringToMap(v)
 			if err != nil {
@@ -113,8 +318,77 @@ func ExtractAndDefaultParameters(parameters map[string]string, driverName string
 			return p, fmt.Errorf("parameters contains invalid option %q", k)
 		}
 	}
+	if p.DiskEncryptionKMSKey != "" && !kmsKeyNameRegex.MatchString(p.DiskEncryptionKMSKey) {
+		return p, fmt.Errorf("parameters contain invalid %s %q, must be projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>", ParameterKeyDiskEncryptionKmsKey, p.DiskEncryptionKMSKey)
+	}
+	if p.ReadOnlyRestore && (p.TrimAfterRestore || p.RegenerateFSUUID) {
+		return p, fmt.Errorf("parameters contain read-only-restore with trim-after-restore or regenerate-fs-uuid, which write to the volume")
+	}
 	if len(p.Tags) > 0 {
-		p.Tags[tagKeyCreatedBy] = driverName
+		p.Tags[TagKeyCreatedBy] = driverName
+	}
+	return p, nil
+}
+
+// parseReplicaZones parses the comma-separated zones of the replica-zones
+// parameter, which must be two distinct zones of one region.
+func parseReplicaZones(v string) ([]string, error) {
+	var zones []string
+	seen := sets.NewString()
+	for _, zone := range strings.Split(v, ",") {
+		zone = strings.ToLower(strings.TrimSpace(zone))
+		if zone == "" || seen.Has(zone) {
+			continue
+		}
+		seen.Insert(zone)
+		zones = append(zones, zone)
+	}
+	if len(zones) != 2 {
+		return nil, fmt.Errorf("parameters contain invalid %s %q, must be two distinct zones", ParameterKeyReplicaZones, v)
+	}
+	if _, err := GetRegionFromZones(zones); err != nil {
+		return nil, fmt.Errorf("parameters contain invalid %s %q, the zones must be in one region: %v", ParameterKeyReplicaZones, v, err)
+	}
+	return zones, nil
+}
+
+// ExtractAndDefaultSnapshotParameters takes the parameters of a
+// VolumeSnapshotClass and puts them into a well defined struct, defaulting
+// unspecified fields.
+func ExtractAndDefaultSnapshotParameters(parameters map[string]string) (SnapshotParameters, error) {
+	p := SnapshotParameters{
+		SnapshotType: DiskSnapshotType,        // Default
+		Labels:       make(map[string]string), // Default
+	}
+	for k, v := range parameters {
+		if strings.HasPrefix(k, "csi.storage.k8s.io/") {
+			// Secret references and metadata added by the external-snapshotter
+			continue
+		}
+		switch strings.ToLower(k) {
+		case ParameterKeySnapshotType:
+			switch strings.ToLower(v) {
+			case "", DiskSnapshotType:
+				p.SnapshotType = DiskSnapshotType
+			case DiskImageType:
+				p.SnapshotType = DiskImageType
+			case DiskInstantSnapshotType:
+				p.SnapshotType = DiskInstantSnapshotType
+			default:
+				return p, fmt.Errorf("parameters contain invalid %s %q, must be %s, %s or %s", ParameterKeySnapshotType, v, DiskSnapshotType, DiskImageType, DiskInstantSnapshotType)
+			}
+		case ParameterKeyLabels:
+			labels, err := ConvertLabelsStringToMap(v)
+			if err != nil {
+				return p, fmt.Errorf("parameters contain invalid labels parameter: %w", err)
+			}
+			p.Labels = labels
+		default:
+			// A snapshot that fails on its parameters is retried
+			// forever by the external-snapshotter, so unknown ones are
+			// only logged.
+			klog.Warningf("Ignoring unknown snapshot parameter %q", k)
+		}
 	}
 	return p, nil
 }
@@ -26,6 +26,7 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 		name         string
 		parameters   map[string]string
 		labels       map[string]string
+		defaults     ParameterDefaults
 		expectParams DiskParameters
 		expectErr    bool
 	}{
@@ -61,12 +62,12 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 		},
 		{
 			name:       "values from parameters",
-			parameters: map[string]string{ParameterKeyType: "pd-ssd", ParameterKeyReplicationType: "regional-pd", ParameterKeyDiskEncryptionKmsKey: "foo/key", ParameterKeyLabels: "key1=value1,key2=value2"},
+			parameters: map[string]string{ParameterKeyType: "pd-ssd", ParameterKeyReplicationType: "regional-pd", ParameterKeyDiskEncryptionKmsKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo", ParameterKeyLabels: "key1=value1,key2=value2"},
 			labels:     map[string]string{},
 			expectParams: DiskParameters{
 				DiskType:             "pd-ssd",
 				ReplicationType:      "regional-pd",
-				DiskEncryptionKMSKey: "foo/key",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo",
 				Tags:                 map[string]string{},
 				Labels: map[string]string{
 					"key1": "value1",
@@ -76,24 +77,24 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 		},
 		{
 			name:       "values from parameters, checking balanced pd",
-			parameters: map[string]string{ParameterKeyType: "pd-balanced", ParameterKeyReplicationType: "regional-pd", ParameterKeyDiskEncryptionKmsKey: "foo/key"},
+			parameters: map[string]string{ParameterKeyType: "pd-balanced", ParameterKeyReplicationType: "regional-pd", ParameterKeyDiskEncryptionKmsKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo"},
 			labels:     map[string]string{},
 			expectParams: DiskParameters{
 				DiskType:             "pd-balanced",
 				ReplicationType:      "regional-pd",
-				DiskEncryptionKMSKey: "foo/key",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo",
 				Tags:                 map[string]string{},
 				Labels:               map[string]string{},
 			},
 		},
 		{
 			name:       "partial spec",
-			parameters: map[string]string{ParameterKeyDiskEncryptionKmsKey: "foo/key"},
+			parameters: map[string]string{ParameterKeyDiskEncryptionKmsKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo"},
 			labels:     map[string]string{},
 			expectParams: DiskParameters{
 				DiskType:             "pd-standard",
 				ReplicationType:      "none",
-				DiskEncryptionKMSKey: "foo/key",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo",
 				Tags:                 map[string]string{},
 				Labels:               map[string]string{},
 			},
@@ -106,7 +107,7 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 				DiskType:             "pd-standard",
 				ReplicationType:      "none",
 				DiskEncryptionKMSKey: "",
-				Tags:                 map[string]string{tagKeyCreatedForClaimName: "testPVCName", tagKeyCreatedForClaimNamespace: "testPVCNamespace", tagKeyCreatedForVolumeName: "testPVName", tagKeyCreatedBy: "testDriver"},
+				Tags:                 map[string]string{tagKeyCreatedForClaimName: "testPVCName", tagKeyCreatedForClaimNamespace: "testPVCNamespace", TagKeyCreatedForVolumeName: "testPVName", TagKeyCreatedBy: "testDriver"},
 				Labels:               map[string]string{},
 			},
 		},
@@ -146,11 +147,271 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 				Labels:               map[string]string{"key1": "value1", "label-1": "value-a", "label-2": "label-value-2"},
 			},
 		},
+		{
+			name:       "driver defaults",
+			parameters: map[string]string{},
+			labels:     map[string]string{},
+			defaults:   ParameterDefaults{DiskType: "PD-SSD", DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/default"},
+			expectParams: DiskParameters{
+				DiskType:             "pd-ssd",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/default",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+			},
+		},
+		{
+			name:       "parameters override driver defaults",
+			parameters: map[string]string{ParameterKeyType: "pd-balanced", ParameterKeyDiskEncryptionKmsKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo"},
+			labels:     map[string]string{},
+			defaults:   ParameterDefaults{DiskType: "pd-ssd", DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/default"},
+			expectParams: DiskParameters{
+				DiskType:             "pd-balanced",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+			},
+		},
+		{
+			name:       "specified empties keep driver defaults",
+			parameters: map[string]string{ParameterKeyType: "", ParameterKeyDiskEncryptionKmsKey: ""},
+			labels:     map[string]string{},
+			defaults:   ParameterDefaults{DiskType: "pd-ssd", DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/default"},
+			expectParams: DiskParameters{
+				DiskType:             "pd-ssd",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/default",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+			},
+		},
+		{
+			name:       "replica zones",
+			parameters: map[string]string{ParameterKeyReplicationType: "regional-pd", ParameterKeyReplicaZones: "us-central1-a, US-central1-b,us-central1-a"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:        "pd-standard",
+				ReplicationType: "regional-pd",
+				ReplicaZones:    []string{"us-central1-a", "us-central1-b"},
+				Tags:            map[string]string{},
+				Labels:          map[string]string{},
+			},
+		},
+		{
+			name:       "one replica zone",
+			parameters: map[string]string{ParameterKeyReplicationType: "regional-pd", ParameterKeyReplicaZones: "us-central1-a"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "replica zones in two regions",
+			parameters: map[string]string{ParameterKeyReplicationType: "regional-pd", ParameterKeyReplicaZones: "us-central1-a,us-east1-b"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "interface is normalized",
+			parameters: map[string]string{ParameterKeyDiskInterface: "nvme"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:        "pd-standard",
+				ReplicationType: "none",
+				Tags:            map[string]string{},
+				Labels:          map[string]string{},
+				DiskInterface:   DiskInterfaceNVME,
+			},
+		},
+		{
+			name:       "invalid interface",
+			parameters: map[string]string{ParameterKeyDiskInterface: "ide"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "mount hardening disabled",
+			parameters: map[string]string{ParameterKeyMountHardening: "false"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:              "pd-standard",
+				ReplicationType:       "none",
+				Tags:                  map[string]string{},
+				Labels:                map[string]string{},
+				DisableMountHardening: true,
+			},
+		},
+		{
+			name:       "mount hardening enabled",
+			parameters: map[string]string{ParameterKeyMountHardening: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:        "pd-standard",
+				ReplicationType: "none",
+				Tags:            map[string]string{},
+				Labels:          map[string]string{},
+			},
+		},
+		{
+			name:       "invalid mount hardening",
+			parameters: map[string]string{ParameterKeyMountHardening: "off"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "discard and trim after restore",
+			parameters: map[string]string{ParameterKeyDiscard: "False", ParameterKeyTrimAfterRestore: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:         "pd-standard",
+				ReplicationType:  "none",
+				Tags:             map[string]string{},
+				Labels:           map[string]string{},
+				Discard:          "false",
+				TrimAfterRestore: true,
+			},
+		},
+		{
+			name:       "invalid discard",
+			parameters: map[string]string{ParameterKeyDiscard: "sometimes"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid trim after restore",
+			parameters: map[string]string{ParameterKeyTrimAfterRestore: "yes"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "regenerate fs uuid",
+			parameters: map[string]string{ParameterKeyRegenerateFSUUID: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:         "pd-standard",
+				ReplicationType:  "none",
+				Tags:             map[string]string{},
+				Labels:           map[string]string{},
+				RegenerateFSUUID: true,
+			},
+		},
+		{
+			name:       "invalid regenerate fs uuid",
+			parameters: map[string]string{ParameterKeyRegenerateFSUUID: "maybe"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "read only restore",
+			parameters: map[string]string{ParameterKeyReadOnlyRestore: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:        "pd-standard",
+				ReplicationType: "none",
+				Tags:            map[string]string{},
+				Labels:          map[string]string{},
+				ReadOnlyRestore: true,
+			},
+		},
+		{
+			name:       "read only restore with trim after restore",
+			parameters: map[string]string{ParameterKeyReadOnlyRestore: "true", ParameterKeyTrimAfterRestore: "true"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "publish metadata",
+			parameters: map[string]string{ParameterKeyPublishMetadata: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:        "pd-standard",
+				ReplicationType: "none",
+				Tags:            map[string]string{},
+				Labels:          map[string]string{},
+				PublishMetadata: true,
+			},
+		},
+		{
+			name: "node io limits",
+			parameters: map[string]string{
+				ParameterKeyNodeReadBytesPerSec:  "100Mi",
+				ParameterKeyNodeWriteBytesPerSec: "50M",
+				ParameterKeyNodeWriteIOPS:        "1000",
+			},
+			labels: map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:        "pd-standard",
+				ReplicationType: "none",
+				Tags:            map[string]string{},
+				Labels:          map[string]string{},
+				NodeIOLimits: IOLimits{
+					ReadBytesPerSec:  100 * 1024 * 1024,
+					WriteBytesPerSec: 50 * 1000 * 1000,
+					WriteIOPS:        1000,
+				},
+			},
+		},
+		{
+			name:       "invalid node bytes per second",
+			parameters: map[string]string{ParameterKeyNodeReadBytesPerSec: "-1Mi"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid node iops",
+			parameters: map[string]string{ParameterKeyNodeReadIOPS: "1.5"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name: "provisioned iops",
+			parameters: map[string]string{
+				ParameterKeyType:            "pd-extreme",
+				ParameterKeyProvisionedIOPS: "10000",
+			},
+			labels: map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:                "pd-extreme",
+				ReplicationType:         "none",
+				Tags:                    map[string]string{},
+				Labels:                  map[string]string{},
+				ProvisionedIOPSOnCreate: 10000,
+			},
+		},
+		{
+			name:       "invalid provisioned iops",
+			parameters: map[string]string{ParameterKeyProvisionedIOPS: "0"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "kms key version",
+			parameters: map[string]string{ParameterKeyDiskEncryptionKmsKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo/cryptoKeyVersions/1"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/foo/cryptoKeyVersions/1",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+			},
+		},
+		{
+			name:       "invalid kms key",
+			parameters: map[string]string{ParameterKeyDiskEncryptionKmsKey: "keyRings/r/cryptoKeys/foo"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid publish metadata",
+			parameters: map[string]string{ParameterKeyPublishMetadata: "always"},
+			labels:     map[string]string{},
+			expectErr:  true,
+		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			p, err := ExtractAndDefaultParameters(tc.parameters, "testDriver", tc.labels)
+			p, err := ExtractAndDefaultParameters(tc.parameters, "testDriver", tc.labels, tc.defaults)
 			if gotErr := err != nil; gotErr != tc.expectErr {
 				t.Fatalf("ExtractAndDefaultParameters(%+v) = %v; expectedErr: %v", tc.parameters, err, tc.expectErr)
 			}
@@ -164,3 +425,94 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractAndDefaultSnapshotParameters(t *testing.T) {
+	testCases := []struct {
+		name       string
+		parameters map[string]string
+		expParams  SnapshotParameters
+		expErr     bool
+	}{
+		{
+			name:      "defaults",
+			expParams: SnapshotParameters{SnapshotType: DiskSnapshotType, Labels: map[string]string{}},
+		},
+		{
+			name:       "images",
+			parameters: map[string]string{ParameterKeySnapshotType: "Images"},
+			expParams:  SnapshotParameters{SnapshotType: DiskImageType, Labels: map[string]string{}},
+		},
+		{
+			name:       "instant snapshots",
+			parameters: map[string]string{ParameterKeySnapshotType: "instant-snapshots"},
+			expParams:  SnapshotParameters{SnapshotType: DiskInstantSnapshotType, Labels: map[string]string{}},
+		},
+		{
+			name: "snapshotter metadata",
+			parameters: map[string]string{
+				"csi.storage.k8s.io/volumesnapshot/name": "snap",
+				ParameterKeySnapshotType:                 DiskSnapshotType,
+			},
+			expParams: SnapshotParameters{SnapshotType: DiskSnapshotType, Labels: map[string]string{}},
+		},
+		{
+			name:       "labels",
+			parameters: map[string]string{ParameterKeyLabels: "team=storage, backup=nightly"},
+			expParams: SnapshotParameters{
+				SnapshotType: DiskSnapshotType,
+				Labels:       map[string]string{"team": "storage", "backup": "nightly"},
+			},
+		},
+		{
+			name:       "invalid labels",
+			parameters: map[string]string{ParameterKeyLabels: "team"},
+			expErr:     true,
+		},
+		{
+			name:       "invalid snapshot type",
+			parameters: map[string]string{ParameterKeySnapshotType: "machine-images"},
+			expErr:     true,
+		},
+		{
+			name:       "unknown parameter is ignored",
+			parameters: map[string]string{"foo": "bar", ParameterKeySnapshotType: DiskImageType},
+			expParams:  SnapshotParameters{SnapshotType: DiskImageType, Labels: map[string]string{}},
+		},
+	}
+	for _, tc := range testCases {
+		p, err := ExtractAndDefaultSnapshotParameters(tc.parameters)
+		if tc.expErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", tc.name, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tc.expParams) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, p, tc.expParams)
+		}
+	}
+}
+
+func TestIOLimitsRoundTrip(t *testing.T) {
+	limits := IOLimits{ReadBytesPerSec: 1048576, WriteIOPS: 500}
+	s := limits.String()
+	if s != "rbps=1048576 wiops=500" {
+		t.Errorf("String() = %q, expected %q", s, "rbps=1048576 wiops=500")
+	}
+	parsed, err := ParseIOLimits(s)
+	if err != nil {
+		t.Fatalf("ParseIOLimits(%q) failed: %v", s, err)
+	}
+	if parsed != limits {
+		t.Errorf("ParseIOLimits(%q) = %+v, expected %+v", s, parsed, limits)
+	}
+	for _, invalid := range []string{"rbps", "rbps=0", "rbps=max", "iops=10"} {
+		if _, err := ParseIOLimits(invalid); err == nil {
+			t.Errorf("ParseIOLimits(%q) succeeded, expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RequestCoalescer lets concurrent callers with the same key share the
+// result of a single call instead of each making their own.
+type RequestCoalescer struct {
+	pending map[string]*coalescedRequest
+	mux     sync.Mutex
+	// timeout bounds each shared call, which does not run on the context of
+	// any of its callers.
+	timeout time.Duration
+}
+
+type coalescedRequest struct {
+	done chan struct{}
+	resp interface{}
+	err  error
+}
+
+func NewRequestCoalescer(timeout time.Duration) *RequestCoalescer {
+	return &RequestCoalescer{
+		pending: make(map[string]*coalescedRequest),
+		timeout: timeout,
+	}
+}
+
+// Do calls fn and returns its result, unless a call with the same key is
+// already in flight, in which case it waits for that call and returns its
+// result instead. shared reports whether the result came from another call.
+// fn runs on a context detached from ctx, bounded by the coalescer timeout,
+// so that a caller that goes away, such as a restarted sidecar, does not
+// cancel the call for the others. Every caller stops waiting when its own
+// ctx is done.
+func (rc *RequestCoalescer) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (resp interface{}, shared bool, err error) {
+	rc.mux.Lock()
+	req, shared := rc.pending[key]
+	if !shared {
+		req = &coalescedRequest{done: make(chan struct{})}
+		rc.pending[key] = req
+		go rc.run(key, req, fn)
+	}
+	rc.mux.Unlock()
+
+	select {
+	case <-req.done:
+		return req.resp, shared, req.err
+	case <-ctx.Done():
+		return nil, shared, ctx.Err()
+	}
+}
+
+func (rc *RequestCoalescer) run(key string, req *coalescedRequest, fn func(ctx context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), rc.timeout)
+	defer cancel()
+	defer func() {
+		rc.mux.Lock()
+		delete(rc.pending, key)
+		rc.mux.Unlock()
+		close(req.done)
+	}()
+	req.resp, req.err = fn(ctx)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy controls how the driver retries a failed CSI call before
+// returning the error to the caller.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Zero or one disables retries.
+	MaxAttempts int
+	// PerAttemptTimeout bounds each attempt. Zero leaves only the caller's
+	// deadline in effect.
+	PerAttemptTimeout time.Duration
+	// Backoff is the pause before the first retry. It doubles after each
+	// further attempt.
+	Backoff time.Duration
+	// RetryableCodes are the status codes for which a call is retried.
+	RetryableCodes []codes.Code
+}
+
+// Retryable returns true if err has one of the policy's retryable codes.
+func (p *RetryPolicy) Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := status.Code(err)
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -39,6 +39,13 @@ const (
 	// Snapshot ID
 	snapshotTotalElements = 5
 	snapshotTopologyKey   = 2
+	snapshotTypeValue     = 3
+
+	// Instant snapshot ID
+	// "projects/{projectName}/{zones|regions}/{location}/instantSnapshots/{name}"
+	instantSnapshotsCollection   = "instantSnapshots"
+	instantSnapshotTypeValue     = 4
+	instantSnapshotTotalElements = 6
 
 	// Node ID Expected Format
 	// "projects/{projectName}/zones/{zoneName}/disks/{diskName}"
@@ -100,15 +107,33 @@ func GenerateUnderspecifiedVolumeID(diskName string, isZonal bool) string {
 	return fmt.Sprintf(volIDRegionalFmt, UnspecifiedValue, UnspecifiedValue, diskName)
 }
 
-func SnapshotIDToKey(id string) (string, error) {
+// SnapshotIDToKey returns the type, DiskSnapshotType, DiskImageType or
+// DiskInstantSnapshotType, and the key of the snapshot with ID id. PD
+// snapshots and images are global, instant snapshots are zonal or regional.
+func SnapshotIDToKey(id string) (string, *meta.Key, error) {
 	splitId := strings.Split(id, "/")
+	if len(splitId) == instantSnapshotTotalElements && splitId[instantSnapshotTypeValue] == instantSnapshotsCollection {
+		name := splitId[instantSnapshotTotalElements-1]
+		switch splitId[volIDToplogyKey] {
+		case "zones":
+			return DiskInstantSnapshotType, meta.ZonalKey(name, splitId[volIDToplogyValue]), nil
+		case "regions":
+			return DiskInstantSnapshotType, meta.RegionalKey(name, splitId[volIDToplogyValue]), nil
+		default:
+			return "", nil, fmt.Errorf("could not get id components, expected either zones or regions, got: %v", splitId[volIDToplogyKey])
+		}
+	}
 	if len(splitId) != snapshotTotalElements {
-		return "", fmt.Errorf("failed to get id components. Expected projects/{project}/global/snapshot/{name}. Got: %s", id)
+		return "", nil, fmt.Errorf("failed to get id components. Expected projects/{project}/global/{snapshots|images}/{name} or projects/{project}/{zones|regions}/{location}/instantSnapshots/{name}. Got: %s", id)
 	}
-	if splitId[snapshotTopologyKey] == "global" {
-		return splitId[snapshotTotalElements-1], nil
-	} else {
-		return "", fmt.Errorf("could not get id components, expected global, got: %v", splitId[snapshotTopologyKey])
+	if splitId[snapshotTopologyKey] != "global" {
+		return "", nil, fmt.Errorf("could not get id components, expected global, got: %v", splitId[snapshotTopologyKey])
+	}
+	switch snapshotType := splitId[snapshotTypeValue]; snapshotType {
+	case DiskSnapshotType, DiskImageType:
+		return snapshotType, meta.GlobalKey(splitId[snapshotTotalElements-1]), nil
+	default:
+		return "", nil, fmt.Errorf("could not get id components, expected %s or %s, got: %v", DiskSnapshotType, DiskImageType, snapshotType)
 	}
 }
 
@@ -239,6 +239,77 @@ func TestNodeIDToZoneAndName(t *testing.T) {
 	}
 }
 
+func TestSnapshotIDToKey(t *testing.T) {
+	testCases := []struct {
+		name       string
+		snapshotID string
+		expType    string
+		expKey     *meta.Key
+		expErr     bool
+	}{
+		{
+			name:       "snapshot",
+			snapshotID: "projects/test-project/global/snapshots/test-name",
+			expType:    DiskSnapshotType,
+			expKey:     meta.GlobalKey("test-name"),
+		},
+		{
+			name:       "image",
+			snapshotID: "projects/test-project/global/images/test-name",
+			expType:    DiskImageType,
+			expKey:     meta.GlobalKey("test-name"),
+		},
+		{
+			name:       "zonal instant snapshot",
+			snapshotID: "projects/test-project/zones/test-zone/instantSnapshots/test-name",
+			expType:    DiskInstantSnapshotType,
+			expKey:     meta.ZonalKey("test-name", "test-zone"),
+		},
+		{
+			name:       "regional instant snapshot",
+			snapshotID: "projects/test-project/regions/test-region/instantSnapshots/test-name",
+			expType:    DiskInstantSnapshotType,
+			expKey:     meta.RegionalKey("test-name", "test-region"),
+		},
+		{
+			name:       "global instant snapshot",
+			snapshotID: "projects/test-project/global/instantSnapshots/test-name",
+			expErr:     true,
+		},
+		{
+			name:       "unknown type",
+			snapshotID: "projects/test-project/global/machineImages/test-name",
+			expErr:     true,
+		},
+		{
+			name:       "not global",
+			snapshotID: "projects/test-project/zones/test-zone/snapshots/test-name",
+			expErr:     true,
+		},
+		{
+			name:       "malformed",
+			snapshotID: "wrong",
+			expErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		snapshotType, key, err := SnapshotIDToKey(tc.snapshotID)
+		if tc.expErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s %v", tc.name, snapshotType, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if snapshotType != tc.expType || !reflect.DeepEqual(key, tc.expKey) {
+			t.Errorf("%s: got %s %v, expected %s %v", tc.name, snapshotType, key, tc.expType, tc.expKey)
+		}
+	}
+}
+
 func TestGetRegionFromZones(t *testing.T) {
 	testCases := []struct {
 		name      string
@@ -17,6 +17,7 @@ limitations under the License.
 package common
 
 import (
+	"context"
 	"sync"
 
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -30,12 +31,17 @@ const (
 // with an ongoing operation.
 type VolumeLocks struct {
 	locks sets.String
-	mux   sync.Mutex
+	// waiters holds, per volume ID, the channels of the Acquire calls
+	// waiting for the lock in the order they started to wait. Release hands
+	// the lock to the first of them by closing its channel.
+	waiters map[string][]chan struct{}
+	mux     sync.Mutex
 }
 
 func NewVolumeLocks() *VolumeLocks {
 	return &VolumeLocks{
-		locks: sets.NewString(),
+		locks:   sets.NewString(),
+		waiters: make(map[string][]chan struct{}),
 	}
 }
 
@@ -51,8 +57,67 @@ func (vl *VolumeLocks) TryAcquire(volumeID string) bool {
 	return true
 }
 
+// Acquire waits until it acquires the lock for operating on volumeID, or
+// returns the error of ctx if ctx is done first. Callers waiting for the
+// same volume ID acquire the lock in the order they called Acquire.
+func (vl *VolumeLocks) Acquire(ctx context.Context, volumeID string) error {
+	vl.mux.Lock()
+	if !vl.locks.Has(volumeID) {
+		vl.locks.Insert(volumeID)
+		vl.mux.Unlock()
+		return nil
+	}
+	acquired := make(chan struct{})
+	vl.waiters[volumeID] = append(vl.waiters[volumeID], acquired)
+	vl.mux.Unlock()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+	}
+
+	vl.mux.Lock()
+	waiters := vl.waiters[volumeID]
+	for i, w := range waiters {
+		if w == acquired {
+			vl.removeWaiter(volumeID, i)
+			vl.mux.Unlock()
+			return ctx.Err()
+		}
+	}
+	vl.mux.Unlock()
+	// The lock was handed over while ctx was done, so pass it on.
+	vl.Release(volumeID)
+	return ctx.Err()
+}
+
+// removeWaiter removes the i-th waiter of volumeID. vl.mux must be held.
+func (vl *VolumeLocks) removeWaiter(volumeID string, i int) {
+	waiters := vl.waiters[volumeID]
+	waiters = append(waiters[:i], waiters[i+1:]...)
+	if len(waiters) == 0 {
+		delete(vl.waiters, volumeID)
+		return
+	}
+	vl.waiters[volumeID] = waiters
+}
+
+// List returns the sorted volume IDs that have an ongoing operation.
+func (vl *VolumeLocks) List() []string {
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+	return vl.locks.List()
+}
+
 func (vl *VolumeLocks) Release(volumeID string) {
 	vl.mux.Lock()
 	defer vl.mux.Unlock()
+	if waiters, ok := vl.waiters[volumeID]; ok {
+		// The lock stays held, by the first waiter.
+		close(waiters[0])
+		vl.removeWaiter(volumeID, 0)
+		return
+	}
 	vl.locks.Delete(volumeID)
 }
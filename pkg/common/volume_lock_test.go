@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVolumeLocksAcquire(t *testing.T) {
+	vl := NewVolumeLocks()
+	if err := vl.Acquire(context.Background(), "vol"); err != nil {
+		t.Fatalf("Acquire() of a free lock failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := vl.Acquire(ctx, "vol"); err != context.DeadlineExceeded {
+		t.Errorf("Acquire() of a held lock = %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	acquired := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			acquired <- vl.Acquire(context.Background(), "vol")
+		}()
+	}
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquire() returned %v while the lock was held", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Each release lets exactly one waiter acquire the lock.
+	for i := 0; i < 2; i++ {
+		vl.Release("vol")
+		if err := <-acquired; err != nil {
+			t.Errorf("Acquire() after release failed: %v", err)
+		}
+		select {
+		case err := <-acquired:
+			t.Fatalf("Acquire() returned %v while the lock was held", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if vl.TryAcquire("vol") {
+		t.Errorf("TryAcquire() succeeded while the lock was held")
+	}
+	vl.Release("vol")
+	if !vl.TryAcquire("vol") {
+		t.Errorf("TryAcquire() failed after the lock was released")
+	}
+}
+
+func TestVolumeLocksAcquireOrder(t *testing.T) {
+	vl := NewVolumeLocks()
+	if !vl.TryAcquire("vol") {
+		t.Fatalf("TryAcquire() of a free lock failed")
+	}
+
+	// The second waiter gives up, which must not disturb the others.
+	const waiters = 4
+	order := make(chan int, waiters)
+	ctxs := make([]context.Context, waiters)
+	cancels := make([]context.CancelFunc, waiters)
+	for i := 0; i < waiters; i++ {
+		ctxs[i], cancels[i] = context.WithCancel(context.Background())
+		defer cancels[i]()
+		go func(i int) {
+			if err := vl.Acquire(ctxs[i], "vol"); err != nil {
+				return
+			}
+			order <- i
+		}(i)
+		// Let the waiter queue up before starting the next one.
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancels[1]()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, exp := range []int{0, 2, 3} {
+		vl.Release("vol")
+		if got := <-order; got != exp {
+			t.Errorf("waiter %d acquired the lock, expected waiter %d", got, exp)
+		}
+	}
+	vl.Release("vol")
+	if !vl.TryAcquire("vol") {
+		t.Errorf("TryAcquire() failed after the lock was released")
+	}
+}
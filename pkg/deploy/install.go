@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	controllerDeployment   = "csi-gce-pd-controller"
+	linuxNodeDaemonSet     = "csi-gce-pd-node"
+	windowsNodeDaemonSet   = "csi-gce-pd-node-win"
+	serviceAccountSecret   = "cloud-sa"
+	serviceAccountKeyField = "cloud-sa.json"
+
+	waitInterval = 10 * time.Second
+	waitTimeout  = 15 * time.Minute
+)
+
+// Install installs the driver rendered from the overlay in overlayDir with
+// opts into the cluster of client, and waits for it to come up. The overlay
+// must be one Render supports. The objects
+// are applied with kubectl, which must be configured for the same cluster.
+// On GKE the caller must be a cluster admin to create the driver RBAC.
+func Install(ctx context.Context, client kubernetes.Interface, overlayDir string, opts Options) error {
+	manifests, err := Render(overlayDir, opts)
+	if err != nil {
+		return fmt.Errorf("failed to render driver manifests: %v", err)
+	}
+	klog.V(4).Infof("Rendered driver manifests:\n%s", manifests)
+
+	namespace := opts.Namespace
+	if namespace != "" {
+		_, err = client.CoreV1().Namespaces().Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create namespace %s: %v", namespace, err)
+		}
+	}
+	if opts.ServiceAccountKeyFile != "" {
+		key, err := ioutil.ReadFile(opts.ServiceAccountKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read service account key: %v", err)
+		}
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: serviceAccountSecret, Namespace: namespace},
+			Data:       map[string][]byte{serviceAccountKeyField: key},
+		}
+		_, err = client.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create service account secret: %v", err)
+		}
+	}
+
+	if err := kubectl("Applying driver manifests", manifests, "apply", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to apply driver manifests: %v", err)
+	}
+	return WaitForDriver(ctx, client, namespace, opts.Windows)
+}
+
+// Delete deletes a driver installed by Install with the same overlayDir and
+// opts, including its namespace.
+func Delete(ctx context.Context, client kubernetes.Interface, overlayDir string, opts Options) error {
+	manifests, err := Render(overlayDir, opts)
+	if err != nil {
+		return fmt.Errorf("failed to render driver manifests: %v", err)
+	}
+	if err := kubectl("Deleting driver manifests", manifests, "delete", "--ignore-not-found", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to delete driver manifests: %v", err)
+	}
+	if opts.Namespace == "" {
+		return nil
+	}
+	err = client.CoreV1().Namespaces().Delete(ctx, opts.Namespace, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete namespace %s: %v", opts.Namespace, err)
+	}
+	return nil
+}
+
+// WaitForDriver waits until the controller deployment in namespace is
+// available and all pods of the node daemonset, the Windows one if windows
+// is set, are ready.
+func WaitForDriver(ctx context.Context, client kubernetes.Interface, namespace string, windows bool) error {
+	nodeDaemonSet := linuxNodeDaemonSet
+	if windows {
+		nodeDaemonSet = windowsNodeDaemonSet
+	}
+	return wait.PollImmediate(waitInterval, waitTimeout, func() (bool, error) {
+		deployment, err := client.AppsV1().Deployments(namespace).Get(ctx, controllerDeployment, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("Failed to get deployment %s: %v", controllerDeployment, err)
+			return false, nil
+		}
+		available := false
+		for _, c := range deployment.Status.Conditions {
+			if c.Type == appsv1.DeploymentAvailable && c.Status == v1.ConditionTrue {
+				available = true
+			}
+		}
+		ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, nodeDaemonSet, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("Failed to get daemonset %s: %v", nodeDaemonSet, err)
+			return false, nil
+		}
+		ready := ds.Status.DesiredNumberScheduled > 0 && ds.Status.NumberReady == ds.Status.DesiredNumberScheduled
+		klog.Infof("Waiting for driver: controller available %v, node pods ready %d/%d", available, ds.Status.NumberReady, ds.Status.DesiredNumberScheduled)
+		return available && ready, nil
+	})
+}
+
+// kubectl runs kubectl with args and stdin, streaming its output.
+func kubectl(action string, stdin []byte, args ...string) error {
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	klog.Infof("%s: %v", action, cmd.Args)
+	return cmd.Run()
+}
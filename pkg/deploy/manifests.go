@@ -0,0 +1,472 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deploy installs the driver into a cluster from the kustomize
+// overlays under deploy/kubernetes, so that test suites and tools can
+// install it without kustomize or the deploy scripts.
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+// The manifests are rendered from the overlays in Go. Only the kustomization
+// features used by the plain overlays are supported: resources, namespace,
+// images and image tag transformers. Overlays that need patches must still
+// be deployed with kustomize.
+
+const (
+	// DriverImagePlaceholder is the driver image name in the base
+	// manifests, which the overlays and Options.DriverImage replace.
+	DriverImagePlaceholder = "gke.gcr.io/gcp-compute-persistent-disk-csi-driver"
+
+	driverContainerName = "gce-pd-driver"
+	kustomizationFile   = "kustomization.yaml"
+	featureGatesArg     = "--feature-gates="
+)
+
+// Kinds that are not namespaced and so are left alone by the namespace
+// transform.
+var clusterScopedKinds = sets.NewString(
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"CSIDriver",
+	"CustomResourceDefinition",
+	"Namespace",
+	"PodSecurityPolicy",
+	"PriorityClass",
+	"StorageClass",
+)
+
+// Options parameterize the installed driver on top of its overlay.
+type Options struct {
+	// Namespace, if set, replaces the overlay namespace.
+	Namespace string
+	// DriverImage, if set, replaces the driver image, including its tag.
+	DriverImage string
+	// ExtraDriverArgs are appended to the args of every driver container,
+	// for example to enable features under test.
+	ExtraDriverArgs []string
+	// FeatureGates are set on the sidecars that take feature gates, over
+	// the gates the overlay sets.
+	FeatureGates map[string]bool
+	// Windows installs the Windows node daemonset alongside the Linux one,
+	// and makes Install wait for it instead.
+	Windows bool
+	// ControllerMetricsEndpoint and NodeMetricsEndpoint, if set, are the
+	// --http-endpoint of the controller and node driver containers. They
+	// differ as both use the host network and may share a node. Setting
+	// NodeMetricsEndpoint also sets --enable-node-metrics, without which the
+	// node driver serves no metrics.
+	ControllerMetricsEndpoint string
+	NodeMetricsEndpoint       string
+	// ServiceAccountKeyFile, if set, is the GCP service account key that
+	// Install stores in the cloud-sa secret the controller mounts. Every
+	// overlay Install can render, see Render, mounts it.
+	ServiceAccountKeyFile string
+}
+
+type kustomization struct {
+	Namespace             string        `json:"namespace"`
+	Resources             []string      `json:"resources"`
+	Transformers          []string      `json:"transformers"`
+	Images                []imageChange `json:"images"`
+	PatchesStrategicMerge []string      `json:"patchesStrategicMerge"`
+	PatchesJson6902       []interface{} `json:"patchesJson6902"`
+}
+
+type imageChange struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName"`
+	NewTag  string `json:"newTag"`
+}
+
+// imageTagTransformer is the builtin kustomize transformer used by the
+// deploy/kubernetes/images directories.
+type imageTagTransformer struct {
+	Kind     string      `json:"kind"`
+	ImageTag imageChange `json:"imageTag"`
+}
+
+type object map[string]interface{}
+
+// OverlayDir returns the directory of the overlay named overlay in the
+// source tree rooted at pkgDir.
+func OverlayDir(pkgDir, overlay string) string {
+	return filepath.Join(pkgDir, "deploy", "kubernetes", "overlays", overlay)
+}
+
+// Render renders the overlay in overlayDir with opts applied and returns the
+// objects as a multi-document YAML stream. Only overlays without patches can
+// be rendered, such as stable-master, alpha, windows-host-process and the
+// prow overlays of recent releases; overlays with patches, such as dev,
+// noauth and operator, must be installed with kustomize.
+func Render(overlayDir string, opts Options) ([]byte, error) {
+	objs, err := renderKustomization(overlayDir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Namespace != "" {
+		setNamespace(objs, opts.Namespace)
+	}
+	if !opts.Windows {
+		objs = withoutWindowsWorkloads(objs)
+	}
+	if opts.DriverImage != "" {
+		name, tag := splitImage(opts.DriverImage)
+		setImages(objs, []imageChange{{Name: DriverImagePlaceholder, NewName: name, NewTag: tag}})
+	}
+	if len(opts.ExtraDriverArgs) > 0 {
+		if err := addDriverArgs(objs, opts.ExtraDriverArgs); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.FeatureGates) > 0 {
+		setFeatureGates(objs, opts.FeatureGates)
+	}
+	if opts.ControllerMetricsEndpoint != "" {
+		if err := addDriverArgs(objectsOfKind(objs, "Deployment"), []string{"--http-endpoint=" + opts.ControllerMetricsEndpoint}); err != nil {
+			return nil, err
+		}
+	}
+	if opts.NodeMetricsEndpoint != "" {
+		if err := addDriverArgs(objectsOfKind(objs, "DaemonSet"), []string{"--enable-node-metrics", "--http-endpoint=" + opts.NodeMetricsEndpoint}); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, obj := range objs {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s %s: %v", obj["kind"], objectName(obj), err)
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+func renderKustomization(dir string) ([]object, error) {
+	k, err := readKustomization(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.PatchesStrategicMerge) > 0 || len(k.PatchesJson6902) > 0 {
+		return nil, fmt.Errorf("%s uses patches, which are not supported without kustomize", dir)
+	}
+
+	var objs []object
+	for _, resource := range k.Resources {
+		path := filepath.Join(dir, resource)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read resource %s: %v", path, err)
+		}
+		var resourceObjs []object
+		if info.IsDir() {
+			resourceObjs, err = renderKustomization(path)
+		} else {
+			resourceObjs, err = readObjects(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, resourceObjs...)
+	}
+
+	if k.Namespace != "" {
+		setNamespace(objs, k.Namespace)
+	}
+	images := k.Images
+	for _, transformer := range k.Transformers {
+		transformerImages, err := readImageTransformers(filepath.Join(dir, transformer))
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, transformerImages...)
+	}
+	setImages(objs, images)
+	return objs, nil
+}
+
+func readKustomization(dir string) (*kustomization, error) {
+	path := filepath.Join(dir, kustomizationFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	k := &kustomization{}
+	if err := yaml.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return k, nil
+}
+
+// readImageTransformers reads the ImageTagTransformer resources of the
+// kustomization in dir.
+func readImageTransformers(dir string) ([]imageChange, error) {
+	k, err := readKustomization(dir)
+	if err != nil {
+		return nil, err
+	}
+	var images []imageChange
+	for _, resource := range k.Resources {
+		path := filepath.Join(dir, resource)
+		docs, err := readDocuments(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			t := imageTagTransformer{}
+			if err := yaml.Unmarshal(doc, &t); err != nil {
+				return nil, fmt.Errorf("failed to parse transformer in %s: %v", path, err)
+			}
+			if t.Kind != "ImageTagTransformer" {
+				return nil, fmt.Errorf("unsupported transformer kind %q in %s", t.Kind, path)
+			}
+			images = append(images, t.ImageTag)
+		}
+	}
+	return images, nil
+}
+
+func readObjects(path string) ([]object, error) {
+	docs, err := readDocuments(path)
+	if err != nil {
+		return nil, err
+	}
+	var objs []object
+	for _, doc := range docs {
+		obj := object{}
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			return nil, fmt.Errorf("failed to parse object in %s: %v", path, err)
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// readDocuments splits the YAML stream in path into its non-empty documents.
+func readDocuments(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	var docs [][]byte
+	var doc []string
+	flush := func() {
+		content := strings.Join(doc, "\n")
+		doc = nil
+		for _, line := range strings.Split(content, "\n") {
+			if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				docs = append(docs, []byte(content))
+				return
+			}
+		}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimRight(line, " \t\r") == "---" {
+			flush()
+			continue
+		}
+		doc = append(doc, line)
+	}
+	flush()
+	return docs, nil
+}
+
+func setNamespace(objs []object, namespace string) {
+	for _, obj := range objs {
+		kind, _ := obj["kind"].(string)
+		if !clusterScopedKinds.Has(kind) {
+			metadata := getMap(obj, "metadata")
+			metadata["namespace"] = namespace
+		}
+		// Bindings refer to the service accounts in the namespace.
+		if kind == "RoleBinding" || kind == "ClusterRoleBinding" {
+			subjects, _ := obj["subjects"].([]interface{})
+			for _, s := range subjects {
+				if subject, ok := s.(map[string]interface{}); ok && subject["kind"] == "ServiceAccount" {
+					subject["namespace"] = namespace
+				}
+			}
+		}
+	}
+}
+
+// withoutWindowsWorkloads returns objs without the workloads scheduled on
+// Windows nodes. Their RBAC is left in place, as it is harmless.
+func withoutWindowsWorkloads(objs []object) []object {
+	var result []object
+	for _, obj := range objs {
+		if !isWindowsWorkload(obj) {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+func isWindowsWorkload(obj object) bool {
+	switch obj["kind"] {
+	case "Deployment", "DaemonSet", "StatefulSet":
+	default:
+		return false
+	}
+	podSpec := getMap(getMap(getMap(obj, "spec"), "template"), "spec")
+	return getMap(podSpec, "nodeSelector")["kubernetes.io/os"] == "windows"
+}
+
+func setImages(objs []object, images []imageChange) {
+	for _, container := range containers(objs) {
+		image, _ := container["image"].(string)
+		name, tag := splitImage(image)
+		for _, change := range images {
+			if name != change.Name {
+				continue
+			}
+			if change.NewName != "" {
+				name = change.NewName
+			}
+			if change.NewTag != "" {
+				tag = change.NewTag
+			}
+		}
+		if tag != "" {
+			container["image"] = name + ":" + tag
+		} else {
+			container["image"] = name
+		}
+	}
+}
+
+func addDriverArgs(objs []object, args []string) error {
+	found := false
+	for _, container := range containers(objs) {
+		if container["name"] != driverContainerName {
+			continue
+		}
+		found = true
+		existing, _ := container["args"].([]interface{})
+		for _, arg := range args {
+			existing = append(existing, arg)
+		}
+		container["args"] = existing
+	}
+	if !found {
+		return fmt.Errorf("no %s container found to add args to", driverContainerName)
+	}
+	return nil
+}
+
+// setFeatureGates merges gates into the --feature-gates arg of each
+// container that has one.
+func setFeatureGates(objs []object, gates map[string]bool) {
+	for _, container := range containers(objs) {
+		args, _ := container["args"].([]interface{})
+		for i, a := range args {
+			arg, _ := a.(string)
+			if !strings.HasPrefix(arg, featureGatesArg) {
+				continue
+			}
+			merged := map[string]string{}
+			for _, gate := range strings.Split(strings.TrimPrefix(arg, featureGatesArg), ",") {
+				if parts := strings.SplitN(gate, "=", 2); len(parts) == 2 {
+					merged[parts[0]] = parts[1]
+				}
+			}
+			for gate, enabled := range gates {
+				merged[gate] = fmt.Sprintf("%t", enabled)
+			}
+			var entries []string
+			for gate, value := range merged {
+				entries = append(entries, gate+"="+value)
+			}
+			sort.Strings(entries)
+			args[i] = featureGatesArg + strings.Join(entries, ",")
+		}
+	}
+}
+
+func objectsOfKind(objs []object, kind string) []object {
+	var result []object
+	for _, obj := range objs {
+		if obj["kind"] == kind {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+// containers returns the containers and init containers of the pod
+// templates of all workloads in objs.
+func containers(objs []object) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, obj := range objs {
+		switch obj["kind"] {
+		case "Deployment", "DaemonSet", "StatefulSet":
+		default:
+			continue
+		}
+		podSpec := getMap(getMap(getMap(obj, "spec"), "template"), "spec")
+		for _, key := range []string{"initContainers", "containers"} {
+			list, _ := podSpec[key].([]interface{})
+			for _, c := range list {
+				if container, ok := c.(map[string]interface{}); ok {
+					result = append(result, container)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// getMap returns the map at key in m, creating it if it is missing.
+func getMap(m map[string]interface{}, key string) map[string]interface{} {
+	if child, ok := m[key].(map[string]interface{}); ok {
+		return child
+	}
+	child := map[string]interface{}{}
+	m[key] = child
+	return child
+}
+
+func objectName(obj object) string {
+	name, _ := getMap(obj, "metadata")["name"].(string)
+	return name
+}
+
+// splitImage splits an image reference into its name and tag. Digests are
+// kept as part of the name.
+func splitImage(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deploy
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestRenderManifests(t *testing.T) {
+	opts := Options{
+		Namespace:       "test-namespace",
+		DriverImage:     "gcr.io/test/pd-driver:test-version",
+		ExtraDriverArgs: []string{"--extra-arg=true"},
+
+		ControllerMetricsEndpoint: ":22021",
+		NodeMetricsEndpoint:       ":22022",
+	}
+	manifests, err := Render(OverlayDir("../..", "stable-master"), opts)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	var driverContainers int
+	for _, doc := range strings.Split(string(manifests), "---\n") {
+		if doc == "" {
+			continue
+		}
+		obj := object{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			t.Fatalf("Failed to parse rendered object: %v", err)
+		}
+		kind := obj["kind"].(string)
+		ns, _ := getMap(obj, "metadata")["namespace"].(string)
+		if clusterScopedKinds.Has(kind) {
+			if ns != "" {
+				t.Errorf("%s %s: got namespace %q, expected none", kind, objectName(obj), ns)
+			}
+		} else if ns != opts.Namespace {
+			t.Errorf("%s %s: got namespace %q, expected %q", kind, objectName(obj), ns, opts.Namespace)
+		}
+
+		for _, container := range containers([]object{obj}) {
+			image := container["image"].(string)
+			if _, tag := splitImage(image); tag == "" {
+				t.Errorf("%s %s: container %s has untagged image %q", kind, objectName(obj), container["name"], image)
+			}
+			if container["name"] != driverContainerName {
+				continue
+			}
+			driverContainers++
+			if image != opts.DriverImage {
+				t.Errorf("%s %s: got driver image %q, expected %q", kind, objectName(obj), image, opts.DriverImage)
+			}
+			expArgs := []interface{}{"--extra-arg=true", "--enable-node-metrics", "--http-endpoint=" + opts.NodeMetricsEndpoint}
+			if kind == "Deployment" {
+				expArgs = []interface{}{"--extra-arg=true", "--http-endpoint=" + opts.ControllerMetricsEndpoint}
+			}
+			args, _ := container["args"].([]interface{})
+			if n := len(args); n < len(expArgs) || !reflect.DeepEqual(args[n-len(expArgs):], expArgs) {
+				t.Errorf("%s %s: got driver args %v, expected %v last", kind, objectName(obj), args, expArgs)
+			}
+		}
+	}
+	if driverContainers == 0 {
+		t.Errorf("no driver containers rendered")
+	}
+}
+
+func TestRenderManifestsRejectsPatches(t *testing.T) {
+	if _, err := Render(OverlayDir("../..", "dev"), Options{}); err == nil {
+		t.Errorf("expected error rendering overlay with patches")
+	}
+}
+
+func TestRenderManifestsWindows(t *testing.T) {
+	testCases := []struct {
+		name          string
+		windows       bool
+		expDaemonSets []string
+	}{
+		{
+			name:          "linux only",
+			expDaemonSets: []string{linuxNodeDaemonSet},
+		},
+		{
+			name:          "windows",
+			windows:       true,
+			expDaemonSets: []string{linuxNodeDaemonSet, windowsNodeDaemonSet},
+		},
+	}
+	for _, tc := range testCases {
+		manifests, err := Render(OverlayDir("../..", "stable-master"), Options{Windows: tc.windows})
+		if err != nil {
+			t.Fatalf("%s: Render failed: %v", tc.name, err)
+		}
+		var daemonSets []string
+		for _, obj := range parseManifests(t, manifests) {
+			if obj["kind"] == "DaemonSet" {
+				daemonSets = append(daemonSets, objectName(obj))
+			}
+		}
+		sort.Strings(daemonSets)
+		if !reflect.DeepEqual(daemonSets, tc.expDaemonSets) {
+			t.Errorf("%s: got daemonsets %v, expected %v", tc.name, daemonSets, tc.expDaemonSets)
+		}
+	}
+}
+
+func TestRenderManifestsWindowsHostProcess(t *testing.T) {
+	manifests, err := Render(OverlayDir("../..", "windows-host-process"), Options{Windows: true})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	var windowsNodes []object
+	for _, obj := range parseManifests(t, manifests) {
+		if obj["kind"] == "DaemonSet" && objectName(obj) == windowsNodeDaemonSet {
+			windowsNodes = append(windowsNodes, obj)
+		}
+	}
+	if len(windowsNodes) != 1 {
+		t.Fatalf("got %d %s daemonsets, expected 1", len(windowsNodes), windowsNodeDaemonSet)
+	}
+	podSpec := getMap(getMap(getMap(windowsNodes[0], "spec"), "template"), "spec")
+	if hostProcess := getMap(getMap(podSpec, "securityContext"), "windowsOptions")["hostProcess"]; hostProcess != true {
+		t.Errorf("got hostProcess %v, expected true", hostProcess)
+	}
+	if volumes, ok := podSpec["volumes"]; ok {
+		t.Errorf("got volumes %v, expected none", volumes)
+	}
+	for _, container := range containers(windowsNodes) {
+		if container["name"] == "csi-driver-registrar" && container["image"] != "k8s.gcr.io/sig-storage/csi-node-driver-registrar:v2.5.0" {
+			t.Errorf("got registrar image %v, expected v2.5.0", container["image"])
+		}
+		if container["name"] != driverContainerName {
+			continue
+		}
+		args, _ := container["args"].([]interface{})
+		found := false
+		for _, arg := range args {
+			found = found || arg == "--windows-host-process"
+		}
+		if !found {
+			t.Errorf("got driver args %v, expected --windows-host-process", args)
+		}
+	}
+}
+
+func TestRenderManifestsFeatureGates(t *testing.T) {
+	opts := Options{FeatureGates: map[string]bool{"Topology": false, "CSIStorageCapacity": true}}
+	manifests, err := Render(OverlayDir("../..", "stable-master"), opts)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	var gateArgs []string
+	for _, container := range containers(parseManifests(t, manifests)) {
+		args, _ := container["args"].([]interface{})
+		for _, a := range args {
+			if arg, _ := a.(string); strings.HasPrefix(arg, featureGatesArg) {
+				gateArgs = append(gateArgs, arg)
+			}
+		}
+	}
+	if len(gateArgs) == 0 {
+		t.Fatalf("no %s args rendered", featureGatesArg)
+	}
+	for _, arg := range gateArgs {
+		if exp := "--feature-gates=CSIStorageCapacity=true,Topology=false"; arg != exp {
+			t.Errorf("got %q, expected %q", arg, exp)
+		}
+	}
+}
+
+func parseManifests(t *testing.T, manifests []byte) []object {
+	var objs []object
+	for _, doc := range strings.Split(string(manifests), "---\n") {
+		if doc == "" {
+			continue
+		}
+		obj := object{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			t.Fatalf("Failed to parse rendered object: %v", err)
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+func TestSplitImage(t *testing.T) {
+	testCases := []struct {
+		image   string
+		expName string
+		expTag  string
+	}{
+		{image: "busybox", expName: "busybox"},
+		{image: "gcr.io/project/image:v1.0", expName: "gcr.io/project/image", expTag: "v1.0"},
+		{image: "localhost:5000/image", expName: "localhost:5000/image"},
+		{image: "gcr.io/image@sha256:abc", expName: "gcr.io/image@sha256:abc"},
+	}
+	for _, tc := range testCases {
+		name, tag := splitImage(tc.image)
+		if name != tc.expName || tag != tc.expTag {
+			t.Errorf("splitImage(%q) = %q, %q, expected %q, %q", tc.image, name, tag, tc.expName, tc.expTag)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+const (
+	// Group, version and resource of the GCEPDDriverConfig custom resource.
+	Group    = "pd.csi.storage.gke.io"
+	Version  = "v1alpha1"
+	Resource = "gcepddriverconfigs"
+
+	// ConfigMapKey is the key of the rendered Config in the ConfigMap that
+	// the operator maintains and the driver mounts as its config file.
+	ConfigMapKey = "config.yaml"
+)
+
+// Feature gates that the config can set. Each overrides the flag of the
+// same name, e.g. --allow-unowned-delete.
+const (
+	FeatureAllowUnownedDelete    = "AllowUnownedDelete"
+	FeatureEnforceMountHardening = "EnforceMountHardening"
+	FeatureFreezeBeforeUnstage   = "FreezeBeforeUnstage"
+)
+
+var featureGates = []string{FeatureAllowUnownedDelete, FeatureEnforceMountHardening, FeatureFreezeBeforeUnstage}
+
+// Config holds the driver settings that can be changed without restarting
+// the driver. It is the spec of a GCEPDDriverConfig resource. Unset fields
+// leave the value given by flags in effect.
+type Config struct {
+	// DefaultDiskType is used when a StorageClass does not specify a type.
+	DefaultDiskType string `json:"defaultDiskType,omitempty"`
+	// DefaultDiskEncryptionKMSKey is used when a StorageClass does not
+	// specify a KMS key.
+	DefaultDiskEncryptionKMSKey string `json:"defaultDiskEncryptionKMSKey,omitempty"`
+	// DeviceDiscoveryTimeout bounds how long NodeStageVolume waits for an
+	// attached disk to appear on the node.
+	DeviceDiscoveryTimeout *metav1.Duration `json:"deviceDiscoveryTimeout,omitempty"`
+	// RetryPolicies are keyed by CSI service, e.g. "Controller", or by CSI
+	// RPC name, e.g. "CreateVolume". A policy for an RPC takes precedence
+	// over the policy for its service.
+	RetryPolicies map[string]RetryPolicy `json:"retryPolicies,omitempty"`
+	// ZoneTopologyKeys are topology keys, besides topology.gke.io/zone,
+	// whose values name the zone in CreateVolume topology requirements.
+	ZoneTopologyKeys []string `json:"zoneTopologyKeys,omitempty"`
+	// ZoneAliases map zone names used in topology requirements to GCE
+	// zones, e.g. "dc1-a" to "us-central1-a".
+	ZoneAliases map[string]string `json:"zoneAliases,omitempty"`
+	// ComputeAPIRateLimit throttles the compute API requests of the
+	// controller, overriding --gce-api-qps and --gce-api-burst.
+	ComputeAPIRateLimit *RateLimit `json:"computeAPIRateLimit,omitempty"`
+	// FeatureGates turn optional driver behaviors on or off by name, e.g.
+	// "AllowUnownedDelete".
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+}
+
+// RateLimit is a token bucket. Zero QPS removes the limit.
+type RateLimit struct {
+	QPS   float32 `json:"qps"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// RetryPolicy is the config form of common.RetryPolicy.
+type RetryPolicy struct {
+	MaxAttempts       int              `json:"maxAttempts,omitempty"`
+	PerAttemptTimeout *metav1.Duration `json:"perAttemptTimeout,omitempty"`
+	Backoff           *metav1.Duration `json:"backoff,omitempty"`
+	// RetryableCodes are gRPC status code names, e.g. "UNAVAILABLE".
+	RetryableCodes []string `json:"retryableCodes,omitempty"`
+}
+
+// CSI services and the RPCs of each that retry policies may be keyed by.
+var retryPolicyKeys = map[string][]string{
+	"Identity": {"GetPluginCapabilities", "GetPluginInfo", "Probe"},
+	"Controller": {
+		"ControllerExpandVolume", "ControllerGetCapabilities", "ControllerPublishVolume",
+		"ControllerUnpublishVolume", "CreateSnapshot", "CreateVolume", "DeleteSnapshot",
+		"DeleteVolume", "GetCapacity", "ListSnapshots", "ListVolumes", "ValidateVolumeCapabilities",
+	},
+	"Node": {
+		"NodeExpandVolume", "NodeGetCapabilities", "NodeGetInfo", "NodeGetVolumeStats",
+		"NodePublishVolume", "NodeStageVolume", "NodeUnpublishVolume", "NodeUnstageVolume",
+	},
+}
+
+// GCEPDDriverConfig is the custom resource read by the operator.
+type GCEPDDriverConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec Config `json:"spec"`
+}
+
+// Parse decodes a Config from YAML or JSON. Unknown fields are rejected so
+// that typos do not silently leave a flag value in effect.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse driver config: %v", err)
+	}
+	for key, policy := range cfg.RetryPolicies {
+		if !isRetryPolicyKey(key) {
+			return nil, fmt.Errorf("invalid retry policy %q: not a CSI service or RPC name", key)
+		}
+		if _, err := policy.toCommon(); err != nil {
+			return nil, fmt.Errorf("invalid retry policy %q: %v", key, err)
+		}
+	}
+	for _, key := range cfg.ZoneTopologyKeys {
+		if key == "" || key == common.TopologyKeyZone {
+			return nil, fmt.Errorf("invalid zone topology key %q", key)
+		}
+	}
+	for alias, zone := range cfg.ZoneAliases {
+		if alias == "" {
+			return nil, fmt.Errorf("invalid zone alias for %q: alias must not be empty", zone)
+		}
+		if _, err := common.GetRegionFromZones([]string{zone}); err != nil {
+			return nil, fmt.Errorf("invalid zone alias %q: %v", alias, err)
+		}
+	}
+	if limit := cfg.ComputeAPIRateLimit; limit != nil && (limit.QPS < 0 || limit.Burst < 0) {
+		return nil, fmt.Errorf("invalid compute API rate limit %+v: qps and burst must not be negative", *limit)
+	}
+	for name := range cfg.FeatureGates {
+		if !isFeatureGate(name) {
+			return nil, fmt.Errorf("unknown feature gate %q", name)
+		}
+	}
+	return cfg, nil
+}
+
+func isRetryPolicyKey(key string) bool {
+	for service, rpcs := range retryPolicyKeys {
+		if key == service {
+			return true
+		}
+		for _, rpc := range rpcs {
+			if key == rpc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isFeatureGate(name string) bool {
+	for _, gate := range featureGates {
+		if name == gate {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) toCommon() (common.RetryPolicy, error) {
+	policy := common.RetryPolicy{MaxAttempts: p.MaxAttempts}
+	if p.MaxAttempts < 0 {
+		return policy, fmt.Errorf("maxAttempts must not be negative, got %d", p.MaxAttempts)
+	}
+	if p.PerAttemptTimeout != nil {
+		if p.PerAttemptTimeout.Duration < 0 {
+			return policy, fmt.Errorf("perAttemptTimeout must not be negative, got %v", p.PerAttemptTimeout.Duration)
+		}
+		policy.PerAttemptTimeout = p.PerAttemptTimeout.Duration
+	}
+	if p.Backoff != nil {
+		if p.Backoff.Duration < 0 {
+			return policy, fmt.Errorf("backoff must not be negative, got %v", p.Backoff.Duration)
+		}
+		policy.Backoff = p.Backoff.Duration
+	}
+	for _, name := range p.RetryableCodes {
+		var code codes.Code
+		// Code only unmarshals from JSON, which accepts the quoted
+		// UPPER_SNAKE_CASE names used in the gRPC spec.
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(name))); err != nil {
+			return policy, fmt.Errorf("unknown retryable code %q", name)
+		}
+		policy.RetryableCodes = append(policy.RetryableCodes, code)
+	}
+	return policy, nil
+}
+
+// Load reads and parses the Config at path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read driver config %s: %v", path, err)
+	}
+	return Parse(data)
+}
+
+// ParameterDefaults returns base with the fields set in the config applied.
+func (c *Config) ParameterDefaults(base common.ParameterDefaults) common.ParameterDefaults {
+	if c.DefaultDiskType != "" {
+		base.DiskType = c.DefaultDiskType
+	}
+	if c.DefaultDiskEncryptionKMSKey != "" {
+		base.DiskEncryptionKMSKey = c.DefaultDiskEncryptionKMSKey
+	}
+	return base
+}
+
+// GetDeviceDiscoveryTimeout returns the configured timeout, or base if it is
+// not set.
+func (c *Config) GetDeviceDiscoveryTimeout(base time.Duration) time.Duration {
+	if c.DeviceDiscoveryTimeout != nil {
+		return c.DeviceDiscoveryTimeout.Duration
+	}
+	return base
+}
+
+// GetRetryPolicies returns the configured retry policies keyed by CSI
+// service or RPC name.
+func (c *Config) GetRetryPolicies() map[string]common.RetryPolicy {
+	policies := map[string]common.RetryPolicy{}
+	for key, p := range c.RetryPolicies {
+		// Parse has already validated the policy.
+		policy, err := p.toCommon()
+		if err != nil {
+			klog.Errorf("Ignoring invalid retry policy %q: %v", key, err)
+			continue
+		}
+		policies[key] = policy
+	}
+	return policies
+}
+
+// GetTopologyAliases returns the configured zone topology keys and zone
+// aliases.
+func (c *Config) GetTopologyAliases() common.TopologyAliases {
+	return common.TopologyAliases{
+		ZoneKeys: c.ZoneTopologyKeys,
+		Zones:    c.ZoneAliases,
+	}
+}
+
+// GetComputeAPIRateLimit returns the configured QPS and burst, or the base
+// ones if the limit is not set.
+func (c *Config) GetComputeAPIRateLimit(qps float32, burst int) (float32, int) {
+	if c.ComputeAPIRateLimit != nil {
+		return c.ComputeAPIRateLimit.QPS, c.ComputeAPIRateLimit.Burst
+	}
+	return qps, burst
+}
+
+// FeatureEnabled returns whether the named feature gate is set, or base if
+// the config does not set it.
+func (c *Config) FeatureEnabled(name string, base bool) bool {
+	if enabled, ok := c.FeatureGates[name]; ok {
+		return enabled
+	}
+	return base
+}
+
+// Watch reads the config at path every period and calls onChange whenever
+// its content differs from the last successfully parsed content. A config
+// that fails to parse is logged and the previous one stays in effect. Watch
+// returns when stopCh is closed.
+func Watch(path string, period time.Duration, onChange func(*Config), stopCh <-chan struct{}) {
+	var last []byte
+	wait.Until(func() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("Failed to read driver config %s: %v", path, err)
+			return
+		}
+		if last != nil && bytes.Equal(data, last) {
+			return
+		}
+		cfg, err := Parse(data)
+		if err != nil {
+			klog.Errorf("Ignoring driver config %s: %v", path, err)
+			return
+		}
+		last = data
+		klog.V(2).Infof("Loaded driver config from %s: %+v", path, *cfg)
+		onChange(cfg)
+	}, period, stopCh)
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        string
+		expConfig   *Config
+		expectError bool
+	}{
+		{
+			name:      "empty",
+			data:      "",
+			expConfig: &Config{},
+		},
+		{
+			name: "all fields",
+			data: "defaultDiskType: pd-ssd\ndefaultDiskEncryptionKMSKey: key\ndeviceDiscoveryTimeout: 1m\n",
+			expConfig: &Config{
+				DefaultDiskType:             "pd-ssd",
+				DefaultDiskEncryptionKMSKey: "key",
+				DeviceDiscoveryTimeout:      &metav1.Duration{Duration: time.Minute},
+			},
+		},
+		{
+			name:        "unknown field",
+			data:        "defaultDiskTpye: pd-ssd\n",
+			expectError: true,
+		},
+		{
+			name:        "invalid duration",
+			data:        "deviceDiscoveryTimeout: soon\n",
+			expectError: true,
+		},
+		{
+			name: "retry policies",
+			data: "retryPolicies:\n  Controller:\n    maxAttempts: 3\n    backoff: 1s\n    retryableCodes: [UNAVAILABLE, DEADLINE_EXCEEDED]\n  CreateVolume:\n    perAttemptTimeout: 30s\n",
+			expConfig: &Config{
+				RetryPolicies: map[string]RetryPolicy{
+					"Controller": {
+						MaxAttempts:    3,
+						Backoff:        &metav1.Duration{Duration: time.Second},
+						RetryableCodes: []string{"UNAVAILABLE", "DEADLINE_EXCEEDED"},
+					},
+					"CreateVolume": {
+						PerAttemptTimeout: &metav1.Duration{Duration: 30 * time.Second},
+					},
+				},
+			},
+		},
+		{
+			name:        "retry policy for unknown rpc",
+			data:        "retryPolicies:\n  CreateVolumes:\n    maxAttempts: 3\n",
+			expectError: true,
+		},
+		{
+			name:        "retry policy with unknown code",
+			data:        "retryPolicies:\n  Node:\n    retryableCodes: [Unavailable]\n",
+			expectError: true,
+		},
+		{
+			name:        "retry policy with negative attempts",
+			data:        "retryPolicies:\n  Node:\n    maxAttempts: -1\n",
+			expectError: true,
+		},
+		{
+			name: "topology aliases",
+			data: "zoneTopologyKeys: [example.com/zone]\nzoneAliases:\n  dc1-a: us-central1-a\n",
+			expConfig: &Config{
+				ZoneTopologyKeys: []string{"example.com/zone"},
+				ZoneAliases:      map[string]string{"dc1-a": "us-central1-a"},
+			},
+		},
+		{
+			name:        "standard zone topology key",
+			data:        "zoneTopologyKeys: [topology.gke.io/zone]\n",
+			expectError: true,
+		},
+		{
+			name:        "zone alias to invalid zone",
+			data:        "zoneAliases:\n  dc1-a: dc1\n",
+			expectError: true,
+		},
+		{
+			name: "rate limit and feature gates",
+			data: "computeAPIRateLimit:\n  qps: 2.5\n  burst: 5\nfeatureGates:\n  AllowUnownedDelete: true\n  FreezeBeforeUnstage: false\n",
+			expConfig: &Config{
+				ComputeAPIRateLimit: &RateLimit{QPS: 2.5, Burst: 5},
+				FeatureGates: map[string]bool{
+					FeatureAllowUnownedDelete:  true,
+					FeatureFreezeBeforeUnstage: false,
+				},
+			},
+		},
+		{
+			name:        "negative rate limit",
+			data:        "computeAPIRateLimit:\n  qps: -1\n",
+			expectError: true,
+		},
+		{
+			name:        "unknown feature gate",
+			data:        "featureGates:\n  AllowUnownedDeletes: true\n",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		cfg, err := Parse([]byte(tc.data))
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", tc.name, cfg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, tc.expConfig) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, cfg, tc.expConfig)
+		}
+	}
+}
+
+func TestConfigOverridesBase(t *testing.T) {
+	base := common.ParameterDefaults{DiskType: "pd-standard", DiskEncryptionKMSKey: "base-key"}
+
+	empty := &Config{}
+	if got := empty.ParameterDefaults(base); !reflect.DeepEqual(got, base) {
+		t.Errorf("empty config changed parameter defaults to %+v", got)
+	}
+	if got := empty.GetDeviceDiscoveryTimeout(time.Second); got != time.Second {
+		t.Errorf("empty config changed device discovery timeout to %v", got)
+	}
+
+	cfg := &Config{
+		DefaultDiskType:        "pd-ssd",
+		DeviceDiscoveryTimeout: &metav1.Duration{Duration: 0},
+	}
+	expDefaults := common.ParameterDefaults{DiskType: "pd-ssd", DiskEncryptionKMSKey: "base-key"}
+	if got := cfg.ParameterDefaults(base); !reflect.DeepEqual(got, expDefaults) {
+		t.Errorf("got parameter defaults %+v, expected %+v", got, expDefaults)
+	}
+	if got := cfg.GetDeviceDiscoveryTimeout(time.Second); got != 0 {
+		t.Errorf("got device discovery timeout %v, expected 0", got)
+	}
+
+	if qps, burst := empty.GetComputeAPIRateLimit(10, 20); qps != 10 || burst != 20 {
+		t.Errorf("empty config changed compute API rate limit to %v/%d", qps, burst)
+	}
+	if !empty.FeatureEnabled(FeatureEnforceMountHardening, true) {
+		t.Errorf("empty config disabled feature %s", FeatureEnforceMountHardening)
+	}
+	cfg = &Config{
+		ComputeAPIRateLimit: &RateLimit{},
+		FeatureGates:        map[string]bool{FeatureEnforceMountHardening: false},
+	}
+	if qps, burst := cfg.GetComputeAPIRateLimit(10, 20); qps != 0 || burst != 0 {
+		t.Errorf("got compute API rate limit %v/%d, expected 0/0", qps, burst)
+	}
+	if cfg.FeatureEnabled(FeatureEnforceMountHardening, true) {
+		t.Errorf("feature %s enabled, expected the config to disable it", FeatureEnforceMountHardening)
+	}
+	if cfg.FeatureEnabled(FeatureAllowUnownedDelete, false) {
+		t.Errorf("feature %s enabled, expected the base value", FeatureAllowUnownedDelete)
+	}
+}
+
+func TestGetRetryPolicies(t *testing.T) {
+	cfg, err := Parse([]byte("retryPolicies:\n  NodeStageVolume:\n    maxAttempts: 2\n    perAttemptTimeout: 10s\n    backoff: 100ms\n    retryableCodes: [INTERNAL]\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	exp := map[string]common.RetryPolicy{
+		"NodeStageVolume": {
+			MaxAttempts:       2,
+			PerAttemptTimeout: 10 * time.Second,
+			Backoff:           100 * time.Millisecond,
+			RetryableCodes:    []codes.Code{codes.Internal},
+		},
+	}
+	if got := cfg.GetRetryPolicies(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got retry policies %+v, expected %+v", got, exp)
+	}
+}
+
+func TestRenderConfigRoundTrip(t *testing.T) {
+	cfg := &GCEPDDriverConfig{
+		Spec: Config{
+			DefaultDiskType:        "pd-balanced",
+			DeviceDiscoveryTimeout: &metav1.Duration{Duration: 45 * time.Second},
+			ComputeAPIRateLimit:    &RateLimit{QPS: 0.5, Burst: 3},
+			FeatureGates:           map[string]bool{FeatureAllowUnownedDelete: true},
+		},
+	}
+	data, err := renderConfig(cfg)
+	if err != nil {
+		t.Fatalf("renderConfig failed: %v", err)
+	}
+	parsed, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse of rendered config %q failed: %v", data, err)
+	}
+	if !reflect.DeepEqual(*parsed, cfg.Spec) {
+		t.Errorf("got %+v after round trip, expected %+v", *parsed, cfg.Spec)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driverconfig")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ConfigMapKey)
+
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	write("defaultDiskType: pd-ssd\n")
+
+	changes := make(chan *Config, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go Watch(path, 10*time.Millisecond, func(cfg *Config) { changes <- cfg }, stopCh)
+
+	expectChange := func(diskType string) {
+		select {
+		case cfg := <-changes:
+			if cfg.DefaultDiskType != diskType {
+				t.Fatalf("got disk type %q, expected %q", cfg.DefaultDiskType, diskType)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for config with disk type %q", diskType)
+		}
+	}
+	expectChange("pd-ssd")
+
+	// An invalid config is skipped and the next valid one is delivered.
+	write("bogus: true\n")
+	time.Sleep(50 * time.Millisecond)
+	write("defaultDiskType: pd-balanced\n")
+	expectChange("pd-balanced")
+
+	select {
+	case cfg := <-changes:
+		t.Fatalf("got unexpected change %+v for unchanged file", cfg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
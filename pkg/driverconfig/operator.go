@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// Operator keeps a ConfigMap in sync with a cluster-scoped GCEPDDriverConfig
+// resource. The controller and node DaemonSet mount the ConfigMap as their
+// config file and pick up changes through Watch.
+type Operator struct {
+	client        kubernetes.Interface
+	configName    string
+	namespace     string
+	configMapName string
+}
+
+func NewOperator(client kubernetes.Interface, configName, namespace, configMapName string) *Operator {
+	return &Operator{
+		client:        client,
+		configName:    configName,
+		namespace:     namespace,
+		configMapName: configMapName,
+	}
+}
+
+// Run syncs the ConfigMap every period until stopCh is closed.
+func (o *Operator) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := o.sync(context.Background()); err != nil {
+			klog.Errorf("Failed to sync driver config: %v", err)
+		}
+	}, period, stopCh)
+}
+
+func (o *Operator) sync(ctx context.Context) error {
+	cfg, err := o.getDriverConfig(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := renderConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	configMaps := o.client.CoreV1().ConfigMaps(o.namespace)
+	cm, err := configMaps.Get(ctx, o.configMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      o.configMapName,
+				Namespace: o.namespace,
+			},
+			Data: map[string]string{ConfigMapKey: data},
+		}
+		if _, err := configMaps.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ConfigMap %s/%s: %v", o.namespace, o.configMapName, err)
+		}
+		klog.V(2).Infof("Created ConfigMap %s/%s from %s %s", o.namespace, o.configMapName, Resource, o.configName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ConfigMap %s/%s: %v", o.namespace, o.configMapName, err)
+	}
+	if cm.Data[ConfigMapKey] == data {
+		return nil
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[ConfigMapKey] = data
+	if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ConfigMap %s/%s: %v", o.namespace, o.configMapName, err)
+	}
+	klog.V(2).Infof("Updated ConfigMap %s/%s from %s %s", o.namespace, o.configMapName, Resource, o.configName)
+	return nil
+}
+
+// getDriverConfig fetches the GCEPDDriverConfig resource. A missing resource
+// yields an empty config so that the driver falls back to its flags.
+func (o *Operator) getDriverConfig(ctx context.Context) (*GCEPDDriverConfig, error) {
+	raw, err := o.client.CoreV1().RESTClient().Get().
+		AbsPath("/apis", Group, Version, Resource, o.configName).
+		DoRaw(ctx)
+	if apierrors.IsNotFound(err) {
+		klog.V(4).Infof("%s %s not found, using an empty driver config", Resource, o.configName)
+		return &GCEPDDriverConfig{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s %s: %v", Resource, o.configName, err)
+	}
+	cfg := &GCEPDDriverConfig{}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode %s %s: %v", Resource, o.configName, err)
+	}
+	return cfg, nil
+}
+
+// renderConfig renders the spec of cfg as the config file content.
+func renderConfig(cfg *GCEPDDriverConfig) (string, error) {
+	data, err := yaml.Marshal(cfg.Spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to render driver config: %v", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	testConfigName    = "default"
+	testNamespace     = "gce-pd-csi-driver"
+	testConfigMapName = "gce-pd-csi-driver-config"
+)
+
+// fakeAPIServer serves the GCEPDDriverConfig resource and the ConfigMap that
+// the operator reads and writes.
+type fakeAPIServer struct {
+	mux       sync.Mutex
+	config    *GCEPDDriverConfig
+	configMap *v1.ConfigMap
+	writes    int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	configPath := "/apis/" + Group + "/" + Version + "/" + Resource + "/" + testConfigName
+	configMapsPath := "/api/v1/namespaces/" + testNamespace + "/configmaps"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == configPath:
+		if s.config == nil {
+			writeNotFound(w)
+			return
+		}
+		json.NewEncoder(w).Encode(s.config)
+	case r.Method == http.MethodGet && r.URL.Path == configMapsPath+"/"+testConfigMapName:
+		if s.configMap == nil {
+			writeNotFound(w)
+			return
+		}
+		json.NewEncoder(w).Encode(s.configMap)
+	case (r.Method == http.MethodPost && r.URL.Path == configMapsPath) ||
+		(r.Method == http.MethodPut && r.URL.Path == configMapsPath+"/"+testConfigMapName):
+		cm := &v1.ConfigMap{}
+		if err := json.NewDecoder(r.Body).Decode(cm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.configMap = cm
+		s.writes++
+		json.NewEncoder(w).Encode(cm)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+}
+
+func TestOperatorSync(t *testing.T) {
+	fake := &fakeAPIServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	op := NewOperator(client, testConfigName, testNamespace, testConfigMapName)
+
+	expectConfig := func(step string, exp Config, expWrites int) {
+		if err := op.sync(context.Background()); err != nil {
+			t.Fatalf("%s: sync failed: %v", step, err)
+		}
+		fake.mux.Lock()
+		defer fake.mux.Unlock()
+		if fake.writes != expWrites {
+			t.Errorf("%s: got %d ConfigMap writes, expected %d", step, fake.writes, expWrites)
+		}
+		if fake.configMap == nil {
+			t.Fatalf("%s: ConfigMap was not created", step)
+		}
+		cfg, err := Parse([]byte(fake.configMap.Data[ConfigMapKey]))
+		if err != nil {
+			t.Fatalf("%s: failed to parse ConfigMap: %v", step, err)
+		}
+		if !reflect.DeepEqual(*cfg, exp) {
+			t.Errorf("%s: got config %+v, expected %+v", step, *cfg, exp)
+		}
+	}
+
+	// A missing resource yields an empty config.
+	expectConfig("missing resource", Config{}, 1)
+
+	spec := Config{
+		DefaultDiskType: "pd-ssd",
+		FeatureGates:    map[string]bool{FeatureAllowUnownedDelete: true},
+	}
+	fake.mux.Lock()
+	fake.config = &GCEPDDriverConfig{Spec: spec}
+	fake.mux.Unlock()
+	expectConfig("resource created", spec, 2)
+
+	// An unchanged resource does not rewrite the ConfigMap.
+	expectConfig("resource unchanged", spec, 2)
+}
@@ -18,13 +18,15 @@ import (
 	"strings"
 
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	computealpha "google.golang.org/api/compute/v0.alpha"
 	computebeta "google.golang.org/api/compute/v0.beta"
 	computev1 "google.golang.org/api/compute/v1"
 )
 
 type CloudDisk struct {
-	disk     *computev1.Disk
-	betaDisk *computebeta.Disk
+	disk      *computev1.Disk
+	betaDisk  *computebeta.Disk
+	alphaDisk *computealpha.Disk
 }
 
 type CloudDiskType string
@@ -41,6 +43,12 @@ func CloudDiskFromBeta(disk *computebeta.Disk) *CloudDisk {
 	}
 }
 
+func CloudDiskFromAlpha(disk *computealpha.Disk) *CloudDisk {
+	return &CloudDisk{
+		alphaDisk: disk,
+	}
+}
+
 func (d *CloudDisk) LocationType() meta.KeyType {
 	var zone, region string
 	switch {
@@ -50,6 +58,9 @@ func (d *CloudDisk) LocationType() meta.KeyType {
 	case d.betaDisk != nil:
 		zone = d.betaDisk.Zone
 		region = d.betaDisk.Region
+	case d.alphaDisk != nil:
+		zone = d.alphaDisk.Zone
+		region = d.alphaDisk.Region
 	}
 	switch {
 	case zone != "":
@@ -67,17 +78,45 @@ func (d *CloudDisk) GetUsers() []string {
 		return d.disk.Users
 	case d.betaDisk != nil:
 		return d.betaDisk.Users
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Users
 	default:
 		return nil
 	}
 }
 
+func (d *CloudDisk) setUsers(users []string) {
+	switch {
+	case d.disk != nil:
+		d.disk.Users = users
+	case d.betaDisk != nil:
+		d.betaDisk.Users = users
+	case d.alphaDisk != nil:
+		d.alphaDisk.Users = users
+	}
+}
+
 func (d *CloudDisk) GetName() string {
 	switch {
 	case d.disk != nil:
 		return d.disk.Name
 	case d.betaDisk != nil:
 		return d.betaDisk.Name
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Name
+	default:
+		return ""
+	}
+}
+
+func (d *CloudDisk) GetDescription() string {
+	switch {
+	case d.disk != nil:
+		return d.disk.Description
+	case d.betaDisk != nil:
+		return d.betaDisk.Description
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Description
 	default:
 		return ""
 	}
@@ -89,6 +128,8 @@ func (d *CloudDisk) GetKind() string {
 		return d.disk.Kind
 	case d.betaDisk != nil:
 		return d.betaDisk.Kind
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Kind
 	default:
 		return ""
 	}
@@ -100,6 +141,8 @@ func (d *CloudDisk) GetStatus() string {
 		return d.disk.Status
 	case d.betaDisk != nil:
 		return d.betaDisk.Status
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Status
 	default:
 		return "Unknown"
 	}
@@ -115,6 +158,8 @@ func (d *CloudDisk) GetPDType() string {
 		pdType = d.disk.Type
 	case d.betaDisk != nil:
 		pdType = d.betaDisk.Type
+	case d.alphaDisk != nil:
+		pdType = d.alphaDisk.Type
 	default:
 		return ""
 	}
@@ -128,6 +173,8 @@ func (d *CloudDisk) GetSelfLink() string {
 		return d.disk.SelfLink
 	case d.betaDisk != nil:
 		return d.betaDisk.SelfLink
+	case d.alphaDisk != nil:
+		return d.alphaDisk.SelfLink
 	default:
 		return ""
 	}
@@ -139,6 +186,8 @@ func (d *CloudDisk) GetSizeGb() int64 {
 		return d.disk.SizeGb
 	case d.betaDisk != nil:
 		return d.betaDisk.SizeGb
+	case d.alphaDisk != nil:
+		return d.alphaDisk.SizeGb
 	default:
 		return -1
 	}
@@ -152,6 +201,8 @@ func (d *CloudDisk) setSizeGb(size int64) {
 		d.disk.SizeGb = size
 	case d.betaDisk != nil:
 		d.betaDisk.SizeGb = size
+	case d.alphaDisk != nil:
+		d.alphaDisk.SizeGb = size
 	}
 }
 
@@ -161,6 +212,8 @@ func (d *CloudDisk) GetZone() string {
 		return d.disk.Zone
 	case d.betaDisk != nil:
 		return d.betaDisk.Zone
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Zone
 	default:
 		return ""
 	}
@@ -172,11 +225,56 @@ func (d *CloudDisk) GetSnapshotId() string {
 		return d.disk.SourceSnapshotId
 	case d.betaDisk != nil:
 		return d.betaDisk.SourceSnapshotId
+	case d.alphaDisk != nil:
+		return d.alphaDisk.SourceSnapshotId
+	default:
+		return ""
+	}
+}
+
+// GetSourceDisk returns the URL of the disk this disk was cloned from, or ""
+// if it is not a clone.
+func (d *CloudDisk) GetSourceDisk() string {
+	switch {
+	case d.disk != nil:
+		return d.disk.SourceDisk
+	case d.betaDisk != nil:
+		return d.betaDisk.SourceDisk
+	case d.alphaDisk != nil:
+		return d.alphaDisk.SourceDisk
 	default:
 		return ""
 	}
 }
 
+// GetSourceImage returns the URL of the image this disk was restored from, or
+// "" if it was not restored from an image.
+func (d *CloudDisk) GetSourceImage() string {
+	switch {
+	case d.disk != nil:
+		return d.disk.SourceImage
+	case d.betaDisk != nil:
+		return d.betaDisk.SourceImage
+	case d.alphaDisk != nil:
+		return d.alphaDisk.SourceImage
+	default:
+		return ""
+	}
+}
+
+func (d *CloudDisk) GetReplicaZones() []string {
+	switch {
+	case d.disk != nil:
+		return d.disk.ReplicaZones
+	case d.betaDisk != nil:
+		return d.betaDisk.ReplicaZones
+	case d.alphaDisk != nil:
+		return d.alphaDisk.ReplicaZones
+	default:
+		return nil
+	}
+}
+
 func (d *CloudDisk) GetKMSKeyName() string {
 	switch {
 	case d.disk != nil:
@@ -187,17 +285,47 @@ func (d *CloudDisk) GetKMSKeyName() string {
 		if dek := d.betaDisk.DiskEncryptionKey; dek != nil {
 			return dek.KmsKeyName
 		}
+	case d.alphaDisk != nil:
+		if dek := d.alphaDisk.DiskEncryptionKey; dek != nil {
+			return dek.KmsKeyName
+		}
 	}
 	return ""
 }
 
+func (d *CloudDisk) GetLabels() map[string]string {
+	switch {
+	case d.disk != nil:
+		return d.disk.Labels
+	case d.betaDisk != nil:
+		return d.betaDisk.Labels
+	case d.alphaDisk != nil:
+		return d.alphaDisk.Labels
+	default:
+		return nil
+	}
+}
+
 func (d *CloudDisk) GetMultiWriter() bool {
 	switch {
 	case d.disk != nil:
 		return false
 	case d.betaDisk != nil:
 		return d.betaDisk.MultiWriter
+	case d.alphaDisk != nil:
+		return d.alphaDisk.MultiWriter
 	default:
 		return false
 	}
 }
+
+// GetProvisionedIops returns the IOPS provisioned for the disk. Only the
+// alpha API reports them, so it is 0 for disks read with other versions.
+func (d *CloudDisk) GetProvisionedIops() int64 {
+	switch {
+	case d.alphaDisk != nil:
+		return d.alphaDisk.ProvisionedIops
+	default:
+		return 0
+	}
+}
@@ -16,19 +16,26 @@ package gcecloudprovider
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	computealpha "google.golang.org/api/compute/v0.alpha"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	computev1 "google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/uuid"
 )
@@ -38,6 +45,7 @@ const (
 	Timestamp                 = "2018-09-05T15:17:08.270-07:00"
 	BasePath                  = "https://www.googleapis.com/compute/v1/projects/"
 	snapshotURITemplateGlobal = "%s/global/snapshots/%s" //{gce.projectID}/global/snapshots/{snapshot.Name}"
+	imageURITemplateGlobal    = "%s/global/images/%s"    //{gce.projectID}/global/images/{image.Name}"
 )
 
 type FakeCloudProvider struct {
@@ -48,23 +56,36 @@ type FakeCloudProvider struct {
 	pageTokens map[string]sets.String
 	instances  map[string]*computev1.Instance
 	snapshots  map[string]*computev1.Snapshot
+	images     map[string]*computev1.Image
+	// instantSnapshots are keyed by the string of their key.
+	instantSnapshots map[string]*computealpha.InstantSnapshot
 
 	// marker to set disk status during InsertDisk operation.
 	mockDiskStatus string
+	// times at which the pending insert operations of disks, by name,
+	// complete. WaitForDiskInsert polls until then.
+	pendingInserts map[string]time.Time
+
+	// clock times pending operations and the waits for them.
+	clock clock.Clock
 }
 
 var _ GCECompute = &FakeCloudProvider{}
 
 func CreateFakeCloudProvider(project, zone string, cloudDisks []*CloudDisk) (*FakeCloudProvider, error) {
 	fcp := &FakeCloudProvider{
-		project:    project,
-		zone:       zone,
-		disks:      map[string]*CloudDisk{},
-		instances:  map[string]*computev1.Instance{},
-		snapshots:  map[string]*computev1.Snapshot{},
-		pageTokens: map[string]sets.String{},
+		project:          project,
+		zone:             zone,
+		disks:            map[string]*CloudDisk{},
+		instances:        map[string]*computev1.Instance{},
+		snapshots:        map[string]*computev1.Snapshot{},
+		images:           map[string]*computev1.Image{},
+		instantSnapshots: map[string]*computealpha.InstantSnapshot{},
+		pageTokens:       map[string]sets.String{},
 		// A newly created disk is marked READY by default.
 		mockDiskStatus: "READY",
+		pendingInserts: map[string]time.Time{},
+		clock:          clock.RealClock{},
 	}
 	for _, d := range cloudDisks {
 		fcp.disks[d.GetName()] = d
@@ -112,6 +133,14 @@ func (cloud *FakeCloudProvider) ListZones(ctx context.Context, region string) ([
 	return []string{cloud.zone, "country-region-fakesecondzone"}, nil
 }
 
+func (cloud *FakeCloudProvider) ZonesCache() map[string][]string {
+	region, err := common.GetRegionFromZones([]string{cloud.zone})
+	if err != nil {
+		return map[string][]string{}
+	}
+	return map[string][]string{region: {cloud.zone, "country-region-fakesecondzone"}}
+}
+
 func (cloud *FakeCloudProvider) ListDisks(ctx context.Context, maxEntries int64, pageToken string) ([]*computev1.Disk, string, error) {
 	// Ignore page tokens for now
 	var seen sets.String
@@ -132,8 +161,18 @@ func (cloud *FakeCloudProvider) ListDisks(ctx context.Context, maxEntries int64,
 	if maxEntries == 0 {
 		maxEntries = 500
 	}
+	region, err := common.GetRegionFromZones([]string{cloud.zone})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get region from zones: %v", err)
+	}
 
 	for name, cd := range cloud.disks {
+		// As in the real provider, only disks in the region and its zones are
+		// listed. Disks created in tests without a location are included.
+		if cd.disk != nil && (cd.disk.Zone != "" && !isScopeInRegion("zones/"+cd.disk.Zone, region) ||
+			cd.disk.Region != "" && cd.disk.Region != region) {
+			continue
+		}
 		// Only return v1 disks for simplicity
 		if !seen.Has(name) {
 			d = append(d, cd.disk)
@@ -151,6 +190,15 @@ func (cloud *FakeCloudProvider) ListDisks(ctx context.Context, maxEntries int64,
 	return d, newToken, nil
 }
 
+func (cloud *FakeCloudProvider) AggregatedListDisks(ctx context.Context, filter string) ([]*computev1.Disk, error) {
+	// Ignore the filter and only return v1 disks for simplicity
+	d := []*computev1.Disk{}
+	for _, cd := range cloud.disks {
+		d = append(d, cd.disk)
+	}
+	return d, nil
+}
+
 func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Snapshot, string, error) {
 	var sourceDisk string
 	snapshots := []*computev1.Snapshot{}
@@ -159,13 +207,11 @@ func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string
 		if len(filterSplits) != 3 || filterSplits[0] != "sourceDisk" {
 			return nil, "", invalidError()
 		}
-		sourceDisk = filterSplits[2]
+		sourceDisk = strings.TrimSuffix(strings.TrimPrefix(filterSplits[2], ".*"), "$")
 	}
 	for _, snapshot := range cloud.snapshots {
-		if len(sourceDisk) > 0 {
-			if snapshot.SourceDisk == sourceDisk {
-				continue
-			}
+		if len(sourceDisk) > 0 && !strings.HasSuffix(snapshot.SourceDisk, sourceDisk) {
+			continue
 		}
 		snapshots = append(snapshots, snapshot)
 	}
@@ -212,12 +258,50 @@ func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string
 }
 
 // Disk Methods
+
+// GetDisk returns the disk as the requested API version would, so that like
+// the real API only the beta and alpha APIs report whether it is in
+// multi-writer mode and only the alpha API reports its provisioned IOPS.
 func (cloud *FakeCloudProvider) GetDisk(ctx context.Context, volKey *meta.Key, api GCEAPIVersion) (*CloudDisk, error) {
 	disk, ok := cloud.disks[volKey.Name]
 	if !ok {
 		return nil, notFoundError()
 	}
-	return disk, nil
+	return convertDiskVersion(disk, api)
+}
+
+// convertDiskVersion copies disk into the representation of the api version,
+// dropping the fields that version does not have.
+func convertDiskVersion(disk *CloudDisk, api GCEAPIVersion) (*CloudDisk, error) {
+	var src interface{} = disk.disk
+	if disk.betaDisk != nil {
+		src = disk.betaDisk
+	} else if disk.alphaDisk != nil {
+		src = disk.alphaDisk
+	}
+	raw, err := json.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	if api == GCEAPIVersionAlpha {
+		alphaDisk := &computealpha.Disk{}
+		if err := json.Unmarshal(raw, alphaDisk); err != nil {
+			return nil, err
+		}
+		return CloudDiskFromAlpha(alphaDisk), nil
+	}
+	if api == GCEAPIVersionBeta {
+		betaDisk := &computebeta.Disk{}
+		if err := json.Unmarshal(raw, betaDisk); err != nil {
+			return nil, err
+		}
+		return CloudDiskFromBeta(betaDisk), nil
+	}
+	v1Disk := &computev1.Disk{}
+	if err := json.Unmarshal(raw, v1Disk); err != nil {
+		return nil, err
+	}
+	return CloudDiskFromV1(v1Disk), nil
 }
 
 func (cloud *FakeCloudProvider) ValidateExistingDisk(ctx context.Context, resp *CloudDisk, params common.DiskParameters, reqBytes, limBytes int64, multiWriter bool) error {
@@ -249,7 +333,7 @@ func (cloud *FakeCloudProvider) ValidateExistingDisk(ctx context.Context, resp *
 	return ValidateDiskParameters(resp, params)
 }
 
-func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID string, multiWriter bool) error {
+func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error {
 	if disk, ok := cloud.disks[volKey.Name]; ok {
 		err := cloud.ValidateExistingDisk(ctx, disk, params,
 			int64(capacityRange.GetRequiredBytes()),
@@ -261,13 +345,21 @@ func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key
 	}
 
 	computeDisk := &computev1.Disk{
-		Name:             volKey.Name,
-		SizeGb:           common.BytesToGbRoundUp(capBytes),
-		Description:      "Disk created by GCE-PD CSI Driver",
-		Type:             cloud.GetDiskTypeURI(volKey, params.DiskType),
-		SourceSnapshotId: snapshotID,
-		Status:           cloud.mockDiskStatus,
-		Labels:           params.Labels,
+		Name:         volKey.Name,
+		SizeGb:       common.BytesToGbRoundUp(capBytes),
+		Description:  diskDescriptionZonal,
+		Type:         cloud.GetDiskTypeURI(volKey, params.DiskType),
+		SourceDisk:   volumeContentSourceVolumeID,
+		ReplicaZones: replicaZones,
+		Status:       cloud.mockDiskStatus,
+		Labels:       params.Labels,
+	}
+	if snapshotID != "" {
+		if snapshotType, _, err := common.SnapshotIDToKey(snapshotID); err == nil && snapshotType == common.DiskImageType {
+			computeDisk.SourceImage = snapshotID
+		} else {
+			computeDisk.SourceSnapshotId = snapshotID
+		}
 	}
 	if params.DiskEncryptionKMSKey != "" {
 		computeDisk.DiskEncryptionKey = &computev1.CustomerEncryptionKey{
@@ -285,6 +377,28 @@ func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key
 		return fmt.Errorf("could not create disk, key was neither zonal nor regional, instead got: %v", volKey.String())
 	}
 
+	if params.ProvisionedIOPSOnCreate > 0 {
+		// As in the real provider, disks with provisioned IOPS are created
+		// with the alpha API.
+		disk, err := convertDiskVersion(CloudDiskFromV1(computeDisk), GCEAPIVersionAlpha)
+		if err != nil {
+			return err
+		}
+		disk.alphaDisk.ProvisionedIops = params.ProvisionedIOPSOnCreate
+		disk.alphaDisk.MultiWriter = multiWriter
+		cloud.disks[volKey.Name] = disk
+		return nil
+	}
+	if multiWriter {
+		// Only the beta API creates disks in multi-writer mode.
+		disk, err := convertDiskVersion(CloudDiskFromV1(computeDisk), GCEAPIVersionBeta)
+		if err != nil {
+			return err
+		}
+		disk.betaDisk.MultiWriter = true
+		cloud.disks[volKey.Name] = disk
+		return nil
+	}
 	cloud.disks[volKey.Name] = CloudDiskFromV1(computeDisk)
 	return nil
 }
@@ -297,7 +411,7 @@ func (cloud *FakeCloudProvider) DeleteDisk(ctx context.Context, volKey *meta.Key
 	return nil
 }
 
-func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string) error {
+func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, diskInterface, instanceZone, instanceName string) error {
 	source := cloud.GetDiskSourceURI(volKey)
 
 	attachedDiskV1 := &computev1.AttachedDisk{
@@ -306,12 +420,16 @@ func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key
 		Mode:       readWrite,
 		Source:     source,
 		Type:       diskType,
+		Interface:  diskInterface,
 	}
 	instance, ok := cloud.instances[instanceName]
 	if !ok {
 		return fmt.Errorf("Failed to get instance %v", instanceName)
 	}
 	instance.Disks = append(instance.Disks, attachedDiskV1)
+	if disk, ok := cloud.disks[volKey.Name]; ok {
+		disk.setUsers(append(disk.GetUsers(), instanceURI(cloud.project, instanceZone, instanceName)))
+	}
 	return nil
 }
 
@@ -329,9 +447,22 @@ func (cloud *FakeCloudProvider) DetachDisk(ctx context.Context, deviceName, inst
 	}
 	instance.Disks[found] = instance.Disks[len(instance.Disks)-1]
 	instance.Disks = instance.Disks[:len(instance.Disks)-1]
+	if disk, ok := cloud.disks[deviceName]; ok {
+		users := []string{}
+		for _, user := range disk.GetUsers() {
+			if user != instanceURI(cloud.project, instanceZone, instanceName) {
+				users = append(users, user)
+			}
+		}
+		disk.setUsers(users)
+	}
 	return nil
 }
 
+func instanceURI(project, zone, name string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/instances/%s", project, zone, name)
+}
+
 func (cloud *FakeCloudProvider) GetDiskTypeURI(volKey *meta.Key, diskType string) string {
 	switch volKey.Type() {
 	case meta.Zonal:
@@ -357,7 +488,7 @@ func (cloud *FakeCloudProvider) WaitForAttach(ctx context.Context, volKey *meta.
 
 // Regional Disk Methods
 func (cloud *FakeCloudProvider) GetReplicaZoneURI(zone string) string {
-	return ""
+	return BasePath + fmt.Sprintf(replicaZoneURITemplateSingleZone, cloud.project, zone)
 }
 
 // Instance Methods
@@ -384,7 +515,7 @@ func (cloud *FakeCloudProvider) GetSnapshot(ctx context.Context, snapshotName st
 	return snapshot, nil
 }
 
-func (cloud *FakeCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*computev1.Snapshot, error) {
+func (cloud *FakeCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error) {
 	if snapshot, ok := cloud.snapshots[snapshotName]; ok {
 		return snapshot, nil
 	}
@@ -395,6 +526,7 @@ func (cloud *FakeCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta
 		CreationTimestamp: Timestamp,
 		Status:            "UPLOADING",
 		SelfLink:          cloud.getGlobalSnapshotURI(snapshotName),
+		Labels:            labels,
 	}
 	switch volKey.Type() {
 	case meta.Zonal:
@@ -429,6 +561,162 @@ func (cloud *FakeCloudProvider) DeleteSnapshot(ctx context.Context, snapshotName
 	return nil
 }
 
+// Image Methods
+func (cloud *FakeCloudProvider) ListImages(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Image, string, error) {
+	var sourceDisk string
+	if len(filter) > 0 {
+		filterSplits := strings.Fields(filter)
+		if len(filterSplits) != 3 || filterSplits[0] != "sourceDisk" {
+			return nil, "", invalidError()
+		}
+		sourceDisk = strings.TrimSuffix(strings.TrimPrefix(filterSplits[2], ".*"), "$")
+	}
+	names := []string{}
+	for name, image := range cloud.images {
+		if len(sourceDisk) > 0 && !strings.HasSuffix(image.SourceDisk, sourceDisk) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start := 0
+	if len(pageToken) > 0 {
+		i, err := strconv.ParseUint(pageToken, 10, 32)
+		if err != nil || int(i) > len(names) {
+			return nil, "", invalidError()
+		}
+		start = int(i)
+	}
+	end := len(names)
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+
+	results := []*computev1.Image{}
+	for _, name := range names[start:end] {
+		results = append(results, cloud.images[name])
+	}
+	var nextToken string
+	if end < len(names) {
+		nextToken = fmt.Sprintf("%d", end)
+	}
+	return results, nextToken, nil
+}
+
+func (cloud *FakeCloudProvider) GetImage(ctx context.Context, imageName string) (*computev1.Image, error) {
+	image, ok := cloud.images[imageName]
+	if !ok {
+		return nil, notFoundError()
+	}
+	image.Status = "READY"
+	return image, nil
+}
+
+func (cloud *FakeCloudProvider) CreateImage(ctx context.Context, volKey *meta.Key, imageName string, labels map[string]string) (*computev1.Image, error) {
+	if image, ok := cloud.images[imageName]; ok {
+		return image, nil
+	}
+	sourceDisk := cloud.GetDiskSourceURI(volKey)
+	if sourceDisk == "" {
+		return nil, fmt.Errorf("could not create image, disk key was neither zonal nor regional, instead got: %v", volKey.String())
+	}
+	imageToCreate := &computev1.Image{
+		Name:              imageName,
+		Description:       imageDescription,
+		DiskSizeGb:        int64(DiskSizeGb),
+		CreationTimestamp: Timestamp,
+		Status:            "PENDING",
+		SelfLink:          cloud.getGlobalImageURI(imageName),
+		SourceDisk:        sourceDisk,
+		Labels:            labels,
+	}
+	cloud.images[imageName] = imageToCreate
+	return imageToCreate, nil
+}
+
+func (cloud *FakeCloudProvider) DeleteImage(ctx context.Context, imageName string) error {
+	delete(cloud.images, imageName)
+	return nil
+}
+
+// Instant Snapshot Methods
+func (cloud *FakeCloudProvider) ListInstantSnapshots(ctx context.Context, volKey *meta.Key, maxEntries int64, pageToken string) ([]*computealpha.InstantSnapshot, string, error) {
+	sourceDisk := cloud.GetDiskSourceURI(volKey)
+	keys := []string{}
+	for key, snapshot := range cloud.instantSnapshots {
+		if snapshot.SourceDisk == sourceDisk {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if len(pageToken) > 0 {
+		i, err := strconv.ParseUint(pageToken, 10, 32)
+		if err != nil || int(i) > len(keys) {
+			return nil, "", invalidError()
+		}
+		start = int(i)
+	}
+	end := len(keys)
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+
+	results := []*computealpha.InstantSnapshot{}
+	for _, key := range keys[start:end] {
+		results = append(results, cloud.instantSnapshots[key])
+	}
+	var nextToken string
+	if end < len(keys) {
+		nextToken = fmt.Sprintf("%d", end)
+	}
+	return results, nextToken, nil
+}
+
+func (cloud *FakeCloudProvider) GetInstantSnapshot(ctx context.Context, key *meta.Key) (*computealpha.InstantSnapshot, error) {
+	snapshot, ok := cloud.instantSnapshots[key.String()]
+	if !ok {
+		return nil, notFoundError()
+	}
+	return snapshot, nil
+}
+
+func (cloud *FakeCloudProvider) CreateInstantSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computealpha.InstantSnapshot, error) {
+	snapshotToCreate := &computealpha.InstantSnapshot{
+		Name:              snapshotName,
+		DiskSizeGb:        int64(DiskSizeGb),
+		CreationTimestamp: Timestamp,
+		Status:            "READY",
+		SourceDisk:        cloud.GetDiskSourceURI(volKey),
+		Labels:            labels,
+	}
+	var key *meta.Key
+	switch volKey.Type() {
+	case meta.Zonal:
+		key = meta.ZonalKey(snapshotName, volKey.Zone)
+		snapshotToCreate.Zone = volKey.Zone
+		snapshotToCreate.SelfLink = fmt.Sprintf("%sprojects/%s/zones/%s/instantSnapshots/%s", GCEComputeAlphaAPIEndpoint, cloud.project, volKey.Zone, snapshotName)
+	case meta.Regional:
+		key = meta.RegionalKey(snapshotName, volKey.Region)
+		snapshotToCreate.Region = volKey.Region
+		snapshotToCreate.SelfLink = fmt.Sprintf("%sprojects/%s/regions/%s/instantSnapshots/%s", GCEComputeAlphaAPIEndpoint, cloud.project, volKey.Region, snapshotName)
+	default:
+		return nil, fmt.Errorf("could not create instant snapshot, disk key was neither zonal nor regional, instead got: %v", volKey.String())
+	}
+	if snapshot, ok := cloud.instantSnapshots[key.String()]; ok {
+		return snapshot, nil
+	}
+	cloud.instantSnapshots[key.String()] = snapshotToCreate
+	return snapshotToCreate, nil
+}
+
+func (cloud *FakeCloudProvider) DeleteInstantSnapshot(ctx context.Context, key *meta.Key) error {
+	delete(cloud.instantSnapshots, key.String())
+	return nil
+}
+
 func (cloud *FakeCloudProvider) ValidateExistingSnapshot(resp *computev1.Snapshot, volKey *meta.Key) error {
 	if resp == nil {
 		return fmt.Errorf("disk does not exist")
@@ -477,10 +765,58 @@ func (cloud *FakeCloudProvider) getGlobalSnapshotURI(snapshotName string) string
 		snapshotName)
 }
 
+func (cloud *FakeCloudProvider) getGlobalImageURI(imageName string) string {
+	return BasePath + fmt.Sprintf(
+		imageURITemplateGlobal,
+		cloud.project,
+		imageName)
+}
+
 func (cloud *FakeCloudProvider) UpdateDiskStatus(s string) {
 	cloud.mockDiskStatus = s
 }
 
+// SetClock replaces the clock that times pending operations and the waits
+// for them, so that tests can step through timeouts with a fake clock.
+func (cloud *FakeCloudProvider) SetClock(clk clock.Clock) {
+	cloud.clock = clk
+}
+
+// SetDiskInsertPending marks the disk as still being inserted by another
+// request. WaitForDiskInsert makes it READY.
+func (cloud *FakeCloudProvider) SetDiskInsertPending(name string) {
+	cloud.SetDiskInsertPendingFor(name, 0)
+}
+
+// SetDiskInsertPendingFor marks the disk as still being inserted by another
+// request, which completes after d on the fake's clock. WaitForDiskInsert
+// polls for it as the real cloud provider does, and makes it READY.
+func (cloud *FakeCloudProvider) SetDiskInsertPendingFor(name string, d time.Duration) {
+	cloud.pendingInserts[name] = cloud.clock.Now().Add(d)
+}
+
+func (cloud *FakeCloudProvider) WaitForDiskInsert(ctx context.Context, volKey *meta.Key) error {
+	done, ok := cloud.pendingInserts[volKey.Name]
+	if !ok {
+		return nil
+	}
+	if err := backoff.RetryWithClock(ctx, cloud.clock, backoff.Standard, func() (bool, error) {
+		return !cloud.clock.Now().Before(done), nil
+	}); err != nil {
+		return err
+	}
+	delete(cloud.pendingInserts, volKey.Name)
+	if disk, ok := cloud.disks[volKey.Name]; ok {
+		if disk.disk != nil {
+			disk.disk.Status = "READY"
+		}
+		if disk.betaDisk != nil {
+			disk.betaDisk.Status = "READY"
+		}
+	}
+	return nil
+}
+
 type FakeBlockingCloudProvider struct {
 	*FakeCloudProvider
 	ReadyToExecute chan chan struct{}
@@ -490,11 +826,11 @@ type FakeBlockingCloudProvider struct {
 // Upon starting a CreateSnapshot, it passes a chan 'executeCreateSnapshot' into readyToExecute, then blocks on executeCreateSnapshot.
 // The test calling this function can block on readyToExecute to ensure that the operation has started and
 // allowed the CreateSnapshot to continue by passing a struct into executeCreateSnapshot.
-func (cloud *FakeBlockingCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*computev1.Snapshot, error) {
+func (cloud *FakeBlockingCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error) {
 	executeCreateSnapshot := make(chan struct{})
 	cloud.ReadyToExecute <- executeCreateSnapshot
 	<-executeCreateSnapshot
-	return cloud.FakeCloudProvider.CreateSnapshot(ctx, volKey, snapshotName)
+	return cloud.FakeCloudProvider.CreateSnapshot(ctx, volKey, snapshotName, labels)
 }
 
 func notFoundError() *googleapi.Error {
@@ -18,25 +18,35 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	computealpha "google.golang.org/api/compute/v0.alpha"
 	computebeta "google.golang.org/api/compute/v0.beta"
 	computev1 "google.golang.org/api/compute/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
 const (
 	operationStatusDone            = "DONE"
 	waitForSnapshotCreationTimeOut = 2 * time.Minute
+	waitForImageCreationTimeOut    = 2 * time.Minute
 	diskKind                       = "compute#disk"
 	cryptoKeyVerDelimiter          = "/cryptoKeyVersions"
+
+	// Descriptions given to disks created without tags.
+	diskDescriptionZonal    = "Disk created by GCE-PD CSI Driver"
+	diskDescriptionRegional = "Regional disk created by GCE-PD CSI Driver"
+	// Description given to images created as snapshots.
+	imageDescription = "Image created by GCE-PD CSI Driver"
 )
 
 type GCEAPIVersion string
@@ -46,8 +56,14 @@ const (
 	GCEAPIVersionV1 GCEAPIVersion = "v1"
 	// Alpha key type
 	GCEAPIVersionBeta GCEAPIVersion = "beta"
+	// Only used to insert disks with provisioned IOPS.
+	GCEAPIVersionAlpha GCEAPIVersion = "alpha"
 )
 
+// GCEAPIVersions are the compute API versions the controller creates clients
+// for.
+var GCEAPIVersions = []GCEAPIVersion{GCEAPIVersionV1, GCEAPIVersionBeta, GCEAPIVersionAlpha}
+
 type GCECompute interface {
 	// Metadata information
 	GetDefaultProject() string
@@ -56,25 +72,38 @@ type GCECompute interface {
 	GetDisk(ctx context.Context, volumeKey *meta.Key, gceAPIVersion GCEAPIVersion) (*CloudDisk, error)
 	RepairUnderspecifiedVolumeKey(ctx context.Context, volumeKey *meta.Key) (*meta.Key, error)
 	ValidateExistingDisk(ctx context.Context, disk *CloudDisk, params common.DiskParameters, reqBytes, limBytes int64, multiWriter bool) error
-	InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID string, multiWriter bool) error
+	InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error
+	WaitForDiskInsert(ctx context.Context, volKey *meta.Key) error
 	DeleteDisk(ctx context.Context, volumeKey *meta.Key) error
-	AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string) error
+	AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, diskInterface, instanceZone, instanceName string) error
 	DetachDisk(ctx context.Context, deviceName string, instanceZone, instanceName string) error
 	GetDiskSourceURI(volKey *meta.Key) string
 	GetDiskTypeURI(volKey *meta.Key, diskType string) string
 	WaitForAttach(ctx context.Context, volKey *meta.Key, instanceZone, instanceName string) error
 	ResizeDisk(ctx context.Context, volKey *meta.Key, requestBytes int64) (int64, error)
 	ListDisks(ctx context.Context, maxEntries int64, pageToken string) ([]*computev1.Disk, string, error)
+	AggregatedListDisks(ctx context.Context, filter string) ([]*computev1.Disk, error)
 	// Regional Disk Methods
 	GetReplicaZoneURI(zone string) string
 	// Instance Methods
 	GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*computev1.Instance, error)
 	// Zone Methods
 	ListZones(ctx context.Context, region string) ([]string, error)
+	ZonesCache() map[string][]string
 	ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Snapshot, string, error)
 	GetSnapshot(ctx context.Context, snapshotName string) (*computev1.Snapshot, error)
-	CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*computev1.Snapshot, error)
+	CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error)
 	DeleteSnapshot(ctx context.Context, snapshotName string) error
+	// Image Methods
+	ListImages(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Image, string, error)
+	GetImage(ctx context.Context, imageName string) (*computev1.Image, error)
+	CreateImage(ctx context.Context, volKey *meta.Key, imageName string, labels map[string]string) (*computev1.Image, error)
+	DeleteImage(ctx context.Context, imageName string) error
+	// Instant Snapshot Methods
+	ListInstantSnapshots(ctx context.Context, volKey *meta.Key, maxEntries int64, pageToken string) ([]*computealpha.InstantSnapshot, string, error)
+	GetInstantSnapshot(ctx context.Context, key *meta.Key) (*computealpha.InstantSnapshot, error)
+	CreateInstantSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computealpha.InstantSnapshot, error)
+	DeleteInstantSnapshot(ctx context.Context, key *meta.Key) error
 }
 
 // GetDefaultProject returns the project that was used to instantiate this GCE client.
@@ -87,10 +116,16 @@ func (cloud *CloudProvider) GetDefaultZone() string {
 	return cloud.zone
 }
 
-// ListDisks lists disks based on maxEntries and pageToken only in the project
-// and zone that the driver is running in.
+// ListDisks lists disks based on maxEntries and pageToken in the zones and the
+// region of the project that the driver is running in. Pages come from an
+// aggregated list of the whole project, so a page may hold fewer than
+// maxEntries disks even when more follow.
 func (cloud *CloudProvider) ListDisks(ctx context.Context, maxEntries int64, pageToken string) ([]*computev1.Disk, string, error) {
-	lCall := cloud.service.Disks.List(cloud.project, cloud.zone)
+	region, err := common.GetRegionFromZones([]string{cloud.zone})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get region from zones: %v", err)
+	}
+	lCall := cloud.service.Disks.AggregatedList(cloud.project)
 	if maxEntries != 0 {
 		lCall = lCall.MaxResults(maxEntries)
 	}
@@ -101,7 +136,44 @@ func (cloud *CloudProvider) ListDisks(ctx context.Context, maxEntries int64, pag
 	if err != nil {
 		return nil, "", err
 	}
-	return diskList.Items, diskList.NextPageToken, nil
+	disks := []*computev1.Disk{}
+	for scope, scopedList := range diskList.Items {
+		if isScopeInRegion(scope, region) {
+			disks = append(disks, scopedList.Disks...)
+		}
+	}
+	// Items is a map, sort so that a page is listed in a stable order.
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].SelfLink < disks[j].SelfLink
+	})
+	return disks, diskList.NextPageToken, nil
+}
+
+// isScopeInRegion returns true if the scope of an aggregated list, either
+// zones/<zone> or regions/<region>, is region or one of its zones.
+func isScopeInRegion(scope, region string) bool {
+	return scope == "regions/"+region || strings.HasPrefix(scope, "zones/"+region+"-")
+}
+
+// AggregatedListDisks lists the disks matching filter in every zone and region
+// of the project, following all result pages.
+func (cloud *CloudProvider) AggregatedListDisks(ctx context.Context, filter string) ([]*computev1.Disk, error) {
+	klog.V(5).Infof("Listing all disks in project %s with filter %q", cloud.project, filter)
+	lCall := cloud.service.Disks.AggregatedList(cloud.project)
+	if len(filter) != 0 {
+		lCall = lCall.Filter(filter)
+	}
+	disks := []*computev1.Disk{}
+	err := lCall.Pages(ctx, func(page *computev1.DiskAggregatedList) error {
+		for _, scopedList := range page.Items {
+			disks = append(disks, scopedList.Disks...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disks, nil
 }
 
 // RepairUnderspecifiedVolumeKey will query the cloud provider and check each zone for the disk specified
@@ -158,8 +230,14 @@ func (cloud *CloudProvider) RepairUnderspecifiedVolumeKey(ctx context.Context, v
 
 func (cloud *CloudProvider) ListZones(ctx context.Context, region string) ([]string, error) {
 	klog.V(5).Infof("Listing zones in region: %v", region)
-	if len(cloud.zonesCache[region]) > 0 {
-		return cloud.zonesCache[region], nil
+	cloud.zonesCacheMux.RLock()
+	cached := cloud.zonesCache[region]
+	cloud.zonesCacheMux.RUnlock()
+	if len(cached) > 0 {
+		return cached, nil
+	}
+	if cloud.minimalPermissions {
+		return nil, fmt.Errorf("cannot list the zones in region %s without compute.zones.list in minimal permission mode, name the zones in the topology requirement instead", region)
 	}
 	zones := []string{}
 	zoneList, err := cloud.service.Zones.List(cloud.project).Filter(fmt.Sprintf("region eq .*%s$", region)).Do()
@@ -169,11 +247,24 @@ func (cloud *CloudProvider) ListZones(ctx context.Context, region string) ([]str
 	for _, zone := range zoneList.Items {
 		zones = append(zones, zone.Name)
 	}
+	cloud.zonesCacheMux.Lock()
 	cloud.zonesCache[region] = zones
+	cloud.zonesCacheMux.Unlock()
 	return zones, nil
 
 }
 
+// ZonesCache returns a copy of the cached zones of each region.
+func (cloud *CloudProvider) ZonesCache() map[string][]string {
+	cloud.zonesCacheMux.RLock()
+	defer cloud.zonesCacheMux.RUnlock()
+	zonesCache := make(map[string][]string, len(cloud.zonesCache))
+	for region, zones := range cloud.zonesCache {
+		zonesCache[region] = append([]string(nil), zones...)
+	}
+	return zonesCache
+}
+
 func (cloud *CloudProvider) ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Snapshot, string, error) {
 	klog.V(5).Infof("Listing snapshots with filter: %s, max entries: %v, page token: %s", filter, maxEntries, pageToken)
 	snapshots := []*computev1.Snapshot{}
@@ -188,11 +279,23 @@ func (cloud *CloudProvider) ListSnapshots(ctx context.Context, filter string, ma
 
 }
 
+func (cloud *CloudProvider) ListImages(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Image, string, error) {
+	klog.V(5).Infof("Listing images with filter: %s, max entries: %v, page token: %s", filter, maxEntries, pageToken)
+	imageList, err := cloud.service.Images.List(cloud.project).Filter(filter).MaxResults(maxEntries).PageToken(pageToken).Context(ctx).Do()
+	if err != nil {
+		return nil, "", err
+	}
+	return imageList.Items, imageList.NextPageToken, nil
+}
+
 func (cloud *CloudProvider) GetDisk(ctx context.Context, key *meta.Key, gceAPIVersion GCEAPIVersion) (*CloudDisk, error) {
 	klog.V(5).Infof("Getting disk %v", key)
 	switch key.Type() {
 	case meta.Zonal:
-		if gceAPIVersion == GCEAPIVersionBeta {
+		if gceAPIVersion == GCEAPIVersionAlpha {
+			disk, err := cloud.alphaService.Disks.Get(cloud.project, key.Zone, key.Name).Context(ctx).Do()
+			return CloudDiskFromAlpha(disk), err
+		} else if gceAPIVersion == GCEAPIVersionBeta {
 			disk, err := cloud.getZonalBetaDiskOrError(ctx, key.Zone, key.Name)
 			return CloudDiskFromBeta(disk), err
 		} else {
@@ -200,7 +303,10 @@ func (cloud *CloudProvider) GetDisk(ctx context.Context, key *meta.Key, gceAPIVe
 			return CloudDiskFromV1(disk), err
 		}
 	case meta.Regional:
-		if gceAPIVersion == GCEAPIVersionBeta {
+		if gceAPIVersion == GCEAPIVersionAlpha {
+			disk, err := cloud.alphaService.RegionDisks.Get(cloud.project, key.Region, key.Name).Context(ctx).Do()
+			return CloudDiskFromAlpha(disk), err
+		} else if gceAPIVersion == GCEAPIVersionBeta {
 			disk, err := cloud.getRegionalAlphaDiskOrError(ctx, key.Region, key.Name)
 			return CloudDiskFromBeta(disk), err
 		} else {
@@ -303,11 +409,41 @@ func ValidateDiskParameters(disk *CloudDisk, params common.DiskParameters) error
 		return fmt.Errorf("actual disk KMS key name %s did not match expected param %s", disk.GetKMSKeyName(), params.DiskEncryptionKMSKey)
 	}
 
+	if len(params.ReplicaZones) > 0 {
+		diskZones := sets.NewString()
+		for _, replicaZone := range disk.GetReplicaZones() {
+			diskZones.Insert(replicaZone[strings.LastIndex(replicaZone, "/")+1:])
+		}
+		if !diskZones.Equal(sets.NewString(params.ReplicaZones...)) {
+			return fmt.Errorf("actual disk replica zones %v did not match expected param %v", diskZones.List(), params.ReplicaZones)
+		}
+	}
+
+	// Disks are only read with the alpha API, which reports the provisioned
+	// IOPS, when the request sets them.
+	if params.ProvisionedIOPSOnCreate > 0 && disk.GetProvisionedIops() != params.ProvisionedIOPSOnCreate {
+		return fmt.Errorf("actual disk provisioned IOPS %d did not match expected param %d", disk.GetProvisionedIops(), params.ProvisionedIOPSOnCreate)
+	}
+
+	// Labels added to the disk since it was created are not compared, only
+	// the requested ones, which InsertDisk set.
+	diskLabels := disk.GetLabels()
+	for key, value := range params.Labels {
+		if actual, ok := diskLabels[key]; !ok || actual != value {
+			return fmt.Errorf("actual disk labels %v did not match expected label %s=%s", diskLabels, key, value)
+		}
+	}
+
 	return nil
 }
 
-func (cloud *CloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID string, multiWriter bool) error {
+func (cloud *CloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error {
 	klog.V(5).Infof("Inserting disk %v", volKey)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("insert of disk %v", volKey))
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	description, err := encodeDiskTags(params.Tags)
 	if err != nil {
@@ -317,14 +453,14 @@ func (cloud *CloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, pa
 	switch volKey.Type() {
 	case meta.Zonal:
 		if description == "" {
-			description = "Disk created by GCE-PD CSI Driver"
+			description = diskDescriptionZonal
 		}
-		return cloud.insertZonalDisk(ctx, volKey, params, capBytes, capacityRange, snapshotID, description, multiWriter)
+		return cloud.insertZonalDisk(ctx, volKey, params, capBytes, capacityRange, snapshotID, volumeContentSourceVolumeID, description, multiWriter)
 	case meta.Regional:
 		if description == "" {
-			description = "Regional disk created by GCE-PD CSI Driver"
+			description = diskDescriptionRegional
 		}
-		return cloud.insertRegionalDisk(ctx, volKey, params, capBytes, capacityRange, replicaZones, snapshotID, description, multiWriter)
+		return cloud.insertRegionalDisk(ctx, volKey, params, capBytes, capacityRange, replicaZones, snapshotID, volumeContentSourceVolumeID, description, multiWriter)
 	default:
 		return fmt.Errorf("could not insert disk, key was neither zonal nor regional, instead got: %v", volKey.String())
 	}
@@ -354,11 +490,38 @@ func convertV1DiskToBetaDisk(v1Disk *computev1.Disk) *computebeta.Disk {
 		Description:       v1Disk.Description,
 		Type:              v1Disk.Type,
 		SourceSnapshot:    v1Disk.SourceSnapshot,
+		SourceImage:       v1Disk.SourceImage,
+		SourceDisk:        v1Disk.SourceDisk,
 		ReplicaZones:      v1Disk.ReplicaZones,
 		DiskEncryptionKey: dek,
 	}
 }
 
+func convertV1DiskToAlphaDisk(v1Disk *computev1.Disk) *computealpha.Disk {
+	var dek *computealpha.CustomerEncryptionKey
+	if v1Disk.DiskEncryptionKey != nil {
+		dek = &computealpha.CustomerEncryptionKey{
+			KmsKeyName: v1Disk.DiskEncryptionKey.KmsKeyName,
+			RawKey:     v1Disk.DiskEncryptionKey.RawKey,
+			Sha256:     v1Disk.DiskEncryptionKey.Sha256,
+		}
+	}
+
+	// Note: this is an incomplete list. It only includes the fields we use for disk creation.
+	return &computealpha.Disk{
+		Name:              v1Disk.Name,
+		SizeGb:            v1Disk.SizeGb,
+		Description:       v1Disk.Description,
+		Type:              v1Disk.Type,
+		SourceSnapshot:    v1Disk.SourceSnapshot,
+		SourceImage:       v1Disk.SourceImage,
+		SourceDisk:        v1Disk.SourceDisk,
+		ReplicaZones:      v1Disk.ReplicaZones,
+		DiskEncryptionKey: dek,
+		Labels:            v1Disk.Labels,
+	}
+}
+
 func (cloud *CloudProvider) insertRegionalDisk(
 	ctx context.Context,
 	volKey *meta.Key,
@@ -367,6 +530,7 @@ func (cloud *CloudProvider) insertRegionalDisk(
 	capacityRange *csi.CapacityRange,
 	replicaZones []string,
 	snapshotID string,
+	volumeContentSourceVolumeID string,
 	description string,
 	multiWriter bool) error {
 	var (
@@ -375,7 +539,9 @@ func (cloud *CloudProvider) insertRegionalDisk(
 		gceAPIVersion = GCEAPIVersionV1
 	)
 
-	if multiWriter {
+	if params.ProvisionedIOPSOnCreate > 0 || instantSnapshotSource(snapshotID) != "" {
+		gceAPIVersion = GCEAPIVersionAlpha
+	} else if multiWriter {
 		gceAPIVersion = GCEAPIVersionBeta
 	}
 
@@ -387,7 +553,11 @@ func (cloud *CloudProvider) insertRegionalDisk(
 		Labels:      params.Labels,
 	}
 	if snapshotID != "" {
-		diskToCreate.SourceSnapshot = snapshotID
+		setDiskSnapshotSource(diskToCreate, snapshotID)
+	}
+	if volumeContentSourceVolumeID != "" {
+		// Volume IDs are partial disk URLs, which GCE accepts as source.
+		diskToCreate.SourceDisk = volumeContentSourceVolumeID
 	}
 	if len(replicaZones) != 0 {
 		diskToCreate.ReplicaZones = replicaZones
@@ -398,10 +568,22 @@ func (cloud *CloudProvider) insertRegionalDisk(
 		}
 	}
 
-	if gceAPIVersion == GCEAPIVersionBeta {
+	if gceAPIVersion == GCEAPIVersionAlpha {
+		var insertOp *computealpha.Operation
+		alphaDiskToCreate := convertV1DiskToAlphaDisk(diskToCreate)
+		alphaDiskToCreate.MultiWriter = multiWriter
+		alphaDiskToCreate.ProvisionedIops = params.ProvisionedIOPSOnCreate
+		alphaDiskToCreate.SourceInstantSnapshot = instantSnapshotSource(snapshotID)
+		alphaDiskToCreate.Type = cloud.getDiskTypeURIForVersion(volKey, params.DiskType, GCEAPIVersionAlpha)
+		insertOp, err = cloud.alphaService.RegionDisks.Insert(cloud.project, volKey.Region, alphaDiskToCreate).Context(ctx).Do()
+		if insertOp != nil {
+			opName = insertOp.Name
+		}
+	} else if gceAPIVersion == GCEAPIVersionBeta {
 		var insertOp *computebeta.Operation
 		betaDiskToCreate := convertV1DiskToBetaDisk(diskToCreate)
 		betaDiskToCreate.MultiWriter = multiWriter
+		betaDiskToCreate.Type = cloud.getDiskTypeURIForVersion(volKey, params.DiskType, GCEAPIVersionBeta)
 		insertOp, err = cloud.betaService.RegionDisks.Insert(cloud.project, volKey.Region, betaDiskToCreate).Context(ctx).Do()
 		if insertOp != nil {
 			opName = insertOp.Name
@@ -415,6 +597,11 @@ func (cloud *CloudProvider) insertRegionalDisk(
 	}
 	if err != nil {
 		if IsGCEError(err, "alreadyExists") {
+			// The disk may still be being created by the request that won
+			// the race, such as from another controller replica.
+			if err := cloud.WaitForDiskInsert(ctx, volKey); err != nil {
+				klog.Warningf("Failed to wait for pending insert of disk %v: %v", volKey, err)
+			}
 			disk, err := cloud.GetDisk(ctx, volKey, gceAPIVersion)
 			if err != nil {
 				return err
@@ -435,6 +622,11 @@ func (cloud *CloudProvider) insertRegionalDisk(
 	err = cloud.waitForRegionalOp(ctx, opName, volKey.Region)
 	if err != nil {
 		if IsGCEError(err, "alreadyExists") {
+			// The disk may still be being created by the request that won
+			// the race, such as from another controller replica.
+			if err := cloud.WaitForDiskInsert(ctx, volKey); err != nil {
+				klog.Warningf("Failed to wait for pending insert of disk %v: %v", volKey, err)
+			}
 			disk, err := cloud.GetDisk(ctx, volKey, gceAPIVersion)
 			if err != nil {
 				return err
@@ -461,6 +653,7 @@ func (cloud *CloudProvider) insertZonalDisk(
 	capBytes int64,
 	capacityRange *csi.CapacityRange,
 	snapshotID string,
+	volumeContentSourceVolumeID string,
 	description string,
 	multiWriter bool) error {
 	var (
@@ -469,7 +662,9 @@ func (cloud *CloudProvider) insertZonalDisk(
 		gceAPIVersion = GCEAPIVersionV1
 	)
 
-	if multiWriter {
+	if params.ProvisionedIOPSOnCreate > 0 || instantSnapshotSource(snapshotID) != "" {
+		gceAPIVersion = GCEAPIVersionAlpha
+	} else if multiWriter {
 		gceAPIVersion = GCEAPIVersionBeta
 	}
 
@@ -482,7 +677,11 @@ func (cloud *CloudProvider) insertZonalDisk(
 	}
 
 	if snapshotID != "" {
-		diskToCreate.SourceSnapshot = snapshotID
+		setDiskSnapshotSource(diskToCreate, snapshotID)
+	}
+	if volumeContentSourceVolumeID != "" {
+		// Volume IDs are partial disk URLs, which GCE accepts as source.
+		diskToCreate.SourceDisk = volumeContentSourceVolumeID
 	}
 
 	if params.DiskEncryptionKMSKey != "" {
@@ -491,10 +690,22 @@ func (cloud *CloudProvider) insertZonalDisk(
 		}
 	}
 
-	if gceAPIVersion == GCEAPIVersionBeta {
+	if gceAPIVersion == GCEAPIVersionAlpha {
+		var insertOp *computealpha.Operation
+		alphaDiskToCreate := convertV1DiskToAlphaDisk(diskToCreate)
+		alphaDiskToCreate.MultiWriter = multiWriter
+		alphaDiskToCreate.ProvisionedIops = params.ProvisionedIOPSOnCreate
+		alphaDiskToCreate.SourceInstantSnapshot = instantSnapshotSource(snapshotID)
+		alphaDiskToCreate.Type = cloud.getDiskTypeURIForVersion(volKey, params.DiskType, GCEAPIVersionAlpha)
+		insertOp, err = cloud.alphaService.Disks.Insert(cloud.project, volKey.Zone, alphaDiskToCreate).Context(ctx).Do()
+		if insertOp != nil {
+			opName = insertOp.Name
+		}
+	} else if gceAPIVersion == GCEAPIVersionBeta {
 		var insertOp *computebeta.Operation
 		betaDiskToCreate := convertV1DiskToBetaDisk(diskToCreate)
 		betaDiskToCreate.MultiWriter = multiWriter
+		betaDiskToCreate.Type = cloud.getDiskTypeURIForVersion(volKey, params.DiskType, GCEAPIVersionBeta)
 		insertOp, err = cloud.betaService.Disks.Insert(cloud.project, volKey.Zone, betaDiskToCreate).Context(ctx).Do()
 		if insertOp != nil {
 			opName = insertOp.Name
@@ -509,6 +720,11 @@ func (cloud *CloudProvider) insertZonalDisk(
 
 	if err != nil {
 		if IsGCEError(err, "alreadyExists") {
+			// The disk may still be being created by the request that won
+			// the race, such as from another controller replica.
+			if err := cloud.WaitForDiskInsert(ctx, volKey); err != nil {
+				klog.Warningf("Failed to wait for pending insert of disk %v: %v", volKey, err)
+			}
 			disk, err := cloud.GetDisk(ctx, volKey, gceAPIVersion)
 			if err != nil {
 				return err
@@ -530,6 +746,11 @@ func (cloud *CloudProvider) insertZonalDisk(
 
 	if err != nil {
 		if IsGCEError(err, "alreadyExists") {
+			// The disk may still be being created by the request that won
+			// the race, such as from another controller replica.
+			if err := cloud.WaitForDiskInsert(ctx, volKey); err != nil {
+				klog.Warningf("Failed to wait for pending insert of disk %v: %v", volKey, err)
+			}
 			disk, err := cloud.GetDisk(ctx, volKey, gceAPIVersion)
 			if err != nil {
 				return err
@@ -549,8 +770,57 @@ func (cloud *CloudProvider) insertZonalDisk(
 	return nil
 }
 
+// WaitForDiskInsert waits for a pending insert of the disk at volKey to
+// finish, such as one issued by another controller replica. It returns nil
+// if there is none, or at once in minimal permission mode.
+func (cloud *CloudProvider) WaitForDiskInsert(ctx context.Context, volKey *meta.Key) error {
+	if cloud.minimalPermissions {
+		// Listing operations needs permissions that are not used in
+		// minimal permission mode, so the insert is not adopted.
+		return nil
+	}
+	filter := `(operationType = "insert") AND (status != "DONE")`
+	suffix := "/disks/" + volKey.Name
+	var opName string
+	findOp := func(ops *computev1.OperationList) error {
+		for _, op := range ops.Items {
+			if strings.HasSuffix(op.TargetLink, suffix) {
+				opName = op.Name
+			}
+		}
+		return nil
+	}
+	switch volKey.Type() {
+	case meta.Zonal:
+		if err := cloud.service.ZoneOperations.List(cloud.project, volKey.Zone).Filter(filter).Pages(ctx, findOp); err != nil {
+			return fmt.Errorf("failed to list operations in zone %s: %v", volKey.Zone, err)
+		}
+		if opName == "" {
+			return nil
+		}
+		klog.V(4).Infof("Waiting for pending insert operation %s of disk %v", opName, volKey)
+		return cloud.waitForZonalOp(ctx, opName, volKey.Zone)
+	case meta.Regional:
+		if err := cloud.service.RegionOperations.List(cloud.project, volKey.Region).Filter(filter).Pages(ctx, findOp); err != nil {
+			return fmt.Errorf("failed to list operations in region %s: %v", volKey.Region, err)
+		}
+		if opName == "" {
+			return nil
+		}
+		klog.V(4).Infof("Waiting for pending insert operation %s of disk %v", opName, volKey)
+		return cloud.waitForRegionalOp(ctx, opName, volKey.Region)
+	default:
+		return fmt.Errorf("could not wait for disk insert, key was neither zonal nor regional, instead got: %v", volKey.String())
+	}
+}
+
 func (cloud *CloudProvider) DeleteDisk(ctx context.Context, volKey *meta.Key) error {
 	klog.V(5).Infof("Deleting disk: %v", volKey)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("delete of disk %v", volKey))
+	if err != nil {
+		return err
+	}
+	defer release()
 	switch volKey.Type() {
 	case meta.Zonal:
 		return cloud.deleteZonalDisk(ctx, volKey.Zone, volKey.Name)
@@ -593,8 +863,13 @@ func (cloud *CloudProvider) deleteRegionalDisk(ctx context.Context, region, name
 	return nil
 }
 
-func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string) error {
+func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, diskInterface, instanceZone, instanceName string) error {
 	klog.V(5).Infof("Attaching disk %v to %s", volKey, instanceName)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("attach of disk %v to %s", volKey, instanceName))
+	if err != nil {
+		return err
+	}
+	defer release()
 	source := cloud.GetDiskSourceURI(volKey)
 
 	deviceName, err := common.GetDeviceName(volKey)
@@ -607,11 +882,13 @@ func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, re
 		Mode:       readWrite,
 		Source:     source,
 		Type:       diskType,
+		// An empty interface leaves the choice to the instance.
+		Interface: diskInterface,
 	}
 
 	op, err := cloud.service.Instances.AttachDisk(cloud.project, instanceZone, instanceName, attachedDiskV1).Context(ctx).Do()
 	if err != nil {
-		return fmt.Errorf("failed cloud service attach disk call: %v", err)
+		return fmt.Errorf("failed cloud service attach disk call: %w", err)
 	}
 	err = cloud.waitForZonalOp(ctx, op.Name, instanceZone)
 	if err != nil {
@@ -622,6 +899,11 @@ func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, re
 
 func (cloud *CloudProvider) DetachDisk(ctx context.Context, deviceName, instanceZone, instanceName string) error {
 	klog.V(5).Infof("Detaching disk %v from %v", deviceName, instanceName)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("detach of disk %v from %v", deviceName, instanceName))
+	if err != nil {
+		return err
+	}
+	defer release()
 	op, err := cloud.service.Instances.DetachDisk(cloud.project, instanceZone, instanceName, deviceName).Context(ctx).Do()
 	if err != nil {
 		return err
@@ -661,29 +943,34 @@ func (cloud *CloudProvider) getRegionalDiskSourceURI(diskName, region string) st
 }
 
 func (cloud *CloudProvider) GetDiskTypeURI(volKey *meta.Key, diskType string) string {
+	return cloud.getDiskTypeURIForVersion(volKey, diskType, GCEAPIVersionV1)
+}
+
+// getDiskTypeURIForVersion returns the disk type URI under the base path of
+// the API version the disk is inserted with.
+func (cloud *CloudProvider) getDiskTypeURIForVersion(volKey *meta.Key, diskType string, gceAPIVersion GCEAPIVersion) string {
+	basePath := cloud.service.BasePath
+	switch gceAPIVersion {
+	case GCEAPIVersionBeta:
+		basePath = cloud.betaService.BasePath
+	case GCEAPIVersionAlpha:
+		basePath = cloud.alphaService.BasePath
+	}
 	switch volKey.Type() {
 	case meta.Zonal:
-		return cloud.getZonalDiskTypeURI(volKey.Zone, diskType)
+		return basePath + fmt.Sprintf(diskTypeURITemplateSingleZone, cloud.project, volKey.Zone, diskType)
 	case meta.Regional:
-		return cloud.getRegionalDiskTypeURI(volKey.Region, diskType)
+		return basePath + fmt.Sprintf(diskTypeURITemplateRegional, cloud.project, volKey.Region, diskType)
 	default:
 		return fmt.Sprintf("could get disk type URI, key was neither zonal nor regional, instead got: %v", volKey.String())
 	}
 }
 
-func (cloud *CloudProvider) getZonalDiskTypeURI(zone, diskType string) string {
-	return cloud.service.BasePath + fmt.Sprintf(diskTypeURITemplateSingleZone, cloud.project, zone, diskType)
-}
-
-func (cloud *CloudProvider) getRegionalDiskTypeURI(region, diskType string) string {
-	return cloud.service.BasePath + fmt.Sprintf(diskTypeURITemplateRegional, cloud.project, region, diskType)
-}
-
 func (cloud *CloudProvider) waitForZonalOp(ctx context.Context, opName string, zone string) error {
 	// The v1 API can query for v1, alpha, or beta operations.
 	svc := cloud.service
 	project := cloud.project
-	return wait.Poll(3*time.Second, 5*time.Minute, func() (bool, error) {
+	return backoff.RetryWithClock(ctx, cloud.clock, backoff.Standard, func() (bool, error) {
 		pollOp, err := svc.ZoneOperations.Get(project, zone, opName).Context(ctx).Do()
 		if err != nil {
 			klog.Errorf("WaitForOp(op: %s, zone: %#v) failed to poll the operation", opName, zone)
@@ -696,7 +983,7 @@ func (cloud *CloudProvider) waitForZonalOp(ctx context.Context, opName string, z
 
 func (cloud *CloudProvider) waitForRegionalOp(ctx context.Context, opName string, region string) error {
 	// The v1 API can query for v1, alpha, or beta operations.
-	return wait.Poll(3*time.Second, 5*time.Minute, func() (bool, error) {
+	return backoff.RetryWithClock(ctx, cloud.clock, backoff.Standard, func() (bool, error) {
 		pollOp, err := cloud.service.RegionOperations.Get(cloud.project, region, opName).Context(ctx).Do()
 		if err != nil {
 			klog.Errorf("WaitForOp(op: %s, region: %#v) failed to poll the operation", opName, region)
@@ -710,7 +997,7 @@ func (cloud *CloudProvider) waitForRegionalOp(ctx context.Context, opName string
 func (cloud *CloudProvider) waitForGlobalOp(ctx context.Context, opName string) error {
 	svc := cloud.service
 	project := cloud.project
-	return wait.Poll(3*time.Second, 5*time.Minute, func() (bool, error) {
+	return backoff.RetryWithClock(ctx, cloud.clock, backoff.Standard, func() (bool, error) {
 		pollOp, err := svc.GlobalOperations.Get(project, opName).Context(ctx).Do()
 		if err != nil {
 			klog.Errorf("waitForGlobalOp(op: %s) failed to poll the operation", opName)
@@ -723,12 +1010,12 @@ func (cloud *CloudProvider) waitForGlobalOp(ctx context.Context, opName string)
 
 func (cloud *CloudProvider) WaitForAttach(ctx context.Context, volKey *meta.Key, instanceZone, instanceName string) error {
 	klog.V(5).Infof("Waiting for attach of disk %v to instance %v to complete...", volKey.Name, instanceName)
-	start := time.Now()
-	return wait.Poll(5*time.Second, 2*time.Minute, func() (bool, error) {
-		klog.V(6).Infof("Polling for attach of disk %v to instance %v to complete for %v", volKey.Name, instanceName, time.Since(start))
+	start := cloud.clock.Now()
+	return backoff.RetryWithClock(ctx, cloud.clock, backoff.AttachConflict, func() (bool, error) {
+		klog.V(6).Infof("Polling for attach of disk %v to instance %v to complete for %v", volKey.Name, instanceName, cloud.clock.Since(start))
 		disk, err := cloud.GetDisk(ctx, volKey, GCEAPIVersionV1)
 		if err != nil {
-			return false, fmt.Errorf("GetDisk failed to get disk: %v", err)
+			return false, fmt.Errorf("GetDisk failed to get disk: %w", err)
 		}
 
 		if disk == nil {
@@ -778,6 +1065,11 @@ func (cloud *CloudProvider) GetSnapshot(ctx context.Context, snapshotName string
 
 func (cloud *CloudProvider) DeleteSnapshot(ctx context.Context, snapshotName string) error {
 	klog.V(5).Infof("Deleting snapshot %v", snapshotName)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("delete of snapshot %v", snapshotName))
+	if err != nil {
+		return err
+	}
+	defer release()
 	op, err := cloud.service.Snapshots.Delete(cloud.project, snapshotName).Context(ctx).Do()
 	if err != nil {
 		if IsGCEError(err, "notFound") {
@@ -793,18 +1085,224 @@ func (cloud *CloudProvider) DeleteSnapshot(ctx context.Context, snapshotName str
 	return nil
 }
 
-func (cloud *CloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*computev1.Snapshot, error) {
+func (cloud *CloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error) {
 	klog.V(5).Infof("Creating snapshot %s for volume %v", snapshotName, volKey)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("snapshot %s of disk %v", snapshotName, volKey))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	switch volKey.Type() {
 	case meta.Zonal:
-		return cloud.createZonalDiskSnapshot(ctx, volKey, snapshotName)
+		return cloud.createZonalDiskSnapshot(ctx, volKey, snapshotName, labels)
 	case meta.Regional:
-		return cloud.createRegionalDiskSnapshot(ctx, volKey, snapshotName)
+		return cloud.createRegionalDiskSnapshot(ctx, volKey, snapshotName, labels)
 	default:
 		return nil, fmt.Errorf("could not create snapshot, key was neither zonal nor regional, instead got: %v", volKey.String())
 	}
 }
 
+func (cloud *CloudProvider) GetImage(ctx context.Context, imageName string) (*computev1.Image, error) {
+	klog.V(5).Infof("Getting image %v", imageName)
+	return cloud.service.Images.Get(cloud.project, imageName).Context(ctx).Do()
+}
+
+func (cloud *CloudProvider) DeleteImage(ctx context.Context, imageName string) error {
+	klog.V(5).Infof("Deleting image %v", imageName)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("delete of image %v", imageName))
+	if err != nil {
+		return err
+	}
+	defer release()
+	op, err := cloud.service.Images.Delete(cloud.project, imageName).Context(ctx).Do()
+	if err != nil {
+		if IsGCEError(err, "notFound") {
+			// Already deleted
+			return nil
+		}
+		return err
+	}
+	return cloud.waitForGlobalOp(ctx, op.Name)
+}
+
+// CreateImage creates an image of the disk volKey. Like a snapshot, the image
+// is taken even if the disk is attached, so it is only crash consistent.
+func (cloud *CloudProvider) CreateImage(ctx context.Context, volKey *meta.Key, imageName string, labels map[string]string) (*computev1.Image, error) {
+	klog.V(5).Infof("Creating image %s for volume %v", imageName, volKey)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("image %s of disk %v", imageName, volKey))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	imageToCreate := &computev1.Image{
+		Name:        imageName,
+		Description: imageDescription,
+		SourceDisk:  cloud.GetDiskSourceURI(volKey),
+		Labels:      labels,
+	}
+	_, err = cloud.service.Images.Insert(cloud.project, imageToCreate).ForceCreate(true).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return cloud.waitForImageCreation(ctx, imageName)
+}
+
+// waitForImageCreation waits for the image to exist. Creating an image takes
+// much longer than a snapshot, so it returns the image while it is PENDING
+// and leaves waiting for it to become READY to the callers polling
+// CreateSnapshot.
+func (cloud *CloudProvider) waitForImageCreation(ctx context.Context, imageName string) (*computev1.Image, error) {
+	ticker := cloud.clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	timer := cloud.clock.NewTimer(waitForImageCreationTimeOut)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			klog.V(6).Infof("Checking GCE Image %s.", imageName)
+			image, err := cloud.GetImage(ctx, imageName)
+			if err != nil {
+				klog.Warningf("Error in getting image %s, %v", imageName, err)
+				continue
+			}
+			klog.V(6).Infof("Image %s status is %s", imageName, image.Status)
+			return image, nil
+		case <-timer.C():
+			return nil, fmt.Errorf("Timeout waiting for image %s to be created.", imageName)
+		}
+	}
+}
+
+// setDiskSnapshotSource sets the source of diskToCreate to the snapshot or
+// image with snapshot ID snapshotID. Instant snapshots are set on the alpha
+// disk, see instantSnapshotSource.
+func setDiskSnapshotSource(diskToCreate *computev1.Disk, snapshotID string) {
+	snapshotType, _, err := common.SnapshotIDToKey(snapshotID)
+	switch {
+	case err == nil && snapshotType == common.DiskImageType:
+		diskToCreate.SourceImage = snapshotID
+	case err == nil && snapshotType == common.DiskInstantSnapshotType:
+	default:
+		diskToCreate.SourceSnapshot = snapshotID
+	}
+}
+
+// instantSnapshotSource returns snapshotID if it is the ID of an instant
+// snapshot, which only the alpha API can restore, or "" otherwise.
+func instantSnapshotSource(snapshotID string) string {
+	if snapshotType, _, err := common.SnapshotIDToKey(snapshotID); err == nil && snapshotType == common.DiskInstantSnapshotType {
+		return snapshotID
+	}
+	return ""
+}
+
+func (cloud *CloudProvider) ListInstantSnapshots(ctx context.Context, volKey *meta.Key, maxEntries int64, pageToken string) ([]*computealpha.InstantSnapshot, string, error) {
+	volumeID, err := common.KeyToVolumeID(volKey, cloud.project)
+	if err != nil {
+		return nil, "", err
+	}
+	filter := fmt.Sprintf("sourceDisk eq .*%s$", volumeID)
+	klog.V(5).Infof("Listing instant snapshots with filter: %s, max entries: %v, page token: %s", filter, maxEntries, pageToken)
+	var list *computealpha.InstantSnapshotList
+	switch volKey.Type() {
+	case meta.Zonal:
+		list, err = cloud.alphaService.ZoneInstantSnapshots.List(cloud.project, volKey.Zone).Filter(filter).MaxResults(maxEntries).PageToken(pageToken).Context(ctx).Do()
+	case meta.Regional:
+		list, err = cloud.alphaService.RegionInstantSnapshots.List(cloud.project, volKey.Region).Filter(filter).MaxResults(maxEntries).PageToken(pageToken).Context(ctx).Do()
+	default:
+		return nil, "", fmt.Errorf("could not list instant snapshots, key was neither zonal nor regional, instead got: %v", volKey.String())
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return list.Items, list.NextPageToken, nil
+}
+
+func (cloud *CloudProvider) GetInstantSnapshot(ctx context.Context, key *meta.Key) (*computealpha.InstantSnapshot, error) {
+	klog.V(5).Infof("Getting instant snapshot %v", key)
+	switch key.Type() {
+	case meta.Zonal:
+		return cloud.alphaService.ZoneInstantSnapshots.Get(cloud.project, key.Zone, key.Name).Context(ctx).Do()
+	case meta.Regional:
+		return cloud.alphaService.RegionInstantSnapshots.Get(cloud.project, key.Region, key.Name).Context(ctx).Do()
+	default:
+		return nil, fmt.Errorf("could not get instant snapshot, key was neither zonal nor regional, instead got: %v", key.String())
+	}
+}
+
+// CreateInstantSnapshot creates an instant snapshot of the disk volKey, in
+// the zone or region of the disk.
+func (cloud *CloudProvider) CreateInstantSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computealpha.InstantSnapshot, error) {
+	klog.V(5).Infof("Creating instant snapshot %s for volume %v", snapshotName, volKey)
+	volumeID, err := common.KeyToVolumeID(volKey, cloud.project)
+	if err != nil {
+		return nil, err
+	}
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("instant snapshot %s of disk %v", snapshotName, volKey))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	snapshotToCreate := &computealpha.InstantSnapshot{
+		Name: snapshotName,
+		// Volume IDs are partial disk URLs, which GCE accepts as source.
+		SourceDisk: volumeID,
+		Labels:     labels,
+	}
+	switch volKey.Type() {
+	case meta.Zonal:
+		op, err := cloud.alphaService.ZoneInstantSnapshots.Insert(cloud.project, volKey.Zone, snapshotToCreate).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		if err := cloud.waitForZonalOp(ctx, op.Name, volKey.Zone); err != nil {
+			return nil, err
+		}
+		return cloud.GetInstantSnapshot(ctx, meta.ZonalKey(snapshotName, volKey.Zone))
+	case meta.Regional:
+		op, err := cloud.alphaService.RegionInstantSnapshots.Insert(cloud.project, volKey.Region, snapshotToCreate).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		if err := cloud.waitForRegionalOp(ctx, op.Name, volKey.Region); err != nil {
+			return nil, err
+		}
+		return cloud.GetInstantSnapshot(ctx, meta.RegionalKey(snapshotName, volKey.Region))
+	default:
+		return nil, fmt.Errorf("could not create instant snapshot, key was neither zonal nor regional, instead got: %v", volKey.String())
+	}
+}
+
+func (cloud *CloudProvider) DeleteInstantSnapshot(ctx context.Context, key *meta.Key) error {
+	klog.V(5).Infof("Deleting instant snapshot %v", key)
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("delete of instant snapshot %v", key))
+	if err != nil {
+		return err
+	}
+	defer release()
+	var op *computealpha.Operation
+	switch key.Type() {
+	case meta.Zonal:
+		op, err = cloud.alphaService.ZoneInstantSnapshots.Delete(cloud.project, key.Zone, key.Name).Context(ctx).Do()
+	case meta.Regional:
+		op, err = cloud.alphaService.RegionInstantSnapshots.Delete(cloud.project, key.Region, key.Name).Context(ctx).Do()
+	default:
+		return fmt.Errorf("could not delete instant snapshot, key was neither zonal nor regional, instead got: %v", key.String())
+	}
+	if err != nil {
+		if IsGCEError(err, "notFound") {
+			// Already deleted
+			return nil
+		}
+		return err
+	}
+	if key.Type() == meta.Zonal {
+		return cloud.waitForZonalOp(ctx, op.Name, key.Zone)
+	}
+	return cloud.waitForRegionalOp(ctx, op.Name, key.Region)
+}
+
 // ResizeDisk takes in the requested disk size in bytes and returns the resized
 // size in Gi
 // TODO(#461) The whole driver could benefit from standardized usage of the
@@ -825,6 +1323,12 @@ func (cloud *CloudProvider) ResizeDisk(ctx context.Context, volKey *meta.Key, re
 		return sizeGb, nil
 	}
 
+	release, err := cloud.opLimiter.acquire(ctx, fmt.Sprintf("resize of disk %v", volKey))
+	if err != nil {
+		return -1, err
+	}
+	defer release()
+
 	switch volKey.Type() {
 	case meta.Zonal:
 		return cloud.resizeZonalDisk(ctx, volKey, requestGb)
@@ -870,9 +1374,10 @@ func (cloud *CloudProvider) resizeRegionalDisk(ctx context.Context, volKey *meta
 	return requestGb, nil
 }
 
-func (cloud *CloudProvider) createZonalDiskSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*computev1.Snapshot, error) {
+func (cloud *CloudProvider) createZonalDiskSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error) {
 	snapshotToCreate := &computev1.Snapshot{
-		Name: snapshotName,
+		Name:   snapshotName,
+		Labels: labels,
 	}
 
 	_, err := cloud.service.Disks.CreateSnapshot(cloud.project, volKey.Zone, volKey.Name, snapshotToCreate).Context(ctx).Do()
@@ -884,9 +1389,10 @@ func (cloud *CloudProvider) createZonalDiskSnapshot(ctx context.Context, volKey
 	return cloud.waitForSnapshotCreation(ctx, snapshotName)
 }
 
-func (cloud *CloudProvider) createRegionalDiskSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*computev1.Snapshot, error) {
+func (cloud *CloudProvider) createRegionalDiskSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error) {
 	snapshotToCreate := &computev1.Snapshot{
-		Name: snapshotName,
+		Name:   snapshotName,
+		Labels: labels,
 	}
 
 	_, err := cloud.service.RegionDisks.CreateSnapshot(cloud.project, volKey.Region, volKey.Name, snapshotToCreate).Context(ctx).Do()
@@ -899,14 +1405,14 @@ func (cloud *CloudProvider) createRegionalDiskSnapshot(ctx context.Context, volK
 }
 
 func (cloud *CloudProvider) waitForSnapshotCreation(ctx context.Context, snapshotName string) (*computev1.Snapshot, error) {
-	ticker := time.NewTicker(time.Second)
+	ticker := cloud.clock.NewTicker(time.Second)
 	defer ticker.Stop()
-	timer := time.NewTimer(waitForSnapshotCreationTimeOut)
+	timer := cloud.clock.NewTimer(waitForSnapshotCreationTimeOut)
 	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			klog.V(6).Infof("Checking GCE Snapshot %s.", snapshotName)
 			snapshot, err := cloud.GetSnapshot(ctx, snapshotName)
 			if err != nil {
@@ -919,7 +1425,7 @@ func (cloud *CloudProvider) waitForSnapshotCreation(ctx context.Context, snapsho
 					klog.V(6).Infof("Snapshot %s is still creating ...", snapshotName)
 				}
 			}
-		case <-timer.C:
+		case <-timer.C():
 			return nil, fmt.Errorf("Timeout waiting for snapshot %s to be created.", snapshotName)
 		}
 	}
@@ -943,6 +1449,48 @@ func removeCryptoKeyVersion(kmsKey string) string {
 	return kmsKey
 }
 
+// IsDiskCreatedByDriver returns true if the disk description carries one of
+// the markers written by InsertDisk: either the default description, or tags
+// naming driverName as the creator.
+func IsDiskCreatedByDriver(disk *CloudDisk, driverName string) bool {
+	description := disk.GetDescription()
+	if description == diskDescriptionZonal || description == diskDescriptionRegional {
+		return true
+	}
+	tags := map[string]string{}
+	if err := json.Unmarshal([]byte(description), &tags); err != nil {
+		return false
+	}
+	return tags[common.TagKeyCreatedBy] == driverName
+}
+
+// IsImageCreatedByDriver returns true if image was created by CreateImage,
+// rather than being one of the other images of the project.
+func IsImageCreatedByDriver(image *computev1.Image) bool {
+	return image.Description == imageDescription
+}
+
+// IsDiskCreatedByInTreeProvisioner returns true if a disk of the given name
+// and description was provisioned by the in-tree GCE PD plugin. That plugin
+// names disks "<cluster name>-dynamic-<pv name>", truncating the prefix to
+// fit 63 characters, and tags the description with the PV name but not with
+// a creator.
+func IsDiskCreatedByInTreeProvisioner(name, description string) bool {
+	tags := map[string]string{}
+	if err := json.Unmarshal([]byte(description), &tags); err != nil {
+		return false
+	}
+	if _, ok := tags[common.TagKeyCreatedBy]; ok {
+		return false
+	}
+	pvName := tags[common.TagKeyCreatedForVolumeName]
+	if !strings.HasPrefix(pvName, "pvc-") {
+		return false
+	}
+	prefix := strings.TrimSuffix(name, "-"+pvName)
+	return prefix != name && prefix != ""
+}
+
 // encodeDiskTags encodes requested volume tags into JSON string, as GCE does
 // not support tags on GCE PDs and we use Description field as fallback.
 func encodeDiskTags(tags map[string]string) (string, error) {
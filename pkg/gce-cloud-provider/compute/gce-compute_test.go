@@ -15,9 +15,29 @@ limitations under the License.
 package gcecloudprovider
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	"golang.org/x/oauth2"
+	computealpha "google.golang.org/api/compute/v0.alpha"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	computev1 "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
@@ -25,6 +45,8 @@ func TestValidateDiskParameters(t *testing.T) {
 	testCases := []struct {
 		fetchedKMSKey      string
 		storageClassKMSKey string
+		fetchedLabels      map[string]string
+		storageClassLabels map[string]string
 		expectErr          bool
 	}{
 		{
@@ -62,6 +84,20 @@ func TestValidateDiskParameters(t *testing.T) {
 			storageClassKMSKey: "projects/my-project/locations/us-central1/keyRings/TestKeyRing/cryptoKeys/foo",
 			expectErr:          true,
 		},
+		{
+			fetchedLabels:      map[string]string{"team": "storage", "cost-center": "1234"},
+			storageClassLabels: map[string]string{"team": "storage"},
+			expectErr:          false,
+		},
+		{
+			fetchedLabels:      map[string]string{"team": "compute"},
+			storageClassLabels: map[string]string{"team": "storage"},
+			expectErr:          true,
+		},
+		{
+			storageClassLabels: map[string]string{"team": "storage"},
+			expectErr:          true,
+		},
 	}
 
 	for i, tc := range testCases {
@@ -78,6 +114,7 @@ func TestValidateDiskParameters(t *testing.T) {
 			DiskEncryptionKey: &computev1.CustomerEncryptionKey{
 				KmsKeyName: tc.fetchedKMSKey,
 			},
+			Labels:                 tc.fetchedLabels,
 			LabelFingerprint:       "42WmSpB8rSM=",
 			PhysicalBlockSizeBytes: 4096,
 			Kind:                   "compute#disk",
@@ -87,6 +124,7 @@ func TestValidateDiskParameters(t *testing.T) {
 			DiskType:             "pd-standard",
 			ReplicationType:      "none",
 			DiskEncryptionKMSKey: tc.storageClassKMSKey,
+			Labels:               tc.storageClassLabels,
 		}
 
 		// Act
@@ -101,3 +139,597 @@ func TestValidateDiskParameters(t *testing.T) {
 		}
 	}
 }
+
+func TestIsDiskCreatedByInTreeProvisioner(t *testing.T) {
+	const pvName = "pvc-3b9a0f1e-5c4d-4e2b-9a7f-2d1c0b8e6f5a"
+	testCases := []struct {
+		name        string
+		diskName    string
+		description string
+		expected    bool
+	}{
+		{
+			name:        "in-tree disk",
+			diskName:    "kubernetes-dynamic-" + pvName,
+			description: `{"kubernetes.io/created-for/pv/name":"` + pvName + `","kubernetes.io/created-for/pvc/name":"data","kubernetes.io/created-for/pvc/namespace":"default"}`,
+			expected:    true,
+		},
+		{
+			name:        "in-tree disk with truncated cluster name",
+			diskName:    "my-long-cluster-name-d-" + pvName,
+			description: `{"kubernetes.io/created-for/pv/name":"` + pvName + `"}`,
+			expected:    true,
+		},
+		{
+			name:        "driver disk",
+			diskName:    pvName,
+			description: `{"kubernetes.io/created-for/pv/name":"` + pvName + `","storage.gke.io/created-by":"pd.csi.storage.gke.io"}`,
+		},
+		{
+			name:        "driver disk without creator",
+			diskName:    pvName,
+			description: `{"kubernetes.io/created-for/pv/name":"` + pvName + `"}`,
+		},
+		{
+			name:        "name of another pv",
+			diskName:    "kubernetes-dynamic-pvc-00000000-0000-0000-0000-000000000000",
+			description: `{"kubernetes.io/created-for/pv/name":"` + pvName + `"}`,
+		},
+		{
+			name:     "no description",
+			diskName: "kubernetes-dynamic-" + pvName,
+		},
+	}
+	for _, tc := range testCases {
+		if got := IsDiskCreatedByInTreeProvisioner(tc.diskName, tc.description); got != tc.expected {
+			t.Errorf("%s: got %t, expected %t", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestCheckEndpointReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Take a free port and close it again so that connections are refused.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	testCases := []struct {
+		name      string
+		endpoint  string
+		expectErr bool
+	}{
+		{
+			name:     "reachable",
+			endpoint: server.URL,
+		},
+		{
+			name:      "connection refused",
+			endpoint:  closedURL,
+			expectErr: true,
+		},
+		{
+			name:      "no scheme",
+			endpoint:  "compute.googleapis.com",
+			expectErr: true,
+		},
+		{
+			name:      "unsupported scheme",
+			endpoint:  "ftp://compute.googleapis.com",
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		err := checkEndpointReachable(tc.endpoint, time.Second)
+		if tc.expectErr && err == nil {
+			t.Errorf("%s: expected error for %s", tc.name, tc.endpoint)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("%s: unexpected error for %s: %v", tc.name, tc.endpoint, err)
+		}
+	}
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "gce.conf")
+	config := "[global]\nproject-id = test-project\ncompute-endpoint = https://compute.example.com\n"
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	configFile, err := readConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		endpoints  Endpoints
+		configFile *ConfigFile
+		expCompute string
+		expectErr  bool
+	}{
+		{
+			name:       "from config",
+			configFile: configFile,
+			expCompute: "https://compute.example.com",
+		},
+		{
+			name:       "flag overrides config",
+			endpoints:  Endpoints{Compute: "https://private.example.com"},
+			configFile: configFile,
+			expCompute: "https://private.example.com",
+		},
+		{
+			name: "no config",
+		},
+		{
+			name:       "region overrides config",
+			endpoints:  Endpoints{Region: "us-central1"},
+			configFile: configFile,
+			expCompute: "https://us-central1-compute.googleapis.com",
+		},
+		{
+			name:      "region and compute endpoint",
+			endpoints: Endpoints{Compute: "https://private.example.com", Region: "us-central1"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid region",
+			endpoints: Endpoints{Region: "us-central1.example.com"},
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		got, err := tc.endpoints.resolve(tc.configFile)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if got.Compute != tc.expCompute {
+			t.Errorf("%s: got compute endpoint %q, expected %q", tc.name, got.Compute, tc.expCompute)
+		}
+	}
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer base-token" {
+			t.Errorf("got authorization %q, expected the base token", got)
+		}
+		var req struct {
+			Scope []string `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if len(req.Scope) != 1 || req.Scope[0] != computev1.ComputeScope {
+			t.Errorf("got scopes %v, expected %v", req.Scope, []string{computev1.ComputeScope})
+		}
+		fmt.Fprintf(w, `{"accessToken": "impersonated-token", "expireTime": %q}`, expiry.Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	ts := &impersonatedTokenSource{
+		client: oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "base-token"})),
+		url:    server.URL,
+		scopes: []string{computev1.ComputeScope},
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if tok.AccessToken != "impersonated-token" || !tok.Expiry.Equal(expiry) {
+		t.Errorf("got token %q expiring %v, expected %q expiring %v", tok.AccessToken, tok.Expiry, "impersonated-token", expiry)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	transport := newInstrumentedTransport(TransportOptions{MaxIdleConnsPerHost: 200})
+	base := transport.base.(*http.Transport)
+	if base.MaxIdleConnsPerHost != 200 {
+		t.Errorf("expected MaxIdleConnsPerHost 200, got %d", base.MaxIdleConnsPerHost)
+	}
+	if base.MaxIdleConns < 200 {
+		t.Errorf("expected MaxIdleConns of at least 200, got %d", base.MaxIdleConns)
+	}
+
+	transport = newInstrumentedTransport(TransportOptions{})
+	if got, want := transport.base.(*http.Transport).MaxIdleConnsPerHost, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost; got != want {
+		t.Errorf("expected default MaxIdleConnsPerHost %d, got %d", want, got)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL + "/compute/v1/projects/p")
+	if err != nil {
+		t.Fatalf("request through transport failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestRetryingTransport(t *testing.T) {
+	testCases := []struct {
+		name        string
+		method      string
+		statuses    []int
+		maxAttempts int
+		expStatus   int
+		expAttempts int
+	}{
+		{
+			name:        "get retried on server error",
+			method:      http.MethodGet,
+			statuses:    []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+			maxAttempts: 3,
+			expStatus:   http.StatusOK,
+			expAttempts: 3,
+		},
+		{
+			name:        "get gives up after max attempts",
+			method:      http.MethodGet,
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			maxAttempts: 2,
+			expStatus:   http.StatusServiceUnavailable,
+			expAttempts: 2,
+		},
+		{
+			name:        "get not retried on client error",
+			method:      http.MethodGet,
+			statuses:    []int{http.StatusNotFound, http.StatusOK},
+			maxAttempts: 3,
+			expStatus:   http.StatusNotFound,
+			expAttempts: 1,
+		},
+		{
+			name:        "post retried on rate limit",
+			method:      http.MethodPost,
+			statuses:    []int{http.StatusTooManyRequests, http.StatusOK},
+			maxAttempts: 3,
+			expStatus:   http.StatusOK,
+			expAttempts: 2,
+		},
+		{
+			name:        "post not retried on internal error",
+			method:      http.MethodPost,
+			statuses:    []int{http.StatusInternalServerError, http.StatusOK},
+			maxAttempts: 3,
+			expStatus:   http.StatusInternalServerError,
+			expAttempts: 1,
+		},
+		{
+			name:        "retries disabled",
+			method:      http.MethodGet,
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusOK},
+			maxAttempts: 1,
+			expStatus:   http.StatusServiceUnavailable,
+			expAttempts: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Running test: %v", tc.name)
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				body := make([]byte, 4)
+				if n, _ := r.Body.Read(body); string(body[:n]) != "body" {
+					t.Errorf("attempt %d got body %q, expected %q", attempts+1, body[:n], "body")
+				}
+			}
+			w.WriteHeader(tc.statuses[attempts])
+			attempts++
+		}))
+		transport, _ := newTransport(TransportOptions{
+			MaxAttempts:    tc.maxAttempts,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		})
+		client := &http.Client{Transport: transport}
+		req, err := http.NewRequest(tc.method, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != tc.expStatus {
+				t.Errorf("got status %d, expected %d", resp.StatusCode, tc.expStatus)
+			}
+		}
+		if attempts != tc.expAttempts {
+			t.Errorf("got %d attempts, expected %d", attempts, tc.expAttempts)
+		}
+		server.Close()
+	}
+}
+
+func TestRateLimitedTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	transport, limiter := newTransport(TransportOptions{QPS: 0.001, Burst: 1})
+	client := &http.Client{Transport: transport}
+	send := func(method, path string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	diskPath := "/compute/v1/projects/p/zones/z/disks/d"
+	if err := send(http.MethodGet, diskPath); err != nil {
+		t.Errorf("first read failed: %v", err)
+	}
+	if err := send(http.MethodGet, diskPath); err == nil {
+		t.Errorf("expected a read beyond the burst to be throttled")
+	}
+	if err := send(http.MethodPost, diskPath); err != nil {
+		t.Errorf("first mutation failed: %v", err)
+	}
+	if err := send(http.MethodPost, "/token"); err != nil {
+		t.Errorf("token request failed: %v", err)
+	}
+
+	limiter.setLimit(0, 0)
+	if err := send(http.MethodGet, diskPath); err != nil {
+		t.Errorf("read after removing the limit failed: %v", err)
+	}
+}
+
+func TestOperationLimiter(t *testing.T) {
+	var unlimited *operationLimiter
+	release, err := unlimited.acquire(context.Background(), "op")
+	if err != nil {
+		t.Fatalf("acquire() on a nil limiter failed: %v", err)
+	}
+	release()
+
+	limiter := newOperationLimiter(1)
+	release, err = limiter.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() of a free slot failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "second"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire() with no free slot = %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := limiter.acquire(context.Background(), "third")
+		if err != nil {
+			t.Errorf("acquire() after a release failed: %v", err)
+			return
+		}
+		release()
+		close(acquired)
+	}()
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Errorf("waiting acquire() did not get the released slot")
+	}
+}
+
+func TestComputeErrorReason(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "no error",
+		},
+		{
+			name: "googleapi reason",
+			err:  &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}},
+			want: "quotaExceeded",
+		},
+		{
+			name: "wrapped googleapi error without reason",
+			err:  fmt.Errorf("attach failed: %w", &googleapi.Error{Code: http.StatusServiceUnavailable}),
+			want: "503",
+		},
+		{
+			name: "context done",
+			err:  fmt.Errorf("polling failed: %w", context.DeadlineExceeded),
+			want: "contextDone",
+		},
+		{
+			name: "other",
+			err:  errors.New("disk does not exist"),
+			want: "other",
+		},
+	}
+	for _, tc := range testCases {
+		if got := computeErrorReason(tc.err); got != tc.want {
+			t.Errorf("%s: computeErrorReason(%v) = %q, want %q", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestComputeAPIVersion(t *testing.T) {
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{path: "/compute/v1/projects/p/zones/z/disks/d", want: apiVersionV1},
+		{path: "/compute/beta/projects/p/zones/z/disks/d", want: apiVersionBeta},
+		{path: "/compute/alpha/projects/p/zones/z/instances/i", want: apiVersionAlpha},
+		{path: "/token", want: apiVersionOther},
+	}
+	for _, tc := range testCases {
+		if got := computeAPIVersion(tc.path); got != tc.want {
+			t.Errorf("computeAPIVersion(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestGetDiskTypeURIForVersion(t *testing.T) {
+	cloud := &CloudProvider{
+		service:      &computev1.Service{BasePath: "https://compute.googleapis.com/compute/v1/projects/"},
+		betaService:  &computebeta.Service{BasePath: "https://compute.googleapis.com/compute/beta/projects/"},
+		alphaService: &computealpha.Service{BasePath: "https://compute.googleapis.com/compute/alpha/projects/"},
+		project:      "test-project",
+	}
+	testCases := []struct {
+		volKey  *meta.Key
+		version GCEAPIVersion
+		want    string
+	}{
+		{
+			volKey:  meta.ZonalKey("disk", "us-central1-c"),
+			version: GCEAPIVersionV1,
+			want:    "https://compute.googleapis.com/compute/v1/projects/test-project/zones/us-central1-c/diskTypes/hyperdisk-balanced",
+		},
+		{
+			volKey:  meta.ZonalKey("disk", "us-central1-c"),
+			version: GCEAPIVersionAlpha,
+			want:    "https://compute.googleapis.com/compute/alpha/projects/test-project/zones/us-central1-c/diskTypes/hyperdisk-balanced",
+		},
+		{
+			volKey:  meta.RegionalKey("disk", "us-central1"),
+			version: GCEAPIVersionBeta,
+			want:    "https://compute.googleapis.com/compute/beta/projects/test-project/regions/us-central1/diskTypes/hyperdisk-balanced",
+		},
+	}
+	for _, tc := range testCases {
+		if got := cloud.getDiskTypeURIForVersion(tc.volKey, "hyperdisk-balanced", tc.version); got != tc.want {
+			t.Errorf("getDiskTypeURIForVersion(%v, %s) = %q, want %q", tc.volKey, tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestFakeWaitForDiskInsert(t *testing.T) {
+	testCases := []struct {
+		name        string
+		pendingFor  time.Duration
+		expDuration time.Duration
+		expErr      error
+	}{
+		{
+			name:       "not pending",
+			pendingFor: -1,
+		},
+		{
+			// Polled every 3s.
+			name:        "completes",
+			pendingFor:  10 * time.Second,
+			expDuration: 12 * time.Second,
+		},
+		{
+			name:        "times out",
+			pendingFor:  time.Hour,
+			expDuration: 5 * time.Minute,
+			expErr:      wait.ErrWaitTimeout,
+		},
+	}
+	for _, tc := range testCases {
+		start := time.Now()
+		clk := clock.NewFakeClock(start)
+		fcp, err := CreateFakeCloudProvider("test-project", "test-zone", nil)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		fcp.SetClock(clk)
+		if tc.pendingFor >= 0 {
+			fcp.SetDiskInsertPendingFor("disk", tc.pendingFor)
+		}
+
+		errCh := make(chan error)
+		go func() {
+			errCh <- fcp.WaitForDiskInsert(context.Background(), meta.ZonalKey("disk", "test-zone"))
+		}()
+		var waitErr error
+	waiting:
+		for {
+			select {
+			case waitErr = <-errCh:
+				break waiting
+			default:
+			}
+			if clk.HasWaiters() {
+				clk.Step(time.Second)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if waitErr != tc.expErr {
+			t.Errorf("%s: got error %v, expected %v", tc.name, waitErr, tc.expErr)
+		}
+		if got := clk.Since(start); got != tc.expDuration {
+			t.Errorf("%s: waited %v, expected %v", tc.name, got, tc.expDuration)
+		}
+	}
+}
+
+func TestMinimalPermissions(t *testing.T) {
+	// The cloud provider has no services, so any API call would panic.
+	cloud := &CloudProvider{
+		project:    "test-project",
+		zone:       "us-central1-a",
+		zonesCache: map[string][]string{"us-east1": {"us-east1-b", "us-east1-c"}},
+	}
+	cloud.SetMinimalPermissions()
+
+	if _, err := cloud.ListZones(context.Background(), "us-central1"); err == nil {
+		t.Errorf("ListZones of an uncached region succeeded, expected an error")
+	}
+	zones, err := cloud.ListZones(context.Background(), "us-east1")
+	if err != nil || !reflect.DeepEqual(zones, []string{"us-east1-b", "us-east1-c"}) {
+		t.Errorf("ListZones of a cached region = %v, %v, expected the cached zones", zones, err)
+	}
+	if err := cloud.WaitForDiskInsert(context.Background(), meta.ZonalKey("disk", "us-central1-a")); err != nil {
+		t.Errorf("WaitForDiskInsert failed: %v", err)
+	}
+}
+
+func TestIsScopeInRegion(t *testing.T) {
+	testCases := []struct {
+		scope    string
+		expected bool
+	}{
+		{scope: "zones/us-central1-a", expected: true},
+		{scope: "regions/us-central1", expected: true},
+		{scope: "zones/us-central2-a", expected: false},
+		{scope: "regions/us-central2", expected: false},
+		{scope: "zones/us-central1", expected: false},
+		{scope: "global", expected: false},
+	}
+	for _, tc := range testCases {
+		if got := isScopeInRegion(tc.scope, "us-central1"); got != tc.expected {
+			t.Errorf("%s: got %v, expected %v", tc.scope, got, tc.expected)
+		}
+	}
+}
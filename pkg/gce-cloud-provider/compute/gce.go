@@ -16,10 +16,16 @@ package gcecloudprovider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2/google"
@@ -28,11 +34,13 @@ import (
 
 	"cloud.google.com/go/compute/metadata"
 	"golang.org/x/oauth2"
+	computealpha "google.golang.org/api/compute/v0.alpha"
 	computebeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
 )
 
 const (
@@ -48,16 +56,38 @@ const (
 	GCEComputeBetaAPIEndpoint  = "https://www.googleapis.com/compute/beta/"
 	GCEComputeAlphaAPIEndpoint = "https://www.googleapis.com/compute/alpha/"
 
+	regionalComputeEndpointTemplate = "https://%s-compute.googleapis.com"
+
 	replicaZoneURITemplateSingleZone = "%s/zones/%s" // {gce.projectID}/zones/{disk.Zone}
+
+	// Timeout for each DNS lookup and connection attempt of the endpoint
+	// preflight check.
+	endpointPreflightTimeout = 10 * time.Second
 )
 
 type CloudProvider struct {
 	service     *compute.Service
 	betaService *computebeta.Service
-	project     string
-	zone        string
-
-	zonesCache map[string][]string
+	// alphaService is only used for disks with provisioned IOPS and for
+	// instant snapshots, which the v1 and beta APIs do not support yet.
+	alphaService *computealpha.Service
+	project      string
+	zone         string
+
+	zonesCache    map[string][]string
+	zonesCacheMux sync.RWMutex
+
+	opLimiter *operationLimiter
+	// apiLimiter throttles compute API requests. It is nil for cloud
+	// providers not created by CreateCloudProvider.
+	apiLimiter *rateLimitedTransport
+
+	// clock times the waits for operations, attaches and snapshots.
+	clock clock.Clock
+
+	// If set, the optional API calls listed in minimalPermissionsDropped
+	// are not made.
+	minimalPermissions bool
 }
 
 var _ GCECompute = &CloudProvider{}
@@ -71,9 +101,76 @@ type ConfigGlobal struct {
 	TokenBody string `gcfg:"token-body"`
 	ProjectId string `gcfg:"project-id"`
 	Zone      string `gcfg:"zone"`
+	// ComputeEndpoint is used as Endpoints.Compute when that is not set.
+	ComputeEndpoint string `gcfg:"compute-endpoint"`
+}
+
+// Endpoints overrides the Google API endpoints used by the driver, for
+// example to reach the restricted VIP from inside a VPC Service Controls
+// perimeter without internet egress. Empty fields keep the public endpoints.
+type Endpoints struct {
+	// Compute is the root URL of the compute API, such as
+	// https://compute.googleapis.com. The versioned paths are appended to it.
+	Compute string
+	// OAuthToken is the OAuth 2.0 token URL used with service account key
+	// credentials, such as https://oauth2.googleapis.com/token.
+	OAuthToken string
+	// Region, if set, selects the regional compute endpoint of the region,
+	// such as https://us-central1-compute.googleapis.com, so that requests
+	// stay in the region. It cannot be used with Compute.
+	Region string
+}
+
+// resolve returns e with the compute endpoint set from Region, or if
+// neither is set taken from configFile, which may be nil.
+func (e Endpoints) resolve(configFile *ConfigFile) (Endpoints, error) {
+	if e.Region != "" {
+		if e.Compute != "" {
+			return e, fmt.Errorf("compute endpoint %s and endpoint region %s cannot both be set", e.Compute, e.Region)
+		}
+		if strings.ContainsAny(e.Region, "/:.") {
+			return e, fmt.Errorf("invalid endpoint region %q", e.Region)
+		}
+		e.Compute = fmt.Sprintf(regionalComputeEndpointTemplate, e.Region)
+	}
+	if e.Compute == "" && configFile != nil {
+		e.Compute = configFile.Global.ComputeEndpoint
+	}
+	return e, nil
+}
+
+// CredentialOptions changes the identity the driver calls the APIs as.
+type CredentialOptions struct {
+	// ImpersonateServiceAccount, if set, is the email of a service account
+	// whose short-lived tokens are generated with the base credentials and
+	// used for all compute API calls. The base identity needs
+	// roles/iam.serviceAccountTokenCreator on it.
+	ImpersonateServiceAccount string
+}
+
+// TransportOptions tunes the HTTP transport shared by the compute API clients
+// and the token source.
+type TransportOptions struct {
+	// MaxIdleConnsPerHost is the number of idle connections kept open to
+	// each API host. Zero keeps the net/http default.
+	MaxIdleConnsPerHost int
+	// MaxAttempts is the total number of attempts of a request that fails
+	// with a retryable error, including the first. Zero or one disables
+	// retries.
+	MaxAttempts int
+	// InitialBackoff is the pause before the first retry. It doubles after
+	// each further attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// QPS and Burst configure two token buckets that compute API requests
+	// wait on before they are sent, one for reads and one for mutations, so
+	// a burst of creates cannot starve polling and vice versa. Zero QPS
+	// disables the limit. Token requests are not limited.
+	QPS   float32
+	Burst int
 }
 
-func CreateCloudProvider(ctx context.Context, vendorVersion string, configPath string) (*CloudProvider, error) {
+func CreateCloudProvider(ctx context.Context, vendorVersion string, configPath string, endpoints Endpoints, credentialOpts CredentialOptions, transportOpts TransportOptions) (*CloudProvider, error) {
 	configFile, err := readConfig(configPath)
 	if err != nil {
 		return nil, err
@@ -83,37 +180,84 @@ func CreateCloudProvider(ctx context.Context, vendorVersion string, configPath s
 
 	klog.V(2).Infof("Using GCE provider config %+v", configFile)
 
-	tokenSource, err := generateTokenSource(ctx, configFile)
+	endpoints, err = endpoints.resolve(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	svc, err := createCloudService(ctx, vendorVersion, tokenSource)
+	for _, endpoint := range []string{endpoints.Compute, endpoints.OAuthToken} {
+		if endpoint == "" {
+			continue
+		}
+		if err := checkEndpointReachable(endpoint, endpointPreflightTimeout); err != nil {
+			return nil, err
+		}
+		klog.V(2).Infof("Endpoint %s is reachable", endpoint)
+	}
+
+	// Token requests and all compute API versions go through a single
+	// transport, so connections to the API hosts are pooled across them.
+	transport, apiLimiter := newTransport(transportOpts)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+
+	tokenSource, err := generateTokenSource(ctx, configFile, endpoints.OAuthToken)
+	if err != nil {
+		return nil, err
+	}
+	if sa := credentialOpts.ImpersonateServiceAccount; sa != "" {
+		klog.V(2).Infof("Impersonating service account %s", sa)
+		tokenSource = newImpersonatedTokenSource(ctx, tokenSource, sa, compute.CloudPlatformScope, compute.ComputeScope)
+	}
+
+	// A single client also shares the cached token between the services.
+	client, err := newOauthClient(ctx, tokenSource)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := createCloudService(vendorVersion, client)
 	if err != nil {
 		return nil, err
 	}
 
-	betasvc, err := createBetaCloudService(ctx, vendorVersion, tokenSource)
+	betasvc, err := createBetaCloudService(ctx, vendorVersion, client)
 	if err != nil {
 		return nil, err
 	}
 
+	alphasvc, err := createAlphaCloudService(ctx, vendorVersion, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoints.Compute != "" {
+		root := strings.TrimSuffix(endpoints.Compute, "/")
+		svc.BasePath = root + "/compute/v1/projects/"
+		betasvc.BasePath = root + "/compute/beta/"
+		alphasvc.BasePath = root + "/compute/alpha/"
+		klog.V(2).Infof("Using compute endpoints %s, %s and %s", svc.BasePath, betasvc.BasePath, alphasvc.BasePath)
+	}
+
 	project, zone, err := getProjectAndZone(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("Failed getting Project and Zone: %v", err)
 	}
 
 	return &CloudProvider{
-		service:     svc,
-		betaService: betasvc,
-		project:     project,
-		zone:        zone,
-		zonesCache:  make(map[string]([]string)),
+		service:      svc,
+		betaService:  betasvc,
+		alphaService: alphasvc,
+		project:      project,
+		zone:         zone,
+		zonesCache:   make(map[string]([]string)),
+		opLimiter:    newOperationLimiter(0),
+		apiLimiter:   apiLimiter,
+		clock:        clock.RealClock{},
 	}, nil
 
 }
 
-func generateTokenSource(ctx context.Context, configFile *ConfigFile) (oauth2.TokenSource, error) {
+func generateTokenSource(ctx context.Context, configFile *ConfigFile, tokenEndpoint string) (oauth2.TokenSource, error) {
 	if configFile != nil && configFile.Global.TokenURL != "" && configFile.Global.TokenURL != "nil" {
 		// configFile.Global.TokenURL is defined
 		// Use AltTokenSource
@@ -123,6 +267,10 @@ func generateTokenSource(ctx context.Context, configFile *ConfigFile) (oauth2.To
 		return tokenSource, nil
 	}
 
+	if tokenEndpoint != "" {
+		return generateTokenSourceWithEndpoint(ctx, tokenEndpoint)
+	}
+
 	// Use DefaultTokenSource
 
 	tokenSource, err := google.DefaultTokenSource(
@@ -141,6 +289,63 @@ func generateTokenSource(ctx context.Context, configFile *ConfigFile) (oauth2.To
 	return tokenSource, err
 }
 
+// generateTokenSourceWithEndpoint returns a token source for the service
+// account key in GOOGLE_APPLICATION_CREDENTIALS that requests tokens from
+// tokenEndpoint instead of the token URL in the key.
+func generateTokenSourceWithEndpoint(ctx context.Context, tokenEndpoint string) (oauth2.TokenSource, error) {
+	gac, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS")
+	if !ok {
+		return nil, fmt.Errorf("an OAuth token endpoint requires service account key credentials in GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	jsonKey, err := ioutil.ReadFile(gac)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read credentials at %s: %v", gac, err)
+	}
+	conf, err := google.JWTConfigFromJSON(jsonKey, compute.CloudPlatformScope, compute.ComputeScope)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read service account key at %s: %v", gac, err)
+	}
+	conf.TokenURL = tokenEndpoint
+	klog.V(2).Infof("Using service account key %s with token endpoint %s", gac, tokenEndpoint)
+	return conf.TokenSource(ctx), nil
+}
+
+// checkEndpointReachable resolves the host of endpoint and opens a TCP
+// connection to it, so that a missing DNS override or firewall rule for a
+// restricted endpoint fails at startup with a clear error instead of as
+// timeouts on every request.
+func checkEndpointReachable(endpoint string, timeout time.Duration) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Hostname() == "" {
+		return fmt.Errorf("invalid endpoint %q: must be an http or https URL with a host", endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("endpoint %s: DNS lookup of %s failed: %v", endpoint, u.Hostname(), err)
+	}
+	klog.V(4).Infof("Endpoint %s resolved to %v", endpoint, addrs)
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), timeout)
+	if err != nil {
+		return fmt.Errorf("endpoint %s: connection to %s failed: %v", endpoint, net.JoinHostPort(u.Hostname(), port), err)
+	}
+	conn.Close()
+	return nil
+}
+
 func readConfig(configPath string) (*ConfigFile, error) {
 	if configPath == "" {
 		return nil, nil
@@ -159,11 +364,7 @@ func readConfig(configPath string) (*ConfigFile, error) {
 	return cfg, nil
 }
 
-func createBetaCloudService(ctx context.Context, vendorVersion string, tokenSource oauth2.TokenSource) (*computebeta.Service, error) {
-	client, err := newOauthClient(ctx, tokenSource)
-	if err != nil {
-		return nil, err
-	}
+func createBetaCloudService(ctx context.Context, vendorVersion string, client *http.Client) (*computebeta.Service, error) {
 	service, err := computebeta.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, err
@@ -172,16 +373,16 @@ func createBetaCloudService(ctx context.Context, vendorVersion string, tokenSour
 	return service, nil
 }
 
-func createCloudService(ctx context.Context, vendorVersion string, tokenSource oauth2.TokenSource) (*compute.Service, error) {
-	svc, err := createCloudServiceWithDefaultServiceAccount(ctx, vendorVersion, tokenSource)
-	return svc, err
-}
-
-func createCloudServiceWithDefaultServiceAccount(ctx context.Context, vendorVersion string, tokenSource oauth2.TokenSource) (*compute.Service, error) {
-	client, err := newOauthClient(ctx, tokenSource)
+func createAlphaCloudService(ctx context.Context, vendorVersion string, client *http.Client) (*computealpha.Service, error) {
+	service, err := computealpha.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, err
 	}
+	service.UserAgent = fmt.Sprintf("GCE CSI Driver/%s (%s %s)", vendorVersion, runtime.GOOS, runtime.GOARCH)
+	return service, nil
+}
+
+func createCloudService(vendorVersion string, client *http.Client) (*compute.Service, error) {
 	service, err := compute.New(client)
 	if err != nil {
 		return nil, err
@@ -191,7 +392,7 @@ func createCloudServiceWithDefaultServiceAccount(ctx context.Context, vendorVers
 }
 
 func newOauthClient(ctx context.Context, tokenSource oauth2.TokenSource) (*http.Client, error) {
-	if err := wait.PollImmediate(5*time.Second, 30*time.Second, func() (bool, error) {
+	if err := backoff.Retry(ctx, backoff.Standard.WithTimeout(30*time.Second), func() (bool, error) {
 		if _, err := tokenSource.Token(); err != nil {
 			klog.Errorf("error fetching initial token: %v", err)
 			return false, nil
@@ -237,11 +438,11 @@ func getProjectAndZone(config *ConfigFile) (string, string, error) {
 	return projectID, zone, nil
 }
 
-// isGCEError returns true if given error is a googleapi.Error with given
-// reason (e.g. "resourceInUseByAnotherResource")
+// isGCEError returns true if given error is, or wraps, a googleapi.Error with
+// given reason (e.g. "resourceInUseByAnotherResource")
 func IsGCEError(err error, reason string) bool {
-	apiErr, ok := err.(*googleapi.Error)
-	if !ok {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
 		return false
 	}
 
@@ -259,6 +460,23 @@ func IsGCENotFoundError(err error) bool {
 	return IsGCEError(err, "notFound")
 }
 
+// IsGCEQuotaError returns true if the error is a googleapi.Error with a quota
+// or rate limit reason
+func IsGCEQuotaError(err error) bool {
+	return IsGCEError(err, "quotaExceeded") || IsGCEError(err, "rateLimitExceeded")
+}
+
+// IsGCEKMSPermissionError returns true if err reports that Compute Engine
+// was denied the use of a Cloud KMS key. GCE only names the denied KMS
+// permission in the message of the error or of the failed operation.
+func IsGCEKMSPermissionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "cloudkms.cryptokeyversions.usetoencrypt") || strings.Contains(msg, "cloudkms.cryptokeyversions.usetodecrypt")
+}
+
 // IsInvalidError returns true if the error is a googleapi.Error with
 // invalid reason
 func IsGCEInvalidError(err error) bool {
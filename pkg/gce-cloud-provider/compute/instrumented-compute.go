@@ -0,0 +1,250 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	computealpha "google.golang.org/api/compute/v0.alpha"
+	computev1 "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+// instrumentedCompute records the latency, errors and concurrency of each
+// call to the compute API made through the wrapped GCECompute. Calls that
+// only build URIs or read local state pass through unrecorded.
+type instrumentedCompute struct {
+	GCECompute
+}
+
+var _ GCECompute = &instrumentedCompute{}
+
+// NewInstrumentedCompute wraps cloud so that its compute API calls are
+// recorded in the compute call metrics.
+func NewInstrumentedCompute(cloud GCECompute) GCECompute {
+	return &instrumentedCompute{GCECompute: cloud}
+}
+
+// startCall records the start of operation and returns a function that
+// records its end with the error it returned.
+func startCall(operation string) func(error) {
+	start := time.Now()
+	metrics.RecordComputeCallStarted(operation)
+	return func(err error) {
+		metrics.RecordComputeCallFinished(operation, time.Since(start), computeErrorReason(err))
+	}
+}
+
+// computeErrorReason returns the googleapi reason of err, or its HTTP code
+// if it has no reason. It returns the empty string if err is nil.
+func computeErrorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &apiErr):
+		if len(apiErr.Errors) > 0 && apiErr.Errors[0].Reason != "" {
+			return apiErr.Errors[0].Reason
+		}
+		return strconv.Itoa(apiErr.Code)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "contextDone"
+	default:
+		return "other"
+	}
+}
+
+func (c *instrumentedCompute) GetDisk(ctx context.Context, volumeKey *meta.Key, gceAPIVersion GCEAPIVersion) (*CloudDisk, error) {
+	done := startCall("getDisk")
+	disk, err := c.GCECompute.GetDisk(ctx, volumeKey, gceAPIVersion)
+	done(err)
+	return disk, err
+}
+
+func (c *instrumentedCompute) RepairUnderspecifiedVolumeKey(ctx context.Context, volumeKey *meta.Key) (*meta.Key, error) {
+	done := startCall("repairUnderspecifiedVolumeKey")
+	key, err := c.GCECompute.RepairUnderspecifiedVolumeKey(ctx, volumeKey)
+	done(err)
+	return key, err
+}
+
+func (c *instrumentedCompute) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error {
+	done := startCall("insertDisk")
+	err := c.GCECompute.InsertDisk(ctx, volKey, params, capBytes, capacityRange, replicaZones, snapshotID, volumeContentSourceVolumeID, multiWriter)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) WaitForDiskInsert(ctx context.Context, volKey *meta.Key) error {
+	done := startCall("waitForDiskInsert")
+	err := c.GCECompute.WaitForDiskInsert(ctx, volKey)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) DeleteDisk(ctx context.Context, volumeKey *meta.Key) error {
+	done := startCall("deleteDisk")
+	err := c.GCECompute.DeleteDisk(ctx, volumeKey)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, diskInterface, instanceZone, instanceName string) error {
+	done := startCall("attachDisk")
+	err := c.GCECompute.AttachDisk(ctx, volKey, readWrite, diskType, diskInterface, instanceZone, instanceName)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) DetachDisk(ctx context.Context, deviceName string, instanceZone, instanceName string) error {
+	done := startCall("detachDisk")
+	err := c.GCECompute.DetachDisk(ctx, deviceName, instanceZone, instanceName)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) WaitForAttach(ctx context.Context, volKey *meta.Key, instanceZone, instanceName string) error {
+	done := startCall("waitForAttach")
+	err := c.GCECompute.WaitForAttach(ctx, volKey, instanceZone, instanceName)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) ResizeDisk(ctx context.Context, volKey *meta.Key, requestBytes int64) (int64, error) {
+	done := startCall("resizeDisk")
+	size, err := c.GCECompute.ResizeDisk(ctx, volKey, requestBytes)
+	done(err)
+	return size, err
+}
+
+func (c *instrumentedCompute) ListDisks(ctx context.Context, maxEntries int64, pageToken string) ([]*computev1.Disk, string, error) {
+	done := startCall("listDisks")
+	disks, nextPageToken, err := c.GCECompute.ListDisks(ctx, maxEntries, pageToken)
+	done(err)
+	return disks, nextPageToken, err
+}
+
+func (c *instrumentedCompute) AggregatedListDisks(ctx context.Context, filter string) ([]*computev1.Disk, error) {
+	done := startCall("aggregatedListDisks")
+	disks, err := c.GCECompute.AggregatedListDisks(ctx, filter)
+	done(err)
+	return disks, err
+}
+
+func (c *instrumentedCompute) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*computev1.Instance, error) {
+	done := startCall("getInstance")
+	instance, err := c.GCECompute.GetInstanceOrError(ctx, instanceZone, instanceName)
+	done(err)
+	return instance, err
+}
+
+func (c *instrumentedCompute) ListZones(ctx context.Context, region string) ([]string, error) {
+	done := startCall("listZones")
+	zones, err := c.GCECompute.ListZones(ctx, region)
+	done(err)
+	return zones, err
+}
+
+func (c *instrumentedCompute) ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Snapshot, string, error) {
+	done := startCall("listSnapshots")
+	snapshots, nextPageToken, err := c.GCECompute.ListSnapshots(ctx, filter, maxEntries, pageToken)
+	done(err)
+	return snapshots, nextPageToken, err
+}
+
+func (c *instrumentedCompute) GetSnapshot(ctx context.Context, snapshotName string) (*computev1.Snapshot, error) {
+	done := startCall("getSnapshot")
+	snapshot, err := c.GCECompute.GetSnapshot(ctx, snapshotName)
+	done(err)
+	return snapshot, err
+}
+
+func (c *instrumentedCompute) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computev1.Snapshot, error) {
+	done := startCall("createSnapshot")
+	snapshot, err := c.GCECompute.CreateSnapshot(ctx, volKey, snapshotName, labels)
+	done(err)
+	return snapshot, err
+}
+
+func (c *instrumentedCompute) DeleteSnapshot(ctx context.Context, snapshotName string) error {
+	done := startCall("deleteSnapshot")
+	err := c.GCECompute.DeleteSnapshot(ctx, snapshotName)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) ListImages(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*computev1.Image, string, error) {
+	done := startCall("listImages")
+	images, nextPageToken, err := c.GCECompute.ListImages(ctx, filter, maxEntries, pageToken)
+	done(err)
+	return images, nextPageToken, err
+}
+
+func (c *instrumentedCompute) GetImage(ctx context.Context, imageName string) (*computev1.Image, error) {
+	done := startCall("getImage")
+	image, err := c.GCECompute.GetImage(ctx, imageName)
+	done(err)
+	return image, err
+}
+
+func (c *instrumentedCompute) CreateImage(ctx context.Context, volKey *meta.Key, imageName string, labels map[string]string) (*computev1.Image, error) {
+	done := startCall("createImage")
+	image, err := c.GCECompute.CreateImage(ctx, volKey, imageName, labels)
+	done(err)
+	return image, err
+}
+
+func (c *instrumentedCompute) DeleteImage(ctx context.Context, imageName string) error {
+	done := startCall("deleteImage")
+	err := c.GCECompute.DeleteImage(ctx, imageName)
+	done(err)
+	return err
+}
+
+func (c *instrumentedCompute) ListInstantSnapshots(ctx context.Context, volKey *meta.Key, maxEntries int64, pageToken string) ([]*computealpha.InstantSnapshot, string, error) {
+	done := startCall("listInstantSnapshots")
+	snapshots, nextPageToken, err := c.GCECompute.ListInstantSnapshots(ctx, volKey, maxEntries, pageToken)
+	done(err)
+	return snapshots, nextPageToken, err
+}
+
+func (c *instrumentedCompute) GetInstantSnapshot(ctx context.Context, key *meta.Key) (*computealpha.InstantSnapshot, error) {
+	done := startCall("getInstantSnapshot")
+	snapshot, err := c.GCECompute.GetInstantSnapshot(ctx, key)
+	done(err)
+	return snapshot, err
+}
+
+func (c *instrumentedCompute) CreateInstantSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*computealpha.InstantSnapshot, error) {
+	done := startCall("createInstantSnapshot")
+	snapshot, err := c.GCECompute.CreateInstantSnapshot(ctx, volKey, snapshotName, labels)
+	done(err)
+	return snapshot, err
+}
+
+func (c *instrumentedCompute) DeleteInstantSnapshot(ctx context.Context, key *meta.Key) error {
+	done := startCall("deleteInstantSnapshot")
+	err := c.GCECompute.DeleteInstantSnapshot(ctx, key)
+	done(err)
+	return err
+}
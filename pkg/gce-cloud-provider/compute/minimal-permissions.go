@@ -0,0 +1,43 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"k8s.io/klog"
+)
+
+// minimalPermissionsDropped are the IAM permissions that the cloud provider
+// does not use in minimal permission mode, with what they are otherwise
+// used for.
+var minimalPermissionsDropped = []struct {
+	permission string
+	use        string
+}{
+	{"compute.zones.list", "listing the zones of a region, to pick the second zone of a regional disk or expand a region topology when the topology requirement does not name the zones, and to find the disk of a volume ID with an unspecified zone"},
+	{"compute.zoneOperations.list", "adopting the pending insert of a zonal disk started by another controller replica, which CreateVolume otherwise retries until the disk is ready"},
+	{"compute.regionOperations.list", "adopting the pending insert of a regional disk started by another controller replica, which CreateVolume otherwise retries until the disk is ready"},
+}
+
+// SetMinimalPermissions stops the cloud provider from making the optional
+// API calls that need the permissions in minimal permissions mode, so that
+// the controller can run with a tighter custom role, and logs the
+// permissions it no longer needs. It must be called before the cloud
+// provider is used.
+func (cloud *CloudProvider) SetMinimalPermissions() {
+	cloud.minimalPermissions = true
+	for _, p := range minimalPermissionsDropped {
+		klog.Infof("Minimal permission mode: not using %s, otherwise used for %s", p.permission, p.use)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+// operationLimiter caps the number of compute operations the driver has in
+// flight. Operations beyond the cap wait in line until one finishes, so the
+// driver stays within a share of the project's operation concurrency that
+// other tooling also draws from. A nil operationLimiter, or one without a
+// cap, only tracks the operations in flight.
+type operationLimiter struct {
+	// slots holds a token per operation in flight. It is nil when there is
+	// no cap.
+	slots chan struct{}
+}
+
+func newOperationLimiter(maxOperations int) *operationLimiter {
+	if maxOperations <= 0 {
+		return &operationLimiter{}
+	}
+	return &operationLimiter{slots: make(chan struct{}, maxOperations)}
+}
+
+// acquire waits for a free slot for an operation, or returns an error if ctx
+// is done first. The returned function releases the slot.
+func (l *operationLimiter) acquire(ctx context.Context, operation string) (func(), error) {
+	if l == nil || l.slots == nil {
+		metrics.RecordComputeOperationStarted(0)
+		return metrics.RecordComputeOperationFinished, nil
+	}
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		klog.V(4).Infof("Waiting for one of the %d in-flight compute operations to finish before %s", cap(l.slots), operation)
+		metrics.RecordComputeOperationQueued(1)
+		select {
+		case l.slots <- struct{}{}:
+			metrics.RecordComputeOperationQueued(-1)
+		case <-ctx.Done():
+			metrics.RecordComputeOperationQueued(-1)
+			return nil, fmt.Errorf("gave up waiting to start %s after %v: %w", operation, time.Since(start), ctx.Err())
+		}
+	}
+	metrics.RecordComputeOperationStarted(time.Since(start))
+	return func() {
+		<-l.slots
+		metrics.RecordComputeOperationFinished()
+	}, nil
+}
+
+// LimitConcurrentOperations caps the number of disk and snapshot mutations,
+// such as inserts, attaches and resizes, that the cloud provider runs at
+// once, counting each until its operation completes. Zero removes the cap.
+// It must be called before the cloud provider is used.
+func (cloud *CloudProvider) LimitConcurrentOperations(maxOperations int) {
+	cloud.opLimiter = newOperationLimiter(maxOperations)
+}
+
+// SetComputeAPIRateLimit replaces the QPS and burst that compute API
+// requests are throttled to. Zero QPS removes the limit. Unlike
+// LimitConcurrentOperations it may be called while the cloud provider is in
+// use.
+func (cloud *CloudProvider) SetComputeAPIRateLimit(qps float32, burst int) {
+	if cloud.apiLimiter == nil {
+		return
+	}
+	klog.V(2).Infof("Limiting compute API requests to %v QPS with a burst of %d", qps, burst)
+	cloud.apiLimiter.setLimit(qps, burst)
+}
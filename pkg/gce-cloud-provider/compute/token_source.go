@@ -17,7 +17,10 @@ limitations under the License.
 package gcecloudprovider
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -34,6 +37,10 @@ const (
 	tokenURLQPS = .05 // back off to once every 20 seconds when failing
 	// Maximum burst of requests to token URL before limiting.
 	tokenURLBurst = 3
+
+	iamCredentialsURLTemplate = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+	// The longest lifetime the IAM credentials API grants by default.
+	impersonatedTokenLifetime = "3600s"
 )
 
 // TODO(#276) add metrics around token requests once the driver integrates with Prometheus.
@@ -89,3 +96,57 @@ func NewAltTokenSource(tokenURL, tokenBody string) oauth2.TokenSource {
 	}
 	return oauth2.ReuseTokenSource(nil, a)
 }
+
+// impersonatedTokenSource generates access tokens of a service account with
+// the IAM credentials API, authenticating with base credentials that have
+// roles/iam.serviceAccountTokenCreator on the service account.
+type impersonatedTokenSource struct {
+	client *http.Client
+	url    string
+	scopes []string
+}
+
+// Token returns a token of the impersonated service account.
+func (i *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(struct {
+		Scope    []string `json:"scope"`
+		Lifetime string   `json:"lifetime"`
+	}{i.scopes, impersonatedTokenLifetime})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", i.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+	var tok struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		Expiry:      tok.ExpireTime,
+	}, nil
+}
+
+// newImpersonatedTokenSource returns a token source for serviceAccount with
+// scopes, authenticated by base. Requests use the HTTP client in ctx, if any.
+func newImpersonatedTokenSource(ctx context.Context, base oauth2.TokenSource, serviceAccount string, scopes ...string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		client: oauth2.NewClient(ctx, base),
+		url:    fmt.Sprintf(iamCredentialsURLTemplate, serviceAccount),
+		scopes: scopes,
+	})
+}
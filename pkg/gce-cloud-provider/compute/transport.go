@@ -0,0 +1,227 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+// API versions that compute API requests are counted under. Requests to
+// other paths, such as the token endpoint, are counted as apiVersionOther.
+const (
+	apiVersionV1    = "v1"
+	apiVersionBeta  = "beta"
+	apiVersionAlpha = "alpha"
+	apiVersionOther = "other"
+)
+
+// instrumentedTransport counts the requests sent through base and whether
+// they reused a pooled connection.
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+var _ http.RoundTripper = &instrumentedTransport{}
+
+// retryingTransport retries requests sent through base that fail with a
+// transient error, so that API hiccups do not fail CSI calls.
+type retryingTransport struct {
+	base   http.RoundTripper
+	policy backoff.Policy
+}
+
+var _ http.RoundTripper = &retryingTransport{}
+
+// rateLimitedTransport holds compute API requests sent through base until
+// the token bucket for their kind of request has a token. The limits can be
+// replaced at runtime, so they are guarded by mux. Nil limiters let requests
+// through.
+type rateLimitedTransport struct {
+	base   http.RoundTripper
+	mux    sync.RWMutex
+	read   flowcontrol.RateLimiter
+	mutate flowcontrol.RateLimiter
+}
+
+var _ http.RoundTripper = &rateLimitedTransport{}
+
+// setLimit replaces the limits with token buckets of the given QPS and
+// burst. A QPS of zero removes the limits.
+func (t *rateLimitedTransport) setLimit(qps float32, burst int) {
+	var read, mutate flowcontrol.RateLimiter
+	if qps > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		read = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+		mutate = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.read, t.mutate = read, mutate
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if computeAPIVersion(req.URL.Path) == apiVersionOther {
+		return t.base.RoundTrip(req)
+	}
+	t.mux.RLock()
+	limiter, kind := t.mutate, "mutation"
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		limiter, kind = t.read, "read"
+	}
+	t.mux.RUnlock()
+	if limiter != nil && !limiter.TryAccept() {
+		klog.V(4).Infof("Throttling %s %s to the %s limit of %v QPS", req.Method, req.URL.Path, kind, limiter.QPS())
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newTransport returns the transport for compute API requests, along with
+// its rate limiter so that the limits can be changed later.
+func newTransport(opts TransportOptions) (http.RoundTripper, *rateLimitedTransport) {
+	limiter := &rateLimitedTransport{base: newInstrumentedTransport(opts)}
+	limiter.setLimit(opts.QPS, opts.Burst)
+	if opts.MaxAttempts <= 1 {
+		return limiter, limiter
+	}
+	return &retryingTransport{
+		base: limiter,
+		policy: backoff.Policy{
+			Duration: opts.InitialBackoff,
+			Factor:   2,
+			Cap:      opts.MaxBackoff,
+			Steps:    opts.MaxAttempts,
+		},
+	}, limiter
+}
+
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	attempt := 0
+	retryErr := backoff.Retry(req.Context(), t.policy, func() (bool, error) {
+		attempt++
+		attemptReq := req
+		if attempt > 1 {
+			if attemptReq, err = rewindRequest(req); err != nil {
+				return true, nil
+			}
+		}
+		resp, err = t.base.RoundTrip(attemptReq)
+		if attempt == t.policy.Steps || !retryableResponse(req, resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return true, nil
+		}
+		if err != nil {
+			klog.V(4).Infof("Retrying %s %s after attempt %d failed: %v", req.Method, req.URL.Path, attempt, err)
+		} else {
+			klog.V(4).Infof("Retrying %s %s after attempt %d failed with status %d", req.Method, req.URL.Path, attempt, resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return false, nil
+	})
+	if retryErr != nil {
+		// The context ended while waiting to retry, and the response of
+		// the last attempt is already closed.
+		return nil, retryErr
+	}
+	return resp, err
+}
+
+// rewindRequest returns a copy of req with a fresh body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = body
+	return clone, nil
+}
+
+// retryableResponse returns true if a request that got resp or err may be
+// sent again. Requests that change state, such as inserts and attaches, are
+// only retried when the server certainly did not act on them, since a blind
+// retry would fail with alreadyExists or resourceInUseByAnotherResource.
+func retryableResponse(req *http.Request, resp *http.Response, err error) bool {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions
+	if err != nil {
+		return idempotent
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+func newInstrumentedTransport(opts TransportOptions) *instrumentedTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		if transport.MaxIdleConns != 0 && transport.MaxIdleConns < opts.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = opts.MaxIdleConnsPerHost
+		}
+	}
+	return &instrumentedTransport{base: transport}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.RecordComputeAPIConnection(info.Reused)
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.RecordComputeAPIRequest(computeAPIVersion(req.URL.Path), code)
+	return resp, err
+}
+
+func computeAPIVersion(path string) string {
+	switch {
+	case strings.Contains(path, "/compute/v1/"):
+		return apiVersionV1
+	case strings.Contains(path, "/compute/beta/"):
+		return apiVersionBeta
+	case strings.Contains(path, "/compute/alpha/"):
+		return apiVersionAlpha
+	default:
+		return apiVersionOther
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"k8s.io/klog"
+)
+
+// Metadata keys that can be set on the GCE project or instance to configure
+// driver defaults across a fleet of clusters. A value set on the instance
+// takes precedence over the one set on the project.
+const (
+	DefaultDiskTypeKey             = "pd-csi-default-disk-type"
+	DefaultLabelsKey               = "pd-csi-default-labels"
+	DefaultDiskEncryptionKMSKeyKey = "pd-csi-default-disk-encryption-kms-key"
+)
+
+// DriverDefaults holds the raw driver default values found in metadata. Empty
+// fields were not set on either the instance or the project.
+type DriverDefaults struct {
+	DiskType             string
+	Labels               string
+	DiskEncryptionKMSKey string
+}
+
+// GetDriverDefaults reads the driver default keys from the instance and
+// project metadata.
+func GetDriverDefaults() (DriverDefaults, error) {
+	var d DriverDefaults
+	var err error
+	if d.DiskType, err = getAttribute(DefaultDiskTypeKey); err != nil {
+		return d, err
+	}
+	if d.Labels, err = getAttribute(DefaultLabelsKey); err != nil {
+		return d, err
+	}
+	if d.DiskEncryptionKMSKey, err = getAttribute(DefaultDiskEncryptionKMSKeyKey); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// getAttribute returns the value of the instance attribute key, falling back
+// to the project attribute, or an empty string if neither is defined.
+func getAttribute(key string) (string, error) {
+	v, err := metadata.InstanceAttributeValue(key)
+	if err == nil {
+		klog.V(2).Infof("Using %s=%q from instance metadata", key, v)
+		return strings.TrimSpace(v), nil
+	}
+	if _, ok := err.(metadata.NotDefinedError); !ok {
+		return "", fmt.Errorf("failed to get instance attribute %s: %v", key, err)
+	}
+	v, err = metadata.ProjectAttributeValue(key)
+	if err == nil {
+		klog.V(2).Infof("Using %s=%q from project metadata", key, v)
+		return strings.TrimSpace(v), nil
+	}
+	if _, ok := err.(metadata.NotDefinedError); !ok {
+		return "", fmt.Errorf("failed to get project attribute %s: %v", key, err)
+	}
+	return "", nil
+}
@@ -17,7 +17,10 @@ limitations under the License.
 package metadata
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"strings"
 
 	"cloud.google.com/go/compute/metadata"
@@ -42,31 +45,86 @@ type metadataServiceManager struct {
 
 var _ MetadataService = &metadataServiceManager{}
 
-func NewMetadataService() (MetadataService, error) {
-	zone, err := metadata.Zone()
+// NodeIdentity is the identity of the instance the node plugin runs on.
+type NodeIdentity struct {
+	Project string `json:"project,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// MachineType is the name of the machine type, such as n2-standard-4,
+	// or its URL.
+	MachineType string `json:"machineType,omitempty"`
+}
+
+// ReadNodeIdentityFile reads a NodeIdentity from the JSON file at path, such
+// as one mounted from a ConfigMap. Fields missing from the file are left
+// empty.
+func ReadNodeIdentityFile(path string) (NodeIdentity, error) {
+	var id NodeIdentity
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get current zone: %v", err)
+		return id, fmt.Errorf("failed to read node identity file: %v", err)
 	}
-	projectID, err := metadata.ProjectID()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get project: %v", err)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&id); err != nil {
+		return id, fmt.Errorf("failed to parse node identity file %s: %v", path, err)
 	}
-	name, err := metadata.InstanceName()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get instance name: %v", err)
+	return id, nil
+}
+
+// Merge returns id with its empty fields filled in from other.
+func (id NodeIdentity) Merge(other NodeIdentity) NodeIdentity {
+	if id.Project == "" {
+		id.Project = other.Project
 	}
-	fullMachineType, err := metadata.Get("instance/machine-type")
-	if err != nil {
-		return nil, fmt.Errorf("failed to get machine-type: %v", err)
+	if id.Zone == "" {
+		id.Zone = other.Zone
+	}
+	if id.Name == "" {
+		id.Name = other.Name
+	}
+	if id.MachineType == "" {
+		id.MachineType = other.MachineType
+	}
+	return id
+}
+
+// NewMetadataService returns the identity of the instance the driver runs
+// on. Fields set in overrides are used as is, and only the others are read
+// from the metadata server, which is not contacted at all if every field is
+// set. This allows running where the metadata server is absent or describes
+// another machine, such as in nested virtualization or test rigs.
+func NewMetadataService(overrides NodeIdentity) (MetadataService, error) {
+	id := overrides
+	var err error
+	if id.Zone == "" {
+		if id.Zone, err = metadata.Zone(); err != nil {
+			return nil, fmt.Errorf("failed to get current zone: %v", err)
+		}
+	}
+	if id.Project == "" {
+		if id.Project, err = metadata.ProjectID(); err != nil {
+			return nil, fmt.Errorf("failed to get project: %v", err)
+		}
+	}
+	if id.Name == "" {
+		if id.Name, err = metadata.InstanceName(); err != nil {
+			return nil, fmt.Errorf("failed to get instance name: %v", err)
+		}
+	}
+	if id.MachineType == "" {
+		if id.MachineType, err = metadata.Get("instance/machine-type"); err != nil {
+			return nil, fmt.Errorf("failed to get machine-type: %v", err)
+		}
 	}
 	// Response format: "projects/[NUMERIC_PROJECT_ID]/machineTypes/[MACHINE_TYPE]"
-	splits := strings.Split(fullMachineType, "/")
+	splits := strings.Split(id.MachineType, "/")
 	machineType := splits[len(splits)-1]
 
 	return &metadataServiceManager{
-		project:     projectID,
-		zone:        zone,
-		name:        name,
+		project:     id.Project,
+		zone:        id.Zone,
+		name:        id.Name,
 		machineType: machineType,
 	}, nil
 }
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNodeIdentityFile(t *testing.T) {
+	testCases := []struct {
+		name      string
+		content   string
+		expID     NodeIdentity
+		expectErr bool
+	}{
+		{
+			name:    "all fields",
+			content: `{"project": "p", "zone": "us-central1-a", "name": "node-1", "machineType": "n2-standard-4"}`,
+			expID:   NodeIdentity{Project: "p", Zone: "us-central1-a", Name: "node-1", MachineType: "n2-standard-4"},
+		},
+		{
+			name:    "some fields",
+			content: `{"name": "node-1"}`,
+			expID:   NodeIdentity{Name: "node-1"},
+		},
+		{
+			name:      "unknown field",
+			content:   `{"instance": "node-1"}`,
+			expectErr: true,
+		},
+		{
+			name:      "not json",
+			content:   `name=node-1`,
+			expectErr: true,
+		},
+	}
+	dir, err := ioutil.TempDir("", "node-identity")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tc := range testCases {
+		path := filepath.Join(dir, "identity.json")
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatalf("Failed to write identity file: %v", err)
+		}
+		id, err := ReadNodeIdentityFile(path)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", tc.name, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if id != tc.expID {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, id, tc.expID)
+		}
+	}
+	if _, err := ReadNodeIdentityFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+}
+
+func TestNewMetadataServiceWithOverrides(t *testing.T) {
+	flags := NodeIdentity{Name: "flag-node"}
+	file := NodeIdentity{Project: "p", Zone: "us-central1-a", Name: "file-node", MachineType: "projects/123/machineTypes/n2-standard-4"}
+	// Every field is set, so the metadata server is not contacted.
+	meta, err := NewMetadataService(flags.Merge(file))
+	if err != nil {
+		t.Fatalf("NewMetadataService failed: %v", err)
+	}
+	if meta.GetName() != "flag-node" || meta.GetProject() != "p" || meta.GetZone() != "us-central1-a" || meta.GetMachineType() != "n2-standard-4" {
+		t.Errorf("Got identity %s/%s/%s/%s, expected flag-node/p/us-central1-a/n2-standard-4", meta.GetName(), meta.GetProject(), meta.GetZone(), meta.GetMachineType())
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// attachAuditTimeout bounds the lookups of an audit so that an unavailable
+// API server does not pile up audits.
+const attachAuditTimeout = 5 * time.Second
+
+// AttachAuditor records which pods an attach or detach is done for. The
+// external-attacher only passes the volume and node, so the pods are found
+// through the claim of the volume's PV among the pods scheduled to the node.
+// The lookups run in the background once the operation is done, so they never
+// hold up or fail it, nor the operations waiting on its volume lock.
+type AttachAuditor struct {
+	cs     *GCEControllerServer
+	client kubernetes.Interface
+}
+
+// NewAttachAuditor returns an auditor for the attaches and detaches of cs.
+func NewAttachAuditor(cs *GCEControllerServer, client kubernetes.Interface) *AttachAuditor {
+	a := &AttachAuditor{
+		cs:     cs,
+		client: client,
+	}
+	cs.attachAuditor = a
+	return a
+}
+
+// record starts logging an audit entry for operation of volumeID on
+// instanceName, which failed with opErr if it is not nil.
+func (a *AttachAuditor) record(operation, volumeID, instanceName string, opErr error) {
+	if a == nil {
+		return
+	}
+	result := "succeeded"
+	if opErr != nil {
+		result = fmt.Sprintf("failed: %v", opErr)
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), attachAuditTimeout)
+		defer cancel()
+		pods, err := a.podsFor(ctx, volumeID, instanceName)
+		if err != nil {
+			klog.Warningf("Audit: %s of disk %s on node %s for unknown pods %s, pod lookup failed: %v", operation, volumeID, instanceName, result, err)
+			return
+		}
+		klog.Infof("Audit: %s of disk %s on node %s for pods [%s] %s", operation, volumeID, instanceName, strings.Join(pods, ", "), result)
+	}()
+}
+
+// podsFor returns the pods on nodeName that use the PV of volumeID.
+func (a *AttachAuditor) podsFor(ctx context.Context, volumeID, nodeName string) ([]string, error) {
+	pvs, err := a.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	pods, err := a.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	return findAttachPods(a.cs.Driver.name, volumeID, pvs.Items, pods.Items)
+}
+
+// findAttachPods returns the namespaced names of the pods that have not
+// terminated and use the claim bound to the PV of driverName for volumeID.
+func findAttachPods(driverName, volumeID string, pvs []v1.PersistentVolume, pods []v1.Pod) ([]string, error) {
+	key, err := diskKeyString(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	var claim *v1.ObjectReference
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if pvKey, err := diskKeyString(pv.Spec.CSI.VolumeHandle); err == nil && pvKey == key {
+			claim = pv.Spec.ClaimRef
+			if claim == nil {
+				return nil, fmt.Errorf("PV %s is not bound", pv.Name)
+			}
+			break
+		}
+	}
+	if claim == nil {
+		return nil, fmt.Errorf("no PV has volume handle %s", volumeID)
+	}
+
+	names := []string{}
+	for _, pod := range pods {
+		if pod.Namespace != claim.Namespace || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claim.Name {
+				names = append(names, pod.Namespace+"/"+pod.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
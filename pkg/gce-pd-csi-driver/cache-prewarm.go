@@ -0,0 +1,141 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+const (
+	// prewarmTimeout bounds how long PrewarmCaches holds up the start of the
+	// driver.
+	prewarmTimeout = 30 * time.Second
+	// prewarmConcurrency is the number of instances read at once, so that
+	// large clusters are warmed well within the instance cache TTL.
+	prewarmConcurrency = 20
+)
+
+// PrewarmCaches reads the instances that volumes of the driver are attached
+// to into the instance cache of cs. After a controller restart the
+// external-attacher republishes every attached volume at once, and with a
+// cold cache each of those publishes reads its instance from GCE. It is run
+// once, just before the driver starts serving, since cached instances are
+// only fresh for the cache TTL. Failures are logged, as a cold cache only
+// costs API calls.
+func PrewarmCaches(ctx context.Context, cs *GCEControllerServer, client kubernetes.Interface) {
+	if cs.instanceCache == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+	defer cancel()
+	start := time.Now()
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Skipping cache prewarm, failed to list persistent volumes: %v", err)
+		return
+	}
+	attachments, err := client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Skipping cache prewarm, failed to list volume attachments: %v", err)
+		return
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Skipping cache prewarm, failed to list nodes: %v", err)
+		return
+	}
+
+	nodeIDs := instancesToPrewarm(cs.Driver.name, pvs.Items, attachments.Items, nodes.Items)
+	var warmed int64
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < prewarmConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nodeID := range work {
+				zone, name, err := common.NodeIDToZoneAndName(nodeID)
+				if err != nil {
+					continue
+				}
+				if _, err := cs.instanceCache.refresh(ctx, zone, name); err != nil {
+					klog.Warningf("Failed to prewarm instance %s: %v", nodeID, err)
+					continue
+				}
+				atomic.AddInt64(&warmed, 1)
+			}
+		}()
+	}
+feed:
+	for _, nodeID := range nodeIDs {
+		select {
+		case work <- nodeID:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	klog.Infof("Prewarmed instance cache with %d of %d instances with attached volumes in %v", warmed, len(nodeIDs), time.Since(start))
+}
+
+// instancesToPrewarm returns the node IDs of the nodes that PVs of driverName
+// are attached to, sorted. Nodes without a driver node ID are skipped.
+func instancesToPrewarm(driverName string, pvs []v1.PersistentVolume, attachments []storagev1.VolumeAttachment, nodes []v1.Node) []string {
+	pvNames := map[string]bool{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName {
+			pvNames[pv.Name] = true
+		}
+	}
+	attachedNodes := map[string]bool{}
+	for _, va := range attachments {
+		pvName := va.Spec.Source.PersistentVolumeName
+		if va.Spec.Attacher != driverName || !va.Status.Attached || pvName == nil || !pvNames[*pvName] {
+			continue
+		}
+		attachedNodes[va.Spec.NodeName] = true
+	}
+
+	nodeIDs := []string{}
+	for i := range nodes {
+		if !attachedNodes[nodes[i].Name] {
+			continue
+		}
+		nodeID, err := csiNodeID(&nodes[i], driverName)
+		if err != nil {
+			continue
+		}
+		if _, _, err := common.NodeIDToZoneAndName(nodeID); err != nil {
+			continue
+		}
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
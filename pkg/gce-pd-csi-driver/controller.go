@@ -18,21 +18,29 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	computealpha "google.golang.org/api/compute/v0.alpha"
 	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
 )
 
 type GCEControllerServer struct {
@@ -43,10 +51,189 @@ type GCEControllerServer struct {
 	// operations for that same volume (as defined by Volume Key) return an
 	// Aborted error
 	volumeLocks *common.VolumeLocks
+	// attachLocks are held by volume ID while a volume is attached or
+	// detached, so that attaching a volume to one node and detaching it from
+	// another happen one after the other instead of interleaving. Unlike
+	// volumeLocks, later operations wait, in the order they arrived, instead
+	// of being aborted.
+	attachLocks *common.VolumeLocks
+
+	// If set, snapshot capabilities are not advertised and the snapshot RPCs
+	// are rejected. Used in projects where compute.snapshots.* is denied.
+	disableSnapshots bool
+
+	// If set, the expansion capability is not advertised and
+	// ControllerExpandVolume is rejected.
+	disableExpansion bool
+
+	// Driver-wide defaults for disk parameters not set in the StorageClass
+	// and the aliases used to translate topology requirements. They may be
+	// replaced at runtime, so they are guarded by configMux.
+	configMux         sync.RWMutex
+	parameterDefaults common.ParameterDefaults
+	topologyAliases   common.TopologyAliases
+
+	// If listVolumesCacheRefreshPeriod is non-zero, ListVolumes is served
+	// from diskCache, a disk inventory refreshed at that period, instead of
+	// listing disks on every call.
+	listVolumesCacheRefreshPeriod time.Duration
+	diskCache                     *diskCache
+
+	// If set, DeleteVolume also deletes disks that lack the description
+	// marker written when the driver creates a disk, such as manually
+	// created disks bound through static PVs. Guarded by configMux.
+	allowUnownedDelete bool
+
+	// If non-zero, ControllerUnpublishVolume honors a pauseDetachUntilKey
+	// instance metadata entry for at most this long after first seeing it.
+	maxDetachPause time.Duration
+	detachPauses   detachPauses
+
+	// Limits the size disks of some types may be expanded to.
+	expansionPolicy common.ExpansionPolicy
+
+	// If set, instances read by ControllerPublishVolume and
+	// ControllerUnpublishVolume are cached for a few seconds.
+	instanceCache *instanceCache
+
+	// snapshotUploads reports the snapshots that are not yet ready to use.
+	snapshotUploads *snapshotUploads
+
+	// If set, rate limits snapshot deletes fairly across source volumes.
+	snapshotDeletes *snapshotDeleteQueue
+
+	// If set, reports attachments that no VolumeAttachment accounts for.
+	orphanDetector *OrphanedAttachmentDetector
+
+	// If set, logs the pods each attach and detach is done for.
+	attachAuditor *AttachAuditor
+
+	// opHistory keeps the last operations on each volume, if enabled.
+	opHistory *operationHistory
+}
+
+type ControllerServerArgs struct {
+	// DisableSnapshots hides the snapshot controller capabilities so that
+	// external-snapshotter does not keep retrying calls that GCE will refuse.
+	DisableSnapshots bool
+
+	// DisableExpansion hides the expansion controller capability so that
+	// external-resizer does not resize volumes of deployments that must
+	// keep their disk sizes.
+	DisableExpansion bool
+
+	// ParameterDefaults override the built-in disk parameter defaults.
+	ParameterDefaults common.ParameterDefaults
+
+	// ListVolumesCacheRefreshPeriod, if non-zero, enables serving ListVolumes
+	// from a disk cache refreshed at this period.
+	ListVolumesCacheRefreshPeriod time.Duration
+
+	// AllowUnownedDelete lets DeleteVolume delete disks not created by the
+	// driver.
+	AllowUnownedDelete bool
+
+	// MaxDetachPause is the longest detach pause that will be honored from
+	// instance metadata, counted from when the pause is first seen. Zero
+	// disables pausing.
+	MaxDetachPause time.Duration
+
+	// InstanceCacheTTL, if non-zero, enables caching instances read by
+	// attach and detach for this long. It must not exceed
+	// MaxInstanceCacheTTL.
+	InstanceCacheTTL time.Duration
+
+	// ExpansionPolicy limits the size disks of some types may be expanded
+	// to before they must be migrated to another type.
+	ExpansionPolicy common.ExpansionPolicy
+
+	// OperationHistorySize is the number of operations kept per volume for
+	// the debug state and the errors of failed operations. Zero disables
+	// the history.
+	OperationHistorySize int
+
+	// SnapshotDeleteQPS, if positive, is the rate of snapshot deletes per
+	// second, with bursts of SnapshotDeleteBurst.
+	SnapshotDeleteQPS   float32
+	SnapshotDeleteBurst int
 }
 
 var _ csi.ControllerServer = &GCEControllerServer{}
 
+// diskSizeRangeGb is the inclusive range of sizes, in GB, allowed for a disk
+// type.
+type diskSizeRangeGb struct {
+	min int64
+	max int64
+}
+
+// Size ranges for disk types whose limits differ from the PD limits. See
+// https://cloud.google.com/compute/docs/disks/hyperdisks#limits-disk
+var diskTypeSizeRangesGb = map[string]diskSizeRangeGb{
+	"hyperdisk-balanced":   {min: 4, max: 64 * 1024},
+	"hyperdisk-extreme":    {min: 64, max: 64 * 1024},
+	"hyperdisk-throughput": {min: 2 * 1024, max: 32 * 1024},
+	"hyperdisk-ml":         {min: 4, max: 64 * 1024},
+	"pd-extreme":           {min: 500, max: 64 * 1024},
+}
+
+// diskPerformanceRange is the inclusive range of IOPS that may be provisioned
+// on creation of a disk type. If maxPerGb is non-zero, it also
+// bounds the value by the size of the disk.
+type diskPerformanceRange struct {
+	min      int64
+	max      int64
+	maxPerGb int64
+}
+
+// IOPS ranges for disk types that accept provisioned-iops-on-create. See
+// https://cloud.google.com/compute/docs/disks/extreme-persistent-disk and
+// https://cloud.google.com/compute/docs/disks/hyperdisks#limits-disk
+var diskTypeIOPSRanges = map[string]diskPerformanceRange{
+	"pd-extreme":         {min: 10000, max: 120000},
+	"hyperdisk-balanced": {min: 3000, max: 160000, maxPerGb: 500},
+	"hyperdisk-extreme":  {min: 2500, max: 350000, maxPerGb: 1000},
+}
+
+// The volume context keys set by the driver, in CreateVolume and ListVolumes,
+// or read by it from the volume attributes of statically provisioned PVs.
+var driverVolumeAttributes = sets.NewString(
+	common.VolumeAttributePartition,
+	common.VolumeAttributeDiskInterface,
+	common.VolumeAttributeMountHardening,
+	common.VolumeAttributeDiscard,
+	common.VolumeAttributeTrimAfterRestore,
+	common.VolumeAttributeRegenerateFSUUID,
+	common.VolumeAttributeReadOnly,
+	common.VolumeAttributePublishMetadata,
+	common.VolumeAttributeDiskType,
+	common.VolumeAttributeIOMax,
+	common.VolumeAttributeProvisionedIOPS,
+	common.VolumeAttributeAccessTypes,
+	common.VolumeAttributeProvisioner,
+)
+
+// Disk types that only exist as zonal disks, so have no regional disk type
+// URI.
+var zonalOnlyDiskTypes = sets.NewString("hyperdisk-balanced", "hyperdisk-extreme", "hyperdisk-throughput", "hyperdisk-ml")
+
+// Machine families that can attach each hyperdisk type. Families that are not
+// listed for any type are passed to GCE unchecked. See
+// https://cloud.google.com/compute/docs/disks/hyperdisks#machine-type-support
+var hyperdiskMachineFamilies = map[string]sets.String{
+	"hyperdisk-balanced":   sets.NewString("a3", "c3", "c3d", "c4", "h3", "m1", "m3", "n4", "x4", "z3"),
+	"hyperdisk-extreme":    sets.NewString("c3", "c3d", "m1", "m2", "m3", "n2", "x4", "z3"),
+	"hyperdisk-throughput": sets.NewString("a3", "c3", "c3d", "g2", "h3", "m3", "n2", "n2d", "t2d", "z3"),
+	"hyperdisk-ml":         sets.NewString("a2", "a3", "c3", "c3d", "g2", "h3"),
+}
+
+// Machine families that only attach hyperdisks.
+var hyperdiskOnlyMachineFamilies = sets.NewString("c4", "n4", "x4")
+
+// Machine families that attach persistent disks over NVMe only. See
+// https://cloud.google.com/compute/docs/disks/disk-interfaces
+var nvmeOnlyMachineFamilies = sets.NewString("c3", "c3d", "c4", "h3", "n4", "t2a")
+
 const (
 	// MaxVolumeSizeInBytes is the maximum standard and ssd size of 64TB
 	MaxVolumeSizeInBytes     int64 = 64 * 1024 * 1024 * 1024 * 1024
@@ -57,8 +244,66 @@ const (
 
 	replicationTypeNone       = "none"
 	replicationTypeRegionalPD = "regional-pd"
+
+	// Instance metadata key holding an RFC 3339 time until which detaches
+	// from that instance are paused, e.g. during an in-place OS upgrade.
+	pauseDetachUntilKey = "pd-csi-pause-detach-until"
 )
 
+// regionalDiskCleanupTimeout bounds the deletion of a half-created regional
+// disk, which waits for the delete operation to complete.
+const regionalDiskCleanupTimeout = 5 * time.Minute
+
+// cloneReadyBackoff bounds the wait for a cloned disk to become READY, which
+// may take longer than its insert operation while the data is copied.
+var cloneReadyBackoff = backoff.Standard
+
+// postInsertGetBackoff bounds the retries of a disk read that does not find
+// a disk right after its insert succeeded.
+var postInsertGetBackoff = backoff.Fast
+
+// SetParameterDefaults replaces the driver-wide disk parameter defaults used
+// by subsequent requests.
+func (gceCS *GCEControllerServer) SetParameterDefaults(defaults common.ParameterDefaults) {
+	gceCS.configMux.Lock()
+	defer gceCS.configMux.Unlock()
+	gceCS.parameterDefaults = defaults
+}
+
+func (gceCS *GCEControllerServer) getParameterDefaults() common.ParameterDefaults {
+	gceCS.configMux.RLock()
+	defer gceCS.configMux.RUnlock()
+	return gceCS.parameterDefaults
+}
+
+// SetTopologyAliases replaces the zone topology keys and zone aliases used
+// to translate the topology requirements of subsequent requests.
+func (gceCS *GCEControllerServer) SetTopologyAliases(aliases common.TopologyAliases) {
+	gceCS.configMux.Lock()
+	defer gceCS.configMux.Unlock()
+	gceCS.topologyAliases = aliases
+}
+
+func (gceCS *GCEControllerServer) getTopologyAliases() common.TopologyAliases {
+	gceCS.configMux.RLock()
+	defer gceCS.configMux.RUnlock()
+	return gceCS.topologyAliases
+}
+
+// SetAllowUnownedDelete sets whether subsequent DeleteVolume calls delete
+// disks that the driver did not create.
+func (gceCS *GCEControllerServer) SetAllowUnownedDelete(allow bool) {
+	gceCS.configMux.Lock()
+	defer gceCS.configMux.Unlock()
+	gceCS.allowUnownedDelete = allow
+}
+
+func (gceCS *GCEControllerServer) getAllowUnownedDelete() bool {
+	gceCS.configMux.RLock()
+	defer gceCS.configMux.RUnlock()
+	return gceCS.allowUnownedDelete
+}
+
 func isDiskReady(disk *gce.CloudDisk) (bool, error) {
 	status := disk.GetStatus()
 	switch status {
@@ -83,6 +328,12 @@ func isDiskReady(disk *gce.CloudDisk) (bool, error) {
 }
 
 func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	start := time.Now()
+	resp, err := gceCS.executeCreateVolume(ctx, req)
+	return resp, gceCS.opHistory.record(req.GetName(), historyOperationCreate, "", start, err)
+}
+
+func (gceCS *GCEControllerServer) executeCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	var err error
 	// Validate arguments
 	volumeCapabilities := req.GetVolumeCapabilities()
@@ -100,29 +351,87 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume Request Capacity is invalid: %v", err))
 	}
 
-	err = validateVolumeCapabilities(volumeCapabilities)
-	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapabilities is invalid: %v", err))
-	}
-
 	// Apply Parameters (case-insensitive). We leave validation of
 	// the values to the cloud provider.
-	params, err := common.ExtractAndDefaultParameters(req.GetParameters(), gceCS.Driver.name, gceCS.Driver.extraVolumeLabels)
+	params, err := common.ExtractAndDefaultParameters(req.GetParameters(), gceCS.Driver.name, gceCS.Driver.extraVolumeLabels, gceCS.getParameterDefaults())
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "failed to extract parameters: %v", err)
 	}
 	// Determine multiWriter
 	gceAPIVersion := gce.GCEAPIVersionV1
 	multiWriter, _ := getMultiWriterFromCapabilities(volumeCapabilities)
-	if multiWriter {
+	if params.ProvisionedIOPSOnCreate > 0 {
+		// Only the alpha API reports provisioned IOPS, which an existing
+		// disk must match.
+		gceAPIVersion = gce.GCEAPIVersionAlpha
+	} else if multiWriter {
 		gceAPIVersion = gce.GCEAPIVersionBeta
 	}
+	err = validateVolumeCapabilitiesForDisk(volumeCapabilities, params.DiskType, params.ReplicationType == replicationTypeRegionalPD, multiWriter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapabilities is invalid: %v", err))
+	}
+	if params.ReadOnlyRestore {
+		if req.GetVolumeContentSource().GetSnapshot() == nil {
+			return nil, status.Error(codes.InvalidArgument, "CreateVolume read-only-restore requires a snapshot source")
+		}
+		if err := validateReadOnlyCapabilities(volumeCapabilities); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapabilities is invalid for read-only-restore: %v", err))
+		}
+	}
+	if params.ReplicationType == replicationTypeRegionalPD && zonalOnlyDiskTypes.Has(params.DiskType) {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume disk type %s does not support replication type %s", params.DiskType, params.ReplicationType)
+	}
+	if err := validateProvisionedPerformance(params, common.BytesToGbRoundUp(capBytes)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume provisioned performance is invalid: %v", err))
+	}
+	accessibilityRequirements, err := translateTopology(req.GetAccessibilityRequirements(), gceCS.getTopologyAliases())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume accessibility requirements are invalid: %v", err))
+	}
+	if err := validateFilesystemTopology(volumeCapabilities, accessibilityRequirements); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume filesystem is not supported: %v", err))
+	}
+	// A clone is placed with its source disk, so the source is checked
+	// before the zones are picked.
+	var sourceVolKey *meta.Key
+	var sourceDisk *gce.CloudDisk
+	volumeContentSourceVolumeID := req.GetVolumeContentSource().GetVolume().GetVolumeId()
+	if volumeContentSourceVolumeID != "" {
+		sourceVolKey, sourceDisk, err = gceCS.getCloneSource(ctx, volumeContentSourceVolumeID)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateCloneSource(sourceDisk, sourceVolKey, params, capBytes); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume cannot clone volume %s: %v", volumeContentSourceVolumeID, err))
+		}
+	}
+	// Instant snapshots can only be restored in their own zone or region, so
+	// like clones their restores are placed with them.
+	var instantSnapshotKey *meta.Key
+	if snapshotID := req.GetVolumeContentSource().GetSnapshot().GetSnapshotId(); snapshotID != "" {
+		if snapshotType, key, err := common.SnapshotIDToKey(snapshotID); err == nil && snapshotType == common.DiskInstantSnapshotType {
+			if err := validateInstantSnapshotRestore(key, params); err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume cannot restore instant snapshot %s: %v", snapshotID, err))
+			}
+			instantSnapshotKey = key
+		}
+	}
 	// Determine the zone or zones+region of the disk
 	var zones []string
 	var volKey *meta.Key
+	if len(params.ReplicaZones) > 0 && params.ReplicationType != replicationTypeRegionalPD {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume parameter %s is only supported with %s %s", common.ParameterKeyReplicaZones, common.ParameterKeyReplicationType, replicationTypeRegionalPD))
+	}
 	switch params.ReplicationType {
 	case replicationTypeNone:
-		zones, err = pickZones(ctx, gceCS, req.GetAccessibilityRequirements(), 1)
+		if sourceDisk != nil {
+			zones, err = pickCloneZones(ctx, gceCS, sourceVolKey, sourceDisk, accessibilityRequirements, 1)
+		} else if instantSnapshotKey != nil {
+			zones, err = pickCloneZones(ctx, gceCS, instantSnapshotKey, nil, accessibilityRequirements, 1)
+		} else {
+			zones, err = pickZones(ctx, gceCS, accessibilityRequirements, 1)
+		}
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed to pick zones for disk: %v", err))
 		}
@@ -132,7 +441,13 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		volKey = meta.ZonalKey(name, zones[0])
 
 	case replicationTypeRegionalPD:
-		zones, err = pickZones(ctx, gceCS, req.GetAccessibilityRequirements(), 2)
+		if len(params.ReplicaZones) > 0 {
+			zones, err = pickPinnedReplicaZones(ctx, gceCS, params.ReplicaZones, sourceVolKey, sourceDisk, accessibilityRequirements)
+		} else if sourceDisk != nil {
+			zones, err = pickCloneZones(ctx, gceCS, sourceVolKey, sourceDisk, accessibilityRequirements, 2)
+		} else {
+			zones, err = pickZones(ctx, gceCS, accessibilityRequirements, 2)
+		}
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed to pick zones for disk: %v", err))
 		}
@@ -140,6 +455,9 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed to get region from zones: %v", err))
 		}
+		if instantSnapshotKey != nil && region != instantSnapshotKey.Region {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume cannot restore instant snapshot %v in region %s, it must be restored in its own region", instantSnapshotKey, region))
+		}
 		volKey = meta.RegionalKey(name, region)
 	default:
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume replication type '%s' is not supported", params.ReplicationType))
@@ -171,8 +489,27 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("CreateVolume disk already exists with same name and is incompatible: %v", err))
 		}
 
+		if existingDisk.GetStatus() == "CREATING" {
+			// Another request, such as from the previous leader during a
+			// controller handover, may still be creating the disk. Adopt
+			// its insert instead of failing until it is done.
+			existingDisk, err = gceCS.waitForDiskInsert(ctx, volKey, gceAPIVersion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if volumeContentSourceVolumeID != "" {
+			existingDisk, err = waitForCloneReady(ctx, gceCS.CloudProvider, existingDisk, volKey, gceAPIVersion)
+			if err != nil {
+				return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to wait for clone %v: %v", volKey, err))
+			}
+		}
+
 		ready, err := isDiskReady(existingDisk)
 		if err != nil {
+			if params.ReplicationType == replicationTypeRegionalPD && gceCS.cleanupFailedRegionalDisk(volKey, gceAPIVersion) {
+				return nil, status.Error(codes.Unavailable, fmt.Sprintf("CreateVolume deleted failed regional disk %v, it will be recreated on retry: %v", volKey, err))
+			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume disk %v had error checking ready status: %v", volKey, err))
 		}
 
@@ -182,14 +519,13 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 
 		// If there is no validation error, immediately return success
 		klog.V(4).Infof("CreateVolume succeeded for disk %v, it already exists and was compatible", volKey)
-		return generateCreateVolumeResponse(existingDisk, zones), nil
+		return generateCreateVolumeResponse(existingDisk, zones, params, volumeCapabilities), nil
 	}
 
 	snapshotID := ""
 	content := req.GetVolumeContentSource()
 	if content != nil {
 		if content.GetSnapshot() != nil {
-			// TODO(#161): Add support for Volume Source (cloning) introduced in CSI v1.0.0
 			snapshotID = content.GetSnapshot().GetSnapshotId()
 
 			// Verify that snapshot exists
@@ -209,24 +545,41 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		if len(zones) != 1 {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to get a single zone for creating zonal disk, instead got: %v", zones))
 		}
-		disk, err = createSingleZoneDisk(ctx, gceCS.CloudProvider, name, zones, params, capacityRange, capBytes, snapshotID, multiWriter)
+		disk, err = createSingleZoneDisk(ctx, gceCS.CloudProvider, name, zones, params, capacityRange, capBytes, snapshotID, volumeContentSourceVolumeID, multiWriter)
 		if err != nil {
+			if gce.IsGCEKMSPermissionError(err) {
+				return nil, kmsPermissionDeniedError(params.DiskEncryptionKMSKey, err)
+			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to create single zonal disk %#v: %v", name, err))
 		}
 	case replicationTypeRegionalPD:
 		if len(zones) != 2 {
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("CreateVolume failed to get a 2 zones for creating regional disk, instead got: %v", zones))
 		}
-		disk, err = createRegionalDisk(ctx, gceCS.CloudProvider, name, zones, params, capacityRange, capBytes, snapshotID, multiWriter)
+		disk, err = createRegionalDisk(ctx, gceCS.CloudProvider, name, zones, params, capacityRange, capBytes, snapshotID, volumeContentSourceVolumeID, multiWriter)
 		if err != nil {
+			gceCS.cleanupFailedRegionalDisk(volKey, gceAPIVersion)
+			if gce.IsGCEKMSPermissionError(err) {
+				return nil, kmsPermissionDeniedError(params.DiskEncryptionKMSKey, err)
+			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to create regional disk %#v: %v", name, err))
 		}
 	default:
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume replication type '%s' is not supported", params.ReplicationType))
 	}
 
+	if volumeContentSourceVolumeID != "" {
+		disk, err = waitForCloneReady(ctx, gceCS.CloudProvider, disk, volKey, gceAPIVersion)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to wait for clone %v: %v", volKey, err))
+		}
+	}
+
 	ready, err := isDiskReady(disk)
 	if err != nil {
+		if params.ReplicationType == replicationTypeRegionalPD {
+			gceCS.cleanupFailedRegionalDisk(volKey, gceAPIVersion)
+		}
 		return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume disk %v had error checking ready status: %v", volKey, err))
 	}
 	if !ready {
@@ -234,11 +587,22 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	}
 
 	klog.V(4).Infof("CreateVolume succeeded for disk %v", volKey)
-	return generateCreateVolumeResponse(disk, zones), nil
+	return generateCreateVolumeResponse(disk, zones, params, volumeCapabilities), nil
 
 }
 
 func (gceCS *GCEControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	start := time.Now()
+	resp, err := gceCS.executeDeleteVolume(ctx, req)
+	name := historyName(req.GetVolumeId())
+	if err == nil {
+		gceCS.opHistory.forget(name)
+		return resp, nil
+	}
+	return resp, gceCS.opHistory.record(name, historyOperationDelete, "", start, err)
+}
+
+func (gceCS *GCEControllerServer) executeDeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	// Validate arguments
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
@@ -267,6 +631,22 @@ func (gceCS *GCEControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 	}
 	defer gceCS.volumeLocks.Release(volumeID)
 
+	if !gceCS.getAllowUnownedDelete() {
+		disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gce.GCEAPIVersionV1)
+		if err != nil {
+			if gce.IsGCENotFoundError(err) {
+				klog.Warningf("DeleteVolume treating volume as deleted because cannot find volume %v: %v", volumeID, err)
+				return &csi.DeleteVolumeResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get disk error: %v", err))
+		}
+		// Disks of migrated in-tree PVs are deleted through the driver
+		// once CSI migration is enabled.
+		if !gce.IsDiskCreatedByDriver(disk, gceCS.Driver.name) && !gce.IsDiskCreatedByInTreeProvisioner(disk.GetName(), disk.GetDescription()) {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("DeleteVolume refusing to delete disk %v which was not created by %v", volKey.String(), gceCS.Driver.name))
+		}
+	}
+
 	err = gceCS.CloudProvider.DeleteDisk(ctx, volKey)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete disk error: %v", err))
@@ -277,6 +657,15 @@ func (gceCS *GCEControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 }
 
 func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	start := time.Now()
+	resp, err := gceCS.executeControllerPublishVolume(ctx, req)
+	if err != nil {
+		metrics.RecordAttachDetachFailure(metrics.OperationAttach, err)
+	}
+	return resp, gceCS.opHistory.record(historyName(req.GetVolumeId()), historyOperationAttach, req.GetNodeId(), start, err)
+}
+
+func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	// Validate arguments
 	volumeID := req.GetVolumeId()
 	readOnly := req.GetReadonly()
@@ -291,6 +680,10 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 	if volumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume capability must be provided")
 	}
+	diskInterface := req.GetVolumeContext()[common.VolumeAttributeDiskInterface]
+	if diskInterface != "" && diskInterface != common.DiskInterfaceNVME && diskInterface != common.DiskInterfaceSCSI {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("ControllerPublishVolume disk interface %q is invalid", diskInterface))
+	}
 
 	volKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
@@ -312,17 +705,23 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, lockingVolumeID)
 	}
 	defer gceCS.volumeLocks.Release(lockingVolumeID)
+	if err := gceCS.acquireAttachLock(ctx, volumeID); err != nil {
+		return nil, err
+	}
+	defer gceCS.attachLocks.Release(volumeID)
 
 	// TODO(#253): Check volume capability matches for ALREADY_EXISTS
 	if err = validateVolumeCapability(volumeCapability); err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapabilities is invalid: %v", err))
 	}
 
-	pubVolResp := &csi.ControllerPublishVolumeResponse{
-		PublishContext: nil,
+	// Only the beta API reports whether a disk is in multi-writer mode.
+	gceAPIVersion := gce.GCEAPIVersionV1
+	multiWriter, _ := getMultiWriterFromCapability(volumeCapability)
+	if multiWriter {
+		gceAPIVersion = gce.GCEAPIVersionBeta
 	}
-
-	_, err = gceCS.CloudProvider.GetDisk(ctx, volKey, gce.GCEAPIVersionV1)
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gceAPIVersion)
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find disk %v: %v", volKey.String(), err))
@@ -333,7 +732,7 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("could not split nodeID: %v", err))
 	}
-	instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+	instance, cached, err := gceCS.getInstance(ctx, instanceZone, instanceName)
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find instance %v: %v", nodeID, err))
@@ -342,7 +741,7 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 	}
 
 	readWrite := "READ_WRITE"
-	if readOnly {
+	if readOnly || req.GetVolumeContext()[common.VolumeAttributeReadOnly] == "true" {
 		readWrite = "READ_ONLY"
 	}
 
@@ -351,7 +750,29 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 		return nil, status.Error(codes.Internal, fmt.Sprintf("error getting device name: %v", err))
 	}
 
-	attached, err := diskIsAttachedAndCompatible(deviceName, instance, volumeCapability, readWrite)
+	pubVolResp := &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			common.ContextKeyDeviceName: deviceName,
+		},
+	}
+	if diskType := disk.GetPDType(); diskType != "" {
+		pubVolResp.PublishContext[common.ContextKeyDiskType] = diskType
+	}
+	if diskInterface != "" {
+		pubVolResp.PublishContext[common.ContextKeyDiskInterface] = diskInterface
+	}
+
+	attached, err := diskIsAttachedAndCompatible(deviceName, instance, volumeCapability, readWrite, diskInterface)
+	if (err != nil || attached) && cached {
+		// Do not fail, or report an attach, on an instance that may be
+		// stale.
+		instance, err = gceCS.instanceCache.refresh(ctx, instanceZone, instanceName)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get instance error: %v", err))
+		}
+		cached = false
+		attached, err = diskIsAttachedAndCompatible(deviceName, instance, volumeCapability, readWrite, diskInterface)
+	}
 	if err != nil {
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Disk %v already published to node %v but incompatbile: %v", volKey.Name, nodeID, err))
 	}
@@ -360,18 +781,50 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 		klog.V(4).Infof("ControllerPublishVolume succeeded for disk %v to instance %v, already attached.", volKey, nodeID)
 		return pubVolResp, nil
 	}
+	if err := validateInstanceDiskInterface(instance, diskInterface); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Cannot attach disk %v to instance %v: %v", volKey.Name, nodeID, err))
+	}
+	if err := validateInstanceDiskType(instance, disk.GetPDType()); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Cannot attach disk %v to instance %v: %v", volKey.Name, nodeID, err))
+	}
+	if err := validateInstanceReplicaZone(disk, instanceZone); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Cannot attach disk %v to instance %v: %v", volKey.Name, nodeID, err))
+	}
+	if multiWriter && !disk.GetMultiWriter() {
+		// GCE would refuse to attach the disk to a second instance.
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Cannot attach disk %v to instance %v with access mode %v, the disk was not created in multi-writer mode", volKey.Name, nodeID, volumeCapability.GetAccessMode().GetMode()))
+	}
+	if readWrite == "READ_WRITE" && !multiWriter {
+		// The attach lock orders this attach after any detach from another
+		// node, but that detach may not have been requested yet.
+		if users := otherDiskUsers(disk, instanceZone, instanceName); len(users) > 0 {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Cannot attach disk %v read-write to instance %v, it is still attached to %v", volKey.Name, nodeID, users))
+		}
+	}
 	instanceZone, instanceName, err = common.NodeIDToZoneAndName(nodeID)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("could not split nodeID: %v", err))
 	}
-	err = gceCS.CloudProvider.AttachDisk(ctx, volKey, readWrite, attachableDiskTypePersistent, instanceZone, instanceName)
+	err = gceCS.CloudProvider.AttachDisk(ctx, volKey, readWrite, attachableDiskTypePersistent, diskInterface, instanceZone, instanceName)
+	gceCS.invalidateInstance(instanceZone, instanceName)
+	gceCS.attachAuditor.record("attach", volumeID, instanceName, err)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Attach error: %v", err))
+		if cached {
+			// The attach may have conflicted with an attach the stale
+			// instance did not show.
+			if instance, getErr := gceCS.instanceCache.refresh(ctx, instanceZone, instanceName); getErr == nil {
+				if attached, _ := diskIsAttachedAndCompatible(deviceName, instance, volumeCapability, readWrite, diskInterface); attached {
+					klog.V(4).Infof("ControllerPublishVolume succeeded for disk %v to instance %v, attached after cached instance was stale.", volKey, nodeID)
+					return pubVolResp, nil
+				}
+			}
+		}
+		return nil, gceStatusError(codeForGCEError(err), fmt.Sprintf("unknown Attach error: %v", err), err)
 	}
 
 	err = gceCS.CloudProvider.WaitForAttach(ctx, volKey, instanceZone, instanceName)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown WaitForAttach error: %v", err))
+		return nil, gceStatusError(codes.Internal, fmt.Sprintf("unknown WaitForAttach error: %v", err), err)
 	}
 
 	klog.V(4).Infof("ControllerPublishVolume succeeded for disk %v to instance %v", volKey, nodeID)
@@ -379,6 +832,15 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 }
 
 func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	start := time.Now()
+	resp, err := gceCS.executeControllerUnpublishVolume(ctx, req)
+	if err != nil {
+		metrics.RecordAttachDetachFailure(metrics.OperationDetach, err)
+	}
+	return resp, gceCS.opHistory.record(historyName(req.GetVolumeId()), historyOperationDetach, req.GetNodeId(), start, err)
+}
+
+func (gceCS *GCEControllerServer) executeControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	// Validate arguments
 	volumeID := req.GetVolumeId()
 	nodeID := req.GetNodeId()
@@ -401,12 +863,16 @@ func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context,
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, lockingVolumeID)
 	}
 	defer gceCS.volumeLocks.Release(lockingVolumeID)
+	if err := gceCS.acquireAttachLock(ctx, volumeID); err != nil {
+		return nil, err
+	}
+	defer gceCS.attachLocks.Release(volumeID)
 
 	instanceZone, instanceName, err := common.NodeIDToZoneAndName(nodeID)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("could not split nodeID: %v", err))
 	}
-	instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+	instance, cached, err := gceCS.getInstance(ctx, instanceZone, instanceName)
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			// Node not existing on GCE means that disk has been detached
@@ -422,6 +888,15 @@ func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context,
 	}
 
 	attached := diskIsAttached(deviceName, instance)
+	if !attached && cached {
+		// Do not report a detach on an instance that may be stale.
+		instance, err = gceCS.instanceCache.refresh(ctx, instanceZone, instanceName)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("error getting instance: %v", err))
+		}
+		cached = false
+		attached = diskIsAttached(deviceName, instance)
+	}
 
 	if !attached {
 		// Volume is not attached to node. Success!
@@ -429,9 +904,23 @@ func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context,
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
+	if until := gceCS.detachPausedUntil(instanceZone, instance); !until.IsZero() {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("ControllerUnpublishVolume detach of disk %v from node %v is paused until %v", volKey, nodeID, until.Format(time.RFC3339)))
+	}
+
 	err = gceCS.CloudProvider.DetachDisk(ctx, deviceName, instanceZone, instanceName)
+	gceCS.invalidateInstance(instanceZone, instanceName)
+	gceCS.attachAuditor.record("detach", volumeID, instanceName, err)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown detach error: %v", err))
+		if cached {
+			// The detach may have conflicted with a detach the stale
+			// instance did not show.
+			if instance, getErr := gceCS.instanceCache.refresh(ctx, instanceZone, instanceName); getErr == nil && !diskIsAttached(deviceName, instance) {
+				klog.V(4).Infof("ControllerUnpublishVolume succeeded for disk %v from node %v, detached after cached instance was stale.", volKey, nodeID)
+				return &csi.ControllerUnpublishVolumeResponse{}, nil
+			}
+		}
+		return nil, gceStatusError(codeForGCEError(err), fmt.Sprintf("unknown detach error: %v", err), err)
 	}
 
 	klog.V(4).Infof("ControllerUnpublishVolume succeeded for disk %v from node %v", volKey, nodeID)
@@ -456,7 +945,12 @@ func (gceCS *GCEControllerServer) ValidateVolumeCapabilities(ctx context.Context
 	}
 	defer gceCS.volumeLocks.Release(volumeID)
 
-	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gce.GCEAPIVersionV1)
+	// Only the beta API reports whether a disk is in multi-writer mode.
+	gceAPIVersion := gce.GCEAPIVersionV1
+	if multiWriter, _ := getMultiWriterFromCapabilities(req.GetVolumeCapabilities()); multiWriter {
+		gceAPIVersion = gce.GCEAPIVersionBeta
+	}
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gceAPIVersion)
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find disk %v: %v", volKey.Name, err))
@@ -464,18 +958,27 @@ func (gceCS *GCEControllerServer) ValidateVolumeCapabilities(ctx context.Context
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get disk error: %v", err))
 	}
 
-	// Check Volume Context is Empty
-	if len(req.GetVolumeContext()) != 0 {
-		return generateFailedValidationMessage("VolumeContext expected to be empty but got %v", req.GetVolumeContext()), nil
+	// Check Volume Context only has keys the driver sets, and that the
+	// access types CreateVolume records for volumes created for both block
+	// and mount cover the capabilities
+	for k := range req.GetVolumeContext() {
+		if !driverVolumeAttributes.Has(k) {
+			return generateFailedValidationMessage("VolumeContext has unknown key %q: %v", k, req.GetVolumeContext()), nil
+		}
+	}
+	if accessTypes, ok := req.GetVolumeContext()[common.VolumeAttributeAccessTypes]; ok {
+		if err := validateAccessTypes(req.GetVolumeCapabilities(), accessTypes); err != nil {
+			return generateFailedValidationMessage("VolumeCapabilities not valid: %v", err), nil
+		}
 	}
 
-	// Check volume capabilities supported by PD. These are the same for any PD
-	if err := validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+	// Check volume capabilities are supported by the disk
+	if err := validateVolumeCapabilitiesForDisk(req.GetVolumeCapabilities(), disk.GetPDType(), disk.LocationType() == meta.Regional, disk.GetMultiWriter()); err != nil {
 		return generateFailedValidationMessage("VolumeCapabilities not valid: %v", err), nil
 	}
 
 	// Validate the disk parameters match the disk we GET
-	params, err := common.ExtractAndDefaultParameters(req.GetParameters(), gceCS.Driver.name, gceCS.Driver.extraVolumeLabels)
+	params, err := common.ExtractAndDefaultParameters(req.GetParameters(), gceCS.Driver.name, gceCS.Driver.extraVolumeLabels, gceCS.getParameterDefaults())
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "failed to extract parameters: %v", err)
 	}
@@ -515,12 +1018,28 @@ func (gceCS *GCEControllerServer) ListVolumes(ctx context.Context, req *csi.List
 		klog.Warningf("ListVolumes requested max entries of %v, GCE only supports values <=500 so defaulting value back to 500", maxEntries)
 		maxEntries = 500
 	}
-	diskList, nextToken, err := gceCS.CloudProvider.ListDisks(ctx, maxEntries, req.StartingToken)
-	if err != nil {
-		if gce.IsGCEInvalidError(err) {
+	var diskList []*compute.Disk
+	var nextToken string
+	if gceCS.diskCache != nil {
+		var lastRefresh time.Time
+		var err error
+		diskList, nextToken, lastRefresh, err = gceCS.diskCache.list(maxEntries, req.StartingToken)
+		if err != nil {
 			return nil, status.Error(codes.Aborted, fmt.Sprintf("ListVolumes error with invalid request: %v", err))
 		}
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list disk error: %v", err))
+		if lastRefresh.IsZero() {
+			return nil, status.Error(codes.Unavailable, "ListVolumes disk cache has not been populated yet")
+		}
+		klog.V(4).Infof("ListVolumes served from disk cache refreshed at %v (%v ago)", lastRefresh, time.Since(lastRefresh))
+	} else {
+		var err error
+		diskList, nextToken, err = gceCS.CloudProvider.ListDisks(ctx, maxEntries, req.StartingToken)
+		if err != nil {
+			if gce.IsGCEInvalidError(err) {
+				return nil, status.Error(codes.Aborted, fmt.Sprintf("ListVolumes error with invalid request: %v", err))
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list disk error: %v", err))
+		}
 	}
 	entries := []*csi.ListVolumesResponse_Entry{}
 	for _, d := range diskList {
@@ -528,9 +1047,14 @@ func (gceCS *GCEControllerServer) ListVolumes(ctx context.Context, req *csi.List
 		for _, u := range d.Users {
 			users = append(users, cleanSelfLink(u))
 		}
+		var volumeContext map[string]string
+		if gce.IsDiskCreatedByInTreeProvisioner(d.Name, d.Description) {
+			volumeContext = map[string]string{common.VolumeAttributeProvisioner: common.InTreeProvisionerName}
+		}
 		entries = append(entries, &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
-				VolumeId: cleanSelfLink(d.SelfLink),
+				VolumeId:      cleanSelfLink(d.SelfLink),
+				VolumeContext: volumeContext,
 			},
 			Status: &csi.ListVolumesResponse_VolumeStatus{
 				PublishedNodeIds: users,
@@ -558,6 +1082,9 @@ func (gceCS *GCEControllerServer) ControllerGetCapabilities(ctx context.Context,
 }
 
 func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if gceCS.disableSnapshots {
+		return nil, status.Error(codes.Unimplemented, "CreateSnapshot is disabled on this driver")
+	}
 	// Validate arguments
 	volumeID := req.GetSourceVolumeId()
 	if len(req.Name) == 0 {
@@ -570,6 +1097,10 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateSnapshot Volume ID is invalid: %v", err))
 	}
+	params, err := common.ExtractAndDefaultSnapshotParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateSnapshot failed to extract parameters: %v", err))
+	}
 
 	if acquired := gceCS.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
@@ -585,15 +1116,32 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 		return nil, status.Error(codes.Internal, fmt.Sprintf("CreateSnapshot unknown get disk error: %v", err))
 	}
 
+	var snapshot *csi.Snapshot
+	switch params.SnapshotType {
+	case common.DiskImageType:
+		snapshot, err = gceCS.createImage(ctx, volKey, req.Name, params.Labels)
+	case common.DiskInstantSnapshotType:
+		snapshot, err = gceCS.createInstantSnapshot(ctx, volKey, req.Name, params.Labels)
+	default:
+		snapshot, err = gceCS.createPDSnapshot(ctx, volKey, req.Name, params.Labels)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot.SourceVolumeId = volumeID
+	klog.V(4).Infof("CreateSnapshot succeeded for snapshot %s on volume %s", snapshot.SnapshotId, volumeID)
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+}
+
+func (gceCS *GCEControllerServer) createPDSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*csi.Snapshot, error) {
 	// Check if snapshot already exists
-	var snapshot *compute.Snapshot
-	snapshot, err = gceCS.CloudProvider.GetSnapshot(ctx, req.Name)
+	snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, snapshotName)
 	if err != nil {
 		if !gce.IsGCEError(err, "notFound") {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get snapshot error: %v", err))
 		}
 		// If we could not find the snapshot, we create a new one
-		snapshot, err = gceCS.CloudProvider.CreateSnapshot(ctx, volKey, req.Name)
+		snapshot, err = gceCS.CloudProvider.CreateSnapshot(ctx, volKey, snapshotName, labels)
 		if err != nil {
 			if gce.IsGCEError(err, "notFound") {
 				return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find volume with ID %v: %v", volKey.String(), err))
@@ -606,32 +1154,126 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 	if err != nil {
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error in creating snapshot: %v", err))
 	}
-	t, err := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+	tp, err := parseCreationTimestamp(snapshot.CreationTimestamp)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to covert creation timestamp: %v", err))
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	tp, err := ptypes.TimestampProto(t)
+	gceCS.snapshotUploads.observe(snapshot)
+	ready, err := isCSISnapshotReady(snapshot.Status)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Snapshot had error checking ready status: %v", err))
+	}
+
+	return &csi.Snapshot{
+		SizeBytes:    common.GbToBytes(snapshot.DiskSizeGb),
+		SnapshotId:   cleanSelfLink(snapshot.SelfLink),
+		CreationTime: tp,
+		ReadyToUse:   ready,
+	}, nil
+}
+
+// createImage creates the image backing an image snapshot. Images are
+// created PENDING and become ready only after minutes, which the
+// external-snapshotter waits for by calling CreateSnapshot again.
+func (gceCS *GCEControllerServer) createImage(ctx context.Context, volKey *meta.Key, imageName string, labels map[string]string) (*csi.Snapshot, error) {
+	// Check if image already exists
+	image, err := gceCS.CloudProvider.GetImage(ctx, imageName)
+	if err != nil {
+		if !gce.IsGCEError(err, "notFound") {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get image error: %v", err))
+		}
+		// If we could not find the image, we create a new one
+		image, err = gceCS.CloudProvider.CreateImage(ctx, volKey, imageName, labels)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find volume with ID %v: %v", volKey.String(), err))
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown create image error: %v", err))
+		}
+	}
+
+	if err := validateSnapshotSourceDisk(image.SourceDisk, volKey); err != nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error in creating image: %v", err))
+	}
+	tp, err := parseCreationTimestamp(image.CreationTimestamp)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ready, err := isCSISnapshotReady(image.Status)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to covert creation timestamp: %v", err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Image had error checking ready status: %v", err))
+	}
+
+	return &csi.Snapshot{
+		SizeBytes:    common.GbToBytes(image.DiskSizeGb),
+		SnapshotId:   cleanSelfLink(image.SelfLink),
+		CreationTime: tp,
+		ReadyToUse:   ready,
+	}, nil
+}
+
+// createInstantSnapshot creates an instant snapshot of the disk volKey in the
+// zone or region of the disk. Instant snapshots are ready as soon as they are
+// created, but can only be restored in the location of their source.
+func (gceCS *GCEControllerServer) createInstantSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string, labels map[string]string) (*csi.Snapshot, error) {
+	var snapshotKey *meta.Key
+	switch volKey.Type() {
+	case meta.Zonal:
+		snapshotKey = meta.ZonalKey(snapshotName, volKey.Zone)
+	case meta.Regional:
+		snapshotKey = meta.RegionalKey(snapshotName, volKey.Region)
+	default:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateSnapshot volume %v is neither zonal nor regional", volKey.String()))
+	}
+
+	// Check if instant snapshot already exists
+	snapshot, err := gceCS.CloudProvider.GetInstantSnapshot(ctx, snapshotKey)
+	if err != nil {
+		if !gce.IsGCEError(err, "notFound") {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get instant snapshot error: %v", err))
+		}
+		// If we could not find the instant snapshot, we create a new one
+		snapshot, err = gceCS.CloudProvider.CreateInstantSnapshot(ctx, volKey, snapshotName, labels)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find volume with ID %v: %v", volKey.String(), err))
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown create instant snapshot error: %v", err))
+		}
 	}
 
+	if err := validateSnapshotSourceDisk(snapshot.SourceDisk, volKey); err != nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error in creating instant snapshot: %v", err))
+	}
+	tp, err := parseCreationTimestamp(snapshot.CreationTimestamp)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	ready, err := isCSISnapshotReady(snapshot.Status)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Snapshot had error checking ready status: %v", err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Instant snapshot had error checking ready status: %v", err))
 	}
 
-	createResp := &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SizeBytes:      common.GbToBytes(snapshot.DiskSizeGb),
-			SnapshotId:     cleanSelfLink(snapshot.SelfLink),
-			SourceVolumeId: volumeID,
-			CreationTime:   tp,
-			ReadyToUse:     ready,
-		},
+	return &csi.Snapshot{
+		SizeBytes:    common.GbToBytes(snapshot.DiskSizeGb),
+		SnapshotId:   cleanSelfLink(snapshot.SelfLink),
+		CreationTime: tp,
+		ReadyToUse:   ready,
+	}, nil
+}
+
+// parseCreationTimestamp converts the creation timestamp of a GCE resource.
+func parseCreationTimestamp(creationTimestamp string) (*timestamp.Timestamp, error) {
+	t, err := time.Parse(time.RFC3339, creationTimestamp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to covert creation timestamp: %v", err)
+	}
+	tp, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to covert creation timestamp: %v", err)
 	}
-	klog.V(4).Infof("CreateSnapshot succeeded for snapshot %s on volume %s", cleanSelfLink(snapshot.SelfLink), volumeID)
-	return createResp, nil
+	return tp, nil
 }
 
 func (gceCS *GCEControllerServer) validateExistingSnapshot(snapshot *compute.Snapshot, volKey *meta.Key) error {
@@ -639,16 +1281,24 @@ func (gceCS *GCEControllerServer) validateExistingSnapshot(snapshot *compute.Sna
 		return fmt.Errorf("disk does not exist")
 	}
 
-	sourceKey, err := common.VolumeIDToKey(cleanSelfLink(snapshot.SourceDisk))
-	if err != nil {
-		return fmt.Errorf("fail to get source disk key %s, %v", snapshot.SourceDisk, err)
+	if err := validateSnapshotSourceDisk(snapshot.SourceDisk, volKey); err != nil {
+		return err
 	}
+	// Snapshot exists with matching source disk.
+	klog.V(5).Infof("Compatible snapshot %s exists with source disk %s.", snapshot.Name, snapshot.SourceDisk)
+	return nil
+}
 
+// validateSnapshotSourceDisk checks that a snapshot or image found by name
+// was taken of the disk volKey.
+func validateSnapshotSourceDisk(sourceDisk string, volKey *meta.Key) error {
+	sourceKey, err := common.VolumeIDToKey(cleanSelfLink(sourceDisk))
+	if err != nil {
+		return fmt.Errorf("fail to get source disk key %s, %v", sourceDisk, err)
+	}
 	if sourceKey.String() != volKey.String() {
 		return fmt.Errorf("snapshot already exists with same name but with a different disk source %s, expected disk source %s", sourceKey.String(), volKey.String())
 	}
-	// Snapshot exists with matching source disk.
-	klog.V(5).Infof("Compatible snapshot %s exists with source disk %s.", snapshot.Name, snapshot.SourceDisk)
 	return nil
 }
 
@@ -667,13 +1317,16 @@ func isCSISnapshotReady(status string) (bool, error) {
 }
 
 func (gceCS *GCEControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if gceCS.disableSnapshots {
+		return nil, status.Error(codes.Unimplemented, "DeleteSnapshot is disabled on this driver")
+	}
 	// Validate arguments
 	snapshotID := req.GetSnapshotId()
 	if len(snapshotID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
 	}
 
-	key, err := common.SnapshotIDToKey(snapshotID)
+	snapshotType, key, err := common.SnapshotIDToKey(snapshotID)
 	if err != nil {
 		// Cannot get snapshot ID from the passing request
 		// This is a success according to the spec
@@ -681,18 +1334,94 @@ func (gceCS *GCEControllerServer) DeleteSnapshot(ctx context.Context, req *csi.D
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
 
-	err = gceCS.CloudProvider.DeleteSnapshot(ctx, key)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete snapshot error: %v", err))
+	if gceCS.snapshotDeletes != nil {
+		// The source volume is read to queue the delete behind the other
+		// deletes of the volume, which also skips the queue for snapshots
+		// that are already gone.
+		sourceVolume, err := gceCS.getSnapshotSourceVolume(ctx, snapshotType, key)
+		if err != nil {
+			if gce.IsGCENotFoundError(err) {
+				gceCS.snapshotUploads.forget(snapshotID)
+				return &csi.DeleteSnapshotResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("DeleteSnapshot unknown get snapshot error: %v", err))
+		}
+		if err := gceCS.snapshotDeletes.wait(ctx, sourceVolume); err != nil {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("DeleteSnapshot of %s gave up waiting for the snapshot delete rate limit: %v", snapshotID, err))
+		}
+	}
+
+	switch snapshotType {
+	case common.DiskImageType:
+		err = gceCS.CloudProvider.DeleteImage(ctx, key.Name)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete image error: %v", err))
+		}
+	case common.DiskInstantSnapshotType:
+		err = gceCS.CloudProvider.DeleteInstantSnapshot(ctx, key)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete instant snapshot error: %v", err))
+		}
+	default:
+		err = gceCS.CloudProvider.DeleteSnapshot(ctx, key.Name)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete snapshot error: %v", err))
+		}
+		gceCS.snapshotUploads.forget(snapshotID)
 	}
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// getSnapshotSourceVolume returns the ID of the source volume of the
+// snapshot of snapshotType at key.
+func (gceCS *GCEControllerServer) getSnapshotSourceVolume(ctx context.Context, snapshotType string, key *meta.Key) (string, error) {
+	switch snapshotType {
+	case common.DiskImageType:
+		image, err := gceCS.CloudProvider.GetImage(ctx, key.Name)
+		if err != nil {
+			return "", err
+		}
+		return cleanSelfLink(image.SourceDisk), nil
+	case common.DiskInstantSnapshotType:
+		snapshot, err := gceCS.CloudProvider.GetInstantSnapshot(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		return cleanSelfLink(snapshot.SourceDisk), nil
+	default:
+		snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, key.Name)
+		if err != nil {
+			return "", err
+		}
+		return cleanSelfLink(snapshot.SourceDisk), nil
+	}
+}
+
 func (gceCS *GCEControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	// case 1: SnapshotId is not empty, return snapshots that match the snapshot id.
+	if gceCS.disableSnapshots {
+		return nil, status.Error(codes.Unimplemented, "ListSnapshots is disabled on this driver")
+	}
+	// https://cloud.google.com/compute/docs/reference/rest/v1/snapshots/list
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(
+			"ListSnapshots got max entries request %v. GCE only supports values between 0-500", req.MaxEntries))
+	}
+	// case 1: SnapshotId is not empty, return snapshots that match the snapshot id,
+	// and the source volume id if it is also set.
 	if len(req.GetSnapshotId()) != 0 {
-		return gceCS.getSnapshotByID(ctx, req.GetSnapshotId())
+		resp, err := gceCS.getSnapshotByID(ctx, req.GetSnapshotId())
+		if err != nil {
+			return nil, err
+		}
+		if sourceVolumeID := req.GetSourceVolumeId(); len(sourceVolumeID) != 0 {
+			for _, e := range resp.GetEntries() {
+				if e.GetSnapshot().GetSourceVolumeId() != sourceVolumeID {
+					return &csi.ListSnapshotsResponse{}, nil
+				}
+			}
+		}
+		return resp, nil
 	}
 
 	// case 2: no SnapshotId is set, so we return all the snapshots that satify the reqeust.
@@ -700,8 +1429,17 @@ func (gceCS *GCEControllerServer) ListSnapshots(ctx context.Context, req *csi.Li
 }
 
 func (gceCS *GCEControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	volumeID := req.GetVolumeId()
-	if len(volumeID) == 0 {
+	start := time.Now()
+	resp, err := gceCS.executeControllerExpandVolume(ctx, req)
+	return resp, gceCS.opHistory.record(historyName(req.GetVolumeId()), historyOperationExpand, "", start, err)
+}
+
+func (gceCS *GCEControllerServer) executeControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if gceCS.disableExpansion {
+		return nil, status.Error(codes.Unimplemented, "ControllerExpandVolume is disabled on this driver")
+	}
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume volume ID must be provided")
 	}
 	capacityRange := req.GetCapacityRange()
@@ -715,6 +1453,46 @@ func (gceCS *GCEControllerServer) ControllerExpandVolume(ctx context.Context, re
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("ControllerExpandVolume Volume ID is invalid: %v", err))
 	}
 
+	volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, volKey)
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "ControllerExpandVolume could not find volume with ID %v: %v", volumeID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume error repairing underspecified volume key: %v", err)
+	}
+
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("ControllerExpandVolume could not find disk %v: %v", volKey.String(), err))
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ControllerExpandVolume unknown get disk error: %v", err))
+	}
+	if r, ok := diskTypeIOPSRanges[disk.GetPDType()]; ok && r.maxPerGb != 0 {
+		// Only the alpha API reports the provisioned IOPS that the new size
+		// is checked against.
+		disk, err = gceCS.CloudProvider.GetDisk(ctx, volKey, gce.GCEAPIVersionAlpha)
+		if err != nil {
+			return nil, status.Error(codeForGCEError(err), fmt.Sprintf("ControllerExpandVolume unknown get disk error: %v", err))
+		}
+	}
+	if err := validateExpansion(disk, reqBytes, capacityRange.GetLimitBytes()); err != nil {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("ControllerExpandVolume cannot resize disk %v: %v", volKey.String(), err))
+	}
+	if currentGb := disk.GetSizeGb(); common.BytesToGbRoundUp(reqBytes) <= currentGb {
+		// The disk already has the requested capacity, and the CSI spec
+		// asks for success with the current capacity rather than an error
+		// when a smaller one is requested.
+		klog.V(4).Infof("ControllerExpandVolume found disk %v already at %vGB, which satisfies the request for %v bytes", volKey, currentGb, reqBytes)
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         common.GbToBytes(currentGb),
+			NodeExpansionRequired: true,
+		}, nil
+	}
+	if err := gceCS.expansionPolicy.Check(disk.GetPDType(), common.BytesToGbRoundUp(reqBytes)); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("ControllerExpandVolume cannot resize disk %v: %v", volKey.String(), err))
+	}
+
 	resizedGb, err := gceCS.CloudProvider.ResizeDisk(ctx, volKey, reqBytes)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ControllerExpandVolume failed to resize disk: %v", err))
@@ -727,30 +1505,110 @@ func (gceCS *GCEControllerServer) ControllerExpandVolume(ctx context.Context, re
 	}, nil
 }
 
+// Page tokens of ListSnapshots start with the prefix of the kind of snapshot
+// they continue listing. PD snapshots are listed first, with the page tokens
+// of GCE, then images, then instant snapshots.
+const (
+	imagesPageTokenPrefix           = "images:"
+	instantSnapshotsPageTokenPrefix = "instantSnapshots:"
+)
+
 func (gceCS *GCEControllerServer) getSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	var snapshots []*compute.Snapshot
-	var nextToken string
-	var err error
+	var filter string
+	// Instant snapshots can only be listed by zone or region, so they are
+	// only listed for a source volume.
+	var sourceVolKey *meta.Key
 	if len(req.GetSourceVolumeId()) != 0 {
-		snapshots, nextToken, err = gceCS.CloudProvider.ListSnapshots(ctx, fmt.Sprintf("sourceDisk eq .*%s$", req.SourceVolumeId), int64(req.MaxEntries), req.StartingToken)
-	} else {
-		snapshots, nextToken, err = gceCS.CloudProvider.ListSnapshots(ctx, "", int64(req.MaxEntries), req.StartingToken)
-	}
-	if err != nil {
-		if gce.IsGCEError(err, "invalid") {
-			return nil, status.Error(codes.Aborted, fmt.Sprintf("Invalid error: %v", err))
+		filter = fmt.Sprintf("sourceDisk eq .*%s$", req.SourceVolumeId)
+		if key, err := common.VolumeIDToKey(req.GetSourceVolumeId()); err == nil {
+			sourceVolKey = key
 		}
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
 	}
+	maxEntries := int64(req.MaxEntries)
+	if maxEntries > 500 {
+		klog.Warningf("ListSnapshots requested max entries of %v, GCE only supports values <=500 so defaulting value back to 500", maxEntries)
+		maxEntries = 500
+	}
+	pageToken := req.StartingToken
 	entries := []*csi.ListSnapshotsResponse_Entry{}
 
+	if !strings.HasPrefix(pageToken, imagesPageTokenPrefix) && !strings.HasPrefix(pageToken, instantSnapshotsPageTokenPrefix) {
+		snapshots, nextToken, err := gceCS.CloudProvider.ListSnapshots(ctx, filter, maxEntries, pageToken)
+		if err != nil {
+			return nil, listSnapshotsError(err)
+		}
+		for _, snapshot := range snapshots {
+			gceCS.snapshotUploads.observe(snapshot)
+			entry, err := generateSnapshotEntry(snapshot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate snapshot entry: %v", err)
+			}
+			entries = append(entries, entry)
+		}
+		if nextToken != "" {
+			return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+		}
+		if maxEntries > 0 && int64(len(entries)) >= maxEntries {
+			return &csi.ListSnapshotsResponse{Entries: entries, NextToken: imagesPageTokenPrefix}, nil
+		}
+		pageToken = imagesPageTokenPrefix
+	}
+
+	if strings.HasPrefix(pageToken, imagesPageTokenPrefix) {
+		limit := maxEntries
+		if maxEntries > 0 {
+			limit -= int64(len(entries))
+		}
+		images, nextToken, err := gceCS.CloudProvider.ListImages(ctx, filter, limit, strings.TrimPrefix(pageToken, imagesPageTokenPrefix))
+		if err != nil {
+			return nil, listSnapshotsError(err)
+		}
+		for _, image := range images {
+			if !gce.IsImageCreatedByDriver(image) {
+				// Snapshots are only listed among the images the
+				// driver created, not the OS and other images of the
+				// project.
+				continue
+			}
+			entry, err := generateImageEntry(image)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate image entry: %v", err)
+			}
+			entries = append(entries, entry)
+		}
+		if nextToken != "" {
+			return &csi.ListSnapshotsResponse{Entries: entries, NextToken: imagesPageTokenPrefix + nextToken}, nil
+		}
+		if sourceVolKey == nil {
+			return &csi.ListSnapshotsResponse{Entries: entries}, nil
+		}
+		if maxEntries > 0 && int64(len(entries)) >= maxEntries {
+			return &csi.ListSnapshotsResponse{Entries: entries, NextToken: instantSnapshotsPageTokenPrefix}, nil
+		}
+		pageToken = instantSnapshotsPageTokenPrefix
+	}
+
+	if sourceVolKey == nil {
+		return &csi.ListSnapshotsResponse{Entries: entries}, nil
+	}
+	limit := maxEntries
+	if maxEntries > 0 {
+		limit -= int64(len(entries))
+	}
+	snapshots, nextToken, err := gceCS.CloudProvider.ListInstantSnapshots(ctx, sourceVolKey, limit, strings.TrimPrefix(pageToken, instantSnapshotsPageTokenPrefix))
+	if err != nil {
+		return nil, listSnapshotsError(err)
+	}
 	for _, snapshot := range snapshots {
-		entry, err := generateSnapshotEntry(snapshot)
+		entry, err := generateInstantSnapshotEntry(snapshot)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate snapshot entry: %v", err)
+			return nil, fmt.Errorf("failed to generate instant snapshot entry: %v", err)
 		}
 		entries = append(entries, entry)
 	}
+	if nextToken != "" {
+		nextToken = instantSnapshotsPageTokenPrefix + nextToken
+	}
 	listSnapshotResp := &csi.ListSnapshotsResponse{
 		Entries:   entries,
 		NextToken: nextToken,
@@ -758,31 +1616,68 @@ func (gceCS *GCEControllerServer) getSnapshots(ctx context.Context, req *csi.Lis
 	return listSnapshotResp, nil
 }
 
+func listSnapshotsError(err error) error {
+	if gce.IsGCEError(err, "invalid") {
+		return status.Error(codes.Aborted, fmt.Sprintf("Invalid error: %v", err))
+	}
+	return status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
+}
+
 func (gceCS *GCEControllerServer) getSnapshotByID(ctx context.Context, snapshotID string) (*csi.ListSnapshotsResponse, error) {
-	key, err := common.SnapshotIDToKey(snapshotID)
+	snapshotType, key, err := common.SnapshotIDToKey(snapshotID)
 	if err != nil {
 		// Cannot get snapshot ID from the passing request
 		klog.Warningf("invalid snapshot id format %s", snapshotID)
 		return &csi.ListSnapshotsResponse{}, nil
 	}
 
-	snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, key)
-	if err != nil {
-		if gce.IsGCEError(err, "notFound") {
-			// return empty list if no snapshot is found
-			return &csi.ListSnapshotsResponse{}, nil
+	var e *csi.ListSnapshotsResponse_Entry
+	switch snapshotType {
+	case common.DiskImageType:
+		image, err := gceCS.CloudProvider.GetImage(ctx, key.Name)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				// return empty list if no image is found
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
+		}
+		e, err = generateImageEntry(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate image entry: %v", err)
+		}
+	case common.DiskInstantSnapshotType:
+		snapshot, err := gceCS.CloudProvider.GetInstantSnapshot(ctx, key)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				// return empty list if no instant snapshot is found
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
+		}
+		e, err = generateInstantSnapshotEntry(snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate instant snapshot entry: %v", err)
+		}
+	default:
+		snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, key.Name)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				// return empty list if no snapshot is found
+				gceCS.snapshotUploads.forget(snapshotID)
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
+		}
+		gceCS.snapshotUploads.observe(snapshot)
+		e, err = generateSnapshotEntry(snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate snapshot entry: %v", err)
 		}
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
-	}
-	e, err := generateSnapshotEntry(snapshot)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate snapshot entry: %v", err)
 	}
 
-	entries := []*csi.ListSnapshotsResponse_Entry{e}
-	//entries[0] = entry
 	listSnapshotResp := &csi.ListSnapshotsResponse{
-		Entries: entries,
+		Entries: []*csi.ListSnapshotsResponse_Entry{e},
 	}
 	return listSnapshotResp, nil
 }
@@ -812,6 +1707,52 @@ func generateSnapshotEntry(snapshot *compute.Snapshot) (*csi.ListSnapshotsRespon
 	return entry, nil
 }
 
+func generateImageEntry(image *compute.Image) (*csi.ListSnapshotsResponse_Entry, error) {
+	t, _ := time.Parse(time.RFC3339, image.CreationTimestamp)
+
+	tp, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to covert creation timestamp: %v", err)
+	}
+
+	// As for snapshots, a FAILED image is listed as not ready.
+	ready, _ := isCSISnapshotReady(image.Status)
+
+	entry := &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      common.GbToBytes(image.DiskSizeGb),
+			SnapshotId:     cleanSelfLink(image.SelfLink),
+			SourceVolumeId: cleanSelfLink(image.SourceDisk),
+			CreationTime:   tp,
+			ReadyToUse:     ready,
+		},
+	}
+	return entry, nil
+}
+
+func generateInstantSnapshotEntry(snapshot *computealpha.InstantSnapshot) (*csi.ListSnapshotsResponse_Entry, error) {
+	t, _ := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+
+	tp, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to covert creation timestamp: %v", err)
+	}
+
+	// As for snapshots, a FAILED instant snapshot is listed as not ready.
+	ready, _ := isCSISnapshotReady(snapshot.Status)
+
+	entry := &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      common.GbToBytes(snapshot.DiskSizeGb),
+			SnapshotId:     cleanSelfLink(snapshot.SelfLink),
+			SourceVolumeId: cleanSelfLink(snapshot.SourceDisk),
+			CreationTime:   tp,
+			ReadyToUse:     ready,
+		},
+	}
+	return entry, nil
+}
+
 func getRequestCapacity(capRange *csi.CapacityRange) (int64, error) {
 	var capBytes int64
 	// Default case where nothing is set
@@ -845,6 +1786,238 @@ func getRequestCapacity(capRange *csi.CapacityRange) (int64, error) {
 	return capBytes, nil
 }
 
+// validateProvisionedPerformance checks that the IOPS in params, if set, are
+// supported by the disk type and that a disk of sizeGb may be created with
+// them. Disks restored from snapshots are checked the
+// same way, as they get the performance of the request rather than that of
+// the snapshot's source disk.
+func validateProvisionedPerformance(params common.DiskParameters, sizeGb int64) error {
+	if params.ProvisionedIOPSOnCreate == 0 {
+		return nil
+	}
+	diskType := params.DiskType
+	if s, ok := diskTypeSizeRangesGb[diskType]; ok && (sizeGb < s.min || sizeGb > s.max) {
+		return fmt.Errorf("size %vGB is outside the range %vGB to %vGB supported by disk type %s", sizeGb, s.min, s.max, diskType)
+	}
+	return validatePerformanceRange(diskTypeIOPSRanges, diskType, common.ParameterKeyProvisionedIOPS, params.ProvisionedIOPSOnCreate, sizeGb)
+}
+
+// validatePerformanceRange checks value, if set, against the range for
+// diskType in ranges. key names the parameter value came from.
+func validatePerformanceRange(ranges map[string]diskPerformanceRange, diskType, key string, value, sizeGb int64) error {
+	if value == 0 {
+		return nil
+	}
+	r, ok := ranges[diskType]
+	if !ok {
+		return fmt.Errorf("disk type %q does not support %s", diskType, key)
+	}
+	if value < r.min || value > r.max {
+		return fmt.Errorf("%s %v is outside the range %v to %v supported by disk type %s", key, value, r.min, r.max, diskType)
+	}
+	if r.maxPerGb != 0 && value > r.maxPerGb*sizeGb {
+		return fmt.Errorf("%s %v exceeds the maximum of %v per GB for a %vGB disk of type %s", key, value, r.maxPerGb, sizeGb, diskType)
+	}
+	return nil
+}
+
+// validateExpansion checks that resizing disk to reqBytes, bounded by
+// limitBytes if non-zero, stays within the limits of its type, including the
+// IOPS per GB limit of hyperdisks. A request no larger than the disk leaves
+// it as is and only has its limit checked.
+func validateExpansion(disk *gce.CloudDisk, reqBytes, limitBytes int64) error {
+	currentGb := disk.GetSizeGb()
+	requestGb := common.BytesToGbRoundUp(reqBytes)
+	if limitBytes != 0 && limitBytes < common.GbToBytes(currentGb) {
+		return fmt.Errorf("limit of %v bytes is smaller than the current size %vGB and disks cannot be shrunk", limitBytes, currentGb)
+	}
+	if requestGb <= currentGb {
+		// The disk is not resized.
+		return nil
+	}
+	diskType := disk.GetPDType()
+	if r, ok := diskTypeSizeRangesGb[diskType]; ok {
+		if requestGb < r.min || requestGb > r.max {
+			return fmt.Errorf("requested size %vGB is outside the range %vGB to %vGB supported by disk type %s", requestGb, r.min, r.max, diskType)
+		}
+	} else if reqBytes > MaxVolumeSizeInBytes {
+		return fmt.Errorf("requested size %v bytes exceeds the maximum of %v bytes supported by disk type %s", reqBytes, MaxVolumeSizeInBytes, diskType)
+	}
+	if r, ok := diskTypeIOPSRanges[diskType]; ok && r.maxPerGb != 0 {
+		if iops := disk.GetProvisionedIops(); iops > r.maxPerGb*requestGb {
+			minGb := (iops + r.maxPerGb - 1) / r.maxPerGb
+			return fmt.Errorf("provisioned IOPS %v of the disk need a size of at least %vGB, as disk type %s supports at most %v IOPS per GB, but %vGB was requested", iops, minGb, diskType, r.maxPerGb, requestGb)
+		}
+	}
+	return nil
+}
+
+// kmsPermissionDeniedError returns the error for a disk insert that failed
+// because Compute Engine may not use kmsKey, naming the role it is missing.
+func kmsPermissionDeniedError(kmsKey string, err error) error {
+	return status.Error(codes.PermissionDenied, fmt.Sprintf("CreateVolume cannot encrypt the disk with KMS key %s, the Compute Engine service agent of the project needs the roles/cloudkms.cryptoKeyEncrypterDecrypter role on the key: %v", kmsKey, err))
+}
+
+// codeForGCEError maps the GCE errors that callers can act on to a gRPC code,
+// defaulting to Internal.
+func codeForGCEError(err error) codes.Code {
+	switch {
+	case gce.IsGCENotFoundError(err):
+		return codes.NotFound
+	case gce.IsGCEQuotaError(err):
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
+
+// statusError is a gRPC status error that keeps the GCE error it reports, so
+// that metrics can classify failures by the googleapi error behind them.
+type statusError struct {
+	status *status.Status
+	cause  error
+}
+
+func (e *statusError) Error() string              { return e.status.Err().Error() }
+func (e *statusError) GRPCStatus() *status.Status { return e.status }
+func (e *statusError) Unwrap() error              { return e.cause }
+
+// gceStatusError returns a gRPC error with code and msg that unwraps to the
+// GCE error cause.
+func gceStatusError(code codes.Code, msg string, cause error) error {
+	return &statusError{status: status.New(code, msg), cause: cause}
+}
+
+// otherDiskUsers returns the instances other than the named one that disk is
+// attached to.
+func otherDiskUsers(disk *gce.CloudDisk, instanceZone, instanceName string) []string {
+	users := []string{}
+	suffix := fmt.Sprintf("zones/%s/instances/%s", instanceZone, instanceName)
+	for _, user := range disk.GetUsers() {
+		if !strings.HasSuffix(user, suffix) {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// acquireAttachLock waits for the attach lock of volumeID, returning Aborted
+// if the request is cancelled or times out first.
+func (gceCS *GCEControllerServer) acquireAttachLock(ctx context.Context, volumeID string) error {
+	if gceCS.attachLocks.TryAcquire(volumeID) {
+		return nil
+	}
+	klog.V(4).Infof("Waiting for another attach or detach of volume %s to finish", volumeID)
+	if err := gceCS.attachLocks.Acquire(ctx, volumeID); err != nil {
+		return status.Errorf(codes.Aborted, "gave up waiting for another attach or detach of volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// getInstance returns the instance and whether it was served from the
+// instance cache, if that is enabled.
+func (gceCS *GCEControllerServer) getInstance(ctx context.Context, zone, name string) (*compute.Instance, bool, error) {
+	if gceCS.instanceCache == nil {
+		instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, zone, name)
+		return instance, false, err
+	}
+	return gceCS.instanceCache.get(ctx, zone, name)
+}
+
+// invalidateInstance drops the cached instance after the controller changed
+// its disks.
+func (gceCS *GCEControllerServer) invalidateInstance(zone, name string) {
+	if gceCS.instanceCache != nil {
+		gceCS.instanceCache.invalidate(zone, name)
+	}
+}
+
+// detachPauses remembers when a detach pause was first seen on each instance,
+// so that renewing the metadata cannot extend a pause past maxDetachPause.
+type detachPauses struct {
+	mux       sync.Mutex
+	firstSeen map[string]time.Time
+}
+
+// observe returns when the pause on the instance with key was first seen,
+// recording now if it had not been seen.
+func (p *detachPauses) observe(key string, now time.Time) time.Time {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if first, ok := p.firstSeen[key]; ok {
+		return first
+	}
+	if p.firstSeen == nil {
+		p.firstSeen = map[string]time.Time{}
+	}
+	p.firstSeen[key] = now
+	return now
+}
+
+// clear forgets the pause on the instance with key, so that the next pause
+// seen on it gets a full maxDetachPause.
+func (p *detachPauses) clear(key string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	delete(p.firstSeen, key)
+}
+
+// detachPausedUntil returns the time until which detaches from instance in
+// zone are paused, or a zero time if they are not. A pause is honored for at
+// most maxDetachPause after the controller first sees it on the instance,
+// however often its metadata is renewed. Pauses that have expired, cannot be
+// parsed or end further than maxDetachPause ahead are ignored.
+func (gceCS *GCEControllerServer) detachPausedUntil(zone string, instance *compute.Instance) time.Time {
+	if gceCS.maxDetachPause == 0 {
+		return time.Time{}
+	}
+	key := zone + "/" + instance.Name
+	value := pauseDetachValue(instance)
+	if value == nil {
+		gceCS.detachPauses.clear(key)
+		return time.Time{}
+	}
+	until, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		klog.Warningf("Ignoring %s=%q on instance %v: %v", pauseDetachUntilKey, *value, instance.Name, err)
+		gceCS.detachPauses.clear(key)
+		return time.Time{}
+	}
+	now := time.Now()
+	if !until.After(now) {
+		gceCS.detachPauses.clear(key)
+		return time.Time{}
+	}
+	if until.After(now.Add(gceCS.maxDetachPause)) {
+		klog.Warningf("Ignoring %s=%q on instance %v: pause exceeds the maximum of %v", pauseDetachUntilKey, *value, instance.Name, gceCS.maxDetachPause)
+		return time.Time{}
+	}
+	first := gceCS.detachPauses.observe(key, now)
+	deadline := first.Add(gceCS.maxDetachPause)
+	if !deadline.After(now) {
+		klog.Warningf("Ignoring %s=%q on instance %v: detaches have been paused since %v, longer than the maximum of %v", pauseDetachUntilKey, *value, instance.Name, first.Format(time.RFC3339), gceCS.maxDetachPause)
+		return time.Time{}
+	}
+	if until.After(deadline) {
+		return deadline
+	}
+	return until
+}
+
+// pauseDetachValue returns the pauseDetachUntilKey metadata value of
+// instance, or nil if it has none.
+func pauseDetachValue(instance *compute.Instance) *string {
+	if instance.Metadata == nil {
+		return nil
+	}
+	for _, item := range instance.Metadata.Items {
+		if item != nil && item.Key == pauseDetachUntilKey && item.Value != nil {
+			return item.Value
+		}
+	}
+	return nil
+}
+
 func diskIsAttached(deviceName string, instance *compute.Instance) bool {
 	for _, disk := range instance.Disks {
 		if disk.DeviceName == deviceName {
@@ -855,13 +2028,16 @@ func diskIsAttached(deviceName string, instance *compute.Instance) bool {
 	return false
 }
 
-func diskIsAttachedAndCompatible(deviceName string, instance *compute.Instance, volumeCapability *csi.VolumeCapability, readWrite string) (bool, error) {
+func diskIsAttachedAndCompatible(deviceName string, instance *compute.Instance, volumeCapability *csi.VolumeCapability, readWrite, diskInterface string) (bool, error) {
 	for _, disk := range instance.Disks {
 		if disk.DeviceName == deviceName {
 			// Disk is attached to node
 			if disk.Mode != readWrite {
 				return true, fmt.Errorf("disk mode does not match. Got %v. Want %v", disk.Mode, readWrite)
 			}
+			if diskInterface != "" && disk.Interface != "" && disk.Interface != diskInterface {
+				return true, fmt.Errorf("disk interface does not match. Got %v. Want %v", disk.Interface, diskInterface)
+			}
 			// TODO(#253): Check volume capability matches for ALREADY_EXISTS
 			return true, nil
 		}
@@ -869,6 +2045,50 @@ func diskIsAttachedAndCompatible(deviceName string, instance *compute.Instance,
 	return false, nil
 }
 
+// validateInstanceDiskInterface checks that instance can attach a persistent
+// disk over diskInterface. Some machine families only support NVMe, and an
+// instance attaches all of its persistent disks over the same interface, so
+// the interface of the disks already attached is authoritative.
+func validateInstanceDiskInterface(instance *compute.Instance, diskInterface string) error {
+	if diskInterface == "" {
+		return nil
+	}
+	if diskInterface == common.DiskInterfaceSCSI {
+		machineType := path.Base(instance.MachineType)
+		family := strings.SplitN(machineType, "-", 2)[0]
+		if nvmeOnlyMachineFamilies.Has(family) {
+			return fmt.Errorf("machine type %s only supports %s disks", machineType, common.DiskInterfaceNVME)
+		}
+	}
+	for _, disk := range instance.Disks {
+		if disk.Type == attachableDiskTypePersistent && disk.Interface != "" && disk.Interface != diskInterface {
+			return fmt.Errorf("persistent disk %s is attached over %s, all persistent disks of an instance use the same interface", disk.DeviceName, disk.Interface)
+		}
+	}
+	return nil
+}
+
+// validateInstanceDiskType checks that the machine type of instance can
+// attach a disk of diskType. Only hyperdisk types and the machine families
+// that require them are checked.
+func validateInstanceDiskType(instance *compute.Instance, diskType string) error {
+	if diskType == "" {
+		return nil
+	}
+	machineType := path.Base(instance.MachineType)
+	family := strings.SplitN(machineType, "-", 2)[0]
+	if families, ok := hyperdiskMachineFamilies[diskType]; ok {
+		if !families.Has(family) {
+			return fmt.Errorf("machine type %s does not support disk type %s", machineType, diskType)
+		}
+		return nil
+	}
+	if hyperdiskOnlyMachineFamilies.Has(family) {
+		return fmt.Errorf("machine type %s only supports hyperdisk disk types, not %s", machineType, diskType)
+	}
+	return nil
+}
+
 func pickZonesFromTopology(top *csi.TopologyRequirement, numZones int) ([]string, error) {
 	reqZones, err := getZonesFromTopology(top.GetRequisite())
 	if err != nil {
@@ -904,8 +2124,65 @@ func pickZonesFromTopology(top *csi.TopologyRequirement, numZones int) ([]string
 	}
 }
 
+// pickReplicaZonesFromTopology picks the replica zones of a regional disk.
+// The first preferred zone, where the pod of a volume that waits for its
+// first consumer is scheduled, decides the region. The other replicas go to
+// the next preferred zones of that region, and only then to its requisite
+// zones, so the disk can be attached where the pods of the volume run.
+// Without preferred zones it picks like pickZonesFromTopology.
+func pickReplicaZonesFromTopology(top *csi.TopologyRequirement, numZones int) ([]string, error) {
+	prefZones, err := getZonesFromTopology(top.GetPreferred())
+	if err != nil {
+		return nil, fmt.Errorf("could not get zones from preferred topology: %v", err)
+	}
+	if len(prefZones) == 0 {
+		return pickZonesFromTopology(top, numZones)
+	}
+	reqZones, err := getZonesFromTopology(top.GetRequisite())
+	if err != nil {
+		return nil, fmt.Errorf("could not get zones from requisite topology: %v", err)
+	}
+	region, err := common.GetRegionFromZones(prefZones[:1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get region of preferred zone %v: %v", prefZones[0], err)
+	}
+	inRegion := func(zone string) bool {
+		zoneRegion, err := common.GetRegionFromZones([]string{zone})
+		return err == nil && zoneRegion == region
+	}
+
+	zones := []string{}
+	for _, zone := range prefZones {
+		if len(zones) < numZones && inRegion(zone) {
+			zones = append(zones, zone)
+		}
+	}
+	remainingZones := sets.NewString()
+	for _, zone := range reqZones {
+		if inRegion(zone) {
+			remainingZones.Insert(zone)
+		}
+	}
+	remainingZones = remainingZones.Difference(sets.NewString(zones...))
+	remainingNumZones := numZones - len(zones)
+	if remainingZones.Len() < remainingNumZones {
+		return nil, fmt.Errorf("need %v zones in region %v from topology, only got %v", numZones, region, len(zones)+remainingZones.Len())
+	}
+	if remainingNumZones > 0 {
+		nSlice, err := pickRandAndConsecutive(remainingZones.List(), remainingNumZones)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, nSlice...)
+	}
+	return zones, nil
+}
+
 func getZonesFromTopology(topList []*csi.Topology) ([]string, error) {
 	zones := []string{}
+	// Segments of nodes in the same zone that mount different filesystems
+	// name the zone more than once.
+	seen := sets.NewString()
 	for _, top := range topList {
 		if top.GetSegments() == nil {
 			return nil, fmt.Errorf("preferred topologies specified but no segments")
@@ -916,6 +2193,10 @@ func getZonesFromTopology(topList []*csi.Topology) ([]string, error) {
 		if err != nil {
 			return nil, fmt.Errorf("could not get zone from preferred topology: %v", err)
 		}
+		if seen.Has(zone) {
+			continue
+		}
+		seen.Insert(zone)
 		zones = append(zones, zone)
 	}
 	return zones, nil
@@ -927,6 +2208,11 @@ func getZoneFromSegment(seg map[string]string) (string, error) {
 		switch k {
 		case common.TopologyKeyZone:
 			zone = v
+		case common.TopologyKeyRegion:
+			// The zone determines the region, so the region key, which
+			// nodes only publish with --report-region-topology, is ignored.
+		case common.TopologyKeyFilesystems:
+			// Filesystems are checked by validateFilesystemTopology.
 		default:
 			return "", fmt.Errorf("topology segment has unknown key %v", k)
 		}
@@ -937,11 +2223,51 @@ func getZoneFromSegment(seg map[string]string) (string, error) {
 	return zone, nil
 }
 
+// expandRegionTopologies replaces each topology segment that names only a
+// region with one segment per zone in that region.
+func expandRegionTopologies(ctx context.Context, gceCS *GCEControllerServer, topList []*csi.Topology) ([]*csi.Topology, error) {
+	expanded := []*csi.Topology{}
+	for _, top := range topList {
+		seg := top.GetSegments()
+		region, hasRegion := seg[common.TopologyKeyRegion]
+		_, hasZone := seg[common.TopologyKeyZone]
+		if !hasRegion || hasZone {
+			expanded = append(expanded, top)
+			continue
+		}
+		zones, err := gceCS.CloudProvider.ListZones(ctx, region)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list zones in region %v: %v", region, err)
+		}
+		for _, zone := range zones {
+			zoneSeg := map[string]string{common.TopologyKeyZone: zone}
+			for k, v := range seg {
+				zoneSeg[k] = v
+			}
+			expanded = append(expanded, &csi.Topology{Segments: zoneSeg})
+		}
+	}
+	return expanded, nil
+}
+
 func pickZones(ctx context.Context, gceCS *GCEControllerServer, top *csi.TopologyRequirement, numZones int) ([]string, error) {
 	var zones []string
 	var err error
 	if top != nil {
-		zones, err = pickZonesFromTopology(top, numZones)
+		expandedTop := &csi.TopologyRequirement{}
+		expandedTop.Requisite, err = expandRegionTopologies(ctx, gceCS, top.GetRequisite())
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand region topology: %v", err)
+		}
+		expandedTop.Preferred, err = expandRegionTopologies(ctx, gceCS, top.GetPreferred())
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand region topology: %v", err)
+		}
+		if numZones > 1 {
+			zones, err = pickReplicaZonesFromTopology(expandedTop, numZones)
+		} else {
+			zones, err = pickZonesFromTopology(expandedTop, numZones)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to pick zones from topology: %v", err)
 		}
@@ -979,19 +2305,66 @@ func getDefaultZonesInRegion(ctx context.Context, gceCS *GCEControllerServer, ex
 	return ret, nil
 }
 
-func generateCreateVolumeResponse(disk *gce.CloudDisk, zones []string) *csi.CreateVolumeResponse {
+func generateCreateVolumeResponse(disk *gce.CloudDisk, zones []string, params common.DiskParameters, vcs []*csi.VolumeCapability) *csi.CreateVolumeResponse {
 	tops := []*csi.Topology{}
 	for _, zone := range zones {
 		tops = append(tops, &csi.Topology{
 			Segments: map[string]string{common.TopologyKeyZone: zone},
 		})
 	}
+	volumeContext := map[string]string{}
+	if params.DiskInterface != "" {
+		// The interface is applied when the disk is attached, so it is
+		// carried to ControllerPublishVolume in the volume context.
+		volumeContext[common.VolumeAttributeDiskInterface] = params.DiskInterface
+	}
+	// Mount hardening, discard, trimming and UUID regeneration are applied
+	// by the node, so they are carried to NodeStageVolume and
+	// NodePublishVolume in the volume context.
+	if params.DisableMountHardening {
+		volumeContext[common.VolumeAttributeMountHardening] = "false"
+	}
+	if params.Discard != "" {
+		volumeContext[common.VolumeAttributeDiscard] = params.Discard
+	}
+	restored := disk.GetSnapshotId() != "" || disk.GetSourceImage() != ""
+	if params.TrimAfterRestore && restored {
+		volumeContext[common.VolumeAttributeTrimAfterRestore] = "true"
+	}
+	if params.RegenerateFSUUID && restored {
+		volumeContext[common.VolumeAttributeRegenerateFSUUID] = "true"
+	}
+	if params.ReadOnlyRestore {
+		// Attached and mounted read-only by ControllerPublishVolume,
+		// NodeStageVolume and NodePublishVolume.
+		volumeContext[common.VolumeAttributeReadOnly] = "true"
+	}
+	if params.PublishMetadata {
+		volumeContext[common.VolumeAttributePublishMetadata] = "true"
+		volumeContext[common.VolumeAttributeDiskType] = params.DiskType
+	}
+	if !params.NodeIOLimits.IsZero() {
+		// Applied by NodePublishVolume to the cgroup of each pod.
+		volumeContext[common.VolumeAttributeIOMax] = params.NodeIOLimits.String()
+	}
+	if params.ProvisionedIOPSOnCreate > 0 {
+		volumeContext[common.VolumeAttributeProvisionedIOPS] = strconv.FormatInt(params.ProvisionedIOPSOnCreate, 10)
+	}
+	if accessTypes := volumeAccessTypes(vcs); strings.Contains(accessTypes, ",") {
+		// The volume was created for both block and mount, so whichever
+		// it is staged as is a choice of the CO. Recorded so that
+		// ValidateVolumeCapabilities confirms the same access types.
+		volumeContext[common.VolumeAttributeAccessTypes] = accessTypes
+	}
+	if len(volumeContext) == 0 {
+		volumeContext = nil
+	}
 	realDiskSizeBytes := common.GbToBytes(disk.GetSizeGb())
 	createResp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			CapacityBytes:      realDiskSizeBytes,
 			VolumeId:           cleanSelfLink(disk.GetSelfLink()),
-			VolumeContext:      nil,
+			VolumeContext:      volumeContext,
 			AccessibleTopology: tops,
 		},
 	}
@@ -1006,16 +2379,300 @@ func generateCreateVolumeResponse(disk *gce.CloudDisk, zones []string) *csi.Crea
 		}
 		createResp.Volume.ContentSource = source
 	}
+	if sourceImage := disk.GetSourceImage(); sourceImage != "" {
+		// Images are snapshots of the images snapshot type.
+		createResp.Volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: cleanSelfLink(sourceImage),
+				},
+			},
+		}
+	}
+	if sourceDisk := disk.GetSourceDisk(); sourceDisk != "" {
+		createResp.Volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: cleanSelfLink(sourceDisk),
+				},
+			},
+		}
+	}
 	return createResp
 }
 
 func cleanSelfLink(selfLink string) string {
 	temp := strings.TrimPrefix(selfLink, gce.GCEComputeAPIEndpoint)
 	temp = strings.TrimPrefix(temp, gce.GCEComputeBetaAPIEndpoint)
-	return strings.TrimPrefix(temp, gce.GCEComputeAlphaAPIEndpoint)
+	temp = strings.TrimPrefix(temp, gce.GCEComputeAlphaAPIEndpoint)
+	// Links returned through a custom compute endpoint carry its host.
+	if strings.Contains(temp, "://") {
+		if i := strings.Index(temp, "/projects/"); i >= 0 {
+			return temp[i+1:]
+		}
+	}
+	return temp
 }
 
-func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, params common.DiskParameters, capacityRange *csi.CapacityRange, capBytes int64, snapshotID string, multiWriter bool) (*gce.CloudDisk, error) {
+// cleanupFailedRegionalDisk deletes the regional disk at volKey if it was left
+// half-created by a failed insert, so that a retry creates it again instead of
+// finding an unusable disk of the same name forever. Only disks created by
+// this driver and not in use are deleted, and the deletion is verified. It
+// must only be called once no insert of the disk is in flight. Returns true if
+// the disk was deleted. It runs on its own context, as the failed insert may
+// have used up the deadline of the request.
+func (gceCS *GCEControllerServer) cleanupFailedRegionalDisk(volKey *meta.Key, gceAPIVersion gce.GCEAPIVersion) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), regionalDiskCleanupTimeout)
+	defer cancel()
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gceAPIVersion)
+	if err != nil {
+		if !gce.IsGCENotFoundError(err) {
+			klog.Errorf("Failed to get regional disk %v to check for a failed insert: %v", volKey, err)
+		}
+		return false
+	}
+	if disk.GetStatus() != "FAILED" && len(disk.GetReplicaZones()) == 2 {
+		return false
+	}
+	if !gce.IsDiskCreatedByDriver(disk, gceCS.Driver.name) {
+		klog.Warningf("Regional disk %v is half-created but was not created by this driver, not deleting it", volKey)
+		return false
+	}
+	if users := disk.GetUsers(); len(users) > 0 {
+		klog.Warningf("Regional disk %v is half-created but in use by %v, not deleting it", volKey, users)
+		return false
+	}
+
+	klog.Warningf("Deleting half-created regional disk %v with status %s and replica zones %v", volKey, disk.GetStatus(), disk.GetReplicaZones())
+	if err := gceCS.CloudProvider.DeleteDisk(ctx, volKey); err != nil {
+		klog.Errorf("Failed to delete half-created regional disk %v: %v", volKey, err)
+		return false
+	}
+	if _, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gceAPIVersion); !gce.IsGCENotFoundError(err) {
+		klog.Errorf("Half-created regional disk %v still exists after delete: %v", volKey, err)
+		return false
+	}
+	klog.V(4).Infof("Deleted half-created regional disk %v", volKey)
+	return true
+}
+
+// waitForDiskInsert waits for a pending insert of the disk at volKey and
+// returns the disk once it is done.
+func (gceCS *GCEControllerServer) waitForDiskInsert(ctx context.Context, volKey *meta.Key, gceAPIVersion gce.GCEAPIVersion) (*gce.CloudDisk, error) {
+	klog.V(4).Infof("CreateVolume found disk %v being created, waiting for its insert", volKey)
+	waitErr := gceCS.CloudProvider.WaitForDiskInsert(ctx, volKey)
+	if waitErr != nil {
+		klog.Warningf("Pending insert of disk %v did not succeed: %v", volKey, waitErr)
+	}
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gceAPIVersion)
+	if err != nil {
+		if gce.IsGCEError(err, "notFound") {
+			return nil, status.Error(codes.Unavailable, fmt.Sprintf("CreateVolume pending insert of disk %v failed, it will be created on retry: %v", volKey, waitErr))
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume unknown get disk error after waiting for insert: %v", err))
+	}
+	return disk, nil
+}
+
+// getCloneSource returns the key and the disk of the source volume of a clone.
+func (gceCS *GCEControllerServer) getCloneSource(ctx context.Context, volumeID string) (*meta.Key, *gce.CloudDisk, error) {
+	volKey, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.NotFound, "CreateVolume source volume %s is invalid: %v", volumeID, err)
+	}
+	volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, volKey)
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return nil, nil, status.Errorf(codes.NotFound, "CreateVolume source volume %s does not exist", volumeID)
+		}
+		return nil, nil, status.Errorf(codes.Internal, "CreateVolume error repairing underspecified source volume key: %v", err)
+	}
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return nil, nil, status.Errorf(codes.NotFound, "CreateVolume source volume %s does not exist", volumeID)
+		}
+		return nil, nil, status.Errorf(codes.Internal, "CreateVolume failed to get source volume %s: %v", volumeID, err)
+	}
+	if disk.GetStatus() != "READY" {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "CreateVolume source volume %s is %s, it must be READY to be cloned", volumeID, disk.GetStatus())
+	}
+	return volKey, disk, nil
+}
+
+// validateCloneSource checks that a disk with params and capBytes may be
+// cloned from sourceDisk. GCE clones a disk only into a disk of the same
+// type and at least the same size, and a regional disk only into another
+// regional disk.
+func validateCloneSource(sourceDisk *gce.CloudDisk, sourceVolKey *meta.Key, params common.DiskParameters, capBytes int64) error {
+	if sourceVolKey.Type() == meta.Regional && params.ReplicationType != replicationTypeRegionalPD {
+		return fmt.Errorf("a regional disk can only be cloned into a regional disk, got replication type %s", params.ReplicationType)
+	}
+	sourceType := sourceDisk.GetPDType()
+	sourceType = sourceType[strings.LastIndex(sourceType, "/")+1:]
+	if sourceType != params.DiskType {
+		return fmt.Errorf("disk type %s does not match the source disk type %s", params.DiskType, sourceType)
+	}
+	if sizeGb := common.BytesToGbRoundUp(capBytes); sizeGb < sourceDisk.GetSizeGb() {
+		return fmt.Errorf("requested size %dGi is smaller than the source disk size %dGi", sizeGb, sourceDisk.GetSizeGb())
+	}
+	return nil
+}
+
+// validateInstantSnapshotRestore checks that a disk with params can be
+// restored from the instant snapshot at snapshotKey. Zonal instant snapshots
+// are restored to zonal disks and regional ones to regional disks.
+func validateInstantSnapshotRestore(snapshotKey *meta.Key, params common.DiskParameters) error {
+	switch snapshotKey.Type() {
+	case meta.Zonal:
+		if params.ReplicationType != replicationTypeNone {
+			return fmt.Errorf("zonal instant snapshots can only be restored with replication type %s", replicationTypeNone)
+		}
+	case meta.Regional:
+		if params.ReplicationType != replicationTypeRegionalPD {
+			return fmt.Errorf("regional instant snapshots can only be restored with replication type %s", replicationTypeRegionalPD)
+		}
+	default:
+		return fmt.Errorf("instant snapshot is neither zonal nor regional")
+	}
+	return nil
+}
+
+// pickCloneZones picks the zones of a clone of the disk at sourceVolKey. A
+// zonal clone is created in the zone of its source. A regional clone keeps
+// the replica zones of a regional source, or of a zonal source is replicated
+// to its zone and another zone of the region, preferably one that top
+// allows. top must allow at least one of the zones. sourceDisk is only read
+// for regional sources, and is nil when placing the restore of a zonal
+// instant snapshot.
+func pickCloneZones(ctx context.Context, gceCS *GCEControllerServer, sourceVolKey *meta.Key, sourceDisk *gce.CloudDisk, top *csi.TopologyRequirement, numZones int) ([]string, error) {
+	topZones, err := getTopologyZones(ctx, gceCS, top)
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []string
+	switch {
+	case sourceVolKey.Type() == meta.Regional:
+		zones = diskReplicaZones(sourceDisk)
+	case numZones == 1:
+		zones = []string{sourceVolKey.Zone}
+	default:
+		zones = []string{sourceVolKey.Zone}
+		region, err := common.GetRegionFromZones(zones)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region of source disk: %v", err)
+		}
+		for _, zone := range topZones {
+			if zoneRegion, err := common.GetRegionFromZones([]string{zone}); err == nil && zoneRegion == region && zone != sourceVolKey.Zone {
+				zones = append(zones, zone)
+				break
+			}
+		}
+		if len(zones) < numZones {
+			zones, err = getDefaultZonesInRegion(ctx, gceCS, zones, numZones)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get default %v zones in region: %v", numZones, err)
+			}
+		}
+	}
+	if len(zones) != numZones {
+		return nil, fmt.Errorf("source disk has zones %v, need %v zones", zones, numZones)
+	}
+	if top != nil && !sets.NewString(topZones...).HasAny(zones...) {
+		return nil, fmt.Errorf("source disk zones %v are not allowed by the topology requirement", zones)
+	}
+	return zones, nil
+}
+
+// pickPinnedReplicaZones checks the zones of the replica-zones parameter
+// against the source disk, which must have its zones among them, and the
+// topology requirement, which must allow one of them.
+func pickPinnedReplicaZones(ctx context.Context, gceCS *GCEControllerServer, replicaZones []string, sourceVolKey *meta.Key, sourceDisk *gce.CloudDisk, top *csi.TopologyRequirement) ([]string, error) {
+	if sourceDisk != nil {
+		sourceZones := []string{sourceVolKey.Zone}
+		if sourceVolKey.Type() == meta.Regional {
+			sourceZones = diskReplicaZones(sourceDisk)
+		}
+		if !sets.NewString(replicaZones...).HasAll(sourceZones...) {
+			return nil, fmt.Errorf("%s %v do not include the zones %v of the source disk", common.ParameterKeyReplicaZones, replicaZones, sourceZones)
+		}
+	}
+	if top == nil {
+		return replicaZones, nil
+	}
+	topZones, err := getTopologyZones(ctx, gceCS, top)
+	if err != nil {
+		return nil, err
+	}
+	if !sets.NewString(topZones...).HasAny(replicaZones...) {
+		return nil, fmt.Errorf("%s %v are not allowed by the topology requirement, which allows %v", common.ParameterKeyReplicaZones, replicaZones, topZones)
+	}
+	return replicaZones, nil
+}
+
+// validateInstanceReplicaZone returns an error if disk is regional and zone
+// is not one of its replica zones. GCE only rejects such an attach after the
+// attach operation is waited on, with an error that does not name the zones.
+func validateInstanceReplicaZone(disk *gce.CloudDisk, zone string) error {
+	replicaZones := diskReplicaZones(disk)
+	if len(replicaZones) == 0 || sets.NewString(replicaZones...).Has(zone) {
+		return nil
+	}
+	return fmt.Errorf("instance zone %s is not a replica zone of the regional disk, it can only be attached to instances in zones %v", zone, replicaZones)
+}
+
+// diskReplicaZones returns the names of the replica zones of disk, which
+// GCE reports as zone URLs.
+func diskReplicaZones(disk *gce.CloudDisk) []string {
+	var zones []string
+	for _, replicaZone := range disk.GetReplicaZones() {
+		zones = append(zones, replicaZone[strings.LastIndex(replicaZone, "/")+1:])
+	}
+	return zones
+}
+
+// getTopologyZones returns the zones of the preferred and requisite
+// topologies of top, with region topologies expanded to their zones.
+func getTopologyZones(ctx context.Context, gceCS *GCEControllerServer, top *csi.TopologyRequirement) ([]string, error) {
+	var topZones []string
+	if top == nil {
+		return topZones, nil
+	}
+	for _, topList := range [][]*csi.Topology{top.GetPreferred(), top.GetRequisite()} {
+		expanded, err := expandRegionTopologies(ctx, gceCS, topList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand region topology: %v", err)
+		}
+		listZones, err := getZonesFromTopology(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("could not get zones from topology: %v", err)
+		}
+		topZones = append(topZones, listZones...)
+	}
+	return topZones, nil
+}
+
+// waitForCloneReady polls the clone at volKey until it is no longer being
+// created. A clone is only usable once READY, and reports CREATING while its
+// data is copied from the source, which may outlast its insert operation.
+func waitForCloneReady(ctx context.Context, cloudProvider gce.GCECompute, disk *gce.CloudDisk, volKey *meta.Key, gceAPIVersion gce.GCEAPIVersion) (*gce.CloudDisk, error) {
+	err := backoff.Retry(ctx, cloneReadyBackoff, func() (bool, error) {
+		if disk.GetStatus() != "CREATING" && disk.GetStatus() != "RESTORING" {
+			return true, nil
+		}
+		klog.V(4).Infof("Clone %v is %s, waiting for it to become READY", volKey, disk.GetStatus())
+		var err error
+		disk, err = cloudProvider.GetDisk(ctx, volKey, gceAPIVersion)
+		return err != nil, err
+	})
+	if err != nil && err != wait.ErrWaitTimeout {
+		return nil, err
+	}
+	return disk, nil
+}
+
+func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, params common.DiskParameters, capacityRange *csi.CapacityRange, capBytes int64, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) (*gce.CloudDisk, error) {
 	region, err := common.GetRegionFromZones(zones)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get region from zones: %v", err)
@@ -1027,7 +2684,7 @@ func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name
 			fullyQualifiedReplicaZones, cloudProvider.GetReplicaZoneURI(replicaZone))
 	}
 
-	err = cloudProvider.InsertDisk(ctx, meta.RegionalKey(name, region), params, capBytes, capacityRange, fullyQualifiedReplicaZones, snapshotID, multiWriter)
+	err = cloudProvider.InsertDisk(ctx, meta.RegionalKey(name, region), params, capBytes, capacityRange, fullyQualifiedReplicaZones, snapshotID, volumeContentSourceVolumeID, multiWriter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert regional disk: %v", err)
 	}
@@ -1037,19 +2694,19 @@ func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name
 		gceAPIVersion = gce.GCEAPIVersionBeta
 	}
 
-	disk, err := cloudProvider.GetDisk(ctx, meta.RegionalKey(name, region), gceAPIVersion)
+	disk, err := getDiskAfterInsert(ctx, cloudProvider, meta.RegionalKey(name, region), gceAPIVersion)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get disk after creating regional disk: %v", err)
 	}
 	return disk, nil
 }
 
-func createSingleZoneDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, params common.DiskParameters, capacityRange *csi.CapacityRange, capBytes int64, snapshotID string, multiWriter bool) (*gce.CloudDisk, error) {
+func createSingleZoneDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, params common.DiskParameters, capacityRange *csi.CapacityRange, capBytes int64, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) (*gce.CloudDisk, error) {
 	if len(zones) != 1 {
 		return nil, fmt.Errorf("got wrong number of zones for zonal create volume: %v", len(zones))
 	}
 	diskZone := zones[0]
-	err := cloudProvider.InsertDisk(ctx, meta.ZonalKey(name, diskZone), params, capBytes, capacityRange, nil, snapshotID, multiWriter)
+	err := cloudProvider.InsertDisk(ctx, meta.ZonalKey(name, diskZone), params, capBytes, capacityRange, nil, snapshotID, volumeContentSourceVolumeID, multiWriter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert zonal disk: %v", err)
 	}
@@ -1058,13 +2715,38 @@ func createSingleZoneDisk(ctx context.Context, cloudProvider gce.GCECompute, nam
 	if multiWriter {
 		gceAPIVersion = gce.GCEAPIVersionBeta
 	}
-	disk, err := cloudProvider.GetDisk(ctx, meta.ZonalKey(name, diskZone), gceAPIVersion)
+	disk, err := getDiskAfterInsert(ctx, cloudProvider, meta.ZonalKey(name, diskZone), gceAPIVersion)
 	if err != nil {
 		return nil, err
 	}
 	return disk, nil
 }
 
+// getDiskAfterInsert gets the disk at volKey right after its insert
+// succeeded. Disk reads are eventually consistent and may not find a disk
+// for a few seconds after it is inserted, so notFound is retried with
+// postInsertGetBackoff rather than failing CreateVolume, which would make the
+// provisioner insert the disk again.
+func getDiskAfterInsert(ctx context.Context, cloudProvider gce.GCECompute, volKey *meta.Key, gceAPIVersion gce.GCEAPIVersion) (*gce.CloudDisk, error) {
+	var disk *gce.CloudDisk
+	var getErr error
+	err := backoff.Retry(ctx, postInsertGetBackoff, func() (bool, error) {
+		disk, getErr = cloudProvider.GetDisk(ctx, volKey, gceAPIVersion)
+		if gce.IsGCENotFoundError(getErr) {
+			klog.V(4).Infof("Disk %v not found right after insert, retrying", volKey)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil && err != wait.ErrWaitTimeout {
+		return nil, err
+	}
+	if getErr != nil {
+		return nil, getErr
+	}
+	return disk, nil
+}
+
 func pickRandAndConsecutive(slice []string, n int) ([]string, error) {
 	if n > len(slice) {
 		return nil, fmt.Errorf("n: %v is greater than length of provided slice: %v", n, slice)
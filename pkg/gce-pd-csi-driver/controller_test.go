@@ -15,10 +15,15 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,12 +32,20 @@ import (
 
 	"context"
 
+	computealpha "google.golang.org/api/compute/v0.alpha"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/flowcontrol"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 )
@@ -63,6 +76,10 @@ var (
 	region, _      = common.GetRegionFromZones([]string{zone})
 	testRegionalID = fmt.Sprintf("projects/%s/regions/%s/disks/%s", project, region, name)
 	testSnapshotID = fmt.Sprintf("projects/%s/global/snapshots/%s", project, name)
+	testImageID    = fmt.Sprintf("projects/%s/global/images/%s", project, name)
+	// testInstantSnapshotID is the ID of an instant snapshot of the disk of
+	// testVolumeID.
+	testInstantSnapshotID = fmt.Sprintf("projects/%s/zones/%s/instantSnapshots/%s", project, zone, name)
 )
 
 func TestCreateSnapshotArguments(t *testing.T) {
@@ -96,6 +113,54 @@ func TestCreateSnapshotArguments(t *testing.T) {
 				ReadyToUse:     false,
 			},
 		},
+		{
+			name: "success image of zonal disk",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters:     map[string]string{common.ParameterKeySnapshotType: common.DiskImageType},
+			},
+			seedDisks: []*gce.CloudDisk{
+				createZonalCloudDisk(name),
+			},
+			expSnapshot: &csi.Snapshot{
+				SnapshotId:     testImageID,
+				SourceVolumeId: testVolumeID,
+				CreationTime:   tp,
+				SizeBytes:      common.GbToBytes(gce.DiskSizeGb),
+				ReadyToUse:     false,
+			},
+		},
+		{
+			name: "success instant snapshot of zonal disk",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters:     map[string]string{common.ParameterKeySnapshotType: common.DiskInstantSnapshotType},
+			},
+			seedDisks: []*gce.CloudDisk{
+				createZonalCloudDisk(name),
+			},
+			expSnapshot: &csi.Snapshot{
+				SnapshotId:     testInstantSnapshotID,
+				SourceVolumeId: testVolumeID,
+				CreationTime:   tp,
+				SizeBytes:      common.GbToBytes(gce.DiskSizeGb),
+				ReadyToUse:     true,
+			},
+		},
+		{
+			name: "fail invalid snapshot type",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters:     map[string]string{common.ParameterKeySnapshotType: "machine-images"},
+			},
+			seedDisks: []*gce.CloudDisk{
+				createZonalCloudDisk(name),
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 		{
 			name: "fail no name",
 			req: &csi.CreateSnapshotRequest{
@@ -165,6 +230,54 @@ func TestCreateSnapshotArguments(t *testing.T) {
 		}
 	}
 }
+func TestCreateSnapshotLabels(t *testing.T) {
+	ctx := context.Background()
+	expLabels := map[string]string{"team": "storage", "backup": "nightly"}
+	for _, snapshotType := range []string{common.DiskSnapshotType, common.DiskImageType, common.DiskInstantSnapshotType} {
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, fcp)
+		_, err = gceDriver.cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           name,
+			SourceVolumeId: testVolumeID,
+			Parameters: map[string]string{
+				common.ParameterKeySnapshotType: snapshotType,
+				common.ParameterKeyLabels:       "team=storage,backup=nightly",
+			},
+		})
+		if err != nil {
+			t.Errorf("%s: CreateSnapshot failed: %v", snapshotType, err)
+			continue
+		}
+		var labels map[string]string
+		switch snapshotType {
+		case common.DiskImageType:
+			image, err := fcp.GetImage(ctx, name)
+			if err != nil {
+				t.Fatalf("%s: failed to get image: %v", snapshotType, err)
+			}
+			labels = image.Labels
+		case common.DiskInstantSnapshotType:
+			snapshot, err := fcp.GetInstantSnapshot(ctx, meta.ZonalKey(name, zone))
+			if err != nil {
+				t.Fatalf("%s: failed to get instant snapshot: %v", snapshotType, err)
+			}
+			labels = snapshot.Labels
+		default:
+			snapshot, err := fcp.GetSnapshot(ctx, name)
+			if err != nil {
+				t.Fatalf("%s: failed to get snapshot: %v", snapshotType, err)
+			}
+			labels = snapshot.Labels
+		}
+		if !reflect.DeepEqual(labels, expLabels) {
+			t.Errorf("%s: got labels %v, expected %v", snapshotType, labels, expLabels)
+		}
+	}
+}
+
 func TestDeleteSnapshot(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -177,6 +290,18 @@ func TestDeleteSnapshot(t *testing.T) {
 				SnapshotId: testSnapshotID,
 			},
 		},
+		{
+			name: "valid image",
+			req: &csi.DeleteSnapshotRequest{
+				SnapshotId: testImageID,
+			},
+		},
+		{
+			name: "valid instant snapshot",
+			req: &csi.DeleteSnapshotRequest{
+				SnapshotId: testInstantSnapshotID,
+			},
+		},
 		{
 			name: "invalid id",
 			req: &csi.DeleteSnapshotRequest{
@@ -216,6 +341,89 @@ func TestDeleteSnapshot(t *testing.T) {
 	}
 }
 
+func TestDisableSnapshots(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, nil)
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	gceDriver := GetGCEDriver()
+	controllerServer := NewControllerServer(gceDriver, fakeCloudProvider, ControllerServerArgs{DisableSnapshots: true})
+	if err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, controllerServer, nil); err != nil {
+		t.Fatalf("Failed to setup GCE Driver: %v", err)
+	}
+
+	resp, err := gceDriver.cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities failed: %v", err)
+	}
+	for _, cap := range resp.GetCapabilities() {
+		switch cap.GetRpc().GetType() {
+		case csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT, csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS:
+			t.Errorf("Expected snapshot capability %v to be hidden", cap.GetRpc().GetType())
+		}
+	}
+
+	_, err = gceDriver.cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: testVolumeID,
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected CreateSnapshot to return %v, got: %v", codes.Unimplemented, err)
+	}
+	_, err = gceDriver.cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: testSnapshotID})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected DeleteSnapshot to return %v, got: %v", codes.Unimplemented, err)
+	}
+	_, err = gceDriver.cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected ListSnapshots to return %v, got: %v", codes.Unimplemented, err)
+	}
+}
+
+func TestDisableExpansion(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	gceDriver := GetGCEDriver()
+	identityServer := NewIdentityServer(gceDriver)
+	controllerServer := NewControllerServer(gceDriver, fakeCloudProvider, ControllerServerArgs{DisableExpansion: true})
+	if err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, identityServer, controllerServer, nil); err != nil {
+		t.Fatalf("Failed to setup GCE Driver: %v", err)
+	}
+
+	resp, err := gceDriver.cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities failed: %v", err)
+	}
+	for _, cap := range resp.GetCapabilities() {
+		if cap.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_EXPAND_VOLUME {
+			t.Errorf("Expected expansion capability %v to be hidden", cap.GetRpc().GetType())
+		}
+	}
+	pluginResp, err := gceDriver.ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("GetPluginCapabilities failed: %v", err)
+	}
+	for _, cap := range pluginResp.GetCapabilities() {
+		if cap.GetVolumeExpansion() != nil {
+			t.Errorf("Expected plugin expansion capability %v to be hidden", cap.GetVolumeExpansion().GetType())
+		}
+	}
+	for _, cap := range nodeServiceCapabilities(&GCENodeServer{disableExpansion: true}) {
+		if cap == csi.NodeServiceCapability_RPC_EXPAND_VOLUME {
+			t.Errorf("Expected node expansion capability %v to be hidden", cap)
+		}
+	}
+
+	_, err = gceDriver.cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      testVolumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected ControllerExpandVolume to return %v, got: %v", codes.Unimplemented, err)
+	}
+}
 func TestListSnapshotsArguments(t *testing.T) {
 	// Define test cases
 	testCases := []struct {
@@ -245,6 +453,22 @@ func TestListSnapshotsArguments(t *testing.T) {
 			},
 			numSnapshots: 5,
 		},
+		{
+			name: "id and matching source volume",
+			req: &csi.ListSnapshotsRequest{
+				SnapshotId:     testSnapshotID + "0",
+				SourceVolumeId: testVolumeID + "0",
+			},
+			numSnapshots: 1,
+		},
+		{
+			name: "negative max entries",
+			req: &csi.ListSnapshotsRequest{
+				MaxEntries: -1,
+			},
+			numSnapshots: 1,
+			expErrCode:   codes.InvalidArgument,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -307,6 +531,284 @@ func TestListSnapshotsArguments(t *testing.T) {
 	}
 }
 
+func TestListSnapshotsSourceVolume(t *testing.T) {
+	ctx := context.Background()
+	otherName := name + "-other"
+	otherVolumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, otherName)
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{createZonalCloudDisk(name), createZonalCloudDisk(otherName)})
+	for snapshotName, volumeID := range map[string]string{name: testVolumeID, otherName: otherVolumeID} {
+		_, err := gceDriver.cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           snapshotName,
+			SourceVolumeId: volumeID,
+		})
+		if err != nil {
+			t.Fatalf("CreateSnapshot of %s failed: %v", volumeID, err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		req      *csi.ListSnapshotsRequest
+		expected []string
+	}{
+		{
+			name:     "source volume",
+			req:      &csi.ListSnapshotsRequest{SourceVolumeId: testVolumeID},
+			expected: []string{testSnapshotID},
+		},
+		{
+			name:     "snapshot of the source volume",
+			req:      &csi.ListSnapshotsRequest{SnapshotId: testSnapshotID, SourceVolumeId: testVolumeID},
+			expected: []string{testSnapshotID},
+		},
+		{
+			name: "snapshot of another source volume",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: testSnapshotID, SourceVolumeId: otherVolumeID},
+		},
+	}
+	for _, tc := range testCases {
+		resp, err := gceDriver.cs.ListSnapshots(ctx, tc.req)
+		if err != nil {
+			t.Errorf("%s: ListSnapshots failed: %v", tc.name, err)
+			continue
+		}
+		var listed []string
+		for _, entry := range resp.GetEntries() {
+			listed = append(listed, entry.GetSnapshot().GetSnapshotId())
+		}
+		if !reflect.DeepEqual(listed, tc.expected) {
+			t.Errorf("%s: got listed snapshots %v, expected %v", tc.name, listed, tc.expected)
+		}
+	}
+}
+
+func TestImageSnapshots(t *testing.T) {
+	ctx := context.Background()
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	snapshotResp, err := gceDriver.cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: testVolumeID,
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot of a PD snapshot failed: %v", err)
+	}
+	imageResp, err := gceDriver.cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: testVolumeID,
+		Parameters:     map[string]string{common.ParameterKeySnapshotType: common.DiskImageType},
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot of an image failed: %v", err)
+	}
+	if snapshotResp.GetSnapshot().GetSnapshotId() != testSnapshotID || imageResp.GetSnapshot().GetSnapshotId() != testImageID {
+		t.Fatalf("got snapshot IDs %s and %s, expected %s and %s", snapshotResp.GetSnapshot().GetSnapshotId(), imageResp.GetSnapshot().GetSnapshotId(), testSnapshotID, testImageID)
+	}
+	// Images the driver did not create are not listed as snapshots.
+	otherImage, err := gceDriver.cs.CloudProvider.CreateImage(ctx, meta.ZonalKey(name, zone), "other-image", nil)
+	if err != nil {
+		t.Fatalf("Failed to create other image: %v", err)
+	}
+	otherImage.Description = ""
+
+	// Listing one entry at a time pages from the snapshots to the images.
+	var listed []string
+	token := ""
+	for i := 0; i < 3; i++ {
+		resp, err := gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 1, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListSnapshots failed: %v", err)
+		}
+		for _, entry := range resp.GetEntries() {
+			listed = append(listed, entry.GetSnapshot().GetSnapshotId())
+		}
+		token = resp.GetNextToken()
+		if token == "" {
+			break
+		}
+	}
+	if expListed := []string{testSnapshotID, testImageID}; !reflect.DeepEqual(listed, expListed) {
+		t.Errorf("got listed snapshots %v, expected %v", listed, expListed)
+	}
+
+	resp, err := gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testImageID})
+	if err != nil {
+		t.Fatalf("ListSnapshots of the image failed: %v", err)
+	}
+	if len(resp.GetEntries()) != 1 || !resp.GetEntries()[0].GetSnapshot().GetReadyToUse() || resp.GetEntries()[0].GetSnapshot().GetSourceVolumeId() != testVolumeID {
+		t.Errorf("got entries %v for the image, expected one ready image of %s", resp.GetEntries(), testVolumeID)
+	}
+
+	restoreResp, err := gceDriver.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "restored",
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         map[string]string{common.ParameterKeyTrimAfterRestore: "true", common.ParameterKeyRegenerateFSUUID: "true"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: testImageID},
+			},
+		},
+	})
+	if err != nil {
+		t.Errorf("CreateVolume from the image failed: %v", err)
+	} else {
+		if source := restoreResp.GetVolume().GetContentSource().GetSnapshot().GetSnapshotId(); source != testImageID {
+			t.Errorf("got content source snapshot %q for the restored volume, expected %q", source, testImageID)
+		}
+		expContext := map[string]string{common.VolumeAttributeTrimAfterRestore: "true", common.VolumeAttributeRegenerateFSUUID: "true"}
+		if got := restoreResp.GetVolume().GetVolumeContext(); !reflect.DeepEqual(got, expContext) {
+			t.Errorf("got volume context %v for the restored volume, expected %v", got, expContext)
+		}
+	}
+
+	if _, err := gceDriver.cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: testImageID}); err != nil {
+		t.Fatalf("DeleteSnapshot of the image failed: %v", err)
+	}
+	resp, err = gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testImageID})
+	if err != nil {
+		t.Fatalf("ListSnapshots of the deleted image failed: %v", err)
+	}
+	if len(resp.GetEntries()) != 0 {
+		t.Errorf("got entries %v for the deleted image, expected none", resp.GetEntries())
+	}
+	resp, err = gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testSnapshotID})
+	if err != nil {
+		t.Fatalf("ListSnapshots of the PD snapshot failed: %v", err)
+	}
+	if len(resp.GetEntries()) != 1 {
+		t.Errorf("got entries %v for the PD snapshot, expected it to be kept", resp.GetEntries())
+	}
+
+	_, err = gceDriver.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "restored-from-deleted",
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: testImageID},
+			},
+		},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v from CreateVolume from the deleted image, expected %v", err, codes.NotFound)
+	}
+}
+
+func TestInstantSnapshots(t *testing.T) {
+	ctx := context.Background()
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	for _, snapshotType := range []string{common.DiskSnapshotType, common.DiskInstantSnapshotType} {
+		_, err := gceDriver.cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           name,
+			SourceVolumeId: testVolumeID,
+			Parameters:     map[string]string{common.ParameterKeySnapshotType: snapshotType},
+		})
+		if err != nil {
+			t.Fatalf("CreateSnapshot of type %s failed: %v", snapshotType, err)
+		}
+	}
+
+	// Instant snapshots are only listed for a source volume, after the PD
+	// snapshots and images.
+	listAll := func(sourceVolumeID string) []string {
+		var listed []string
+		token := ""
+		for i := 0; i < 4; i++ {
+			resp, err := gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID, MaxEntries: 1, StartingToken: token})
+			if err != nil {
+				t.Fatalf("ListSnapshots of source volume %q failed: %v", sourceVolumeID, err)
+			}
+			for _, entry := range resp.GetEntries() {
+				listed = append(listed, entry.GetSnapshot().GetSnapshotId())
+			}
+			token = resp.GetNextToken()
+			if token == "" {
+				break
+			}
+		}
+		return listed
+	}
+	if listed, expListed := listAll(""), []string{testSnapshotID}; !reflect.DeepEqual(listed, expListed) {
+		t.Errorf("got listed snapshots %v, expected %v", listed, expListed)
+	}
+	if listed, expListed := listAll(testVolumeID), []string{testSnapshotID, testInstantSnapshotID}; !reflect.DeepEqual(listed, expListed) {
+		t.Errorf("got listed snapshots of %s %v, expected %v", testVolumeID, listed, expListed)
+	}
+
+	resp, err := gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testInstantSnapshotID})
+	if err != nil {
+		t.Fatalf("ListSnapshots of the instant snapshot failed: %v", err)
+	}
+	if len(resp.GetEntries()) != 1 || !resp.GetEntries()[0].GetSnapshot().GetReadyToUse() || resp.GetEntries()[0].GetSnapshot().GetSourceVolumeId() != testVolumeID {
+		t.Errorf("got entries %v for the instant snapshot, expected one ready instant snapshot of %s", resp.GetEntries(), testVolumeID)
+	}
+
+	otherZone := "other-zone"
+	restoreCases := []struct {
+		name       string
+		params     map[string]string
+		topology   *csi.TopologyRequirement
+		expZone    string
+		expErrCode codes.Code
+	}{
+		{
+			name:    "restore in the zone of the snapshot",
+			expZone: zone,
+		},
+		{
+			name: "restore in another zone",
+			topology: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{common.TopologyKeyZone: otherZone}}},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "regional restore of a zonal snapshot",
+			params:     map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for i, tc := range restoreCases {
+		volResp, err := gceDriver.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                      fmt.Sprintf("restored-%d", i),
+			CapacityRange:             stdCapRange,
+			VolumeCapabilities:        stdVolCaps,
+			Parameters:                tc.params,
+			AccessibilityRequirements: tc.topology,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: testInstantSnapshotID},
+				},
+			},
+		})
+		if tc.expErrCode != codes.OK {
+			if status.Code(err) != tc.expErrCode {
+				t.Errorf("%s: got error %v, expected code %v", tc.name, err, tc.expErrCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		volKey, err := common.VolumeIDToKey(volResp.GetVolume().GetVolumeId())
+		if err != nil || volKey.Zone != tc.expZone {
+			t.Errorf("%s: got volume %s, expected it in zone %s", tc.name, volResp.GetVolume().GetVolumeId(), tc.expZone)
+		}
+	}
+
+	if _, err := gceDriver.cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: testInstantSnapshotID}); err != nil {
+		t.Fatalf("DeleteSnapshot of the instant snapshot failed: %v", err)
+	}
+	resp, err = gceDriver.cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testInstantSnapshotID})
+	if err != nil {
+		t.Fatalf("ListSnapshots of the deleted instant snapshot failed: %v", err)
+	}
+	if len(resp.GetEntries()) != 0 {
+		t.Errorf("got entries %v for the deleted instant snapshot, expected none", resp.GetEntries())
+	}
+}
+
 func TestCreateVolumeArguments(t *testing.T) {
 	// Define test cases
 	testCases := []struct {
@@ -371,38 +873,144 @@ func TestCreateVolumeArguments(t *testing.T) {
 			},
 		},
 		{
-			name: "fail no name",
-			req: &csi.CreateVolumeRequest{
-				Name:               "",
-				CapacityRange:      stdCapRange,
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
-			},
-			expErrCode: codes.InvalidArgument,
-		},
-		{
-			name: "success no capacity range",
+			name: "success with block/MULTI_NODE_MULTI_WRITER capabilities on pd-ssd",
 			req: &csi.CreateVolumeRequest{
 				Name:               "test-name",
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+				Parameters:         map[string]string{common.ParameterKeyType: "pd-ssd"},
 			},
 			expVol: &csi.Volume{
-				CapacityBytes:      MinimumVolumeSizeInBytes,
+				CapacityBytes:      common.GbToBytes(20),
 				VolumeId:           testVolumeID,
 				VolumeContext:      nil,
 				AccessibleTopology: stdTopology,
 			},
 		},
 		{
-			name: "fail no capabilities",
+			name: "fail with block/MULTI_NODE_MULTI_WRITER capabilities on default pd-standard",
 			req: &csi.CreateVolumeRequest{
-				Name:          "test-name",
-				CapacityRange: stdCapRange,
-				Parameters:    stdParams,
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
 			},
 			expErrCode: codes.InvalidArgument,
 		},
+		{
+			name: "fail with block/MULTI_NODE_MULTI_WRITER capabilities on regional disk",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+				Parameters: map[string]string{
+					common.ParameterKeyType:            "pd-ssd",
+					common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail with mount/MULTI_NODE_READER_ONLY capabilities on hyperdisk",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: createVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+				Parameters:         map[string]string{common.ParameterKeyType: "hyperdisk-balanced"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no name",
+			req: &csi.CreateVolumeRequest{
+				Name:               "",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success no capacity range",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      MinimumVolumeSizeInBytes,
+				VolumeId:           testVolumeID,
+				VolumeContext:      nil,
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "fail no capabilities",
+			req: &csi.CreateVolumeRequest{
+				Name:          "test-name",
+				CapacityRange: stdCapRange,
+				Parameters:    stdParams,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail with filesystem no node supports",
+			req: &csi.CreateVolumeRequest{
+				Name:          "test-name",
+				CapacityRange: stdCapRange,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{FsType: "btrfs"},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				Parameters: stdParams,
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{
+						{
+							Segments: map[string]string{common.TopologyKeyZone: zone, common.TopologyKeyFilesystems: "ext4"},
+						},
+					},
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success with mount hardening disabled",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyMountHardening: "false"},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      map[string]string{common.VolumeAttributeMountHardening: "false"},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "success with publish metadata",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyPublishMetadata: "true"},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testVolumeID,
+				VolumeContext: map[string]string{
+					common.VolumeAttributePublishMetadata: "true",
+					common.VolumeAttributeDiskType:        "test-type",
+				},
+				AccessibleTopology: stdTopology,
+			},
+		},
 		{
 			name: "success no params",
 			req: &csi.CreateVolumeRequest{
@@ -569,6 +1177,35 @@ func TestCreateVolumeArguments(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "success with region-only topology with repd",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{
+						{
+							Segments: map[string]string{common.TopologyKeyRegion: region},
+						},
+					},
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testRegionalID,
+				VolumeContext: nil,
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: secondZone},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: zone},
+					},
+				},
+			},
+		},
 		{
 			name: "fail not enough topology with repd",
 			req: &csi.CreateVolumeRequest{
@@ -617,6 +1254,108 @@ func TestCreateVolumeArguments(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "success with preferred topology in two regions with repd",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Preferred: []*csi.Topology{
+						{
+							Segments: map[string]string{common.TopologyKeyZone: region + "-c"},
+						},
+						{
+							Segments: map[string]string{common.TopologyKeyZone: "country-otherregion-a"},
+						},
+						{
+							Segments: map[string]string{common.TopologyKeyZone: region + "-b"},
+						},
+					},
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testRegionalID,
+				VolumeContext: nil,
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: region + "-c"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: region + "-b"},
+					},
+				},
+			},
+		},
+		{
+			name: "success with replica zones",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+					common.ParameterKeyReplicaZones:    region + "-a, " + region + "-b",
+				},
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Preferred: []*csi.Topology{
+						{
+							Segments: map[string]string{common.TopologyKeyZone: region + "-b"},
+						},
+						{
+							Segments: map[string]string{common.TopologyKeyZone: region + "-c"},
+						},
+					},
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testRegionalID,
+				VolumeContext: nil,
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: region + "-a"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: region + "-b"},
+					},
+				},
+			},
+		},
+		{
+			name: "fail replica zones not allowed by topology",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+					common.ParameterKeyReplicaZones:    region + "-a," + region + "-b",
+				},
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{
+						{
+							Segments: map[string]string{common.TopologyKeyZone: region + "-c"},
+						},
+					},
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail replica zones without repd",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyReplicaZones: region + "-a," + region + "-b",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 		{
 			name: "success with block volume capability",
 			req: &csi.CreateVolumeRequest{
@@ -632,7 +1371,7 @@ func TestCreateVolumeArguments(t *testing.T) {
 			},
 		},
 		{
-			name: "fail with both mount and block volume capability",
+			name: "success with both mount and block volume capability",
 			req: &csi.CreateVolumeRequest{
 				Name:          name,
 				CapacityRange: stdCapRange,
@@ -655,7 +1394,12 @@ func TestCreateVolumeArguments(t *testing.T) {
 					},
 				},
 			},
-			expErrCode: codes.InvalidArgument,
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      map[string]string{common.VolumeAttributeAccessTypes: "block,mount"},
+				AccessibleTopology: stdTopology,
+			},
 		},
 		{
 			name: "success with disk encryption kms key",
@@ -803,30 +1547,162 @@ func TestListVolumeArgs(t *testing.T) {
 	}
 }
 
-func TestCreateVolumeWithVolumeSource(t *testing.T) {
-	// Define test cases
-	testCases := []struct {
-		name            string
-		volKey          *meta.Key
-		snapshotOnCloud bool
-		expErrCode      codes.Code
-	}{
-		{
-			name:            "success with data source of snapshot type",
-			volKey:          meta.ZonalKey("my-disk", zone),
-			snapshotOnCloud: true,
-		},
-		{
-			name:            "fail with data source of snapshot type that doesn't exist",
-			volKey:          meta.ZonalKey("my-disk", zone),
-			snapshotOnCloud: false,
-			expErrCode:      codes.NotFound,
-		},
+func TestListVolumesInTreeDisks(t *testing.T) {
+	inTreeName := "kubernetes-dynamic-pvc-3b9a0f1e-5c4d-4e2b-9a7f-2d1c0b8e6f5a"
+	disk := func(diskName, description string) *gce.CloudDisk {
+		return gce.CloudDiskFromV1(&compute.Disk{
+			Name:        diskName,
+			Description: description,
+			SelfLink:    common.CreateZonalVolumeID(project, zone, diskName),
+		})
+	}
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{
+		disk(inTreeName, `{"kubernetes.io/created-for/pv/name":"pvc-3b9a0f1e-5c4d-4e2b-9a7f-2d1c0b8e6f5a"}`),
+		disk(name, fmt.Sprintf(`{"storage.gke.io/created-by":%q}`, driver)),
+	})
+	resp, err := gceDriver.cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	contexts := map[string]map[string]string{}
+	for _, e := range resp.GetEntries() {
+		key, err := common.VolumeIDToKey(e.GetVolume().GetVolumeId())
+		if err != nil {
+			t.Fatalf("ListVolumes returned invalid volume ID %q: %v", e.GetVolume().GetVolumeId(), err)
+		}
+		contexts[key.Name] = e.GetVolume().GetVolumeContext()
+	}
+	expContexts := map[string]map[string]string{
+		inTreeName: {common.VolumeAttributeProvisioner: common.InTreeProvisionerName},
+		name:       nil,
+	}
+	if !reflect.DeepEqual(contexts, expContexts) {
+		t.Errorf("got volume contexts %v, expected %v", contexts, expContexts)
 	}
+}
 
-	// Run test cases
-	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
+func TestListVolumesPublishedNodes(t *testing.T) {
+	instance := fmt.Sprintf("projects/%s/zones/%s/instances/%s", project, zone, node)
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{
+		gce.CloudDiskFromV1(&compute.Disk{
+			Name:     "zonal",
+			Zone:     zone,
+			SelfLink: common.CreateZonalVolumeID(project, zone, "zonal"),
+			Users:    []string{"https://www.googleapis.com/compute/v1/" + instance},
+		}),
+		gce.CloudDiskFromV1(&compute.Disk{
+			Name:     "regional",
+			Region:   region,
+			SelfLink: fmt.Sprintf("projects/%s/regions/%s/disks/regional", project, region),
+		}),
+		gce.CloudDiskFromV1(&compute.Disk{
+			Name:     "other-region",
+			Zone:     "other-region-a",
+			SelfLink: common.CreateZonalVolumeID(project, "other-region-a", "other-region"),
+		}),
+	})
+	resp, err := gceDriver.cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	published := map[string][]string{}
+	for _, e := range resp.GetEntries() {
+		published[e.GetVolume().GetVolumeId()] = e.GetStatus().GetPublishedNodeIds()
+	}
+	expPublished := map[string][]string{
+		common.CreateZonalVolumeID(project, zone, "zonal"):                    {instance},
+		fmt.Sprintf("projects/%s/regions/%s/disks/regional", project, region): {},
+	}
+	if !reflect.DeepEqual(published, expPublished) {
+		t.Errorf("got published nodes %v, expected %v", published, expPublished)
+	}
+}
+
+func TestListVolumesFromDiskCache(t *testing.T) {
+	var d []*gce.CloudDisk
+	for i := 0; i < 600; i++ {
+		name := fmt.Sprintf("%v", i)
+		d = append(d, gce.CloudDiskFromV1(&compute.Disk{
+			Name:     name,
+			SelfLink: fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+		}))
+	}
+	gceDriver := initGCEDriver(t, d)
+	cache := newDiskCache(gceDriver.cs.CloudProvider, nil)
+	gceDriver.cs.diskCache = cache
+
+	// An unpopulated cache is reported as unavailable.
+	_, err := gceDriver.cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Got error %v from unpopulated cache, expected code %v", err, codes.Unavailable)
+	}
+
+	if err := cache.refresh(context.TODO()); err != nil {
+		t.Fatalf("Failed to refresh disk cache: %v", err)
+	}
+
+	seen := sets.NewString()
+	var token string
+	var pages int
+	for {
+		resp, err := gceDriver.cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{
+			MaxEntries:    250,
+			StartingToken: token,
+		})
+		if err != nil {
+			t.Fatalf("Got error %v, expecting none", err)
+		}
+		pages++
+		for _, e := range resp.Entries {
+			seen.Insert(e.Volume.VolumeId)
+		}
+		token = resp.NextToken
+		if token == "" {
+			break
+		}
+	}
+	if pages != 3 || seen.Len() != 600 {
+		t.Fatalf("Got %v distinct volumes in %v pages, expected 600 in 3", seen.Len(), pages)
+	}
+
+	// A token from before a refresh is rejected.
+	resp, err := gceDriver.cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{MaxEntries: 250})
+	if err != nil {
+		t.Fatalf("Got error %v, expecting none", err)
+	}
+	if err := cache.refresh(context.TODO()); err != nil {
+		t.Fatalf("Failed to refresh disk cache: %v", err)
+	}
+	_, err = gceDriver.cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{StartingToken: resp.NextToken})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Got error %v for stale token, expected code %v", err, codes.Aborted)
+	}
+}
+
+func TestCreateVolumeWithVolumeSource(t *testing.T) {
+	// Define test cases
+	testCases := []struct {
+		name            string
+		volKey          *meta.Key
+		snapshotOnCloud bool
+		expErrCode      codes.Code
+	}{
+		{
+			name:            "success with data source of snapshot type",
+			volKey:          meta.ZonalKey("my-disk", zone),
+			snapshotOnCloud: true,
+		},
+		{
+			name:            "fail with data source of snapshot type that doesn't exist",
+			volKey:          meta.ZonalKey("my-disk", zone),
+			snapshotOnCloud: false,
+			expErrCode:      codes.NotFound,
+		},
+	}
+
+	// Run test cases
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
 		// Setup new driver each time so no interference
 		gceDriver := initGCEDriver(t, nil)
 
@@ -845,7 +1721,7 @@ func TestCreateVolumeWithVolumeSource(t *testing.T) {
 		}
 
 		if tc.snapshotOnCloud {
-			gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), tc.volKey, name)
+			gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), tc.volKey, name, nil)
 		}
 		resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
 		//check response
@@ -872,819 +1748,3683 @@ func TestCreateVolumeWithVolumeSource(t *testing.T) {
 	}
 }
 
-func TestCreateVolumeRandomRequisiteTopology(t *testing.T) {
-	req := &csi.CreateVolumeRequest{
-		Name:               "test-name",
-		CapacityRange:      stdCapRange,
-		VolumeCapabilities: stdVolCaps,
-		Parameters:         map[string]string{"type": "test-type"},
-		AccessibilityRequirements: &csi.TopologyRequirement{
-			Requisite: []*csi.Topology{
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-				},
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-				},
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-				},
+func TestCreateVolumeClone(t *testing.T) {
+	sourceName := "source-disk"
+	zonalSourceID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, sourceName)
+	regionalSourceID := fmt.Sprintf("projects/%s/regions/%s/disks/%s", project, region, sourceName)
+	createSourceDisk := func(volKey *meta.Key, diskType, status string) *gce.CloudDisk {
+		disk := &compute.Disk{
+			Name:   volKey.Name,
+			SizeGb: 20,
+			Status: status,
+		}
+		if volKey.Type() == meta.Regional {
+			disk.Region = volKey.Region
+			disk.Type = fmt.Sprintf("projects/%s/regions/%s/diskTypes/%s", project, volKey.Region, diskType)
+			disk.ReplicaZones = []string{
+				fmt.Sprintf("projects/%s/zones/%s", project, zone),
+				fmt.Sprintf("projects/%s/zones/%s", project, secondZone),
+			}
+		} else {
+			disk.Zone = volKey.Zone
+			disk.Type = fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", project, volKey.Zone, diskType)
+		}
+		return gce.CloudDiskFromV1(disk)
+	}
+	zonalSource := createSourceDisk(meta.ZonalKey(sourceName, zone), "pd-standard", "READY")
+	regionalSource := createSourceDisk(meta.RegionalKey(sourceName, region), "pd-standard", "READY")
+	testCases := []struct {
+		name       string
+		sourceDisk *gce.CloudDisk
+		sourceID   string
+		params     map[string]string
+		sizeGb     int64
+		topology   *csi.TopologyRequirement
+		expErrCode codes.Code
+		expZones   []string
+		expSizeGb  int64
+	}{
+		{
+			name:       "same zone",
+			sourceDisk: zonalSource,
+			sourceID:   zonalSourceID,
+			sizeGb:     20,
+			topology:   &csi.TopologyRequirement{Requisite: stdTopology},
+			expZones:   []string{zone},
+			expSizeGb:  20,
+		},
+		{
+			name:       "size up",
+			sourceDisk: zonalSource,
+			sourceID:   zonalSourceID,
+			sizeGb:     50,
+			expZones:   []string{zone},
+			expSizeGb:  50,
+		},
+		{
+			name:       "smaller than the source",
+			sourceDisk: zonalSource,
+			sourceID:   zonalSourceID,
+			sizeGb:     10,
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "zone not allowed by topology",
+			sourceDisk: zonalSource,
+			sourceID:   zonalSourceID,
+			sizeGb:     20,
+			topology: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{common.TopologyKeyZone: secondZone}}},
 			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "zonal to regional",
+			sourceDisk: zonalSource,
+			sourceID:   zonalSourceID,
+			params:     map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			sizeGb:     200,
+			expZones:   []string{secondZone, zone},
+			expSizeGb:  200,
+		},
+		{
+			name:       "regional to regional",
+			sourceDisk: regionalSource,
+			sourceID:   regionalSourceID,
+			params:     map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			sizeGb:     20,
+			expZones:   []string{secondZone, zone},
+			expSizeGb:  20,
+		},
+		{
+			name:       "regional to zonal",
+			sourceDisk: regionalSource,
+			sourceID:   regionalSourceID,
+			sizeGb:     20,
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "hyperdisk to pd-standard",
+			sourceDisk: createSourceDisk(meta.ZonalKey(sourceName, zone), "hyperdisk-balanced", "READY"),
+			sourceID:   zonalSourceID,
+			sizeGb:     20,
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "source does not exist",
+			sourceID:   zonalSourceID,
+			sizeGb:     20,
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:       "source not ready",
+			sourceDisk: createSourceDisk(meta.ZonalKey(sourceName, zone), "pd-standard", "CREATING"),
+			sourceID:   zonalSourceID,
+			sizeGb:     20,
+			expErrCode: codes.FailedPrecondition,
 		},
 	}
-
-	gceDriver := initGCEDriver(t, nil)
-
-	tZones := map[string]bool{}
-	// Start Test
-	for i := 0; i < 25; i++ {
-		resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
+	for _, tc := range testCases {
+		var seedDisks []*gce.CloudDisk
+		if tc.sourceDisk != nil {
+			seedDisks = append(seedDisks, tc.sourceDisk)
+		}
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, seedDisks)
 		if err != nil {
-			t.Fatalf("CreateVolume did not expect error, but got %v", err)
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
 		}
-		tZone, ok := resp.GetVolume().GetAccessibleTopology()[0].GetSegments()[common.TopologyKeyZone]
-		if !ok {
-			t.Fatalf("Could not find topology zone in response")
+		gceDriver := initGCEDriverWithCloudProvider(t, fcp)
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                      "test-name",
+			CapacityRange:             &csi.CapacityRange{RequiredBytes: common.GbToBytes(tc.sizeGb)},
+			VolumeCapabilities:        stdVolCaps,
+			Parameters:                tc.params,
+			AccessibilityRequirements: tc.topology,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: tc.sourceID},
+				},
+			},
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		vol := resp.GetVolume()
+		if got := vol.GetContentSource().GetVolume().GetVolumeId(); got != tc.sourceID {
+			t.Errorf("%s: got content source volume %q, expected %q", tc.name, got, tc.sourceID)
+		}
+		if got := vol.GetCapacityBytes(); got != common.GbToBytes(tc.expSizeGb) {
+			t.Errorf("%s: got capacity %d, expected %d", tc.name, got, common.GbToBytes(tc.expSizeGb))
+		}
+		var zones []string
+		for _, top := range vol.GetAccessibleTopology() {
+			zones = append(zones, top.GetSegments()[common.TopologyKeyZone])
+		}
+		sort.Strings(zones)
+		if !reflect.DeepEqual(zones, tc.expZones) {
+			t.Errorf("%s: got zones %v, expected %v", tc.name, zones, tc.expZones)
 		}
-		tZones[tZone] = true
-	}
-	// We expect that we should have picked all 3 topology zones here
-	if len(tZones) != 3 {
-		t.Fatalf("Expected all 3 topology zones to be rotated through, got only: %v", tZones)
 	}
 }
 
-func createZonalCloudDisk(name string) *gce.CloudDisk {
+// creatingCloneCloudProvider reports the disk named clone as CREATING for
+// the first reads after its insert, like a clone whose data is still being
+// copied after the insert operation is done.
+type creatingCloneCloudProvider struct {
+	*gce.FakeCloudProvider
+	clone         string
+	creatingReads int
+}
+
+func (cloud *creatingCloneCloudProvider) GetDisk(ctx context.Context, volKey *meta.Key, api gce.GCEAPIVersion) (*gce.CloudDisk, error) {
+	disk, err := cloud.FakeCloudProvider.GetDisk(ctx, volKey, api)
+	if err != nil || volKey.Name != cloud.clone || cloud.creatingReads == 0 {
+		return disk, err
+	}
+	cloud.creatingReads--
 	return gce.CloudDiskFromV1(&compute.Disk{
-		Name: name,
-	})
+		Name:       disk.GetName(),
+		SizeGb:     disk.GetSizeGb(),
+		Type:       disk.GetPDType(),
+		Zone:       disk.GetZone(),
+		SelfLink:   disk.GetSelfLink(),
+		SourceDisk: disk.GetSourceDisk(),
+		Status:     "CREATING",
+	}), nil
 }
 
-func TestDeleteVolume(t *testing.T) {
+func TestCreateVolumeCloneWaitsForReady(t *testing.T) {
+	defer func(policy backoff.Policy) { cloneReadyBackoff = policy }(cloneReadyBackoff)
+	cloneReadyBackoff = backoff.Policy{Duration: time.Millisecond, Factor: 1, Steps: 5}
+
 	testCases := []struct {
-		name      string
-		seedDisks []*gce.CloudDisk
-		req       *csi.DeleteVolumeRequest
-		expErr    bool
+		name          string
+		creatingReads int
+		expErrCode    codes.Code
 	}{
 		{
-			name: "valid",
-			seedDisks: []*gce.CloudDisk{
-				createZonalCloudDisk(name),
+			name:          "ready after a few reads",
+			creatingReads: 3,
+		},
+		{
+			name:          "not ready in time",
+			creatingReads: 10,
+			expErrCode:    codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		source := gce.CloudDiskFromV1(&compute.Disk{
+			Name:   "source-disk",
+			Zone:   zone,
+			SizeGb: 20,
+			Type:   fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-standard", project, zone),
+			Status: "READY",
+		})
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{source})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, &creatingCloneCloudProvider{FakeCloudProvider: fcp, clone: name, creatingReads: tc.creatingReads})
+		_, err = gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: fmt.Sprintf("projects/%s/zones/%s/disks/source-disk", project, zone)},
+				},
 			},
-			req: &csi.DeleteVolumeRequest{
-				VolumeId: testVolumeID,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+		}
+	}
+}
+
+func TestCreateVolumeDiscardPolicy(t *testing.T) {
+	snapshotSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: testSnapshotID,
 			},
 		},
+	}
+	testCases := []struct {
+		name             string
+		params           map[string]string
+		source           *csi.VolumeContentSource
+		expVolumeContext map[string]string
+	}{
 		{
-			name: "invalid id",
-			req: &csi.DeleteVolumeRequest{
-				VolumeId: testVolumeID + "/foo",
-			},
-			expErr: false,
+			name:   "no policy",
+			source: snapshotSource,
 		},
 		{
-			name: "repairable ID",
-			seedDisks: []*gce.CloudDisk{
-				createZonalCloudDisk(name),
-			},
-			req: &csi.DeleteVolumeRequest{
-				VolumeId: common.GenerateUnderspecifiedVolumeID(name, true /* isZonal */),
-			},
-			expErr: false,
+			name:             "discard",
+			params:           map[string]string{common.ParameterKeyDiscard: "true"},
+			expVolumeContext: map[string]string{common.VolumeAttributeDiscard: "true"},
 		},
 		{
-			name: "non-repairable ID (invalid)",
-			seedDisks: []*gce.CloudDisk{
-				createZonalCloudDisk("nottherightname"),
-			},
-			req: &csi.DeleteVolumeRequest{
-				VolumeId: common.GenerateUnderspecifiedVolumeID(name, true /* isZonal */),
+			name:   "trim after restore without snapshot",
+			params: map[string]string{common.ParameterKeyTrimAfterRestore: "true"},
+		},
+		{
+			name:   "trim after restore from snapshot",
+			params: map[string]string{common.ParameterKeyDiscard: "false", common.ParameterKeyTrimAfterRestore: "true"},
+			source: snapshotSource,
+			expVolumeContext: map[string]string{
+				common.VolumeAttributeDiscard:          "false",
+				common.VolumeAttributeTrimAfterRestore: "true",
 			},
-			expErr: false,
+		},
+		{
+			name:   "regenerate fs uuid without snapshot",
+			params: map[string]string{common.ParameterKeyRegenerateFSUUID: "true"},
+		},
+		{
+			name:             "regenerate fs uuid from snapshot",
+			params:           map[string]string{common.ParameterKeyRegenerateFSUUID: "true"},
+			source:           snapshotSource,
+			expVolumeContext: map[string]string{common.VolumeAttributeRegenerateFSUUID: "true"},
+		},
+		{
+			name:             "node io limits",
+			params:           map[string]string{common.ParameterKeyNodeReadBytesPerSec: "1Mi", common.ParameterKeyNodeWriteIOPS: "100"},
+			expVolumeContext: map[string]string{common.VolumeAttributeIOMax: "rbps=1048576 wiops=100"},
 		},
 	}
 	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
-		// Setup new driver each time so no interference
-		gceDriver := initGCEDriver(t, tc.seedDisks)
-
-		_, err := gceDriver.cs.DeleteVolume(context.Background(), tc.req)
-		if err == nil && tc.expErr {
-			t.Errorf("Expected error but got none")
-		}
-		if err != nil && !tc.expErr {
-			t.Errorf("Did not expect error but got: %v", err)
-		}
-
+		gceDriver := initGCEDriver(t, nil)
+		gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), meta.ZonalKey("my-disk", zone), name, nil)
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                "test-name",
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          tc.params,
+			VolumeContentSource: tc.source,
+		})
 		if err != nil {
+			t.Errorf("%s: CreateVolume failed: %v", tc.name, err)
 			continue
 		}
-
+		if got := resp.GetVolume().GetVolumeContext(); !reflect.DeepEqual(got, tc.expVolumeContext) {
+			t.Errorf("%s: got volume context %v, expected %v", tc.name, got, tc.expVolumeContext)
+		}
 	}
 }
 
-func TestGetRequestCapacity(t *testing.T) {
+func TestCreateVolumeProvisionedPerformance(t *testing.T) {
 	testCases := []struct {
-		name     string
-		capRange *csi.CapacityRange
-		expCap   int64
-		expErr   bool
+		name             string
+		params           map[string]string
+		sizeGb           int64
+		expErrCode       codes.Code
+		expVolumeContext map[string]string
 	}{
 		{
-			name:     "nil cap range",
-			capRange: nil,
-			expCap:   MinimumVolumeSizeInBytes,
+			name:             "pd-extreme",
+			params:           map[string]string{common.ParameterKeyType: "pd-extreme", common.ParameterKeyProvisionedIOPS: "20000"},
+			sizeGb:           500,
+			expVolumeContext: map[string]string{common.VolumeAttributeProvisionedIOPS: "20000"},
 		},
 		{
-			name: "success: required below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 1,
-			},
-			expCap: MinimumVolumeSizeInBytes,
+			name:   "pd-extreme without provisioned iops",
+			params: map[string]string{common.ParameterKeyType: "pd-extreme"},
+			sizeGb: 500,
 		},
 		{
-			name: "success: required equals min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes,
-			},
-			expCap: MinimumVolumeSizeInBytes,
+			name:       "iops below range",
+			params:     map[string]string{common.ParameterKeyType: "pd-extreme", common.ParameterKeyProvisionedIOPS: "100"},
+			sizeGb:     500,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "success: required above min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes + 1,
-			},
-			expCap: MinimumVolumeSizeInBytes + 1,
+			name:       "iops above range",
+			params:     map[string]string{common.ParameterKeyType: "pd-extreme", common.ParameterKeyProvisionedIOPS: "200000"},
+			sizeGb:     500,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "fail: limit below min",
-			capRange: &csi.CapacityRange{
-				LimitBytes: MinimumVolumeSizeInBytes - 1,
-			},
-			expErr: true,
+			name:       "disk too small",
+			params:     map[string]string{common.ParameterKeyType: "pd-extreme", common.ParameterKeyProvisionedIOPS: "20000"},
+			sizeGb:     100,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "success: limit equal min",
-			capRange: &csi.CapacityRange{
-				LimitBytes: MinimumVolumeSizeInBytes,
-			},
-			expCap: MinimumVolumeSizeInBytes,
+			name:       "unsupported disk type",
+			params:     map[string]string{common.ParameterKeyType: "pd-ssd", common.ParameterKeyProvisionedIOPS: "20000"},
+			sizeGb:     500,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "success: limit above min",
-			capRange: &csi.CapacityRange{
-				LimitBytes: MinimumVolumeSizeInBytes + 1,
-			},
-			expCap: MinimumVolumeSizeInBytes,
+			name:             "hyperdisk-balanced",
+			params:           map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyProvisionedIOPS: "5000"},
+			sizeGb:           100,
+			expVolumeContext: map[string]string{common.VolumeAttributeProvisionedIOPS: "5000"},
 		},
 		{
-			name: "success: fully specified both above min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: common.GbToBytes(20),
-				LimitBytes:    common.GbToBytes(50),
-			},
-			expCap: common.GbToBytes(20),
+			name:       "hyperdisk-balanced iops above size limit",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyProvisionedIOPS: "50000"},
+			sizeGb:     20,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "success: fully specified required below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 1,
-				LimitBytes:    common.GbToBytes(50),
-			},
-			expCap: MinimumVolumeSizeInBytes,
+			name:       "hyperdisk-throughput with iops",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-throughput", common.ParameterKeyProvisionedIOPS: "5000"},
+			sizeGb:     2048,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "success: fully specified both below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 2,
-				LimitBytes:    MinimumVolumeSizeInBytes - 1,
+			name: "regional hyperdisk",
+			params: map[string]string{
+				common.ParameterKeyType:            "hyperdisk-balanced",
+				common.ParameterKeyReplicationType: "regional-pd",
+				common.ParameterKeyProvisionedIOPS: "5000",
 			},
-			expErr: true,
+			sizeGb:     100,
+			expErrCode: codes.InvalidArgument,
 		},
-		{
-			name: "fail: limit less than required",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: common.GbToBytes(50),
-				LimitBytes:    common.GbToBytes(20),
+	}
+	for _, tc := range testCases {
+		gceDriver := initGCEDriver(t, nil)
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "test-name",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: common.GbToBytes(tc.sizeGb)},
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         tc.params,
+		})
+		if tc.expErrCode != codes.OK {
+			if status.Code(err) != tc.expErrCode {
+				t.Errorf("%s: got error %v, expected code %v", tc.name, err, tc.expErrCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: CreateVolume failed: %v", tc.name, err)
+			continue
+		}
+		if got := resp.GetVolume().GetVolumeContext(); !reflect.DeepEqual(got, tc.expVolumeContext) {
+			t.Errorf("%s: got volume context %v, expected %v", tc.name, got, tc.expVolumeContext)
+		}
+	}
+}
+
+func TestCreateVolumeFromSnapshotProvisionedPerformance(t *testing.T) {
+	snapshotSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: testSnapshotID,
 			},
-			expErr: true,
 		},
+	}
+	testCases := []struct {
+		name       string
+		params     map[string]string
+		sizeGb     int64
+		expErrCode codes.Code
+		expIOPS    int64
+	}{
 		{
-			name: "fail: limit less than required below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 2,
-				LimitBytes:    MinimumVolumeSizeInBytes - 3,
-			},
-			expErr: true,
+			name:    "iops override",
+			params:  map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyProvisionedIOPS: "5000"},
+			sizeGb:  100,
+			expIOPS: 5000,
+		},
+		{
+			name:   "no override",
+			params: map[string]string{common.ParameterKeyType: "hyperdisk-balanced"},
+			sizeGb: 100,
+		},
+		{
+			name:       "iops override beyond the size of the restored disk",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyProvisionedIOPS: "50000"},
+			sizeGb:     10,
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "iops override on hyperdisk-throughput",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-throughput", common.ParameterKeyProvisionedIOPS: "5000"},
+			sizeGb:     2048,
+			expErrCode: codes.InvalidArgument,
 		},
 	}
 	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
-
-		gotCap, err := getRequestCapacity(tc.capRange)
-		if err == nil && tc.expErr {
-			t.Fatalf("Expected error but got none")
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, nil)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
 		}
-		if err != nil && !tc.expErr {
-			t.Fatalf("Did not expect error but got: %v", err)
+		gceDriver := initGCEDriverWithCloudProvider(t, fcp)
+		fcp.CreateSnapshot(context.Background(), meta.ZonalKey("my-disk", zone), name, nil)
+		_, err = gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                "test-name",
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: common.GbToBytes(tc.sizeGb)},
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          tc.params,
+			VolumeContentSource: snapshotSource,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
 		}
-
 		if err != nil {
 			continue
 		}
-
-		if gotCap != tc.expCap {
-			t.Fatalf("Got capacity: %v, expected: %v", gotCap, tc.expCap)
+		disk, err := fcp.GetDisk(context.Background(), meta.ZonalKey("test-name", zone), gce.GCEAPIVersionAlpha)
+		if err != nil {
+			t.Errorf("%s: failed to get restored disk: %v", tc.name, err)
+			continue
+		}
+		if disk.GetSnapshotId() == "" {
+			t.Errorf("%s: restored disk has no source snapshot", tc.name)
+		}
+		if iops := disk.GetProvisionedIops(); iops != tc.expIOPS {
+			t.Errorf("%s: got provisioned iops %d, expected %d", tc.name, iops, tc.expIOPS)
 		}
 	}
 }
 
-func TestDiskIsAttached(t *testing.T) {
+func TestCreateVolumeFromSnapshotInOtherLocation(t *testing.T) {
+	otherZone := "country-otherregion-a"
+	otherSecondZone := "country-otherregion-b"
+	zoneTopology := func(zones ...string) []*csi.Topology {
+		var tops []*csi.Topology
+		for _, z := range zones {
+			tops = append(tops, &csi.Topology{Segments: map[string]string{common.TopologyKeyZone: z}})
+		}
+		return tops
+	}
 	testCases := []struct {
-		name        string
-		deviceName  string
-		instance    *compute.Instance
-		expAttached bool
+		name      string
+		params    map[string]string
+		requisite []*csi.Topology
+		preferred []*csi.Topology
+		expZones  []string
 	}{
 		{
-			name:       "normal-attached",
-			deviceName: "test-disk",
-			instance: &compute.Instance{
-				Disks: []*compute.AttachedDisk{
-					{
-						DeviceName: "test-disk",
-					},
-				},
-			},
-			expAttached: true,
+			name:      "other zone",
+			requisite: zoneTopology(secondZone),
+			expZones:  []string{secondZone},
 		},
 		{
-			name:       "normal-not-attached",
-			deviceName: "test-disk",
-			instance: &compute.Instance{
-				Disks: []*compute.AttachedDisk{
-					{
-						DeviceName: "not-the-test-disk",
-					},
-				},
+			name:      "other region",
+			requisite: zoneTopology(otherZone, otherSecondZone),
+			preferred: zoneTopology(otherSecondZone),
+			expZones:  []string{otherSecondZone},
+		},
+		{
+			name:      "regional disk",
+			params:    map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			requisite: zoneTopology(zone, secondZone),
+			expZones:  []string{secondZone, zone},
+		},
+		{
+			name:   "regional disk in region topology",
+			params: map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			requisite: []*csi.Topology{
+				{Segments: map[string]string{common.TopologyKeyRegion: region}},
 			},
-			expAttached: false,
+			expZones: []string{secondZone, zone},
+		},
+		{
+			name:      "regional disk in other region",
+			params:    map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			requisite: zoneTopology(otherZone, otherSecondZone),
+			expZones:  []string{otherZone, otherSecondZone},
 		},
 	}
 	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
-		if attached := diskIsAttached(tc.deviceName, tc.instance); attached != tc.expAttached {
-			t.Errorf("Expected disk attached to be %v, but got %v", tc.expAttached, attached)
+		gceDriver := initGCEDriver(t, nil)
+		// The snapshot is taken of a disk in zone.
+		gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), meta.ZonalKey("my-disk", zone), name, nil)
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "test-name",
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         tc.params,
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Requisite: tc.requisite,
+				Preferred: tc.preferred,
+			},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: testSnapshotID},
+				},
+			},
+		})
+		if err != nil {
+			t.Errorf("%s: CreateVolume failed: %v", tc.name, err)
+			continue
+		}
+		vol := resp.GetVolume()
+		if vol.GetContentSource().GetSnapshot().GetSnapshotId() != testSnapshotID {
+			t.Errorf("%s: got content source %v, expected snapshot %s", tc.name, vol.GetContentSource(), testSnapshotID)
+		}
+		var zones []string
+		for _, top := range vol.GetAccessibleTopology() {
+			zones = append(zones, top.GetSegments()[common.TopologyKeyZone])
+		}
+		sort.Strings(zones)
+		if !reflect.DeepEqual(zones, tc.expZones) {
+			t.Errorf("%s: got zones %v, expected %v", tc.name, zones, tc.expZones)
+		}
+		volKey, err := common.VolumeIDToKey(vol.GetVolumeId())
+		if err != nil {
+			t.Errorf("%s: invalid volume ID %s: %v", tc.name, vol.GetVolumeId(), err)
+			continue
+		}
+		expRegion, _ := common.GetRegionFromZones(tc.expZones[:1])
+		if volKey.Type() == meta.Regional && volKey.Region != expRegion {
+			t.Errorf("%s: got region %s, expected %s", tc.name, volKey.Region, expRegion)
+		}
+		if volKey.Type() == meta.Zonal && volKey.Zone != tc.expZones[0] {
+			t.Errorf("%s: got zone %s, expected %s", tc.name, volKey.Zone, tc.expZones[0])
 		}
 	}
 }
 
-func TestDiskIsAttachedAndCompatible(t *testing.T) {
+func TestCreateVolumeReadOnlyRestore(t *testing.T) {
+	snapshotSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: testSnapshotID,
+			},
+		},
+	}
+	readOnlyVolCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+		},
+	}
 	testCases := []struct {
-		name        string
-		deviceName  string
-		instance    *compute.Instance
-		mode        string
-		expAttached bool
-		expErr      bool
+		name             string
+		source           *csi.VolumeContentSource
+		volCaps          []*csi.VolumeCapability
+		expErrCode       codes.Code
+		expVolumeContext map[string]string
 	}{
 		{
-			name:       "normal-attached",
-			deviceName: "test-disk",
-			instance: &compute.Instance{
-				Disks: []*compute.AttachedDisk{
-					{
-						DeviceName: "test-disk",
-						Mode:       "test-mode",
-					},
-				},
-			},
-			mode:        "test-mode",
-			expAttached: true,
+			name:             "from snapshot",
+			source:           snapshotSource,
+			volCaps:          readOnlyVolCaps,
+			expVolumeContext: map[string]string{common.VolumeAttributeReadOnly: "true"},
 		},
 		{
-			name:       "normal-not-attached",
-			deviceName: "test-disk",
-			instance: &compute.Instance{
-				Disks: []*compute.AttachedDisk{
-					{
-						DeviceName: "not-the-test-disk",
-						Mode:       "test-mode",
-					},
-				},
-			},
-			mode:        "test-mode",
-			expAttached: false,
+			name:       "without snapshot",
+			volCaps:    readOnlyVolCaps,
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name:       "incompatible mode",
-			deviceName: "test-disk",
-			instance: &compute.Instance{
-				Disks: []*compute.AttachedDisk{
-					{
-						DeviceName: "test-disk",
-						Mode:       "test-mode",
-					},
-				},
-			},
-			mode:        "random-mode",
-			expAttached: true,
-			expErr:      true,
+			name:       "writable access mode",
+			source:     snapshotSource,
+			volCaps:    stdVolCaps,
+			expErrCode: codes.InvalidArgument,
 		},
 	}
 	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
-		attached, err := diskIsAttachedAndCompatible(tc.deviceName, tc.instance, nil, tc.mode)
-		if err != nil && !tc.expErr {
-			t.Errorf("Did not expect error but got: %v", err)
+		gceDriver := initGCEDriver(t, nil)
+		gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), meta.ZonalKey("my-disk", zone), name, nil)
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                "test-name",
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  tc.volCaps,
+			Parameters:          map[string]string{common.ParameterKeyReadOnlyRestore: "true"},
+			VolumeContentSource: tc.source,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
 		}
-		if err == nil && tc.expErr {
-			t.Errorf("Expected error but got none")
+		if err != nil {
+			continue
 		}
-		if attached != tc.expAttached {
-			t.Errorf("Expected disk attached to be %v, but got %v", tc.expAttached, attached)
+		if got := resp.GetVolume().GetVolumeContext(); !reflect.DeepEqual(got, tc.expVolumeContext) {
+			t.Errorf("%s: got volume context %v, expected %v", tc.name, got, tc.expVolumeContext)
 		}
 	}
 }
 
-func TestGetZonesFromTopology(t *testing.T) {
+// kmsDeniedCloudProvider fails disk inserts like GCE does when the Compute
+// Engine service agent may not use the KMS key of the disk.
+type kmsDeniedCloudProvider struct {
+	*gce.FakeCloudProvider
+}
+
+func (cloud *kmsDeniedCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error {
+	return &googleapi.Error{
+		Code:    http.StatusBadRequest,
+		Message: fmt.Sprintf("Cloud KMS error when using key %s: Permission 'cloudkms.cryptoKeyVersions.useToEncrypt' denied on resource", params.DiskEncryptionKMSKey),
+	}
+}
+
+func TestCreateVolumeDiskEncryptionKMSKey(t *testing.T) {
+	kmsKey := "projects/kms-project/locations/us-central1/keyRings/ring/cryptoKeys/key"
+	snapshotSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: testSnapshotID,
+			},
+		},
+	}
 	testCases := []struct {
-		name     string
-		topology []*csi.Topology
-		expZones sets.String
-		expErr   bool
+		name       string
+		source     *csi.VolumeContentSource
+		kmsKey     string
+		kmsDenied  bool
+		expErrCode codes.Code
 	}{
 		{
-			name: "succes: normal",
-			topology: []*csi.Topology{
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
-				},
-			},
-			expZones: sets.NewString([]string{"test-zone"}...),
+			name:   "new disk",
+			kmsKey: kmsKey,
 		},
 		{
-			name: "succes: multiple topologies",
-			topology: []*csi.Topology{
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
-				},
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone2"},
-				},
-			},
-			expZones: sets.NewString([]string{"test-zone", "test-zone2"}...),
+			name:   "restored disk",
+			source: snapshotSource,
+			kmsKey: kmsKey,
 		},
 		{
-			name: "fail: wrong key",
-			topology: []*csi.Topology{
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
-				},
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone2"},
-				},
-				{
-					Segments: map[string]string{"fake-key": "fake-value"},
-				},
-			},
-			expErr: true,
+			name:       "invalid key name",
+			kmsKey:     "ring/key",
+			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "success: duplicate",
-			topology: []*csi.Topology{
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
-				},
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
-				},
-			},
-			expZones: sets.NewString([]string{"test-zone"}...),
+			name:       "key access denied",
+			kmsKey:     kmsKey,
+			kmsDenied:  true,
+			expErrCode: codes.PermissionDenied,
 		},
+	}
+	for _, tc := range testCases {
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, nil)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		var cloudProvider gce.GCECompute = fcp
+		if tc.kmsDenied {
+			cloudProvider = &kmsDeniedCloudProvider{FakeCloudProvider: fcp}
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, cloudProvider)
+		fcp.CreateSnapshot(context.Background(), meta.ZonalKey("my-disk", zone), name, nil)
+		_, err = gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                "test-name",
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          map[string]string{common.ParameterKeyDiskEncryptionKmsKey: tc.kmsKey},
+			VolumeContentSource: tc.source,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		disk, err := fcp.GetDisk(context.Background(), meta.ZonalKey("test-name", zone), gce.GCEAPIVersionV1)
+		if err != nil {
+			t.Errorf("%s: failed to get disk: %v", tc.name, err)
+			continue
+		}
+		if got := disk.GetKMSKeyName(); got != tc.kmsKey {
+			t.Errorf("%s: got KMS key %q, expected %q", tc.name, got, tc.kmsKey)
+		}
+		if tc.source != nil && disk.GetSnapshotId() == "" {
+			t.Errorf("%s: restored disk has no source snapshot", tc.name)
+		}
+	}
+}
+
+func TestCreateVolumeExistingMultiWriterDisk(t *testing.T) {
+	createDisk := func(multiWriter bool) *gce.CloudDisk {
+		return gce.CloudDiskFromBeta(&computebeta.Disk{
+			Name:        name,
+			SizeGb:      20,
+			Type:        fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-ssd", project, zone),
+			SelfLink:    fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+			Zone:        zone,
+			Status:      "READY",
+			MultiWriter: multiWriter,
+		})
+	}
+	req := &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		Parameters:         map[string]string{common.ParameterKeyType: "pd-ssd"},
+	}
+	testCases := []struct {
+		name       string
+		disks      []*gce.CloudDisk
+		expErrCode codes.Code
+	}{
 		{
-			name:     "success: empty",
-			topology: []*csi.Topology{},
-			expZones: sets.NewString(),
+			name: "created by an earlier request",
 		},
 		{
-			name: "fail: wrong key inside",
-			topology: []*csi.Topology{
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone", "fake-key": "fake-value"},
-				},
-				{
-					Segments: map[string]string{common.TopologyKeyZone: "test-zone2"},
-				},
-			},
-			expErr: true,
+			name:  "pre-created multi-writer disk",
+			disks: []*gce.CloudDisk{createDisk(true)},
 		},
 		{
-			name:     "success: no topology",
-			expZones: sets.NewString(),
+			name:       "pre-created single-writer disk",
+			disks:      []*gce.CloudDisk{createDisk(false)},
+			expErrCode: codes.AlreadyExists,
 		},
 	}
 	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
-		gotZones, err := getZonesFromTopology(tc.topology)
-		if err != nil && !tc.expErr {
-			t.Errorf("Did not expect error but got: %v", err)
-		}
-		if err == nil && tc.expErr {
-			t.Errorf("Expected error but got none")
+		gceDriver := initGCEDriver(t, tc.disks)
+		if tc.disks == nil {
+			if _, err := gceDriver.cs.CreateVolume(context.Background(), req); err != nil {
+				t.Errorf("%s: first CreateVolume failed: %v", tc.name, err)
+				continue
+			}
 		}
-
-		gotZonesSet := sets.NewString(gotZones...)
-		if !gotZonesSet.Equal(tc.expZones) {
-			t.Errorf("Expected zones: %v, instead got: %v", tc.expZones, gotZonesSet)
+		_, err := gceDriver.cs.CreateVolume(context.Background(), req)
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
 		}
 	}
 }
 
-func TestPickZonesFromTopology(t *testing.T) {
+func TestCreateVolumeExistingProvisionedIOPSDisk(t *testing.T) {
+	createReq := func(iops string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: common.GbToBytes(500)},
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         map[string]string{common.ParameterKeyType: "pd-extreme", common.ParameterKeyProvisionedIOPS: iops},
+		}
+	}
 	testCases := []struct {
-		name     string
-		top      *csi.TopologyRequirement
-		numZones int
-		expZones []string
-		expErr   bool
+		name       string
+		firstIOPS  string
+		secondIOPS string
+		expErrCode codes.Code
 	}{
 		{
-			name: "success: preferred",
-			top: &csi.TopologyRequirement{
-				Requisite: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
+			name:       "same iops",
+			firstIOPS:  "20000",
+			secondIOPS: "20000",
+		},
+		{
+			name:       "different iops",
+			firstIOPS:  "20000",
+			secondIOPS: "30000",
+			expErrCode: codes.AlreadyExists,
+		},
+	}
+	for _, tc := range testCases {
+		gceDriver := initGCEDriver(t, nil)
+		if _, err := gceDriver.cs.CreateVolume(context.Background(), createReq(tc.firstIOPS)); err != nil {
+			t.Errorf("%s: first CreateVolume failed: %v", tc.name, err)
+			continue
+		}
+		_, err := gceDriver.cs.CreateVolume(context.Background(), createReq(tc.secondIOPS))
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+		}
+	}
+}
+
+func TestCreateVolumeRandomRequisiteTopology(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-name",
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         map[string]string{"type": "test-type"},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
 				},
-				Preferred: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+				},
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
 				},
 			},
-			numZones: 2,
-			expZones: []string{"topology-zone2", "topology-zone3"},
 		},
-		{
-			name: "success: preferred and requisite",
-			top: &csi.TopologyRequirement{
-				Requisite: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone5"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone6"},
-					},
-				},
-				Preferred: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
+	}
+
+	gceDriver := initGCEDriver(t, nil)
+
+	tZones := map[string]bool{}
+	// Start Test
+	for i := 0; i < 25; i++ {
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateVolume did not expect error, but got %v", err)
+		}
+		tZone, ok := resp.GetVolume().GetAccessibleTopology()[0].GetSegments()[common.TopologyKeyZone]
+		if !ok {
+			t.Fatalf("Could not find topology zone in response")
+		}
+		tZones[tZone] = true
+	}
+	// We expect that we should have picked all 3 topology zones here
+	if len(tZones) != 3 {
+		t.Fatalf("Expected all 3 topology zones to be rotated through, got only: %v", tZones)
+	}
+}
+
+func TestCreateVolumeTopologyAliases(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-name",
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{
+				{
+					Segments: map[string]string{"example.com/zone": "dc1-a"},
 				},
 			},
-			numZones: 5,
-			expZones: []string{"topology-zone2", "topology-zone3", "topology-zone1", "topology-zone5", "topology-zone6"},
 		},
+	}
+
+	gceDriver := initGCEDriver(t, nil)
+	if _, err := gceDriver.cs.CreateVolume(context.Background(), req); err == nil {
+		t.Fatalf("CreateVolume with an unknown zone key expected error, got none")
+	}
+
+	gceDriver.cs.SetTopologyAliases(common.TopologyAliases{
+		ZoneKeys: []string{"example.com/zone"},
+		Zones:    map[string]string{"dc1-a": "us-central1-a"},
+	})
+	resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume did not expect error, but got %v", err)
+	}
+	expTopology := []*csi.Topology{{Segments: map[string]string{common.TopologyKeyZone: "us-central1-a"}}}
+	if !reflect.DeepEqual(resp.GetVolume().GetAccessibleTopology(), expTopology) {
+		t.Errorf("got accessible topology %v, expected %v", resp.GetVolume().GetAccessibleTopology(), expTopology)
+	}
+	if _, ok := req.GetAccessibilityRequirements().GetRequisite()[0].GetSegments()[common.TopologyKeyZone]; ok {
+		t.Errorf("CreateVolume modified the request topology")
+	}
+}
+
+func createZonalCloudDisk(name string) *gce.CloudDisk {
+	return gce.CloudDiskFromV1(&compute.Disk{
+		Name: name,
+	})
+}
+
+func createDriverZonalCloudDisk(name, description string) *gce.CloudDisk {
+	return gce.CloudDiskFromV1(&compute.Disk{
+		Name:        name,
+		Description: description,
+	})
+}
+
+func TestDeleteVolume(t *testing.T) {
+	testCases := []struct {
+		name               string
+		seedDisks          []*gce.CloudDisk
+		allowUnownedDelete bool
+		req                *csi.DeleteVolumeRequest
+		expErr             bool
+	}{
 		{
-			name: "fail: not enough topologies",
-			top: &csi.TopologyRequirement{
-				Requisite: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
-				},
-				Preferred: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
-				},
+			name: "valid",
+			seedDisks: []*gce.CloudDisk{
+				createDriverZonalCloudDisk(name, "Disk created by GCE-PD CSI Driver"),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
 			},
-			numZones: 4,
-			expErr:   true,
 		},
 		{
-			name: "success: only requisite",
-			top: &csi.TopologyRequirement{
-				Requisite: []*csi.Topology{
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
-					},
-					{
-						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
-					},
-				},
+			name: "invalid id",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID + "/foo",
 			},
-			numZones: 3,
-			expZones: []string{"topology-zone2", "topology-zone3", "topology-zone1"},
+			expErr: false,
 		},
-	}
+		{
+			name: "repairable ID",
+			seedDisks: []*gce.CloudDisk{
+				createDriverZonalCloudDisk(name, "Disk created by GCE-PD CSI Driver"),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: common.GenerateUnderspecifiedVolumeID(name, true /* isZonal */),
+			},
+			expErr: false,
+		},
+		{
+			name: "non-repairable ID (invalid)",
+			seedDisks: []*gce.CloudDisk{
+				createZonalCloudDisk("nottherightname"),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: common.GenerateUnderspecifiedVolumeID(name, true /* isZonal */),
+			},
+			expErr: false,
+		},
+		{
+			name: "created by driver with tags",
+			seedDisks: []*gce.CloudDisk{
+				createDriverZonalCloudDisk(name, fmt.Sprintf(`{"kubernetes.io/created-for/pvc/name":"test-pvc","storage.gke.io/created-by":%q}`, driver)),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
+			},
+		},
+		{
+			name: "created by another driver",
+			seedDisks: []*gce.CloudDisk{
+				createDriverZonalCloudDisk(name, `{"storage.gke.io/created-by":"other-driver"}`),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
+			},
+			expErr: true,
+		},
+		{
+			name: "not created by driver",
+			seedDisks: []*gce.CloudDisk{
+				createZonalCloudDisk(name),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
+			},
+			expErr: true,
+		},
+		{
+			name: "created by in-tree provisioner",
+			seedDisks: []*gce.CloudDisk{
+				createDriverZonalCloudDisk("kubernetes-dynamic-pvc-3b9a0f1e-5c4d-4e2b-9a7f-2d1c0b8e6f5a", `{"kubernetes.io/created-for/pv/name":"pvc-3b9a0f1e-5c4d-4e2b-9a7f-2d1c0b8e6f5a"}`),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: common.CreateZonalVolumeID(project, zone, "kubernetes-dynamic-pvc-3b9a0f1e-5c4d-4e2b-9a7f-2d1c0b8e6f5a"),
+			},
+		},
+		{
+			name: "not created by driver with unowned delete allowed",
+			seedDisks: []*gce.CloudDisk{
+				createZonalCloudDisk(name),
+			},
+			allowUnownedDelete: true,
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
+			},
+		},
+	}
 	for _, tc := range testCases {
 		t.Logf("test case: %s", tc.name)
-		gotZones, err := pickZonesFromTopology(tc.top, tc.numZones)
+		// Setup new driver each time so no interference
+		gceDriver := initGCEDriver(t, tc.seedDisks)
+		gceDriver.cs.allowUnownedDelete = tc.allowUnownedDelete
+
+		_, err := gceDriver.cs.DeleteVolume(context.Background(), tc.req)
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
 		if err != nil && !tc.expErr {
 			t.Errorf("Did not expect error but got: %v", err)
 		}
-		if err == nil && tc.expErr {
-			t.Errorf("Expected error but got none")
+
+		if err != nil {
+			continue
+		}
+
+	}
+}
+
+func TestGetRequestCapacity(t *testing.T) {
+	testCases := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		expCap   int64
+		expErr   bool
+	}{
+		{
+			name:     "nil cap range",
+			capRange: nil,
+			expCap:   MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: required below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 1,
+			},
+			expCap: MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: required equals min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes,
+			},
+			expCap: MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: required above min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes + 1,
+			},
+			expCap: MinimumVolumeSizeInBytes + 1,
+		},
+		{
+			name: "fail: limit below min",
+			capRange: &csi.CapacityRange{
+				LimitBytes: MinimumVolumeSizeInBytes - 1,
+			},
+			expErr: true,
+		},
+		{
+			name: "success: limit equal min",
+			capRange: &csi.CapacityRange{
+				LimitBytes: MinimumVolumeSizeInBytes,
+			},
+			expCap: MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: limit above min",
+			capRange: &csi.CapacityRange{
+				LimitBytes: MinimumVolumeSizeInBytes + 1,
+			},
+			expCap: MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: fully specified both above min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: common.GbToBytes(20),
+				LimitBytes:    common.GbToBytes(50),
+			},
+			expCap: common.GbToBytes(20),
+		},
+		{
+			name: "success: fully specified required below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 1,
+				LimitBytes:    common.GbToBytes(50),
+			},
+			expCap: MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: fully specified both below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 2,
+				LimitBytes:    MinimumVolumeSizeInBytes - 1,
+			},
+			expErr: true,
+		},
+		{
+			name: "fail: limit less than required",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: common.GbToBytes(50),
+				LimitBytes:    common.GbToBytes(20),
+			},
+			expErr: true,
+		},
+		{
+			name: "fail: limit less than required below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 2,
+				LimitBytes:    MinimumVolumeSizeInBytes - 3,
+			},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		gotCap, err := getRequestCapacity(tc.capRange)
+		if err == nil && tc.expErr {
+			t.Fatalf("Expected error but got none")
+		}
+		if err != nil && !tc.expErr {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if gotCap != tc.expCap {
+			t.Fatalf("Got capacity: %v, expected: %v", gotCap, tc.expCap)
+		}
+	}
+}
+
+func TestDiskIsAttached(t *testing.T) {
+	testCases := []struct {
+		name        string
+		deviceName  string
+		instance    *compute.Instance
+		expAttached bool
+	}{
+		{
+			name:       "normal-attached",
+			deviceName: "test-disk",
+			instance: &compute.Instance{
+				Disks: []*compute.AttachedDisk{
+					{
+						DeviceName: "test-disk",
+					},
+				},
+			},
+			expAttached: true,
+		},
+		{
+			name:       "normal-not-attached",
+			deviceName: "test-disk",
+			instance: &compute.Instance{
+				Disks: []*compute.AttachedDisk{
+					{
+						DeviceName: "not-the-test-disk",
+					},
+				},
+			},
+			expAttached: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if attached := diskIsAttached(tc.deviceName, tc.instance); attached != tc.expAttached {
+			t.Errorf("Expected disk attached to be %v, but got %v", tc.expAttached, attached)
+		}
+	}
+}
+
+func TestDiskIsAttachedAndCompatible(t *testing.T) {
+	testCases := []struct {
+		name          string
+		deviceName    string
+		instance      *compute.Instance
+		mode          string
+		diskInterface string
+		expAttached   bool
+		expErr        bool
+	}{
+		{
+			name:       "normal-attached",
+			deviceName: "test-disk",
+			instance: &compute.Instance{
+				Disks: []*compute.AttachedDisk{
+					{
+						DeviceName: "test-disk",
+						Mode:       "test-mode",
+					},
+				},
+			},
+			mode:        "test-mode",
+			expAttached: true,
+		},
+		{
+			name:       "normal-not-attached",
+			deviceName: "test-disk",
+			instance: &compute.Instance{
+				Disks: []*compute.AttachedDisk{
+					{
+						DeviceName: "not-the-test-disk",
+						Mode:       "test-mode",
+					},
+				},
+			},
+			mode:        "test-mode",
+			expAttached: false,
+		},
+		{
+			name:       "incompatible mode",
+			deviceName: "test-disk",
+			instance: &compute.Instance{
+				Disks: []*compute.AttachedDisk{
+					{
+						DeviceName: "test-disk",
+						Mode:       "test-mode",
+					},
+				},
+			},
+			mode:        "random-mode",
+			expAttached: true,
+			expErr:      true,
+		},
+		{
+			name:       "incompatible interface",
+			deviceName: "test-disk",
+			instance: &compute.Instance{
+				Disks: []*compute.AttachedDisk{
+					{
+						DeviceName: "test-disk",
+						Mode:       "test-mode",
+						Interface:  "SCSI",
+					},
+				},
+			},
+			mode:          "test-mode",
+			diskInterface: "NVME",
+			expAttached:   true,
+			expErr:        true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		attached, err := diskIsAttachedAndCompatible(tc.deviceName, tc.instance, nil, tc.mode, tc.diskInterface)
+		if err != nil && !tc.expErr {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+		if attached != tc.expAttached {
+			t.Errorf("Expected disk attached to be %v, but got %v", tc.expAttached, attached)
+		}
+	}
+}
+
+func TestGetZonesFromTopology(t *testing.T) {
+	testCases := []struct {
+		name     string
+		topology []*csi.Topology
+		expZones sets.String
+		expErr   bool
+	}{
+		{
+			name: "succes: normal",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
+				},
+			},
+			expZones: sets.NewString([]string{"test-zone"}...),
+		},
+		{
+			name: "succes: multiple topologies",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
+				},
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone2"},
+				},
+			},
+			expZones: sets.NewString([]string{"test-zone", "test-zone2"}...),
+		},
+		{
+			name: "fail: wrong key",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
+				},
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone2"},
+				},
+				{
+					Segments: map[string]string{"fake-key": "fake-value"},
+				},
+			},
+			expErr: true,
+		},
+		{
+			name: "success: duplicate",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
+				},
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone"},
+				},
+			},
+			expZones: sets.NewString([]string{"test-zone"}...),
+		},
+		{
+			name:     "success: empty",
+			topology: []*csi.Topology{},
+			expZones: sets.NewString(),
+		},
+		{
+			name: "success: zone and matching region",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "country-region-zone", common.TopologyKeyRegion: "country-region"},
+				},
+			},
+			expZones: sets.NewString([]string{"country-region-zone"}...),
+		},
+		{
+			name: "success: region is ignored",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "country-region-zone", common.TopologyKeyRegion: "country-otherregion"},
+				},
+			},
+			expZones: sets.NewString([]string{"country-region-zone"}...),
+		},
+		{
+			name: "fail: wrong key inside",
+			topology: []*csi.Topology{
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone", "fake-key": "fake-value"},
+				},
+				{
+					Segments: map[string]string{common.TopologyKeyZone: "test-zone2"},
+				},
+			},
+			expErr: true,
+		},
+		{
+			name:     "success: no topology",
+			expZones: sets.NewString(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gotZones, err := getZonesFromTopology(tc.topology)
+		if err != nil && !tc.expErr {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+
+		gotZonesSet := sets.NewString(gotZones...)
+		if !gotZonesSet.Equal(tc.expZones) {
+			t.Errorf("Expected zones: %v, instead got: %v", tc.expZones, gotZonesSet)
+		}
+	}
+}
+
+func TestPickZonesFromTopology(t *testing.T) {
+	testCases := []struct {
+		name     string
+		top      *csi.TopologyRequirement
+		numZones int
+		expZones []string
+		expErr   bool
+	}{
+		{
+			name: "success: preferred",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+				},
+				Preferred: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+				},
+			},
+			numZones: 2,
+			expZones: []string{"topology-zone2", "topology-zone3"},
+		},
+		{
+			name: "success: preferred and requisite",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone5"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone6"},
+					},
+				},
+				Preferred: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+				},
+			},
+			numZones: 5,
+			expZones: []string{"topology-zone2", "topology-zone3", "topology-zone1", "topology-zone5", "topology-zone6"},
+		},
+		{
+			name: "fail: not enough topologies",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+				},
+				Preferred: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+				},
+			},
+			numZones: 4,
+			expErr:   true,
+		},
+		{
+			name: "success: only requisite",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone3"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2"},
+					},
+				},
+			},
+			numZones: 3,
+			expZones: []string{"topology-zone2", "topology-zone3", "topology-zone1"},
+		},
+		{
+			name: "success: zones repeated by filesystem keys",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1", common.TopologyKeyFilesystems: "ext4"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone2", common.TopologyKeyFilesystems: "ext4"},
+					},
+				},
+				Preferred: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1", common.TopologyKeyFilesystems: "ext4"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: "topology-zone1", common.TopologyKeyFilesystems: "xfs"},
+					},
+				},
+			},
+			numZones: 2,
+			expZones: []string{"topology-zone1", "topology-zone2"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gotZones, err := pickZonesFromTopology(tc.top, tc.numZones)
+		if err != nil && !tc.expErr {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+		if len(gotZones) != len(tc.expZones) || !sets.NewString(gotZones...).Equal(sets.NewString(tc.expZones...)) {
+			t.Errorf("Expected zones: %v, but got: %v", tc.expZones, gotZones)
+		}
+	}
+}
+
+func TestPickRandAndConsecutive(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	testCases := []struct {
+		name   string
+		slice  []string
+		n      int
+		expErr bool
+	}{
+		{
+			name:  "success: normal",
+			slice: []string{"test", "second", "third"},
+			n:     2,
+		},
+		{
+			name:  "success: full",
+			slice: []string{"test", "second", "third"},
+			n:     3,
+		},
+		{
+			name:  "success: large",
+			slice: []string{"test", "second", "third", "fourth", "fifth", "sixth"},
+			n:     2,
+		},
+		{
+			name:   "fail: n too large",
+			slice:  []string{},
+			n:      2,
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		tot := sets.String{}
+		sort.Strings(tc.slice)
+		for i := 0; i < 25; i++ {
+			theslice, err := pickRandAndConsecutive(tc.slice, tc.n)
+			if err != nil && !tc.expErr {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			if err == nil && tc.expErr {
+				t.Errorf("Expected error but got none")
+			}
+			if err != nil {
+				break
+			}
+			if len(theslice) != tc.n {
+				t.Errorf("expected the resulting slice to be length %v, but got %v instead", tc.n, theslice)
+			}
+			// Find where it is in the slice
+			var idx = -1
+			for j, elem := range tc.slice {
+				if elem == theslice[0] {
+					idx = j
+					break
+				}
+			}
+			if idx == -1 {
+				t.Errorf("could not find %v in the original slice %v", theslice[0], tc.slice)
+			}
+			for j := 0; j < tc.n; j++ {
+				if theslice[j] != tc.slice[(idx+j)%len(tc.slice)] {
+					t.Errorf("did not pick sorted consecutive values from the slice")
+				}
+			}
+
+			tot.Insert(theslice...)
+		}
+		if !tot.Equal(sets.NewString(tc.slice...)) {
+			t.Errorf("randomly picking n from slice did not get all %v, instead got only %v", tc.slice, tot)
+		}
+
+	}
+}
+
+func TestCodeForGCEError(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		expCode codes.Code
+	}{
+		{
+			name:    "not found",
+			err:     &googleapi.Error{Errors: []googleapi.ErrorItem{{Reason: "notFound"}}},
+			expCode: codes.NotFound,
+		},
+		{
+			name:    "wrapped quota exceeded",
+			err:     fmt.Errorf("failed cloud service attach disk call: %w", &googleapi.Error{Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}),
+			expCode: codes.ResourceExhausted,
+		},
+		{
+			name:    "rate limit exceeded",
+			err:     &googleapi.Error{Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}},
+			expCode: codes.ResourceExhausted,
+		},
+		{
+			name:    "unknown",
+			err:     fmt.Errorf("operation failed"),
+			expCode: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		if code := codeForGCEError(tc.err); code != tc.expCode {
+			t.Errorf("%s: got code %v, expected %v", tc.name, code, tc.expCode)
+		}
+	}
+}
+
+func TestGCEStatusError(t *testing.T) {
+	cause := fmt.Errorf("failed cloud service attach disk call: %w", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}})
+	err := gceStatusError(codes.ResourceExhausted, fmt.Sprintf("unknown Attach error: %v", cause), cause)
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("got code %v, expected %v", code, codes.ResourceExhausted)
+	}
+	if msg := status.Convert(err).Message(); msg != fmt.Sprintf("unknown Attach error: %v", cause) {
+		t.Errorf("got message %q", msg)
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		t.Errorf("expected %v to unwrap to a googleapi error", err)
+	}
+}
+
+func TestControllerPublishVolumeDiskInterface(t *testing.T) {
+	testCases := []struct {
+		name          string
+		machineType   string
+		attachedDisks []*compute.AttachedDisk
+		diskInterface string
+		expErrCode    codes.Code
+	}{
+		{
+			name:        "no interface",
+			machineType: "n2-standard-4",
+		},
+		{
+			name:          "nvme",
+			machineType:   "n2-standard-4",
+			diskInterface: common.DiskInterfaceNVME,
+		},
+		{
+			name:          "scsi on nvme-only machine family",
+			machineType:   "c3-standard-4",
+			diskInterface: common.DiskInterfaceSCSI,
+			expErrCode:    codes.FailedPrecondition,
+		},
+		{
+			name:        "nvme on instance with scsi persistent disks",
+			machineType: "n2-standard-4",
+			attachedDisks: []*compute.AttachedDisk{
+				{DeviceName: "boot", Type: attachableDiskTypePersistent, Interface: common.DiskInterfaceSCSI},
+			},
+			diskInterface: common.DiskInterfaceNVME,
+			expErrCode:    codes.FailedPrecondition,
+		},
+		{
+			name:          "invalid interface",
+			machineType:   "n2-standard-4",
+			diskInterface: "IDE",
+			expErrCode:    codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		disk := gce.CloudDiskFromV1(&compute.Disk{
+			Name: name,
+			Type: fmt.Sprintf("zones/%s/diskTypes/pd-ssd", zone),
+		})
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{disk})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		instance := &compute.Instance{
+			Name:        node,
+			MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, tc.machineType),
+			Disks:       tc.attachedDisks,
+		}
+		fakeCloudProvider.InsertInstance(instance, zone, node)
+		gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+
+		req := &csi.ControllerPublishVolumeRequest{
+			VolumeId:         testVolumeID,
+			NodeId:           common.CreateNodeID(project, zone, node),
+			VolumeCapability: stdVolCap,
+		}
+		if tc.diskInterface != "" {
+			req.VolumeContext = map[string]string{common.VolumeAttributeDiskInterface: tc.diskInterface}
+		}
+		resp, err := gceDriver.cs.ControllerPublishVolume(context.Background(), req)
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("Expected error code %v, got %v: %v", tc.expErrCode, code, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := resp.GetPublishContext()[common.ContextKeyDiskInterface]; got != tc.diskInterface {
+			t.Errorf("Expected interface %q in publish context, got %q", tc.diskInterface, got)
+		}
+		if got := resp.GetPublishContext()[common.ContextKeyDiskType]; got != "pd-ssd" {
+			t.Errorf("Expected disk type pd-ssd in publish context, got %q", got)
+		}
+		attachedDisk := instance.Disks[len(instance.Disks)-1]
+		if attachedDisk.Interface != tc.diskInterface {
+			t.Errorf("Expected disk attached with interface %q, got %q", tc.diskInterface, attachedDisk.Interface)
+		}
+	}
+}
+
+func TestControllerPublishVolumeDiskType(t *testing.T) {
+	testCases := []struct {
+		name        string
+		machineType string
+		diskType    string
+		expErrCode  codes.Code
+	}{
+		{
+			name:        "pd on general purpose machine",
+			machineType: "n2-standard-4",
+			diskType:    "pd-balanced",
+		},
+		{
+			name:        "pd on hyperdisk-only machine",
+			machineType: "c4-standard-4",
+			diskType:    "pd-balanced",
+			expErrCode:  codes.FailedPrecondition,
+		},
+		{
+			name:        "hyperdisk on supported machine",
+			machineType: "c4-standard-4",
+			diskType:    "hyperdisk-balanced",
+		},
+		{
+			name:        "hyperdisk on unsupported machine",
+			machineType: "e2-standard-4",
+			diskType:    "hyperdisk-balanced",
+			expErrCode:  codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		disk := gce.CloudDiskFromV1(&compute.Disk{
+			Name: name,
+			Type: fmt.Sprintf("zones/%s/diskTypes/%s", zone, tc.diskType),
+		})
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{disk})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		instance := &compute.Instance{
+			Name:        node,
+			MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, tc.machineType),
+		}
+		fakeCloudProvider.InsertInstance(instance, zone, node)
+		gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+
+		_, err = gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         testVolumeID,
+			NodeId:           common.CreateNodeID(project, zone, node),
+			VolumeCapability: stdVolCap,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("Expected error code %v, got %v: %v", tc.expErrCode, code, err)
+		}
+	}
+}
+
+func TestControllerPublishVolumeReadOnlyAttribute(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	instance := &compute.Instance{
+		Name:        node,
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/n2-standard-4", zone),
+	}
+	fakeCloudProvider.InsertInstance(instance, zone, node)
+	gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+
+	_, err = gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         testVolumeID,
+		NodeId:           common.CreateNodeID(project, zone, node),
+		VolumeCapability: stdVolCap,
+		VolumeContext:    map[string]string{common.VolumeAttributeReadOnly: "true"},
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if len(instance.Disks) != 1 || instance.Disks[0].Mode != "READ_ONLY" {
+		t.Errorf("Expected disk attached read-only, got %+v", instance.Disks)
+	}
+}
+
+func TestControllerPublishVolumeWaitsForAttachLock(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	instance := &compute.Instance{
+		Name:        node,
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/n2-standard-4", zone),
+	}
+	fakeCloudProvider.InsertInstance(instance, zone, node)
+	gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         testVolumeID,
+		NodeId:           common.CreateNodeID(project, zone, node),
+		VolumeCapability: stdVolCap,
+	}
+
+	// A detach of the volume from another node holds the attach lock.
+	if !gceDriver.cs.attachLocks.TryAcquire(testVolumeID) {
+		t.Fatalf("Failed to acquire attach lock")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = gceDriver.cs.ControllerPublishVolume(ctx, req)
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("Expected error code %v when the request times out, got %v: %v", codes.Aborted, code, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("ControllerPublishVolume returned %v while the attach lock was held", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	gceDriver.cs.attachLocks.Release(testVolumeID)
+	if err := <-done; err != nil {
+		t.Errorf("ControllerPublishVolume failed once the attach lock was released: %v", err)
+	}
+	if len(instance.Disks) != 1 {
+		t.Errorf("Expected disk to be attached, got %v", instance.Disks)
+	}
+}
+
+func createMultiWriterCloudDisk(name string) *gce.CloudDisk {
+	return gce.CloudDiskFromBeta(&computebeta.Disk{
+		Name:        name,
+		Type:        fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-ssd", project, zone),
+		SelfLink:    fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+		Zone:        zone,
+		MultiWriter: true,
+	})
+}
+
+func TestControllerPublishVolumeAttachedElsewhere(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createMultiWriterCloudDisk(name)})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	nodes := []string{"node-a", "node-b"}
+	for _, n := range nodes {
+		fakeCloudProvider.InsertInstance(&compute.Instance{
+			Name:        n,
+			MachineType: fmt.Sprintf("zones/%s/machineTypes/n2-standard-4", zone),
+		}, zone, n)
+	}
+	gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+	publish := func(node string, volCap *csi.VolumeCapability) error {
+		_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         testVolumeID,
+			NodeId:           common.CreateNodeID(project, zone, node),
+			VolumeCapability: volCap,
+		})
+		return err
+	}
+
+	if err := publish(nodes[0], stdVolCap); err != nil {
+		t.Fatalf("ControllerPublishVolume to %s failed: %v", nodes[0], err)
+	}
+	if code := status.Code(publish(nodes[1], stdVolCap)); code != codes.FailedPrecondition {
+		t.Errorf("Expected error code %v for a read-write disk attached to another node, got %v", codes.FailedPrecondition, code)
+	}
+	multiWriterCap := createVolumeCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	multiWriterCap.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	if err := publish(nodes[1], multiWriterCap); err != nil {
+		t.Errorf("ControllerPublishVolume of a multi-writer disk to %s failed: %v", nodes[1], err)
+	}
+	_, err = gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: testVolumeID,
+		NodeId:   common.CreateNodeID(project, zone, nodes[1]),
+	})
+	if err != nil {
+		t.Fatalf("ControllerUnpublishVolume from %s failed: %v", nodes[1], err)
+	}
+	_, err = gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: testVolumeID,
+		NodeId:   common.CreateNodeID(project, zone, nodes[0]),
+	})
+	if err != nil {
+		t.Fatalf("ControllerUnpublishVolume from %s failed: %v", nodes[0], err)
+	}
+	if err := publish(nodes[1], stdVolCap); err != nil {
+		t.Errorf("ControllerPublishVolume to %s after detach from %s failed: %v", nodes[1], nodes[0], err)
+	}
+}
+
+func TestControllerPublishVolumeMultiWriter(t *testing.T) {
+	multiWriterCap := createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)[0]
+	testCases := []struct {
+		name       string
+		disk       *gce.CloudDisk
+		expErrCode codes.Code
+	}{
+		{
+			name: "multi-writer disk",
+			disk: createMultiWriterCloudDisk(name),
+		},
+		{
+			name:       "single-writer disk",
+			disk:       createZonalCloudDisk(name),
+			expErrCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{tc.disk})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		nodes := []string{"node-a", "node-b"}
+		for _, n := range nodes {
+			fakeCloudProvider.InsertInstance(&compute.Instance{Name: n}, zone, n)
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+		for _, n := range nodes {
+			_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         testVolumeID,
+				NodeId:           common.CreateNodeID(project, zone, n),
+				VolumeCapability: multiWriterCap,
+			})
+			if code := status.Code(err); code != tc.expErrCode {
+				t.Errorf("%s: expected error code %v publishing to %s, got %v: %v", tc.name, tc.expErrCode, n, code, err)
+			}
+		}
+	}
+}
+
+func TestControllerPublishVolumeReplicaZones(t *testing.T) {
+	thirdZone := region + "-c"
+	disk := gce.CloudDiskFromV1(&compute.Disk{
+		Name:   name,
+		Region: region,
+		ReplicaZones: []string{
+			fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s", project, zone),
+			fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s", project, secondZone),
+		},
+	})
+	testCases := []struct {
+		name         string
+		instanceZone string
+		expErrCode   codes.Code
+	}{
+		{
+			name:         "instance in replica zone",
+			instanceZone: secondZone,
+		},
+		{
+			name:         "instance outside replica zones",
+			instanceZone: thirdZone,
+			expErrCode:   codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{disk})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		fakeCloudProvider.InsertInstance(&compute.Instance{Name: node}, tc.instanceZone, node)
+		gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+		_, err = gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         testRegionalID,
+			NodeId:           common.CreateNodeID(project, tc.instanceZone, node),
+			VolumeCapability: stdVolCap,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), secondZone) && tc.expErrCode == codes.FailedPrecondition {
+			t.Errorf("%s: expected error to name the replica zones, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestControllerUnpublishVolumePausedDetach(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name           string
+		pauseUntil     string
+		maxDetachPause time.Duration
+		// How long ago the pause was first seen, if it was seen before.
+		pausedFor  time.Duration
+		expErrCode codes.Code
+	}{
+		{
+			name:           "no pause",
+			maxDetachPause: time.Hour,
+		},
+		{
+			name:           "paused",
+			pauseUntil:     now.Add(10 * time.Minute).Format(time.RFC3339),
+			maxDetachPause: time.Hour,
+			expErrCode:     codes.Unavailable,
+		},
+		{
+			name:       "pausing disabled",
+			pauseUntil: now.Add(10 * time.Minute).Format(time.RFC3339),
+		},
+		{
+			name:           "pause expired",
+			pauseUntil:     now.Add(-10 * time.Minute).Format(time.RFC3339),
+			maxDetachPause: time.Hour,
+		},
+		{
+			name:           "pause exceeds maximum",
+			pauseUntil:     now.Add(2 * time.Hour).Format(time.RFC3339),
+			maxDetachPause: time.Hour,
+		},
+		{
+			name:           "invalid pause",
+			pauseUntil:     "tomorrow",
+			maxDetachPause: time.Hour,
+		},
+		{
+			name:           "renewed pause within maximum",
+			pauseUntil:     now.Add(10 * time.Minute).Format(time.RFC3339),
+			maxDetachPause: time.Hour,
+			pausedFor:      30 * time.Minute,
+			expErrCode:     codes.Unavailable,
+		},
+		{
+			name:           "renewed pause past maximum",
+			pauseUntil:     now.Add(10 * time.Minute).Format(time.RFC3339),
+			maxDetachPause: time.Hour,
+			pausedFor:      2 * time.Hour,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		instance := &compute.Instance{
+			Name:     node,
+			Disks:    []*compute.AttachedDisk{{DeviceName: name}},
+			Metadata: &compute.Metadata{},
+		}
+		if tc.pauseUntil != "" {
+			instance.Metadata.Items = []*compute.MetadataItems{{Key: pauseDetachUntilKey, Value: &tc.pauseUntil}}
+		}
+		fakeCloudProvider.InsertInstance(instance, zone, node)
+		gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+		gceDriver.cs.maxDetachPause = tc.maxDetachPause
+		if tc.pausedFor != 0 {
+			gceDriver.cs.detachPauses.observe(zone+"/"+node, now.Add(-tc.pausedFor))
+		}
+
+		_, err = gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: testVolumeID,
+			NodeId:   common.CreateNodeID(project, zone, node),
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("Expected error code %v, got %v: %v", tc.expErrCode, code, err)
+		}
+	}
+}
+
+func TestValidateVolumeCapabilitiesDiskSupport(t *testing.T) {
+	createDisk := func(diskType string, multiWriter bool) *gce.CloudDisk {
+		return gce.CloudDiskFromBeta(&computebeta.Disk{
+			Name:        name,
+			Type:        fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", project, zone, diskType),
+			SelfLink:    fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+			Zone:        zone,
+			MultiWriter: multiWriter,
+		})
+	}
+	testCases := []struct {
+		name         string
+		disk         *gce.CloudDisk
+		caps         []*csi.VolumeCapability
+		expConfirmed bool
+	}{
+		{
+			name:         "single writer on pd-standard",
+			disk:         createDisk("pd-standard", false),
+			caps:         createVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			expConfirmed: true,
+		},
+		{
+			name:         "multi writer on multi-writer pd-ssd",
+			disk:         createDisk("pd-ssd", true),
+			caps:         createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			expConfirmed: true,
+		},
+		{
+			name: "multi writer on single-writer pd-ssd",
+			disk: createDisk("pd-ssd", false),
+			caps: createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		},
+		{
+			name:         "multi reader on pd-balanced",
+			disk:         createDisk("pd-balanced", false),
+			caps:         createVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			expConfirmed: true,
+		},
+		{
+			name: "multi reader on hyperdisk-extreme",
+			disk: createDisk("hyperdisk-extreme", false),
+			caps: createVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, []*gce.CloudDisk{tc.disk})
+		resp, err := gceDriver.cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           testVolumeID,
+			VolumeCapabilities: tc.caps,
+			Parameters:         map[string]string{common.ParameterKeyType: tc.disk.GetPDType()},
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		if confirmed := resp.GetConfirmed() != nil; confirmed != tc.expConfirmed {
+			t.Errorf("Expected confirmed %v, got %v: %s", tc.expConfirmed, confirmed, resp.GetMessage())
+		}
+	}
+}
+
+func TestValidateVolumeCapabilitiesAccessTypes(t *testing.T) {
+	dualCaps := append(createVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)...)
+	testCases := []struct {
+		name          string
+		caps          []*csi.VolumeCapability
+		volumeContext map[string]string
+		expConfirmed  bool
+	}{
+		{
+			name:         "block and mount",
+			caps:         dualCaps,
+			expConfirmed: true,
+		},
+		{
+			name:          "block and mount on a block and mount volume",
+			caps:          dualCaps,
+			volumeContext: map[string]string{common.VolumeAttributeAccessTypes: "block,mount"},
+			expConfirmed:  true,
+		},
+		{
+			name:          "block on a block and mount volume",
+			caps:          createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			volumeContext: map[string]string{common.VolumeAttributeAccessTypes: "block,mount"},
+			expConfirmed:  true,
+		},
+		{
+			name:          "block and mount on a block volume",
+			caps:          dualCaps,
+			volumeContext: map[string]string{common.VolumeAttributeAccessTypes: "block"},
+		},
+		{
+			name: "other driver volume context",
+			caps: dualCaps,
+			volumeContext: map[string]string{
+				common.VolumeAttributeAccessTypes:      "block,mount",
+				common.VolumeAttributeReadOnly:         "true",
+				common.VolumeAttributeTrimAfterRestore: "true",
+				common.VolumeAttributeProvisionedIOPS:  "5000",
+			},
+			expConfirmed: true,
+		},
+		{
+			name: "unknown volume context",
+			caps: dualCaps,
+			volumeContext: map[string]string{
+				common.VolumeAttributeAccessTypes: "block,mount",
+				"foo":                             "bar",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+			Name:     name,
+			Type:     fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-standard", project, zone),
+			SelfLink: fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+			Zone:     zone,
+		})})
+		resp, err := gceDriver.cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           testVolumeID,
+			VolumeCapabilities: tc.caps,
+			VolumeContext:      tc.volumeContext,
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		if confirmed := resp.GetConfirmed() != nil; confirmed != tc.expConfirmed {
+			t.Errorf("Expected confirmed %v, got %v: %s", tc.expConfirmed, confirmed, resp.GetMessage())
+		}
+	}
+}
+
+// instanceReadCountingCloudProvider counts instance reads and, like GCE,
+// returns copies of instances and fails attaches of attached disks and
+// detaches of detached ones.
+type instanceReadCountingCloudProvider struct {
+	*gce.FakeCloudProvider
+	reads int
+}
+
+func (cloud *instanceReadCountingCloudProvider) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*compute.Instance, error) {
+	cloud.reads++
+	instance, err := cloud.FakeCloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	instanceCopy := *instance
+	instanceCopy.Disks = append([]*compute.AttachedDisk{}, instance.Disks...)
+	return &instanceCopy, nil
+}
+
+func (cloud *instanceReadCountingCloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, diskInterface, instanceZone, instanceName string) error {
+	instance, err := cloud.FakeCloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+	if err != nil {
+		return err
+	}
+	if diskIsAttached(volKey.Name, instance) {
+		return fmt.Errorf("disk %s is already attached to %s", volKey.Name, instanceName)
+	}
+	return cloud.FakeCloudProvider.AttachDisk(ctx, volKey, readWrite, diskType, diskInterface, instanceZone, instanceName)
+}
+
+func (cloud *instanceReadCountingCloudProvider) DetachDisk(ctx context.Context, deviceName, instanceZone, instanceName string) error {
+	instance, err := cloud.FakeCloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+	if err != nil {
+		return err
+	}
+	if !diskIsAttached(deviceName, instance) {
+		return fmt.Errorf("disk %s is not attached to %s", deviceName, instanceName)
+	}
+	return cloud.FakeCloudProvider.DetachDisk(ctx, deviceName, instanceZone, instanceName)
+}
+
+func TestControllerPublishVolumeInstanceCache(t *testing.T) {
+	otherName := "test-other-name"
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name), createZonalCloudDisk(otherName)})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	fakeCloudProvider.InsertInstance(&compute.Instance{Name: node}, zone, node)
+	cloudProvider := &instanceReadCountingCloudProvider{FakeCloudProvider: fakeCloudProvider}
+	gceDriver := initGCEDriverWithCloudProvider(t, cloudProvider)
+	gceDriver.cs.instanceCache = newInstanceCache(cloudProvider, time.Hour)
+	volKey := meta.ZonalKey(name, zone)
+	otherVolumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, otherName)
+	nodeID := common.CreateNodeID(project, zone, node)
+
+	publish := func(volumeID string) error {
+		_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeID,
+			VolumeCapability: stdVolCap,
+		})
+		return err
+	}
+	unpublish := func(volumeID string) error {
+		_, err := gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   nodeID,
+		})
+		return err
+	}
+	expectReads := func(step string, reads int) {
+		t.Helper()
+		if cloudProvider.reads != reads {
+			t.Errorf("%s: expected %d instance reads, got %d", step, reads, cloudProvider.reads)
+		}
+	}
+
+	// The attach drops the instance read before it, so the republish reads
+	// it again. The one after that finds the disk attached in the cache, and
+	// reads the instance again before reporting the attach.
+	for i := 0; i < 3; i++ {
+		if err := publish(testVolumeID); err != nil {
+			t.Fatalf("Publish %d failed: %v", i, err)
+		}
+	}
+	expectReads("republish", 3)
+
+	// A detach made behind the controller's back is not seen in the cache,
+	// so the detach fails and the instance is read again.
+	if err := fakeCloudProvider.DetachDisk(context.Background(), name, zone, node); err != nil {
+		t.Fatalf("Failed to detach disk: %v", err)
+	}
+	if err := unpublish(testVolumeID); err != nil {
+		t.Errorf("Unpublish with stale cached instance failed: %v", err)
+	}
+	expectReads("stale detach", 4)
+
+	// The instance read after the failed detach is cached without the disk.
+	// Attaching the other disk drops it, and its republish caches it again.
+	// Then attach the disk behind the controller's back.
+	if err := publish(otherVolumeID); err != nil {
+		t.Fatalf("Publish of other volume failed: %v", err)
+	}
+	if err := publish(otherVolumeID); err != nil {
+		t.Fatalf("Republish of other volume failed: %v", err)
+	}
+	expectReads("publish other volume", 5)
+	if err := fakeCloudProvider.AttachDisk(context.Background(), volKey, "READ_WRITE", attachableDiskTypePersistent, "", zone, node); err != nil {
+		t.Fatalf("Failed to attach disk: %v", err)
+	}
+	if err := publish(testVolumeID); err != nil {
+		t.Errorf("Publish with stale cached instance failed: %v", err)
+	}
+	expectReads("stale attach", 6)
+
+	// The instance read after the failed attach is cached with the disk.
+	// Detach it behind the controller's back, so that the publish must not
+	// trust the cache and attaches the disk again.
+	if err := fakeCloudProvider.DetachDisk(context.Background(), name, zone, node); err != nil {
+		t.Fatalf("Failed to detach disk: %v", err)
+	}
+	if err := publish(testVolumeID); err != nil {
+		t.Errorf("Publish with stale attached instance failed: %v", err)
+	}
+	expectReads("stale attached", 7)
+	instance, err := fakeCloudProvider.GetInstanceOrError(context.Background(), zone, node)
+	if err != nil {
+		t.Fatalf("Failed to get instance: %v", err)
+	}
+	if !diskIsAttached(name, instance) {
+		t.Errorf("Expected disk %v to be attached after publish with stale attached instance", name)
+	}
+
+	status := gceDriver.cs.instanceCache.status()
+	if status.Hits != 5 || status.Misses != 7 {
+		t.Errorf("Expected 5 hits and 7 misses, got %+v", status)
+	}
+}
+
+func TestInstanceCacheExpiry(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, nil)
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	fakeCloudProvider.InsertInstance(&compute.Instance{Name: node}, zone, node)
+	cloudProvider := &instanceReadCountingCloudProvider{FakeCloudProvider: fakeCloudProvider}
+	cache := newInstanceCache(cloudProvider, 10*time.Millisecond)
+
+	if _, cached, err := cache.get(context.Background(), zone, node); err != nil || cached {
+		t.Fatalf("Expected uncached instance, got cached %v, err %v", cached, err)
+	}
+	if _, cached, err := cache.get(context.Background(), zone, node); err != nil || !cached {
+		t.Fatalf("Expected cached instance, got cached %v, err %v", cached, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, cached, err := cache.get(context.Background(), zone, node); err != nil || cached {
+		t.Fatalf("Expected expired instance to be read again, got cached %v, err %v", cached, err)
+	}
+
+	// Errors are not cached.
+	if _, _, err := cache.get(context.Background(), zone, "missing"); !gce.IsGCENotFoundError(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	if _, _, err := cache.get(context.Background(), zone, "missing"); !gce.IsGCENotFoundError(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+	if cloudProvider.reads != 4 {
+		t.Errorf("Expected 4 instance reads, got %d", cloudProvider.reads)
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	createSizedDisk := func(diskType string, sizeGb int64) *gce.CloudDisk {
+		return gce.CloudDiskFromV1(&compute.Disk{
+			Name:   name,
+			SizeGb: sizeGb,
+			Type:   fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", project, zone, diskType),
+		})
+	}
+	createIOPSDisk := func(diskType string, sizeGb, iops int64) *gce.CloudDisk {
+		return gce.CloudDiskFromAlpha(&computealpha.Disk{
+			Name:            name,
+			SizeGb:          sizeGb,
+			Type:            fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", project, zone, diskType),
+			ProvisionedIops: iops,
+		})
+	}
+	policy := common.ExpansionPolicy{"pd-standard": {MaxSizeGb: 100, ToType: "pd-balanced"}}
+	testCases := []struct {
+		name            string
+		seedDisk        *gce.CloudDisk
+		capRange        *csi.CapacityRange
+		expansionPolicy common.ExpansionPolicy
+		expSizeGb       int64
+		expErrCode      codes.Code
+	}{
+		{
+			name:      "grow",
+			seedDisk:  createSizedDisk("pd-standard", 10),
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(20)},
+			expSizeGb: 20,
+		},
+		{
+			name:      "same size",
+			seedDisk:  createSizedDisk("pd-standard", 10),
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+			expSizeGb: 10,
+		},
+		{
+			name:      "shrink",
+			seedDisk:  createSizedDisk("pd-standard", 20),
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+			expSizeGb: 20,
+		},
+		{
+			name:      "hyperdisk shrink below minimum",
+			seedDisk:  createSizedDisk("hyperdisk-throughput", 2048),
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(1)},
+			expSizeGb: 2048,
+		},
+		{
+			name:       "limit below current size",
+			seedDisk:   createSizedDisk("pd-standard", 20),
+			capRange:   &csi.CapacityRange{LimitBytes: common.GbToBytes(10)},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name:       "pd beyond maximum",
+			seedDisk:   createSizedDisk("pd-ssd", 20),
+			capRange:   &csi.CapacityRange{RequiredBytes: MaxVolumeSizeInBytes + common.GbToBytes(1)},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name:      "hyperdisk within range",
+			seedDisk:  createSizedDisk("hyperdisk-throughput", 2048),
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(4096)},
+			expSizeGb: 4096,
+		},
+		{
+			name:       "hyperdisk beyond maximum",
+			seedDisk:   createSizedDisk("hyperdisk-throughput", 2048),
+			capRange:   &csi.CapacityRange{RequiredBytes: common.GbToBytes(40 * 1024)},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name:       "hyperdisk too small for its IOPS",
+			seedDisk:   createIOPSDisk("hyperdisk-balanced", 4, 5000),
+			capRange:   &csi.CapacityRange{RequiredBytes: common.GbToBytes(8)},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name:      "hyperdisk large enough for its IOPS",
+			seedDisk:  createIOPSDisk("hyperdisk-balanced", 4, 5000),
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+			expSizeGb: 10,
+		},
+		{
+			name:       "missing disk",
+			capRange:   &csi.CapacityRange{RequiredBytes: common.GbToBytes(20)},
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:            "within expansion policy",
+			seedDisk:        createSizedDisk("pd-standard", 10),
+			capRange:        &csi.CapacityRange{RequiredBytes: common.GbToBytes(100)},
+			expansionPolicy: policy,
+			expSizeGb:       100,
+		},
+		{
+			name:            "beyond expansion policy",
+			seedDisk:        createSizedDisk("pd-standard", 10),
+			capRange:        &csi.CapacityRange{RequiredBytes: common.GbToBytes(101)},
+			expansionPolicy: policy,
+			expErrCode:      codes.FailedPrecondition,
+		},
+		{
+			name:            "type without expansion policy",
+			seedDisk:        createSizedDisk("pd-ssd", 10),
+			capRange:        &csi.CapacityRange{RequiredBytes: common.GbToBytes(200)},
+			expansionPolicy: policy,
+			expSizeGb:       200,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		var seedDisks []*gce.CloudDisk
+		if tc.seedDisk != nil {
+			seedDisks = append(seedDisks, tc.seedDisk)
+		}
+		gceDriver := initGCEDriver(t, seedDisks)
+		gceDriver.cs.expansionPolicy = tc.expansionPolicy
+
+		resp, err := gceDriver.cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+			VolumeId:      testVolumeID,
+			CapacityRange: tc.capRange,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("Expected error code %v, got %v: %v", tc.expErrCode, code, err)
+			continue
+		}
+		if err == nil && resp.CapacityBytes != common.GbToBytes(tc.expSizeGb) {
+			t.Errorf("Expected capacity %v, got %v", common.GbToBytes(tc.expSizeGb), resp.CapacityBytes)
+		}
+	}
+}
+
+func TestVolumeOperationConcurrency(t *testing.T) {
+	readyToExecute := make(chan chan struct{}, 1)
+	gceDriver := initBlockingGCEDriver(t, []*gce.CloudDisk{
+		createZonalCloudDisk(name + "1"),
+		createZonalCloudDisk(name + "2"),
+	}, readyToExecute)
+	cs := gceDriver.cs
+
+	vol1CreateSnapshotAReq := &csi.CreateSnapshotRequest{
+		Name:           name + "1A",
+		SourceVolumeId: testVolumeID + "1",
+	}
+	vol1CreateSnapshotBReq := &csi.CreateSnapshotRequest{
+		Name:           name + "1B",
+		SourceVolumeId: testVolumeID + "1",
+	}
+	vol2CreateSnapshotReq := &csi.CreateSnapshotRequest{
+		Name:           name + "2",
+		SourceVolumeId: testVolumeID + "2",
+	}
+
+	runRequest := func(req *csi.CreateSnapshotRequest) <-chan error {
+		response := make(chan error)
+		go func() {
+			_, err := cs.CreateSnapshot(context.Background(), req)
+			response <- err
+		}()
+		return response
+	}
+
+	// Start first valid request vol1CreateSnapshotA and block until it reaches the CreateSnapshot
+	vol1CreateSnapshotAResp := runRequest(vol1CreateSnapshotAReq)
+	execVol1CreateSnapshotA := <-readyToExecute
+
+	// Start vol1CreateSnapshotB and allow it to execute to completion. Then check for Aborted error.
+	// If a non Abort error is received or if the operation was started, then there is a problem
+	// with volume locking
+	vol1CreateSnapshotBResp := runRequest(vol1CreateSnapshotBReq)
+	select {
+	case err := <-vol1CreateSnapshotBResp:
+		if err != nil {
+			serverError, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from err: %v", err)
+			}
+			if serverError.Code() != codes.Aborted {
+				t.Errorf("Expected error code: %v, got: %v. err : %v", codes.Aborted, serverError.Code(), err)
+			}
+		} else {
+			t.Errorf("Expected error: %v, got no error", codes.Aborted)
+		}
+	case <-readyToExecute:
+		t.Errorf("The operation for vol1CreateSnapshotB should have been aborted, but was started")
+	}
+
+	// Start vol2CreateSnapshot and allow it to execute to completion. Then check for success.
+	vol2CreateSnapshotResp := runRequest(vol2CreateSnapshotReq)
+	execVol2CreateSnapshot := <-readyToExecute
+	execVol2CreateSnapshot <- struct{}{}
+	if err := <-vol2CreateSnapshotResp; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// To clean up, allow the vol1CreateSnapshotA to complete
+	execVol1CreateSnapshotA <- struct{}{}
+	if err := <-vol1CreateSnapshotAResp; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCreateVolumeLabels(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	createVolume := func(labels string) error {
+		_, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         map[string]string{common.ParameterKeyLabels: labels},
+		})
+		return err
+	}
+
+	if err := createVolume("team=storage"); err != nil {
+		t.Fatalf("Failed to create volume: %v", err)
+	}
+	disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), meta.ZonalKey(name, zone), gce.GCEAPIVersionV1)
+	if err != nil {
+		t.Fatalf("Failed to get disk: %v", err)
+	}
+	if got := disk.GetLabels()["team"]; got != "storage" {
+		t.Errorf("Expected disk label team=storage, got team=%s", got)
+	}
+	if err := createVolume("team=storage"); err != nil {
+		t.Errorf("Repeated create with the same labels failed: %v", err)
+	}
+	if err := createVolume("team=compute"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected repeated create with other labels to fail with %v, got %v", codes.AlreadyExists, err)
+	}
+	if err := createVolume("Team=storage"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected create with an invalid label to fail with %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeReplicaZones(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	createVolume := func(replicaZones string) error {
+		_, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters: map[string]string{
+				common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+				common.ParameterKeyReplicaZones:    replicaZones,
+			},
+		})
+		return err
+	}
+
+	if err := createVolume(zone + "," + secondZone); err != nil {
+		t.Fatalf("Failed to create volume: %v", err)
+	}
+	disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), meta.RegionalKey(name, region), gce.GCEAPIVersionV1)
+	if err != nil {
+		t.Fatalf("Failed to get disk: %v", err)
+	}
+	if got, exp := sets.NewString(diskReplicaZones(disk)...), sets.NewString(zone, secondZone); !got.Equal(exp) {
+		t.Errorf("Expected disk replica zones %v, got %v", exp.List(), got.List())
+	}
+	if err := createVolume(secondZone + "," + zone); err != nil {
+		t.Errorf("Repeated create with the same replica zones failed: %v", err)
+	}
+	if err := createVolume(zone + "," + region + "-c"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected repeated create with other replica zones to fail with %v, got %v", codes.AlreadyExists, err)
+	}
+	if err := createVolume(zone); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected create with one replica zone to fail with %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeDiskReady(t *testing.T) {
+	// Define test cases
+	testCases := []struct {
+		name       string
+		diskStatus string
+		req        *csi.CreateVolumeRequest
+		expVol     *csi.Volume
+		expErrCode codes.Code
+	}{
+		{
+			name:       "disk status RESTORING",
+			diskStatus: "RESTORING",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.Internal,
+		},
+		{
+			name:       "disk status CREATING",
+			diskStatus: "CREATING",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.Internal,
+		},
+		{
+			name:       "disk status DELETING",
+			diskStatus: "DELETING",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.Internal,
+		},
+		{
+			name:       "disk status FAILED",
+			diskStatus: "FAILED",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.Internal,
+		},
+		{
+			name:       "success default",
+			diskStatus: "READY",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      nil,
+				AccessibleTopology: stdTopology,
+			},
+		},
+	}
+
+	// Run test cases
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fcp, err := gce.CreateFakeCloudProvider(project, zone, nil)
+			if err != nil {
+				t.Fatalf("Failed to create fake cloud provider: %v", err)
+			}
+
+			// Setup hook to create new disks with given status.
+			fcp.UpdateDiskStatus(tc.diskStatus)
+			// Setup new driver each time so no interference
+			gceDriver := initGCEDriverWithCloudProvider(t, fcp)
+			// Start Test
+			resp, err := gceDriver.cs.CreateVolume(context.Background(), tc.req)
+			//check response
+			if err != nil {
+				serverError, ok := status.FromError(err)
+				if !ok {
+					t.Fatalf("Could not get error status code from err: %v", serverError)
+				}
+				if serverError.Code() != tc.expErrCode {
+					t.Fatalf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, serverError.Code(), err)
+				}
+				return
+			}
+			if tc.expErrCode != codes.OK {
+				t.Fatalf("Expected error: %v, got no error", tc.expErrCode)
+			}
+
+			vol := resp.GetVolume()
+			if !reflect.DeepEqual(vol, tc.expVol) {
+				t.Fatalf("Mismatch in expected vol %v, current volume: %v\n", tc.expVol, vol)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeAdoptsPendingInsert(t *testing.T) {
+	testCases := []struct {
+		name       string
+		pending    bool
+		expErrCode codes.Code
+	}{
+		{
+			name:    "insert by another request completes",
+			pending: true,
+		},
+		{
+			name:       "disk stuck creating",
+			expErrCode: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, nil)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		// Another replica has started creating the disk.
+		fcp.UpdateDiskStatus("CREATING")
+		params := common.DiskParameters{DiskType: "test-type", ReplicationType: "none"}
+		if err := fcp.InsertDisk(context.Background(), meta.ZonalKey(name, zone), params, common.GbToBytes(20), stdCapRange, nil, "", "", false); err != nil {
+			t.Fatalf("Failed to insert disk: %v", err)
+		}
+		if tc.pending {
+			fcp.SetDiskInsertPending(name)
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, fcp)
+
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         stdParams,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
+		}
+		if err == nil && resp.GetVolume().GetVolumeId() != testVolumeID {
+			t.Errorf("%s: expected volume %v, got %v", tc.name, testVolumeID, resp.GetVolume().GetVolumeId())
+		}
+	}
+}
+
+func TestCreateVolumeCleansUpFailedRegionalDisk(t *testing.T) {
+	createFailedRegionalDisk := func(description string) *gce.CloudDisk {
+		return gce.CloudDiskFromV1(&compute.Disk{
+			Name:         name,
+			Region:       region,
+			Status:       "FAILED",
+			Description:  description,
+			SizeGb:       20,
+			Type:         fmt.Sprintf("projects/%s/regions/%s/diskTypes/pd-standard", project, region),
+			ReplicaZones: []string{zone},
+		})
+	}
+	testCases := []struct {
+		name          string
+		seedDisks     []*gce.CloudDisk
+		newDiskStatus string
+		expErrCode    codes.Code
+		expDeleted    bool
+	}{
+		{
+			name:          "insert leaves failed disk",
+			newDiskStatus: "FAILED",
+			expErrCode:    codes.Internal,
+			expDeleted:    true,
+		},
+		{
+			name:       "existing failed disk created by driver",
+			seedDisks:  []*gce.CloudDisk{createFailedRegionalDisk("Regional disk created by GCE-PD CSI Driver")},
+			expErrCode: codes.Unavailable,
+			expDeleted: true,
+		},
+		{
+			name:       "existing failed disk not created by driver",
+			seedDisks:  []*gce.CloudDisk{createFailedRegionalDisk("")},
+			expErrCode: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fcp, err := gce.CreateFakeCloudProvider(project, zone, tc.seedDisks)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		if tc.newDiskStatus != "" {
+			fcp.UpdateDiskStatus(tc.newDiskStatus)
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, fcp)
+
+		_, err = gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{Segments: map[string]string{common.TopologyKeyZone: zone}},
+					{Segments: map[string]string{common.TopologyKeyZone: secondZone}},
+				},
+			},
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("Expected error code %v, got %v: %v", tc.expErrCode, code, err)
+		}
+		_, err = fcp.GetDisk(context.Background(), meta.RegionalKey(name, region), gce.GCEAPIVersionV1)
+		if deleted := gce.IsGCENotFoundError(err); deleted != tc.expDeleted {
+			t.Errorf("Expected disk deleted to be %v, got %v", tc.expDeleted, deleted)
+		}
+	}
+}
+
+// deadlineInsertCloudProvider cancels the request once a disk is inserted,
+// like an insert that uses up the deadline of the request, and fails disk
+// deletes on done contexts.
+type deadlineInsertCloudProvider struct {
+	*gce.FakeCloudProvider
+	cancel context.CancelFunc
+}
+
+func (cloud *deadlineInsertCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error {
+	err := cloud.FakeCloudProvider.InsertDisk(ctx, volKey, params, capBytes, capacityRange, replicaZones, snapshotID, volumeContentSourceVolumeID, multiWriter)
+	cloud.cancel()
+	return err
+}
+
+func (cloud *deadlineInsertCloudProvider) DeleteDisk(ctx context.Context, volKey *meta.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cloud.FakeCloudProvider.DeleteDisk(ctx, volKey)
+}
+
+func TestCleanupFailedRegionalDiskAfterRequestDeadline(t *testing.T) {
+	fcp, err := gce.CreateFakeCloudProvider(project, zone, nil)
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	fcp.UpdateDiskStatus("FAILED")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gceDriver := initGCEDriverWithCloudProvider(t, &deadlineInsertCloudProvider{FakeCloudProvider: fcp, cancel: cancel})
+
+	_, err = gceDriver.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{
+				{Segments: map[string]string{common.TopologyKeyZone: zone}},
+				{Segments: map[string]string{common.TopologyKeyZone: secondZone}},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatalf("Expected CreateVolume of a failed regional disk to fail")
+	}
+	if _, err := fcp.GetDisk(context.Background(), meta.RegionalKey(name, region), gce.GCEAPIVersionV1); !gce.IsGCENotFoundError(err) {
+		t.Errorf("Expected the failed regional disk to be deleted after the request ended, got %v", err)
+	}
+}
+
+// laggingReadCloudProvider does not find a disk for the first misses reads
+// after its insert, like GCE right after a disk is created.
+type laggingReadCloudProvider struct {
+	*gce.FakeCloudProvider
+	misses  int
+	pending map[string]int
+}
+
+func (cloud *laggingReadCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, volumeContentSourceVolumeID string, multiWriter bool) error {
+	cloud.pending[volKey.Name] = cloud.misses
+	return cloud.FakeCloudProvider.InsertDisk(ctx, volKey, params, capBytes, capacityRange, replicaZones, snapshotID, volumeContentSourceVolumeID, multiWriter)
+}
+
+func (cloud *laggingReadCloudProvider) GetDisk(ctx context.Context, volKey *meta.Key, api gce.GCEAPIVersion) (*gce.CloudDisk, error) {
+	if cloud.pending[volKey.Name] > 0 {
+		cloud.pending[volKey.Name]--
+		return nil, &googleapi.Error{Errors: []googleapi.ErrorItem{{Reason: "notFound"}}}
+	}
+	return cloud.FakeCloudProvider.GetDisk(ctx, volKey, api)
+}
+
+func TestCreateVolumeRetriesNotFoundAfterInsert(t *testing.T) {
+	defer func(policy backoff.Policy) { postInsertGetBackoff = policy }(postInsertGetBackoff)
+	postInsertGetBackoff = backoff.Policy{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+	testCases := []struct {
+		name       string
+		misses     int
+		expErrCode codes.Code
+	}{
+		{
+			name: "found at once",
+		},
+		{
+			name:   "found after retries",
+			misses: 2,
+		},
+		{
+			name:       "never found",
+			misses:     3,
+			expErrCode: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, nil)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		cloudProvider := &laggingReadCloudProvider{FakeCloudProvider: fakeCloudProvider, misses: tc.misses, pending: map[string]int{}}
+		gceDriver := initGCEDriverWithCloudProvider(t, cloudProvider)
+
+		req := &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         stdParams,
+		}
+		_, err = gceDriver.cs.CreateVolume(context.Background(), req)
+		if tc.expErrCode != codes.OK {
+			if status.Code(err) != tc.expErrCode {
+				t.Errorf("%s: got error %v, expected code %v", tc.name, err, tc.expErrCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestSnapshotUploads(t *testing.T) {
+	snapshotID := "projects/test-project/global/snapshots/test-snapshot"
+	uploading := &compute.Snapshot{
+		SelfLink:           "https://www.googleapis.com/compute/v1/" + snapshotID,
+		Status:             "UPLOADING",
+		CreationTimestamp:  time.Now().Add(-time.Hour).Format(time.RFC3339),
+		DiskSizeGb:         10,
+		StorageBytes:       common.GbToBytes(4),
+		StorageBytesStatus: "UPDATING",
+	}
+	if got := snapshotProgress(uploading); got != 40 {
+		t.Errorf("got progress %d, expected 40", got)
+	}
+
+	uploads := newSnapshotUploads()
+	uploads.observe(uploading)
+	created, ok := uploads.created[snapshotID]
+	if !ok {
+		t.Fatalf("uploading snapshot %s is not tracked", snapshotID)
+	}
+	if age := time.Since(created); age < time.Hour {
+		t.Errorf("got upload age %v, expected at least an hour", age)
+	}
+
+	ready := *uploading
+	ready.Status = "READY"
+	if got := snapshotProgress(&ready); got != 100 {
+		t.Errorf("got progress %d of ready snapshot, expected 100", got)
+	}
+	uploads.observe(&ready)
+	if _, ok := uploads.created[snapshotID]; ok {
+		t.Errorf("ready snapshot %s is still tracked", snapshotID)
+	}
+
+	uploads.observe(uploading)
+	uploads.forget(snapshotID)
+	if len(uploads.created) != 0 {
+		t.Errorf("deleted snapshot is still tracked: %v", uploads.created)
+	}
+}
+
+func TestCleanSelfLink(t *testing.T) {
+	testCases := []struct {
+		selfLink string
+		expected string
+	}{
+		{
+			selfLink: "https://www.googleapis.com/compute/v1/projects/p/zones/z/disks/d",
+			expected: "projects/p/zones/z/disks/d",
+		},
+		{
+			selfLink: "https://www.googleapis.com/compute/beta/projects/p/regions/r/disks/d",
+			expected: "projects/p/regions/r/disks/d",
+		},
+		{
+			selfLink: "https://compute.googleapis.com/compute/v1/projects/p/zones/z/disks/d",
+			expected: "projects/p/zones/z/disks/d",
+		},
+		{
+			selfLink: "projects/p/zones/z/disks/d",
+			expected: "projects/p/zones/z/disks/d",
+		},
+	}
+	for _, tc := range testCases {
+		if got := cleanSelfLink(tc.selfLink); got != tc.expected {
+			t.Errorf("cleanSelfLink(%q) = %q, expected %q", tc.selfLink, got, tc.expected)
+		}
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	lockedVolume := "projects/test-project/zones/country-region-zone/disks/busy"
+	if !gceDriver.cs.volumeLocks.TryAcquire(lockedVolume) {
+		t.Fatalf("Failed to acquire volume lock")
+	}
+	defer gceDriver.cs.volumeLocks.Release(lockedVolume)
+
+	rec := httptest.NewRecorder()
+	gceDriver.cs.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	state := controllerDebugState{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("Failed to decode debug state %q: %v", rec.Body.String(), err)
+	}
+	expState := controllerDebugState{
+		ZonesCache:        map[string][]string{region: {zone, secondZone}},
+		OngoingOperations: []string{lockedVolume},
+	}
+	if !reflect.DeepEqual(state, expState) {
+		t.Errorf("Expected debug state %+v, got %+v", expState, state)
+	}
+
+	rec = httptest.NewRecorder()
+	gceDriver.cs.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/state", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %v for POST, got %v", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestOperationHistory(t *testing.T) {
+	var disabled *operationHistory
+	errFailed := status.Error(codes.Internal, "attach failed")
+	if err := disabled.record("disk", historyOperationAttach, node, time.Now(), errFailed); err != errFailed {
+		t.Errorf("Disabled history changed error %v to %v", errFailed, err)
+	}
+
+	h := newOperationHistory(2)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+	start := now
+	if err := h.record("disk", historyOperationAttach, node, start, errFailed); err != errFailed {
+		t.Errorf("First failure changed error %v to %v", errFailed, err)
+	}
+	now = now.Add(10 * time.Second)
+	if err := h.record("disk", historyOperationDetach, node, start, nil); err != nil {
+		t.Errorf("Success returned error %v", err)
+	}
+	now = now.Add(20 * time.Second)
+	err := h.record("disk", historyOperationAttach, node, start, status.Error(codes.NotFound, "instance not found"))
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("Expected error code %v, got %v", codes.NotFound, code)
+	}
+	expMsg := "instance not found (last attach failed 30s ago with Internal: attach failed)"
+	if msg := status.Convert(err).Message(); msg != expMsg {
+		t.Errorf("Expected error message %q, got %q", expMsg, msg)
+	}
+
+	ops := h.status()["disk"]
+	if len(ops) != 2 {
+		t.Fatalf("Expected the last 2 operations, got %+v", ops)
+	}
+	expOps := []operationRecord{
+		{Operation: historyOperationDetach, Node: node, Start: start, End: start.Add(10 * time.Second)},
+		{Operation: historyOperationAttach, Node: node, Start: start, End: start.Add(30 * time.Second), Code: "NotFound", Error: "instance not found"},
+	}
+	if !reflect.DeepEqual(ops, expOps) {
+		t.Errorf("Expected operations %+v, got %+v", expOps, ops)
+	}
+
+	h.forget("disk")
+	if volumes := h.status(); len(volumes) != 0 {
+		t.Errorf("Expected no history after forget, got %+v", volumes)
+	}
+}
+
+func TestControllerOperationHistory(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	gceDriver.cs.opHistory = newOperationHistory(5)
+	nodeID := common.CreateNodeID(project, zone, node)
+	publish := func() error {
+		_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         testVolumeID,
+			NodeId:           nodeID,
+			VolumeCapability: stdVolCap,
+		})
+		return err
+	}
+
+	// The disk does not exist, so attaches fail.
+	if err := publish(); err == nil {
+		t.Fatalf("Expected ControllerPublishVolume of a missing disk to fail")
+	}
+	err := publish()
+	if err == nil {
+		t.Fatalf("Expected ControllerPublishVolume of a missing disk to fail")
+	}
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, "last attach failed") {
+		t.Errorf("Expected error to name the last failed attach, got %q", msg)
+	}
+
+	rec := httptest.NewRecorder()
+	gceDriver.cs.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	state := controllerDebugState{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("Failed to decode debug state %q: %v", rec.Body.String(), err)
+	}
+	if ops := state.VolumeOperations[name]; len(ops) != 2 || ops[1].Operation != historyOperationAttach || ops[1].Node != nodeID {
+		t.Errorf("Expected two attaches to %s in the debug state, got %+v", nodeID, ops)
+	}
+
+	// Deleting the volume drops its history.
+	if _, err := gceDriver.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: testVolumeID}); err != nil {
+		t.Fatalf("DeleteVolume failed: %v", err)
+	}
+	if volumes := gceDriver.cs.opHistory.status(); len(volumes) != 0 {
+		t.Errorf("Expected no history after DeleteVolume, got %+v", volumes)
+	}
+}
+
+func TestNodeShuttingDown(t *testing.T) {
+	taints := sets.NewString("node.kubernetes.io/out-of-service")
+	testCases := []struct {
+		name   string
+		taints []v1.Taint
+		exp    bool
+	}{
+		{
+			name: "no taints",
+		},
+		{
+			name:   "other taint",
+			taints: []v1.Taint{{Key: "node.kubernetes.io/unschedulable", Effect: v1.TaintEffectNoSchedule}},
+		},
+		{
+			name: "shutdown taint",
+			taints: []v1.Taint{
+				{Key: "node.kubernetes.io/unschedulable", Effect: v1.TaintEffectNoSchedule},
+				{Key: "node.kubernetes.io/out-of-service", Effect: v1.TaintEffectNoExecute},
+			},
+			exp: true,
+		},
+	}
+	for _, tc := range testCases {
+		node := &v1.Node{Spec: v1.NodeSpec{Taints: tc.taints}}
+		if got := nodeShuttingDown(node, taints); got != tc.exp {
+			t.Errorf("%s: nodeShuttingDown() = %v, expected %v", tc.name, got, tc.exp)
+		}
+	}
+}
+
+func TestNodeVolumeInUse(t *testing.T) {
+	node := &v1.Node{Status: v1.NodeStatus{VolumesInUse: []v1.UniqueVolumeName{
+		"kubernetes.io/csi/other.csi.driver^vol-1",
+		"kubernetes.io/csi/test-driver^projects/p/zones/z/disks/in-use",
+	}}}
+	testCases := []struct {
+		name   string
+		handle string
+		exp    bool
+	}{
+		{
+			name:   "in use",
+			handle: "projects/p/zones/z/disks/in-use",
+			exp:    true,
+		},
+		{
+			name:   "unmounted",
+			handle: "projects/p/zones/z/disks/unmounted",
+		},
+		{
+			name:   "in use by other driver",
+			handle: "vol-1",
+		},
+	}
+	for _, tc := range testCases {
+		if got := nodeVolumeInUse(node, "test-driver", tc.handle); got != tc.exp {
+			t.Errorf("%s: nodeVolumeInUse() = %v, expected %v", tc.name, got, tc.exp)
+		}
+	}
+}
+
+func TestCSINodeID(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expNodeID   string
+		expErr      bool
+	}{
+		{
+			name:        "node ID",
+			annotations: map[string]string{nodeIDAnnotationKey: `{"other.csi.driver":"other","test-driver":"projects/p/zones/z/instances/n"}`},
+			expNodeID:   "projects/p/zones/z/instances/n",
+		},
+		{
+			name:   "no annotation",
+			expErr: true,
+		},
+		{
+			name:        "no node ID for driver",
+			annotations: map[string]string{nodeIDAnnotationKey: `{"other.csi.driver":"other"}`},
+			expErr:      true,
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{nodeIDAnnotationKey: "test-driver"},
+			expErr:      true,
+		},
+	}
+	for _, tc := range testCases {
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n", Annotations: tc.annotations}}
+		nodeID, err := csiNodeID(node, "test-driver")
+		if gotErr := err != nil; gotErr != tc.expErr {
+			t.Errorf("%s: csiNodeID() = %v; expected error: %v", tc.name, err, tc.expErr)
+			continue
+		}
+		if nodeID != tc.expNodeID {
+			t.Errorf("%s: csiNodeID() = %q, expected %q", tc.name, nodeID, tc.expNodeID)
+		}
+	}
+}
+
+func TestVolumesToPreDetach(t *testing.T) {
+	attachment := func(attacher, nodeName, pvName string, attached bool) storagev1.VolumeAttachment {
+		return storagev1.VolumeAttachment{
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: nodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+			Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+		}
+	}
+	attachments := []storagev1.VolumeAttachment{
+		attachment("test-driver", "node-1", "pv-unused", true),
+		attachment("test-driver", "node-1", "pv-in-use", true),
+		attachment("test-driver", "node-1", "pv-detached", false),
+		attachment("test-driver", "node-2", "pv-other-node", true),
+		attachment("other.csi.driver", "node-1", "pv-other-driver", true),
+		{
+			Spec:   storagev1.VolumeAttachmentSpec{Attacher: "test-driver", NodeName: "node-1"},
+			Status: storagev1.VolumeAttachmentStatus{Attached: true},
+		},
+	}
+	got := volumesToPreDetach("node-1", "test-driver", attachments, sets.NewString("pv-in-use"))
+	if exp := []string{"pv-unused"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("volumesToPreDetach() = %v, expected %v", got, exp)
+	}
+}
+
+func TestFindOrphanedAttachments(t *testing.T) {
+	node := func(name, instance string) v1.Node {
+		return v1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{nodeIDAnnotationKey: fmt.Sprintf(`{"test-driver":"projects/p/zones/%s/instances/%s"}`, zone, instance)},
+		}}
+	}
+	pv := func(name, driver, volumeID string) v1.PersistentVolume {
+		return v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeID},
+			}},
+		}
+	}
+	attachment := func(nodeName, pvName string) storagev1.VolumeAttachment {
+		return storagev1.VolumeAttachment{Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: "test-driver",
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		}}
+	}
+	disk := func(name string, instances ...string) *compute.Disk {
+		d := &compute.Disk{
+			Name:        name,
+			SelfLink:    gce.GCEComputeAPIEndpoint + common.CreateZonalVolumeID("p", zone, name),
+			Description: `{"storage.gke.io/created-by":"test-driver"}`,
 		}
-		if !sets.NewString(gotZones...).Equal(sets.NewString(tc.expZones...)) {
-			t.Errorf("Expected zones: %v, but got: %v", tc.expZones, gotZones)
+		for _, instance := range instances {
+			d.Users = append(d.Users, fmt.Sprintf("%sprojects/p/zones/%s/instances/%s", gce.GCEComputeAPIEndpoint, zone, instance))
 		}
+		return d
 	}
-}
 
-func TestPickRandAndConsecutive(t *testing.T) {
-	rand.Seed(time.Now().UnixNano())
-	testCases := []struct {
-		name   string
-		slice  []string
-		n      int
-		expErr bool
-	}{
+	nodes := []v1.Node{node("node-1", "instance-1"), node("node-2", "instance-2"), {ObjectMeta: metav1.ObjectMeta{Name: "node-3"}}}
+	pvs := []v1.PersistentVolume{
+		pv("pv-attached", "test-driver", common.CreateZonalVolumeID("p", zone, "attached")),
+		pv("pv-orphaned", "test-driver", common.CreateZonalVolumeID(common.UnspecifiedValue, zone, "orphaned")),
+		pv("pv-unknown-node", "test-driver", common.CreateZonalVolumeID("p", zone, "unknown-node")),
+		pv("pv-other-driver", "other.csi.driver", common.CreateZonalVolumeID("p", zone, "other-driver")),
+		pv("pv-unowned", "test-driver", common.CreateZonalVolumeID("p", zone, "unowned")),
+		pv("pv-busy", "test-driver", common.CreateZonalVolumeID("p", zone, "busy")),
+	}
+	attachments := []storagev1.VolumeAttachment{
+		attachment("node-1", "pv-attached"),
+		attachment("node-1", "pv-orphaned"),
+		attachment("node-3", "pv-unknown-node"),
+		attachment("node-1", "pv-unowned"),
+		attachment("node-1", "pv-busy"),
+	}
+	unowned := disk("unowned", "instance-1", "instance-2")
+	unowned.Description = ""
+	disks := []*compute.Disk{
+		disk("attached", "instance-1"),
+		disk("orphaned", "instance-1", "instance-2"),
+		disk("unknown-node", "instance-2"),
+		disk("other-driver", "instance-2"),
+		disk("boot-disk", "instance-2"),
+		unowned,
+		disk("busy", "instance-1", "instance-2"),
+	}
+	busy := sets.NewString(meta.ZonalKey("busy", zone).String())
+
+	got := findOrphanedAttachments("test-driver", pvs, attachments, nodes, disks, busy)
+	exp := []orphanedAttachment{
 		{
-			name:  "success: normal",
-			slice: []string{"test", "second", "third"},
-			n:     2,
+			VolumeID:     common.CreateZonalVolumeID("p", zone, "orphaned"),
+			PVName:       "pv-orphaned",
+			InstanceZone: zone,
+			InstanceName: "instance-2",
 		},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("findOrphanedAttachments() = %+v, expected %+v", got, exp)
+	}
+	if cmd, expCmd := detachDiskCommand(exp[0]), fmt.Sprintf("gcloud compute instances detach-disk instance-2 --zone=%s --disk=orphaned", zone); cmd != expCmd {
+		t.Errorf("detachDiskCommand() = %q, expected %q", cmd, expCmd)
+	}
+}
+
+func TestOrphanedAttachmentDetectorConfirm(t *testing.T) {
+	orphan := func(name string) orphanedAttachment {
+		return orphanedAttachment{VolumeID: common.CreateZonalVolumeID("p", zone, name), PVName: "pv-" + name, InstanceZone: zone, InstanceName: "instance-1"}
+	}
+	d := &OrphanedAttachmentDetector{}
+	checks := []struct {
+		candidates []orphanedAttachment
+		exp        []orphanedAttachment
+	}{
 		{
-			name:  "success: full",
-			slice: []string{"test", "second", "third"},
-			n:     3,
+			candidates: []orphanedAttachment{orphan("a"), orphan("b")},
 		},
 		{
-			name:  "success: large",
-			slice: []string{"test", "second", "third", "fourth", "fifth", "sixth"},
-			n:     2,
+			candidates: []orphanedAttachment{orphan("a"), orphan("c")},
+			exp:        []orphanedAttachment{orphan("a")},
 		},
 		{
-			name:   "fail: n too large",
-			slice:  []string{},
-			n:      2,
-			expErr: true,
+			candidates: []orphanedAttachment{orphan("b")},
 		},
 	}
-	for _, tc := range testCases {
-		t.Logf("test case: %s", tc.name)
-		tot := sets.String{}
-		sort.Strings(tc.slice)
-		for i := 0; i < 25; i++ {
-			theslice, err := pickRandAndConsecutive(tc.slice, tc.n)
-			if err != nil && !tc.expErr {
-				t.Errorf("Did not expect error but got: %v", err)
-			}
-			if err == nil && tc.expErr {
-				t.Errorf("Expected error but got none")
-			}
-			if err != nil {
-				break
-			}
-			if len(theslice) != tc.n {
-				t.Errorf("expected the resulting slice to be length %v, but got %v instead", tc.n, theslice)
-			}
-			// Find where it is in the slice
-			var idx = -1
-			for j, elem := range tc.slice {
-				if elem == theslice[0] {
-					idx = j
-					break
-				}
-			}
-			if idx == -1 {
-				t.Errorf("could not find %v in the original slice %v", theslice[0], tc.slice)
-			}
-			for j := 0; j < tc.n; j++ {
-				if theslice[j] != tc.slice[(idx+j)%len(tc.slice)] {
-					t.Errorf("did not pick sorted consecutive values from the slice")
-				}
-			}
-
-			tot.Insert(theslice...)
+	for i, check := range checks {
+		if got := d.confirm(check.candidates); !reflect.DeepEqual(got, check.exp) {
+			t.Errorf("check %d: confirm() = %+v, expected %+v", i, got, check.exp)
 		}
-		if !tot.Equal(sets.NewString(tc.slice...)) {
-			t.Errorf("randomly picking n from slice did not get all %v, instead got only %v", tc.slice, tot)
-		}
-
 	}
 }
 
-func TestVolumeOperationConcurrency(t *testing.T) {
-	readyToExecute := make(chan chan struct{}, 1)
-	gceDriver := initBlockingGCEDriver(t, []*gce.CloudDisk{
-		createZonalCloudDisk(name + "1"),
-		createZonalCloudDisk(name + "2"),
-	}, readyToExecute)
-	cs := gceDriver.cs
-
-	vol1CreateSnapshotAReq := &csi.CreateSnapshotRequest{
-		Name:           name + "1A",
-		SourceVolumeId: testVolumeID + "1",
+func TestInstancesToPrewarm(t *testing.T) {
+	node := func(name, instance string) v1.Node {
+		return v1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{nodeIDAnnotationKey: fmt.Sprintf(`{"test-driver":"projects/p/zones/%s/instances/%s"}`, zone, instance)},
+		}}
 	}
-	vol1CreateSnapshotBReq := &csi.CreateSnapshotRequest{
-		Name:           name + "1B",
-		SourceVolumeId: testVolumeID + "1",
+	pv := func(name, driver string) v1.PersistentVolume {
+		return v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: common.CreateZonalVolumeID("p", zone, name)},
+			}},
+		}
 	}
-	vol2CreateSnapshotReq := &csi.CreateSnapshotRequest{
-		Name:           name + "2",
-		SourceVolumeId: testVolumeID + "2",
+	attachment := func(attacher, nodeName, pvName string, attached bool) storagev1.VolumeAttachment {
+		return storagev1.VolumeAttachment{
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: nodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+			Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+		}
 	}
 
-	runRequest := func(req *csi.CreateSnapshotRequest) <-chan error {
-		response := make(chan error)
-		go func() {
-			_, err := cs.CreateSnapshot(context.Background(), req)
-			response <- err
-		}()
-		return response
+	nodes := []v1.Node{
+		node("node-1", "instance-1"),
+		node("node-2", "instance-2"),
+		node("node-3", "instance-3"),
+		node("node-4", "instance-4"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-5"}},
+	}
+	pvs := []v1.PersistentVolume{
+		pv("pv-1", "test-driver"),
+		pv("pv-2", "test-driver"),
+		pv("pv-3", "test-driver"),
+		pv("pv-other-driver", "other.csi.driver"),
+	}
+	attachments := []storagev1.VolumeAttachment{
+		attachment("test-driver", "node-1", "pv-1", true),
+		attachment("test-driver", "node-1", "pv-2", true),
+		attachment("test-driver", "node-2", "pv-3", false),
+		attachment("other.csi.driver", "node-3", "pv-other-driver", true),
+		attachment("test-driver", "node-4", "pv-deleted", true),
+		attachment("test-driver", "node-5", "pv-3", true),
 	}
 
-	// Start first valid request vol1CreateSnapshotA and block until it reaches the CreateSnapshot
-	vol1CreateSnapshotAResp := runRequest(vol1CreateSnapshotAReq)
-	execVol1CreateSnapshotA := <-readyToExecute
+	got := instancesToPrewarm("test-driver", pvs, attachments, nodes)
+	if exp := []string{common.CreateNodeID("p", zone, "instance-1")}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("instancesToPrewarm() = %v, expected %v", got, exp)
+	}
+}
 
-	// Start vol1CreateSnapshotB and allow it to execute to completion. Then check for Aborted error.
-	// If a non Abort error is received or if the operation was started, then there is a problem
-	// with volume locking
-	vol1CreateSnapshotBResp := runRequest(vol1CreateSnapshotBReq)
-	select {
-	case err := <-vol1CreateSnapshotBResp:
-		if err != nil {
-			serverError, ok := status.FromError(err)
-			if !ok {
-				t.Fatalf("Could not get error status code from err: %v", err)
-			}
-			if serverError.Code() != codes.Aborted {
-				t.Errorf("Expected error code: %v, got: %v. err : %v", codes.Aborted, serverError.Code(), err)
-			}
-		} else {
-			t.Errorf("Expected error: %v, got no error", codes.Aborted)
+func TestFindAttachPods(t *testing.T) {
+	volumeID := common.CreateZonalVolumeID("p", zone, "disk")
+	pv := func(name, driver, volumeID string, claim *v1.ObjectReference) v1.PersistentVolume {
+		return v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeID},
+				},
+				ClaimRef: claim,
+			},
 		}
-	case <-readyToExecute:
-		t.Errorf("The operation for vol1CreateSnapshotB should have been aborted, but was started")
 	}
-
-	// Start vol2CreateSnapshot and allow it to execute to completion. Then check for success.
-	vol2CreateSnapshotResp := runRequest(vol2CreateSnapshotReq)
-	execVol2CreateSnapshot := <-readyToExecute
-	execVol2CreateSnapshot <- struct{}{}
-	if err := <-vol2CreateSnapshotResp; err != nil {
-		t.Errorf("Unexpected error: %v", err)
+	pod := func(namespace, name, claimName string, phase v1.PodPhase) v1.Pod {
+		return v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec: v1.PodSpec{Volumes: []v1.Volume{{
+				Name:         "data",
+				VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+			}}},
+			Status: v1.PodStatus{Phase: phase},
+		}
 	}
-
-	// To clean up, allow the vol1CreateSnapshotA to complete
-	execVol1CreateSnapshotA <- struct{}{}
-	if err := <-vol1CreateSnapshotAResp; err != nil {
-		t.Errorf("Unexpected error: %v", err)
+	claim := &v1.ObjectReference{Namespace: "ns", Name: "claim"}
+	pods := []v1.Pod{
+		pod("ns", "writer-1", "claim", v1.PodRunning),
+		pod("ns", "reader", "claim", v1.PodPending),
+		pod("ns", "done", "claim", v1.PodSucceeded),
+		pod("ns", "other-claim", "other", v1.PodRunning),
+		pod("other-ns", "same-claim-name", "claim", v1.PodRunning),
 	}
-}
 
-func TestCreateVolumeDiskReady(t *testing.T) {
-	// Define test cases
 	testCases := []struct {
-		name       string
-		diskStatus string
-		req        *csi.CreateVolumeRequest
-		expVol     *csi.Volume
-		expErrCode codes.Code
+		name      string
+		pvs       []v1.PersistentVolume
+		expPods   []string
+		expectErr bool
 	}{
 		{
-			name:       "disk status RESTORING",
-			diskStatus: "RESTORING",
-			req: &csi.CreateVolumeRequest{
-				Name:               "test-name",
-				CapacityRange:      stdCapRange,
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
-			},
-			expErrCode: codes.Internal,
-		},
-		{
-			name:       "disk status CREATING",
-			diskStatus: "CREATING",
-			req: &csi.CreateVolumeRequest{
-				Name:               "test-name",
-				CapacityRange:      stdCapRange,
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
+			name: "pods using claim",
+			pvs: []v1.PersistentVolume{
+				pv("pv-other-driver", "other.csi.driver", volumeID, &v1.ObjectReference{Namespace: "ns", Name: "other"}),
+				pv("pv", "test-driver", common.CreateZonalVolumeID(common.UnspecifiedValue, zone, "disk"), claim),
 			},
-			expErrCode: codes.Internal,
+			expPods: []string{"ns/reader", "ns/writer-1"},
 		},
 		{
-			name:       "disk status DELETING",
-			diskStatus: "DELETING",
-			req: &csi.CreateVolumeRequest{
-				Name:               "test-name",
-				CapacityRange:      stdCapRange,
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
-			},
-			expErrCode: codes.Internal,
+			name:    "no pods using claim",
+			pvs:     []v1.PersistentVolume{pv("pv", "test-driver", volumeID, &v1.ObjectReference{Namespace: "ns", Name: "unused"})},
+			expPods: []string{},
 		},
 		{
-			name:       "disk status FAILED",
-			diskStatus: "FAILED",
-			req: &csi.CreateVolumeRequest{
-				Name:               "test-name",
-				CapacityRange:      stdCapRange,
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
-			},
-			expErrCode: codes.Internal,
+			name:      "unbound PV",
+			pvs:       []v1.PersistentVolume{pv("pv", "test-driver", volumeID, nil)},
+			expectErr: true,
 		},
 		{
-			name:       "success default",
-			diskStatus: "READY",
-			req: &csi.CreateVolumeRequest{
-				Name:               "test-name",
-				CapacityRange:      stdCapRange,
-				VolumeCapabilities: stdVolCaps,
-				Parameters:         stdParams,
-			},
-			expVol: &csi.Volume{
-				CapacityBytes:      common.GbToBytes(20),
-				VolumeId:           testVolumeID,
-				VolumeContext:      nil,
-				AccessibleTopology: stdTopology,
-			},
+			name:      "no PV",
+			pvs:       []v1.PersistentVolume{pv("pv-other-driver", "other.csi.driver", volumeID, claim)},
+			expectErr: true,
 		},
 	}
-
-	// Run test cases
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			fcp, err := gce.CreateFakeCloudProvider(project, zone, nil)
-			if err != nil {
-				t.Fatalf("Failed to create fake cloud provider: %v", err)
-			}
-
-			// Setup hook to create new disks with given status.
-			fcp.UpdateDiskStatus(tc.diskStatus)
-			// Setup new driver each time so no interference
-			gceDriver := initGCEDriverWithCloudProvider(t, fcp)
-			// Start Test
-			resp, err := gceDriver.cs.CreateVolume(context.Background(), tc.req)
-			//check response
-			if err != nil {
-				serverError, ok := status.FromError(err)
-				if !ok {
-					t.Fatalf("Could not get error status code from err: %v", serverError)
-				}
-				if serverError.Code() != tc.expErrCode {
-					t.Fatalf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, serverError.Code(), err)
+			got, err := findAttachPods("test-driver", volumeID, tc.pvs, pods)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got pods %v", got)
 				}
 				return
 			}
-			if tc.expErrCode != codes.OK {
-				t.Fatalf("Expected error: %v, got no error", tc.expErrCode)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
 			}
-
-			vol := resp.GetVolume()
-			if !reflect.DeepEqual(vol, tc.expVol) {
-				t.Fatalf("Mismatch in expected vol %v, current volume: %v\n", tc.expVol, vol)
+			if !reflect.DeepEqual(got, tc.expPods) {
+				t.Errorf("got pods %v, expected %v", got, tc.expPods)
 			}
 		})
 	}
 }
+
+func TestSnapshotDeleteQueueFairness(t *testing.T) {
+	// The queue is driven by hand, without its rate limited loop.
+	q := &snapshotDeleteQueue{
+		wake:    make(chan struct{}, 1),
+		pending: map[string][]*queuedSnapshotDelete{},
+	}
+	deletes := map[*queuedSnapshotDelete]string{}
+	queue := func(volume, name string) *queuedSnapshotDelete {
+		d := &queuedSnapshotDelete{admitted: make(chan struct{})}
+		deletes[d] = name
+		q.push(volume, d)
+		return d
+	}
+	queue("vol-a", "a1")
+	queue("vol-a", "a2")
+	a3 := queue("vol-a", "a3")
+	queue("vol-a", "a4")
+	queue("vol-b", "b1")
+	c1 := queue("vol-c", "c1")
+	q.remove("vol-a", a3)
+	q.remove("vol-c", c1)
+	queue("vol-c", "c2")
+
+	var admitted []string
+	for d := q.next(); d != nil; d = q.next() {
+		admitted = append(admitted, deletes[d])
+	}
+	if expAdmitted := []string{"a1", "b1", "c2", "a2", "a4"}; !reflect.DeepEqual(admitted, expAdmitted) {
+		t.Errorf("got deletes admitted in order %v, expected %v", admitted, expAdmitted)
+	}
+	if depth := q.queued(); depth != 0 {
+		t.Errorf("got queue depth %d after admitting all deletes, expected 0", depth)
+	}
+}
+
+func TestDeleteSnapshotRateLimited(t *testing.T) {
+	ctx := context.Background()
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	cs := gceDriver.cs
+	if _, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: testVolumeID}); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	// A queue that admits nothing turns the delete away once its context
+	// is done, and leaves the snapshot alone.
+	never := flowcontrol.NewFakeNeverRateLimiter()
+	defer never.Stop()
+	cs.snapshotDeletes = &snapshotDeleteQueue{
+		limiter: never,
+		wake:    make(chan struct{}, 1),
+		pending: map[string][]*queuedSnapshotDelete{},
+	}
+	go cs.snapshotDeletes.run()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err := cs.DeleteSnapshot(timeoutCtx, &csi.DeleteSnapshotRequest{SnapshotId: testSnapshotID})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("got %v from DeleteSnapshot with a full queue, expected %v", err, codes.Aborted)
+	}
+	if depth := cs.snapshotDeletes.queued(); depth != 0 {
+		t.Errorf("got queue depth %d after the delete gave up, expected 0", depth)
+	}
+	resp, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testSnapshotID})
+	if err != nil || len(resp.GetEntries()) != 1 {
+		t.Fatalf("got %v, %v listing the snapshot, expected it to be kept", resp, err)
+	}
+
+	cs.snapshotDeletes = newSnapshotDeleteQueue(1000, 1)
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: testSnapshotID}); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	resp, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: testSnapshotID})
+	if err != nil || len(resp.GetEntries()) != 0 {
+		t.Errorf("got %v, %v listing the deleted snapshot, expected no entries", resp, err)
+	}
+	// Deleting a snapshot that is already gone succeeds without queueing.
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: testSnapshotID}); err != nil {
+		t.Errorf("DeleteSnapshot of a deleted snapshot failed: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog"
+)
+
+// controllerDebugState is the controller state served by DebugHandler. It
+// holds the inputs of decisions that are otherwise only visible in code, such
+// as the zones a regional disk may be placed in.
+type controllerDebugState struct {
+	// ZonesCache maps each region looked up so far to its zones.
+	ZonesCache map[string][]string `json:"zonesCache"`
+	// OngoingOperations lists the volume IDs, or node/volume IDs for
+	// attach and detach, that currently hold a volume lock.
+	OngoingOperations []string `json:"ongoingOperations"`
+	// DiskCache summarizes the ListVolumes disk cache, if enabled.
+	DiskCache *diskCacheStatus `json:"diskCache,omitempty"`
+	// InstanceCache summarizes the attach and detach instance cache, if
+	// enabled.
+	InstanceCache *instanceCacheStatus `json:"instanceCache,omitempty"`
+	// OrphanedAttachments holds the result of the last orphaned attachment
+	// check, if enabled.
+	OrphanedAttachments *orphanedAttachmentsStatus `json:"orphanedAttachments,omitempty"`
+	// VolumeOperations holds the last operations on each volume by disk
+	// name, if the operation history is enabled.
+	VolumeOperations map[string][]operationRecord `json:"volumeOperations,omitempty"`
+}
+
+func (gceCS *GCEControllerServer) debugState() controllerDebugState {
+	state := controllerDebugState{
+		ZonesCache:        gceCS.CloudProvider.ZonesCache(),
+		OngoingOperations: gceCS.volumeLocks.List(),
+	}
+	if gceCS.diskCache != nil {
+		status := gceCS.diskCache.status()
+		state.DiskCache = &status
+	}
+	if gceCS.instanceCache != nil {
+		status := gceCS.instanceCache.status()
+		state.InstanceCache = &status
+	}
+	if gceCS.orphanDetector != nil {
+		status := gceCS.orphanDetector.status()
+		state.OrphanedAttachments = &status
+	}
+	if gceCS.opHistory != nil {
+		state.VolumeOperations = gceCS.opHistory.status()
+	}
+	return state
+}
+
+// DebugHandler returns an HTTP handler that dumps the controller caches and
+// ongoing operations as JSON.
+func (gceCS *GCEControllerServer) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.MarshalIndent(gceCS.debugState(), "", "  ")
+		if err != nil {
+			klog.Errorf("Failed to encode controller debug state: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	computev1 "google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+// diskCache is a periodically refreshed inventory of the disks in the project.
+// It lets ListVolumes page through a consistent snapshot without issuing a
+// full aggregatedList on every call, which times out in very large projects.
+type diskCache struct {
+	cloudProvider gce.GCECompute
+	filter        string
+
+	mux sync.RWMutex
+	// generation is bumped on every successful refresh and embedded in page
+	// tokens so that a token from an older snapshot is rejected.
+	generation  int64
+	disks       []*computev1.Disk
+	lastRefresh time.Time
+}
+
+func newDiskCache(cloudProvider gce.GCECompute, labels map[string]string) *diskCache {
+	return &diskCache{
+		cloudProvider: cloudProvider,
+		filter:        labelsFilter(labels),
+	}
+}
+
+// labelsFilter builds a GCE list filter matching disks that carry all of the
+// given labels. An empty map matches every disk.
+func labelsFilter(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	terms := make([]string, 0, len(keys))
+	for _, k := range keys {
+		terms = append(terms, fmt.Sprintf("(labels.%s = %q)", k, labels[k]))
+	}
+	return strings.Join(terms, " ")
+}
+
+// run refreshes the cache every period until stopCh is closed.
+func (c *diskCache) run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := c.refresh(context.Background()); err != nil {
+			klog.Errorf("Failed to refresh disk cache: %v", err)
+		}
+	}, period, stopCh)
+}
+
+func (c *diskCache) refresh(ctx context.Context) error {
+	disks, err := c.cloudProvider.AggregatedListDisks(ctx, c.filter)
+	if err != nil {
+		return err
+	}
+	// Sort so that pages are stable within a generation.
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].SelfLink < disks[j].SelfLink
+	})
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.generation++
+	c.disks = disks
+	c.lastRefresh = time.Now()
+	klog.V(4).Infof("Refreshed disk cache with %d disks (generation %d)", len(disks), c.generation)
+	return nil
+}
+
+// list returns up to maxEntries disks starting at pageToken, the token for the
+// next page and the time the cache was last refreshed. A zero time means the
+// cache has not been populated yet.
+func (c *diskCache) list(maxEntries int64, pageToken string) ([]*computev1.Disk, string, time.Time, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.lastRefresh.IsZero() {
+		return nil, "", c.lastRefresh, nil
+	}
+
+	var offset int64
+	if len(pageToken) != 0 {
+		var err error
+		offset, err = c.parsePageToken(pageToken)
+		if err != nil {
+			return nil, "", c.lastRefresh, err
+		}
+	}
+
+	end := int64(len(c.disks))
+	if maxEntries != 0 && offset+maxEntries < end {
+		end = offset + maxEntries
+	}
+	var nextToken string
+	if end < int64(len(c.disks)) {
+		nextToken = fmt.Sprintf("%d:%d", c.generation, end)
+	}
+	return c.disks[offset:end], nextToken, c.lastRefresh, nil
+}
+
+// diskCacheStatus summarizes the cache contents for the debug handler.
+type diskCacheStatus struct {
+	Generation  int64     `json:"generation"`
+	Disks       int       `json:"disks"`
+	LastRefresh time.Time `json:"lastRefresh"`
+}
+
+func (c *diskCache) status() diskCacheStatus {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return diskCacheStatus{
+		Generation:  c.generation,
+		Disks:       len(c.disks),
+		LastRefresh: c.lastRefresh,
+	}
+}
+
+func (c *diskCache) parsePageToken(pageToken string) (int64, error) {
+	splits := strings.Split(pageToken, ":")
+	if len(splits) != 2 {
+		return 0, fmt.Errorf("malformed page token %q", pageToken)
+	}
+	generation, err := strconv.ParseInt(splits[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed page token %q: %v", pageToken, err)
+	}
+	if generation != c.generation {
+		return 0, fmt.Errorf("page token %q is from a previous disk cache generation, current is %d", pageToken, c.generation)
+	}
+	offset, err := strconv.ParseInt(splits[1], 10, 64)
+	if err != nil || offset < 0 || offset > int64(len(c.disks)) {
+		return 0, fmt.Errorf("page token %q is out of range", pageToken)
+	}
+	return offset, nil
+}
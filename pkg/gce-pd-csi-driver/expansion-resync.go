@@ -0,0 +1,342 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/mount-utils"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/resizefs"
+)
+
+const (
+	// filesystemResizeSlack is the share of its device a filesystem may
+	// leave unused before it is grown. Filesystems report their size less
+	// their metadata, so a filesystem spanning its device still reports a
+	// few percent less than the device.
+	filesystemResizeSlack = 0.1
+
+	// expansionResyncEventReason is the reason of the events on the PVCs
+	// of volumes whose filesystem the resync grew, the same as the kubelet
+	// uses after NodeExpandVolume.
+	expansionResyncEventReason = "FileSystemResizeSuccessful"
+
+	// The kubelet stages each CSI filesystem volume at a globalmount
+	// directory under kubeletCSIPluginDir of its root directory, next to a
+	// kubeletVolDataFile naming the driver, the volume handle and the PV.
+	defaultKubeletRootDir = "/var/lib/kubelet"
+	kubeletCSIPluginDir   = "plugins/kubernetes.io/csi"
+	kubeletStagingDir     = "globalmount"
+	kubeletVolDataFile    = "vol_data.json"
+)
+
+// kubeletVolData is the part of the kubeletVolDataFile of a staged volume
+// used by the resync.
+type kubeletVolData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+	PVName       string `json:"specVolID"`
+}
+
+// readKubeletVolData reads the kubeletVolDataFile of the volume staged at
+// stagingPath.
+func readKubeletVolData(stagingPath string) (kubeletVolData, error) {
+	data := kubeletVolData{}
+	content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(stagingPath), kubeletVolDataFile))
+	if err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return data, fmt.Errorf("failed to parse %s of %s: %v", kubeletVolDataFile, stagingPath, err)
+	}
+	return data, nil
+}
+
+// stagedFilesystem is a filesystem volume staged on the node.
+type stagedFilesystem struct {
+	stagingPath string
+	partition   string
+}
+
+// stagedFilesystems records the filesystem volumes staged on the node by
+// volume ID. Volumes staged before the node service started are only known
+// once the ExpansionResyncer discovers them.
+type stagedFilesystems struct {
+	mux     sync.Mutex
+	volumes map[string]stagedFilesystem
+}
+
+func newStagedFilesystems() *stagedFilesystems {
+	return &stagedFilesystems{volumes: map[string]stagedFilesystem{}}
+}
+
+func (s *stagedFilesystems) add(volumeID, stagingPath, partition string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.volumes[volumeID] = stagedFilesystem{stagingPath: stagingPath, partition: partition}
+}
+
+func (s *stagedFilesystems) remove(volumeID string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.volumes, volumeID)
+}
+
+// list returns the IDs of the staged volumes, sorted, and their filesystems.
+func (s *stagedFilesystems) list() ([]string, map[string]stagedFilesystem) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	volumeIDs := make([]string, 0, len(s.volumes))
+	volumes := make(map[string]stagedFilesystem, len(s.volumes))
+	for volumeID, fs := range s.volumes {
+		volumeIDs = append(volumeIDs, volumeID)
+		volumes[volumeID] = fs
+	}
+	sort.Strings(volumeIDs)
+	return volumeIDs, volumes
+}
+
+// ExpansionResyncer grows the filesystems staged on the node that are
+// smaller than their disks. The kubelet only calls NodeExpandVolume while
+// the PVC is pending a node expansion, and a kubelet restart at the wrong
+// time leaves the PVC stuck there with the filesystem at its old size until
+// the volume is staged again.
+type ExpansionResyncer struct {
+	ns *GCENodeServer
+	// client, if set, is used to post an event on the PVC of each volume
+	// whose filesystem is grown.
+	client kubernetes.Interface
+
+	// Replaced in tests.
+	filesystemSize func(path string) (int64, error)
+	deviceSize     func(devicePath string) (int64, error)
+	resize         func(devicePath, path string) error
+}
+
+func NewExpansionResyncer(ns *GCENodeServer, client kubernetes.Interface) *ExpansionResyncer {
+	return &ExpansionResyncer{
+		ns:     ns,
+		client: client,
+		filesystemSize: func(path string) (int64, error) {
+			_, capacity, _, _, _, _, err := ns.VolumeStatter.StatFS(path)
+			return capacity, err
+		},
+		deviceSize: func(devicePath string) (int64, error) {
+			return getBlockSizeBytes(devicePath, ns.Mounter)
+		},
+		resize: func(devicePath, path string) error {
+			_, err := resizefs.NewResizeFs(ns.Mounter).Resize(devicePath, path)
+			return err
+		},
+	}
+}
+
+// Run discovers the filesystems staged before the node service started, then
+// checks the staged filesystems every period until stopCh is closed.
+func (r *ExpansionResyncer) Run(period time.Duration, stopCh <-chan struct{}) {
+	r.discover()
+	wait.Until(func() {
+		r.sync(context.Background())
+	}, period, stopCh)
+}
+
+func (r *ExpansionResyncer) sync(ctx context.Context) {
+	volumeIDs, volumes := r.ns.stagedFilesystems.list()
+	for _, volumeID := range volumeIDs {
+		fs := volumes[volumeID]
+		oldBytes, newBytes, err := r.resyncVolume(volumeID, fs)
+		if err != nil {
+			klog.Warningf("Failed to resync the expansion of volume %v at %s: %v", volumeID, fs.stagingPath, err)
+			continue
+		}
+		if newBytes > oldBytes {
+			klog.Infof("Grew the filesystem of volume %v at %s from %d to %d bytes, its expansion was not completed by NodeExpandVolume", volumeID, fs.stagingPath, oldBytes, newBytes)
+			r.postEvent(ctx, volumeID, fs.stagingPath, oldBytes, newBytes)
+		}
+	}
+}
+
+// discover records the read-write filesystems of the driver staged by the
+// kubelet, as found in the mount table, such as those staged before the node
+// service restarted. Volumes mounted from a partition, which the kubelet
+// does not record, are left out.
+func (r *ExpansionResyncer) discover() {
+	rootDir := r.ns.kubeletRootDir
+	if rootDir == "" {
+		rootDir = defaultKubeletRootDir
+	}
+	pluginDir := filepath.Join(rootDir, kubeletCSIPluginDir) + string(os.PathSeparator)
+	mountPoints, err := r.ns.Mounter.List()
+	if err != nil {
+		klog.Warningf("Failed to list mounts to discover the staged filesystems: %v", err)
+		return
+	}
+	for _, mp := range mountPoints {
+		if !strings.HasPrefix(mp.Path, pluginDir) || filepath.Base(mp.Path) != kubeletStagingDir || sets.NewString(mp.Opts...).Has("ro") {
+			continue
+		}
+		data, err := readKubeletVolData(mp.Path)
+		if err != nil {
+			klog.V(4).Infof("Not discovering the volume staged at %s: %v", mp.Path, err)
+			continue
+		}
+		if data.DriverName != r.ns.Driver.name || data.VolumeHandle == "" {
+			continue
+		}
+		r.discoverVolume(data.VolumeHandle, mp)
+	}
+}
+
+// discoverVolume records volumeID as staged at mp if mp is a mount of its
+// whole disk.
+func (r *ExpansionResyncer) discoverVolume(volumeID string, mp mount.MountPoint) {
+	// Volumes being staged or unstaged are tracked by the operation.
+	if acquired := r.ns.volumeLocks.TryAcquire(volumeID); !acquired {
+		return
+	}
+	defer r.ns.volumeLocks.Release(volumeID)
+
+	devicePath, err := getDevicePath(r.ns, volumeID, "")
+	if err != nil {
+		klog.V(4).Infof("Not discovering volume %v staged at %s: failed to get device path: %v", volumeID, mp.Path, err)
+		return
+	}
+	if !sameDevicePath(mp.Device, devicePath) {
+		klog.V(4).Infof("Not discovering volume %v staged at %s: mounted from %s, not its disk %s", volumeID, mp.Path, mp.Device, devicePath)
+		return
+	}
+	klog.V(4).Infof("Discovered volume %v staged at %s", volumeID, mp.Path)
+	r.ns.stagedFilesystems.add(volumeID, mp.Path, "")
+}
+
+// sameDevicePath returns true if a and b resolve to the same device path.
+func sameDevicePath(a, b string) bool {
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+	return a == b
+}
+
+// resyncVolume grows the filesystem of volumeID if it is smaller than its
+// device and returns its size before and after.
+func (r *ExpansionResyncer) resyncVolume(volumeID string, fs stagedFilesystem) (int64, int64, error) {
+	// Volumes being staged, unstaged or expanded are left to the operation.
+	if acquired := r.ns.volumeLocks.TryAcquire(volumeID); !acquired {
+		return 0, 0, nil
+	}
+	defer r.ns.volumeLocks.Release(volumeID)
+
+	if !r.ns.isVolumePathMounted(fs.stagingPath) {
+		return 0, 0, nil
+	}
+	devicePath, err := getDevicePath(r.ns, volumeID, fs.partition)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get device path: %v", err)
+	}
+	deviceBytes, err := r.deviceSize(devicePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get size of device %s: %v", devicePath, err)
+	}
+	oldBytes, err := r.filesystemSize(fs.stagingPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get filesystem size: %v", err)
+	}
+	if !filesystemNeedsResize(oldBytes, deviceBytes) {
+		return oldBytes, oldBytes, nil
+	}
+	if err := r.resize(devicePath, fs.stagingPath); err != nil {
+		return 0, 0, err
+	}
+	newBytes, err := r.filesystemSize(fs.stagingPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get filesystem size after resize: %v", err)
+	}
+	return oldBytes, newBytes, nil
+}
+
+// filesystemNeedsResize returns true if a filesystem of fsBytes leaves more
+// of a device of deviceBytes unused than its metadata could take.
+func filesystemNeedsResize(fsBytes, deviceBytes int64) bool {
+	return float64(fsBytes) < float64(deviceBytes)*(1-filesystemResizeSlack)
+}
+
+// postEvent posts an event on the PVC bound to the PV of volumeID, staged at
+// stagingPath. The PV is named in the kubeletVolDataFile of the staging path.
+// The event is best effort, the expansion is complete either way.
+func (r *ExpansionResyncer) postEvent(ctx context.Context, volumeID, stagingPath string, oldBytes, newBytes int64) {
+	if r.client == nil {
+		return
+	}
+	data, err := readKubeletVolData(stagingPath)
+	if err != nil || data.PVName == "" {
+		klog.Warningf("Not posting the resync event of volume %v, its PV is not known: %v", volumeID, err)
+		return
+	}
+	pv, err := r.client.CoreV1().PersistentVolumes().Get(ctx, data.PVName, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Failed to get PV %s to post the resync event of volume %v: %v", data.PVName, volumeID, err)
+		return
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != r.ns.Driver.name || pv.Spec.CSI.VolumeHandle != volumeID {
+		return
+	}
+	claim := pv.Spec.ClaimRef
+	if claim == nil {
+		return
+	}
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: claim.Name + ".",
+			Namespace:    claim.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Namespace:  claim.Namespace,
+			Name:       claim.Name,
+			UID:        claim.UID,
+		},
+		Reason:         expansionResyncEventReason,
+		Message:        fmt.Sprintf("Filesystem of volume %s on node %s grown from %d to %d bytes by the driver, after NodeExpandVolume did not complete the expansion", volumeID, r.ns.MetadataService.GetName(), oldBytes, newBytes),
+		Type:           v1.EventTypeNormal,
+		Source:         v1.EventSource{Component: r.ns.Driver.name, Host: r.ns.MetadataService.GetName()},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := r.client.CoreV1().Events(claim.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		klog.Warningf("Failed to post the resync event of volume %v on PVC %s/%s: %v", volumeID, claim.Namespace, claim.Name, err)
+	}
+}
@@ -16,10 +16,15 @@ package gceGCEDriver
 
 import (
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 	"k8s.io/mount-utils"
 	common "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
@@ -37,9 +42,23 @@ type GCEDriver struct {
 	ns  *GCENodeServer
 	cs  *GCEControllerServer
 
+	// manifest is returned by GetPluginInfo.
+	manifest map[string]string
+
 	vcap  []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 	nscap []*csi.NodeServiceCapability
+
+	// retryPolicies are keyed by CSI service or RPC name, and guarded by
+	// retryMux as they are replaced when the driver config is reloaded.
+	retryMux      sync.RWMutex
+	retryPolicies map[string]common.RetryPolicy
+
+	// logSampler samples the logs of frequently called methods.
+	logSampler *common.LogSampler
+
+	// concurrencyLimiter caps the calls in flight to each method.
+	concurrencyLimiter *common.ConcurrencyLimiter
 }
 
 func GetGCEDriver() *GCEDriver {
@@ -58,32 +77,71 @@ func (gceDriver *GCEDriver) SetupGCEDriver(name, vendorVersion string, extraVolu
 		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 	}
 	gceDriver.AddVolumeCapabilityAccessModes(vcam)
+	gceDriver.AddControllerServiceCapabilities(controllerServiceCapabilities(controllerServer))
+	gceDriver.AddNodeServiceCapabilities(nodeServiceCapabilities(nodeServer))
+
+	gceDriver.name = name
+	gceDriver.vendorVersion = vendorVersion
+	gceDriver.extraVolumeLabels = extraVolumeLabels
+	gceDriver.ids = identityServer
+	gceDriver.cs = controllerServer
+	gceDriver.ns = nodeServer
+
+	if controllerServer != nil && controllerServer.listVolumesCacheRefreshPeriod > 0 {
+		// Only disks carrying the driver's extra labels are cached, so that
+		// the inventory does not include unrelated disks in shared projects.
+		controllerServer.diskCache = newDiskCache(controllerServer.CloudProvider, extraVolumeLabels)
+		go controllerServer.diskCache.run(controllerServer.listVolumesCacheRefreshPeriod, wait.NeverStop)
+	}
+
+	return nil
+}
+
+// controllerServiceCapabilities returns the capabilities of the features
+// enabled on controllerServer, so that the sidecars do not call RPCs that
+// would be rejected.
+func controllerServiceCapabilities(controllerServer *GCEControllerServer) []csi.ControllerServiceCapability_RPC_Type {
 	csc := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	}
+	if controllerServer == nil || !controllerServer.disableExpansion {
+		csc = append(csc, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
 	}
-	gceDriver.AddControllerServiceCapabilities(csc)
-	ns := []csi.NodeServiceCapability_RPC_Type{
+	if controllerServer == nil || !controllerServer.disableSnapshots {
+		csc = append(csc,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		)
+	}
+	return csc
+}
+
+// nodeServiceCapabilities returns the capabilities of the features enabled
+// on nodeServer.
+func nodeServiceCapabilities(nodeServer *GCENodeServer) []csi.NodeServiceCapability_RPC_Type {
+	nsc := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 	}
-	gceDriver.AddNodeServiceCapabilities(ns)
-
-	gceDriver.name = name
-	gceDriver.vendorVersion = vendorVersion
-	gceDriver.extraVolumeLabels = extraVolumeLabels
-	gceDriver.ids = identityServer
-	gceDriver.cs = controllerServer
-	gceDriver.ns = nodeServer
+	if nodeServer == nil || !nodeServer.disableExpansion {
+		nsc = append(nsc, csi.NodeServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	return nsc
+}
 
-	return nil
+// expansionEnabled returns false if expansion is disabled on every service
+// the driver runs.
+func (gceDriver *GCEDriver) expansionEnabled() bool {
+	cs, ns := gceDriver.cs, gceDriver.ns
+	if cs == nil && ns == nil {
+		return true
+	}
+	return (cs != nil && !cs.disableExpansion) || (ns != nil && !ns.disableExpansion)
 }
 
 func (gceDriver *GCEDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_AccessMode_Mode) error {
@@ -136,22 +194,61 @@ func NewIdentityServer(gceDriver *GCEDriver) *GCEIdentityServer {
 	}
 }
 
-func NewNodeServer(gceDriver *GCEDriver, mounter *mount.SafeFormatAndMount, deviceUtils mountmanager.DeviceUtils, meta metadataservice.MetadataService, statter mountmanager.Statter) *GCENodeServer {
+func NewNodeServer(gceDriver *GCEDriver, mounter *mount.SafeFormatAndMount, deviceUtils mountmanager.DeviceUtils, meta metadataservice.MetadataService, statter mountmanager.Statter, args NodeServerArgs) *GCENodeServer {
+	var watchdog *operationWatchdog
+	if args.OperationHardLimit > 0 {
+		watchdog = newOperationWatchdog(args.OperationHardLimit)
+	}
+	ioLimitsCgroupRoot := ""
+	if args.EnableIOLimits {
+		ioLimitsCgroupRoot = cgroupRoot
+	}
 	return &GCENodeServer{
-		Driver:          gceDriver,
-		Mounter:         mounter,
-		DeviceUtils:     deviceUtils,
-		MetadataService: meta,
-		volumeLocks:     common.NewVolumeLocks(),
-		VolumeStatter:   statter,
+		Driver:                 gceDriver,
+		Mounter:                mounter,
+		DeviceUtils:            deviceUtils,
+		MetadataService:        meta,
+		volumeLocks:            common.NewVolumeLocks(),
+		VolumeStatter:          statter,
+		deviceDiscoveryTimeout: args.DeviceDiscoveryTimeout,
+		volumeAttachLimit:      args.VolumeAttachLimit,
+		enforceMountHardening:  args.EnforceMountHardening,
+
+		reportFilesystemTopology: args.ReportFilesystemTopology,
+		reportRegionTopology:     args.ReportRegionTopology,
+		kubeletRootDir:           args.KubeletRootDir,
+		stateDir:                 args.StateDir,
+		freezeBeforeUnstage:      args.FreezeBeforeUnstage,
+		watchdog:                 watchdog,
+		ioLimitsCgroupRoot:       ioLimitsCgroupRoot,
+		deepMountChecks:          args.DeepMountChecks,
+		stagedFilesystems:        newStagedFilesystems(),
+		disableExpansion:         args.DisableExpansion,
 	}
 }
 
-func NewControllerServer(gceDriver *GCEDriver, cloudProvider gce.GCECompute) *GCEControllerServer {
+func NewControllerServer(gceDriver *GCEDriver, cloudProvider gce.GCECompute, args ControllerServerArgs) *GCEControllerServer {
+	var cache *instanceCache
+	if args.InstanceCacheTTL > 0 {
+		cache = newInstanceCache(cloudProvider, args.InstanceCacheTTL)
+	}
 	return &GCEControllerServer{
-		Driver:        gceDriver,
-		CloudProvider: cloudProvider,
-		volumeLocks:   common.NewVolumeLocks(),
+		Driver:            gceDriver,
+		CloudProvider:     cloudProvider,
+		volumeLocks:       common.NewVolumeLocks(),
+		attachLocks:       common.NewVolumeLocks(),
+		disableSnapshots:  args.DisableSnapshots,
+		disableExpansion:  args.DisableExpansion,
+		parameterDefaults: args.ParameterDefaults,
+
+		listVolumesCacheRefreshPeriod: args.ListVolumesCacheRefreshPeriod,
+		allowUnownedDelete:            args.AllowUnownedDelete,
+		maxDetachPause:                args.MaxDetachPause,
+		expansionPolicy:               args.ExpansionPolicy,
+		instanceCache:                 cache,
+		snapshotUploads:               newSnapshotUploads(),
+		opHistory:                     newOperationHistory(args.OperationHistorySize),
+		snapshotDeletes:               newSnapshotDeleteQueue(args.SnapshotDeleteQPS, args.SnapshotDeleteBurst),
 	}
 }
 
@@ -159,7 +256,7 @@ func (gceDriver *GCEDriver) Run(endpoint string) {
 	klog.V(4).Infof("Driver: %v", gceDriver.name)
 
 	//Start the nonblocking GRPC
-	s := NewNonBlockingGRPCServer()
+	s := NewNonBlockingGRPCServer(gceDriver.retryPolicyFor, gceDriver.logSampler, gceDriver.concurrencyLimiter)
 	// TODO(#34): Only start specific servers based on a flag.
 	// In the future have this only run specific combinations of servers depending on which version this is.
 	// The schema for that was in util. basically it was just s.start but with some nil servers.
@@ -167,3 +264,51 @@ func (gceDriver *GCEDriver) Run(endpoint string) {
 	s.Start(endpoint, gceDriver.ids, gceDriver.cs, gceDriver.ns)
 	s.Wait()
 }
+
+// SetLogSampleInterval logs frequently called methods at most once per
+// interval. It must be called before Run.
+func (gceDriver *GCEDriver) SetLogSampleInterval(interval time.Duration) {
+	gceDriver.logSampler = common.NewLogSampler(interval)
+}
+
+// SetConcurrencyLimits caps the calls to each RPC that run at once. Calls
+// beyond the limit fail with Aborted. It must be called before Run.
+func (gceDriver *GCEDriver) SetConcurrencyLimits(limits common.ConcurrencyLimits) {
+	gceDriver.concurrencyLimiter = common.NewConcurrencyLimiter(limits)
+}
+
+// SetBuildInfo sets the build details reported in the GetPluginInfo manifest.
+// computeAPIVersions are empty when the controller is not running.
+func (gceDriver *GCEDriver) SetBuildInfo(gitCommit string, computeAPIVersions []string) {
+	gceDriver.manifest = map[string]string{
+		"gitCommit":          gitCommit,
+		"goVersion":          runtime.Version(),
+		"computeAPIVersions": strings.Join(computeAPIVersions, ","),
+	}
+}
+
+// SetRetryPolicies replaces the retry policies applied to incoming CSI calls.
+func (gceDriver *GCEDriver) SetRetryPolicies(policies map[string]common.RetryPolicy) {
+	gceDriver.retryMux.Lock()
+	defer gceDriver.retryMux.Unlock()
+	gceDriver.retryPolicies = policies
+}
+
+// retryPolicyFor returns the retry policy for a gRPC full method name such as
+// "/csi.v1.Controller/CreateVolume", or nil if calls to it are not retried.
+func (gceDriver *GCEDriver) retryPolicyFor(fullMethod string) *common.RetryPolicy {
+	gceDriver.retryMux.RLock()
+	defer gceDriver.retryMux.RUnlock()
+	parts := strings.Split(strings.TrimPrefix(fullMethod, "/"), "/")
+	if len(parts) != 2 {
+		return nil
+	}
+	if policy, ok := gceDriver.retryPolicies[parts[1]]; ok {
+		return &policy
+	}
+	service := parts[0][strings.LastIndex(parts[0], ".")+1:]
+	if policy, ok := gceDriver.retryPolicies[service]; ok {
+		return &policy
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ package gceGCEDriver
 
 import (
 	"context"
+	"strings"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -35,44 +36,55 @@ func (gceIdentity *GCEIdentityServer) GetPluginInfo(ctx context.Context, req *cs
 	return &csi.GetPluginInfoResponse{
 		Name:          gceIdentity.Driver.name,
 		VendorVersion: gceIdentity.Driver.vendorVersion,
+		Manifest:      gceIdentity.Driver.manifest,
 	}, nil
 }
 
 func (gceIdentity *GCEIdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	caps := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
-					},
+		},
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
 				},
 			},
-			{
+		},
+	}
+	if gceIdentity.Driver.expansionEnabled() {
+		caps = append(caps,
+			&csi.PluginCapability{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
 						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 					},
 				},
 			},
-			{
+			&csi.PluginCapability{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
 						Type: csi.PluginCapability_VolumeExpansion_OFFLINE,
 					},
 				},
 			},
-		},
-	}, nil
+		)
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+// Probe fails while a node operation has run beyond its hard limit, since
+// only a restart recovers the node plugin from it.
 func (gceIdentity *GCEIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if ns := gceIdentity.Driver.ns; ns != nil {
+		if stuck := ns.watchdog.stuckOperations(); len(stuck) > 0 {
+			return nil, status.Errorf(codes.Unavailable, "node operations are hung: %s", strings.Join(stuck, "; "))
+		}
+	}
 	return &csi.ProbeResponse{}, nil
 }
@@ -15,11 +15,19 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
 	"context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestGetPluginInfo(t *testing.T) {
@@ -30,6 +38,7 @@ func TestGetPluginInfo(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
+	gceDriver.SetBuildInfo("test-commit", []string{"v1", "beta"})
 
 	resp, err := gceDriver.ids.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
 	if err != nil {
@@ -44,6 +53,15 @@ func TestGetPluginInfo(t *testing.T) {
 	if respVer != vendorVersion {
 		t.Fatalf("Vendor version expected: %v, got: %v", vendorVersion, respVer)
 	}
+
+	expManifest := map[string]string{
+		"gitCommit":          "test-commit",
+		"goVersion":          runtime.Version(),
+		"computeAPIVersions": "v1,beta",
+	}
+	if !reflect.DeepEqual(resp.GetManifest(), expManifest) {
+		t.Fatalf("Manifest expected: %v, got: %v", expManifest, resp.GetManifest())
+	}
 }
 
 func TestGetPluginCapabilities(t *testing.T) {
@@ -92,3 +110,47 @@ func TestProbe(t *testing.T) {
 		t.Fatalf("Probe returned unexpected error: %v", err)
 	}
 }
+
+func TestProbeHungNodeOperation(t *testing.T) {
+	readyToExecute := make(chan chan struct{}, 1)
+	gceDriver := getTestBlockingGCEDriver(t, readyToExecute)
+	identityServer := NewIdentityServer(gceDriver)
+	now := time.Now()
+	gceDriver.ns.watchdog = newOperationWatchdog(time.Minute)
+	gceDriver.ns.watchdog.now = func() time.Time { return now }
+
+	tempDir, err := ioutil.TempDir("", "phno")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Block a publish in its mount.
+	resp := make(chan error)
+	go func() {
+		_, err := gceDriver.ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			TargetPath:        filepath.Join(tempDir, defaultTargetPath),
+			StagingTargetPath: filepath.Join(tempDir, defaultStagingPath),
+			VolumeCapability:  stdVolCap,
+		})
+		resp <- err
+	}()
+	execPublish := <-readyToExecute
+
+	if _, err := identityServer.Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe during a publish within the limit returned unexpected error: %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := identityServer.Probe(context.Background(), &csi.ProbeRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Probe during a hung publish returned %v, expected code %v", err, codes.Unavailable)
+	}
+
+	execPublish <- struct{}{}
+	if err := <-resp; err != nil {
+		t.Errorf("Unexpected publish error: %v", err)
+	}
+	if _, err := identityServer.Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe after the publish returned unexpected error: %v", err)
+	}
+}
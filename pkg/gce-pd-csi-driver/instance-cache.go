@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	computev1 "google.golang.org/api/compute/v1"
+	"k8s.io/klog"
+
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+// MaxInstanceCacheTTL bounds how long an instance may be served from the
+// cache, as attach state older than this is too likely to be wrong.
+const MaxInstanceCacheTTL = 5 * time.Second
+
+// instanceCache is a short-lived read-through cache of instances.get. During
+// a cluster-wide reboot every volume of a node is republished at once, and
+// without it each ControllerPublishVolume reads the same instance again.
+//
+// Entries are dropped whenever the controller attaches or detaches a disk on
+// the instance, so the cache only hides changes made by others, and only for
+// at most ttl. Callers re-read the instance before reporting that a disk is
+// already attached or detached, so a stale entry can only cost an extra call.
+type instanceCache struct {
+	cloudProvider gce.GCECompute
+	ttl           time.Duration
+
+	mux     sync.Mutex
+	entries map[string]instanceCacheEntry
+	// generation is bumped by every invalidate, so that a read that was
+	// in flight during an attach or detach is not cached.
+	generation int64
+	lastSweep  time.Time
+	hits       int64
+	misses     int64
+}
+
+type instanceCacheEntry struct {
+	instance *computev1.Instance
+	fetched  time.Time
+}
+
+func newInstanceCache(cloudProvider gce.GCECompute, ttl time.Duration) *instanceCache {
+	return &instanceCache{
+		cloudProvider: cloudProvider,
+		ttl:           ttl,
+		entries:       map[string]instanceCacheEntry{},
+	}
+}
+
+func instanceCacheKey(zone, name string) string {
+	return fmt.Sprintf("%s/%s", zone, name)
+}
+
+// get returns the instance and whether it was served from the cache. Errors
+// are not cached.
+func (c *instanceCache) get(ctx context.Context, zone, name string) (*computev1.Instance, bool, error) {
+	c.mux.Lock()
+	entry, ok := c.entries[instanceCacheKey(zone, name)]
+	if ok && time.Since(entry.fetched) < c.ttl {
+		c.hits++
+		c.mux.Unlock()
+		return entry.instance, true, nil
+	}
+	c.mux.Unlock()
+
+	instance, err := c.refresh(ctx, zone, name)
+	return instance, false, err
+}
+
+// refresh reads the instance from GCE, bypassing the cache, and caches it.
+func (c *instanceCache) refresh(ctx context.Context, zone, name string) (*computev1.Instance, error) {
+	key := instanceCacheKey(zone, name)
+	c.mux.Lock()
+	c.misses++
+	generation := c.generation
+	c.mux.Unlock()
+
+	fetched := time.Now()
+	instance, err := c.cloudProvider.GetInstanceOrError(ctx, zone, name)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err != nil {
+		delete(c.entries, key)
+		return nil, err
+	}
+	if generation == c.generation {
+		c.entries[key] = instanceCacheEntry{instance: instance, fetched: fetched}
+	}
+	c.sweepLocked(fetched)
+	return instance, nil
+}
+
+// invalidate drops the cached instance, so that the next get reads it from
+// GCE.
+func (c *instanceCache) invalidate(zone, name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.generation++
+	delete(c.entries, instanceCacheKey(zone, name))
+}
+
+// sweepLocked drops expired entries at most once per ttl, so that instances
+// that are no longer published to do not accumulate.
+func (c *instanceCache) sweepLocked(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, entry := range c.entries {
+		if now.Sub(entry.fetched) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+	klog.V(5).Infof("Swept instance cache, %d entries left", len(c.entries))
+}
+
+// instanceCacheStatus summarizes the cache contents for the debug handler.
+type instanceCacheStatus struct {
+	TTL     string `json:"ttl"`
+	Entries int    `json:"entries"`
+	Hits    int64  `json:"hits"`
+	Misses  int64  `json:"misses"`
+}
+
+func (c *instanceCache) status() instanceCacheStatus {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return instanceCacheStatus{
+		TTL:     c.ttl.String(),
+		Entries: len(c.entries),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"strings"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+const (
+	// metricLabelUnknown is the value of the metric labels a volume's
+	// requests don't tell, such as the disk type of a volume staged before
+	// the node service started.
+	metricLabelUnknown = "unknown"
+	// metricFsTypeBlock is the filesystem type label of block volumes.
+	metricFsTypeBlock = "block"
+)
+
+// nodeMetricLabels are the filesystem type and disk type the node operations
+// on a volume are recorded with.
+type nodeMetricLabels struct {
+	fsType   string
+	diskType string
+}
+
+var unknownNodeMetricLabels = nodeMetricLabels{fsType: metricLabelUnknown, diskType: metricLabelUnknown}
+
+// newNodeMetricLabels returns the labels of a volume staged or published with
+// vc and publishContext.
+func newNodeMetricLabels(vc *csi.VolumeCapability, publishContext map[string]string) nodeMetricLabels {
+	labels := unknownNodeMetricLabels
+	if vc.GetBlock() != nil {
+		labels.fsType = metricFsTypeBlock
+	} else if mnt := vc.GetMount(); mnt != nil {
+		labels.fsType = mnt.GetFsType()
+		if labels.fsType == "" {
+			labels.fsType = getDefaultFsType()
+		}
+	}
+	if diskType := publishContext[common.ContextKeyDiskType]; diskType != "" {
+		labels.diskType = diskType
+	}
+	return labels
+}
+
+// stagedVolumeLabels returns the labels volumeID was staged with, for the
+// operations whose requests carry neither its capability nor its publish
+// context.
+func (ns *GCENodeServer) stagedVolumeLabels(volumeID string) nodeMetricLabels {
+	if labels, ok := ns.volumeMetricLabels.Load(volumeID); ok {
+		return labels.(nodeMetricLabels)
+	}
+	return unknownNodeMetricLabels
+}
+
+// recordNodeOperation records the duration of operation since start. It is
+// meant to be deferred.
+func recordNodeOperation(operation string, labels nodeMetricLabels, start time.Time) {
+	metrics.RecordNodeOperation(operation, labels.fsType, labels.diskType, time.Since(start))
+}
+
+// filesystemTimedMounter returns a copy of m that records the duration of the
+// mkfs and fsck runs of FormatAndMount with labels.
+func filesystemTimedMounter(m *mount.SafeFormatAndMount, labels nodeMetricLabels) *mount.SafeFormatAndMount {
+	return &mount.SafeFormatAndMount{
+		Interface: m.Interface,
+		Exec:      &filesystemTimedExec{Interface: m.Exec, labels: labels},
+	}
+}
+
+// filesystemOperation returns the filesystem operation cmd runs, or "" if it
+// is not timed.
+func filesystemOperation(cmd string) string {
+	switch {
+	case strings.HasPrefix(cmd, "mkfs"):
+		return metrics.FilesystemOperationFormat
+	case strings.HasPrefix(cmd, "fsck"):
+		return metrics.FilesystemOperationCheck
+	default:
+		return ""
+	}
+}
+
+type filesystemTimedExec struct {
+	utilexec.Interface
+	labels nodeMetricLabels
+}
+
+func (e *filesystemTimedExec) Command(cmd string, args ...string) utilexec.Cmd {
+	c := e.Interface.Command(cmd, args...)
+	operation := filesystemOperation(cmd)
+	if operation == "" {
+		return c
+	}
+	return &filesystemTimedCmd{Cmd: c, operation: operation, labels: e.labels}
+}
+
+// filesystemTimedCmd times CombinedOutput, which is how mount-utils runs mkfs
+// and fsck.
+type filesystemTimedCmd struct {
+	utilexec.Cmd
+	operation string
+	labels    nodeMetricLabels
+}
+
+func (c *filesystemTimedCmd) CombinedOutput() ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		metrics.RecordFilesystemOperation(c.operation, c.labels.fsType, c.labels.diskType, time.Since(start))
+	}()
+	return c.Cmd.CombinedOutput()
+}
@@ -16,8 +16,15 @@ package gceGCEDriver
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"context"
 
@@ -29,8 +36,10 @@ import (
 	"k8s.io/klog"
 	"k8s.io/mount-utils"
 
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/backoff"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/resizefs"
 )
@@ -45,10 +54,167 @@ type GCENodeServer struct {
 	// A map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by VolumeID) return an Aborted error
 	volumeLocks *common.VolumeLocks
+
+	// How long NodeStageVolume keeps looking for an attached device before
+	// giving up. Zero means the device is only looked for once. It may be
+	// replaced at runtime by SetDeviceDiscoveryTimeout, so it is guarded by
+	// configMux.
+	configMux              sync.RWMutex
+	deviceDiscoveryTimeout time.Duration
+
+	// If non-zero, the volume limit reported by NodeGetInfo instead of the
+	// one computed from the machine type.
+	volumeAttachLimit int64
+
+	// If true, filesystem volumes are mounted noexec, nosuid and nodev
+	// unless they opt out. Guarded by configMux.
+	enforceMountHardening bool
+
+	// If true, NodeGetInfo reports the filesystems the node can mount in
+	// its topology.
+	reportFilesystemTopology bool
+
+	// If true, NodeGetInfo also reports the region of the node in its
+	// topology.
+	reportRegionTopology bool
+
+	// If set, NodePublishVolume rejects paths that are not under it.
+	kubeletRootDir string
+
+	// If set, the directory keeping state about volumes that must outlive
+	// their staging, such as which restored volumes have been prepared.
+	stateDir string
+
+	// If true, filesystems are frozen and thawed before being unstaged.
+	// Guarded by configMux.
+	freezeBeforeUnstage bool
+
+	// If set, tracks operations so that Probe fails while one is hung.
+	watchdog *operationWatchdog
+
+	// If set, the cgroup root under which the IO limits of volumes are
+	// applied to the pods they are published to.
+	ioLimitsCgroupRoot string
+
+	// If true, existing stage and publish mounts are also checked to be
+	// responsive and backed by the expected device.
+	deepMountChecks bool
+
+	// If set, the expansion capability is not advertised and
+	// NodeExpandVolume is rejected.
+	disableExpansion bool
+
+	// The writable filesystems staged on the node, which the expansion
+	// resync checks.
+	stagedFilesystems *stagedFilesystems
+
+	// The nodeMetricLabels of the volumes staged on the node by volume ID,
+	// for the operations on them whose requests don't carry the labels.
+	volumeMetricLabels sync.Map
+}
+
+type NodeServerArgs struct {
+	// DeviceDiscoveryTimeout bounds how long NodeStageVolume retries device
+	// discovery when the attached disk has not shown up on the node yet.
+	DeviceDiscoveryTimeout time.Duration
+
+	// VolumeAttachLimit overrides the number of volumes the node reports it
+	// can attach. Zero means the limit is computed from the machine type.
+	VolumeAttachLimit int64
+
+	// EnforceMountHardening mounts filesystem volumes with noexec, nosuid and
+	// nodev unless their volume context opts out. It has no effect on
+	// Windows.
+	EnforceMountHardening bool
+
+	// ReportFilesystemTopology adds a topology key for each filesystem the
+	// node can mount, so that CreateVolume can reject filesystems no node
+	// supports.
+	ReportFilesystemTopology bool
+
+	// ReportRegionTopology adds the region of the node as a topology key.
+	// Controllers that predate the key reject it, so it must only be set
+	// once every controller has been upgraded.
+	ReportRegionTopology bool
+
+	// KubeletRootDir, if set, is the directory NodePublishVolume target and
+	// staging paths must be under.
+	KubeletRootDir string
+
+	// StateDir, if set, is a directory on the host in which the node keeps
+	// state across reboots. Without it, volumes restored from snapshots are
+	// prepared each time they are staged.
+	StateDir string
+
+	// FreezeBeforeUnstage freezes and thaws filesystems before
+	// NodeUnstageVolume unmounts them, instead of only syncing them. It has
+	// no effect on Windows.
+	FreezeBeforeUnstage bool
+
+	// OperationHardLimit, if positive, is how long a node operation may run
+	// before Probe reports the node plugin unhealthy, so that the liveness
+	// probe restarts it.
+	OperationHardLimit time.Duration
+
+	// EnableIOLimits applies the IO limits set in the volume context of a
+	// volume to the cgroup of each pod it is published to. It has no effect
+	// on Windows.
+	EnableIOLimits bool
+
+	// DeepMountChecks makes NodeStageVolume and NodePublishVolume check that
+	// an existing mount answers statfs and is backed by the expected device,
+	// instead of only that it is a mount point. It has no effect on Windows.
+	DeepMountChecks bool
+
+	// DisableExpansion hides the expansion node capability so that the
+	// kubelet does not grow filesystems.
+	DisableExpansion bool
 }
 
 var _ csi.NodeServer = &GCENodeServer{}
 
+// SetDeviceDiscoveryTimeout replaces the device discovery timeout used by
+// subsequent NodeStageVolume calls.
+func (ns *GCENodeServer) SetDeviceDiscoveryTimeout(timeout time.Duration) {
+	ns.configMux.Lock()
+	defer ns.configMux.Unlock()
+	ns.deviceDiscoveryTimeout = timeout
+}
+
+func (ns *GCENodeServer) getDeviceDiscoveryTimeout() time.Duration {
+	ns.configMux.RLock()
+	defer ns.configMux.RUnlock()
+	return ns.deviceDiscoveryTimeout
+}
+
+// SetEnforceMountHardening sets whether subsequent stage and publish calls
+// harden the mount options of filesystem volumes.
+func (ns *GCENodeServer) SetEnforceMountHardening(enforce bool) {
+	ns.configMux.Lock()
+	defer ns.configMux.Unlock()
+	ns.enforceMountHardening = enforce
+}
+
+func (ns *GCENodeServer) getEnforceMountHardening() bool {
+	ns.configMux.RLock()
+	defer ns.configMux.RUnlock()
+	return ns.enforceMountHardening
+}
+
+// SetFreezeBeforeUnstage sets whether subsequent NodeUnstageVolume calls
+// freeze filesystems before unmounting them.
+func (ns *GCENodeServer) SetFreezeBeforeUnstage(freeze bool) {
+	ns.configMux.Lock()
+	defer ns.configMux.Unlock()
+	ns.freezeBeforeUnstage = freeze
+}
+
+func (ns *GCENodeServer) getFreezeBeforeUnstage() bool {
+	ns.configMux.RLock()
+	defer ns.configMux.RUnlock()
+	return ns.freezeBeforeUnstage
+}
+
 // The constants are used to map from the machine type to the limit of
 // persistent disks that can be attached to an instance. Please refer to gcloud
 // doc https://cloud.google.com/compute/docs/disks/#pdnumberlimits
@@ -60,8 +226,51 @@ const (
 	volumeLimitBig       int64 = 127
 	defaultLinuxFsType         = "ext4"
 	defaultWindowsFsType       = "ntfs"
+
+	// cgroupRoot is where the node plugin finds pod cgroups to apply IO
+	// limits to.
+	cgroupRoot = "/sys/fs/cgroup"
 )
 
+// mountOptions returns the options to mount a filesystem volume with, adding
+// the hardening options when they are enforced and the volume has not opted
+// out.
+func (ns *GCENodeServer) mountOptions(options []string, volumeContext map[string]string) ([]string, error) {
+	if !ns.getEnforceMountHardening() || runtime.GOOS == "windows" {
+		return options, nil
+	}
+	if v, ok := volumeContext[common.VolumeAttributeMountHardening]; ok {
+		hardening, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume attribute %s %q, must be true or false", common.VolumeAttributeMountHardening, v)
+		}
+		if !hardening {
+			return options, nil
+		}
+	}
+	return hardenMountOptions(options)
+}
+
+// skipJournalReplayOptions returns the mount options, not already in options,
+// that keep a filesystem of fstype from replaying its journal on mount.
+func skipJournalReplayOptions(fstype string, options []string) []string {
+	var option string
+	switch fstype {
+	case "ext3", "ext4":
+		option = "noload"
+	case "xfs":
+		option = "norecovery"
+	default:
+		return nil
+	}
+	for _, o := range options {
+		if o == option {
+			return nil
+		}
+	}
+	return []string{option}
+}
+
 func getDefaultFsType() string {
 	if runtime.GOOS == "windows" {
 		return defaultWindowsFsType
@@ -85,11 +294,108 @@ func (ns *GCENodeServer) isVolumePathMounted(path string) bool {
 	return false
 }
 
+// verifyMountDevice returns an error if deep mount checks are enabled and
+// the filesystem mounted at path does not answer statfs or is not backed by
+// the same device as source, which is either a block device or the path of
+// another mount of the same filesystem.
+func (ns *GCENodeServer) verifyMountDevice(path, source string) error {
+	if !ns.deepMountChecks || runtime.GOOS == "windows" {
+		return nil
+	}
+	major, minor, err := mountedDeviceNumber(path)
+	if err != nil {
+		return err
+	}
+	expMajor, expMinor, err := deviceNumber(source)
+	if err != nil {
+		expMajor, expMinor, err = mountedDeviceNumber(source)
+		if err != nil {
+			return err
+		}
+	}
+	if major != expMajor || minor != expMinor {
+		return fmt.Errorf("%s is on device %d:%d, expected %d:%d of %s", path, major, minor, expMajor, expMinor, source)
+	}
+	return nil
+}
+
+// checkDeviceUnclaimed returns an error if the device at devicePath is in
+// use other than by a mount at stagingTargetPath: either another device is
+// stacked on it, such as a multipath or LVM device set up by another
+// driver, or it is mounted elsewhere, such as in another CSI driver's
+// staging directory. Formatting or mounting it could corrupt its data.
+// Devices whose path does not resolve are not checked.
+func (ns *GCENodeServer) checkDeviceUnclaimed(devicePath, stagingTargetPath string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		klog.Warningf("Not checking if device %s is in use, could not resolve it: %v", devicePath, err)
+		return nil
+	}
+	holders, err := deviceHolders(realPath)
+	if err != nil {
+		return fmt.Errorf("failed to list the holders of %s: %v", realPath, err)
+	}
+	if len(holders) > 0 {
+		return fmt.Errorf("%s is held by %s", realPath, strings.Join(holders, ", "))
+	}
+	mountPoints, err := ns.Mounter.Interface.List()
+	if err != nil {
+		return fmt.Errorf("failed to list mounts: %v", err)
+	}
+	for _, mp := range mountPoints {
+		device := mp.Device
+		if resolved, err := filepath.EvalSymlinks(device); err == nil {
+			device = resolved
+		}
+		if device == realPath && comparablePath(mp.Path) != comparablePath(stagingTargetPath) {
+			return fmt.Errorf("%s is mounted at %s", realPath, mp.Path)
+		}
+	}
+	return nil
+}
+
+// checkPublishTarget returns whether targetPath already holds a usable
+// publish of the volume. A corrupted mount left behind by a kubelet that
+// crashed or restarted mid-publish is unmounted so that it is published
+// again. Other mounts at targetPath are left alone: a mount of another device
+// is AlreadyExists, and a filesystem bind mount of a staging path that is no
+// longer mounted, which exposes the empty staging directory as the volume, is
+// FailedPrecondition until the volume is unpublished and staged again.
+func (ns *GCENodeServer) checkPublishTarget(targetPath, stagingTargetPath string, vc *csi.VolumeCapability) (bool, error) {
+	notMnt, err := ns.Mounter.Interface.IsLikelyNotMountPoint(targetPath)
+	if mount.IsCorruptedMnt(err) {
+		klog.Warningf("NodePublishVolume target path %s is a corrupted mount, unmounting it to publish again: %v", targetPath, err)
+		if err := ns.Mounter.Interface.Unmount(targetPath); err != nil {
+			return false, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to unmount corrupted target path %s: %v", targetPath, err))
+		}
+		return false, nil
+	}
+	if err != nil || notMnt {
+		klog.V(4).Infof("NodePublishVolume target path %s is not mounted: %v", targetPath, err)
+		return false, nil
+	}
+	if vc.GetMount() == nil {
+		return true, nil
+	}
+	// TODO(#95): check that the existing mount is compatible with the request.
+	stagingNotMnt, err := ns.Mounter.Interface.IsLikelyNotMountPoint(stagingTargetPath)
+	if err != nil || !stagingNotMnt {
+		if err := ns.verifyMountDevice(targetPath, stagingTargetPath); err != nil {
+			return false, status.Error(codes.AlreadyExists, fmt.Sprintf("NodePublishVolume target path %s is already mounted but not from staging path %s: %v", targetPath, stagingTargetPath, err))
+		}
+		return true, nil
+	}
+	return false, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodePublishVolume target path %s is mounted but staging path %s is not, the volume must be unpublished and staged again", targetPath, stagingTargetPath))
+}
+
 func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	// Validate Arguments
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
-	readOnly := req.GetReadonly()
+	readOnly := req.GetReadonly() || req.GetVolumeContext()[common.VolumeAttributeReadOnly] == "true"
 	volumeID := req.GetVolumeId()
 	volumeCapability := req.GetVolumeCapability()
 	if len(volumeID) == 0 {
@@ -104,17 +410,37 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 	if volumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
 	}
+	targetPath, err := validateTargetPath(targetPath, ns.kubeletRootDir)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume Target Path is invalid: %v", err))
+	}
+	stagingTargetPath, err = validateTargetPath(stagingTargetPath, ns.kubeletRootDir)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume Staging Target Path is invalid: %v", err))
+	}
 
 	if acquired := ns.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer ns.volumeLocks.Release(volumeID)
+	defer ns.watchdog.track("NodePublishVolume", volumeID)()
+	defer recordNodeOperation(metrics.NodeOperationPublish, newNodeMetricLabels(volumeCapability, req.GetPublishContext()), time.Now())
 
 	if err := validateVolumeCapability(volumeCapability); err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapability is invalid: %v", err))
 	}
 
-	if ns.isVolumePathMounted(targetPath) {
+	mounted, err := ns.checkPublishTarget(targetPath, stagingTargetPath, volumeCapability)
+	if err != nil {
+		return nil, err
+	}
+	// The pod cgroup exists before kubelet publishes the volumes of the pod.
+	// The limits are also applied to existing publishes, so that they are
+	// set if an earlier publish failed after mounting.
+	if err := ns.applyIOLimits(volumeID, targetPath, req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	if mounted {
 		klog.V(4).Infof("NodePublishVolume succeeded on volume %v to %s, mount already exists.", volumeID, targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
@@ -126,7 +452,11 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 	if readOnly {
 		options = append(options, "ro")
 	}
-	var err error
+
+	metadata, err := getDiskMetadata(volumeID, req.GetPublishContext(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume invalid volume context: %v", err))
+	}
 
 	if mnt := volumeCapability.GetMount(); mnt != nil {
 		if mnt.FsType != "" {
@@ -141,6 +471,10 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 		for _, flag := range mnt.MountFlags {
 			options = append(options, flag)
 		}
+		options, err = ns.mountOptions(options, req.GetVolumeContext())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume invalid mount options: %v", err))
+		}
 
 		sourcePath = stagingTargetPath
 		if err := preparePublishPath(targetPath, ns.Mounter); err != nil {
@@ -205,10 +539,60 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 		return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume mount of disk failed: %v", err))
 	}
 
+	if metadata != nil {
+		// The metadata only helps to correlate incidents, so failing to write
+		// it does not fail the publish.
+		if volumeCapability.GetMount() == nil || readOnly {
+			klog.Warningf("Not writing disk metadata for volume %v to %s: only writable filesystem volumes can hold it", volumeID, targetPath)
+		} else if err := writeDiskMetadata(targetPath, metadata); err != nil {
+			klog.Warningf("Failed to write disk metadata for volume %v to %s: %v", volumeID, targetPath, err)
+		}
+	}
+
 	klog.V(4).Infof("NodePublishVolume succeeded on volume %v to %s", volumeID, targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// applyIOLimits limits the IO of the pod a volume is published to, if the
+// volume context sets IO limits.
+func (ns *GCENodeServer) applyIOLimits(volumeID, targetPath string, volumeContext map[string]string) error {
+	v, ok := volumeContext[common.VolumeAttributeIOMax]
+	if !ok {
+		return nil
+	}
+	limits, err := common.ParseIOLimits(v)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume invalid volume attribute %s: %v", common.VolumeAttributeIOMax, err))
+	}
+	if ns.ioLimitsCgroupRoot == "" {
+		klog.Warningf("Not applying IO limits %q of volume %v: IO limits are not enabled on this node", limits, volumeID)
+		return nil
+	}
+	podUID, err := podUIDFromPublishRequest(targetPath, volumeContext)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume cannot apply IO limits: %v", err))
+	}
+	// io.max only accepts whole disks, so the limits apply to the disk
+	// whatever partition is published.
+	devicePath, err := getDevicePath(ns, volumeID, "")
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume cannot apply IO limits: %v", err))
+	}
+	major, minor, err := deviceNumber(devicePath)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume cannot apply IO limits to %s: %v", devicePath, err))
+	}
+	cgroupDir, err := findPodCgroup(ns.ioLimitsCgroupRoot, podUID)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume cannot apply IO limits: %v", err))
+	}
+	if err := writeCgroupIOLimits(cgroupDir, major, minor, limits); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to apply IO limits to %s: %v", cgroupDir, err))
+	}
+	klog.V(4).Infof("Applied IO limits %q of volume %v on device %d:%d to pod cgroup %s", limits, volumeID, major, minor, cgroupDir)
+	return nil
+}
+
 func makeFile(path string) error {
 	// Create file
 	newFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0750)
@@ -236,6 +620,8 @@ func (ns *GCENodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeU
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer ns.volumeLocks.Release(volumeID)
+	defer ns.watchdog.track("NodeUnpublishVolume", volumeID)()
+	defer recordNodeOperation(metrics.NodeOperationUnpublish, ns.stagedVolumeLabels(volumeID), time.Now())
 
 	if err := cleanupPublishPath(targetPath, ns.Mounter); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unmount failed: %v\nUnmounting arguments: %s\n", err, targetPath))
@@ -263,6 +649,10 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer ns.volumeLocks.Release(volumeID)
+	defer ns.watchdog.track("NodeStageVolume", volumeID)()
+	metricLabels := newNodeMetricLabels(volumeCapability, req.GetPublishContext())
+	ns.volumeMetricLabels.Store(volumeID, metricLabels)
+	defer recordNodeOperation(metrics.NodeOperationStage, metricLabels, time.Now())
 
 	if err := validateVolumeCapability(volumeCapability); err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapability is invalid: %v", err))
@@ -281,16 +671,24 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 	if part, ok := req.GetVolumeContext()[common.VolumeAttributePartition]; ok {
 		partition = part
 	}
-	devicePath, err := getDevicePath(ns, volumeID, partition)
 
+	devicePath, err := ns.waitForDevicePath(ctx, volumeID, partition)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Error when getting device path: %v", err))
 	}
 
-	klog.V(4).Infof("Successfully found attached GCE PD %q at device path %s.", volumeKey.Name, devicePath)
+	if diskInterface, ok := req.GetPublishContext()[common.ContextKeyDiskInterface]; ok {
+		klog.V(4).Infof("Successfully found attached GCE PD %q at device path %s, attached over %s.", volumeKey.Name, devicePath, diskInterface)
+	} else {
+		klog.V(4).Infof("Successfully found attached GCE PD %q at device path %s.", volumeKey.Name, devicePath)
+	}
 
 	// Part 2: Check if mount already exists at stagingTargetPath
 	if ns.isVolumePathMounted(stagingTargetPath) {
+		if err := ns.verifyMountDevice(stagingTargetPath, devicePath); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume staging path %s failed the deep mount check: %v", stagingTargetPath, err))
+		}
+		ns.trackStagedFilesystem(volumeID, stagingTargetPath, partition, volumeCapability, req.GetVolumeContext())
 		klog.V(4).Infof("NodeStageVolume succeeded on volume %v to %s, mount already exists.", volumeID, stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
@@ -299,6 +697,13 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		return nil, status.Error(codes.Internal, fmt.Sprintf("mkdir failed on disk %s (%v)", stagingTargetPath, err))
 	}
 
+	// Block volumes are left alone, as pods may stack devices on them.
+	if volumeCapability.GetMount() != nil {
+		if err := ns.checkDeviceUnclaimed(devicePath, stagingTargetPath); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume device %s of volume %v is in use by another driver or system: %v", devicePath, volumeID, err))
+		}
+	}
+
 	// Part 3: Mount device to stagingTargetPath
 	fstype := getDefaultFsType()
 
@@ -310,23 +715,195 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		for _, flag := range mnt.MountFlags {
 			options = append(options, flag)
 		}
+		if req.GetVolumeContext()[common.VolumeAttributeReadOnly] == "true" {
+			// The disk is attached read-only, so neither formatting nor a
+			// read-write mount could succeed, nor could replaying a journal
+			// the snapshot left unclean.
+			options = append(options, "ro")
+			options = append(options, skipJournalReplayOptions(fstype, options)...)
+		}
+		options, err = ns.mountOptions(options, req.GetVolumeContext())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume invalid mount options: %v", err))
+		}
+		options, err = applyDiscardPolicy(options, req.GetVolumeContext())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume invalid mount options: %v", err))
+		}
 	} else if blk := volumeCapability.GetBlock(); blk != nil {
 		// Noop for Block NodeStageVolume
 		klog.V(4).Infof("NodeStageVolume succeeded on %v to %s, capability is block so this is a no-op", volumeID, stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	err = formatAndMount(devicePath, stagingTargetPath, fstype, options, ns.Mounter)
+	regenerateUUID := req.GetVolumeContext()[common.VolumeAttributeRegenerateFSUUID] == "true"
+	mountOptions := options
+	if regenerateUUID && fstype == "xfs" {
+		// Until its UUID is regenerated, xfs refuses to mount a restored
+		// filesystem on the node that mounts its source.
+		mountOptions = append(mountOptions, "nouuid")
+	}
+	err = formatAndMount(devicePath, stagingTargetPath, fstype, mountOptions, filesystemTimedMounter(ns.Mounter, metricLabels))
 	if err != nil {
 		return nil, status.Error(codes.Internal,
 			fmt.Sprintf("Failed to format and mount device from (%q) to (%q) with fstype (%q) and options (%q): %v",
-				devicePath, stagingTargetPath, fstype, options, err))
+				devicePath, stagingTargetPath, fstype, mountOptions, err))
+	}
+
+	trim := req.GetVolumeContext()[common.VolumeAttributeTrimAfterRestore] == "true"
+	if regenerateUUID || trim {
+		if err := ns.prepareRestoredFilesystem(volumeID, devicePath, stagingTargetPath, fstype, options, regenerateUUID, trim); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to prepare restored volume %v: %v", volumeID, err))
+		}
 	}
 
+	ns.trackStagedFilesystem(volumeID, stagingTargetPath, partition, volumeCapability, req.GetVolumeContext())
 	klog.V(4).Infof("NodeStageVolume succeeded on %v to %s", volumeID, stagingTargetPath)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// trackStagedFilesystem records volumeID, staged at stagingTargetPath, for
+// the expansion resync if it is a filesystem mounted read-write.
+func (ns *GCENodeServer) trackStagedFilesystem(volumeID, stagingTargetPath, partition string, vc *csi.VolumeCapability, volumeContext map[string]string) {
+	mnt := vc.GetMount()
+	if mnt == nil || volumeContext[common.VolumeAttributeReadOnly] == "true" {
+		return
+	}
+	switch vc.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return
+	}
+	for _, flag := range mnt.MountFlags {
+		if flag == "ro" {
+			return
+		}
+	}
+	ns.stagedFilesystems.add(volumeID, stagingTargetPath, partition)
+}
+
+// restorePreparedDir is the directory under the state directory holding a
+// file for each restored volume that has been prepared, named by its escaped
+// volume ID and holding the UUID of its filesystem once prepared. The state
+// is kept outside of the filesystem so that preparing a volume does not
+// change the user's files.
+const restorePreparedDir = "restore-prepared"
+
+// restorePreparedPath returns the file recording the preparation of the
+// restored volume volumeID, or "" if the node keeps no state.
+func (ns *GCENodeServer) restorePreparedPath(volumeID string) string {
+	if ns.stateDir == "" {
+		return ""
+	}
+	return filepath.Join(ns.stateDir, restorePreparedDir, url.PathEscape(volumeID))
+}
+
+// restorePrepared returns whether the filesystem on devicePath is the one
+// recorded as prepared in statePath. A filesystem with another UUID, such as
+// one restored again under the same volume ID, is not.
+func restorePrepared(statePath, devicePath string, m *mount.SafeFormatAndMount) (bool, error) {
+	recorded, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	uuid, err := filesystemUUID(devicePath, m)
+	if err != nil {
+		return false, err
+	}
+	return string(recorded) == uuid, nil
+}
+
+// recordRestorePrepared records in statePath that the filesystem on
+// devicePath has been prepared.
+func recordRestorePrepared(statePath, devicePath string, m *mount.SafeFormatAndMount) error {
+	uuid, err := filesystemUUID(devicePath, m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, []byte(uuid), 0600)
+}
+
+// prepareRestoredFilesystem gives the filesystem of a volume restored from a
+// snapshot, which is mounted at stagingTargetPath, a new UUID and trims it,
+// unless that was done by an earlier stage of the volume on this node. The
+// preparation is best effort, as the volume is usable without it, so only an
+// error leaving the filesystem unmounted is returned.
+func (ns *GCENodeServer) prepareRestoredFilesystem(volumeID, devicePath, stagingTargetPath, fstype string, options []string, regenerateUUID, trim bool) error {
+	statePath := ns.restorePreparedPath(volumeID)
+	if statePath != "" {
+		prepared, err := restorePrepared(statePath, devicePath, ns.Mounter)
+		if err != nil {
+			klog.Warningf("Not preparing restored volume %v, failed to check %s: %v", volumeID, statePath, err)
+			return nil
+		}
+		if prepared {
+			klog.V(4).Infof("Restored volume %v was already prepared", volumeID)
+			return nil
+		}
+	}
+
+	if regenerateUUID {
+		// A volume restored from a snapshot carries the UUID of its source
+		// filesystem, and xfs refuses to mount two filesystems with the
+		// same UUID on one node. The UUID can only be changed while the
+		// filesystem is unmounted.
+		if err := ns.Mounter.Unmount(stagingTargetPath); err != nil {
+			klog.Warningf("Not regenerating the filesystem UUID of volume %v, failed to unmount %s: %v", volumeID, stagingTargetPath, err)
+		} else {
+			if err := regenerateFilesystemUUID(devicePath, ns.Mounter); err != nil {
+				klog.Warningf("Failed to regenerate the filesystem UUID of volume %v at %s: %v", volumeID, devicePath, err)
+			}
+			if err := formatAndMount(devicePath, stagingTargetPath, fstype, options, ns.Mounter); err != nil {
+				return fmt.Errorf("failed to remount %s at %s after regenerating its filesystem UUID: %v", devicePath, stagingTargetPath, err)
+			}
+		}
+	}
+	if trim {
+		// Blocks that were in use in the snapshot but are free in the
+		// filesystem are released, which shrinks thin-provisioned disks.
+		if err := trimFilesystem(stagingTargetPath, ns.Mounter); err != nil {
+			klog.Warningf("Failed to trim volume %v at %s: %v", volumeID, stagingTargetPath, err)
+		}
+	}
+	if statePath != "" {
+		if err := recordRestorePrepared(statePath, devicePath, ns.Mounter); err != nil {
+			klog.Warningf("Failed to record restored volume %v as prepared, it will be prepared again when next staged: %v", volumeID, err)
+		}
+	}
+	return nil
+}
+
+// waitForDevicePath looks up the device path for the volume, retrying until
+// the device appears, deviceDiscoveryTimeout elapses or ctx is done. Attach
+// can complete on the GCE side slightly before the device is visible to the
+// node, and failing right away would leave it to kubelet to retry with a much
+// longer backoff.
+func (ns *GCENodeServer) waitForDevicePath(ctx context.Context, volumeID, partition string) (string, error) {
+	timeout := ns.getDeviceDiscoveryTimeout()
+	devicePath, err := getDevicePath(ns, volumeID, partition)
+	if err == nil || timeout <= 0 {
+		return devicePath, err
+	}
+
+	start := time.Now()
+	pollErr := backoff.Retry(ctx, backoff.Fast.WithTimeout(timeout), func() (bool, error) {
+		klog.V(6).Infof("Retrying device discovery for volume %v after %v: %v", volumeID, time.Since(start), err)
+		devicePath, err = getDevicePath(ns, volumeID, partition)
+		return err == nil, nil
+	})
+	if pollErr != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", fmt.Errorf("device for volume %v did not appear before the request ended after %v: %v: %v", volumeID, time.Since(start), ctxErr, err)
+		}
+		return "", fmt.Errorf("device for volume %v did not appear after %v: %v", volumeID, timeout, err)
+	}
+	return devicePath, nil
+}
+
 func (ns *GCENodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	// Validate arguments
 	volumeID := req.GetVolumeId()
@@ -342,15 +919,41 @@ func (ns *GCENodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUns
 		return nil, status.Error(codes.Aborted, fmt.Sprintf("An operation with the given Volume ID %s already exists", volumeID))
 	}
 	defer ns.volumeLocks.Release(volumeID)
+	defer ns.watchdog.track("NodeUnstageVolume", volumeID)()
+	defer recordNodeOperation(metrics.NodeOperationUnstage, ns.stagedVolumeLabels(volumeID), time.Now())
 
+	ns.flushStagedVolume(ctx, volumeID, stagingTargetPath)
+
+	ns.stagedFilesystems.remove(volumeID)
 	if err := cleanupStagePath(stagingTargetPath, ns.Mounter); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeUnstageVolume failed: %v\nUnmounting arguments: %s\n", err, stagingTargetPath))
 	}
+	ns.volumeMetricLabels.Delete(volumeID)
 
 	klog.V(4).Infof("NodeUnstageVolume succeeded on %v from %s", volumeID, stagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// flushStagedVolume writes out the dirty pages of the filesystem staged at
+// stagingTargetPath and the buffers of the volume's device, so that a detach
+// right after unstaging, as during a node drain, cannot lose them. Unmounting
+// flushes them as well, so failures are only logged.
+func (ns *GCENodeServer) flushStagedVolume(ctx context.Context, volumeID, stagingTargetPath string) {
+	if ns.isVolumePathMounted(stagingTargetPath) {
+		if err := syncFilesystem(ctx, stagingTargetPath, ns.getFreezeBeforeUnstage(), ns.Mounter); err != nil {
+			klog.Warningf("Failed to sync volume %v at %s before unstaging: %v", volumeID, stagingTargetPath, err)
+		}
+	}
+	devicePath, err := getDevicePath(ns, volumeID, "")
+	if err != nil {
+		klog.V(4).Infof("Not flushing the device buffers of volume %v: %v", volumeID, err)
+		return
+	}
+	if err := flushDeviceBuffers(devicePath, ns.Mounter); err != nil {
+		klog.Warningf("Failed to flush the device buffers of volume %v at %s before unstaging: %v", volumeID, devicePath, err)
+	}
+}
+
 func (ns *GCENodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: ns.Driver.nscap,
@@ -358,8 +961,33 @@ func (ns *GCENodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeG
 }
 
 func (ns *GCENodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	zone := ns.MetadataService.GetZone()
 	top := &csi.Topology{
-		Segments: map[string]string{common.TopologyKeyZone: ns.MetadataService.GetZone()},
+		Segments: map[string]string{common.TopologyKeyZone: zone},
+	}
+	if ns.reportRegionTopology {
+		// Publishing the region as well lets volumes whose topology only
+		// names a region be scheduled onto nodes.
+		region, err := common.GetRegionFromZones([]string{zone})
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get region from zone %v: %v", zone, err))
+		}
+		top.Segments[common.TopologyKeyRegion] = region
+	}
+
+	if ns.reportFilesystemTopology {
+		// The key is reported even when the filesystems are unknown, so that
+		// all nodes have the same topology keys.
+		value := common.TopologyFilesystemsUnknown
+		filesystems, err := supportedFilesystems()
+		if err != nil {
+			// The node is still usable, CreateVolume assumes that nodes
+			// with unknown filesystems support all of them.
+			klog.Warningf("Reporting unknown supported filesystems: %v", err)
+		} else {
+			value = filesystemTopologyValue(filesystems)
+		}
+		top.Segments[common.TopologyKeyFilesystems] = value
 	}
 
 	nodeID := common.CreateNodeID(ns.MetadataService.GetProject(), ns.MetadataService.GetZone(), ns.MetadataService.GetName())
@@ -382,6 +1010,8 @@ func (ns *GCENodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
+	defer ns.watchdog.track("NodeGetVolumeStats", req.VolumeId)()
+
 	_, err := os.Lstat(req.VolumePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -432,6 +1062,9 @@ func (ns *GCENodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 }
 
 func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if ns.disableExpansion {
+		return nil, status.Error(codes.Unimplemented, "NodeExpandVolume is disabled on this driver")
+	}
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume ID must be provided")
@@ -451,35 +1084,50 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume ID is invalid: %v", err))
 	}
+	defer ns.watchdog.track("NodeExpandVolume", volumeID)()
 
 	devicePath, err := getDevicePath(ns, volumeID, "")
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("error when getting device path for %s: %v", volumeID, err))
 	}
 
+	isBlock := false
 	volumeCapability := req.GetVolumeCapability()
 	if volumeCapability != nil {
 		// VolumeCapability is optional, if specified, validate it
 		if err := validateVolumeCapability(volumeCapability); err != nil {
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapability is invalid: %v", err))
 		}
-
-		if blk := volumeCapability.GetBlock(); blk != nil {
-			// Noop for Block NodeExpandVolume
-			klog.V(4).Infof("NodeExpandVolume succeeded on %v to %s, capability is block so this is a no-op", volumeID, volumePath)
-			return &csi.NodeExpandVolumeResponse{}, nil
+		isBlock = volumeCapability.GetBlock() != nil
+	} else {
+		// Without a capability, a block volume is told apart by its path
+		// being the device rather than a mount point.
+		isBlock, err = isBlockDevice(volumePath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("error checking volume path %s: %v", volumePath, err))
 		}
 	}
 
-	// TODO(#328): Use requested size in resize if provided
-	resizer := resizefs.NewResizeFs(ns.Mounter)
-	_, err = resizer.Resize(devicePath, volumePath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("error when resizing volume %s: %v", volKey.String(), err))
+	if isBlock {
+		// There is no filesystem to resize, but the node may not have
+		// picked up the new size of the disk yet.
+		if err := rescanBlockDevice(devicePath, ns.Mounter); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("error when rescanning block volume %s: %v", volKey.String(), err))
+		}
+	} else {
+		// TODO(#328): Use requested size in resize if provided
+		resizer := resizefs.NewResizeFs(ns.Mounter)
+		_, err = resizer.Resize(devicePath, volumePath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("error when resizing volume %s: %v", volKey.String(), err))
 
+		}
 	}
 
 	diskSizeBytes, err := getBlockSizeBytes(devicePath, ns.Mounter)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("error when getting size of volume %s: %v", volKey.String(), err))
+	}
 	if diskSizeBytes < reqBytes {
 		// It's possible that the somewhere the volume size was rounded up, getting more size than requested is a success :)
 		return nil, status.Errorf(codes.Internal, "resize requested for %v but after resize volume was size %v", reqBytes, diskSizeBytes)
@@ -506,13 +1154,17 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 	*/
 
 	// Respond
-	klog.V(4).Infof("NodeExpandVolume succeeded on volume %v to size %v", volKey, reqBytes)
+	klog.V(4).Infof("NodeExpandVolume succeeded on volume %v to size %v, block: %v", volKey, reqBytes, isBlock)
 	return &csi.NodeExpandVolumeResponse{
 		CapacityBytes: reqBytes,
 	}, nil
 }
 
 func (ns *GCENodeServer) GetVolumeLimits() (int64, error) {
+	if ns.volumeAttachLimit > 0 {
+		return ns.volumeAttachLimit, nil
+	}
+
 	// Machine-type format: n1-type-CPUS or custom-CPUS-RAM or f1/g1-type
 	machineType := ns.MetadataService.GetMachineType()
 
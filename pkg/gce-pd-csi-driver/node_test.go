@@ -15,15 +15,24 @@ package gceGCEDriver
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 )
@@ -42,7 +51,7 @@ func getTestGCEDriverWithCustomMounter(t *testing.T, mounter *mount.SafeFormatAn
 
 func getCustomTestGCEDriver(t *testing.T, mounter *mount.SafeFormatAndMount, deviceUtils mountmanager.DeviceUtils, metaService metadataservice.MetadataService) *GCEDriver {
 	gceDriver := GetGCEDriver()
-	nodeServer := NewNodeServer(gceDriver, mounter, deviceUtils, metaService, mountmanager.NewFakeStatter(mounter))
+	nodeServer := NewNodeServer(gceDriver, mounter, deviceUtils, metaService, mountmanager.NewFakeStatter(mounter), NodeServerArgs{})
 	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
@@ -53,7 +62,7 @@ func getCustomTestGCEDriver(t *testing.T, mounter *mount.SafeFormatAndMount, dev
 func getTestBlockingGCEDriver(t *testing.T, readyToExecute chan chan struct{}) *GCEDriver {
 	gceDriver := GetGCEDriver()
 	mounter := mountmanager.NewFakeSafeBlockingMounter(readyToExecute)
-	nodeServer := NewNodeServer(gceDriver, mounter, mountmanager.NewFakeDeviceUtils(), metadataservice.NewFakeService(), mountmanager.NewFakeStatter(mounter))
+	nodeServer := NewNodeServer(gceDriver, mounter, mountmanager.NewFakeDeviceUtils(), metadataservice.NewFakeService(), mountmanager.NewFakeStatter(mounter), NodeServerArgs{})
 	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
@@ -192,6 +201,85 @@ func TestNodeGetVolumeLimits(t *testing.T) {
 	}
 }
 
+func TestNodeGetVolumeLimitsOverride(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	ns := gceDriver.ns
+	ns.volumeAttachLimit = 15
+	req := &csi.NodeGetInfoRequest{}
+
+	for _, machineType := range []string{"n1-standard-1", "e2-micro"} {
+		metadataservice.SetMachineType(machineType)
+		res, err := ns.NodeGetInfo(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Failed to get node info: %v", err)
+		}
+		if volumeLimit := res.GetMaxVolumesPerNode(); volumeLimit != 15 {
+			t.Fatalf("Expected volume limit: 15, got %v, for machine-type: %v", volumeLimit, machineType)
+		}
+	}
+}
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		reportRegionTopology bool
+		expSegments          map[string]string
+	}{
+		{
+			name:        "zone only",
+			expSegments: map[string]string{common.TopologyKeyZone: metadataservice.FakeZone},
+		},
+		{
+			name:                 "zone and region",
+			reportRegionTopology: true,
+			expSegments: map[string]string{
+				common.TopologyKeyZone:   metadataservice.FakeZone,
+				common.TopologyKeyRegion: "country-region",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		gceDriver := getTestGCEDriver(t)
+		gceDriver.ns.reportRegionTopology = tc.reportRegionTopology
+		res, err := gceDriver.ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+		if err != nil {
+			t.Fatalf("%s: failed to get node info: %v", tc.name, err)
+		}
+		if segments := res.GetAccessibleTopology().GetSegments(); !reflect.DeepEqual(segments, tc.expSegments) {
+			t.Errorf("%s: expected topology segments %v, got %v", tc.name, tc.expSegments, segments)
+		}
+	}
+}
+
+func TestNodeGetInfoFilesystemTopology(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	gceDriver.ns.reportFilesystemTopology = true
+	res, err := gceDriver.ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get node info: %v", err)
+	}
+	segments := res.GetAccessibleTopology().GetSegments()
+	if segments[common.TopologyKeyZone] != metadataservice.FakeZone {
+		t.Errorf("Expected zone %v in topology segments, got %v", metadataservice.FakeZone, segments)
+	}
+	// The filesystems depend on the kernel running the test, but the key
+	// must be reported with reportable filesystems only.
+	value, ok := segments[common.TopologyKeyFilesystems]
+	if !ok {
+		t.Fatalf("Expected %s in topology segments, got %v", common.TopologyKeyFilesystems, segments)
+	}
+	if value != common.TopologyFilesystemsUnknown && value != "" {
+		for _, fs := range strings.Split(value, ".") {
+			if !reportableFilesystems.Has(fs) {
+				t.Errorf("Unexpected filesystem %q in topology segment %s=%s", fs, common.TopologyKeyFilesystems, value)
+			}
+		}
+	}
+	if len(segments) != 2 {
+		t.Errorf("Unexpected topology segments %v", segments)
+	}
+}
+
 func TestNodePublishVolume(t *testing.T) {
 	gceDriver := getTestGCEDriver(t)
 	ns := gceDriver.ns
@@ -291,6 +379,299 @@ func TestNodePublishVolume(t *testing.T) {
 	}
 }
 
+func TestNodePublishVolumeMountHardening(t *testing.T) {
+	fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}}
+	gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, nil))
+	ns := gceDriver.ns
+	ns.enforceMountHardening = true
+
+	tempDir, err := ioutil.TempDir("", "npvh")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, defaultStagingPath)
+
+	testCases := []struct {
+		name          string
+		mountFlags    []string
+		volumeContext map[string]string
+		expOptions    []string
+		expErrCode    codes.Code
+	}{
+		{
+			name:       "hardening enforced",
+			mountFlags: []string{"discard"},
+			expOptions: []string{"bind", "discard", "noexec", "nosuid", "nodev"},
+		},
+		{
+			name:          "hardening explicitly enabled",
+			volumeContext: map[string]string{common.VolumeAttributeMountHardening: "true"},
+			expOptions:    []string{"bind", "noexec", "nosuid", "nodev"},
+		},
+		{
+			name:          "volume opts out",
+			mountFlags:    []string{"exec"},
+			volumeContext: map[string]string{common.VolumeAttributeMountHardening: "false"},
+			expOptions:    []string{"bind", "exec"},
+		},
+		{
+			name:       "conflicting mount flag",
+			mountFlags: []string{"suid"},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:          "invalid volume attribute",
+			volumeContext: map[string]string{common.VolumeAttributeMountHardening: "off"},
+			expErrCode:    codes.InvalidArgument,
+		},
+	}
+	for i, tc := range testCases {
+		targetPath := filepath.Join(tempDir, fmt.Sprintf("target-%d", i))
+		volCap := createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+		volCap.GetMount().MountFlags = tc.mountFlags
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			TargetPath:        targetPath,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     tc.volumeContext,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var options []string
+		for _, mp := range fakeMounter.MountPoints {
+			if mp.Path == targetPath {
+				options = mp.Opts
+			}
+		}
+		if !reflect.DeepEqual(options, tc.expOptions) {
+			t.Errorf("%s: expected mount options %v, got %v", tc.name, tc.expOptions, options)
+		}
+	}
+}
+
+func TestNodePublishVolumeReadOnlyAttribute(t *testing.T) {
+	fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}}
+	gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, nil))
+
+	tempDir, err := ioutil.TempDir("", "npvro")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	targetPath := filepath.Join(tempDir, "target")
+
+	_, err = gceDriver.ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		TargetPath:        targetPath,
+		StagingTargetPath: filepath.Join(tempDir, defaultStagingPath),
+		VolumeCapability:  createVolumeCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		VolumeContext:     map[string]string{common.VolumeAttributeReadOnly: "true"},
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	if len(fakeMounter.MountPoints) != 1 || !reflect.DeepEqual(fakeMounter.MountPoints[0].Opts, []string{"bind", "ro"}) {
+		t.Errorf("Expected a read-only bind mount, got %+v", fakeMounter.MountPoints)
+	}
+}
+
+func TestNodePublishVolumeStaleTarget(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "npvs")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, "staging")
+	targetPath := filepath.Join(tempDir, "target")
+	for _, dir := range []string{stagingPath, targetPath} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		stagingMount bool
+		targetMount  bool
+		targetErr    error
+		expErrCode   codes.Code
+		expMount     bool
+		expTargetMnt bool
+	}{
+		{
+			name:         "target not mounted",
+			stagingMount: true,
+			expMount:     true,
+			expTargetMnt: true,
+		},
+		{
+			name:         "target already published",
+			stagingMount: true,
+			targetMount:  true,
+			expTargetMnt: true,
+		},
+		{
+			name:         "corrupted target",
+			stagingMount: true,
+			targetMount:  true,
+			targetErr:    &os.PathError{Op: "stat", Path: targetPath, Err: syscall.ENOTCONN},
+			expMount:     true,
+			expTargetMnt: true,
+		},
+		{
+			name:         "staging path no longer mounted",
+			targetMount:  true,
+			expErrCode:   codes.FailedPrecondition,
+			expTargetMnt: true,
+		},
+	}
+	for _, tc := range testCases {
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, MountCheckErrors: map[string]error{}}
+		if tc.stagingMount {
+			fakeMounter.MountPoints = append(fakeMounter.MountPoints, mount.MountPoint{Device: "/dev/sdb", Path: stagingPath})
+		}
+		if tc.targetMount {
+			fakeMounter.MountPoints = append(fakeMounter.MountPoints, mount.MountPoint{Device: stagingPath, Path: targetPath})
+		}
+		if tc.targetErr != nil {
+			fakeMounter.MountCheckErrors[targetPath] = tc.targetErr
+		}
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, nil))
+
+		_, err := gceDriver.ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			TargetPath:        targetPath,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+		}
+		mounted := false
+		for _, action := range fakeMounter.GetLog() {
+			if action.Action == mount.FakeActionMount && action.Target == targetPath {
+				mounted = true
+			}
+		}
+		if mounted != tc.expMount {
+			t.Errorf("%s: expected mount of target %t, got %t", tc.name, tc.expMount, mounted)
+		}
+		notMnt, err := fakeMounter.IsLikelyNotMountPoint(targetPath)
+		if err != nil {
+			t.Errorf("%s: failed to check target mount: %v", tc.name, err)
+		} else if notMnt == tc.expTargetMnt {
+			t.Errorf("%s: expected target mounted %t, got %t", tc.name, tc.expTargetMnt, !notMnt)
+		}
+	}
+}
+
+func TestNodePublishVolumeDiskMetadata(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	ns := gceDriver.ns
+
+	tempDir, err := ioutil.TempDir("", "npvm")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, defaultStagingPath)
+
+	testCases := []struct {
+		name           string
+		readOnly       bool
+		publishContext map[string]string
+		volumeContext  map[string]string
+		expMetadata    *diskMetadata
+		expErrCode     codes.Code
+	}{
+		{
+			name: "metadata not requested",
+		},
+		{
+			name:           "metadata requested",
+			publishContext: map[string]string{common.ContextKeyDeviceName: "test-device"},
+			volumeContext: map[string]string{
+				common.VolumeAttributePublishMetadata: "true",
+				common.VolumeAttributeDiskType:        "pd-ssd",
+			},
+			expMetadata: &diskMetadata{
+				DiskName: "testDisk",
+				Zone:     "c1",
+				DiskType: "pd-ssd",
+				Serial:   "test-device",
+			},
+		},
+		{
+			name:          "serial from volume ID",
+			volumeContext: map[string]string{common.VolumeAttributePublishMetadata: "true"},
+			expMetadata: &diskMetadata{
+				DiskName: "testDisk",
+				Zone:     "c1",
+				Serial:   "testDisk",
+			},
+		},
+		{
+			name:          "metadata disabled",
+			volumeContext: map[string]string{common.VolumeAttributePublishMetadata: "false"},
+		},
+		{
+			name:          "read only volume",
+			readOnly:      true,
+			volumeContext: map[string]string{common.VolumeAttributePublishMetadata: "true"},
+		},
+		{
+			name:          "invalid volume attribute",
+			volumeContext: map[string]string{common.VolumeAttributePublishMetadata: "sometimes"},
+			expErrCode:    codes.InvalidArgument,
+		},
+	}
+	for i, tc := range testCases {
+		targetPath := filepath.Join(tempDir, fmt.Sprintf("target-%d", i))
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			TargetPath:        targetPath,
+			StagingTargetPath: stagingPath,
+			Readonly:          tc.readOnly,
+			VolumeCapability:  createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			PublishContext:    tc.publishContext,
+			VolumeContext:     tc.volumeContext,
+		})
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Errorf("%s: expected error code %v, got %v: %v", tc.name, tc.expErrCode, code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(targetPath, diskMetadataFile))
+		if tc.expMetadata == nil {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: expected no metadata file, got %q, %v", tc.name, data, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to read metadata file: %v", tc.name, err)
+			continue
+		}
+		metadata := &diskMetadata{}
+		if err := json.Unmarshal(data, metadata); err != nil {
+			t.Errorf("%s: failed to parse metadata file %q: %v", tc.name, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(metadata, tc.expMetadata) {
+			t.Errorf("%s: expected metadata %+v, got %+v", tc.name, tc.expMetadata, metadata)
+		}
+	}
+}
+
 func TestNodeUnpublishVolume(t *testing.T) {
 	gceDriver := getTestGCEDriver(t)
 	ns := gceDriver.ns
@@ -348,6 +729,102 @@ func TestNodeUnpublishVolume(t *testing.T) {
 	}
 }
 
+func TestCheckDeviceUnclaimed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	device := filepath.Join(tempDir, "sdz")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatalf("Failed to create %s: %v", device, err)
+	}
+	devicePath := filepath.Join(tempDir, "google-disk")
+	if err := os.Symlink(device, devicePath); err != nil {
+		t.Fatalf("Failed to link %s: %v", devicePath, err)
+	}
+	stagingPath := filepath.Join(tempDir, "staging")
+
+	testCases := []struct {
+		name        string
+		devicePath  string
+		mountPoints []mount.MountPoint
+		expectErr   bool
+	}{
+		{
+			name:       "not mounted",
+			devicePath: devicePath,
+			mountPoints: []mount.MountPoint{
+				{Device: "/dev/sda1", Path: "/"},
+			},
+		},
+		{
+			name:       "mounted at staging path",
+			devicePath: devicePath,
+			mountPoints: []mount.MountPoint{
+				{Device: device, Path: stagingPath},
+			},
+		},
+		{
+			name:       "mounted by another driver",
+			devicePath: devicePath,
+			mountPoints: []mount.MountPoint{
+				{Device: device, Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/other.csi.driver/abc/globalmount"},
+			},
+			expectErr: true,
+		},
+		{
+			name:       "unresolvable device",
+			devicePath: filepath.Join(tempDir, "missing"),
+			mountPoints: []mount.MountPoint{
+				{Device: filepath.Join(tempDir, "missing"), Path: "/mnt"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		mounter := mountmanager.NewCustomFakeSafeMounter(&mount.FakeMounter{MountPoints: tc.mountPoints}, &testingexec.FakeExec{DisableScripts: true})
+		ns := getTestGCEDriverWithCustomMounter(t, mounter).ns
+		err := ns.checkDeviceUnclaimed(tc.devicePath, stagingPath)
+		if tc.expectErr && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+// missingDeviceUtils never finds the device of a volume.
+type missingDeviceUtils struct {
+	mountmanager.DeviceUtils
+}
+
+func (m *missingDeviceUtils) VerifyDevicePath(devicePaths []string, diskName string) (string, error) {
+	return "", nil
+}
+
+func TestWaitForDevicePathStopsWithRequest(t *testing.T) {
+	gceDriver := getCustomTestGCEDriver(t, mountmanager.NewFakeSafeMounter(), &missingDeviceUtils{mountmanager.NewFakeDeviceUtils()}, metadataservice.NewFakeService())
+	ns := gceDriver.ns
+	ns.SetDeviceDiscoveryTimeout(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := ns.waitForDevicePath(ctx, defaultVolumeID, "")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected an error for a device that never appears")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Device discovery did not stop when the request ended")
+	}
+}
+
 func TestNodeStageVolume(t *testing.T) {
 	gceDriver := getTestGCEDriver(t)
 	ns := gceDriver.ns
@@ -431,6 +908,15 @@ func TestNodeStageVolume(t *testing.T) {
 			},
 			expErrCode: codes.InvalidArgument,
 		},
+		{
+			name: "Valid request with matching publish context device name",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				PublishContext:    map[string]string{common.ContextKeyDeviceName: "testDisk"},
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdVolCap,
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Logf("Test case: %s", tc.name)
@@ -451,6 +937,83 @@ func TestNodeStageVolume(t *testing.T) {
 	}
 }
 
+func TestNodeStageVolumeRestorePreparedOnce(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "nsvrp")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, defaultStagingPath)
+	stateDir := filepath.Join(tempDir, "state")
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  stdVolCap,
+		VolumeContext: map[string]string{
+			common.VolumeAttributeRegenerateFSUUID: "true",
+			common.VolumeAttributeTrimAfterRestore: "true",
+		},
+	}
+	prepareCommands := []string{
+		"tune2fs -U random /dev/disk/fake-path",
+		"fstrim " + stagingPath,
+	}
+
+	// Each stage uses a new mounter, as after a reboot, but the state
+	// directory is kept. A filesystem with another UUID under the same
+	// volume ID, such as one restored again, is prepared again.
+	stages := []struct {
+		uuid        string
+		expPrepared bool
+	}{
+		{uuid: "uuid-1", expPrepared: true},
+		{uuid: "uuid-1", expPrepared: false},
+		{uuid: "uuid-2", expPrepared: true},
+	}
+	for i, stage := range stages {
+		var commands []string
+		action := func(cmd string, args ...string) exec.Cmd {
+			commands = append(commands, strings.Join(append([]string{cmd}, args...), " "))
+			output := ""
+			if cmd == "blkid" {
+				output = "TYPE=ext4\n"
+				if strings.Contains(strings.Join(args, " "), "-s UUID") {
+					output = stage.uuid + "\n"
+				}
+			}
+			return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+				CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) { return []byte(output), nil, nil },
+				},
+			}, cmd, args...)
+		}
+		fakeExec := &testingexec.FakeExec{}
+		for j := 0; j < 20; j++ {
+			fakeExec.CommandScript = append(fakeExec.CommandScript, action)
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}}
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, fakeExec))
+		gceDriver.ns.stateDir = stateDir
+
+		if _, err := gceDriver.ns.NodeStageVolume(context.Background(), req); err != nil {
+			t.Fatalf("stage %d: NodeStageVolume failed: %v", i, err)
+		}
+		for _, cmd := range prepareCommands {
+			ran := false
+			for _, c := range commands {
+				ran = ran || c == cmd
+			}
+			if ran != stage.expPrepared {
+				t.Errorf("stage %d: expected %q to run: %v, got commands %q", i, cmd, stage.expPrepared, commands)
+			}
+		}
+		// Nothing is written to the filesystem of the volume.
+		if files, err := ioutil.ReadDir(stagingPath); err != nil || len(files) != 0 {
+			t.Errorf("stage %d: expected an empty staging path, got %v, err %v", i, files, err)
+		}
+	}
+}
+
 // TODO: This test is too brittle due to the fakeexec package not being
 // expressive enough for our purposes. The main issue being that the actions
 // executed by fakeexec are executed in order of definition instead of by
@@ -682,6 +1245,85 @@ func TestNodeUnstageVolume(t *testing.T) {
 	}
 }
 
+func TestNodeUnstageVolumeFlushes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "nusvf")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, defaultStagingPath)
+
+	testCases := []struct {
+		name        string
+		freeze      bool
+		failFreeze  bool
+		expCommands []string
+	}{
+		{
+			name: "sync",
+			expCommands: []string{
+				"sync -f " + stagingPath,
+				"blockdev --flushbufs /dev/disk/fake-path",
+			},
+		},
+		{
+			name:   "freeze",
+			freeze: true,
+			expCommands: []string{
+				"fsfreeze --freeze " + stagingPath,
+				"fsfreeze --unfreeze " + stagingPath,
+				"blockdev --flushbufs /dev/disk/fake-path",
+			},
+		},
+		{
+			name:       "failed freeze is thawed",
+			freeze:     true,
+			failFreeze: true,
+			expCommands: []string{
+				"fsfreeze --freeze " + stagingPath,
+				"fsfreeze --unfreeze " + stagingPath,
+				"blockdev --flushbufs /dev/disk/fake-path",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		if err := os.MkdirAll(stagingPath, 0750); err != nil {
+			t.Fatalf("Failed to create staging path: %v", err)
+		}
+		var commands []string
+		action := func(cmd string, args ...string) exec.Cmd {
+			commands = append(commands, strings.Join(append([]string{cmd}, args...), " "))
+			var err error
+			if tc.failFreeze && cmd == "fsfreeze" && args[0] == "--freeze" {
+				err = &testingexec.FakeExitError{Status: 1}
+			}
+			return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+				CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) { return nil, nil, err },
+				},
+			}, cmd, args...)
+		}
+		fakeExec := &testingexec.FakeExec{}
+		for range tc.expCommands {
+			fakeExec.CommandScript = append(fakeExec.CommandScript, action)
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{{Device: "/dev/disk/fake-path", Path: stagingPath}}}
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, fakeExec))
+		gceDriver.ns.freezeBeforeUnstage = tc.freeze
+
+		_, err := gceDriver.ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: stagingPath,
+		})
+		if err != nil {
+			t.Errorf("%s: NodeUnstageVolume failed: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(commands, tc.expCommands) {
+			t.Errorf("%s: got commands %q, expected %q", tc.name, commands, tc.expCommands)
+		}
+	}
+}
+
 func TestNodeGetCapabilities(t *testing.T) {
 	gceDriver := getTestGCEDriver(t)
 	ns := gceDriver.ns
@@ -775,3 +1417,393 @@ func TestConcurrentNodeOperations(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestValidateTargetPath(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "vtp")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	kubeletDir := filepath.Join(tempDir, "kubelet")
+	outsideDir := filepath.Join(tempDir, "outside")
+	for _, dir := range []string{filepath.Join(kubeletDir, "pods"), outsideDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(kubeletDir, "pods", "escape")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	linkedKubeletDir := filepath.Join(tempDir, "linked-kubelet")
+	if err := os.Symlink(kubeletDir, linkedKubeletDir); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		path           string
+		kubeletRootDir string
+		expPath        string
+		expErr         bool
+	}{
+		{
+			name:    "no kubelet root",
+			path:    outsideDir + "/mount/",
+			expPath: filepath.Join(outsideDir, "mount"),
+		},
+		{
+			name:   "too long",
+			path:   "/" + strings.Repeat("a", maxTargetPathLength),
+			expErr: true,
+		},
+		{
+			name:           "under kubelet root",
+			path:           kubeletDir + "/pods/uid/volumes/mount",
+			kubeletRootDir: kubeletDir,
+			expPath:        filepath.Join(kubeletDir, "pods", "uid", "volumes", "mount"),
+		},
+		{
+			name:           "under kubelet root through symlinked root",
+			path:           filepath.Join(linkedKubeletDir, "pods", "uid"),
+			kubeletRootDir: kubeletDir,
+			expPath:        filepath.Join(linkedKubeletDir, "pods", "uid"),
+		},
+		{
+			name:           "kubelet root itself",
+			path:           kubeletDir,
+			kubeletRootDir: kubeletDir,
+			expErr:         true,
+		},
+		{
+			name:           "dot dot escape",
+			path:           kubeletDir + "/pods/../../outside/mount",
+			kubeletRootDir: kubeletDir,
+			expErr:         true,
+		},
+		{
+			name:           "symlink escape",
+			path:           filepath.Join(kubeletDir, "pods", "escape", "mount"),
+			kubeletRootDir: kubeletDir,
+			expErr:         true,
+		},
+	}
+	for _, tc := range testCases {
+		got, err := validateTargetPath(tc.path, tc.kubeletRootDir)
+		if gotErr := err != nil; gotErr != tc.expErr {
+			t.Errorf("%s: validateTargetPath() = %v; expected error: %v", tc.name, err, tc.expErr)
+			continue
+		}
+		if got != tc.expPath {
+			t.Errorf("%s: validateTargetPath() = %q, expected %q", tc.name, got, tc.expPath)
+		}
+	}
+}
+
+func TestNodePublishVolumeOutsideKubeletRoot(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	gceDriver.ns.kubeletRootDir = "/var/lib/kubelet"
+	_, err := gceDriver.ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		TargetPath:        "/var/lib/kubelet/../../../etc",
+		StagingTargetPath: "/var/lib/kubelet/plugins/staging",
+		VolumeCapability:  createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("NodePublishVolume() = %v, expected %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestExpansionResync(t *testing.T) {
+	const gb = int64(1000000000)
+	testCases := []struct {
+		name        string
+		fsBytes     int64
+		deviceBytes int64
+		notMounted  bool
+		locked      bool
+		expResize   bool
+	}{
+		{
+			name:        "filesystem smaller than its device",
+			fsBytes:     10 * gb,
+			deviceBytes: 20 * gb,
+			expResize:   true,
+		},
+		{
+			name:        "filesystem spanning its device",
+			fsBytes:     19 * gb,
+			deviceBytes: 20 * gb,
+		},
+		{
+			name:        "staging path no longer mounted",
+			fsBytes:     10 * gb,
+			deviceBytes: 20 * gb,
+			notMounted:  true,
+		},
+		{
+			name:        "volume operation in progress",
+			fsBytes:     10 * gb,
+			deviceBytes: 20 * gb,
+			locked:      true,
+		},
+	}
+	stagingPath, err := ioutil.TempDir("", "expansion-resync")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(stagingPath)
+	for _, tc := range testCases {
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}}
+		if !tc.notMounted {
+			fakeMounter.MountPoints = append(fakeMounter.MountPoints, mount.MountPoint{Device: "/dev/sdb", Path: stagingPath})
+		}
+		ns := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, nil)).ns
+		ns.trackStagedFilesystem(defaultVolumeID, stagingPath, "", createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), nil)
+		if tc.locked {
+			ns.volumeLocks.TryAcquire(defaultVolumeID)
+		}
+
+		fsBytes := tc.fsBytes
+		resized := false
+		resyncer := NewExpansionResyncer(ns, nil)
+		resyncer.filesystemSize = func(path string) (int64, error) { return fsBytes, nil }
+		resyncer.deviceSize = func(devicePath string) (int64, error) { return tc.deviceBytes, nil }
+		resyncer.resize = func(devicePath, path string) error {
+			resized = true
+			fsBytes = tc.deviceBytes * 97 / 100
+			return nil
+		}
+		resyncer.sync(context.Background())
+		if resized != tc.expResize {
+			t.Errorf("%s: expected resize %t, got %t", tc.name, tc.expResize, resized)
+		}
+	}
+}
+
+func TestExpansionResyncDiscover(t *testing.T) {
+	kubeletDir, err := ioutil.TempDir("", "expansion-resync-discover")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(kubeletDir)
+	pluginDir := filepath.Join(kubeletDir, kubeletCSIPluginDir)
+
+	const otherVolumeID = "projects/test001/zones/c1/disks/otherDisk"
+	volumes := []struct {
+		dir      string
+		volData  string
+		device   string
+		opts     []string
+		expFound bool
+	}{
+		{
+			dir:      "pv/pvc-1",
+			volData:  `{"driverName":"` + driver + `","volumeHandle":"` + defaultVolumeID + `","specVolID":"pvc-1"}`,
+			device:   "/dev/disk/fake-path",
+			expFound: true,
+		},
+		{
+			// Read-only mounts are not grown.
+			dir:     "pv/pvc-2",
+			volData: `{"driverName":"` + driver + `","volumeHandle":"` + otherVolumeID + `","specVolID":"pvc-2"}`,
+			device:  "/dev/disk/fake-path",
+			opts:    []string{"ro"},
+		},
+		{
+			// Volumes of other drivers are not tracked.
+			dir:     "other.csi.driver/abc",
+			volData: `{"driverName":"other.csi.driver","volumeHandle":"` + otherVolumeID + `"}`,
+			device:  "/dev/disk/fake-path",
+		},
+		{
+			// Partitions are not recorded by the kubelet.
+			dir:     driver + "/def",
+			volData: `{"driverName":"` + driver + `","volumeHandle":"` + otherVolumeID + `"}`,
+			device:  "/dev/disk/fake-path-part1",
+		},
+		{
+			// Without a vol_data.json the volume is unknown.
+			dir:    "pv/pvc-3",
+			device: "/dev/disk/fake-path",
+		},
+	}
+	fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}}
+	for _, volume := range volumes {
+		stagingPath := filepath.Join(pluginDir, volume.dir, kubeletStagingDir)
+		if err := os.MkdirAll(stagingPath, 0750); err != nil {
+			t.Fatalf("Failed to create staging path: %v", err)
+		}
+		if volume.volData != "" {
+			if err := ioutil.WriteFile(filepath.Join(pluginDir, volume.dir, kubeletVolDataFile), []byte(volume.volData), 0640); err != nil {
+				t.Fatalf("Failed to write vol data: %v", err)
+			}
+		}
+		fakeMounter.MountPoints = append(fakeMounter.MountPoints, mount.MountPoint{Device: volume.device, Path: stagingPath, Opts: volume.opts})
+	}
+	ns := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, nil)).ns
+	ns.kubeletRootDir = kubeletDir
+
+	NewExpansionResyncer(ns, nil).discover()
+	volumeIDs, staged := ns.stagedFilesystems.list()
+	expStagingPath := filepath.Join(pluginDir, "pv/pvc-1", kubeletStagingDir)
+	if !reflect.DeepEqual(volumeIDs, []string{defaultVolumeID}) || staged[defaultVolumeID].stagingPath != expStagingPath {
+		t.Errorf("got staged filesystems %v, expected %s at %s", staged, defaultVolumeID, expStagingPath)
+	}
+	if data, err := readKubeletVolData(expStagingPath); err != nil || data.PVName != "pvc-1" {
+		t.Errorf("got PV name %q, err %v, expected pvc-1", data.PVName, err)
+	}
+}
+
+func TestNodeStageVolumeReadOnlyRestore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "nsvro")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, defaultStagingPath)
+
+	testCases := []struct {
+		fsType     string
+		mountFlags []string
+		expOpts    []string
+	}{
+		{
+			fsType:  "ext4",
+			expOpts: []string{"ro", "noload", "defaults"},
+		},
+		{
+			fsType:  "xfs",
+			expOpts: []string{"ro", "norecovery", "defaults"},
+		},
+		{
+			fsType:     "ext4",
+			mountFlags: []string{"noload"},
+			expOpts:    []string{"noload", "ro", "defaults"},
+		},
+		{
+			fsType:  "btrfs",
+			expOpts: []string{"ro", "defaults"},
+		},
+	}
+	for _, tc := range testCases {
+		// The restored disk already holds a filesystem of the requested type.
+		output := "TYPE=" + tc.fsType + "\n"
+		fakeExec := &testingexec.FakeExec{}
+		for j := 0; j < 5; j++ {
+			fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+				return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+					CombinedOutputScript: []testingexec.FakeAction{
+						func() ([]byte, []byte, error) { return []byte(output), nil, nil },
+					},
+				}, cmd, args...)
+			})
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}}
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewCustomFakeSafeMounter(fakeMounter, fakeExec))
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: tc.fsType, MountFlags: tc.mountFlags}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			},
+			VolumeContext: map[string]string{common.VolumeAttributeReadOnly: "true"},
+		})
+		if err != nil {
+			t.Errorf("%s %v: NodeStageVolume failed: %v", tc.fsType, tc.mountFlags, err)
+			continue
+		}
+		if len(fakeMounter.MountPoints) != 1 || !reflect.DeepEqual(fakeMounter.MountPoints[0].Opts, tc.expOpts) {
+			t.Errorf("%s %v: expected mount options %v, got %+v", tc.fsType, tc.mountFlags, tc.expOpts, fakeMounter.MountPoints)
+		}
+	}
+}
+
+func TestTrackStagedFilesystem(t *testing.T) {
+	testCases := []struct {
+		name          string
+		vc            *csi.VolumeCapability
+		volumeContext map[string]string
+		expTracked    bool
+	}{
+		{
+			name:       "read-write filesystem",
+			vc:         createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			expTracked: true,
+		},
+		{
+			name: "block",
+			vc:   createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0],
+		},
+		{
+			name: "read-only access mode",
+			vc:   createVolumeCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		},
+		{
+			name:          "read-only restore",
+			vc:            createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			volumeContext: map[string]string{common.VolumeAttributeReadOnly: "true"},
+		},
+		{
+			name: "ro mount flag",
+			vc: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"ro"}}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		ns := getTestGCEDriver(t).ns
+		ns.trackStagedFilesystem(defaultVolumeID, defaultStagingPath, "", tc.vc, tc.volumeContext)
+		volumeIDs, _ := ns.stagedFilesystems.list()
+		if tracked := len(volumeIDs) == 1; tracked != tc.expTracked {
+			t.Errorf("%s: expected tracked %t, got %t", tc.name, tc.expTracked, tracked)
+		}
+		ns.stagedFilesystems.remove(defaultVolumeID)
+		if volumeIDs, _ := ns.stagedFilesystems.list(); len(volumeIDs) != 0 {
+			t.Errorf("%s: volume still tracked after removal", tc.name)
+		}
+	}
+}
+
+func TestNodeMetricLabels(t *testing.T) {
+	ns := getTestGCEDriver(t).ns
+	tempDir, err := ioutil.TempDir("", "nml")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	stagingPath := filepath.Join(tempDir, defaultStagingPath)
+
+	if labels := ns.stagedVolumeLabels(defaultVolumeID); labels != unknownNodeMetricLabels {
+		t.Errorf("Expected unknown labels before staging, got %+v", labels)
+	}
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		PublishContext:    map[string]string{common.ContextKeyDiskType: "pd-ssd"},
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  stdVolCap,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	expLabels := nodeMetricLabels{fsType: getDefaultFsType(), diskType: "pd-ssd"}
+	if labels := ns.stagedVolumeLabels(defaultVolumeID); labels != expLabels {
+		t.Errorf("Expected labels %+v after staging, got %+v", expLabels, labels)
+	}
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: stagingPath,
+	})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	if labels := ns.stagedVolumeLabels(defaultVolumeID); labels != unknownNodeMetricLabels {
+		t.Errorf("Expected unknown labels after unstaging, got %+v", labels)
+	}
+
+	blockLabels := newNodeMetricLabels(createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0], nil)
+	if expLabels := (nodeMetricLabels{fsType: metricFsTypeBlock, diskType: metricLabelUnknown}); blockLabels != expLabels {
+		t.Errorf("Expected block labels %+v, got %+v", expLabels, blockLabels)
+	}
+}
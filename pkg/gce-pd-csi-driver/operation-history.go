@@ -0,0 +1,156 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+// Operations recorded in the operation history.
+const (
+	historyOperationCreate = "create"
+	historyOperationDelete = "delete"
+	historyOperationAttach = "attach"
+	historyOperationDetach = "detach"
+	historyOperationExpand = "expand"
+)
+
+// operationRecord is an operation on a volume in the operation history.
+type operationRecord struct {
+	Operation string `json:"operation"`
+	// Node is the node of attaches and detaches.
+	Node  string    `json:"node,omitempty"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Code and Error are the status code and message the operation failed
+	// with, or empty if it succeeded.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// operationHistory keeps the last operations on each volume in memory, so
+// that a stuck volume can be debugged without searching the logs. The
+// history is served in the debug state, and the errors of failed operations
+// name the last earlier failure on the volume.
+type operationHistory struct {
+	// size is the number of operations kept per volume.
+	size int
+	now  func() time.Time
+
+	mux sync.Mutex
+	// volumes holds the operations on each volume by disk name, oldest
+	// first.
+	volumes map[string][]operationRecord
+}
+
+// newOperationHistory returns a history keeping the last size operations on
+// each volume, or nil, which records nothing, if size is not positive.
+func newOperationHistory(size int) *operationHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &operationHistory{
+		size:    size,
+		now:     time.Now,
+		volumes: map[string][]operationRecord{},
+	}
+}
+
+// historyName returns the name volumeID is recorded under in the history.
+// Volumes are recorded by disk name, which CreateVolume knows before it
+// picks the zones that make up the volume ID.
+func historyName(volumeID string) string {
+	key, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return volumeID
+	}
+	return key.Name
+}
+
+// record adds operation on the volume named name, which started at start
+// and returned err, and returns err with the last earlier failure on the
+// volume added to its message.
+func (h *operationHistory) record(name, operation, node string, start time.Time, err error) error {
+	if h == nil || name == "" {
+		return err
+	}
+	end := h.now()
+	rec := operationRecord{
+		Operation: operation,
+		Node:      node,
+		Start:     start,
+		End:       end,
+	}
+	if err != nil {
+		s := status.Convert(err)
+		rec.Code = s.Code().String()
+		rec.Error = s.Message()
+	}
+
+	h.mux.Lock()
+	ops := h.volumes[name]
+	var lastFailure *operationRecord
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].Code != "" {
+			failure := ops[i]
+			lastFailure = &failure
+			break
+		}
+	}
+	ops = append(ops, rec)
+	if len(ops) > h.size {
+		ops = ops[len(ops)-h.size:]
+	}
+	h.volumes[name] = ops
+	h.mux.Unlock()
+
+	if err == nil || lastFailure == nil {
+		return err
+	}
+	note := fmt.Sprintf("last %s failed %v ago with %s: %s", lastFailure.Operation, end.Sub(lastFailure.End).Round(time.Second), lastFailure.Code, lastFailure.Error)
+	if s, ok := status.FromError(err); ok {
+		return status.Errorf(s.Code(), "%s (%s)", s.Message(), note)
+	}
+	return fmt.Errorf("%v (%s)", err, note)
+}
+
+// forget drops the history of the volume named name once it is deleted.
+func (h *operationHistory) forget(name string) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	delete(h.volumes, name)
+}
+
+// status returns a copy of the history for the debug handler.
+func (h *operationHistory) status() map[string][]operationRecord {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	volumes := make(map[string][]operationRecord, len(h.volumes))
+	for name, ops := range h.volumes {
+		volumes[name] = append([]operationRecord(nil), ops...)
+	}
+	return volumes
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	computev1 "google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+// orphanedAttachment is a disk backing one of the driver's PVs that is
+// attached to an instance no VolumeAttachment attaches it to.
+type orphanedAttachment struct {
+	VolumeID     string `json:"volumeID"`
+	PVName       string `json:"pvName"`
+	InstanceZone string `json:"instanceZone"`
+	InstanceName string `json:"instanceName"`
+}
+
+// orphanedAttachmentsStatus is the result of the last check, served by the
+// debug handler.
+type orphanedAttachmentsStatus struct {
+	LastCheck time.Time            `json:"lastCheck"`
+	Orphans   []orphanedAttachment `json:"orphans"`
+}
+
+// OrphanedAttachmentDetector periodically compares the instances the disks of
+// the driver's PVs are attached to against the driver's VolumeAttachments.
+// Attachments left behind by a detach that failed or was skipped otherwise go
+// unnoticed until an attach elsewhere fails, so they are counted in a metric
+// and logged with the command that removes them. An attachment is only
+// reported once two checks in a row find it orphaned, so that attaches and
+// detaches that are still settling are not.
+type OrphanedAttachmentDetector struct {
+	cs     *GCEControllerServer
+	client kubernetes.Interface
+
+	// The attachments the previous check found orphaned. Only used by sync.
+	suspects map[orphanedAttachment]bool
+
+	mux    sync.RWMutex
+	result orphanedAttachmentsStatus
+}
+
+// NewOrphanedAttachmentDetector returns a detector for the volumes of cs,
+// whose results are included in the state served by cs.DebugHandler.
+func NewOrphanedAttachmentDetector(cs *GCEControllerServer, client kubernetes.Interface) *OrphanedAttachmentDetector {
+	d := &OrphanedAttachmentDetector{
+		cs:     cs,
+		client: client,
+	}
+	cs.orphanDetector = d
+	return d
+}
+
+// Run checks for orphaned attachments every period until stopCh is closed.
+func (d *OrphanedAttachmentDetector) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := d.sync(context.Background()); err != nil {
+			klog.Errorf("Failed to check for orphaned attachments: %v", err)
+		}
+	}, period, stopCh)
+}
+
+func (d *OrphanedAttachmentDetector) sync(ctx context.Context) error {
+	pvs, err := d.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	attachments, err := d.client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list volume attachments: %v", err)
+	}
+	nodes, err := d.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	disks, err := d.cs.CloudProvider.AggregatedListDisks(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to list disks: %v", err)
+	}
+
+	// Disks with an operation in flight are skipped, as the operation may
+	// be about to change their attachments.
+	busy := sets.NewString()
+	for _, volumeID := range append(d.cs.volumeLocks.List(), d.cs.attachLocks.List()...) {
+		if key, err := diskKeyString(volumeID); err == nil {
+			busy.Insert(key)
+		}
+	}
+
+	orphans := d.confirm(findOrphanedAttachments(d.cs.Driver.name, pvs.Items, attachments.Items, nodes.Items, disks, busy))
+	for _, o := range orphans {
+		klog.Warningf("Disk %s of PV %s is attached to instance %s in zone %s, but no VolumeAttachment attaches it there. "+
+			"If no workload on the instance uses the disk, detach it with: %s", o.VolumeID, o.PVName, o.InstanceName, o.InstanceZone, detachDiskCommand(o))
+	}
+	metrics.RecordOrphanedAttachments(len(orphans))
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.result = orphanedAttachmentsStatus{
+		LastCheck: time.Now(),
+		Orphans:   orphans,
+	}
+	return nil
+}
+
+// confirm returns the candidates that the previous check also found, and
+// remembers candidates for the next check.
+func (d *OrphanedAttachmentDetector) confirm(candidates []orphanedAttachment) []orphanedAttachment {
+	suspects := map[orphanedAttachment]bool{}
+	var orphans []orphanedAttachment
+	for _, c := range candidates {
+		suspects[c] = true
+		if d.suspects[c] {
+			orphans = append(orphans, c)
+		}
+	}
+	d.suspects = suspects
+	return orphans
+}
+
+func (d *OrphanedAttachmentDetector) status() orphanedAttachmentsStatus {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	return d.result
+}
+
+// findOrphanedAttachments returns the attachments of the disks backing the
+// PVs of driverName to instances that no VolumeAttachment of the PV names.
+// Attachments of the PV to nodes without a driver node ID cannot be told
+// apart, so the PV is skipped. Disks that back no PV of the driver, such as
+// boot disks, disks the driver did not create, and the busy disks, given by
+// diskKeyString, are never reported.
+func findOrphanedAttachments(driverName string, pvs []v1.PersistentVolume, attachments []storagev1.VolumeAttachment, nodes []v1.Node, disks []*computev1.Disk, busy sets.String) []orphanedAttachment {
+	// Instances by node name, as zone/name.
+	instances := map[string]string{}
+	for i := range nodes {
+		nodeID, err := csiNodeID(&nodes[i], driverName)
+		if err != nil {
+			continue
+		}
+		zone, name, err := common.NodeIDToZoneAndName(nodeID)
+		if err != nil {
+			continue
+		}
+		instances[nodes[i].Name] = zone + "/" + name
+	}
+
+	// Instances each PV is expected to be attached to. Attachments that are
+	// still being attached or detached count, so that neither is reported.
+	expected := map[string]map[string]bool{}
+	unknown := map[string]bool{}
+	for _, va := range attachments {
+		pvName := va.Spec.Source.PersistentVolumeName
+		if va.Spec.Attacher != driverName || pvName == nil {
+			continue
+		}
+		instance, ok := instances[va.Spec.NodeName]
+		if !ok {
+			unknown[*pvName] = true
+			continue
+		}
+		if expected[*pvName] == nil {
+			expected[*pvName] = map[string]bool{}
+		}
+		expected[*pvName][instance] = true
+	}
+
+	// PV names by disk.
+	pvNames := map[string]string{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if key, err := diskKeyString(pv.Spec.CSI.VolumeHandle); err == nil {
+			pvNames[key] = pv.Name
+		}
+	}
+
+	var orphans []orphanedAttachment
+	for _, disk := range disks {
+		volumeID := cleanSelfLink(disk.SelfLink)
+		key, err := diskKeyString(volumeID)
+		if err != nil || busy.Has(key) {
+			continue
+		}
+		pvName, ok := pvNames[key]
+		if !ok || unknown[pvName] {
+			continue
+		}
+		// Disks of migrated in-tree PVs are managed by the driver too.
+		if !gce.IsDiskCreatedByDriver(gce.CloudDiskFromV1(disk), driverName) && !gce.IsDiskCreatedByInTreeProvisioner(disk.Name, disk.Description) {
+			continue
+		}
+		for _, user := range disk.Users {
+			zone, name, err := common.NodeIDToZoneAndName(cleanSelfLink(user))
+			if err != nil {
+				continue
+			}
+			if expected[pvName][zone+"/"+name] {
+				continue
+			}
+			orphans = append(orphans, orphanedAttachment{
+				VolumeID:     volumeID,
+				PVName:       pvName,
+				InstanceZone: zone,
+				InstanceName: name,
+			})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].VolumeID != orphans[j].VolumeID {
+			return orphans[i].VolumeID < orphans[j].VolumeID
+		}
+		return orphans[i].InstanceName < orphans[j].InstanceName
+	})
+	return orphans
+}
+
+// diskKeyString identifies the disk of volumeID regardless of the project
+// it names, which is UNSPECIFIED in some static and migrated volumes.
+func diskKeyString(volumeID string) (string, error) {
+	key, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// detachDiskCommand returns the gcloud command that detaches the disk of o
+// from its instance.
+func detachDiskCommand(o orphanedAttachment) string {
+	cmd := fmt.Sprintf("gcloud compute instances detach-disk %s --zone=%s", o.InstanceName, o.InstanceZone)
+	key, err := common.VolumeIDToKey(o.VolumeID)
+	if err != nil {
+		return cmd
+	}
+	cmd += " --disk=" + key.Name
+	if key.Type() == meta.Regional {
+		cmd += " --disk-scope=regional"
+	}
+	return cmd
+}
@@ -25,6 +25,8 @@ import (
 	"k8s.io/klog"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
 // Defines Non blocking GRPC server interfaces
@@ -39,14 +41,17 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+func NewNonBlockingGRPCServer(retryPolicyFor func(fullMethod string) *common.RetryPolicy, logSampler *common.LogSampler, concurrencyLimiter *common.ConcurrencyLimiter) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{retryPolicyFor: retryPolicyFor, logSampler: logSampler, concurrencyLimiter: concurrencyLimiter}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
-	wg     sync.WaitGroup
-	server *grpc.Server
+	wg                 sync.WaitGroup
+	server             *grpc.Server
+	retryPolicyFor     func(fullMethod string) *common.RetryPolicy
+	logSampler         *common.LogSampler
+	concurrencyLimiter *common.ConcurrencyLimiter
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -72,7 +77,7 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(logGRPC(s.logSampler), coalesceGRPC(common.NewRequestCoalescer(coalescedRequestTimeout)), limitGRPC(s.concurrencyLimiter), retryGRPC(s.retryPolicyFor)),
 	}
 
 	u, err := url.Parse(endpoint)
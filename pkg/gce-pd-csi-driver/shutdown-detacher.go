@@ -0,0 +1,216 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// nodeIDAnnotationKey is the node annotation in which the kubelet
+	// records the node ID each CSI driver reported for the node.
+	nodeIDAnnotationKey = "csi.volume.kubernetes.io/nodeid"
+)
+
+// ShutdownDetacher detaches disks from nodes that are shutting down or being
+// preempted as soon as no running pod on the node uses them, instead of
+// waiting for the external-attacher to notice that their pods are gone. This
+// shortens failover for StatefulSets on spot and preemptible nodes.
+type ShutdownDetacher struct {
+	cs     *GCEControllerServer
+	client kubernetes.Interface
+	// taints mark a node as shutting down.
+	taints sets.String
+}
+
+func NewShutdownDetacher(cs *GCEControllerServer, client kubernetes.Interface, taints []string) *ShutdownDetacher {
+	return &ShutdownDetacher{
+		cs:     cs,
+		client: client,
+		taints: sets.NewString(taints...),
+	}
+}
+
+// Run checks for shutting down nodes every period until stopCh is closed.
+func (d *ShutdownDetacher) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := d.sync(context.Background()); err != nil {
+			klog.Errorf("Failed to detach volumes from shutting down nodes: %v", err)
+		}
+	}, period, stopCh)
+}
+
+func (d *ShutdownDetacher) sync(ctx context.Context) error {
+	nodes, err := d.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	var attachments *storagev1.VolumeAttachmentList
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !nodeShuttingDown(node, d.taints) {
+			continue
+		}
+		// Volume attachments are only listed once a node is shutting down,
+		// which is rare.
+		if attachments == nil {
+			if attachments, err = d.client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{}); err != nil {
+				return fmt.Errorf("failed to list volume attachments: %v", err)
+			}
+		}
+		if err := d.detachNode(ctx, node, attachments.Items); err != nil {
+			klog.Errorf("Failed to detach volumes from shutting down node %s: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// detachNode detaches the disks attached to node that no running pod on the
+// node uses and that the node no longer reports in use, which the kubelet
+// does until it has unmounted them.
+func (d *ShutdownDetacher) detachNode(ctx context.Context, node *v1.Node, attachments []storagev1.VolumeAttachment) error {
+	nodeID, err := csiNodeID(node, d.cs.Driver.name)
+	if err != nil {
+		return err
+	}
+	inUse, err := d.volumesInUse(ctx, node.Name)
+	if err != nil {
+		return err
+	}
+	for _, pvName := range volumesToPreDetach(node.Name, d.cs.Driver.name, attachments, inUse) {
+		pv, err := d.client.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("Failed to get PV %s to detach it from shutting down node %s: %v", pvName, node.Name, err)
+			continue
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.cs.Driver.name {
+			continue
+		}
+		if nodeVolumeInUse(node, d.cs.Driver.name, pv.Spec.CSI.VolumeHandle) {
+			klog.V(4).Infof("Not detaching volume %s of PV %s from shutting down node %s, the node has not unmounted it yet", pv.Spec.CSI.VolumeHandle, pvName, node.Name)
+			continue
+		}
+		klog.V(2).Infof("Detaching volume %s of PV %s from shutting down node %s", pv.Spec.CSI.VolumeHandle, pvName, node.Name)
+		_, err = d.cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: pv.Spec.CSI.VolumeHandle,
+			NodeId:   nodeID,
+		})
+		if err != nil {
+			klog.Errorf("Failed to detach volume %s from shutting down node %s: %v", pv.Spec.CSI.VolumeHandle, node.Name, err)
+		}
+	}
+	return nil
+}
+
+// volumesInUse returns the names of the PVs used by the pods on node that
+// have not terminated.
+func (d *ShutdownDetacher) volumesInUse(ctx context.Context, nodeName string) (sets.String, error) {
+	pods, err := d.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	inUse := sets.NewString()
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+			pvc, err := d.client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(ctx, volume.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			if err != nil {
+				// Without the claim its volume cannot be told apart from
+				// the others, so none are detached.
+				return nil, fmt.Errorf("failed to get PVC %s/%s: %v", pod.Namespace, volume.PersistentVolumeClaim.ClaimName, err)
+			}
+			if pvc.Spec.VolumeName != "" {
+				inUse.Insert(pvc.Spec.VolumeName)
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// nodeShuttingDown returns true if node has one of taints.
+func nodeShuttingDown(node *v1.Node, taints sets.String) bool {
+	for _, taint := range node.Spec.Taints {
+		if taints.Has(taint.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeVolumeInUse returns true if node reports the CSI volume volumeHandle of
+// driverName in its status as in use.
+func nodeVolumeInUse(node *v1.Node, driverName, volumeHandle string) bool {
+	name := v1.UniqueVolumeName(fmt.Sprintf("kubernetes.io/csi/%s^%s", driverName, volumeHandle))
+	for _, inUse := range node.Status.VolumesInUse {
+		if inUse == name {
+			return true
+		}
+	}
+	return false
+}
+
+// csiNodeID returns the node ID the driver reported for node.
+func csiNodeID(node *v1.Node, driverName string) (string, error) {
+	annotation, ok := node.Annotations[nodeIDAnnotationKey]
+	if !ok {
+		return "", fmt.Errorf("node %s has no %s annotation", node.Name, nodeIDAnnotationKey)
+	}
+	nodeIDs := map[string]string{}
+	if err := json.Unmarshal([]byte(annotation), &nodeIDs); err != nil {
+		return "", fmt.Errorf("node %s has an invalid %s annotation: %v", node.Name, nodeIDAnnotationKey, err)
+	}
+	nodeID, ok := nodeIDs[driverName]
+	if !ok {
+		return "", fmt.Errorf("node %s has no node ID for driver %s", node.Name, driverName)
+	}
+	return nodeID, nil
+}
+
+// volumesToPreDetach returns the PVs the driver attached to nodeName that are
+// not inUse.
+func volumesToPreDetach(nodeName, driverName string, attachments []storagev1.VolumeAttachment, inUse sets.String) []string {
+	var pvNames []string
+	for _, va := range attachments {
+		if va.Spec.Attacher != driverName || va.Spec.NodeName != nodeName || !va.Status.Attached {
+			continue
+		}
+		pvName := va.Spec.Source.PersistentVolumeName
+		if pvName == nil || inUse.Has(*pvName) {
+			continue
+		}
+		pvNames = append(pvNames, *pvName)
+	}
+	return pvNames
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/client-go/util/flowcontrol"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+// snapshotDeleteQueue rate limits snapshot deletes, so that a retention
+// sweep deleting thousands of snapshots does not use up the mutation quota
+// that provisioning and attaching need. Waiting deletes are admitted in
+// turn across their source volumes, so that the sweep of one volume does not
+// hold up the deletes of the others. Deletes are admitted in batches of up
+// to the burst when the queue has been idle, then at the QPS. A nil queue
+// admits every delete at once.
+type snapshotDeleteQueue struct {
+	limiter flowcontrol.RateLimiter
+	// wake is signaled when a delete is queued.
+	wake chan struct{}
+
+	mux sync.Mutex
+	// pending holds the waiting deletes of each source volume, oldest
+	// first.
+	pending map[string][]*queuedSnapshotDelete
+	// volumes holds the source volumes with waiting deletes in the order
+	// they are next served.
+	volumes []string
+	depth   int
+}
+
+type queuedSnapshotDelete struct {
+	// admitted is closed when the delete may start.
+	admitted chan struct{}
+}
+
+// newSnapshotDeleteQueue returns a queue admitting qps deletes per second
+// with a burst of burst, or nil if qps is not positive.
+func newSnapshotDeleteQueue(qps float32, burst int) *snapshotDeleteQueue {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	q := &snapshotDeleteQueue{
+		limiter: flowcontrol.NewTokenBucketRateLimiter(qps, burst),
+		wake:    make(chan struct{}, 1),
+		pending: map[string][]*queuedSnapshotDelete{},
+	}
+	go q.run()
+	return q
+}
+
+// wait queues a delete of a snapshot of sourceVolume and returns once it may
+// start, or an error if ctx is done first.
+func (q *snapshotDeleteQueue) wait(ctx context.Context, sourceVolume string) error {
+	if q == nil {
+		return nil
+	}
+	d := &queuedSnapshotDelete{admitted: make(chan struct{})}
+	q.push(sourceVolume, d)
+	select {
+	case <-d.admitted:
+		return nil
+	case <-ctx.Done():
+		q.remove(sourceVolume, d)
+		return ctx.Err()
+	}
+}
+
+func (q *snapshotDeleteQueue) run() {
+	for range q.wake {
+		for q.queued() > 0 {
+			q.limiter.Accept()
+			if d := q.next(); d != nil {
+				close(d.admitted)
+			}
+		}
+	}
+}
+
+func (q *snapshotDeleteQueue) push(sourceVolume string, d *queuedSnapshotDelete) {
+	q.mux.Lock()
+	if len(q.pending[sourceVolume]) == 0 {
+		q.volumes = append(q.volumes, sourceVolume)
+	}
+	q.pending[sourceVolume] = append(q.pending[sourceVolume], d)
+	q.setDepth(q.depth + 1)
+	q.mux.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest waiting delete of the next source volume in turn, or
+// returns nil if no delete is waiting.
+func (q *snapshotDeleteQueue) next() *queuedSnapshotDelete {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.volumes) == 0 {
+		return nil
+	}
+	volume := q.volumes[0]
+	q.volumes = q.volumes[1:]
+	deletes := q.pending[volume]
+	d := deletes[0]
+	if len(deletes) > 1 {
+		q.pending[volume] = deletes[1:]
+		q.volumes = append(q.volumes, volume)
+	} else {
+		delete(q.pending, volume)
+	}
+	q.setDepth(q.depth - 1)
+	return d
+}
+
+// remove drops d from the queue if it has not been admitted yet.
+func (q *snapshotDeleteQueue) remove(sourceVolume string, d *queuedSnapshotDelete) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	deletes := q.pending[sourceVolume]
+	for i := range deletes {
+		if deletes[i] != d {
+			continue
+		}
+		deletes = append(deletes[:i:i], deletes[i+1:]...)
+		if len(deletes) > 0 {
+			q.pending[sourceVolume] = deletes
+		} else {
+			delete(q.pending, sourceVolume)
+			for j, volume := range q.volumes {
+				if volume == sourceVolume {
+					q.volumes = append(q.volumes[:j:j], q.volumes[j+1:]...)
+					break
+				}
+			}
+		}
+		q.setDepth(q.depth - 1)
+		return
+	}
+}
+
+func (q *snapshotDeleteQueue) queued() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.depth
+}
+
+// setDepth must be called with mux held.
+func (q *snapshotDeleteQueue) setDepth(depth int) {
+	q.depth = depth
+	metrics.RecordSnapshotDeletesQueued(depth)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"sync"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
+)
+
+// snapshotUploads tracks the snapshots that are not yet ready to use, as
+// seen by the external-snapshotter polling CreateSnapshot and ListSnapshots,
+// and reports their number and age as metrics so that backup windows can be
+// monitored.
+type snapshotUploads struct {
+	mux sync.Mutex
+	// created holds the creation time of each uploading snapshot by ID.
+	created map[string]time.Time
+}
+
+func newSnapshotUploads() *snapshotUploads {
+	return &snapshotUploads{created: map[string]time.Time{}}
+}
+
+// observe records the state of snapshot and logs its progress if it is
+// still uploading.
+func (u *snapshotUploads) observe(snapshot *compute.Snapshot) {
+	id := cleanSelfLink(snapshot.SelfLink)
+	ready, err := isCSISnapshotReady(snapshot.Status)
+	if ready || err != nil {
+		u.forget(id)
+		return
+	}
+
+	now := time.Now()
+	created, parseErr := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+	if parseErr != nil {
+		created = now
+	}
+	klog.V(4).Infof("Snapshot %s is uploading: status %s, about %d%% done (%d of %d bytes, storage bytes %s), age %v",
+		id, snapshot.Status, snapshotProgress(snapshot), snapshot.StorageBytes, common.GbToBytes(snapshot.DiskSizeGb), snapshot.StorageBytesStatus, now.Sub(created).Round(time.Second))
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.created[id] = created
+	u.record(now)
+}
+
+// forget stops reporting the snapshot with the given ID, once it is ready,
+// failed or deleted.
+func (u *snapshotUploads) forget(id string) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if _, ok := u.created[id]; !ok {
+		return
+	}
+	delete(u.created, id)
+	u.record(time.Now())
+}
+
+func (u *snapshotUploads) record(now time.Time) {
+	ages := make(map[string]time.Duration, len(u.created))
+	for id, created := range u.created {
+		ages[id] = now.Sub(created)
+	}
+	metrics.RecordSnapshotUploads(ages)
+}
+
+// snapshotProgress estimates how far the upload of snapshot is, in percent.
+// GCE does not report upload progress; while storageBytesStatus is UPDATING
+// storageBytes grows towards the stored size of the snapshot, which is at
+// most the size of the source disk, so their ratio is a lower bound.
+func snapshotProgress(snapshot *compute.Snapshot) int64 {
+	if ready, _ := isCSISnapshotReady(snapshot.Status); ready {
+		return 100
+	}
+	diskBytes := common.GbToBytes(snapshot.DiskSizeGb)
+	if diskBytes <= 0 {
+		return 0
+	}
+	progress := snapshot.StorageBytes * 100 / diskBytes
+	if progress > 99 {
+		progress = 99
+	}
+	return progress
+}
@@ -17,18 +17,60 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
 var ProbeCSIFullMethod = "/csi.v1.Identity/Probe"
 
+// Controller methods that mutate GCE resources. An identical request
+// resent while one of these is in flight, as sidecars do after a restart,
+// waits for the in-flight call instead of racing it for the volume lock.
+var coalescedCSIFullMethods = sets.NewString(
+	"/csi.v1.Controller/CreateVolume",
+	"/csi.v1.Controller/DeleteVolume",
+	"/csi.v1.Controller/ControllerPublishVolume",
+	"/csi.v1.Controller/ControllerUnpublishVolume",
+	"/csi.v1.Controller/CreateSnapshot",
+	"/csi.v1.Controller/DeleteSnapshot",
+	"/csi.v1.Controller/ControllerExpandVolume",
+)
+
+// coalescedRequestTimeout bounds a coalesced call, which outlives the
+// request that started it. It is long enough for a regional disk insert.
+const coalescedRequestTimeout = 10 * time.Minute
+
+// Methods called so often, by sidecars and the kubelet, that their logs are
+// sampled when a log sample interval is set.
+var sampledCSIFullMethods = sets.NewString(
+	"/csi.v1.Identity/GetPluginInfo",
+	"/csi.v1.Identity/GetPluginCapabilities",
+	"/csi.v1.Controller/ControllerGetCapabilities",
+	"/csi.v1.Node/NodeGetCapabilities",
+	"/csi.v1.Node/NodeGetVolumeStats",
+)
+
 func NewVolumeCapabilityAccessMode(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability_AccessMode {
 	return &csi.VolumeCapability_AccessMode{Mode: mode}
 }
@@ -53,27 +95,417 @@ func NewNodeServiceCapability(cap csi.NodeServiceCapability_RPC_Type) *csi.NodeS
 	}
 }
 
-func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	if info.FullMethod == ProbeCSIFullMethod {
+// logGRPC returns an interceptor that logs requests and responses. Calls to
+// the methods in sampledCSIFullMethods are logged as sampler allows, with a
+// count of the calls that were not; errors are always logged.
+func logGRPC(sampler *common.LogSampler) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == ProbeCSIFullMethod {
+			return handler(ctx, req)
+		}
+		log := true
+		if sampledCSIFullMethods.Has(info.FullMethod) {
+			var suppressed int
+			log, suppressed = sampler.Sample(info.FullMethod)
+			if suppressed > 0 {
+				klog.V(4).Infof("%s called %d times without being logged", info.FullMethod, suppressed)
+			}
+		}
+		// Note that secrets are not included in any RPC message. In the past protosanitizer and other log
+		// stripping was shown to cause a significant increase of CPU usage (see
+		// https://github.com/kubernetes-sigs/gcp-compute-persistent-disk-csi-driver/issues/356#issuecomment-550529004).
+		if log {
+			klog.V(4).Infof("%s called with request: %s", info.FullMethod, req)
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			klog.Errorf("%s returned with error: %v", info.FullMethod, err)
+		} else if log {
+			klog.V(4).Infof("%s returned with response: %s", info.FullMethod, resp)
+		}
+		return resp, err
+	}
+}
+
+// coalesceGRPC returns an interceptor that gives identical concurrent
+// requests to the methods in coalescedCSIFullMethods the result of a single
+// call. The call keeps running when the caller that started it goes away.
+func coalesceGRPC(coalescer *common.RequestCoalescer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !coalescedCSIFullMethods.Has(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		key, err := requestHash(info.FullMethod, req)
+		if err != nil {
+			klog.Warningf("Not coalescing %s: %v", info.FullMethod, err)
+			return handler(ctx, req)
+		}
+		resp, shared, err := coalescer.Do(ctx, key, func(callCtx context.Context) (interface{}, error) {
+			return handler(callCtx, req)
+		})
+		if shared {
+			klog.V(4).Infof("%s request was coalesced with an identical in-flight request", info.FullMethod)
+		}
+		if err != nil && err == ctx.Err() {
+			return nil, status.Error(codes.DeadlineExceeded, fmt.Sprintf("%s waiting for in-flight request: %v", info.FullMethod, err))
+		}
+		return resp, err
+	}
+}
+
+// limitGRPC returns an interceptor that fails calls with Aborted once the
+// method has as many calls in flight as limiter allows, so that the caller
+// backs off and retries instead of the driver piling up calls. It runs
+// inside coalesceGRPC so that coalesced requests take a single slot.
+func limitGRPC(limiter *common.ConcurrencyLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		rpc := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		release, ok := limiter.TryAcquire(rpc)
+		if !ok {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("%s already has the maximum of %d calls in flight", rpc, limiter.Limit(rpc)))
+		}
+		defer release()
 		return handler(ctx, req)
 	}
-	// Note that secrets are not included in any RPC message. In the past protosanitizer and other log
-	// stripping was shown to cause a significant increase of CPU usage (see
-	// https://github.com/kubernetes-sigs/gcp-compute-persistent-disk-csi-driver/issues/356#issuecomment-550529004).
-	klog.V(4).Infof("%s called with request: %s", info.FullMethod, req)
-	resp, err := handler(ctx, req)
-	if err != nil {
-		klog.Errorf("%s returned with error: %v", info.FullMethod, err)
-	} else {
-		klog.V(4).Infof("%s returned with response: %s", info.FullMethod, resp)
+}
+
+// retryGRPC returns an interceptor that retries calls according to the
+// policy policyFor returns for the method. It runs inside coalesceGRPC so that
+// coalesced requests share the retries of a single call.
+//
+// The per-attempt timeout is applied through the context given to the
+// handler; an attempt that ignores its context is waited for.
+func retryGRPC(policyFor func(fullMethod string) *common.RetryPolicy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		policy := policyFor(info.FullMethod)
+		if policy == nil {
+			return handler(ctx, req)
+		}
+		backoff := policy.Backoff
+		for attempt := 1; ; attempt++ {
+			resp, err := callWithTimeout(ctx, req, handler, policy.PerAttemptTimeout)
+			if err == nil || attempt >= policy.MaxAttempts || !policy.Retryable(err) {
+				return resp, err
+			}
+			klog.Warningf("%s attempt %d of %d failed, retrying in %v: %v", info.FullMethod, attempt, policy.MaxAttempts, backoff, err)
+			select {
+			case <-ctx.Done():
+				return resp, err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// callWithTimeout calls handler with a context bounded by timeout, if it is
+// positive. An error returned after that context expired is reported as
+// DeadlineExceeded so that it can be retried as such.
+func callWithTimeout(ctx context.Context, req interface{}, handler grpc.UnaryHandler, timeout time.Duration) (interface{}, error) {
+	if timeout <= 0 {
+		return handler(ctx, req)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := handler(attemptCtx, req)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+		return resp, status.Error(codes.DeadlineExceeded, fmt.Sprintf("attempt timed out after %v: %v", timeout, err))
 	}
 	return resp, err
 }
 
-func validateVolumeCapabilities(vcs []*csi.VolumeCapability) error {
-	isMnt := false
-	isBlk := false
+// requestHash returns a key identifying the request to method. Secrets are
+// hashed along with the rest of the request and never stored.
+func requestHash(method string, req interface{}) (string, error) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return "", fmt.Errorf("request of type %T is not a proto message", req)
+	}
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(msg); err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+	sum := sha256.Sum256(append([]byte(method+"\x00"), buf.Bytes()...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hardeningMountOptions are added to filesystem mounts when the node enforces
+// mount hardening. Each is keyed by the option that would undo it.
+var hardeningMountOptions = map[string]string{
+	"exec": "noexec",
+	"suid": "nosuid",
+	"dev":  "nodev",
+}
+
+// hardenMountOptions returns options with the hardening options added, or an
+// error if options include one that undoes them.
+func hardenMountOptions(options []string) ([]string, error) {
+	given := sets.NewString(options...)
+	for _, opt := range options {
+		if hardened, ok := hardeningMountOptions[opt]; ok {
+			return nil, fmt.Errorf("mount option %q conflicts with enforced mount option %q, set volume attribute %s to \"false\" to opt out of mount hardening", opt, hardened, common.VolumeAttributeMountHardening)
+		}
+	}
+	hardened := append([]string{}, options...)
+	for _, opt := range []string{"noexec", "nosuid", "nodev"} {
+		if !given.Has(opt) {
+			hardened = append(hardened, opt)
+		}
+	}
+	return hardened, nil
+}
+
+// applyDiscardPolicy returns options with discard added when the volume
+// context asks for it, or an error if it forbids discard and options include
+// it. Without a policy the options are returned unchanged.
+func applyDiscardPolicy(options []string, volumeContext map[string]string) ([]string, error) {
+	v, ok := volumeContext[common.VolumeAttributeDiscard]
+	if !ok {
+		return options, nil
+	}
+	discard, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume attribute %s %q, must be true or false", common.VolumeAttributeDiscard, v)
+	}
+	given := sets.NewString(options...)
+	if !discard {
+		if given.Has("discard") {
+			return nil, fmt.Errorf("mount option \"discard\" conflicts with volume attribute %s \"false\"", common.VolumeAttributeDiscard)
+		}
+		return options, nil
+	}
+	if given.Has("nodiscard") {
+		return nil, fmt.Errorf("mount option \"nodiscard\" conflicts with volume attribute %s \"true\"", common.VolumeAttributeDiscard)
+	}
+	if given.Has("discard") {
+		return options, nil
+	}
+	return append(options, "discard"), nil
+}
+
+// diskMetadataFile is the file, relative to the root of a published volume,
+// the disk metadata is written to.
+const diskMetadataFile = ".gce-pd-metadata.json"
+
+// diskMetadata identifies the disk backing a volume to the workload using it.
+type diskMetadata struct {
+	DiskName string `json:"diskName"`
+	Zone     string `json:"zone,omitempty"`
+	Region   string `json:"region,omitempty"`
+	DiskType string `json:"diskType,omitempty"`
+	// Serial is the serial the disk shows up with on the node.
+	Serial string `json:"serial"`
+}
+
+// getDiskMetadata returns the metadata of the disk of volumeID, or nil if the
+// volume context does not ask for it to be published.
+func getDiskMetadata(volumeID string, publishContext, volumeContext map[string]string) (*diskMetadata, error) {
+	v, ok := volumeContext[common.VolumeAttributePublishMetadata]
+	if !ok {
+		return nil, nil
+	}
+	publish, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume attribute %s %q, must be true or false", common.VolumeAttributePublishMetadata, v)
+	}
+	if !publish {
+		return nil, nil
+	}
+	volKey, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	serial := publishContext[common.ContextKeyDeviceName]
+	if serial == "" {
+		if serial, err = common.GetDeviceName(volKey); err != nil {
+			return nil, err
+		}
+	}
+	return &diskMetadata{
+		DiskName: volKey.Name,
+		Zone:     volKey.Zone,
+		Region:   volKey.Region,
+		DiskType: volumeContext[common.VolumeAttributeDiskType],
+		Serial:   serial,
+	}, nil
+}
+
+// writeDiskMetadata writes md to the metadata file in dir. The file is
+// replaced atomically so readers never see a partial write.
+func writeDiskMetadata(dir string, md *diskMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, diskMetadataFile+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, diskMetadataFile))
+}
+
+// validateTargetPath returns path cleaned up for the platform. It returns an
+// error if the path is too long or if kubeletRootDir is set and the path,
+// once symlinks are resolved, is not under it.
+func validateTargetPath(path, kubeletRootDir string) (string, error) {
+	cleaned := normalizeTargetPath(path)
+	if len(cleaned) > maxTargetPathLength {
+		return "", fmt.Errorf("path %s is %d characters long, the maximum is %d", path, len(cleaned), maxTargetPathLength)
+	}
+	if kubeletRootDir == "" {
+		return cleaned, nil
+	}
+	root := comparablePath(resolveExistingPath(normalizeTargetPath(kubeletRootDir)))
+	resolved := comparablePath(resolveExistingPath(cleaned))
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is not under the kubelet root directory %s", path, kubeletRootDir)
+	}
+	return cleaned, nil
+}
+
+// resolveExistingPath resolves the symlinks in the longest leading part of
+// path that exists, so that paths kubelet has not created yet can be checked.
+func resolveExistingPath(path string) string {
+	existing, rest := path, ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(existing); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// reportableFilesystems are the filesystems nodes report support for in their
+// topology.
+var reportableFilesystems = sets.NewString("ext2", "ext3", "ext4", "xfs", "btrfs", "ntfs")
+
+// parseProcFilesystems returns the block device filesystems listed in the
+// /proc/filesystems content data.
+func parseProcFilesystems(data []byte) sets.String {
+	filesystems := sets.NewString()
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// Filesystems that need no block device are listed as "nodev <name>".
+		if len(fields) == 1 {
+			filesystems.Insert(fields[0])
+		}
+	}
+	return filesystems
+}
+
+// filesystemTopologyValue returns the TopologyKeyFilesystems value reporting
+// support for the reportable filesystems among filesystems.
+func filesystemTopologyValue(filesystems sets.String) string {
+	return strings.Join(filesystems.Intersection(reportableFilesystems).List(), ".")
+}
+
+// segmentSupportsFilesystem returns whether the node of a topology segment
+// may support fsType. Nodes that do not report their filesystems, or failed
+// to list them, may support any.
+func segmentSupportsFilesystem(segments map[string]string, fsType string) bool {
+	value, ok := segments[common.TopologyKeyFilesystems]
+	if !ok || value == common.TopologyFilesystemsUnknown {
+		return true
+	}
+	return sets.NewString(strings.Split(value, ".")...).Has(fsType)
+}
+
+// validateFilesystemTopology returns an error if the filesystem requested by
+// vcs is not supported by any node in top. Nodes that do not report their
+// filesystems may support any, as may nodes when no filesystem is requested.
+func validateFilesystemTopology(vcs []*csi.VolumeCapability, top *csi.TopologyRequirement) error {
+	segments := append(append([]*csi.Topology{}, top.GetRequisite()...), top.GetPreferred()...)
+	for _, vc := range vcs {
+		fsType := strings.ToLower(vc.GetMount().GetFsType())
+		if fsType == "" || len(segments) == 0 {
+			continue
+		}
+		supported := false
+		for _, seg := range segments {
+			if segmentSupportsFilesystem(seg.GetSegments(), fsType) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("no node in the requested topology supports filesystem %q", fsType)
+		}
+	}
+	return nil
+}
 
+// translateTopology returns a copy of top in which the zone of each segment,
+// whether given under one of aliases.ZoneKeys or under TopologyKeyZone, is
+// translated through aliases.Zones and set under TopologyKeyZone. It returns
+// an error if a segment names more than one zone.
+func translateTopology(top *csi.TopologyRequirement, aliases common.TopologyAliases) (*csi.TopologyRequirement, error) {
+	if top == nil || (len(aliases.ZoneKeys) == 0 && len(aliases.Zones) == 0) {
+		return top, nil
+	}
+	requisite, err := translateSegments(top.GetRequisite(), aliases)
+	if err != nil {
+		return nil, err
+	}
+	preferred, err := translateSegments(top.GetPreferred(), aliases)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.TopologyRequirement{Requisite: requisite, Preferred: preferred}, nil
+}
+
+func translateSegments(topologies []*csi.Topology, aliases common.TopologyAliases) ([]*csi.Topology, error) {
+	if topologies == nil {
+		return nil, nil
+	}
+	zoneKeys := sets.NewString(aliases.ZoneKeys...).Insert(common.TopologyKeyZone)
+	translated := make([]*csi.Topology, 0, len(topologies))
+	for _, t := range topologies {
+		segments := map[string]string{}
+		zone := ""
+		for key, value := range t.GetSegments() {
+			if !zoneKeys.Has(key) {
+				segments[key] = value
+				continue
+			}
+			if alias, ok := aliases.Zones[value]; ok {
+				value = alias
+			}
+			if zone != "" && zone != value {
+				return nil, fmt.Errorf("topology segment %v names more than one zone: %q and %q", t.GetSegments(), zone, value)
+			}
+			zone = value
+		}
+		if zone != "" {
+			segments[common.TopologyKeyZone] = zone
+		}
+		translated = append(translated, &csi.Topology{Segments: segments})
+	}
+	return translated, nil
+}
+
+// validateVolumeCapabilities checks each of vcs. The list may mix mount and
+// block capabilities: the CSI spec has a volume satisfy every capability it
+// is created with, and a PD serves either access type, which is picked each
+// time the volume is staged.
+func validateVolumeCapabilities(vcs []*csi.VolumeCapability) error {
 	if vcs == nil {
 		return errors.New("volume capabilities is nil")
 	}
@@ -82,18 +514,41 @@ func validateVolumeCapabilities(vcs []*csi.VolumeCapability) error {
 		if err := validateVolumeCapability(vc); err != nil {
 			return err
 		}
-		if blk := vc.GetBlock(); blk != nil {
-			isBlk = true
+	}
+	return nil
+}
+
+// Access types recorded in the volume context of volumes created for more
+// than one.
+const (
+	accessTypeBlock = "block"
+	accessTypeMount = "mount"
+)
+
+// volumeAccessTypes returns the access types of vcs, sorted and comma
+// separated.
+func volumeAccessTypes(vcs []*csi.VolumeCapability) string {
+	types := sets.NewString()
+	for _, vc := range vcs {
+		if vc.GetBlock() != nil {
+			types.Insert(accessTypeBlock)
 		}
-		if mnt := vc.GetMount(); mnt != nil {
-			isMnt = true
+		if vc.GetMount() != nil {
+			types.Insert(accessTypeMount)
 		}
 	}
+	return strings.Join(types.List(), ",")
+}
 
-	if isBlk && isMnt {
-		return errors.New("both mount and block volume capabilities specified")
+// validateAccessTypes checks that the access type of each of vcs is one of
+// accessTypes, as recorded by volumeAccessTypes.
+func validateAccessTypes(vcs []*csi.VolumeCapability, accessTypes string) error {
+	recorded := sets.NewString(strings.Split(accessTypes, ",")...)
+	for _, requested := range strings.Split(volumeAccessTypes(vcs), ",") {
+		if requested != "" && !recorded.Has(requested) {
+			return fmt.Errorf("access type %s is not one of the access types %s the volume was created for", requested, accessTypes)
+		}
 	}
-
 	return nil
 }
 
@@ -111,7 +566,20 @@ func validateVolumeCapability(vc *csi.VolumeCapability) error {
 		return errors.New("specified both mount and block access types")
 	}
 	if mnt != nil && mod == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
-		return errors.New("specified multi writer with mount access type")
+		return fmt.Errorf("access mode %v is only supported for block volumes, a filesystem cannot be mounted read-write on several nodes at once", mod)
+	}
+	return nil
+}
+
+// validateReadOnlyCapabilities checks that vcs only have read-only access
+// modes.
+func validateReadOnlyCapabilities(vcs []*csi.VolumeCapability) error {
+	for _, vc := range vcs {
+		switch mode := vc.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		default:
+			return fmt.Errorf("access mode %v is not read-only", mode)
+		}
 	}
 	return nil
 }
@@ -132,6 +600,65 @@ func validateAccessMode(am *csi.VolumeCapability_AccessMode) error {
 	return nil
 }
 
+// diskTypeSupport records which disk settings beyond a single read-write
+// attachment a disk type supports.
+type diskTypeSupport struct {
+	// multiWriter is whether the disk can be created in multi-writer mode,
+	// as needed by MULTI_NODE_MULTI_WRITER.
+	multiWriter bool
+	// multiReader is whether the disk can be attached read-only to several
+	// instances, as needed by MULTI_NODE_READER_ONLY.
+	multiReader bool
+	// regional is whether the disk can be replicated across two zones.
+	regional bool
+}
+
+// Support of the disk types known to the driver. See
+// https://cloud.google.com/compute/docs/disks/sharing-disks-between-vms.
+// Other disk types are passed to GCE unchecked.
+var knownDiskTypes = map[string]diskTypeSupport{
+	"pd-standard":          {multiReader: true, regional: true},
+	"pd-balanced":          {multiWriter: true, multiReader: true, regional: true},
+	"pd-ssd":               {multiWriter: true, multiReader: true, regional: true},
+	"pd-extreme":           {multiReader: true},
+	"hyperdisk-balanced":   {},
+	"hyperdisk-extreme":    {},
+	"hyperdisk-throughput": {},
+	"hyperdisk-ml":         {multiReader: true},
+}
+
+// validateVolumeCapabilitiesForDisk checks vcs, and that a disk of diskType
+// can serve every one of them. regional is whether the disk is replicated
+// and multiWriter whether it is in multi-writer mode.
+func validateVolumeCapabilitiesForDisk(vcs []*csi.VolumeCapability, diskType string, regional, multiWriter bool) error {
+	if err := validateVolumeCapabilities(vcs); err != nil {
+		return err
+	}
+	if regional && multiWriter {
+		return errors.New("multi-writer mode is not supported for regional disks")
+	}
+	support, known := knownDiskTypes[diskType]
+	if known && regional && !support.regional {
+		return fmt.Errorf("disk type %s does not support regional replication", diskType)
+	}
+	if known && multiWriter && !support.multiWriter {
+		return fmt.Errorf("disk type %s does not support multi-writer mode", diskType)
+	}
+	for _, vc := range vcs {
+		switch mode := vc.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			if !multiWriter {
+				return fmt.Errorf("access mode %v requires a multi-writer disk", mode)
+			}
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+			if known && !support.multiReader {
+				return fmt.Errorf("access mode %v is not supported for disk type %s", mode, diskType)
+			}
+		}
+	}
+	return nil
+}
+
 func getMultiWriterFromCapability(vc *csi.VolumeCapability) (bool, error) {
 	if vc.GetAccessMode() == nil {
 		return false, errors.New("access mode is nil")
@@ -155,3 +682,81 @@ func getMultiWriterFromCapabilities(vcs []*csi.VolumeCapability) (bool, error) {
 	}
 	return false, nil
 }
+
+// podUIDKey is the volume context key of the pod UID passed to
+// NodePublishVolume when the CSIDriver has podInfoOnMount set.
+const podUIDKey = "csi.storage.k8s.io/pod.uid"
+
+// podUIDFromPublishRequest returns the UID of the pod a volume is published
+// to, from the volume context if the CSIDriver passes pod info on mount, or
+// else from the kubelet layout of the target path.
+func podUIDFromPublishRequest(targetPath string, volumeContext map[string]string) (string, error) {
+	if uid := volumeContext[podUIDKey]; uid != "" {
+		return uid, nil
+	}
+	// Filesystem volumes are published to
+	// <kubelet>/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount, and block
+	// volumes to <kubelet>/plugins/kubernetes.io/csi/volumeDevices/publish/<pv>/<uid>.
+	parts := strings.Split(filepath.ToSlash(targetPath), "/")
+	for i, part := range parts {
+		if part == "pods" && i+2 < len(parts) && parts[i+2] == "volumes" {
+			return parts[i+1], nil
+		}
+		if part == "volumeDevices" && i+3 < len(parts) && parts[i+1] == "publish" {
+			return parts[i+3], nil
+		}
+	}
+	return "", fmt.Errorf("target path %s is not under a pod directory", targetPath)
+}
+
+// findPodCgroup returns the cgroup directory of the pod with podUID under
+// cgroupRoot, for the cgroupfs and systemd cgroup drivers and for both the
+// unified hierarchy and the blkio hierarchy of cgroup v1.
+func findPodCgroup(cgroupRoot, podUID string) (string, error) {
+	systemdUID := strings.ReplaceAll(podUID, "-", "_")
+	for _, root := range []string{cgroupRoot, filepath.Join(cgroupRoot, "blkio")} {
+		for _, pattern := range []string{
+			"kubepods*/pod" + podUID,
+			"kubepods*/*/pod" + podUID,
+			"kubepods*/*pod" + systemdUID + ".slice",
+			"kubepods*/*/*pod" + systemdUID + ".slice",
+		} {
+			matches, err := filepath.Glob(filepath.Join(root, pattern))
+			if err != nil {
+				return "", err
+			}
+			if len(matches) > 0 {
+				return matches[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no cgroup found for pod %s under %s", podUID, cgroupRoot)
+}
+
+// writeCgroupIOLimits limits the IO of the cgroup at cgroupDir to the device
+// with the given numbers, through io.max on cgroup v2 or the blkio throttle
+// files on cgroup v1.
+func writeCgroupIOLimits(cgroupDir string, major, minor uint32, limits common.IOLimits) error {
+	device := fmt.Sprintf("%d:%d", major, minor)
+	ioMax := filepath.Join(cgroupDir, "io.max")
+	if _, err := os.Stat(ioMax); err == nil {
+		return ioutil.WriteFile(ioMax, []byte(fmt.Sprintf("%s %s", device, limits)), 0644)
+	}
+	if _, err := os.Stat(filepath.Join(cgroupDir, "blkio.throttle.read_bps_device")); err != nil {
+		return fmt.Errorf("cgroup %s has neither io.max nor blkio throttle files, the io controller may not be enabled", cgroupDir)
+	}
+	for file, limit := range map[string]int64{
+		"blkio.throttle.read_bps_device":   limits.ReadBytesPerSec,
+		"blkio.throttle.write_bps_device":  limits.WriteBytesPerSec,
+		"blkio.throttle.read_iops_device":  limits.ReadIOPS,
+		"blkio.throttle.write_iops_device": limits.WriteIOPS,
+	} {
+		if limit == 0 {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(cgroupDir, file), []byte(fmt.Sprintf("%s %d", device, limit)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
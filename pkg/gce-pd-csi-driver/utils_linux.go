@@ -16,17 +16,38 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
 	"k8s.io/mount-utils"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
+const (
+	// PATH_MAX less the terminating null byte.
+	maxTargetPathLength = 4095
+
+	sysfsBlockPath      = "/sys/class/block"
+	procFilesystemsPath = "/proc/filesystems"
+	osReleasePath       = "/proc/sys/kernel/osrelease"
+	kernelModulesPath   = "/lib/modules"
+
+	// syncFilesystemTimeout bounds each of the sync, freeze and thaw
+	// commands run before unstaging.
+	syncFilesystemTimeout = time.Minute
+)
+
 func getDevicePath(ns *GCENodeServer, volumeID, partition string) (string, error) {
 	volumeKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
@@ -79,3 +100,199 @@ func getBlockSizeBytes(devicePath string, m *mount.SafeFormatAndMount) (int64, e
 	}
 	return gotSizeBytes, nil
 }
+
+func isBlockDevice(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0, nil
+}
+
+// rescanBlockDevice makes the kernel pick up a new size of the disk at
+// devicePath. NVMe disks are resized by the kernel on their own, SCSI disks
+// are rescanned through sysfs.
+func rescanBlockDevice(devicePath string, m *mount.SafeFormatAndMount) error {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		klog.Warningf("Could not resolve device path %s to rescan it: %v", devicePath, err)
+	} else {
+		rescanPath := filepath.Join(sysfsBlockPath, filepath.Base(realPath), "device", "rescan")
+		if _, err := os.Stat(rescanPath); err == nil {
+			if err := ioutil.WriteFile(rescanPath, []byte("1"), 0200); err != nil {
+				return fmt.Errorf("error rescanning device %s: %v", realPath, err)
+			}
+		}
+	}
+	output, err := m.Exec.Command("blockdev", "--rereadpt", devicePath).CombinedOutput()
+	if err != nil {
+		// This fails while the device is in use, which does not stop
+		// the new size from being picked up.
+		klog.Warningf("Failed to reread partition table of %s: output: %s, err: %v", devicePath, string(output), err)
+	}
+	return nil
+}
+
+// trimFilesystem discards the unused blocks of the filesystem mounted at path.
+func trimFilesystem(path string, m *mount.SafeFormatAndMount) error {
+	output, err := m.Exec.Command("fstrim", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fstrim of %s failed: output: %s, err: %v", path, string(output), err)
+	}
+	return nil
+}
+
+// syncFilesystem writes out the dirty pages of the filesystem mounted at
+// path. With freeze, the filesystem is frozen and thawed instead, which also
+// leaves its journal clean. The filesystem is thawed whenever a freeze was
+// attempted, as a freeze that timed out or was cancelled may still have taken
+// effect, and a filesystem left frozen blocks every writer on it.
+func syncFilesystem(ctx context.Context, path string, freeze bool, m *mount.SafeFormatAndMount) (err error) {
+	syncCtx, cancel := context.WithTimeout(ctx, syncFilesystemTimeout)
+	defer cancel()
+	if !freeze {
+		output, err := m.Exec.CommandContext(syncCtx, "sync", "-f", path).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("sync of %s failed: output: %s, err: %v", path, string(output), err)
+		}
+		return nil
+	}
+	defer func() {
+		// The thaw must run even when ctx is done, so it gets a context of
+		// its own.
+		thawCtx, cancel := context.WithTimeout(context.Background(), syncFilesystemTimeout)
+		defer cancel()
+		output, thawErr := m.Exec.CommandContext(thawCtx, "fsfreeze", "--unfreeze", path).CombinedOutput()
+		if thawErr == nil {
+			return
+		}
+		if err != nil {
+			// The freeze failing most likely left nothing to thaw.
+			klog.V(4).Infof("fsfreeze --unfreeze of %s after a failed freeze: output: %s, err: %v", path, string(output), thawErr)
+			return
+		}
+		err = fmt.Errorf("fsfreeze --unfreeze of %s failed: output: %s, err: %v", path, string(output), thawErr)
+	}()
+	output, err := m.Exec.CommandContext(syncCtx, "fsfreeze", "--freeze", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fsfreeze --freeze of %s failed: output: %s, err: %v", path, string(output), err)
+	}
+	return nil
+}
+
+func flushDeviceBuffers(devicePath string, m *mount.SafeFormatAndMount) error {
+	output, err := m.Exec.Command("blockdev", "--flushbufs", devicePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("blockdev --flushbufs of %s failed: output: %s, err: %v", devicePath, string(output), err)
+	}
+	return nil
+}
+
+func normalizeTargetPath(path string) string {
+	return filepath.Clean(path)
+}
+
+func comparablePath(path string) string {
+	return path
+}
+
+// regenerateFilesystemUUID gives the ext or xfs filesystem on devicePath a
+// new random UUID. The filesystem must not be mounted. Devices without a
+// filesystem, or with another filesystem, are left as they are.
+func regenerateFilesystemUUID(devicePath string, m *mount.SafeFormatAndMount) error {
+	fsType, err := m.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to get the filesystem of %s: %v", devicePath, err)
+	}
+	var cmd string
+	var args []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmd, args = "tune2fs", []string{"-U", "random", devicePath}
+	case "xfs":
+		cmd, args = "xfs_admin", []string{"-U", "generate", devicePath}
+	default:
+		return nil
+	}
+	output, err := m.Exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s of %s failed: output: %s, err: %v", cmd, devicePath, string(output), err)
+	}
+	return nil
+}
+
+// filesystemUUID returns the UUID of the filesystem on devicePath.
+func filesystemUUID(devicePath string, m *mount.SafeFormatAndMount) (string, error) {
+	output, err := m.Exec.Command("blkid", "-s", "UUID", "-o", "value", devicePath).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("blkid of %s failed: output: %s, err: %v", devicePath, string(output), err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// supportedFilesystems returns the block device filesystems the kernel has
+// loaded or can load from a module.
+func supportedFilesystems() (sets.String, error) {
+	data, err := ioutil.ReadFile(procFilesystemsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", procFilesystemsPath, err)
+	}
+	filesystems := parseProcFilesystems(data)
+	release, err := ioutil.ReadFile(osReleasePath)
+	if err != nil {
+		klog.Warningf("Not looking for filesystem modules, failed to read %s: %v", osReleasePath, err)
+		return filesystems, nil
+	}
+	modulesPath := filepath.Join(kernelModulesPath, strings.TrimSpace(string(release)), "kernel", "fs")
+	for _, fs := range reportableFilesystems.Difference(filesystems).List() {
+		if _, err := os.Stat(filepath.Join(modulesPath, fs)); err == nil {
+			filesystems.Insert(fs)
+		}
+	}
+	return filesystems, nil
+}
+
+// deviceNumber returns the major and minor numbers of the block device at
+// devicePath, following symlinks such as /dev/disk/by-id paths.
+func deviceNumber(devicePath string) (uint32, uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devicePath, &st); err != nil {
+		return 0, 0, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", devicePath)
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), nil
+}
+
+// deviceHolders returns the names of the devices stacked on the block device
+// at devicePath, such as device-mapper or md devices.
+func deviceHolders(devicePath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsBlockPath, filepath.Base(devicePath), "holders"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var holders []string
+	for _, entry := range entries {
+		holders = append(holders, entry.Name())
+	}
+	return holders, nil
+}
+
+// mountedDeviceNumber returns the major and minor numbers of the device
+// backing the filesystem at path. It fails if the filesystem does not answer
+// statfs, as for a mount whose device is gone.
+func mountedDeviceNumber(path string) (uint32, uint32, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return 0, 0, fmt.Errorf("statfs of %s failed: %v", path, err)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)), nil
+}
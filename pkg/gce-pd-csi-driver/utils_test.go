@@ -18,9 +18,26 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
 var (
@@ -169,6 +186,11 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 				createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
 			},
 		},
+		{
+			name: "success with mount + block capabilities",
+			vc: append(createVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)...),
+		},
 	}
 
 	for _, tc := range testCases {
@@ -183,6 +205,81 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 	}
 }
 
+func TestValidateVolumeCapabilitiesForDisk(t *testing.T) {
+	accessModes := []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_UNKNOWN,
+	}
+	diskTypes := []string{
+		"pd-standard",
+		"pd-balanced",
+		"pd-ssd",
+		"pd-extreme",
+		"hyperdisk-balanced",
+		"hyperdisk-extreme",
+		"hyperdisk-throughput",
+		"hyperdisk-ml",
+		// Unknown disk types are left to GCE.
+		"unknown-type",
+	}
+	unsupportedModes := sets.NewString(
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER.String(),
+		csi.VolumeCapability_AccessMode_UNKNOWN.String())
+	multiWriterTypes := sets.NewString("pd-balanced", "pd-ssd", "unknown-type")
+	multiReaderTypes := sets.NewString("pd-standard", "pd-balanced", "pd-ssd", "pd-extreme", "hyperdisk-ml", "unknown-type")
+	regionalTypes := sets.NewString("pd-standard", "pd-balanced", "pd-ssd", "unknown-type")
+
+	for _, mode := range accessModes {
+		for _, block := range []bool{false, true} {
+			for _, diskType := range diskTypes {
+				for _, regional := range []bool{false, true} {
+					for _, multiWriter := range []bool{false, true} {
+						vc := createVolumeCapability(mode)
+						if block {
+							vc = createBlockVolumeCapability(mode)
+						}
+						var invalid []string
+						if unsupportedModes.Has(mode.String()) {
+							invalid = append(invalid, "unsupported access mode")
+						}
+						if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER && !block {
+							invalid = append(invalid, "multi-writer filesystem")
+						}
+						if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER && !multiWriter {
+							invalid = append(invalid, "multi-writer access to single-writer disk")
+						}
+						if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY && !multiReaderTypes.Has(diskType) {
+							invalid = append(invalid, "disk type cannot be shared read-only")
+						}
+						if multiWriter && !multiWriterTypes.Has(diskType) {
+							invalid = append(invalid, "disk type cannot be multi-writer")
+						}
+						if regional && !regionalTypes.Has(diskType) {
+							invalid = append(invalid, "disk type cannot be regional")
+						}
+						if regional && multiWriter {
+							invalid = append(invalid, "regional multi-writer disk")
+						}
+
+						err := validateVolumeCapabilitiesForDisk([]*csi.VolumeCapability{vc}, diskType, regional, multiWriter)
+						desc := fmt.Sprintf("mode %v, block %v, type %s, regional %v, multi-writer %v", mode, block, diskType, regional, multiWriter)
+						if len(invalid) > 0 && err == nil {
+							t.Errorf("%s: expected error for %v, got none", desc, invalid)
+						}
+						if len(invalid) == 0 && err != nil {
+							t.Errorf("%s: unexpected error: %v", desc, err)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
 func TestGetMultiWriterFromCapabilities(t *testing.T) {
 	testCases := []struct {
 		name   string
@@ -234,3 +331,719 @@ func TestGetMultiWriterFromCapabilities(t *testing.T) {
 		}
 	}
 }
+
+func TestHardenMountOptions(t *testing.T) {
+	testCases := []struct {
+		name       string
+		options    []string
+		expOptions []string
+		expErr     bool
+	}{
+		{
+			name:       "no options",
+			expOptions: []string{"noexec", "nosuid", "nodev"},
+		},
+		{
+			name:       "user options kept",
+			options:    []string{"bind", "ro", "discard"},
+			expOptions: []string{"bind", "ro", "discard", "noexec", "nosuid", "nodev"},
+		},
+		{
+			name:       "hardening options not repeated",
+			options:    []string{"nodev", "noexec"},
+			expOptions: []string{"nodev", "noexec", "nosuid"},
+		},
+		{
+			name:    "exec conflicts",
+			options: []string{"discard", "exec"},
+			expErr:  true,
+		},
+		{
+			name:    "suid conflicts",
+			options: []string{"suid"},
+			expErr:  true,
+		},
+		{
+			name:    "dev conflicts",
+			options: []string{"dev"},
+			expErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		options, err := hardenMountOptions(tc.options)
+		if tc.expErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got options %v", tc.name, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, tc.expOptions) {
+			t.Errorf("%s: got options %v, expected %v", tc.name, options, tc.expOptions)
+		}
+	}
+}
+
+func TestApplyDiscardPolicy(t *testing.T) {
+	testCases := []struct {
+		name          string
+		options       []string
+		volumeContext map[string]string
+		expOptions    []string
+		expErr        bool
+	}{
+		{
+			name:       "no policy",
+			options:    []string{"discard"},
+			expOptions: []string{"discard"},
+		},
+		{
+			name:          "discard added",
+			options:       []string{"noatime"},
+			volumeContext: map[string]string{common.VolumeAttributeDiscard: "true"},
+			expOptions:    []string{"noatime", "discard"},
+		},
+		{
+			name:          "discard not repeated",
+			options:       []string{"discard"},
+			volumeContext: map[string]string{common.VolumeAttributeDiscard: "true"},
+			expOptions:    []string{"discard"},
+		},
+		{
+			name:          "discard disabled",
+			options:       []string{"noatime"},
+			volumeContext: map[string]string{common.VolumeAttributeDiscard: "false"},
+			expOptions:    []string{"noatime"},
+		},
+		{
+			name:          "discard conflicts with disabled policy",
+			options:       []string{"discard"},
+			volumeContext: map[string]string{common.VolumeAttributeDiscard: "false"},
+			expErr:        true,
+		},
+		{
+			name:          "nodiscard conflicts with enabled policy",
+			options:       []string{"nodiscard"},
+			volumeContext: map[string]string{common.VolumeAttributeDiscard: "true"},
+			expErr:        true,
+		},
+		{
+			name:          "invalid policy",
+			volumeContext: map[string]string{common.VolumeAttributeDiscard: "maybe"},
+			expErr:        true,
+		},
+	}
+	for _, tc := range testCases {
+		options, err := applyDiscardPolicy(tc.options, tc.volumeContext)
+		if tc.expErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got options %v", tc.name, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, tc.expOptions) {
+			t.Errorf("%s: got options %v, expected %v", tc.name, options, tc.expOptions)
+		}
+	}
+}
+
+func TestParseProcFilesystems(t *testing.T) {
+	data := "nodev\tsysfs\nnodev\ttmpfs\n\text3\n\text2\n\text4\n\tsquashfs\n\tvfat\nnodev\tfuse\n"
+	filesystems := parseProcFilesystems([]byte(data))
+	expFilesystems := sets.NewString("ext2", "ext3", "ext4", "squashfs", "vfat")
+	if !filesystems.Equal(expFilesystems) {
+		t.Errorf("got filesystems %v, expected %v", filesystems.List(), expFilesystems.List())
+	}
+	if value := filesystemTopologyValue(filesystems); value != "ext2.ext3.ext4" {
+		t.Errorf("got topology value %q, expected %q", value, "ext2.ext3.ext4")
+	}
+}
+
+func TestValidateFilesystemTopology(t *testing.T) {
+	fsCap := func(fsType string) []*csi.VolumeCapability {
+		vc := createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+		vc.GetMount().FsType = fsType
+		return []*csi.VolumeCapability{vc}
+	}
+	segment := func(filesystems ...string) *csi.Topology {
+		segments := map[string]string{common.TopologyKeyZone: zone}
+		if len(filesystems) > 0 {
+			segments[common.TopologyKeyFilesystems] = strings.Join(filesystems, ".")
+		}
+		return &csi.Topology{Segments: segments}
+	}
+	testCases := []struct {
+		name   string
+		vcs    []*csi.VolumeCapability
+		top    *csi.TopologyRequirement
+		expErr bool
+	}{
+		{
+			name: "no topology",
+			vcs:  fsCap("xfs"),
+		},
+		{
+			name: "no filesystem requested",
+			vcs:  fsCap(""),
+			top:  &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4")}},
+		},
+		{
+			name: "block volume",
+			vcs:  createBlockVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			top:  &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4")}},
+		},
+		{
+			name: "supported by a requisite node",
+			vcs:  fsCap("XFS"),
+			top:  &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4"), segment("ext4", "xfs")}},
+		},
+		{
+			name: "supported by a preferred node",
+			vcs:  fsCap("xfs"),
+			top:  &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4")}, Preferred: []*csi.Topology{segment("xfs")}},
+		},
+		{
+			name: "node does not report filesystems",
+			vcs:  fsCap("btrfs"),
+			top:  &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4"), segment()}},
+		},
+		{
+			name: "node filesystems unknown",
+			vcs:  fsCap("btrfs"),
+			top:  &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4"), segment(common.TopologyFilesystemsUnknown)}},
+		},
+		{
+			name:   "node supports no reportable filesystem",
+			vcs:    fsCap("ext4"),
+			top:    &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("")}},
+			expErr: true,
+		},
+		{
+			name:   "not supported",
+			vcs:    fsCap("btrfs"),
+			top:    &csi.TopologyRequirement{Requisite: []*csi.Topology{segment("ext4"), segment("ext4", "xfs")}},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		err := validateFilesystemTopology(tc.vcs, tc.top)
+		if tc.expErr && err == nil {
+			t.Errorf("%s: expected error, got none", tc.name)
+		}
+		if !tc.expErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestTranslateTopology(t *testing.T) {
+	aliases := common.TopologyAliases{
+		ZoneKeys: []string{"example.com/zone"},
+		Zones:    map[string]string{"dc1-a": "us-central1-a", "dc1-b": "us-central1-b"},
+	}
+	req := func(segments ...map[string]string) *csi.TopologyRequirement {
+		top := &csi.TopologyRequirement{}
+		for _, s := range segments {
+			top.Requisite = append(top.Requisite, &csi.Topology{Segments: s})
+			top.Preferred = append(top.Preferred, &csi.Topology{Segments: s})
+		}
+		return top
+	}
+	testCases := []struct {
+		name    string
+		top     *csi.TopologyRequirement
+		aliases common.TopologyAliases
+		expTop  *csi.TopologyRequirement
+		expErr  bool
+	}{
+		{
+			name:    "no topology",
+			aliases: aliases,
+		},
+		{
+			name:   "no aliases",
+			top:    req(map[string]string{"example.com/zone": "dc1-a"}),
+			expTop: req(map[string]string{"example.com/zone": "dc1-a"}),
+		},
+		{
+			name:    "custom key and alias",
+			top:     req(map[string]string{"example.com/zone": "dc1-a", "example.com/rack": "r1"}),
+			aliases: aliases,
+			expTop:  req(map[string]string{common.TopologyKeyZone: "us-central1-a", "example.com/rack": "r1"}),
+		},
+		{
+			name:    "custom key without alias",
+			top:     req(map[string]string{"example.com/zone": "us-central1-c"}),
+			aliases: aliases,
+			expTop:  req(map[string]string{common.TopologyKeyZone: "us-central1-c"}),
+		},
+		{
+			name:    "alias under standard key",
+			top:     req(map[string]string{common.TopologyKeyZone: "dc1-b"}),
+			aliases: aliases,
+			expTop:  req(map[string]string{common.TopologyKeyZone: "us-central1-b"}),
+		},
+		{
+			name:    "keys agree",
+			top:     req(map[string]string{common.TopologyKeyZone: "us-central1-a", "example.com/zone": "dc1-a"}),
+			aliases: aliases,
+			expTop:  req(map[string]string{common.TopologyKeyZone: "us-central1-a"}),
+		},
+		{
+			name:    "keys conflict",
+			top:     req(map[string]string{common.TopologyKeyZone: "us-central1-b", "example.com/zone": "dc1-a"}),
+			aliases: aliases,
+			expErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		var orig *csi.TopologyRequirement
+		if tc.top != nil {
+			orig = proto.Clone(tc.top).(*csi.TopologyRequirement)
+		}
+		top, err := translateTopology(tc.top, tc.aliases)
+		if tc.expErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tc.name, top)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !proto.Equal(top, tc.expTop) {
+			t.Errorf("%s: got %v, expected %v", tc.name, top, tc.expTop)
+		}
+		if tc.top != nil && !proto.Equal(tc.top, orig) {
+			t.Errorf("%s: request topology was modified to %v", tc.name, tc.top)
+		}
+	}
+}
+
+func TestCoalesceGRPC(t *testing.T) {
+	interceptor := coalesceGRPC(common.NewRequestCoalescer(time.Minute))
+	createInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+
+	var mux sync.Mutex
+	calls := map[string]int{}
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		name := req.(*csi.CreateVolumeRequest).GetName()
+		mux.Lock()
+		calls[name]++
+		mux.Unlock()
+		started <- struct{}{}
+		<-release
+		return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: name}}, nil
+	}
+
+	requests := []*csi.CreateVolumeRequest{
+		{Name: "vol-a", Parameters: map[string]string{"type": "pd-ssd", "labels": "a=b"}},
+		{Name: "vol-a", Parameters: map[string]string{"labels": "a=b", "type": "pd-ssd"}},
+		{Name: "vol-b"},
+	}
+	var wg sync.WaitGroup
+	responses := make([]interface{}, len(requests))
+	for i, req := range requests {
+		wg.Add(1)
+		go func(i int, req *csi.CreateVolumeRequest) {
+			defer wg.Done()
+			resp, err := interceptor(context.Background(), req, createInfo, handler)
+			if err != nil {
+				t.Errorf("request %d: unexpected error: %v", i, err)
+			}
+			responses[i] = resp
+		}(i, req)
+	}
+	// Wait until the two distinct requests are in the handler, then give the
+	// duplicate time to find the in-flight one before releasing them.
+	<-started
+	<-started
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls["vol-a"] != 1 || calls["vol-b"] != 1 {
+		t.Errorf("expected one call per distinct request, got %v", calls)
+	}
+	if responses[0] != responses[1] {
+		t.Errorf("expected identical requests to share a response, got %v and %v", responses[0], responses[1])
+	}
+}
+
+func TestCoalesceGRPCCancelledCaller(t *testing.T) {
+	interceptor := coalesceGRPC(common.NewRequestCoalescer(time.Minute))
+	createInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return &csi.CreateVolumeResponse{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	req := &csi.CreateVolumeRequest{Name: "vol-a"}
+
+	// The first caller, whose call the second shares, goes away.
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := interceptor(firstCtx, req, createInfo, handler)
+		firstErr <- err
+	}()
+	<-started
+	secondResp := make(chan error)
+	go func() {
+		_, err := interceptor(context.Background(), req, createInfo, handler)
+		secondResp <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-firstErr; status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected cancelled caller to get DeadlineExceeded, got %v", err)
+	}
+
+	close(release)
+	if err := <-secondResp; err != nil {
+		t.Errorf("expected waiting caller to get the shared result, got %v", err)
+	}
+}
+
+func TestRetryGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	policy := &common.RetryPolicy{
+		MaxAttempts:       3,
+		PerAttemptTimeout: 20 * time.Millisecond,
+		Backoff:           time.Millisecond,
+		RetryableCodes:    []codes.Code{codes.Unavailable, codes.DeadlineExceeded},
+	}
+	// errHang makes an attempt wait for its context to expire.
+	errHang := fmt.Errorf("hang")
+
+	testCases := []struct {
+		name        string
+		policy      *common.RetryPolicy
+		errs        []error
+		expAttempts int
+		expCode     codes.Code
+	}{
+		{
+			name:        "no policy",
+			errs:        []error{status.Error(codes.Unavailable, "")},
+			expAttempts: 1,
+			expCode:     codes.Unavailable,
+		},
+		{
+			name:        "success after retries",
+			policy:      policy,
+			errs:        []error{status.Error(codes.Unavailable, ""), status.Error(codes.Unavailable, ""), nil},
+			expAttempts: 3,
+			expCode:     codes.OK,
+		},
+		{
+			name:        "attempts exhausted",
+			policy:      policy,
+			errs:        []error{status.Error(codes.Unavailable, ""), status.Error(codes.Unavailable, ""), status.Error(codes.Unavailable, "")},
+			expAttempts: 3,
+			expCode:     codes.Unavailable,
+		},
+		{
+			name:        "code not retryable",
+			policy:      policy,
+			errs:        []error{status.Error(codes.Internal, ""), nil},
+			expAttempts: 1,
+			expCode:     codes.Internal,
+		},
+		{
+			name:        "attempt timeout is retried",
+			policy:      policy,
+			errs:        []error{errHang, status.Error(codes.Unavailable, ""), status.Error(codes.NotFound, "")},
+			expAttempts: 3,
+			expCode:     codes.NotFound,
+		},
+	}
+	for _, tc := range testCases {
+		attempts := 0
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			err := tc.errs[attempts]
+			attempts++
+			if err == errHang {
+				<-ctx.Done()
+				return nil, status.Error(codes.Internal, ctx.Err().Error())
+			}
+			return nil, err
+		}
+		interceptor := retryGRPC(func(string) *common.RetryPolicy { return tc.policy })
+		_, err := interceptor(context.Background(), nil, info, handler)
+		if attempts != tc.expAttempts {
+			t.Errorf("%s: got %d attempts, expected %d", tc.name, attempts, tc.expAttempts)
+		}
+		if code := status.Code(err); code != tc.expCode {
+			t.Errorf("%s: got code %v, expected %v: %v", tc.name, code, tc.expCode, err)
+		}
+	}
+}
+
+func TestLimitGRPC(t *testing.T) {
+	interceptor := limitGRPC(common.NewConcurrencyLimiter(common.ConcurrencyLimits{"CreateVolume": 1}))
+	createInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	deleteInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := interceptor(context.Background(), nil, createInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(started)
+			<-unblock
+			return nil, nil
+		})
+		done <- err
+	}()
+	<-started
+
+	if _, err := interceptor(context.Background(), nil, createInfo, ok); status.Code(err) != codes.Aborted {
+		t.Errorf("call beyond the limit got %v, expected code %v", err, codes.Aborted)
+	}
+	if _, err := interceptor(context.Background(), nil, deleteInfo, ok); err != nil {
+		t.Errorf("call to a method without a limit failed: %v", err)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Errorf("first call failed: %v", err)
+	}
+	if _, err := interceptor(context.Background(), nil, createInfo, ok); err != nil {
+		t.Errorf("call after the first one finished failed: %v", err)
+	}
+}
+
+func TestRetryPolicyFor(t *testing.T) {
+	driver := GetGCEDriver()
+	if policy := driver.retryPolicyFor("/csi.v1.Controller/CreateVolume"); policy != nil {
+		t.Errorf("expected no policy before any are set, got %+v", policy)
+	}
+	driver.SetRetryPolicies(map[string]common.RetryPolicy{
+		"Controller":   {MaxAttempts: 2},
+		"CreateVolume": {MaxAttempts: 5},
+	})
+	testCases := []struct {
+		method         string
+		expMaxAttempts int
+	}{
+		{method: "/csi.v1.Controller/CreateVolume", expMaxAttempts: 5},
+		{method: "/csi.v1.Controller/DeleteVolume", expMaxAttempts: 2},
+		{method: "/csi.v1.Node/NodeStageVolume"},
+		{method: "bogus"},
+	}
+	for _, tc := range testCases {
+		policy := driver.retryPolicyFor(tc.method)
+		maxAttempts := 0
+		if policy != nil {
+			maxAttempts = policy.MaxAttempts
+		}
+		if maxAttempts != tc.expMaxAttempts {
+			t.Errorf("%s: got max attempts %d, expected %d", tc.method, maxAttempts, tc.expMaxAttempts)
+		}
+	}
+}
+
+func TestPodUIDFromPublishRequest(t *testing.T) {
+	testCases := []struct {
+		name          string
+		targetPath    string
+		volumeContext map[string]string
+		expUID        string
+		expErr        bool
+	}{
+		{
+			name:       "filesystem volume",
+			targetPath: "/var/lib/kubelet/pods/0f7a-42/volumes/kubernetes.io~csi/pv-1/mount",
+			expUID:     "0f7a-42",
+		},
+		{
+			name:       "block volume",
+			targetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pv-1/0f7a-42",
+			expUID:     "0f7a-42",
+		},
+		{
+			name:          "pod info on mount",
+			targetPath:    "/mnt/target",
+			volumeContext: map[string]string{podUIDKey: "0f7a-42"},
+			expUID:        "0f7a-42",
+		},
+		{
+			name:       "not a pod path",
+			targetPath: "/mnt/target",
+			expErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		uid, err := podUIDFromPublishRequest(tc.targetPath, tc.volumeContext)
+		if gotErr := err != nil; gotErr != tc.expErr {
+			t.Errorf("%s: got error %v, expected error %v", tc.name, err, tc.expErr)
+			continue
+		}
+		if uid != tc.expUID {
+			t.Errorf("%s: got pod UID %q, expected %q", tc.name, uid, tc.expUID)
+		}
+	}
+}
+
+func TestPodCgroupIOLimits(t *testing.T) {
+	limits := common.IOLimits{ReadBytesPerSec: 1048576, WriteIOPS: 100}
+	testCases := []struct {
+		name     string
+		podDir   string
+		files    []string
+		expFiles map[string]string
+		expErr   bool
+	}{
+		{
+			name:     "cgroup v2 with systemd",
+			podDir:   "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0f7a_42.slice",
+			files:    []string{"io.max"},
+			expFiles: map[string]string{"io.max": "8:16 rbps=1048576 wiops=100"},
+		},
+		{
+			name:   "cgroup v1 with cgroupfs",
+			podDir: "blkio/kubepods/pod0f7a-42",
+			files: []string{
+				"blkio.throttle.read_bps_device",
+				"blkio.throttle.write_bps_device",
+				"blkio.throttle.read_iops_device",
+				"blkio.throttle.write_iops_device",
+			},
+			expFiles: map[string]string{
+				"blkio.throttle.read_bps_device":   "8:16 1048576",
+				"blkio.throttle.write_bps_device":  "",
+				"blkio.throttle.write_iops_device": "8:16 100",
+			},
+		},
+		{
+			name:   "no io controller",
+			podDir: "kubepods/besteffort/pod0f7a-42",
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		root, err := ioutil.TempDir("", "cgroup")
+		if err != nil {
+			t.Fatalf("Failed to set up temp dir: %v", err)
+		}
+		defer os.RemoveAll(root)
+		podDir := filepath.Join(root, tc.podDir)
+		if err := os.MkdirAll(podDir, 0755); err != nil {
+			t.Fatalf("Failed to create cgroup dir: %v", err)
+		}
+		for _, file := range tc.files {
+			if err := ioutil.WriteFile(filepath.Join(podDir, file), nil, 0644); err != nil {
+				t.Fatalf("Failed to create cgroup file: %v", err)
+			}
+		}
+
+		cgroupDir, err := findPodCgroup(root, "0f7a-42")
+		if err != nil {
+			t.Errorf("%s: findPodCgroup failed: %v", tc.name, err)
+			continue
+		}
+		if cgroupDir != podDir {
+			t.Errorf("%s: findPodCgroup found %s, expected %s", tc.name, cgroupDir, podDir)
+		}
+		err = writeCgroupIOLimits(cgroupDir, 8, 16, limits)
+		if gotErr := err != nil; gotErr != tc.expErr {
+			t.Errorf("%s: got error %v, expected error %v", tc.name, err, tc.expErr)
+			continue
+		}
+		for file, expContent := range tc.expFiles {
+			content, err := ioutil.ReadFile(filepath.Join(podDir, file))
+			if err != nil {
+				t.Errorf("%s: failed to read %s: %v", tc.name, file, err)
+			} else if string(content) != expContent {
+				t.Errorf("%s: %s = %q, expected %q", tc.name, file, content, expContent)
+			}
+		}
+	}
+
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if _, err := findPodCgroup(root, "0f7a-42"); err == nil {
+		t.Errorf("findPodCgroup found a cgroup for a pod without one")
+	}
+}
+
+func TestVerifyMountDevice(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Deep mount checks are not supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatalf("Failed to set up temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sameFs := filepath.Join(dir, "same")
+	if err := os.Mkdir(sameFs, 0750); err != nil {
+		t.Fatalf("Failed to create %s: %v", sameFs, err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	testCases := []struct {
+		name      string
+		deep      bool
+		path      string
+		source    string
+		expectErr bool
+	}{
+		{
+			name:   "same filesystem",
+			deep:   true,
+			path:   sameFs,
+			source: dir,
+		},
+		{
+			name:      "missing path",
+			deep:      true,
+			path:      missing,
+			source:    dir,
+			expectErr: true,
+		},
+		{
+			name:      "missing source",
+			deep:      true,
+			path:      sameFs,
+			source:    missing,
+			expectErr: true,
+		},
+		{
+			name:   "fast checks",
+			path:   missing,
+			source: dir,
+		},
+	}
+	for _, tc := range testCases {
+		ns := &GCENodeServer{deepMountChecks: tc.deep}
+		err := ns.verifyMountDevice(tc.path, tc.source)
+		if tc.expectErr && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
@@ -16,39 +16,59 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/mount-utils"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	mounter "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 )
 
+// The maximum length of a path with the \\?\ long path prefix.
+const maxTargetPathLength = 32767
+
+// normalizeTargetPath uses backslashes throughout, drops the long path
+// prefix, which mount.NormalizeWindowsPath would take for a path without a
+// drive, and adds the c: drive to rooted paths without one.
+func normalizeTargetPath(path string) string {
+	path = strings.ReplaceAll(path, "/", `\`)
+	path = strings.TrimPrefix(path, `\\?\`)
+	return filepath.Clean(mount.NormalizeWindowsPath(path))
+}
+
+// Windows paths are compared case insensitively.
+func comparablePath(path string) string {
+	return strings.ToLower(path)
+}
+
 func formatAndMount(source, target, fstype string, options []string, m *mount.SafeFormatAndMount) error {
 	if !strings.EqualFold(fstype, defaultWindowsFsType) {
 		return fmt.Errorf("GCE PD CSI driver can only supports %s file system, it does not support %s", defaultWindowsFsType, fstype)
 	}
-	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := m.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return fmt.Errorf("could not cast to csi proxy class")
+		return fmt.Errorf("could not cast to windows mounter")
 	}
-	return proxy.FormatAndMount(source, target, fstype, options)
+	return windowsMounter.FormatAndMount(source, target, fstype, options)
 }
 
 // Before mounting (which means creating symlink) in Windows, the targetPath should
 // not exist. Currently kubelet creates the path beforehand, this is a workaround to
 // remove the path first.
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
-	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := m.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return fmt.Errorf("could not cast to csi proxy class")
+		return fmt.Errorf("could not cast to windows mounter")
 	}
-	exists, err := proxy.ExistsPath(path)
+	exists, err := windowsMounter.ExistsPath(path)
 	if err != nil {
 		return err
 	}
 	if exists {
-		return proxy.RemovePodDir(path)
+		return windowsMounter.RemovePodDir(path)
 	}
 	return nil
 }
@@ -60,19 +80,19 @@ func prepareStagePath(path string, m *mount.SafeFormatAndMount) error {
 }
 
 func cleanupPublishPath(path string, m *mount.SafeFormatAndMount) error {
-	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := m.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return fmt.Errorf("could not cast to csi proxy class")
+		return fmt.Errorf("could not cast to windows mounter")
 	}
-	return proxy.RemovePodDir(path)
+	return windowsMounter.RemovePodDir(path)
 }
 
 func cleanupStagePath(path string, m *mount.SafeFormatAndMount) error {
-	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := m.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return fmt.Errorf("could not cast to csi proxy class")
+		return fmt.Errorf("could not cast to windows mounter")
 	}
-	return proxy.UnmountDevice(path)
+	return windowsMounter.UnmountDevice(path)
 }
 
 // search Windows disk number by volumeID
@@ -85,18 +105,69 @@ func getDevicePath(ns *GCENodeServer, volumeID, partition string) (string, error
 	if err != nil {
 		return "", fmt.Errorf("error getting device name: %v", err)
 	}
-	proxy, ok := ns.Mounter.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := ns.Mounter.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return "", fmt.Errorf("could not cast to csi proxy class")
+		return "", fmt.Errorf("could not cast to windows mounter")
 	}
-	return proxy.GetDevicePath(deviceName, partition, volumeKey.Name)
+	return windowsMounter.GetDevicePath(deviceName, partition, volumeKey.Name)
 }
 
 func getBlockSizeBytes(devicePath string, m *mount.SafeFormatAndMount) (int64, error) {
-	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := m.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return 0, fmt.Errorf("could not cast to csi proxy class")
+		return 0, fmt.Errorf("could not cast to windows mounter")
 	}
 
-	return proxy.GetBlockSizeBytes(devicePath)
+	return windowsMounter.GetBlockSizeBytes(devicePath)
+}
+
+// Block volumes on Windows are only identified by their volume capability.
+func isBlockDevice(path string) (bool, error) {
+	return false, nil
+}
+
+func rescanBlockDevice(devicePath string, m *mount.SafeFormatAndMount) error {
+	windowsMounter, ok := m.Interface.(mounter.WindowsMounter)
+	if !ok {
+		return fmt.Errorf("could not cast to windows mounter")
+	}
+	return windowsMounter.RescanDisks()
+}
+
+// Trimming is left to the periodic optimization Windows runs on its own.
+func trimFilesystem(path string, m *mount.SafeFormatAndMount) error {
+	return nil
+}
+
+// Windows flushes volumes when they are dismounted.
+func syncFilesystem(ctx context.Context, path string, freeze bool, m *mount.SafeFormatAndMount) error {
+	return nil
+}
+
+func flushDeviceBuffers(devicePath string, m *mount.SafeFormatAndMount) error {
+	return nil
+}
+
+func regenerateFilesystemUUID(devicePath string, m *mount.SafeFormatAndMount) error {
+	return nil
+}
+
+func filesystemUUID(devicePath string, m *mount.SafeFormatAndMount) (string, error) {
+	return "", nil
+}
+
+func supportedFilesystems() (sets.String, error) {
+	return sets.NewString(defaultWindowsFsType), nil
+}
+
+func deviceNumber(devicePath string) (uint32, uint32, error) {
+	return 0, 0, fmt.Errorf("IO limits are not supported on Windows")
+}
+
+func deviceHolders(devicePath string) ([]string, error) {
+	return nil, nil
+}
+
+func mountedDeviceNumber(path string) (uint32, uint32, error) {
+	return 0, 0, fmt.Errorf("deep mount checks are not supported on Windows")
 }
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// operationWatchdog tracks the node operations in flight. An operation that
+// runs beyond the hard limit, such as a mount hung on a dying device, cannot
+// be cancelled and holds its volume lock forever, so the watchdog logs it and
+// Probe reports the node plugin unhealthy until it finishes. The liveness
+// probe then restarts the plugin.
+type operationWatchdog struct {
+	limit time.Duration
+
+	mux    sync.Mutex
+	nextID int
+	ops    map[int]*trackedOperation
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type trackedOperation struct {
+	method   string
+	volumeID string
+	start    time.Time
+	timer    *time.Timer
+}
+
+func newOperationWatchdog(limit time.Duration) *operationWatchdog {
+	return &operationWatchdog{
+		limit: limit,
+		ops:   make(map[int]*trackedOperation),
+		now:   time.Now,
+	}
+}
+
+// track records the start of method on volumeID and returns a function that
+// records its end. A nil watchdog tracks nothing.
+func (w *operationWatchdog) track(method, volumeID string) func() {
+	if w == nil {
+		return func() {}
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	id := w.nextID
+	w.nextID++
+	op := &trackedOperation{method: method, volumeID: volumeID, start: w.now()}
+	op.timer = time.AfterFunc(w.limit, func() {
+		klog.Errorf("%s of volume %s has been running for more than %v and is likely hung; the node plugin reports itself unhealthy until it returns", method, volumeID, w.limit)
+	})
+	w.ops[id] = op
+	return func() {
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		op.timer.Stop()
+		delete(w.ops, id)
+	}
+}
+
+// stuckOperations describes the operations that have run beyond the limit,
+// oldest first.
+func (w *operationWatchdog) stuckOperations() []string {
+	if w == nil {
+		return nil
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	now := w.now()
+	var stuck []*trackedOperation
+	for _, op := range w.ops {
+		if now.Sub(op.start) > w.limit {
+			stuck = append(stuck, op)
+		}
+	}
+	sort.Slice(stuck, func(i, j int) bool { return stuck[i].start.Before(stuck[j].start) })
+	descriptions := make([]string, 0, len(stuck))
+	for _, op := range stuck {
+		descriptions = append(descriptions, fmt.Sprintf("%s of volume %s for %v", op.method, op.volumeID, now.Sub(op.start).Round(time.Second)))
+	}
+	return descriptions
+}
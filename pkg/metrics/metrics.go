@@ -17,10 +17,19 @@ limitations under the License.
 package metrics
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/component-base/metrics"
 	"k8s.io/klog"
 )
@@ -29,23 +38,129 @@ const (
 	// envGKEPDCSIVersion is an environment variable set in the PDCSI controller manifest
 	// with the current version of the GKE component.
 	envGKEPDCSIVersion = "GKE_PDCSI_VERSION"
+
+	// Operations recorded by the attach/detach failure metric.
+	OperationAttach = "attach"
+	OperationDetach = "detach"
+
+	// Operations recorded by the node operation duration metric.
+	NodeOperationStage     = "stage"
+	NodeOperationUnstage   = "unstage"
+	NodeOperationPublish   = "publish"
+	NodeOperationUnpublish = "unpublish"
+
+	// Operations recorded by the node filesystem duration metric.
+	FilesystemOperationFormat = "format"
+	FilesystemOperationCheck  = "fsck"
+
+	// Reasons that attach/detach failures are bucketed into, separating
+	// user misconfiguration from GCE and driver problems.
+	reasonInvalidArgument = "invalid_argument"
+	reasonQuota           = "quota"
+	reasonRateLimit       = "rate_limit"
+	reasonNotFound        = "not_found"
+	reasonConflict        = "conflict"
+	reasonGCEError        = "gce_error"
+	reasonInternal        = "internal"
 )
 
 var (
+	// This metric is exposed from every driver component.
+	buildInfo = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Name: "csi_driver_build_info",
+		Help: "Metric with a constant value of 1 labeled by the driver version, git commit, Go version and the compute API versions in use.",
+	}, []string{"version", "git_commit", "go_version", "compute_api_versions"})
+
 	// This metric is exposed only from the controller driver component when GKE_PDCSI_VERSION env variable is set.
 	gkeComponentVersion = metrics.NewGaugeVec(&metrics.GaugeOpts{
 		Name: "component_version",
 		Help: "Metric to expose the version of the PDCSI GKE component.",
 	}, []string{"component_version"})
+
+	// This metric is exposed only from the controller driver component.
+	attachDetachFailures = metrics.NewCounterVec(&metrics.CounterOpts{
+		Name: "attach_detach_failures_total",
+		Help: "Number of failed ControllerPublishVolume and ControllerUnpublishVolume calls by operation and failure reason.",
+	}, []string{"operation", "reason"})
+
+	// These metrics are exposed only from the controller driver component.
+	computeAPIRequests = metrics.NewCounterVec(&metrics.CounterOpts{
+		Name: "compute_api_requests_total",
+		Help: "Number of requests sent to the compute API and the token endpoint by API version and HTTP status code.",
+	}, []string{"api_version", "code"})
+	computeAPIConnections = metrics.NewCounterVec(&metrics.CounterOpts{
+		Name: "compute_api_connections_total",
+		Help: "Number of connections used by compute API and token requests, by whether an idle connection was reused.",
+	}, []string{"reused"})
+	computeCallDuration = metrics.NewHistogramVec(&metrics.HistogramOpts{
+		Name:    "compute_call_duration_seconds",
+		Help:    "Seconds taken by each cloud provider call to the compute API, such as attachDisk, including waiting for its operation, by call.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation"})
+	computeCallErrors = metrics.NewCounterVec(&metrics.CounterOpts{
+		Name: "compute_call_errors_total",
+		Help: "Number of failed cloud provider calls to the compute API by call and googleapi error reason, or HTTP code if the error has no reason.",
+	}, []string{"operation", "reason"})
+	computeCallsInFlight = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Name: "compute_calls_in_flight",
+		Help: "Number of cloud provider calls to the compute API in progress by call.",
+	}, []string{"operation"})
+	computeOperationsInFlight = metrics.NewGauge(&metrics.GaugeOpts{
+		Name: "compute_operations_in_flight",
+		Help: "Number of disk and snapshot mutations started by the driver whose compute operation has not yet completed.",
+	})
+	computeOperationsQueued = metrics.NewGauge(&metrics.GaugeOpts{
+		Name: "compute_operations_queued",
+		Help: "Number of disk and snapshot mutations waiting for the number of in-flight compute operations to drop below the configured maximum.",
+	})
+	computeOperationQueueWait = metrics.NewHistogram(&metrics.HistogramOpts{
+		Name:    "compute_operation_queue_wait_seconds",
+		Help:    "Seconds disk and snapshot mutations waited before starting because of the maximum number of in-flight compute operations.",
+		Buckets: []float64{0.01, 0.1, 1, 5, 15, 30, 60, 120, 300},
+	})
+
+	// These metrics are exposed only from the controller driver component.
+	snapshotUploadsInProgress = metrics.NewGauge(&metrics.GaugeOpts{
+		Name: "snapshot_uploads_in_progress",
+		Help: "Number of snapshots seen by CreateSnapshot or ListSnapshots that are not yet ready to use.",
+	})
+	snapshotUploadAge = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Name: "snapshot_upload_age_seconds",
+		Help: "Seconds since the creation of each snapshot that is not yet ready to use, as of the last time it was seen.",
+	}, []string{"snapshot"})
+	snapshotDeletesQueued = metrics.NewGauge(&metrics.GaugeOpts{
+		Name: "snapshot_deletes_queued",
+		Help: "Number of DeleteSnapshot calls waiting for the snapshot delete rate limit.",
+	})
+
+	// These metrics are exposed only from the node driver component.
+	nodeOperationDuration = metrics.NewHistogramVec(&metrics.HistogramOpts{
+		Name:    "node_operation_duration_seconds",
+		Help:    "Seconds taken by NodeStageVolume, NodeUnstageVolume, NodePublishVolume and NodeUnpublishVolume calls, failed or not, by operation, filesystem type and disk type. Staging includes waiting for the attached disk to appear on the node.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation", "fs_type", "disk_type"})
+	nodeFilesystemDuration = metrics.NewHistogramVec(&metrics.HistogramOpts{
+		Name:    "node_filesystem_operation_duration_seconds",
+		Help:    "Seconds taken by the mkfs and fsck runs of NodeStageVolume, by operation, filesystem type and disk type.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation", "fs_type", "disk_type"})
+
+	// This metric is exposed only from the controller driver component.
+	orphanedAttachments = metrics.NewGauge(&metrics.GaugeOpts{
+		Name: "orphaned_attachments",
+		Help: "Number of attachments of disks backing the driver's PVs to instances that no VolumeAttachment attaches them to, as of the last check.",
+	})
 )
 
 type metricsManager struct {
 	registry metrics.KubeRegistry
+	mux      *http.ServeMux
 }
 
 func NewMetricsManager() metricsManager {
 	mm := metricsManager{
 		registry: metrics.NewKubeRegistry(),
+		mux:      http.NewServeMux(),
 	}
 	return mm
 }
@@ -79,6 +194,179 @@ func (mm *metricsManager) EmitGKEComponentVersion() error {
 	return nil
 }
 
+// EmitBuildInfo registers and records the build info metric.
+func (mm *metricsManager) EmitBuildInfo(version, gitCommit string, computeAPIVersions []string) {
+	mm.registry.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(version, gitCommit, runtime.Version(), strings.Join(computeAPIVersions, ",")).Set(1.0)
+}
+
+// RegisterAttachDetachMetrics registers the attach/detach failure counters.
+func (mm *metricsManager) RegisterAttachDetachMetrics() {
+	mm.registry.MustRegister(attachDetachFailures)
+}
+
+// RegisterComputeAPIMetrics registers the compute API request and connection
+// counters.
+func (mm *metricsManager) RegisterComputeAPIMetrics() {
+	mm.registry.MustRegister(computeAPIRequests, computeAPIConnections, computeOperationsInFlight, computeOperationsQueued, computeOperationQueueWait,
+		computeCallDuration, computeCallErrors, computeCallsInFlight)
+}
+
+// RegisterSnapshotMetrics registers the snapshot upload and delete queue
+// gauges.
+func (mm *metricsManager) RegisterSnapshotMetrics() {
+	mm.registry.MustRegister(snapshotUploadsInProgress, snapshotUploadAge, snapshotDeletesQueued)
+}
+
+// RegisterOrphanedAttachmentMetrics registers the orphaned attachment gauge.
+func (mm *metricsManager) RegisterOrphanedAttachmentMetrics() {
+	mm.registry.MustRegister(orphanedAttachments)
+}
+
+// RegisterNodeOperationMetrics registers the node operation and filesystem
+// duration histograms.
+func (mm *metricsManager) RegisterNodeOperationMetrics() {
+	mm.registry.MustRegister(nodeOperationDuration, nodeFilesystemDuration)
+}
+
+// RegisterProcessMetrics registers the standard Go runtime and process
+// collectors, such as go_goroutines and process_open_fds, which indicate
+// goroutine and file descriptor leaks in the driver.
+func (mm *metricsManager) RegisterProcessMetrics() {
+	mm.registry.RawMustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// RecordAttachDetachFailure counts a failed attach or detach, bucketed by the
+// googleapi error err wraps, or by its gRPC code if it wraps none. It is a no-op until the metrics are registered.
+func RecordAttachDetachFailure(operation string, err error) {
+	attachDetachFailures.WithLabelValues(operation, failureReason(err)).Inc()
+}
+
+// RecordComputeAPIRequest counts a request sent to the compute API. It is a
+// no-op until the metrics are registered.
+func RecordComputeAPIRequest(apiVersion, code string) {
+	computeAPIRequests.WithLabelValues(apiVersion, code).Inc()
+}
+
+// RecordComputeAPIConnection counts a connection used by a compute API
+// request. It is a no-op until the metrics are registered.
+func RecordComputeAPIConnection(reused bool) {
+	computeAPIConnections.WithLabelValues(strconv.FormatBool(reused)).Inc()
+}
+
+// RecordComputeCallStarted counts a cloud provider call in progress. It is a
+// no-op until the metrics are registered.
+func RecordComputeCallStarted(operation string) {
+	computeCallsInFlight.WithLabelValues(operation).Inc()
+}
+
+// RecordComputeCallFinished records the duration of a cloud provider call,
+// and counts it as failed with reason if reason is not empty. It is a no-op
+// until the metrics are registered.
+func RecordComputeCallFinished(operation string, duration time.Duration, reason string) {
+	computeCallsInFlight.WithLabelValues(operation).Dec()
+	computeCallDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if reason != "" {
+		computeCallErrors.WithLabelValues(operation, reason).Inc()
+	}
+}
+
+// RecordComputeOperationQueued adds delta to the number of mutations waiting
+// for an operation slot. It is a no-op until the metrics are registered.
+func RecordComputeOperationQueued(delta int) {
+	computeOperationsQueued.Add(float64(delta))
+}
+
+// RecordComputeOperationStarted counts a mutation that started after waiting
+// for an operation slot. It is a no-op until the metrics are registered.
+func RecordComputeOperationStarted(wait time.Duration) {
+	computeOperationQueueWait.Observe(wait.Seconds())
+	computeOperationsInFlight.Inc()
+}
+
+// RecordComputeOperationFinished counts a mutation whose operation completed.
+// It is a no-op until the metrics are registered.
+func RecordComputeOperationFinished() {
+	computeOperationsInFlight.Dec()
+}
+
+// RecordSnapshotUploads sets the snapshot upload gauges to the age of each
+// snapshot in uploads, keyed by snapshot ID. Snapshots missing from uploads
+// are no longer reported. It is a no-op until the metrics are registered.
+func RecordSnapshotUploads(uploads map[string]time.Duration) {
+	snapshotUploadAge.Reset()
+	for snapshot, age := range uploads {
+		snapshotUploadAge.WithLabelValues(snapshot).Set(age.Seconds())
+	}
+	snapshotUploadsInProgress.Set(float64(len(uploads)))
+}
+
+// RecordSnapshotDeletesQueued sets the number of snapshot deletes waiting
+// for the rate limit. It is a no-op until the metrics are registered.
+func RecordSnapshotDeletesQueued(count int) {
+	snapshotDeletesQueued.Set(float64(count))
+}
+
+// RecordOrphanedAttachments sets the orphaned attachment gauge. It is a no-op
+// until the metric is registered.
+func RecordOrphanedAttachments(count int) {
+	orphanedAttachments.Set(float64(count))
+}
+
+// RecordNodeOperation records the duration of a node operation on a volume
+// with fsType and diskType. It is a no-op until the metrics are registered.
+func RecordNodeOperation(operation, fsType, diskType string, duration time.Duration) {
+	nodeOperationDuration.WithLabelValues(operation, fsType, diskType).Observe(duration.Seconds())
+}
+
+// RecordFilesystemOperation records the duration of a mkfs or fsck run on a
+// disk of diskType. It is a no-op until the metrics are registered.
+func RecordFilesystemOperation(operation, fsType, diskType string, duration time.Duration) {
+	nodeFilesystemDuration.WithLabelValues(operation, fsType, diskType).Observe(duration.Seconds())
+}
+
+func failureReason(err error) string {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return gceFailureReason(apiErr)
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return reasonInvalidArgument
+	case codes.ResourceExhausted:
+		return reasonQuota
+	case codes.NotFound:
+		return reasonNotFound
+	case codes.AlreadyExists, codes.Aborted, codes.FailedPrecondition:
+		return reasonConflict
+	default:
+		return reasonInternal
+	}
+}
+
+// gceFailureReason buckets a googleapi error by its error reasons and HTTP
+// code.
+func gceFailureReason(apiErr *googleapi.Error) string {
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return reasonRateLimit
+		case "quotaExceeded":
+			return reasonQuota
+		case "notFound":
+			return reasonNotFound
+		}
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests:
+		return reasonRateLimit
+	case http.StatusNotFound:
+		return reasonNotFound
+	default:
+		return reasonGCEError
+	}
+}
+
 // Server represents any type that could serve HTTP requests for the metrics
 // endpoint.
 type Server interface {
@@ -96,16 +384,21 @@ func (mm *metricsManager) registerToServer(s Server, metricsPath string) {
 
 // InitializeHttpHandler sets up a server and creates a handler for metrics.
 func (mm *metricsManager) InitializeHttpHandler(address, path string) {
-	mux := http.NewServeMux()
-	mm.registerToServer(mux, path)
+	mm.registerToServer(mm.mux, path)
 	go func() {
 		klog.Infof("Metric server listening at %q", address)
-		if err := http.ListenAndServe(address, mux); err != nil {
+		if err := http.ListenAndServe(address, mm.mux); err != nil {
 			klog.Fatalf("Failed to start metric server at specified address (%q) and path (%q): %s", address, path, err)
 		}
 	}()
 }
 
+// RegisterHandler serves handler at path on the metrics server, alongside the
+// metrics. It may be called after InitializeHttpHandler.
+func (mm *metricsManager) RegisterHandler(path string, handler http.Handler) {
+	mm.mux.Handle(path, handler)
+}
+
 func getEnvVar(envVarName string) string {
 	v, ok := os.LookupEnv(envVarName)
 	if !ok {
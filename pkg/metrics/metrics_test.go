@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFailureReason(t *testing.T) {
+	testCases := []struct {
+		name   string
+		err    error
+		expect string
+	}{
+		{
+			name:   "gRPC invalid argument",
+			err:    status.Error(codes.InvalidArgument, "bad"),
+			expect: reasonInvalidArgument,
+		},
+		{
+			name:   "gRPC conflict",
+			err:    status.Error(codes.Aborted, "busy"),
+			expect: reasonConflict,
+		},
+		{
+			name:   "gRPC internal",
+			err:    status.Error(codes.Internal, "boom"),
+			expect: reasonInternal,
+		},
+		{
+			name:   "wrapped quota exceeded",
+			err:    fmt.Errorf("attach: %w", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}),
+			expect: reasonQuota,
+		},
+		{
+			name:   "wrapped rate limit reason",
+			err:    fmt.Errorf("attach: %w", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}),
+			expect: reasonRateLimit,
+		},
+		{
+			name:   "wrapped too many requests",
+			err:    fmt.Errorf("attach: %w", &googleapi.Error{Code: http.StatusTooManyRequests}),
+			expect: reasonRateLimit,
+		},
+		{
+			name:   "wrapped not found",
+			err:    fmt.Errorf("attach: %w", &googleapi.Error{Code: http.StatusNotFound}),
+			expect: reasonNotFound,
+		},
+		{
+			name:   "wrapped other GCE error",
+			err:    fmt.Errorf("attach: %w", &googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "resourceInUseByAnotherResource"}}}),
+			expect: reasonGCEError,
+		},
+	}
+	for _, tc := range testCases {
+		if got := failureReason(tc.err); got != tc.expect {
+			t.Errorf("%s: got reason %q, expected %q", tc.name, got, tc.expect)
+		}
+	}
+}
@@ -36,6 +36,7 @@ const (
 	diskPartitionSuffix  = "-part"
 	diskSDPath           = "/dev/sd"
 	diskSDPattern        = "/dev/sd*"
+	diskNvmePath         = "/dev/nvme"
 	// How many times to retry for a consistent read of /proc/mounts.
 	maxListTries = 3
 	// Number of fields per line in /proc/mounts as per the fstab man page.
@@ -184,6 +185,12 @@ func (m *deviceUtils) VerifyDevicePath(devicePaths []string, deviceName string)
 		if innerErr != nil {
 			return false, fmt.Errorf("filepath.EvalSymlinks(%q) failed with %v", devicePath, innerErr)
 		}
+		// Disks attached over NVMe have no SCSI serial. Their by-id link is
+		// created by udev from the NVMe namespace identifier, which carries
+		// the device name, so a link to an NVMe device is trusted.
+		if strings.HasPrefix(devSDX, diskNvmePath) {
+			return true, nil
+		}
 		// Check to make sure device path maps to the correct disk
 		if strings.Contains(devSDX, diskSDPath) {
 			scsiSerial, innerErr := getScsiSerial(devSDX)
@@ -0,0 +1,277 @@
+// +build windows
+
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountmanager
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+)
+
+var _ WindowsMounter = &HostProcessMounter{}
+
+// HostProcessMounter manages disks and volumes with the storage cmdlets of
+// the node, for a node plugin that runs in a HostProcess container and so
+// has the node's filesystem and PowerShell at hand instead of csi-proxy.
+// The cmdlets are those csi-proxy runs on behalf of the plugin.
+type HostProcessMounter struct{}
+
+// NewHostProcessSafeMounter returns the mounter of a node plugin running in a
+// HostProcess container.
+func NewHostProcessSafeMounter() (*mount.SafeFormatAndMount, error) {
+	return &mount.SafeFormatAndMount{
+		Interface: &HostProcessMounter{},
+		Exec:      utilexec.New(),
+	}, nil
+}
+
+// runPowershell runs command with env added to its environment. Paths and IDs
+// are passed in the environment rather than in the command so that they need
+// no quoting.
+func runPowershell(command string, env ...string) ([]byte, error) {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", command)
+	cmd.Env = append(os.Environ(), env...)
+	klog.V(5).Infof("Running powershell command %q with %v", command, env)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("powershell command %q with %v failed: %v, output: %s", command, env, err, out)
+	}
+	return out, nil
+}
+
+// Mount just creates a soft link at target pointing to source.
+func (mounter *HostProcessMounter) Mount(source string, target string, fstype string, options []string) error {
+	return mounter.MountSensitive(source, target, fstype, options, nil /* sensitiveOptions */)
+}
+
+// MountSensitive is the same as Mount, the options are not used to create
+// the link.
+func (mounter *HostProcessMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(mount.NormalizeWindowsPath(source), mount.NormalizeWindowsPath(target))
+}
+
+// MountSensitiveWithoutSystemd is the same as MountSensitive for Windows
+func (mounter *HostProcessMounter) MountSensitiveWithoutSystemd(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return mounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+// RemovePodDir removes the link or directory at target. The volume a link
+// points to is left alone.
+func (mounter *HostProcessMounter) RemovePodDir(target string) error {
+	return os.RemoveAll(mount.NormalizeWindowsPath(target))
+}
+
+// UnmountDevice removes the access path at target of the volume mounted
+// there, deletes target and sets the disk of the volume offline.
+func (mounter *HostProcessMounter) UnmountDevice(target string) error {
+	target = mount.NormalizeWindowsPath(target)
+	if exists, err := mounter.ExistsPath(target); !exists {
+		return err
+	}
+	volumeID, err := getVolumeIDFromMount(target)
+	if err != nil {
+		return err
+	}
+	volumeEnv := "volumeid=" + volumeID
+	out, err := runPowershell(`(Get-Volume -UniqueId $Env:volumeid | Get-Partition).DiskNumber`, volumeEnv)
+	if err != nil {
+		return err
+	}
+	diskNumber := strings.TrimSpace(string(out))
+
+	_, err = runPowershell(`Get-Volume -UniqueId $Env:volumeid | Get-Partition | Remove-PartitionAccessPath -AccessPath $Env:mountpath`, volumeEnv, "mountpath="+target)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	// Set disk to offline mode to have a clean state
+	klog.V(4).Infof("get disk number %s from volume %s", diskNumber, volumeID)
+	_, err = runPowershell(`Set-Disk -Number $Env:disknumber -IsOffline $true`, "disknumber="+diskNumber)
+	return err
+}
+
+func (mounter *HostProcessMounter) Unmount(target string) error {
+	return mounter.RemovePodDir(target)
+}
+
+// GetDevicePath returns the number of the disk attached with deviceName. GCE
+// reports the device name of a disk as its serial number.
+func (mounter *HostProcessMounter) GetDevicePath(deviceName string, partition string, volumeKey string) (string, error) {
+	out, err := runPowershell(`ConvertTo-Json -InputObject @(Get-Disk | Select-Object Number, SerialNumber)`)
+	if err != nil {
+		return "", err
+	}
+	return parseDiskNumber(out, deviceName)
+}
+
+// FormatAndMount accepts the source disk number, target path to mount, the fstype to format with and options to be used.
+// After formatting, it will mount the disk to target path on the host. Only
+// NTFS is supported.
+func (mounter *HostProcessMounter) FormatAndMount(source string, target string, fstype string, options []string) error {
+	if err := validateHostProcessFsType(fstype); err != nil {
+		return err
+	}
+	diskEnv := "disknumber=" + source
+	// make sure disk is online. if disk is already online, this call should also succeed.
+	if _, err := runPowershell(`Set-Disk -Number $Env:disknumber -IsOffline $false`, diskEnv); err != nil {
+		return err
+	}
+	// Partition the disk with a single partition unless it already has one,
+	// as csi-proxy does.
+	_, err := runPowershell(`if ((Get-Disk -Number $Env:disknumber).PartitionStyle -eq 'RAW') { Initialize-Disk -Number $Env:disknumber -PartitionStyle GPT }
+if (-not (Get-Partition -DiskNumber $Env:disknumber | Where-Object Type -ne 'Reserved')) { New-Partition -DiskNumber $Env:disknumber -UseMaximumSize | Out-Null }`, diskEnv)
+	if err != nil {
+		return err
+	}
+
+	out, err := runPowershell(`ConvertTo-Json -InputObject @(Get-Partition -DiskNumber $Env:disknumber | Get-Volume | Select-Object -ExpandProperty UniqueId)`, diskEnv)
+	if err != nil {
+		return err
+	}
+	volumeIDs, err := parseVolumeIDs(out, source)
+	if err != nil {
+		return err
+	}
+	// TODO: consider partitions and choose the right partition.
+	if len(volumeIDs) == 0 {
+		return fmt.Errorf("disk %s does not have any volumes", source)
+	}
+	volumeEnv := "volumeid=" + volumeIDs[0]
+
+	out, err = runPowershell(`(Get-Volume -UniqueId $Env:volumeid).FileSystemType`, volumeEnv)
+	if err != nil {
+		return err
+	}
+	if fsType := strings.TrimSpace(string(out)); fsType == "" || fsType == "Unknown" {
+		if _, err := runPowershell(`Get-Volume -UniqueId $Env:volumeid | Format-Volume -FileSystem NTFS -Confirm:$false | Out-Null`, volumeEnv); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	_, err = runPowershell(`Get-Volume -UniqueId $Env:volumeid | Get-Partition | Add-PartitionAccessPath -AccessPath $Env:mountpath`, volumeEnv, "mountpath="+mount.NormalizeWindowsPath(target))
+	return err
+}
+
+func (mounter *HostProcessMounter) GetMountRefs(pathname string) ([]string, error) {
+	return []string{}, fmt.Errorf("GetMountRefs not implemented for HostProcessMounter")
+}
+
+// IsLikelyNotMountPoint returns false for the links of published volumes and
+// the access paths of staged ones, which are both reparse points.
+func (mounter *HostProcessMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	info, err := os.Lstat(mount.NormalizeWindowsPath(file))
+	if err != nil {
+		return true, err
+	}
+	return info.Mode()&(os.ModeSymlink|os.ModeIrregular) == 0, nil
+}
+
+func (mounter *HostProcessMounter) List() ([]mount.MountPoint, error) {
+	return []mount.MountPoint{}, nil
+}
+
+func (mounter *HostProcessMounter) IsMountPointMatch(mp mount.MountPoint, dir string) bool {
+	return mp.Path == dir
+}
+
+// ExistsPath - Checks if a path exists. Unlike util ExistsPath, this call does not perform follow link.
+func (mounter *HostProcessMounter) ExistsPath(path string) (bool, error) {
+	_, err := os.Lstat(mount.NormalizeWindowsPath(path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mounter *HostProcessMounter) GetBlockSizeBytes(diskId string) (int64, error) {
+	out, err := runPowershell(`(Get-Disk -Number $Env:disknumber).Size`, "disknumber="+diskId)
+	if err != nil {
+		return 0, err
+	}
+	return parseDiskSize(out, diskId)
+}
+
+// RescanDisks makes Windows pick up changes to the attached disks, such as a
+// new size after an expansion.
+func (mounter *HostProcessMounter) RescanDisks() error {
+	_, err := runPowershell(`Update-HostStorageCache`)
+	return err
+}
+
+func (mounter *HostProcessMounter) GetVolumeStats(path string) (int64, int64, error) {
+	volumeID, err := getVolumeIDFromMount(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	out, err := runPowershell(`Get-Volume -UniqueId $Env:volumeid | Select-Object Size, SizeRemaining | ConvertTo-Json`, "volumeid="+volumeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseVolumeStats(out, volumeID)
+}
+
+// ResizeVolume grows the partition of the volume mounted at path to the
+// largest size its disk supports. A partition already at that size is left
+// alone, as Resize-Partition fails on it.
+func (mounter *HostProcessMounter) ResizeVolume(path string) error {
+	volumeID, err := getVolumeIDFromMount(path)
+	if err != nil {
+		return err
+	}
+	_, err = runPowershell(`$partition = Get-Volume -UniqueId $Env:volumeid | Get-Partition
+$sizeMax = ($partition | Get-PartitionSupportedSize).SizeMax
+if ($partition.Size -lt $sizeMax) { $partition | Resize-Partition -Size $sizeMax }`, "volumeid="+volumeID)
+	return err
+}
+
+// maxMountLinks bounds the links getVolumeIDFromMount follows, so that a
+// cycle of links cannot hang it.
+const maxMountLinks = 8
+
+// getVolumeIDFromMount returns the unique ID of the volume mounted at path,
+// following links, such as that of a published volume to its staging path,
+// to the access path of the volume as csi-proxy does.
+func getVolumeIDFromMount(path string) (string, error) {
+	path = mount.NormalizeWindowsPath(path)
+	for i := 0; i < maxMountLinks; i++ {
+		out, err := runPowershell(`(Get-Item -Path $Env:mountpath).Target`, "mountpath="+path)
+		if err != nil {
+			return "", err
+		}
+		volumeID, next, err := parseItemTarget(out, path)
+		if err != nil || volumeID != "" {
+			return volumeID, err
+		}
+		path = next
+	}
+	return "", fmt.Errorf("no volume found at %s after following %d links", path, maxMountLinks)
+}
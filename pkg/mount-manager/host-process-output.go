@@ -0,0 +1,105 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountmanager
+
+// Parsing of the PowerShell output read by the HostProcessMounter. It is
+// kept apart from the mounter so that it builds, and is tested, on every
+// platform.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hostProcessFsType is the only filesystem the HostProcessMounter formats
+// volumes with.
+const hostProcessFsType = "ntfs"
+
+// validateHostProcessFsType returns an error if volumes cannot be formatted
+// with fstype. An empty fstype is the default, NTFS.
+func validateHostProcessFsType(fstype string) error {
+	if fstype != "" && !strings.EqualFold(fstype, hostProcessFsType) {
+		return fmt.Errorf("filesystem %q is not supported, only NTFS is", fstype)
+	}
+	return nil
+}
+
+// parseDiskNumber returns the number of the disk with serial number
+// deviceName among the Number and SerialNumber of disks in JSON.
+func parseDiskNumber(out []byte, deviceName string) (string, error) {
+	var disks []struct {
+		Number       int64
+		SerialNumber string
+	}
+	if err := json.Unmarshal(out, &disks); err != nil {
+		return "", fmt.Errorf("failed to parse disks %s: %v", out, err)
+	}
+	for _, disk := range disks {
+		if strings.TrimSpace(disk.SerialNumber) == deviceName {
+			return strconv.FormatInt(disk.Number, 10), nil
+		}
+	}
+	return "", fmt.Errorf("could not find disk number for device %s", deviceName)
+}
+
+// parseVolumeIDs returns the unique IDs of the volumes of disk in JSON.
+func parseVolumeIDs(out []byte, disk string) ([]string, error) {
+	var volumeIDs []string
+	if err := json.Unmarshal(out, &volumeIDs); err != nil {
+		return nil, fmt.Errorf("failed to parse volumes %s of disk %s: %v", out, disk, err)
+	}
+	return volumeIDs, nil
+}
+
+// parseItemTarget parses the Target of the item at path. The target of an
+// access path is its volume, whose unique ID is returned; the target of a
+// link, such as a published volume linking to its staging path, is returned
+// as next, to be followed.
+func parseItemTarget(out []byte, path string) (volumeID, next string, err error) {
+	// Targets are listed one per line.
+	target := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0])
+	switch {
+	case target == "":
+		return "", "", fmt.Errorf("no volume is mounted at %s", path)
+	case strings.HasPrefix(target, "Volume"):
+		return `\\?\` + target, "", nil
+	default:
+		return "", target, nil
+	}
+}
+
+// parseVolumeStats returns the size and used bytes of a volume from its
+// Size and SizeRemaining in JSON.
+func parseVolumeStats(out []byte, volumeID string) (int64, int64, error) {
+	var stats struct {
+		Size          int64
+		SizeRemaining int64
+	}
+	if err := json.Unmarshal(out, &stats); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse stats %s of volume %s: %v", out, volumeID, err)
+	}
+	return stats.Size, stats.Size - stats.SizeRemaining, nil
+}
+
+// parseDiskSize parses the size in bytes of a disk.
+func parseDiskSize(out []byte, disk string) (int64, error) {
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size %s of disk %s: %v", out, disk, err)
+	}
+	return size, nil
+}
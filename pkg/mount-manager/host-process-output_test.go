@@ -0,0 +1,170 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountmanager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateHostProcessFsType(t *testing.T) {
+	testCases := []struct {
+		fstype      string
+		expectError bool
+	}{
+		{fstype: ""},
+		{fstype: "ntfs"},
+		{fstype: "NTFS"},
+		{fstype: "ext4", expectError: true},
+		{fstype: "refs", expectError: true},
+	}
+	for _, tc := range testCases {
+		err := validateHostProcessFsType(tc.fstype)
+		if tc.expectError != (err != nil) {
+			t.Errorf("%q: got error %v, expected error %t", tc.fstype, err, tc.expectError)
+		}
+	}
+}
+
+func TestParseDiskNumber(t *testing.T) {
+	testCases := []struct {
+		name        string
+		out         string
+		deviceName  string
+		expNumber   string
+		expectError bool
+	}{
+		{
+			name:       "found",
+			out:        `[{"Number":0,"SerialNumber":"boot"},{"Number":2,"SerialNumber":"pvc-1  "}]`,
+			deviceName: "pvc-1",
+			expNumber:  "2",
+		},
+		{
+			name:        "not found",
+			out:         `[{"Number":0,"SerialNumber":"boot"}]`,
+			deviceName:  "pvc-1",
+			expectError: true,
+		},
+		{
+			name:        "not JSON",
+			out:         "Get-Disk : access denied",
+			deviceName:  "pvc-1",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		number, err := parseDiskNumber([]byte(tc.out), tc.deviceName)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if number != tc.expNumber {
+			t.Errorf("%s: got disk number %s, expected %s", tc.name, number, tc.expNumber)
+		}
+	}
+}
+
+func TestParseVolumeIDs(t *testing.T) {
+	volumeIDs, err := parseVolumeIDs([]byte(`["\\\\?\\Volume{a}\\","\\\\?\\Volume{b}\\"]`), "2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{`\\?\Volume{a}\`, `\\?\Volume{b}\`}; !reflect.DeepEqual(volumeIDs, exp) {
+		t.Errorf("got volume IDs %v, expected %v", volumeIDs, exp)
+	}
+	if _, err := parseVolumeIDs([]byte(`\\?\Volume{a}\`), "2"); err == nil {
+		t.Errorf("expected error parsing a single unquoted volume, got none")
+	}
+}
+
+func TestParseItemTarget(t *testing.T) {
+	testCases := []struct {
+		name        string
+		out         string
+		expVolumeID string
+		expNext     string
+		expectError bool
+	}{
+		{
+			name:        "volume",
+			out:         "Volume{a}\\\r\n",
+			expVolumeID: `\\?\Volume{a}\`,
+		},
+		{
+			name:    "link",
+			out:     "c:\\var\\lib\\kubelet\\plugins\\globalmount\r\n",
+			expNext: `c:\var\lib\kubelet\plugins\globalmount`,
+		},
+		{
+			name:        "first of several targets",
+			out:         "Volume{a}\\\r\nVolume{b}\\\r\n",
+			expVolumeID: `\\?\Volume{a}\`,
+		},
+		{
+			name:        "nothing mounted",
+			out:         "\r\n",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		volumeID, next, err := parseItemTarget([]byte(tc.out), `c:\mnt`)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if volumeID != tc.expVolumeID || next != tc.expNext {
+			t.Errorf("%s: got volume ID %q and next %q, expected %q and %q", tc.name, volumeID, next, tc.expVolumeID, tc.expNext)
+		}
+	}
+}
+
+func TestParseVolumeStats(t *testing.T) {
+	size, used, err := parseVolumeStats([]byte(`{"Size":1000,"SizeRemaining":400}`), "v")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 1000 || used != 600 {
+		t.Errorf("got size %d and used %d, expected 1000 and 600", size, used)
+	}
+	if _, _, err := parseVolumeStats([]byte("Get-Volume : not found"), "v"); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
+
+func TestParseDiskSize(t *testing.T) {
+	size, err := parseDiskSize([]byte("10737418240\r\n"), "2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 10737418240 {
+		t.Errorf("got size %d, expected 10737418240", size)
+	}
+	if _, err := parseDiskSize([]byte(""), "2"); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package mountmanager
 
 import (
+	"fmt"
+
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 )
@@ -30,3 +32,9 @@ func NewSafeMounter() (*mount.SafeFormatAndMount, error) {
 	}, nil
 
 }
+
+// NewHostProcessSafeMounter fails, HostProcess containers only exist on
+// Windows.
+func NewHostProcessSafeMounter() (*mount.SafeFormatAndMount, error) {
+	return nil, fmt.Errorf("HostProcess containers are only supported on Windows")
+}
@@ -39,7 +39,26 @@ import (
 	utilexec "k8s.io/utils/exec"
 )
 
-var _ mount.Interface = &CSIProxyMounter{}
+// WindowsMounter is the mounter of the node plugin on Windows, which manages
+// disks and volumes either through csi-proxy or, in a HostProcess container,
+// directly on the node.
+type WindowsMounter interface {
+	mount.Interface
+	ExistsPath(path string) (bool, error)
+	RemovePodDir(target string) error
+	UnmountDevice(target string) error
+	GetDevicePath(deviceName string, partition string, volumeKey string) (string, error)
+	FormatAndMount(source string, target string, fstype string, options []string) error
+	GetBlockSizeBytes(diskId string) (int64, error)
+	RescanDisks() error
+	// GetVolumeStats returns the capacity and used bytes of the volume
+	// mounted at path.
+	GetVolumeStats(path string) (int64, int64, error)
+	// ResizeVolume grows the volume mounted at path to the size of its disk.
+	ResizeVolume(path string) error
+}
+
+var _ WindowsMounter = &CSIProxyMounter{}
 
 type CSIProxyMounter struct {
 	FsClient     *fsclient.Client
@@ -324,3 +343,45 @@ func (mounter *CSIProxyMounter) GetBlockSizeBytes(diskId string) (int64, error)
 		})
 	return DiskStatsResponse.DiskSize, err
 }
+
+// RescanDisks makes Windows pick up changes to the attached disks, such as a
+// new size after an expansion.
+func (mounter *CSIProxyMounter) RescanDisks() error {
+	_, err := mounter.DiskClient.Rescan(context.Background(), &diskapi.RescanRequest{})
+	return err
+}
+
+func (mounter *CSIProxyMounter) GetVolumeStats(path string) (int64, int64, error) {
+	volumeId, err := mounter.getVolumeIDFromMount(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	response, err := mounter.VolumeClient.VolumeStats(context.Background(), &volumeapi.VolumeStatsRequest{
+		VolumeId: volumeId,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return response.GetVolumeSize(), response.GetVolumeUsedSize(), nil
+}
+
+func (mounter *CSIProxyMounter) ResizeVolume(path string) error {
+	volumeId, err := mounter.getVolumeIDFromMount(path)
+	if err != nil {
+		return err
+	}
+	_, err = mounter.VolumeClient.ResizeVolume(context.Background(), &volumeapi.ResizeVolumeRequest{
+		VolumeId: volumeId,
+	})
+	return err
+}
+
+func (mounter *CSIProxyMounter) getVolumeIDFromMount(path string) (string, error) {
+	idResponse, err := mounter.VolumeClient.GetVolumeIDFromMount(context.Background(), &volumeapi.VolumeIDFromMountRequest{
+		Mount: path,
+	})
+	if err != nil {
+		return "", err
+	}
+	return idResponse.GetVolumeId(), nil
+}
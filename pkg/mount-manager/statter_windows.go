@@ -16,10 +16,8 @@ limitations under the License.
 package mountmanager
 
 import (
-	"context"
 	"fmt"
 
-	volumeapi "github.com/kubernetes-csi/csi-proxy/client/api/volume/v1beta1"
 	"k8s.io/mount-utils"
 )
 
@@ -42,29 +40,14 @@ func (r *realStatter) IsBlockDevice(fullPath string) (bool, error) {
 func (r *realStatter) StatFS(path string) (available, capacity, used, inodesFree, inodes, inodesUsed int64, err error) {
 	zero := int64(0)
 
-	proxy, ok := r.mounter.Interface.(*CSIProxyMounter)
+	windowsMounter, ok := r.mounter.Interface.(WindowsMounter)
 	if !ok {
-		return zero, zero, zero, zero, zero, zero, fmt.Errorf("could not cast to csi proxy class")
+		return zero, zero, zero, zero, zero, zero, fmt.Errorf("could not cast to windows mounter")
 	}
-
-	idRequest := &volumeapi.VolumeIDFromMountRequest{
-		Mount: path,
-	}
-	idResponse, err := proxy.VolumeClient.GetVolumeIDFromMount(context.Background(), idRequest)
-	if err != nil {
-		return zero, zero, zero, zero, zero, zero, err
-	}
-	volumeId := idResponse.GetVolumeId()
-
-	request := &volumeapi.VolumeStatsRequest{
-		VolumeId: volumeId,
-	}
-	response, err := proxy.VolumeClient.VolumeStats(context.Background(), request)
+	capacity, used, err = windowsMounter.GetVolumeStats(path)
 	if err != nil {
 		return zero, zero, zero, zero, zero, zero, err
 	}
-	capacity = response.GetVolumeSize()
-	used = response.GetVolumeUsedSize()
 	available = capacity - used
 	return available, capacity, used, zero, zero, zero, nil
 }
@@ -0,0 +1,240 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package regionalmigration converts the disk of a zonal PV into a regional
+// disk replicated to a second zone.
+package regionalmigration
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+const (
+	snapshotReadyPollInterval = 5 * time.Second
+	snapshotReadyTimeout      = time.Hour
+)
+
+// Options select the PV to migrate and how.
+type Options struct {
+	// PVName is the PV whose zonal disk is migrated.
+	PVName string
+	// ReplicaZone is the zone the regional disk is replicated to in addition
+	// to the zone of the zonal disk.
+	ReplicaZone string
+	// RegionalDiskName is the name of the regional disk. Empty uses the name
+	// of the zonal disk.
+	RegionalDiskName string
+	// SnapshotName is the name of the snapshot the regional disk is restored
+	// from. Empty uses the name of the zonal disk.
+	SnapshotName string
+	// KeepSnapshot keeps the snapshot once the regional disk is created.
+	KeepSnapshot bool
+}
+
+// Migrator converts the zonal disk of a PV provisioned by the driver into a
+// regional disk. The zonal disk is left in place so that the migration can be
+// rolled back; it must be deleted by hand once the new PV is in use.
+type Migrator struct {
+	client     kubernetes.Interface
+	cloud      gce.GCECompute
+	driverName string
+}
+
+func NewMigrator(client kubernetes.Interface, cloud gce.GCECompute, driverName string) *Migrator {
+	return &Migrator{
+		client:     client,
+		cloud:      cloud,
+		driverName: driverName,
+	}
+}
+
+// Migrate creates a regional disk from a snapshot of the disk of the PV and
+// returns a PV using the regional disk in place of the PV. The disk must not
+// be attached to any node.
+func (m *Migrator) Migrate(ctx context.Context, opts Options) (*v1.PersistentVolume, error) {
+	pv, err := m.client.CoreV1().PersistentVolumes().Get(ctx, opts.PVName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PV %s: %v", opts.PVName, err)
+	}
+	volKey, err := zonalVolumeKey(pv, m.driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := m.client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume attachments: %v", err)
+	}
+	for _, va := range attachments.Items {
+		if pvName := va.Spec.Source.PersistentVolumeName; pvName != nil && *pvName == pv.Name {
+			return nil, fmt.Errorf("PV %s is still attached to node %s, stop the pods using it first", pv.Name, va.Spec.NodeName)
+		}
+	}
+
+	regionalKey, err := migrateDisk(ctx, m.cloud, volKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	volumeID, err := common.KeyToVolumeID(regionalKey, m.cloud.GetDefaultProject())
+	if err != nil {
+		return nil, err
+	}
+	return regionalPV(pv, volumeID, []string{volKey.Zone, opts.ReplicaZone}), nil
+}
+
+// zonalVolumeKey returns the key of the zonal disk of pv, or an error if pv
+// is not a zonal volume of the driver.
+func zonalVolumeKey(pv *v1.PersistentVolume, driverName string) (*meta.Key, error) {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+		return nil, fmt.Errorf("PV %s is not a %s volume", pv.Name, driverName)
+	}
+	volKey, err := common.VolumeIDToKey(pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return nil, fmt.Errorf("PV %s has an invalid volume handle: %v", pv.Name, err)
+	}
+	if volKey.Type() != meta.Zonal {
+		return nil, fmt.Errorf("PV %s is not a zonal volume: %s", pv.Name, pv.Spec.CSI.VolumeHandle)
+	}
+	return volKey, nil
+}
+
+// migrateDisk creates a regional disk replicated to the zone of volKey and
+// opts.ReplicaZone from a snapshot of the zonal disk, and returns its key.
+func migrateDisk(ctx context.Context, cloud gce.GCECompute, volKey *meta.Key, opts Options) (*meta.Key, error) {
+	if opts.ReplicaZone == "" || opts.ReplicaZone == volKey.Zone {
+		return nil, fmt.Errorf("replica zone must be set and differ from the disk zone %s", volKey.Zone)
+	}
+	zones := []string{volKey.Zone, opts.ReplicaZone}
+	region, err := common.GetRegionFromZones(zones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get region from zones %v: %v", zones, err)
+	}
+
+	disk, err := cloud.GetDisk(ctx, volKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get disk %v: %v", volKey, err)
+	}
+	if users := disk.GetUsers(); len(users) > 0 {
+		return nil, fmt.Errorf("disk %v is still attached to %v", volKey, users)
+	}
+
+	snapshotName := opts.SnapshotName
+	if snapshotName == "" {
+		snapshotName = volKey.Name
+	}
+	klog.V(2).Infof("Creating snapshot %s of disk %v", snapshotName, volKey)
+	if _, err := cloud.CreateSnapshot(ctx, volKey, snapshotName, nil); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot %s of disk %v: %v", snapshotName, volKey, err)
+	}
+	var snapshotLink string
+	err = wait.PollImmediate(snapshotReadyPollInterval, snapshotReadyTimeout, func() (bool, error) {
+		snapshot, err := cloud.GetSnapshot(ctx, snapshotName)
+		if err != nil {
+			return false, err
+		}
+		switch snapshot.Status {
+		case "READY":
+			snapshotLink = snapshot.SelfLink
+			return true, nil
+		case "FAILED", "DELETING":
+			return false, fmt.Errorf("snapshot is %s", snapshot.Status)
+		default:
+			klog.V(4).Infof("Waiting for snapshot %s, currently %s", snapshotName, snapshot.Status)
+			return false, nil
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to wait for snapshot %s of disk %v: %v", snapshotName, volKey, err)
+	}
+
+	regionalName := opts.RegionalDiskName
+	if regionalName == "" {
+		regionalName = volKey.Name
+	}
+	regionalKey := meta.RegionalKey(regionalName, region)
+	params := common.DiskParameters{
+		DiskType:             disk.GetPDType(),
+		DiskEncryptionKMSKey: disk.GetKMSKeyName(),
+		Labels:               disk.GetLabels(),
+	}
+	klog.V(2).Infof("Creating regional disk %v in zones %v from snapshot %s", regionalKey, zones, snapshotName)
+	err = cloud.InsertDisk(ctx, regionalKey, params, common.GbToBytes(disk.GetSizeGb()), nil, zones, snapshotLink, "", false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create regional disk %v: %v", regionalKey, err)
+	}
+
+	if !opts.KeepSnapshot {
+		if err := cloud.DeleteSnapshot(ctx, snapshotName); err != nil {
+			klog.Warningf("Failed to delete snapshot %s, delete it by hand: %v", snapshotName, err)
+		}
+	}
+	return regionalKey, nil
+}
+
+// regionalPV returns a copy of pv that uses the disk of volumeID, available
+// in zones. The copy is ready to be created once pv and its claim are deleted;
+// its claim reference matches a claim recreated with the same name.
+func regionalPV(pv *v1.PersistentVolume, volumeID string, zones []string) *v1.PersistentVolume {
+	newPV := &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+	newPV.Spec.CSI.VolumeHandle = volumeID
+	newPV.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{
+					MatchExpressions: []v1.NodeSelectorRequirement{
+						{
+							Key:      common.TopologyKeyZone,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   zones,
+						},
+					},
+				},
+			},
+		},
+	}
+	if ref := newPV.Spec.ClaimRef; ref != nil {
+		newPV.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:       ref.Kind,
+			APIVersion: ref.APIVersion,
+			Namespace:  ref.Namespace,
+			Name:       ref.Name,
+		}
+	}
+	return newPV
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regionalmigration
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	computev1 "google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+const (
+	testDriverName = "pd.csi.storage.gke.io"
+	testProject    = "test-project"
+	testZone       = "us-central1-c"
+	testDiskName   = "pvc-test"
+)
+
+func TestZonalVolumeKey(t *testing.T) {
+	testCases := []struct {
+		name   string
+		csi    *v1.CSIPersistentVolumeSource
+		expKey *meta.Key
+	}{
+		{
+			name:   "zonal volume",
+			csi:    &v1.CSIPersistentVolumeSource{Driver: testDriverName, VolumeHandle: "projects/p/zones/us-central1-c/disks/d"},
+			expKey: meta.ZonalKey("d", "us-central1-c"),
+		},
+		{
+			name: "regional volume",
+			csi:  &v1.CSIPersistentVolumeSource{Driver: testDriverName, VolumeHandle: "projects/p/regions/us-central1/disks/d"},
+		},
+		{
+			name: "other driver",
+			csi:  &v1.CSIPersistentVolumeSource{Driver: "other.csi.driver", VolumeHandle: "projects/p/zones/us-central1-c/disks/d"},
+		},
+		{
+			name: "invalid volume handle",
+			csi:  &v1.CSIPersistentVolumeSource{Driver: testDriverName, VolumeHandle: "d"},
+		},
+		{
+			name: "not a CSI volume",
+		},
+	}
+	for _, tc := range testCases {
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{CSI: tc.csi},
+			},
+		}
+		key, err := zonalVolumeKey(pv, testDriverName)
+		if tc.expKey == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got key %v", tc.name, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(key, tc.expKey) {
+			t.Errorf("%s: expected key %v, got %v", tc.name, tc.expKey, key)
+		}
+	}
+}
+
+func TestMigrateDisk(t *testing.T) {
+	testCases := []struct {
+		name        string
+		users       []string
+		opts        Options
+		expSnapshot bool
+		expErr      bool
+	}{
+		{
+			name: "migrate",
+			opts: Options{ReplicaZone: "us-central1-b", RegionalDiskName: "pvc-test-regional"},
+		},
+		{
+			name:        "keep snapshot",
+			opts:        Options{ReplicaZone: "us-central1-b", RegionalDiskName: "pvc-test-regional", SnapshotName: "migration", KeepSnapshot: true},
+			expSnapshot: true,
+		},
+		{
+			name:   "attached disk",
+			users:  []string{"projects/test-project/zones/us-central1-c/instances/node"},
+			opts:   Options{ReplicaZone: "us-central1-b", RegionalDiskName: "pvc-test-regional"},
+			expErr: true,
+		},
+		{
+			name:   "no replica zone",
+			opts:   Options{RegionalDiskName: "pvc-test-regional"},
+			expErr: true,
+		},
+		{
+			name:   "replica zone in other region",
+			opts:   Options{ReplicaZone: "europe-west1-b", RegionalDiskName: "pvc-test-regional"},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		ctx := context.Background()
+		disk := gce.CloudDiskFromV1(&computev1.Disk{
+			Name:              testDiskName,
+			Zone:              testZone,
+			SizeGb:            200,
+			Type:              "projects/test-project/zones/us-central1-c/diskTypes/pd-ssd",
+			Labels:            map[string]string{"team": "storage"},
+			DiskEncryptionKey: &computev1.CustomerEncryptionKey{KmsKeyName: "key"},
+			Users:             tc.users,
+		})
+		cloud, err := gce.CreateFakeCloudProvider(testProject, testZone, []*gce.CloudDisk{disk})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		volKey := meta.ZonalKey(testDiskName, testZone)
+		regionalKey, err := migrateDisk(ctx, cloud, volKey, tc.opts)
+		if gotErr := err != nil; gotErr != tc.expErr {
+			t.Errorf("%s: migrateDisk() = %v; expected error: %v", tc.name, err, tc.expErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if expKey := meta.RegionalKey(tc.opts.RegionalDiskName, "us-central1"); !reflect.DeepEqual(regionalKey, expKey) {
+			t.Errorf("%s: expected regional key %v, got %v", tc.name, expKey, regionalKey)
+		}
+		regional, err := cloud.GetDisk(ctx, regionalKey, gce.GCEAPIVersionV1)
+		if err != nil {
+			t.Errorf("%s: failed to get regional disk: %v", tc.name, err)
+			continue
+		}
+		if regional.GetPDType() != "pd-ssd" || regional.GetSizeGb() != 200 || regional.GetKMSKeyName() != "key" || !reflect.DeepEqual(regional.GetLabels(), disk.GetLabels()) {
+			t.Errorf("%s: regional disk %+v does not match zonal disk", tc.name, regional)
+		}
+		snapshotName := tc.opts.SnapshotName
+		if snapshotName == "" {
+			snapshotName = testDiskName
+		}
+		_, err = cloud.GetSnapshot(ctx, snapshotName)
+		if gotSnapshot := err == nil; gotSnapshot != tc.expSnapshot {
+			t.Errorf("%s: expected snapshot %s to exist: %v, got %v", tc.name, snapshotName, tc.expSnapshot, err)
+		}
+		if _, err := cloud.GetDisk(ctx, volKey, gce.GCEAPIVersionV1); err != nil {
+			t.Errorf("%s: expected zonal disk to be kept, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestRegionalPV(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pvc-test",
+			UID:             "pv-uid",
+			ResourceVersion: "10",
+			Annotations:     map[string]string{"pv.kubernetes.io/provisioned-by": testDriverName},
+			Finalizers:      []string{"kubernetes.io/pv-protection"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       testDriverName,
+					VolumeHandle: "projects/test-project/zones/us-central1-c/disks/pvc-test",
+					FSType:       "ext4",
+				},
+			},
+			ClaimRef: &v1.ObjectReference{
+				Kind:            "PersistentVolumeClaim",
+				Namespace:       "default",
+				Name:            "data",
+				UID:             "pvc-uid",
+				ResourceVersion: "5",
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: common.TopologyKeyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"us-central1-c"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+	}
+	volumeID := "projects/test-project/regions/us-central1/disks/pvc-test"
+	zones := []string{"us-central1-c", "us-central1-b"}
+
+	got := regionalPV(pv, volumeID, zones)
+	if got.Spec.CSI.VolumeHandle != volumeID {
+		t.Errorf("expected volume handle %s, got %s", volumeID, got.Spec.CSI.VolumeHandle)
+	}
+	if pv.Spec.CSI.VolumeHandle == volumeID {
+		t.Errorf("original PV was modified")
+	}
+	expAffinity := []v1.NodeSelectorRequirement{
+		{Key: common.TopologyKeyZone, Operator: v1.NodeSelectorOpIn, Values: zones},
+	}
+	if terms := got.Spec.NodeAffinity.Required.NodeSelectorTerms; len(terms) != 1 || !reflect.DeepEqual(terms[0].MatchExpressions, expAffinity) {
+		t.Errorf("expected node affinity %v, got %v", expAffinity, terms)
+	}
+	expClaimRef := &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "data"}
+	if !reflect.DeepEqual(got.Spec.ClaimRef, expClaimRef) {
+		t.Errorf("expected claim ref %v, got %v", expClaimRef, got.Spec.ClaimRef)
+	}
+	if got.UID != "" || got.ResourceVersion != "" || got.Finalizers != nil || got.Status.Phase != "" {
+		t.Errorf("expected server set fields to be cleared, got %+v", got)
+	}
+	if !reflect.DeepEqual(got.Annotations, pv.Annotations) || got.Spec.CSI.FSType != "ext4" {
+		t.Errorf("expected annotations and volume source to be kept, got %+v", got)
+	}
+}
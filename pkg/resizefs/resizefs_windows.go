@@ -19,10 +19,8 @@ limitations under the License.
 package resizefs
 
 import (
-	"context"
 	"fmt"
 
-	volumeapi "github.com/kubernetes-csi/csi-proxy/client/api/volume/v1beta1"
 	"k8s.io/klog"
 	"k8s.io/mount-utils"
 	mounter "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
@@ -44,25 +42,11 @@ func NewResizeFs(mounter *mount.SafeFormatAndMount) *resizeFs {
 func (resizefs *resizeFs) Resize(devicePath string, deviceMountPath string) (bool, error) {
 	klog.V(3).Infof("resizeFS.Resize - Expanding mounted volume %s", deviceMountPath)
 
-	proxy, ok := resizefs.mounter.Interface.(*mounter.CSIProxyMounter)
+	windowsMounter, ok := resizefs.mounter.Interface.(mounter.WindowsMounter)
 	if !ok {
-		return false, fmt.Errorf("could not cast to csi proxy class")
+		return false, fmt.Errorf("could not cast to windows mounter")
 	}
-
-	idRequest := &volumeapi.VolumeIDFromMountRequest{
-		Mount: deviceMountPath,
-	}
-	idResponse, err := proxy.VolumeClient.GetVolumeIDFromMount(context.Background(), idRequest)
-	if err != nil {
-		return false, err
-	}
-	volumeId := idResponse.GetVolumeId()
-
-	request := &volumeapi.ResizeVolumeRequest{
-		VolumeId: volumeId,
-	}
-	_, err = proxy.VolumeClient.ResizeVolume(context.Background(), request)
-	if err != nil {
+	if err := windowsMounter.ResizeVolume(deviceMountPath); err != nil {
 		return false, err
 	}
 	return true, nil
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"google.golang.org/api/iterator"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	fieldmask "google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// keyStateTimeout bounds how long a key version state change may take
+	// to reach Compute Engine.
+	keyStateTimeout = 5 * time.Minute
+)
+
+var _ = Describe("GCE PD CSI Driver CMEK", func() {
+
+	It("Should fail attach with INTERNAL while the CMEK key is disabled and attach once it is re-enabled", func() {
+		ctx := context.Background()
+		Expect(testContexts).ToNot(BeEmpty())
+		testContext := getRandomTestContext()
+
+		p, z, _ := testContext.Instance.GetIdentity()
+		client := testContext.Client
+		nodeID := testContext.Instance.GetNodeID()
+
+		keyName, keyVersions := createCryptoKey(ctx, p)
+		defer destroyCryptoKeyVersions(ctx, keyVersions)
+
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID, err := client.CreateVolume(volName, map[string]string{
+			common.ParameterKeyDiskEncryptionKmsKey: keyName,
+		}, defaultSizeGb,
+			&csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: z},
+					},
+				},
+			})
+		Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+		defer deleteVolumeOrError(client, volID, p)
+
+		cloudDisk, err := computeService.Disks.Get(p, z, volName).Do()
+		Expect(err).To(BeNil(), "Could not get disk from cloud directly")
+		Expect(cloudDisk.DiskEncryptionKey).ToNot(BeNil())
+		Expect(cloudDisk.DiskEncryptionKey.KmsKeyName).To(HavePrefix(keyName))
+
+		// Disabling a key version is eventually consistent, so attaches may
+		// still succeed for a while. Detach those and try again.
+		setCryptoKeyVersionsState(ctx, keyVersions, kmspb.CryptoKeyVersion_DISABLED)
+		var publishErr error
+		err = wait.Poll(10*time.Second, keyStateTimeout, func() (bool, error) {
+			publishErr = client.ControllerPublishVolume(volID, nodeID)
+			if publishErr != nil {
+				return true, nil
+			}
+			klog.Infof("Disk %v attached with its CMEK key disabled, detaching and retrying", volName)
+			if err := client.ControllerUnpublishVolume(volID, nodeID); err != nil {
+				return false, err
+			}
+			return false, nil
+		})
+		Expect(err).To(BeNil(), "ControllerPublishVolume kept succeeding with the CMEK key disabled")
+		Expect(status.Code(publishErr)).To(Equal(codes.Internal), "Unexpected ControllerPublishVolume error: %v", publishErr)
+
+		// The failed attach must not have left the disk attached.
+		instance, err := computeService.Instances.Get(p, z, testContext.Instance.GetName()).Do()
+		Expect(err).To(BeNil(), "Failed to get instance %v", testContext.Instance.GetName())
+		for _, disk := range instance.Disks {
+			Expect(disk.Source).ToNot(HaveSuffix("/disks/"+volName), "Disk %v attached although ControllerPublishVolume failed", volName)
+		}
+
+		setCryptoKeyVersionsState(ctx, keyVersions, kmspb.CryptoKeyVersion_ENABLED)
+		err = wait.Poll(10*time.Second, keyStateTimeout, func() (bool, error) {
+			publishErr = client.ControllerPublishVolume(volID, nodeID)
+			if publishErr != nil {
+				klog.Infof("ControllerPublishVolume still failing after re-enabling the CMEK key: %v", publishErr)
+				return false, nil
+			}
+			return true, nil
+		})
+		Expect(err).To(BeNil(), "ControllerPublishVolume did not succeed after re-enabling the CMEK key: %v", publishErr)
+
+		err = client.ControllerUnpublishVolume(volID, nodeID)
+		Expect(err).To(BeNil(), "ControllerUnpublishVolume failed with error")
+	})
+})
+
+// createCryptoKey creates a symmetric key in the test key ring of project and
+// returns its name and the names of its versions.
+func createCryptoKey(ctx context.Context, project string) (string, []string) {
+	locationID := "global"
+
+	// The resource name of the key rings.
+	parentName := fmt.Sprintf("projects/%s/locations/%s", project, locationID)
+	keyRingId := "gce-pd-csi-test-ring"
+
+	// Create KeyRing
+	ringReq := &kmspb.CreateKeyRingRequest{
+		Parent:    parentName,
+		KeyRingId: keyRingId,
+	}
+	keyRing, err := kmsClient.CreateKeyRing(ctx, ringReq)
+	if !gce.IsGCEError(err, "alreadyExists") {
+		getKeyRingReq := &kmspb.GetKeyRingRequest{
+			Name: fmt.Sprintf("%s/keyRings/%s", parentName, keyRingId),
+		}
+		keyRing, err = kmsClient.GetKeyRing(ctx, getKeyRingReq)
+
+	}
+	Expect(err).To(BeNil(), "Failed to create or get key ring %v", keyRingId)
+
+	// Create CryptoKey in KeyRing
+	keyId := "test-key-" + string(uuid.NewUUID())
+	keyReq := &kmspb.CreateCryptoKeyRequest{
+		Parent:      keyRing.Name,
+		CryptoKeyId: keyId,
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{
+				Algorithm: kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION,
+			},
+		},
+	}
+	key, err := kmsClient.CreateCryptoKey(ctx, keyReq)
+	Expect(err).To(BeNil(), "Failed to create crypto key %v in key ring %v", keyId, keyRing.Name)
+
+	keyVersions := []string{}
+	keyVersionReq := &kmspb.ListCryptoKeyVersionsRequest{
+		Parent: key.Name,
+	}
+
+	it := kmsClient.ListCryptoKeyVersions(ctx, keyVersionReq)
+
+	for {
+		keyVersion, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		Expect(err).To(BeNil(), "Failed to list crypto key versions")
+
+		keyVersions = append(keyVersions, keyVersion.Name)
+	}
+	return key.Name, keyVersions
+}
+
+// destroyCryptoKeyVersions schedules the key versions for destruction.
+// https://cloud.google.com/kms/docs/destroy-restore
+func destroyCryptoKeyVersions(ctx context.Context, keyVersions []string) {
+	for _, keyVersion := range keyVersions {
+		destroyKeyReq := &kmspb.DestroyCryptoKeyVersionRequest{
+			Name: keyVersion,
+		}
+		_, err := kmsClient.DestroyCryptoKeyVersion(ctx, destroyKeyReq)
+		Expect(err).To(BeNil(), "Failed to destroy crypto key version: %v", keyVersion)
+	}
+}
+
+// setCryptoKeyVersionsState enables or disables the key versions.
+// https://cloud.google.com/kms/docs/enable-disable
+func setCryptoKeyVersionsState(ctx context.Context, keyVersions []string, state kmspb.CryptoKeyVersion_CryptoKeyVersionState) {
+	for _, keyVersion := range keyVersions {
+		updateReq := &kmspb.UpdateCryptoKeyVersionRequest{
+			CryptoKeyVersion: &kmspb.CryptoKeyVersion{
+				Name:  keyVersion,
+				State: state,
+			},
+			UpdateMask: &fieldmask.FieldMask{
+				Paths: []string{"state"},
+			},
+		}
+		_, err := kmsClient.UpdateCryptoKeyVersion(ctx, updateReq)
+		Expect(err).To(BeNil(), "Failed to set crypto key version %v to %v", keyVersion, state)
+	}
+}
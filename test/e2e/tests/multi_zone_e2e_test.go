@@ -181,59 +181,25 @@ func testAttachWriteReadDetach(volID string, volName string, instance *remote.In
 func testLifecycleWithVerify(volID string, volName string, instance *remote.InstanceInfo, client *remote.CsiClient, readOnly, useBlock bool, firstMountVerify, secondMountVerify verifyFunc) error {
 	var err error
 	klog.Infof("Starting testAttachWriteReadDetach with volume %v node %v with readonly %v\n", volID, instance.GetNodeID(), readOnly)
-	// Attach Disk
-	err = client.ControllerPublishVolume(volID, instance.GetNodeID())
-	if err != nil {
-		return fmt.Errorf("ControllerPublishVolume failed with error for disk %v on node %v: %v", volID, instance.GetNodeID(), err)
-	}
-
-	defer func() {
-		// Detach Disk
-		err = client.ControllerUnpublishVolume(volID, instance.GetNodeID())
-		if err != nil {
-			klog.Errorf("Failed to detach disk: %v", err)
-		}
-
-	}()
-
-	// Stage Disk
+	// Attach, stage and mount the disk
 	stageDir := filepath.Join("/tmp/", volName, "stage")
-	if useBlock {
-		err = client.NodeStageBlockVolume(volID, stageDir)
-	} else {
-		err = client.NodeStageExt4Volume(volID, stageDir)
-	}
-
-	//err = client.NodeStageExt4Volume(volID, stageDir)
+	publishDir := filepath.Join("/tmp/", volName, "mount")
+	cleanup, err := testutils.StageAndPublish(client, volID, instance.GetNodeID(), stageDir, publishDir, useBlock)
 	if err != nil {
-		return fmt.Errorf("NodeStageExt4Volume failed with error: %v", err)
+		return err
 	}
 
 	defer func() {
-		// Unstage Disk
-		err = client.NodeUnstageVolume(volID, stageDir)
-		if err != nil {
-			klog.Errorf("Failed to unstage volume: %v", err)
+		// Unmount, unstage and detach the disk
+		if err := cleanup(); err != nil {
+			klog.Errorf("Failed to clean up volume %v: %v", volID, err)
 		}
 		fp := filepath.Join("/tmp/", volName)
-		err = testutils.RmAll(instance, fp)
-		if err != nil {
+		if err := testutils.RmAll(instance, fp); err != nil {
 			klog.Errorf("Failed to rm file path %s: %v", fp, err)
 		}
 	}()
 
-	// Mount Disk
-	publishDir := filepath.Join("/tmp/", volName, "mount")
-
-	if useBlock {
-		err = client.NodePublishBlockVolume(volID, stageDir, publishDir)
-	} else {
-		err = client.NodePublishVolume(volID, stageDir, publishDir)
-	}
-
-	if err != nil {
-		return fmt.Errorf("NodePublishVolume failed with error: %v", err)
-	}
 	err = testutils.ForceChmod(instance, filepath.Join("/tmp/", volName), "777")
 	if err != nil {
 		return fmt.Errorf("Chmod failed with error: %v", err)
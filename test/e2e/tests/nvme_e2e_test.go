@@ -0,0 +1,163 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// nvmeMachineVariant is a machine family that only attaches disks over NVMe,
+// where device discovery differs from the SCSI families.
+type nvmeMachineVariant struct {
+	family string
+	config remote.InstanceConfig
+	// arch is the architecture to cross-compile the driver for, if it is
+	// not the local one.
+	arch string
+}
+
+var nvmeMachineVariants = []nvmeMachineVariant{
+	{
+		family: "c3",
+		config: remote.InstanceConfig{
+			MachineType: "c3-standard-4",
+			ImageURL:    "projects/debian-cloud/global/images/family/debian-12",
+			GVNIC:       true,
+		},
+	},
+	{
+		family: "t2a",
+		config: remote.InstanceConfig{
+			MachineType: "t2a-standard-1",
+			ImageURL:    "projects/debian-cloud/global/images/family/debian-12-arm64",
+			GVNIC:       true,
+		},
+		arch: "arm64",
+	},
+}
+
+var _ = Describe("GCE PD CSI Driver on NVMe-only machine families", func() {
+
+	for _, variant := range nvmeMachineVariants {
+		family := variant.family
+		It(fmt.Sprintf("Should stage, publish, expand and get stats of a volume on %s", family), func() {
+			testContext, ok := nvmeTestContexts[family]
+			if !ok {
+				Skip("NVMe tests are only run with --run-nvme-tests")
+			}
+			p, z, _ := testContext.Instance.GetIdentity()
+			client := testContext.Client
+			instance := testContext.Instance
+
+			// These families do not support pd-standard.
+			volName := testNamePrefix + string(uuid.NewUUID())
+			volID, err := client.CreateVolume(volName, map[string]string{
+				common.ParameterKeyType:          "pd-balanced",
+				common.ParameterKeyDiskInterface: common.DiskInterfaceNVME,
+			}, defaultSizeGb,
+				&csi.TopologyRequirement{
+					Requisite: []*csi.Topology{
+						{
+							Segments: map[string]string{common.TopologyKeyZone: z},
+						},
+					},
+				})
+			Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+			defer deleteVolumeOrError(client, volID, p)
+
+			var newSizeGb int64 = 10
+			testFileContents := "test"
+			firstMountVerify := func(a verifyArgs) error {
+				if err := verifyDiskInterface(instance, volName, common.DiskInterfaceNVME); err != nil {
+					return err
+				}
+
+				testFile := filepath.Join(a.publishDir, "testfile")
+				if err := testutils.WriteFile(instance, testFile, testFileContents); err != nil {
+					return fmt.Errorf("Failed to write file: %v", err)
+				}
+
+				_, capacity, _, _, _, _, err := client.NodeGetVolumeStats(volID, a.publishDir)
+				if err != nil {
+					return fmt.Errorf("NodeGetVolumeStats failed with error: %v", err)
+				}
+				if capacity <= 0 {
+					return fmt.Errorf("got capacity %d from NodeGetVolumeStats, expected a positive capacity", capacity)
+				}
+
+				if err := client.ControllerExpandVolume(volID, newSizeGb); err != nil {
+					return fmt.Errorf("ControllerExpandVolume failed with error: %v", err)
+				}
+				if _, err := client.NodeExpandVolume(volID, a.publishDir, newSizeGb); err != nil {
+					return fmt.Errorf("NodeExpandVolume failed with error: %v", err)
+				}
+				return verifyFSSize(instance, a.publishDir, newSizeGb)
+			}
+			secondMountVerify := func(a verifyArgs) error {
+				readContents, err := testutils.ReadFile(instance, filepath.Join(a.publishDir, "testfile"))
+				if err != nil {
+					return fmt.Errorf("ReadFile failed with error: %v", err)
+				}
+				if strings.TrimSpace(readContents) != testFileContents {
+					return fmt.Errorf("wanted test file content: %s, got content: %s", testFileContents, readContents)
+				}
+				return verifyFSSize(instance, a.publishDir, newSizeGb)
+			}
+			err = testLifecycleWithVerify(volID, volName, instance, client, false /* readOnly */, false /* fs */, firstMountVerify, secondMountVerify)
+			Expect(err).To(BeNil(), "Failed lifecycle on %s", family)
+		})
+	}
+})
+
+// verifyDiskInterface checks that the disk named diskName is attached to
+// instance over diskInterface.
+func verifyDiskInterface(instance *remote.InstanceInfo, diskName, diskInterface string) error {
+	p, z, name := instance.GetIdentity()
+	inst, err := computeService.Instances.Get(p, z, name).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get instance %s: %v", name, err)
+	}
+	for _, disk := range inst.Disks {
+		if disk.DeviceName == diskName {
+			if disk.Interface != diskInterface {
+				return fmt.Errorf("disk %s is attached over %s, expected %s", diskName, disk.Interface, diskInterface)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("disk %s is not attached to instance %s", diskName, name)
+}
+
+func verifyFSSize(instance *remote.InstanceInfo, publishDir string, sizeGb int64) error {
+	got, err := testutils.GetFSSizeInGb(instance, publishDir)
+	if err != nil {
+		return fmt.Errorf("failed to get FSSize in GB: %v", err)
+	}
+	if got != sizeGb {
+		return fmt.Errorf("got filesystem size %dGb, expected %dGb", got, sizeGb)
+	}
+	return nil
+}
@@ -346,9 +346,14 @@ var _ = Describe("GCE PD CSI Driver", func() {
 		Expect(cloudDisk.SizeGb).To(Equal(newSizeGb))
 
 		// Resize node
-		resp, err := client.NodeExpandVolume(volID, publishDir, newSizeGb)
+		resp, err := client.NodeExpandBlockVolume(volID, publishDir, newSizeGb)
 		Expect(err).To(BeNil(), "Node expand volume failed")
-		Expect(resp.CapacityBytes).To(Equal(common.GbToBytes(newSizeGb)), "Node expand should not do anything")
+		Expect(resp.CapacityBytes).To(Equal(common.GbToBytes(newSizeGb)), "Node expand should report the new size")
+
+		// Resize node without a capability, which must detect the block volume
+		resp, err = client.NodeExpandVolume(volID, publishDir, newSizeGb)
+		Expect(err).To(BeNil(), "Node expand volume without capability failed")
+		Expect(resp.CapacityBytes).To(Equal(common.GbToBytes(newSizeGb)), "Node expand should report the new size")
 
 		// Verify disk size
 		sizeGb, err = testutils.GetBlockSizeInGb(instance, publishDir)
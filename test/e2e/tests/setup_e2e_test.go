@@ -37,8 +37,15 @@ var (
 	serviceAccount  = flag.String("service-account", "", "Service account to bring up instance with")
 	runInProw       = flag.Bool("run-in-prow", false, "If true, use a Boskos loaned project and special CI service accounts and ssh keys")
 	deleteInstances = flag.Bool("delete-instances", false, "Delete the instances after tests run")
-
-	testContexts        = []*remote.TestContext{}
+	runWindowsTests = flag.Bool("run-windows-tests", false, "If true, also bring up a Windows instance and run the Windows node tests on it")
+	csiProxyURL     = flag.String("csi-proxy-url", "https://storage.googleapis.com/gke-release/csi-proxy/v0.2.2/csi-proxy.exe", "URL of the csi-proxy binary to run on the Windows instance")
+	runNVMeTests    = flag.Bool("run-nvme-tests", false, "If true, also bring up instances of the NVMe-only machine families and run the NVMe tests on them")
+	nvmeZone        = flag.String("nvme-zone", "us-central1-a", "Zone to bring up the NVMe-only instances in, which must offer all of their machine types")
+
+	testContexts       = []*remote.TestContext{}
+	windowsTestContext *remote.TestContext
+	// nvmeTestContexts are keyed by machine family.
+	nvmeTestContexts    = map[string]*remote.TestContext{}
 	computeService      *compute.Service
 	computeAlphaService *computealpha.Service
 	kmsClient           *cloudkms.KeyManagementClient
@@ -114,15 +121,93 @@ var _ = BeforeSuite(func() {
 		}(zone)
 	}
 
-	for i := 0; i < len(zones); i++ {
+	if *runWindowsTests {
+		go func(curZone string) {
+			defer GinkgoRecover()
+			nodeID := fmt.Sprintf("gce-pd-csi-e2e-win-%s", curZone)
+			klog.Infof("Setting up Windows node %s\n", nodeID)
+
+			i, err := remote.SetupWindowsInstance(*project, curZone, nodeID, *serviceAccount, computeService)
+			if err != nil {
+				klog.Fatalf("Failed to setup Windows instance %v: %v", nodeID, err)
+			}
+
+			klog.Infof("Creating new driver and client for Windows node %s\n", i.GetName())
+			testContext, err := testutils.GCEClientAndWindowsDriverSetup(i, *csiProxyURL)
+			if err != nil {
+				klog.Fatalf("Failed to set up Test Context for Windows instance %v: %v", i.GetName(), err)
+			}
+			tcc <- testContext
+		}(zones[0])
+	}
+
+	// Instance names of the NVMe-only machine families, to tell their test
+	// contexts apart.
+	nvmeInstanceFamilies := map[string]string{}
+	if *runNVMeTests {
+		for _, variant := range nvmeMachineVariants {
+			nodeID := fmt.Sprintf("gce-pd-csi-e2e-%s-%s", variant.family, *nvmeZone)
+			nvmeInstanceFamilies[nodeID] = variant.family
+			go func(nodeID string, variant nvmeMachineVariant) {
+				defer GinkgoRecover()
+				klog.Infof("Setting up %s node %s\n", variant.family, nodeID)
+
+				i, err := remote.SetupInstanceWithConfig(*project, *nvmeZone, nodeID, *serviceAccount, variant.config, computeService)
+				if err != nil {
+					klog.Fatalf("Failed to setup instance %v: %v", nodeID, err)
+				}
+
+				err = testutils.MkdirAll(i, "/lib/udev_containerized")
+				if err != nil {
+					klog.Fatalf("Could not make scsi_id containerized directory: %v", err)
+				}
+
+				err = testutils.CopyFile(i, "/lib/udev/scsi_id", "/lib/udev_containerized/scsi_id")
+				if err != nil {
+					klog.Fatalf("could not copy scsi_id to containerized directory: %v", err)
+				}
+
+				klog.Infof("Creating new driver and client for node %s\n", i.GetName())
+				testContext, err := testutils.GCEClientAndDriverSetupForArch(i, variant.arch)
+				if err != nil {
+					klog.Fatalf("Failed to set up Test Context for instance %v: %v", i.GetName(), err)
+				}
+				tcc <- testContext
+			}(nodeID, variant)
+		}
+	}
+
+	numInstances := len(zones) + len(nvmeInstanceFamilies)
+	if *runWindowsTests {
+		numInstances++
+	}
+	for i := 0; i < numInstances; i++ {
 		tc := <-tcc
 		klog.Infof("Test Context for node %s set up\n", tc.Instance.GetName())
+		// The Windows instance only runs the Windows tests, as the other
+		// tests verify their results with Linux commands.
+		if tc.Instance.IsWindows() {
+			windowsTestContext = tc
+			continue
+		}
+		// The NVMe-only instances are in a different zone from the others,
+		// so they only run the NVMe tests.
+		if family, ok := nvmeInstanceFamilies[tc.Instance.GetName()]; ok {
+			nvmeTestContexts[family] = tc
+			continue
+		}
 		testContexts = append(testContexts, tc)
 	}
 })
 
 var _ = AfterSuite(func() {
 
+	if windowsTestContext != nil {
+		testContexts = append(testContexts, windowsTestContext)
+	}
+	for _, tc := range nvmeTestContexts {
+		testContexts = append(testContexts, tc)
+	}
 	for _, tc := range testContexts {
 		err := remote.TeardownDriverAndClient(tc)
 		Expect(err).To(BeNil(), "Teardown Driver and Client failed with error")
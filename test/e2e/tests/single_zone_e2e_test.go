@@ -34,9 +34,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	"google.golang.org/api/iterator"
 	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
-	fieldmask "google.golang.org/genproto/protobuf/field_mask"
 )
 
 const (
@@ -47,6 +45,7 @@ const (
 	defaultMwSizeGb    int64 = 200
 	readyState               = "READY"
 	standardDiskType         = "pd-standard"
+	ssdDiskType              = "pd-ssd"
 	defaultVolumeLimit int64 = 127
 
 	defaultEpsilon = 500000000 // 500M
@@ -393,78 +392,15 @@ var _ = Describe("GCE PD CSI Driver", func() {
 		controllerClient := testContext.Client
 
 		p, z, _ := controllerInstance.GetIdentity()
-		locationID := "global"
 
-		// The resource name of the key rings.
-		parentName := fmt.Sprintf("projects/%s/locations/%s", p, locationID)
-		keyRingId := "gce-pd-csi-test-ring"
-
-		// Create KeyRing
-		ringReq := &kmspb.CreateKeyRingRequest{
-			Parent:    parentName,
-			KeyRingId: keyRingId,
-		}
-		keyRing, err := kmsClient.CreateKeyRing(ctx, ringReq)
-		if !gce.IsGCEError(err, "alreadyExists") {
-			getKeyRingReq := &kmspb.GetKeyRingRequest{
-				Name: fmt.Sprintf("%s/keyRings/%s", parentName, keyRingId),
-			}
-			keyRing, err = kmsClient.GetKeyRing(ctx, getKeyRingReq)
-
-		}
-		Expect(err).To(BeNil(), "Failed to create or get key ring %v", keyRingId)
-
-		// Create CryptoKey in KeyRing
-		keyId := "test-key-" + string(uuid.NewUUID())
-		keyReq := &kmspb.CreateCryptoKeyRequest{
-			Parent:      keyRing.Name,
-			CryptoKeyId: keyId,
-			CryptoKey: &kmspb.CryptoKey{
-				Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT,
-				VersionTemplate: &kmspb.CryptoKeyVersionTemplate{
-					Algorithm: kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION,
-				},
-			},
-		}
-		key, err := kmsClient.CreateCryptoKey(ctx, keyReq)
-		Expect(err).To(BeNil(), "Failed to create crypto key %v in key ring %v", keyId, keyRing.Name)
-
-		keyVersions := []string{}
-		keyVersionReq := &kmspb.ListCryptoKeyVersionsRequest{
-			Parent: key.Name,
-		}
-
-		it := kmsClient.ListCryptoKeyVersions(ctx, keyVersionReq)
-
-		for {
-			keyVersion, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-			Expect(err).To(BeNil(), "Failed to list crypto key versions")
-
-			keyVersions = append(keyVersions, keyVersion.Name)
-		}
-
-		// Defer deletion of all key versions
-		// https://cloud.google.com/kms/docs/destroy-restore
-		defer func() {
-
-			for _, keyVersion := range keyVersions {
-				destroyKeyReq := &kmspb.DestroyCryptoKeyVersionRequest{
-					Name: keyVersion,
-				}
-				_, err = kmsClient.DestroyCryptoKeyVersion(ctx, destroyKeyReq)
-				Expect(err).To(BeNil(), "Failed to destroy crypto key version: %v", keyVersion)
-			}
-
-		}()
+		keyName, keyVersions := createCryptoKey(ctx, p)
+		defer destroyCryptoKeyVersions(ctx, keyVersions)
 
 		// Go through volume lifecycle using CMEK-ed PD
 		// Create Disk
 		volName := testNamePrefix + string(uuid.NewUUID())
 		volID, err := controllerClient.CreateVolume(volName, map[string]string{
-			common.ParameterKeyDiskEncryptionKmsKey: key.Name,
+			common.ParameterKeyDiskEncryptionKmsKey: keyName,
 		}, defaultSizeGb,
 			&csi.TopologyRequirement{
 				Requisite: []*csi.Topology{
@@ -499,39 +435,14 @@ var _ = Describe("GCE PD CSI Driver", func() {
 
 		// Revoke CMEK key
 		// https://cloud.google.com/kms/docs/enable-disable
-
-		for _, keyVersion := range keyVersions {
-			disableReq := &kmspb.UpdateCryptoKeyVersionRequest{
-				CryptoKeyVersion: &kmspb.CryptoKeyVersion{
-					Name:  keyVersion,
-					State: kmspb.CryptoKeyVersion_DISABLED,
-				},
-				UpdateMask: &fieldmask.FieldMask{
-					Paths: []string{"state"},
-				},
-			}
-			_, err = kmsClient.UpdateCryptoKeyVersion(ctx, disableReq)
-			Expect(err).To(BeNil(), "Failed to disable crypto key")
-		}
+		setCryptoKeyVersionsState(ctx, keyVersions, kmspb.CryptoKeyVersion_DISABLED)
 
 		// Make sure attach of PD fails
 		err = testAttachWriteReadDetach(volID, volName, controllerInstance, controllerClient, false /* readOnly */)
 		Expect(err).ToNot(BeNil(), "Volume lifecycle should have failed, but succeeded")
 
 		// Restore CMEK key
-		for _, keyVersion := range keyVersions {
-			enableReq := &kmspb.UpdateCryptoKeyVersionRequest{
-				CryptoKeyVersion: &kmspb.CryptoKeyVersion{
-					Name:  keyVersion,
-					State: kmspb.CryptoKeyVersion_ENABLED,
-				},
-				UpdateMask: &fieldmask.FieldMask{
-					Paths: []string{"state"},
-				},
-			}
-			_, err = kmsClient.UpdateCryptoKeyVersion(ctx, enableReq)
-			Expect(err).To(BeNil(), "Failed to enable crypto key")
-		}
+		setCryptoKeyVersionsState(ctx, keyVersions, kmspb.CryptoKeyVersion_ENABLED)
 
 		// Make sure attach of PD succeeds
 		err = testAttachWriteReadDetach(volID, volName, controllerInstance, controllerClient, false /* readOnly */)
@@ -832,9 +743,8 @@ func equalWithinEpsilon(a, b, epsiolon int64) bool {
 
 func createAndValidateUniqueZonalDisk(client *remote.CsiClient, project, zone string) (volName, volID string) {
 	// Create Disk
-	var err error
 	volName = testNamePrefix + string(uuid.NewUUID())
-	volID, err = client.CreateVolume(volName, nil, defaultSizeGb,
+	vol, err := testutils.CreateAndValidateVolume(client, volName, nil, defaultSizeGb,
 		&csi.TopologyRequirement{
 			Requisite: []*csi.Topology{
 				{
@@ -843,6 +753,7 @@ func createAndValidateUniqueZonalDisk(client *remote.CsiClient, project, zone st
 			},
 		})
 	Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+	volID = vol.GetVolumeId()
 
 	// Validate Disk Created
 	cloudDisk, err := computeService.Disks.Get(project, zone, volName).Do()
@@ -869,7 +780,8 @@ func deleteVolumeOrError(client *remote.CsiClient, volID, project string) {
 func createAndValidateUniqueZonalMultiWriterDisk(client *remote.CsiClient, project, zone string) (string, string) {
 	// Create Disk
 	volName := testNamePrefix + string(uuid.NewUUID())
-	volID, err := client.CreateVolumeWithCaps(volName, nil, defaultMwSizeGb,
+	// Multi-writer mode is not supported on pd-standard.
+	volID, err := client.CreateVolumeWithCaps(volName, map[string]string{common.ParameterKeyType: ssdDiskType}, defaultMwSizeGb,
 		&csi.TopologyRequirement{
 			Requisite: []*csi.Topology{
 				{
@@ -892,7 +804,7 @@ func createAndValidateUniqueZonalMultiWriterDisk(client *remote.CsiClient, proje
 	// Validate Disk Created
 	cloudDisk, err := computeAlphaService.Disks.Get(project, zone, volName).Do()
 	Expect(err).To(BeNil(), "Could not get disk from cloud directly")
-	Expect(cloudDisk.Type).To(ContainSubstring(standardDiskType))
+	Expect(cloudDisk.Type).To(ContainSubstring(ssdDiskType))
 	Expect(cloudDisk.Status).To(Equal(readyState))
 	Expect(cloudDisk.SizeGb).To(Equal(defaultMwSizeGb))
 	Expect(cloudDisk.Name).To(Equal(volName))
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// csi-proxy only allows operations on paths under the kubelet
+	// directory, so the tests use the paths kubelet would.
+	windowsStageDirFormat   = `C:\var\lib\kubelet\plugins\kubernetes.io\csi\pv\%s\globalmount`
+	windowsPublishDirFormat = `C:\var\lib\kubelet\pods\%s\volumes\kubernetes.io~csi\%s\mount`
+)
+
+var _ = Describe("GCE PD CSI Driver on Windows", func() {
+
+	BeforeEach(func() {
+		if windowsTestContext == nil {
+			Skip("Windows tests are only run with --run-windows-tests")
+		}
+	})
+
+	It("Should create, attach, stage, publish, write, read, and detach a volume", func() {
+		instance := windowsTestContext.Instance
+		client := windowsTestContext.Client
+		p, z, _ := instance.GetIdentity()
+
+		volName, volID := createAndValidateUniqueZonalDisk(client, p, z)
+		defer deleteVolumeOrError(client, volID, p)
+
+		err := testWindowsLifecycle(volID, volName, instance, client)
+		Expect(err).To(BeNil(), "Failed Windows volume lifecycle")
+	})
+})
+
+func testWindowsLifecycle(volID, volName string, instance *remote.InstanceInfo, client *remote.CsiClient) error {
+	klog.Infof("Starting testWindowsLifecycle with volume %v node %v\n", volID, instance.GetNodeID())
+	err := client.ControllerPublishVolume(volID, instance.GetNodeID())
+	if err != nil {
+		return fmt.Errorf("ControllerPublishVolume failed with error for disk %v on node %v: %v", volID, instance.GetNodeID(), err)
+	}
+	defer func() {
+		err = client.ControllerUnpublishVolume(volID, instance.GetNodeID())
+		if err != nil {
+			klog.Errorf("Failed to detach disk: %v", err)
+		}
+	}()
+
+	stageDir := fmt.Sprintf(windowsStageDirFormat, volName)
+	err = client.NodeStageExt4Volume(volID, stageDir)
+	if err != nil {
+		return fmt.Errorf("NodeStageVolume failed with error: %v", err)
+	}
+	defer func() {
+		err = client.NodeUnstageVolume(volID, stageDir)
+		if err != nil {
+			klog.Errorf("Failed to unstage volume: %v", err)
+		}
+	}()
+
+	publishDir := fmt.Sprintf(windowsPublishDirFormat, volName, volName)
+	err = client.NodePublishVolume(volID, stageDir, publishDir)
+	if err != nil {
+		return fmt.Errorf("NodePublishVolume failed with error: %v", err)
+	}
+
+	testFile := publishDir + `\testfile`
+	testFileContents := "test"
+	output, err := instance.PowerShell(fmt.Sprintf("Set-Content -Path '%s' -Value '%s'", testFile, testFileContents))
+	if err != nil {
+		return fmt.Errorf("failed to write test file %s. Output: %v, error: %v", testFile, output, err)
+	}
+	output, err = instance.PowerShell(fmt.Sprintf("Get-Content -Path '%s'", testFile))
+	if err != nil {
+		return fmt.Errorf("failed to read test file %s. Output: %v, error: %v", testFile, output, err)
+	}
+	if strings.TrimSpace(output) != testFileContents {
+		return fmt.Errorf("wanted test file content: %s, got content: %s", testFileContents, output)
+	}
+
+	err = client.NodeUnpublishVolume(volID, publishDir)
+	if err != nil {
+		return fmt.Errorf("NodeUnpublishVolume failed with error: %v", err)
+	}
+
+	klog.Infof("Completed testWindowsLifecycle with volume %v node %v\n", volID, instance.GetNodeID())
+	return nil
+}
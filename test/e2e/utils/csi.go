@@ -0,0 +1,140 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	remote "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+)
+
+// CreateAndValidateVolume creates a filesystem volume of sizeGb through
+// client and checks the response against the request: the volume must have
+// an ID, at least the requested capacity and, if topReq has requisite
+// topology, a zone from it.
+func CreateAndValidateVolume(client *remote.CsiClient, name string, params map[string]string, sizeGb int64, topReq *csi.TopologyRequirement) (*csi.Volume, error) {
+	vol, err := client.CreateVolumeFromRequest(&csi.CreateVolumeRequest{
+		Name:                      name,
+		CapacityRange:             &csi.CapacityRange{RequiredBytes: common.GbToBytes(sizeGb)},
+		Parameters:                params,
+		AccessibilityRequirements: topReq,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CreateVolume %s failed: %v", name, err)
+	}
+	if vol.GetVolumeId() == "" {
+		return vol, fmt.Errorf("CreateVolume %s returned no volume ID", name)
+	}
+	if vol.GetCapacityBytes() < common.GbToBytes(sizeGb) {
+		return vol, fmt.Errorf("CreateVolume %s returned capacity %d, requested %d", name, vol.GetCapacityBytes(), common.GbToBytes(sizeGb))
+	}
+	if len(topReq.GetRequisite()) > 0 && !topologyInRequisite(vol.GetAccessibleTopology(), topReq.GetRequisite()) {
+		return vol, fmt.Errorf("CreateVolume %s returned topology %v outside of the requisite topology %v", name, vol.GetAccessibleTopology(), topReq.GetRequisite())
+	}
+	return vol, nil
+}
+
+func topologyInRequisite(accessible, requisite []*csi.Topology) bool {
+	zones := map[string]bool{}
+	for _, t := range requisite {
+		zones[t.GetSegments()[common.TopologyKeyZone]] = true
+	}
+	if len(accessible) == 0 {
+		return false
+	}
+	for _, t := range accessible {
+		if !zones[t.GetSegments()[common.TopologyKeyZone]] {
+			return false
+		}
+	}
+	return true
+}
+
+// StageAndPublish attaches volID to nodeID, stages it at stageDir and
+// publishes it at publishDir, as a block device if block is set and as an
+// ext4 filesystem otherwise. It returns a cleanup function that unpublishes,
+// unstages and detaches the volume. If a step fails, the steps that succeeded
+// are undone before the error is returned.
+func StageAndPublish(client *remote.CsiClient, volID, nodeID, stageDir, publishDir string, block bool) (func() error, error) {
+	var undo []func() error
+	cleanup := func() error {
+		var firstErr error
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				klog.Errorf("Failed to clean up volume %s: %v", volID, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		return firstErr
+	}
+	fail := func(err error) (func() error, error) {
+		cleanup()
+		return nil, err
+	}
+
+	if err := client.ControllerPublishVolume(volID, nodeID); err != nil {
+		return fail(fmt.Errorf("ControllerPublishVolume failed for volume %s on node %s: %v", volID, nodeID, err))
+	}
+	undo = append(undo, func() error {
+		if err := client.ControllerUnpublishVolume(volID, nodeID); err != nil {
+			return fmt.Errorf("ControllerUnpublishVolume failed: %v", err)
+		}
+		return nil
+	})
+
+	var err error
+	if block {
+		err = client.NodeStageBlockVolume(volID, stageDir)
+	} else {
+		err = client.NodeStageExt4Volume(volID, stageDir)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("NodeStageVolume failed for volume %s at %s: %v", volID, stageDir, err))
+	}
+	undo = append(undo, func() error {
+		if err := client.NodeUnstageVolume(volID, stageDir); err != nil {
+			return fmt.Errorf("NodeUnstageVolume failed: %v", err)
+		}
+		return nil
+	})
+
+	if block {
+		err = client.NodePublishBlockVolume(volID, stageDir, publishDir)
+	} else {
+		err = client.NodePublishVolume(volID, stageDir, publishDir)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("NodePublishVolume failed for volume %s at %s: %v", volID, publishDir, err))
+	}
+	undo = append(undo, func() error {
+		if err := client.NodeUnpublishVolume(volID, publishDir); err != nil {
+			return fmt.Errorf("NodeUnpublishVolume failed: %v", err)
+		}
+		return nil
+	})
+	return cleanup, nil
+}
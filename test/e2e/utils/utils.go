@@ -44,6 +44,13 @@ var (
 )
 
 func GCEClientAndDriverSetup(instance *remote.InstanceInfo) (*remote.TestContext, error) {
+	return GCEClientAndDriverSetupForArch(instance, "")
+}
+
+// GCEClientAndDriverSetupForArch is GCEClientAndDriverSetup for an instance
+// of another architecture, such as arm64, that the driver is cross-compiled
+// for. An empty arch builds the driver with make for the local architecture.
+func GCEClientAndDriverSetupForArch(instance *remote.InstanceInfo, arch string) (*remote.TestContext, error) {
 	port := fmt.Sprintf("%v", 1024+rand.Intn(10000))
 	goPath, ok := os.LookupEnv("GOPATH")
 	if !ok {
@@ -64,6 +71,42 @@ func GCEClientAndDriverSetup(instance *remote.InstanceInfo) (*remote.TestContext
 		WorkspaceDir: workspace,
 		RunDriverCmd: driverRunCmd,
 		Port:         port,
+		Arch:         arch,
+	}
+
+	err := os.Setenv("GCE_PD_CSI_STAGING_VERSION", "latest")
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.SetupNewDriverAndClient(instance, config)
+}
+
+// GCEClientAndWindowsDriverSetup is GCEClientAndDriverSetup for a Windows
+// instance, running the Windows driver binary alongside csi-proxy downloaded
+// from csiProxyURL.
+func GCEClientAndWindowsDriverSetup(instance *remote.InstanceInfo, csiProxyURL string) (*remote.TestContext, error) {
+	port := fmt.Sprintf("%v", 1024+rand.Intn(10000))
+	goPath, ok := os.LookupEnv("GOPATH")
+	if !ok {
+		return nil, fmt.Errorf("Could not find environment variable GOPATH")
+	}
+	pkgPath := path.Join(goPath, "src/sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/")
+	binPath := path.Join(pkgPath, "bin/gce-pd-csi-driver.exe")
+
+	endpoint := fmt.Sprintf("tcp://localhost:%s", port)
+
+	workspace := remote.NewWindowsWorkspaceDir("gce-pd-e2e-")
+	driverRunCmd := fmt.Sprintf(`cmd /c %s\gce-pd-csi-driver.exe -v=4 --endpoint=%s --extra-labels=%s=%s 2> %s\prog.out`,
+		workspace, endpoint, DiskLabelKey, DiskLabelValue, workspace)
+
+	config := &remote.ClientConfig{
+		PkgPath:      pkgPath,
+		BinPath:      binPath,
+		WorkspaceDir: workspace,
+		RunDriverCmd: driverRunCmd,
+		Port:         port,
+		CSIProxyURL:  csiProxyURL,
 	}
 
 	err := os.Setenv("GCE_PD_CSI_STAGING_VERSION", "latest")
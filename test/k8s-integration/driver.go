@@ -10,10 +10,12 @@ import (
 
 	"k8s.io/klog"
 	"k8s.io/kubernetes/test/e2e/framework/podlogs"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deploy"
 )
 
 func getOverlayDir(pkgDir, deployOverlayName string) string {
-	return filepath.Join(pkgDir, "deploy", "kubernetes", "overlays", deployOverlayName)
+	return deploy.OverlayDir(pkgDir, deployOverlayName)
 }
 
 func installDriver(testParams *testParameters, stagingImage, deployOverlayName string, doDriverBuild bool) error {
@@ -32,8 +34,14 @@ func installDriver(testParams *testParameters, stagingImage, deployOverlayName s
 			return fmt.Errorf("failed to change to overlay directory: %s, err: %v", out, err)
 		}
 
-		// TODO (#138): in a local environment this is going to modify the actual kustomize files.
-		// maybe a copy should be made instead
+		// The edit modifies the kustomization in the source tree, so it is
+		// restored once the driver is deployed, or the runner fails or is
+		// interrupted.
+		restoreKustomization, err := snapshotFile(filepath.Join(overlayDir, "kustomization.yaml"))
+		if err != nil {
+			return fmt.Errorf("failed to save kustomization: %v", err)
+		}
+		defer restoreKustomization()
 		out, err = exec.Command(
 			filepath.Join(testParams.pkgDir, "bin", "kustomize"),
 			"edit",
@@ -128,7 +136,7 @@ func deleteDriver(testParams *testParameters, deployOverlayName string) error {
 	return nil
 }
 
-func pushImage(pkgDir, stagingImage, stagingVersion, platform string) error {
+func pushImage(pkgDir, stagingImage, stagingVersion, platform string, windowsHostProcess bool) error {
 	err := os.Setenv("GCE_PD_CSI_STAGING_VERSION", stagingVersion)
 	if err != nil {
 		return err
@@ -141,7 +149,11 @@ func pushImage(pkgDir, stagingImage, stagingVersion, platform string) error {
 
 	if platform == "windows" {
 		// build multi-arch image which can work for both Linux and Windows
-		cmd = exec.Command("make", "-C", pkgDir, "build-and-push-multi-arch",
+		target := "build-and-push-multi-arch"
+		if windowsHostProcess {
+			target = "build-and-push-multi-arch-hostprocess"
+		}
+		cmd = exec.Command("make", "-C", pkgDir, target,
 			fmt.Sprintf("GCE_PD_CSI_STAGING_VERSION=%s", stagingVersion),
 			fmt.Sprintf("GCE_PD_CSI_STAGING_IMAGE=%s", stagingImage))
 		err = runCommand("Building and Pushing GCP Container for Windows", cmd)
@@ -27,6 +27,7 @@ import (
 	apimachineryversion "k8s.io/apimachinery/pkg/util/version"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deploy"
 	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
 )
 
@@ -36,6 +37,7 @@ var (
 	teardownDriver       = flag.Bool("teardown-driver", true, "teardown the driver after the e2e test")
 	bringupCluster       = flag.Bool("bringup-cluster", true, "build kubernetes and bringup a cluster")
 	platform             = flag.String("platform", "linux", "platform that the tests will be run, either linux or windows")
+	windowsHostProcess   = flag.Bool("windows-host-process", false, "run the Windows node plugin as a HostProcess container without csi-proxy, building its host process image and deploying the windows-host-process overlay unless --deploy-overlay-name is set. Requires --platform=windows")
 	gceZone              = flag.String("gce-zone", "", "zone that the gce k8s cluster is created/found in")
 	gceRegion            = flag.String("gce-region", "", "region that gke regional cluster should be created in")
 	kubeVersion          = flag.String("kube-version", "", "version of Kubernetes to download and use for the cluster")
@@ -64,6 +66,12 @@ var (
 	deployOverlayName   = flag.String("deploy-overlay-name", "", "which kustomize overlay to deploy the driver with")
 	doDriverBuild       = flag.Bool("do-driver-build", true, "building the driver from source")
 	useGKEManagedDriver = flag.Bool("use-gke-managed-driver", false, "use GKE managed PD CSI driver for the tests")
+	useGoManifests      = flag.Bool("use-go-manifests", false, "render the driver manifests from the overlay in Go and apply them without kustomize or the deploy scripts. Overlays with patches are not supported")
+	driverExtraArgs     = flag.String("driver-extra-args", "", "comma-separated list of extra args for the driver container. Only used with --use-go-manifests")
+
+	// Test driver metrics flags
+	checkDriverMetrics     = flag.Bool("check-driver-metrics", false, "after the tests, scrape the metrics of the driver pods and fail if any exceeds --driver-metric-thresholds. With --use-go-manifests the driver is installed with its metrics endpoints enabled")
+	driverMetricThresholds = flag.String("driver-metric-thresholds", `attach_detach_failures_total{reason="internal"}=5;go_goroutines=500;process_open_fds=500`, "semicolon-separated list of per-pod metric thresholds of the form name{label=value,...}=max, used with --check-driver-metrics")
 
 	// Test flags
 	migrationTest = flag.Bool("migration-test", false, "sets the flag on the e2e binary signalling migration")
@@ -74,7 +82,7 @@ var (
 )
 
 const (
-	pdImagePlaceholder        = "gke.gcr.io/gcp-compute-persistent-disk-csi-driver"
+	pdImagePlaceholder        = deploy.DriverImagePlaceholder
 	k8sInDockerBuildBinDir    = "_output/dockerized/bin/linux/amd64"
 	k8sOutOfDockerBuildBinDir = "_output/bin"
 	externalDriverNamespace   = "gce-pd-csi-driver"
@@ -84,6 +92,7 @@ const (
 
 type testParameters struct {
 	platform             string
+	windowsHostProcess   bool
 	stagingVersion       string
 	goPath               string
 	pkgDir               string
@@ -131,6 +140,12 @@ func main() {
 		}
 	}
 
+	if *checkDriverMetrics {
+		if _, err := parseMetricThresholds(*driverMetricThresholds); err != nil {
+			klog.Fatalf("Invalid driver-metric-thresholds: %v", err)
+		}
+	}
+
 	ensureVariable(testFocus, true, "test-focus is a required flag")
 
 	if len(*gceRegion) != 0 {
@@ -158,6 +173,15 @@ func main() {
 		ensureFlag(bringupCluster, false, "bringupCluster is set to false if it is for testing in windows cluster")
 	}
 
+	if *windowsHostProcess {
+		if *platform != "windows" {
+			klog.Fatalf("windows-host-process requires platform to be windows, got %s", *platform)
+		}
+		if *deployOverlayName == "" {
+			*deployOverlayName = "windows-host-process"
+		}
+	}
+
 	if *deploymentStrat == "gke" {
 		ensureVariable(kubeVersion, false, "Cannot set kube-version when using deployment strategy 'gke'. Use gke-cluster-version.")
 		ensureExactlyOneVariableSet([]*string{gkeClusterVer, gkeReleaseChannel},
@@ -196,6 +220,7 @@ func handle() error {
 
 	testParams := &testParameters{
 		platform:            *platform,
+		windowsHostProcess:  *windowsHostProcess,
 		testFocus:           *testFocus,
 		snapshotClassFile:   *snapshotClassFile,
 		stagingVersion:      string(uuid.NewUUID()),
@@ -250,7 +275,7 @@ func handle() error {
 
 	// Build and push the driver, if required. Defer the driver image deletion.
 	if *doDriverBuild {
-		err := pushImage(testParams.pkgDir, *stagingImage, testParams.stagingVersion, testParams.platform)
+		err := pushImage(testParams.pkgDir, *stagingImage, testParams.stagingVersion, testParams.platform, testParams.windowsHostProcess)
 		if err != nil {
 			return fmt.Errorf("failed pushing image: %v", err)
 		}
@@ -391,10 +416,21 @@ func handle() error {
 
 	if !testParams.useGKEManagedDriver {
 		// Install the driver and defer its teardown
-		err := installDriver(testParams, *stagingImage, *deployOverlayName, *doDriverBuild)
+		var err error
+		if *useGoManifests {
+			err = installDriverFromManifests(getOverlayDir(testParams.pkgDir, *deployOverlayName), getManifestOptions(testParams))
+		} else {
+			err = installDriver(testParams, *stagingImage, *deployOverlayName, *doDriverBuild)
+		}
 		if *teardownDriver {
 			defer func() {
-				if teardownErr := deleteDriver(testParams, *deployOverlayName); teardownErr != nil {
+				var teardownErr error
+				if *useGoManifests {
+					teardownErr = deleteDriverFromManifests(getOverlayDir(testParams.pkgDir, *deployOverlayName), getManifestOptions(testParams))
+				} else {
+					teardownErr = deleteDriver(testParams, *deployOverlayName)
+				}
+				if teardownErr != nil {
 					klog.Errorf("failed to delete driver: %v", teardownErr)
 				}
 			}()
@@ -515,6 +551,20 @@ func handle() error {
 		return fmt.Errorf("failed to run tests: %w", err)
 	}
 
+	if *checkDriverMetrics {
+		thresholds, err := parseMetricThresholds(*driverMetricThresholds)
+		if err != nil {
+			return fmt.Errorf("failed to parse driver metric thresholds: %w", err)
+		}
+		client, err := getKubeClient()
+		if err != nil {
+			return fmt.Errorf("failed to get kubeclient: %w", err)
+		}
+		if err := assertDriverMetrics(client, getDriverNamespace(), thresholds); err != nil {
+			return fmt.Errorf("driver metrics check failed: %w", err)
+		}
+	}
+
 	return nil
 }
 
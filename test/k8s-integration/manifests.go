@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deploy"
+)
+
+// installDriverFromManifests installs the driver from manifests rendered in
+// Go, without kustomize or the deploy scripts.
+func installDriverFromManifests(overlayDir string, opts deploy.Options) error {
+	client, err := getKubeClient()
+	if err != nil {
+		return fmt.Errorf("failed to get kubeclient: %v", err)
+	}
+	ctx := context.Background()
+	// The driver RBAC can only be created by a cluster admin on GKE.
+	if err := ensureClusterAdminBinding(ctx, client); err != nil {
+		return err
+	}
+	return deploy.Install(ctx, client, overlayDir, opts)
+}
+
+// deleteDriverFromManifests deletes a driver installed by
+// installDriverFromManifests.
+func deleteDriverFromManifests(overlayDir string, opts deploy.Options) error {
+	client, err := getKubeClient()
+	if err != nil {
+		return fmt.Errorf("failed to get kubeclient: %v", err)
+	}
+	return deploy.Delete(context.Background(), client, overlayDir, opts)
+}
+
+func ensureClusterAdminBinding(ctx context.Context, client kubernetes.Interface) error {
+	const bindingName = "cluster-admin-binding"
+	_, err := client.RbacV1().ClusterRoleBindings().Get(ctx, bindingName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get clusterrolebinding %s: %v", bindingName, err)
+	}
+	out, err := exec.Command("gcloud", "config", "get-value", "account").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to get gcloud account: %s, err: %v", out, err)
+	}
+	binding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: bindingName},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     "cluster-admin",
+		},
+		Subjects: []rbacv1.Subject{{
+			APIGroup: rbacv1.GroupName,
+			Kind:     rbacv1.UserKind,
+			Name:     strings.TrimSpace(string(out)),
+		}},
+	}
+	_, err = client.RbacV1().ClusterRoleBindings().Create(ctx, binding, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create clusterrolebinding %s: %v", bindingName, err)
+	}
+	return nil
+}
+
+func getManifestOptions(testParams *testParameters) deploy.Options {
+	opts := deploy.Options{
+		Namespace:             getDriverNamespace(),
+		Windows:               testParams.platform == "windows",
+		ServiceAccountKeyFile: *saFile,
+	}
+	if *doDriverBuild {
+		opts.DriverImage = fmt.Sprintf("%s:%s", *stagingImage, testParams.stagingVersion)
+	}
+	if *driverExtraArgs != "" {
+		opts.ExtraDriverArgs = strings.Split(*driverExtraArgs, ",")
+	}
+	if *checkDriverMetrics {
+		opts.ControllerMetricsEndpoint = controllerMetricsEndpoint
+		opts.NodeMetricsEndpoint = nodeMetricsEndpoint
+	}
+	return opts
+}
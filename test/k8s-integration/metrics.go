@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// Metrics endpoints the driver serves on when installed with
+	// --check-driver-metrics and --use-go-manifests. They avoid the sidecar
+	// ports in the controller manifest.
+	controllerMetricsEndpoint = ":22021"
+	nodeMetricsEndpoint       = ":22022"
+
+	defaultMetricsPath  = "/metrics"
+	driverContainerName = "gce-pd-driver"
+)
+
+// metricThreshold is an upper bound on the sum of the samples of a driver
+// metric whose labels include all of labels, checked per pod.
+type metricThreshold struct {
+	name   string
+	labels map[string]string
+	max    float64
+}
+
+func (mt metricThreshold) String() string {
+	var labels []string
+	for k, v := range mt.labels {
+		labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(labels)
+	if len(labels) == 0 {
+		return mt.name
+	}
+	return fmt.Sprintf("%s{%s}", mt.name, strings.Join(labels, ","))
+}
+
+// parseMetricThresholds parses a semicolon-separated list of thresholds of
+// the form name{label=value,...}=max, where the label selector is optional.
+func parseMetricThresholds(s string) ([]metricThreshold, error) {
+	var thresholds []metricThreshold
+	for _, raw := range strings.Split(s, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		i := strings.LastIndex(raw, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("threshold %q is missing a maximum", raw)
+		}
+		max, err := strconv.ParseFloat(strings.TrimSpace(raw[i+1:]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("threshold %q has an invalid maximum: %v", raw, err)
+		}
+		mt := metricThreshold{name: strings.TrimSpace(raw[:i]), labels: map[string]string{}, max: max}
+		if j := strings.Index(mt.name, "{"); j >= 0 {
+			if !strings.HasSuffix(mt.name, "}") {
+				return nil, fmt.Errorf("threshold %q has an unterminated label selector", raw)
+			}
+			for _, label := range strings.Split(mt.name[j+1:len(mt.name)-1], ",") {
+				kv := strings.SplitN(label, "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("threshold %q has an invalid label %q", raw, label)
+				}
+				mt.labels[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+			mt.name = mt.name[:j]
+		}
+		if mt.name == "" {
+			return nil, fmt.Errorf("threshold %q is missing a metric name", raw)
+		}
+		thresholds = append(thresholds, mt)
+	}
+	return thresholds, nil
+}
+
+// assertDriverMetrics scrapes the metrics of every driver pod in namespace
+// and returns an error if any pod exceeds a threshold. This catches errors
+// and leaks that do not fail individual tests.
+func assertDriverMetrics(client kubernetes.Interface, namespace string, thresholds []metricThreshold) error {
+	ctx := context.Background()
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list driver pods: %v", err)
+	}
+
+	var violations []string
+	scraped := 0
+	for _, pod := range pods.Items {
+		port, path, ok := driverMetricsEndpoint(&pod)
+		if !ok {
+			continue
+		}
+		data, err := client.CoreV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("pods").
+			SubResource("proxy").
+			Name(fmt.Sprintf("%s:%s", pod.Name, port)).
+			Suffix(path).
+			DoRaw(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scrape metrics of pod %s: %v", pod.Name, err)
+		}
+		families, err := (&expfmt.TextParser{}).TextToMetricFamilies(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse metrics of pod %s: %v", pod.Name, err)
+		}
+		scraped++
+		for _, mt := range thresholds {
+			value := sumMetric(families, mt)
+			klog.Infof("Driver pod %s metric %v = %v (max %v)", pod.Name, mt, value, mt.max)
+			if value > mt.max {
+				violations = append(violations, fmt.Sprintf("pod %s: %v = %v exceeds %v", pod.Name, mt, value, mt.max))
+			}
+		}
+	}
+	if scraped == 0 {
+		return fmt.Errorf("no driver pods in namespace %s serve metrics", namespace)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("driver metrics exceeded thresholds: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// driverMetricsEndpoint returns the port and path of the metrics endpoint
+// of the driver container of pod, if it serves one.
+func driverMetricsEndpoint(pod *v1.Pod) (string, string, bool) {
+	for _, c := range pod.Spec.Containers {
+		if c.Name != driverContainerName {
+			continue
+		}
+		port, path := "", defaultMetricsPath
+		for _, arg := range c.Args {
+			if strings.HasPrefix(arg, "--http-endpoint=") {
+				endpoint := strings.TrimPrefix(arg, "--http-endpoint=")
+				port = endpoint[strings.LastIndex(endpoint, ":")+1:]
+			}
+			if strings.HasPrefix(arg, "--metrics-path=") {
+				path = strings.TrimPrefix(arg, "--metrics-path=")
+			}
+		}
+		return port, path, port != ""
+	}
+	return "", "", false
+}
+
+// sumMetric sums the samples of the counters, gauges and untyped metrics of
+// families that match mt. A missing metric sums to zero, as counters are
+// only exported once incremented.
+func sumMetric(families map[string]*dto.MetricFamily, mt metricThreshold) float64 {
+	family, ok := families[mt.name]
+	if !ok {
+		return 0
+	}
+	var sum float64
+	for _, m := range family.GetMetric() {
+		if !labelsMatch(m.GetLabel(), mt.labels) {
+			continue
+		}
+		switch {
+		case m.Counter != nil:
+			sum += m.GetCounter().GetValue()
+		case m.Gauge != nil:
+			sum += m.GetGauge().GetValue()
+		case m.Untyped != nil:
+			sum += m.GetUntyped().GetValue()
+		}
+	}
+	return sum
+}
+
+func labelsMatch(pairs []*dto.LabelPair, selector map[string]string) bool {
+	for k, v := range selector {
+		found := false
+		for _, pair := range pairs {
+			if pair.GetName() == k && pair.GetValue() == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestParseMetricThresholds(t *testing.T) {
+	testCases := []struct {
+		name          string
+		thresholds    string
+		expThresholds []metricThreshold
+		expectError   bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:       "names and labels",
+			thresholds: `attach_detach_failures_total{reason="internal", operation=attach}=5; go_goroutines=500`,
+			expThresholds: []metricThreshold{
+				{name: "attach_detach_failures_total", labels: map[string]string{"reason": "internal", "operation": "attach"}, max: 5},
+				{name: "go_goroutines", labels: map[string]string{}, max: 500},
+			},
+		},
+		{
+			name:        "missing max",
+			thresholds:  "go_goroutines",
+			expectError: true,
+		},
+		{
+			name:        "invalid max",
+			thresholds:  "go_goroutines=many",
+			expectError: true,
+		},
+		{
+			name:        "unterminated labels",
+			thresholds:  "go_goroutines{a=b=1",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		thresholds, err := parseMetricThresholds(tc.thresholds)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tc.name, thresholds)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(thresholds, tc.expThresholds) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, thresholds, tc.expThresholds)
+		}
+	}
+}
+
+func TestSumMetric(t *testing.T) {
+	data := `# TYPE attach_detach_failures_total counter
+attach_detach_failures_total{operation="attach",reason="internal"} 2
+attach_detach_failures_total{operation="detach",reason="internal"} 3
+attach_detach_failures_total{operation="attach",reason="not_found"} 7
+# TYPE go_goroutines gauge
+go_goroutines 42
+`
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse metrics: %v", err)
+	}
+	testCases := []struct {
+		threshold string
+		expSum    float64
+	}{
+		{threshold: `attach_detach_failures_total{reason="internal"}=0`, expSum: 5},
+		{threshold: `attach_detach_failures_total=0`, expSum: 12},
+		{threshold: `attach_detach_failures_total{reason="quota"}=0`, expSum: 0},
+		{threshold: `go_goroutines=0`, expSum: 42},
+		{threshold: `process_open_fds=0`, expSum: 0},
+	}
+	for _, tc := range testCases {
+		thresholds, err := parseMetricThresholds(tc.threshold)
+		if err != nil {
+			t.Fatalf("%s: failed to parse threshold: %v", tc.threshold, err)
+		}
+		if sum := sumMetric(families, thresholds[0]); sum != tc.expSum {
+			t.Errorf("%s: got sum %v, expected %v", tc.threshold, sum, tc.expSum)
+		}
+	}
+}
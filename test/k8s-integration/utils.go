@@ -5,6 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"k8s.io/klog"
 )
@@ -29,6 +32,53 @@ func runCommand(action string, cmd *exec.Cmd) error {
 	return nil
 }
 
+// snapshotFile saves the content of path and returns a function that writes
+// it back. The content is also written back if the runner is interrupted
+// before the function is called, so that a local run does not leave the
+// working tree modified.
+func snapshotFile(path string) (func(), error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	var once sync.Once
+	restoreFile := func() {
+		once.Do(func() {
+			if err := ioutil.WriteFile(path, content, info.Mode()); err != nil {
+				klog.Errorf("Failed to restore %s: %v", path, err)
+				return
+			}
+			klog.V(4).Infof("Restored %s", path)
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			restoreFile()
+			klog.Fatalf("Interrupted by %v", sig)
+		case <-done:
+		}
+	}()
+
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+		restoreFile()
+	}, nil
+}
+
 func generateUniqueTmpDir() string {
 	dir, err := ioutil.TempDir("", "gcp-pd-driver-tmp")
 	if err != nil {
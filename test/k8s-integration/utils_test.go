@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-file")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kustomization.yaml")
+	original := "images:\n- name: driver\n"
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	restore, err := snapshotFile(path)
+	if err != nil {
+		t.Fatalf("snapshotFile failed: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("images:\n- name: driver\n  newTag: test\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit file: %v", err)
+	}
+	restore()
+	// Restoring is idempotent, so that a later edit is kept.
+	if err := ioutil.WriteFile(path, []byte("edited"), 0644); err != nil {
+		t.Fatalf("Failed to edit file: %v", err)
+	}
+	restore()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "edited" {
+		t.Errorf("Expected only the first restore to write the file, got %q", content)
+	}
+
+	if _, err := snapshotFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("Expected error snapshotting a missing file")
+	}
+}
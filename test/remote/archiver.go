@@ -26,7 +26,7 @@ import (
 	"k8s.io/klog"
 )
 
-func CreateDriverArchive(archiveName, pkgPath, binPath string) (string, error) {
+func CreateDriverArchive(archiveName, pkgPath, binPath, arch string) (string, error) {
 	klog.V(2).Infof("Building archive...")
 	tarDir, err := ioutil.TempDir("", "driver-temp-archive")
 	if err != nil {
@@ -35,7 +35,11 @@ func CreateDriverArchive(archiveName, pkgPath, binPath string) (string, error) {
 	defer os.RemoveAll(tarDir)
 
 	// Call the suite function to setup the test package.
-	err = setupBinaries(tarDir, pkgPath, binPath)
+	if arch != "" {
+		err = crossCompileDriver(tarDir, pkgPath, binPath, arch)
+	} else {
+		err = setupBinaries(tarDir, pkgPath, binPath)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to setup test package %q: %v", tarDir, err)
 	}
@@ -53,6 +57,23 @@ func CreateDriverArchive(archiveName, pkgPath, binPath string) (string, error) {
 	return filepath.Join(dir, archiveName), nil
 }
 
+// crossCompileDriver builds the Linux driver for arch directly into tarDir,
+// named like binPath. It does not use make so that it does not overwrite the
+// binary that other instances use.
+func crossCompileDriver(tarDir, pkgPath, binPath, arch string) error {
+	klog.V(4).Infof("Cross-compiling driver for %s to temp dir...", arch)
+	cmd := exec.Command("go", "build", "-mod=vendor",
+		"-ldflags", fmt.Sprintf("-X main.version=%s", os.Getenv("GCE_PD_CSI_STAGING_VERSION")),
+		"-o", filepath.Join(tarDir, filepath.Base(binPath)),
+		"./cmd/gce-pd-csi-driver/")
+	cmd.Dir = pkgPath
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+arch, "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to build driver for %s at %s: %v: %v", arch, pkgPath, string(out), err)
+	}
+	return nil
+}
+
 func setupBinaries(tarDir, pkgPath, binPath string) error {
 	klog.V(4).Infof("Making binaries and copying to temp dir...")
 	out, err := exec.Command("make", "-C", pkgPath).CombinedOutput()
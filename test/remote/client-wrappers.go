@@ -52,6 +52,10 @@ var (
 	}
 )
 
+// DefaultCallTimeout bounds each CSI call made by a CsiClient. It is long
+// enough for attaches and regional disk creates, which take minutes at worst.
+const DefaultCallTimeout = 5 * time.Minute
+
 type CsiClient struct {
 	conn       *grpc.ClientConn
 	idClient   csipb.IdentityClient
@@ -59,10 +63,20 @@ type CsiClient struct {
 	ctrlClient csipb.ControllerClient
 
 	endpoint string
+
+	// Timeout bounds each CSI call. Zero means no timeout.
+	Timeout time.Duration
 }
 
 func CreateCSIClient(endpoint string) *CsiClient {
-	return &CsiClient{endpoint: endpoint}
+	return &CsiClient{endpoint: endpoint, Timeout: DefaultCallTimeout}
+}
+
+func (c *CsiClient) callContext() (context.Context, context.CancelFunc) {
+	if c.Timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), c.Timeout)
 }
 
 func (c *CsiClient) AssertCSIConnection() error {
@@ -112,11 +126,22 @@ func (c *CsiClient) CreateVolumeWithCaps(volName string, params map[string]strin
 	if topReq != nil {
 		cvr.AccessibilityRequirements = topReq
 	}
-	cresp, err := c.ctrlClient.CreateVolume(context.Background(), cvr)
+	vol, err := c.CreateVolumeFromRequest(cvr)
 	if err != nil {
 		return "", err
 	}
-	return cresp.GetVolume().GetVolumeId(), nil
+	return vol.GetVolumeId(), nil
+}
+
+// CreateVolumeFromRequest sends cvr as is and returns the created volume.
+func (c *CsiClient) CreateVolumeFromRequest(cvr *csipb.CreateVolumeRequest) (*csipb.Volume, error) {
+	ctx, cancel := c.callContext()
+	defer cancel()
+	cresp, err := c.ctrlClient.CreateVolume(ctx, cvr)
+	if err != nil {
+		return nil, err
+	}
+	return cresp.GetVolume(), nil
 }
 
 func (c *CsiClient) CreateVolume(volName string, params map[string]string, sizeInGb int64, topReq *csipb.TopologyRequirement) (string, error) {
@@ -127,7 +152,9 @@ func (c *CsiClient) DeleteVolume(volId string) error {
 	dvr := &csipb.DeleteVolumeRequest{
 		VolumeId: volId,
 	}
-	_, err := c.ctrlClient.DeleteVolume(context.Background(), dvr)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.ctrlClient.DeleteVolume(ctx, dvr)
 	return err
 }
 
@@ -138,12 +165,16 @@ func (c *CsiClient) ControllerPublishVolume(volId, nodeId string) error {
 		VolumeCapability: stdVolCap,
 		Readonly:         false,
 	}
-	_, err := c.ctrlClient.ControllerPublishVolume(context.Background(), cpreq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.ctrlClient.ControllerPublishVolume(ctx, cpreq)
 	return err
 }
 
 func (c *CsiClient) ListVolumes() (map[string]([]string), error) {
-	resp, err := c.ctrlClient.ListVolumes(context.Background(), &csipb.ListVolumesRequest{})
+	ctx, cancel := c.callContext()
+	defer cancel()
+	resp, err := c.ctrlClient.ListVolumes(ctx, &csipb.ListVolumesRequest{})
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +190,9 @@ func (c *CsiClient) ControllerUnpublishVolume(volId, nodeId string) error {
 		VolumeId: volId,
 		NodeId:   nodeId,
 	}
-	_, err := c.ctrlClient.ControllerUnpublishVolume(context.Background(), cupreq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.ctrlClient.ControllerUnpublishVolume(ctx, cupreq)
 	return err
 }
 
@@ -177,7 +210,9 @@ func (c *CsiClient) NodeStageVolume(volId, stageDir string, volumeCap *csipb.Vol
 		StagingTargetPath: stageDir,
 		VolumeCapability:  volumeCap,
 	}
-	_, err := c.nodeClient.NodeStageVolume(context.Background(), nodeStageReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.nodeClient.NodeStageVolume(ctx, nodeStageReq)
 	return err
 }
 
@@ -186,7 +221,9 @@ func (c *CsiClient) NodeUnstageVolume(volId, stageDir string) error {
 		VolumeId:          volId,
 		StagingTargetPath: stageDir,
 	}
-	_, err := c.nodeClient.NodeUnstageVolume(context.Background(), nodeUnstageReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.nodeClient.NodeUnstageVolume(ctx, nodeUnstageReq)
 	return err
 }
 
@@ -195,7 +232,9 @@ func (c *CsiClient) NodeUnpublishVolume(volumeID, publishDir string) error {
 		VolumeId:   volumeID,
 		TargetPath: publishDir,
 	}
-	_, err := c.nodeClient.NodeUnpublishVolume(context.Background(), nodeUnpublishReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.nodeClient.NodeUnpublishVolume(ctx, nodeUnpublishReq)
 	return err
 }
 
@@ -207,7 +246,9 @@ func (c *CsiClient) NodePublishVolume(volumeID, stageDir, publishDir string) err
 		VolumeCapability:  stdVolCap,
 		Readonly:          false,
 	}
-	_, err := c.nodeClient.NodePublishVolume(context.Background(), nodePublishReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.nodeClient.NodePublishVolume(ctx, nodePublishReq)
 	return err
 }
 
@@ -219,7 +260,9 @@ func (c *CsiClient) NodePublishBlockVolume(volumeID, stageDir, publishDir string
 		VolumeCapability:  blockVolCap,
 		Readonly:          false,
 	}
-	_, err := c.nodeClient.NodePublishVolume(context.Background(), nodePublishReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.nodeClient.NodePublishVolume(ctx, nodePublishReq)
 	return err
 }
 
@@ -230,28 +273,45 @@ func (c *CsiClient) ControllerExpandVolume(volumeID string, sizeGb int64) error
 			RequiredBytes: common.GbToBytes(sizeGb),
 		},
 	}
-	_, err := c.ctrlClient.ControllerExpandVolume(context.Background(), controllerExpandReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.ctrlClient.ControllerExpandVolume(ctx, controllerExpandReq)
 	return err
 }
 
 func (c *CsiClient) NodeExpandVolume(volumeID, volumePath string, sizeGb int64) (*csipb.NodeExpandVolumeResponse, error) {
+	return c.nodeExpandVolume(volumeID, volumePath, sizeGb, nil)
+}
+
+func (c *CsiClient) NodeExpandBlockVolume(volumeID, volumePath string, sizeGb int64) (*csipb.NodeExpandVolumeResponse, error) {
+	return c.nodeExpandVolume(volumeID, volumePath, sizeGb, blockVolCap)
+}
+
+func (c *CsiClient) nodeExpandVolume(volumeID, volumePath string, sizeGb int64, volumeCap *csipb.VolumeCapability) (*csipb.NodeExpandVolumeResponse, error) {
 	nodeExpandReq := &csipb.NodeExpandVolumeRequest{
 		VolumeId:   volumeID,
 		VolumePath: volumePath,
 		CapacityRange: &csipb.CapacityRange{
 			RequiredBytes: common.GbToBytes(sizeGb),
 		},
+		VolumeCapability: volumeCap,
 	}
-	return c.nodeClient.NodeExpandVolume(context.Background(), nodeExpandReq)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	return c.nodeClient.NodeExpandVolume(ctx, nodeExpandReq)
 }
 
 func (c *CsiClient) NodeGetInfo() (*csipb.NodeGetInfoResponse, error) {
-	resp, err := c.nodeClient.NodeGetInfo(context.Background(), &csipb.NodeGetInfoRequest{})
+	ctx, cancel := c.callContext()
+	defer cancel()
+	resp, err := c.nodeClient.NodeGetInfo(ctx, &csipb.NodeGetInfoRequest{})
 	return resp, err
 }
 
 func (c *CsiClient) NodeGetVolumeStats(volumeID, volumePath string) (available, capacity, used, inodesFree, inodes, inodesUsed int64, err error) {
-	resp, err := c.nodeClient.NodeGetVolumeStats(context.Background(), &csipb.NodeGetVolumeStatsRequest{
+	ctx, cancel := c.callContext()
+	defer cancel()
+	resp, err := c.nodeClient.NodeGetVolumeStats(ctx, &csipb.NodeGetVolumeStatsRequest{
 		VolumeId:   volumeID,
 		VolumePath: volumePath,
 	})
@@ -287,7 +347,9 @@ func (c *CsiClient) CreateSnapshot(snapshotName, sourceVolumeId string, params m
 		SourceVolumeId: sourceVolumeId,
 		Parameters:     params,
 	}
-	cresp, err := c.ctrlClient.CreateSnapshot(context.Background(), csr)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	cresp, err := c.ctrlClient.CreateSnapshot(ctx, csr)
 	if err != nil {
 		return "", err
 	}
@@ -298,6 +360,8 @@ func (c *CsiClient) DeleteSnapshot(snapshotID string) error {
 	dsr := &csipb.DeleteSnapshotRequest{
 		SnapshotId: snapshotID,
 	}
-	_, err := c.ctrlClient.DeleteSnapshot(context.Background(), dsr)
+	ctx, cancel := c.callContext()
+	defer cancel()
+	_, err := c.ctrlClient.DeleteSnapshot(ctx, dsr)
 	return err
 }
@@ -18,6 +18,7 @@ package remote
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -41,14 +42,38 @@ const (
 	defaultMachine      = "n1-standard-1"
 	defaultFirewallRule = "default-allow-ssh"
 
+	// Windows instances need more memory, and take longer to boot as they
+	// run sysprep and install the SSH server on first boot.
+	windowsMachine      = "n1-standard-4"
+	windowsImage        = "projects/windows-cloud/global/images/family/windows-2019-core"
+	windowsStartTimeout = 20 * time.Minute
+
 	// timestampFormat is the timestamp format used in the e2e directory name.
 	timestampFormat = "20060102T150405"
 )
 
+// InstanceConfig overrides the defaults used to create an instance, to test
+// on other machine families.
+type InstanceConfig struct {
+	// MachineType is the machine type, such as c3-standard-4.
+	MachineType string
+	// ImageURL is the boot image, which must match the architecture of the
+	// machine type.
+	ImageURL string
+	// GVNIC creates the network interface as gVNIC, which is the only
+	// interface third generation and Arm machine families support.
+	GVNIC bool
+}
+
 type InstanceInfo struct {
 	project string
 	zone    string
 	name    string
+	config  InstanceConfig
+
+	// windows is true for Windows Server instances, which are reached over
+	// OpenSSH and run commands with PowerShell.
+	windows bool
 
 	// External IP is filled in after instance creation
 	externalIP string
@@ -64,6 +89,11 @@ func (i *InstanceInfo) GetName() string {
 	return i.name
 }
 
+// IsWindows returns true if the instance runs Windows Server.
+func (i *InstanceInfo) IsWindows() bool {
+	return i.windows
+}
+
 func (i *InstanceInfo) GetNodeID() string {
 	return common.CreateNodeID(i.project, i.zone, i.name)
 }
@@ -92,9 +122,22 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 	}
 
 	imageURL := "projects/debian-cloud/global/images/family/debian-9"
+	machine := ""
+	startTimeout := 5 * time.Minute
+	if i.windows {
+		imageURL = windowsImage
+		machine = windowsMachine
+		startTimeout = windowsStartTimeout
+	}
+	if i.config.ImageURL != "" {
+		imageURL = i.config.ImageURL
+	}
+	if i.config.MachineType != "" {
+		machine = i.config.MachineType
+	}
 	inst := &compute.Instance{
 		Name:        i.name,
-		MachineType: machineType(i.zone, ""),
+		MachineType: machineType(i.zone, machine),
 		NetworkInterfaces: []*compute.NetworkInterface{
 			{
 				AccessConfigs: []*compute.AccessConfig{
@@ -131,25 +174,28 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 		}
 		inst.Metadata = meta
 	}
+	if i.windows {
+		if inst.Metadata == nil {
+			inst.Metadata = &compute.Metadata{}
+		}
+		inst.Metadata.Items = append(inst.Metadata.Items, windowsSSHMetadata()...)
+	}
 
 	if _, err := i.computeService.Instances.Get(i.project, i.zone, inst.Name).Do(); err != nil {
-		op, err := i.computeService.Instances.Insert(i.project, i.zone, inst).Do()
-		klog.V(4).Infof("Inserted instance %v in project: %v, zone: %v", inst.Name, i.project, i.zone)
+		if i.config.GVNIC {
+			err = i.insertGVNICInstance(inst)
+		} else {
+			err = i.insertInstance(inst)
+		}
 		if err != nil {
-			ret := fmt.Sprintf("could not create instance %s: API error: %v", i.name, err)
-			if op != nil {
-				ret = fmt.Sprintf("%s. op error: %v", ret, op.Error)
-			}
-			return errors.New(ret)
-		} else if op.Error != nil {
-			return fmt.Errorf("could not create instance %s: %+v", i.name, op.Error)
+			return err
 		}
 	} else {
 		klog.V(4).Infof("Compute service GOT instance %v, skipping instance creation", inst.Name)
 	}
 
 	then := time.Now()
-	err = wait.Poll(15*time.Second, 5*time.Minute, func() (bool, error) {
+	err = wait.Poll(15*time.Second, startTimeout, func() (bool, error) {
 		klog.V(2).Infof("Waiting for instance %v to come up. %v elapsed", i.name, time.Since(then))
 
 		instance, err = i.computeService.Instances.Get(i.project, i.zone, i.name).Do()
@@ -187,6 +233,54 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 	return nil
 }
 
+func (i *InstanceInfo) insertInstance(inst *compute.Instance) error {
+	op, err := i.computeService.Instances.Insert(i.project, i.zone, inst).Do()
+	klog.V(4).Infof("Inserted instance %v in project: %v, zone: %v", inst.Name, i.project, i.zone)
+	if err != nil {
+		ret := fmt.Sprintf("could not create instance %s: API error: %v", i.name, err)
+		if op != nil {
+			ret = fmt.Sprintf("%s. op error: %v", ret, op.Error)
+		}
+		return errors.New(ret)
+	} else if op.Error != nil {
+		return fmt.Errorf("could not create instance %s: %+v", i.name, op.Error)
+	}
+	return nil
+}
+
+// insertGVNICInstance inserts inst with gVNIC network interfaces. The v1 API
+// has no NIC type, so the instance is inserted through the alpha API.
+func (i *InstanceInfo) insertGVNICInstance(inst *compute.Instance) error {
+	alphaService, err := GetComputeAlphaClient()
+	if err != nil {
+		return fmt.Errorf("could not get alpha compute client to create instance %s: %v", i.name, err)
+	}
+	data, err := inst.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("could not convert instance %s to alpha: %v", i.name, err)
+	}
+	alphaInst := &computealpha.Instance{}
+	if err := json.Unmarshal(data, alphaInst); err != nil {
+		return fmt.Errorf("could not convert instance %s to alpha: %v", i.name, err)
+	}
+	for _, ni := range alphaInst.NetworkInterfaces {
+		ni.NicType = "GVNIC"
+	}
+
+	op, err := alphaService.Instances.Insert(i.project, i.zone, alphaInst).Do()
+	klog.V(4).Infof("Inserted gVNIC instance %v in project: %v, zone: %v", inst.Name, i.project, i.zone)
+	if err != nil {
+		ret := fmt.Sprintf("could not create instance %s: API error: %v", i.name, err)
+		if op != nil {
+			ret = fmt.Sprintf("%s. op error: %v", ret, op.Error)
+		}
+		return errors.New(ret)
+	} else if op.Error != nil {
+		return fmt.Errorf("could not create instance %s: %+v", i.name, op.Error)
+	}
+	return nil
+}
+
 func (i *InstanceInfo) DeleteInstance() {
 	klog.V(4).Infof("Deleting instance %q", i.name)
 	_, err := i.computeService.Instances.Delete(i.project, i.zone, i.name).Do()
@@ -337,6 +431,23 @@ func generateMetadataWithPublicKey(pubKeyFile string) (*compute.Metadata, error)
 	return newMeta, nil
 }
 
+// windowsSSHMetadata returns the metadata that installs and enables the
+// OpenSSH server on a Windows instance, which is what the tests connect to.
+func windowsSSHMetadata() []*compute.MetadataItems {
+	enable := "TRUE"
+	install := "googet -noconfirm=true install google-compute-engine-ssh"
+	return []*compute.MetadataItems{
+		{
+			Key:   "enable-windows-ssh",
+			Value: &enable,
+		},
+		{
+			Key:   "sysprep-specialize-script-cmd",
+			Value: &install,
+		},
+	}
+}
+
 // isGCEError returns true if given error is a googleapi.Error with given
 // reason (e.g. "resourceInUseByAnotherResource")
 func isGCEError(err error, reason string) bool {
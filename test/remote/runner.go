@@ -88,6 +88,78 @@ func (i *InstanceInfo) UploadAndRun(archivePath, remoteWorkspace, driverRunCmd s
 	return driverPID, nil
 }
 
+// UploadAndRunWindows is UploadAndRun for Windows instances. It also
+// downloads csi-proxy from csiProxyURL and starts it before the driver, as
+// the driver does all its disk and volume operations through it. It returns
+// the PIDs of the driver and of csi-proxy.
+func (i *InstanceInfo) UploadAndRunWindows(archivePath, remoteWorkspace, driverRunCmd, csiProxyURL string) (int, int, error) {
+	klog.V(4).Infof("Staging test binaries on %q", i.name)
+	if output, err := i.PowerShell(fmt.Sprintf("New-Item -ItemType Directory -Force -Path '%s'", remoteWorkspace)); err != nil {
+		return -1, -1, fmt.Errorf("failed to create remoteWorkspace directory %q on i.name %q: %v output: %q", remoteWorkspace, i.name, err, output)
+	}
+
+	// scp to Windows OpenSSH takes forward slashes.
+	if output, err := runSSHCommand("scp", archivePath, fmt.Sprintf("%s:%s/", i.GetSSHTarget(), strings.Replace(remoteWorkspace, `\`, "/", -1))); err != nil {
+		return -1, -1, fmt.Errorf("failed to copy test archive: %v, output: %q", err, output)
+	}
+
+	archiveName := path.Base(archivePath)
+	klog.V(4).Infof("Extracting tar on %q", i.name)
+	if output, err := i.PowerShell(fmt.Sprintf("tar -xzf '%s\\%s' -C '%s'", remoteWorkspace, archiveName, remoteWorkspace)); err != nil {
+		return -1, -1, fmt.Errorf("failed to extract test archive: %v, output: %q", err, output)
+	}
+
+	klog.V(4).Infof("Starting csi-proxy on %q", i.name)
+	csiProxyPath := remoteWorkspace + `\csi-proxy.exe`
+	if output, err := i.PowerShell(fmt.Sprintf("Invoke-WebRequest -UseBasicParsing -Uri '%s' -OutFile '%s'", csiProxyURL, csiProxyPath)); err != nil {
+		return -1, -1, fmt.Errorf("failed to download csi-proxy from %s: %v, output: %q", csiProxyURL, err, output)
+	}
+	csiProxyPID, err := i.startWindowsProcess(fmt.Sprintf(`cmd /c %s 2> %s\csi-proxy.out`, csiProxyPath, remoteWorkspace))
+	if err != nil {
+		return -1, -1, fmt.Errorf("failed to start csi-proxy: %v", err)
+	}
+
+	klog.V(4).Infof("Starting driver on %q", i.name)
+	driverPID, err := i.startWindowsProcess(driverRunCmd)
+	if err != nil {
+		return -1, csiProxyPID, fmt.Errorf("failed to start driver: %v", err)
+	}
+	return driverPID, csiProxyPID, nil
+}
+
+// startWindowsProcess starts cmdLine on a Windows instance and returns its
+// PID. The process is created through WMI rather than by the SSH session, as
+// Windows OpenSSH kills the processes of a session when it ends.
+func (i *InstanceInfo) startWindowsProcess(cmdLine string) (int, error) {
+	script := fmt.Sprintf(
+		"$p = Invoke-WmiMethod -Class Win32_Process -Name Create -ArgumentList '%s'; if ($p.ReturnValue -ne 0) { exit $p.ReturnValue }; $p.ProcessId",
+		strings.Replace(cmdLine, "'", "''", -1))
+	output, err := i.PowerShell(script)
+	if err != nil {
+		return -1, fmt.Errorf("failed to run %q, got output: %v, error: %v", cmdLine, output, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return -1, fmt.Errorf("failed to convert PID from string %s to int: %v", output, err)
+	}
+	return pid, nil
+}
+
+// KillWindowsProcess kills the process with pid on a Windows instance, along
+// with its children.
+func (i *InstanceInfo) KillWindowsProcess(pid int) error {
+	output, err := i.SSH("taskkill", "/PID", strconv.Itoa(pid), "/T", "/F")
+	if err != nil {
+		return fmt.Errorf("failed to kill process %d, got output %s: %v", pid, output, err)
+	}
+	return nil
+}
+
 func NewWorkspaceDir(workspaceDirPrefix string) string {
 	return filepath.Join("/tmp", workspaceDirPrefix+getTimestamp())
 }
+
+// NewWindowsWorkspaceDir is NewWorkspaceDir for Windows instances.
+func NewWindowsWorkspaceDir(workspaceDirPrefix string) string {
+	return `C:\` + workspaceDirPrefix + getTimestamp()
+}
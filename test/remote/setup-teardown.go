@@ -46,11 +46,18 @@ type ClientConfig struct {
 	RunDriverCmd string
 	// Port to use as SSH tunnel on both remote and local side.
 	Port string
+	// URL of the csi-proxy binary to run alongside the driver. Only used
+	// for Windows instances.
+	CSIProxyURL string
+	// Arch, if set, is the GOARCH to cross-compile the Linux driver for,
+	// such as arm64, instead of building it with make.
+	Arch string
 }
 
 type processes struct {
-	sshTunnel    int
-	remoteDriver int
+	sshTunnel      int
+	remoteDriver   int
+	remoteCSIProxy int
 }
 
 // SetupInstance sets up the specified GCE Instance for E2E testing and returns a handle to the instance object for future use.
@@ -68,12 +75,43 @@ func SetupInstance(instanceProject, instanceZone, instanceName, instanceServiceA
 	return instance, nil
 }
 
+// SetupInstanceWithConfig is SetupInstance for an instance created with config
+// rather than the default machine type and image.
+func SetupInstanceWithConfig(instanceProject, instanceZone, instanceName, instanceServiceAccount string, config InstanceConfig, cs *compute.Service) (*InstanceInfo, error) {
+	instance, err := CreateInstanceInfo(instanceProject, instanceZone, instanceName, cs)
+	if err != nil {
+		return nil, err
+	}
+	instance.config = config
+
+	err = instance.CreateOrGetInstance(instanceServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// SetupWindowsInstance is SetupInstance for a Windows Server instance.
+func SetupWindowsInstance(instanceProject, instanceZone, instanceName, instanceServiceAccount string, cs *compute.Service) (*InstanceInfo, error) {
+	instance, err := CreateInstanceInfo(instanceProject, instanceZone, instanceName, cs)
+	if err != nil {
+		return nil, err
+	}
+	instance.windows = true
+
+	err = instance.CreateOrGetInstance(instanceServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
 // SetupNewDriverAndClient gets the driver binary, runs it on the provided instance and connects
 // a CSI client to it through SHH tunnelling. It returns a TestContext with both a handle to the instance
 // that the driver is on and the CSI Client object to make CSI calls to the remote driver.
 func SetupNewDriverAndClient(instance *InstanceInfo, config *ClientConfig) (*TestContext, error) {
 	archiveName := fmt.Sprintf("e2e_driver_binaries_%s.tar.gz", uuid.NewUUID())
-	archivePath, err := CreateDriverArchive(archiveName, config.PkgPath, config.BinPath)
+	archivePath, err := CreateDriverArchive(archiveName, config.PkgPath, config.BinPath, config.Arch)
 	if err != nil {
 		return nil, err
 	}
@@ -85,7 +123,12 @@ func SetupNewDriverAndClient(instance *InstanceInfo, config *ClientConfig) (*Tes
 	}()
 
 	// Upload archive to instance and run binaries
-	driverPID, err := instance.UploadAndRun(archivePath, config.WorkspaceDir, config.RunDriverCmd)
+	var driverPID, csiProxyPID int
+	if instance.windows {
+		driverPID, csiProxyPID, err = instance.UploadAndRunWindows(archivePath, config.WorkspaceDir, config.RunDriverCmd, config.CSIProxyURL)
+	} else {
+		driverPID, err = instance.UploadAndRun(archivePath, config.WorkspaceDir, config.RunDriverCmd)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -106,8 +149,9 @@ func SetupNewDriverAndClient(instance *InstanceInfo, config *ClientConfig) (*Tes
 		Instance: instance,
 		Client:   client,
 		proc: &processes{
-			sshTunnel:    sshPID,
-			remoteDriver: driverPID,
+			sshTunnel:      sshPID,
+			remoteDriver:   driverPID,
+			remoteCSIProxy: csiProxyPID,
 		},
 	}, nil
 }
@@ -129,6 +173,16 @@ func TeardownDriverAndClient(context *TestContext) error {
 		return fmt.Errorf("failed to kill ssh tunnel process %v: %v", context.proc.sshTunnel, err)
 	}
 
+	if context.Instance.windows {
+		if err := context.Instance.KillWindowsProcess(context.proc.remoteDriver); err != nil {
+			return fmt.Errorf("failed to kill driver on remote instance: %v", err)
+		}
+		if err := context.Instance.KillWindowsProcess(context.proc.remoteCSIProxy); err != nil {
+			return fmt.Errorf("failed to kill csi-proxy on remote instance: %v", err)
+		}
+		return nil
+	}
+
 	// Kill the driver process on remote
 	cmd := fmt.Sprintf("kill %v", context.proc.remoteDriver)
 	output, err := context.Instance.SSH(cmd)
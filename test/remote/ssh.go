@@ -17,11 +17,14 @@ limitations under the License.
 package remote
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
 	"strings"
+	"unicode/utf16"
 
 	"k8s.io/klog"
 )
@@ -59,7 +62,11 @@ func getSSHCommand(sep string, args ...string) string {
 
 // SSH executes ssh command with runSSHCommand as root. The `sudo` makes sure that all commands
 // are executed by root, so that there won't be permission mismatch between different commands.
+// On Windows the SSH user is already an administrator and there is no sudo.
 func (i *InstanceInfo) SSH(cmd ...string) (string, error) {
+	if i.windows {
+		return i.SSHNoSudo(cmd...)
+	}
 	return runSSHCommand("ssh", append([]string{i.GetSSHTarget(), "--", "sudo"}, cmd...)...)
 }
 
@@ -87,6 +94,23 @@ func (i *InstanceInfo) SSHNoSudo(cmd ...string) (string, error) {
 	return runSSHCommand("ssh", append([]string{i.GetSSHTarget(), "--"}, cmd...)...)
 }
 
+// PowerShell runs script with PowerShell on a Windows instance. The script is
+// sent encoded, so it needs no quoting for ssh or cmd.exe.
+func (i *InstanceInfo) PowerShell(script string) (string, error) {
+	return i.SSHNoSudo("powershell", "-NoProfile", "-NonInteractive", "-EncodedCommand", encodePowerShell(script))
+}
+
+// encodePowerShell encodes script for powershell -EncodedCommand, which
+// takes base64 of the UTF-16LE script.
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
 // SSHCheckAlive just pings the server quickly to check whether it is reachable by SSH
 func (i *InstanceInfo) SSHCheckAlive() (string, error) {
 	return runSSHCommand("ssh", []string{i.GetSSHTarget(), "-o", "ConnectTimeout=10", "--", "echo"}...)